@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/contrib/snapshotservice"
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/containerd/imgcrypt/images/encryption/atrest"
+	"google.golang.org/grpc"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	Usage = "ctd-atrest-snapshotter is a containerd proxy snapshotter keeping unpacked layers encrypted at rest"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "ctd-atrest-snapshotter"
+	app.Usage = Usage
+	app.Action = run
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "Root directory of the snapshots; it is protected with the key when it is empty",
+			Value: "/var/lib/imgcrypt/atrest-snapshotter",
+		},
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "Unix socket to serve the snapshotter on, the address of the proxy plugin in the containerd configuration",
+			Value: "/run/imgcrypt/atrest-snapshotter.sock",
+		},
+		cli.StringFlag{
+			Name:  "key-file",
+			Usage: "File holding the secret the key of the root directory is derived from",
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	if context.String("key-file") == "" {
+		return errors.New("the secret of the key must be given with --key-file")
+	}
+	secret, err := os.ReadFile(context.String("key-file"))
+	if err != nil {
+		return err
+	}
+	key := atrest.KeyFromSecret(secret)
+	for i := range secret {
+		secret[i] = 0
+	}
+
+	root := context.String("root")
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return err
+	}
+	// protects a new root and adds the key of an existing one
+	if _, err := atrest.Setup(root, key); err != nil {
+		return err
+	}
+	sn, err := overlay.NewSnapshotter(root, overlay.AsynchronousRemove)
+	if err != nil {
+		return err
+	}
+	sn = atrest.NewSnapshotter(sn, root, key)
+	defer sn.Close()
+
+	address := context.String("address")
+	if err := os.MkdirAll(filepath.Dir(address), 0o700); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(address); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", address, err)
+	}
+	defer os.Remove(address)
+
+	srv := grpc.NewServer()
+	snapshotsapi.RegisterSnapshotsServer(srv, snapshotservice.FromSnapshotter(sn))
+
+	ctx, cancel := signal.NotifyContext(gocontext.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	return srv.Serve(l)
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+)
+
+// auditUnwrap records the result of unwrapping the key of the layer in the
+// payload in the namespace the decoder is configured for
+func auditUnwrap(target, namespace string, payload *imgcrypt.Payload, layers []attempts.Layer, err error) error {
+	var sink interface {
+		audit.Sink
+		Close() error
+	}
+	var serr error
+	if target == "syslog" {
+		sink, serr = audit.NewSyslogSink("ctd-decoder")
+	} else {
+		sink, serr = audit.NewFileSink(target)
+	}
+	if serr != nil {
+		return serr
+	}
+	defer sink.Close()
+
+	ctx := context.Background()
+	if namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, namespace)
+	}
+	audit.Emit(audit.WithSink(ctx, sink), unwrapRecord(payload, layers), err)
+	return nil
+}
+
+// unwrapRecord returns the audit record of unwrapping the key of the layer in
+// the payload; once the key is unwrapped only the scheme and the recipient
+// whose key unwrapped it are recorded, not every recipient of the layer
+func unwrapRecord(payload *imgcrypt.Payload, layers []attempts.Layer) audit.Record {
+	rec := audit.Record{
+		Operation: audit.OpUnwrap,
+		Layer:     payload.Descriptor.Digest,
+		Tenant:    payload.Tenant(),
+	}
+	for _, l := range layers {
+		if a, ok := l.UnwrappedBy(); ok {
+			rec.Schemes = []string{a.Scheme}
+			if a.Recipient != "" {
+				// threshold schemes are unwrapped by the keys of several shares
+				rec.Recipients = strings.Split(a.Recipient, ",")
+			}
+			return rec
+		}
+	}
+	if li, err := encryption.GetLayerInfo(0, payload.Descriptor, nil); err == nil {
+		rec.Schemes = li.Schemes()
+	}
+	return rec
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestUnwrapRecord(t *testing.T) {
+	payload := &imgcrypt.Payload{}
+	payload.Descriptor.Digest = digest.FromString("layer")
+
+	layers := []attempts.Layer{{
+		Digest:    payload.Descriptor.Digest,
+		Unwrapped: true,
+		Attempts: []attempts.Attempt{
+			{Scheme: "jwe", Reason: attempts.ReasonNoKey},
+			{Scheme: "threshold", Reason: attempts.ReasonUnwrapped, Recipient: "a,b"},
+		},
+	}}
+	rec := unwrapRecord(payload, layers)
+	if rec.Layer != payload.Descriptor.Digest {
+		t.Fatalf("expected layer %s, got %s", payload.Descriptor.Digest, rec.Layer)
+	}
+	if !reflect.DeepEqual(rec.Schemes, []string{"threshold"}) {
+		t.Fatalf("expected the scheme that unwrapped the key, got %v", rec.Schemes)
+	}
+	if !reflect.DeepEqual(rec.Recipients, []string{"a", "b"}) {
+		t.Fatalf("expected the recipients whose keys unwrapped the key, got %v", rec.Recipients)
+	}
+
+	layers[0].Unwrapped = false
+	layers[0].Attempts = layers[0].Attempts[:1]
+	if rec := unwrapRecord(payload, layers); len(rec.Recipients) != 0 {
+		t.Fatalf("expected no recipients if the key was not unwrapped, got %v", rec.Recipients)
+	}
+}
@@ -17,63 +17,52 @@
 package main
 
 import (
-	b64 "encoding/base64"
-	"errors"
+	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
 
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keydir"
 	encconfig "github.com/gobars/ocicrypt/config"
-	cryptUtils "github.com/gobars/ocicrypt/utils"
 )
 
-// getDecryptionKeys reads the keys from the given directory
-func getDecryptionKeys(keysPath string) (encconfig.CryptoConfig, error) {
-	var cc encconfig.CryptoConfig
-
-	base64Keys := make([]string, 0)
-
-	walkFn := func(path string, info os.FileInfo, err error) error {
-
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		// Handle symlinks
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			return errors.New("Symbolic links not supported in decryption keys paths")
-		}
-
-		privateKey, err := os.ReadFile(path)
-		if err != nil {
-			return err
+// getNamespaceDecryptionKeys reads the keys of the given namespace from its subdirectory
+// of keysRoot; nil is returned if the namespace has no keys
+func getNamespaceDecryptionKeys(keysRoot, namespace string) (*encconfig.CryptoConfig, error) {
+	dir, err := encryption.NamespaceKeysDir(keysRoot, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-
-		// TODO - Remove the need to covert to base64. The ocicrypt library
-		// should provide a method to directly process the private keys
-		sEnc := b64.StdEncoding.EncodeToString(privateKey)
-		base64Keys = append(base64Keys, sEnc)
-
-		return nil
+		return nil, err
 	}
-
-	err := filepath.Walk(keysPath, walkFn)
+	cc, err := keydir.Load(dir)
 	if err != nil {
-		return cc, err
+		return nil, err
 	}
+	return &cc, nil
+}
 
-	sortedDc, err := cryptUtils.SortDecryptionKeys(strings.Join(base64Keys, ","))
+// getTenantDecryptionKeys reads the keys of the given tenant from its
+// subdirectory of keysRoot, which must exist
+func getTenantDecryptionKeys(keysRoot, tenant string) (*encconfig.CryptoConfig, error) {
+	dir, err := encryption.TenantKeysDir(keysRoot, tenant)
 	if err != nil {
-		return cc, err
+		return nil, err
 	}
-
-	cc = encconfig.InitDecryption(sortedDc)
-
-	return cc, nil
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no keys are configured for tenant %s", tenant)
+		}
+		return nil, err
+	}
+	cc, err := keydir.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &cc, nil
 }
 
 func combineDecryptionConfigs(dc1, dc2 *encconfig.DecryptConfig) *encconfig.DecryptConfig {
@@ -17,17 +17,49 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"syscall"
+	"time"
 
+	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/imgcrypt"
 	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/bufpool"
+	"github.com/containerd/imgcrypt/images/encryption/enclave"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/gpgagent"
+	"github.com/containerd/imgcrypt/images/encryption/keydir"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/keyusage"
+	"github.com/containerd/imgcrypt/images/encryption/kmip"
+	"github.com/containerd/imgcrypt/images/encryption/lockfile"
+	"github.com/containerd/imgcrypt/images/encryption/membudget"
+	"github.com/containerd/imgcrypt/images/encryption/metrics"
+	"github.com/containerd/imgcrypt/images/encryption/pkcs11pool"
+	"github.com/containerd/imgcrypt/images/encryption/sandbox"
+	"github.com/containerd/imgcrypt/images/encryption/scratch"
+	"github.com/containerd/imgcrypt/images/encryption/securemem"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
+	"github.com/containerd/imgcrypt/images/encryption/status"
+	"github.com/containerd/imgcrypt/images/encryption/timelock"
+	"github.com/containerd/imgcrypt/images/encryption/uniformunwrap"
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	"github.com/containerd/imgcrypt/images/encryption/unwraporder"
 	"github.com/containerd/typeurl"
+	encconfig "github.com/gobars/ocicrypt/config"
 
+	units "github.com/docker/go-units"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -44,6 +76,140 @@ func main() {
 			Name:  "decryption-keys-path",
 			Usage: "Path to load decryption keys from. (optional)",
 		},
+		cli.StringFlag{
+			Name:  "namespace-keys-path",
+			Usage: "Path with per-namespace subdirectories to load decryption keys from; only the keys of the namespace given with --namespace are used. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "policy",
+			Usage: "Authorization policy whose rules for all images (match \"*\") every layer in the namespace of --namespace must comply with; plaintext layers are checked if the decoder is also registered for their media types. (optional)",
+		},
+		cli.BoolFlag{
+			Name:  "decompress",
+			Usage: "Write decrypted layers uncompressed, for stream processors that return application/vnd.oci.image.layer.v1.tar. (optional)",
+		},
+		cli.StringFlag{
+			Name:   "namespace",
+			Usage:  "The containerd namespace this decoder serves, set in the env of the stream processor configuration; it selects the keys of --namespace-keys-path and is recorded in the audit log. (optional)",
+			EnvVar: "IMGCRYPT_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:  "tenant-keys-path",
+			Usage: "Path with per-tenant subdirectories of decryption keys; layers requested for a tenant are only decrypted with the keys of the tenant and not with those of --decryption-keys-path and --namespace-keys-path. The tenant is named by the unauthenticated client, so this selects keys but does not isolate tenants. (optional)",
+		},
+		cli.StringSliceFlag{
+			Name:  "verify-key",
+			Usage: "Public key the cosign signature of the image must be made with; layers of images without a valid signature in the payload are not decrypted. (optional)",
+		},
+		cli.StringSliceFlag{
+			Name:  "enclave",
+			Usage: "Address of an enclave helper holding a private key to unwrap JWE wrapped layer keys with, as unix://<path> or tcp://<host:port>. (optional)",
+		},
+		cli.BoolFlag{
+			Name:  "gpg-agent",
+			Usage: "Have gpg-agent unwrap PGP wrapped layer keys, e.g. with a key held on an OpenPGP smartcard; the key must be usable without entering a PIN or the PIN must be cached. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "gpg-homedir",
+			Usage: "GnuPG home directory of the gpg-agent used with --gpg-agent; by default ~/.gnupg. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "gpg-passphrase-source",
+			Usage: "Passphrase of the PGP key given to the gpg-agent used with --gpg-agent through loopback pinentry, read from file:<path> or env:<variable>. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "kmip-config",
+			Usage: "JSON configuration for connecting to KMIP servers to unwrap the keys of kmip recipients with. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "timelock-config",
+			Usage: "JSON configuration for connecting to the time-lock services of timelock recipients. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "pkcs11-config",
+			Usage: "ocicrypt configuration whose pkcs11 section restricts the PKCS#11 modules that may be loaded, with optional SHA-256 digests of them; it replaces the pkcs11 configuration passed by clients. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "key-usage-policy",
+			Usage: "Policy with validity windows and revocations of decryption keys; expired and revoked keys are not used. (optional)",
+		},
+		cli.BoolFlag{
+			Name:  "fips",
+			Usage: "Only decrypt layers encrypted with FIPS approved algorithms; also enabled by IMGCRYPT_FIPS=true. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "algorithm-policy",
+			Usage: "Policy restricting the wrap schemes, RSA key sizes, curves and ciphers of layers that are decrypted. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "unwrap-order",
+			Usage: "File setting the order in which the wrap schemes of layer keys are tried. (optional)",
+		},
+		cli.DurationFlag{
+			Name:  "unwrap-min-duration",
+			Usage: "Minimum time an attempt to unwrap a JWE or PKCS#7 wrapped layer key takes, successful or not, so that its duration does not tell which private key matched; 0 disables the padding.",
+			Value: 50 * time.Millisecond,
+		},
+		cli.StringFlag{
+			Name:  "unwrap-limits",
+			Usage: "File limiting the failed attempts to use the PINs of PKCS#11 tokens and the passphrases of private keys; by default 2 wrong PINs per token within an hour and 5 wrong passphrases per key within 15 minutes are tried. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "unwrap-failures-file",
+			Usage: "File shared by the decoders to count the failed attempts to use PINs and passphrases in.",
+			Value: filepath.Join(stateDir, "unwrap-failures.json"),
+		},
+		cli.StringFlag{
+			Name:  "metrics-textfile",
+			Usage: "File in the directory of the textfile collector of the Prometheus node exporter to add decryption metrics to. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "status-file",
+			Usage: "File shared by the decoders to record when layers were decrypted and why decryptions failed in, for the status served by imgcrypt-agent --status-socket. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "File to append audit records of key unwrapping to, or \"syslog\". (optional)",
+		},
+		cli.StringFlag{
+			Name:  "memory-limit",
+			Usage: "Memory that the decoders decrypting layers concurrently may use together, e.g. 512MiB; layers whose decryption does not fit wait for others to finish. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "memory-per-layer",
+			Usage: "Memory reserved from --memory-limit for the decryption of a layer.",
+			Value: units.BytesSize(membudget.DefaultReservation),
+		},
+		cli.DurationFlag{
+			Name:  "memory-wait",
+			Usage: "How long to wait for memory to be released if --memory-limit is reached before failing the decryption; 0 fails it immediately.",
+			Value: time.Minute,
+		},
+		cli.StringFlag{
+			Name:  "memory-budget-file",
+			Usage: "File shared by the decoders to reserve memory from --memory-limit in.",
+			Value: filepath.Join(stateDir, "memory-budget.json"),
+		},
+		cli.StringFlag{
+			Name:  "scratch-dir",
+			Usage: "Directory, such as a tmpfs, to create the private directory for temporary files of the decryption in; it is removed when the decryption ends. (optional)",
+		},
+		cli.StringFlag{
+			Name:  "scratch-limit",
+			Usage: "Size the temporary files of the decryption may have together, e.g. 16MiB; the decryption fails if it is exceeded. (optional)",
+		},
+		cli.BoolFlag{
+			Name:  "no-sandbox",
+			Usage: "Do not restrict the decoder with a seccomp filter and a Landlock ruleset and do not drop its capabilities before the layer is decrypted, such as for debugging. (optional)",
+		},
+		cli.StringSliceFlag{
+			Name:  "sandbox-writable",
+			Usage: "File or directory the sandboxed decoder and the programs it runs, such as keyprovider commands or PKCS#11 modules, may write to in addition to those it writes to itself. (optional)",
+		},
+		cli.BoolFlag{
+			Name:  "scratch-no-disk",
+			Usage: "Refuse to decrypt unless the directory for temporary files is on a memory-backed file system; --scratch-dir defaults to " + scratch.DefaultMemoryDir + ". (optional)",
+		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
@@ -51,8 +217,45 @@ func main() {
 	}
 }
 
+// stateDir is the directory of the files shared by the decoders by default;
+// it is created for root only, so that other users cannot forge the files
+const stateDir = "/run/imgcrypt"
+
+// stateFiles returns the files shared by the decoders that the decoder
+// updates
+func stateFiles(ctx *cli.Context) []string {
+	files := []string{ctx.GlobalString("unwrap-failures-file")}
+	if ctx.GlobalIsSet("memory-limit") {
+		files = append(files, ctx.GlobalString("memory-budget-file"))
+	}
+	if path := ctx.GlobalString("status-file"); path != "" {
+		files = append(files, path)
+	}
+	return files
+}
+
+// checkStateFiles creates the directories of the shared files and checks
+// that no other user can plant or replace the files
+func checkStateFiles(ctx *cli.Context) error {
+	for _, path := range stateFiles(ctx) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		if err := lockfile.Check(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func run(ctx *cli.Context) error {
-	if err := decrypt(ctx); err != nil {
+	err := decrypt(ctx)
+	if path := ctx.GlobalString("metrics-textfile"); path != "" {
+		if merr := metrics.UpdateTextfile(path); merr != nil {
+			fmt.Fprintf(os.Stderr, "could not update metrics: %s\n", merr)
+		}
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 		return err
@@ -61,39 +264,347 @@ func run(ctx *cli.Context) error {
 }
 
 func decrypt(ctx *cli.Context) error {
+	if mediaType, ok := isPlaintextLayer(); ok {
+		return passPlaintext(ctx, mediaType)
+	}
+
+	var space *scratch.Space
 	payload, err := getPayload()
 	if err != nil {
 		return err
 	}
 
+	if ctx.GlobalIsSet("scratch-dir") || ctx.GlobalIsSet("scratch-limit") || ctx.GlobalBool("scratch-no-disk") {
+		s, err := newScratchSpace(ctx)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		defer removeOnSignal(s)()
+		space = s
+	}
+
+	if ctx.GlobalBool("fips") {
+		fips.Enable()
+	}
+
+	if ctx.GlobalIsSet("algorithm-policy") {
+		p, err := algpolicy.Load(ctx.GlobalString("algorithm-policy"))
+		if err != nil {
+			return err
+		}
+		algpolicy.Set(p)
+	}
+
+	if ctx.GlobalIsSet("unwrap-order") {
+		o, err := unwraporder.Load(ctx.GlobalString("unwrap-order"))
+		if err != nil {
+			return err
+		}
+		unwraporder.Set(o)
+	}
+	uniformunwrap.Set(ctx.GlobalDuration("unwrap-min-duration"))
+
+	if err := checkStateFiles(ctx); err != nil {
+		return err
+	}
+
+	limits := unwraplimit.DefaultLimits
+	if ctx.GlobalIsSet("unwrap-limits") {
+		l, err := unwraplimit.Load(ctx.GlobalString("unwrap-limits"))
+		if err != nil {
+			return err
+		}
+		limits = *l
+	}
+	limits.StateFile = ctx.GlobalString("unwrap-failures-file")
+	unwraplimit.Set(&limits)
+
+	if path := ctx.GlobalString("status-file"); path != "" {
+		status.Set(&status.Tracker{Path: path})
+	}
+
+	if ctx.GlobalIsSet("verify-key") {
+		keys, err := signature.LoadCosignKeys(ctx.GlobalStringSlice("verify-key"))
+		if err != nil {
+			return err
+		}
+		payload.Descriptor, err = signature.VerifyPayload(keys, payload)
+		if err != nil {
+			return fmt.Errorf("image verification failed: %w", err)
+		}
+	}
+
+	// the wrapped keys of layers with many recipients are passed in a key blob
+	payload.Descriptor, err = encryption.ExpandKeysFrom(payload.Descriptor, payload.KeyBlobs)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicy(ctx, payload.Descriptor); err != nil {
+		return err
+	}
+
 	decCc := &payload.DecryptConfig
 
-	// TODO: If decryption key path is set, get additional keys to augment payload keys
-	if ctx.GlobalIsSet("decryption-keys-path") {
-		keyPathCc, err := getDecryptionKeys(ctx.GlobalString("decryption-keys-path"))
+	if tenant := payload.Tenant(); tenant != "" {
+		// the key sets of tenants are isolated from each other and from the
+		// shared keys of the decoder
+		if !ctx.GlobalIsSet("tenant-keys-path") {
+			return fmt.Errorf("layer requested for tenant %s, but no tenant keys are configured", tenant)
+		}
+		tenantCc, err := getTenantDecryptionKeys(ctx.GlobalString("tenant-keys-path"), tenant)
+		if err != nil {
+			return fmt.Errorf("unable to get decryption keys of tenant %s: %w", tenant, err)
+		}
+		decCc = combineDecryptionConfigs(tenantCc.DecryptConfig, decCc)
+	} else {
+		decCc, err = sharedDecryptionKeys(ctx, decCc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.GlobalIsSet("key-usage-policy") {
+		p, err := keyusage.Load(ctx.GlobalString("key-usage-policy"))
+		if err != nil {
+			return err
+		}
+		var rejections []keyusage.Rejection
+		decCc, rejections = p.Filter(decCc, time.Now())
+		for _, r := range rejections {
+			fmt.Fprintf(os.Stderr, "not using key %s\n", r)
+		}
+	}
+
+	if ctx.GlobalIsSet("kmip-config") {
+		c, err := kmip.LoadConfig(ctx.GlobalString("kmip-config"))
 		if err != nil {
-			return fmt.Errorf("unable to get decryption keys in provided key path: %w", err)
+			return err
 		}
-		decCc = combineDecryptionConfigs(keyPathCc.DecryptConfig, &payload.DecryptConfig)
+		kmip.Install(c)
 	}
 
+	var tc *timelock.Config
+	if ctx.GlobalIsSet("timelock-config") {
+		c, err := timelock.LoadConfig(ctx.GlobalString("timelock-config"))
+		if err != nil {
+			return err
+		}
+		tc = c
+	}
+	timelock.Install(tc)
+
+	if ctx.GlobalIsSet("pkcs11-config") {
+		p, err := pkcs11pool.LoadModulePolicy(ctx.GlobalString("pkcs11-config"))
+		if err != nil {
+			return err
+		}
+		pkcs11pool.SetModulePolicy(p)
+		// modules are only searched and allowed as configured for the decoder,
+		// not as the client passed in the payload
+		if _, ok := decCc.Parameters["pkcs11-config"]; ok {
+			data, err := yaml.Marshal(p.Pkcs11Config())
+			if err != nil {
+				return err
+			}
+			decCc.Parameters["pkcs11-config"] = [][]byte{data}
+		}
+	}
+
+	if ctx.GlobalBool("gpg-agent") {
+		// only the home directory given to the decoder is used, not those
+		// the client passed in the payload
+		delete(decCc.Parameters, gpgagent.ParameterName)
+		delete(decCc.Parameters, gpgagent.PassphraseParameterName)
+		gpgagent.Install()
+		if src := ctx.GlobalString("gpg-passphrase-source"); src != "" {
+			passphrase, err := gpgagent.ReadPassphraseSource(src)
+			if err != nil {
+				return err
+			}
+			gpgagent.WithAgentPassphrase(decCc, ctx.GlobalString("gpg-homedir"), passphrase)
+		} else {
+			gpgagent.WithAgent(decCc, ctx.GlobalString("gpg-homedir"))
+		}
+	}
+
+	if ctx.GlobalIsSet("enclave") {
+		enclave.Install()
+		enclave.WithAddresses(decCc, ctx.GlobalStringSlice("enclave"))
+	}
+
+	// the keys are kept outside of the Go heap and zeroed once the layer is
+	// decrypted
+	if err := securemem.ProtectParameters(decCc.Parameters); err != nil {
+		return err
+	}
+	defer securemem.ReleaseParameters(decCc.Parameters)
+
+	if len(payload.UnwrappedKeys) > 0 {
+		keys := make([]keyprovider.UnwrappedKey, 0, len(payload.UnwrappedKeys))
+		for _, k := range payload.UnwrappedKeys {
+			keys = append(keys, keyprovider.UnwrappedKey(k))
+		}
+		defer keyprovider.Seed(decCc, keys)()
+	}
+
+	if ctx.GlobalIsSet("memory-limit") {
+		release, err := reserveMemory(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	// the layer and its annotations are chosen by whoever built the image,
+	// so the decoder is restricted before it parses them
+	if !ctx.GlobalBool("no-sandbox") {
+		if _, err := sandbox.Apply(sandbox.Config{Writable: sandboxWritable(ctx, space)}); err != nil {
+			return fmt.Errorf("could not sandbox the decoder: %w", err)
+		}
+	}
+
+	rec, unbind := attempts.Bind(decCc)
 	_, r, _, err := encryption.DecryptLayer(decCc, os.Stdin, payload.Descriptor, false)
+	unbind()
+	if ctx.GlobalIsSet("audit-log") {
+		if aerr := auditUnwrap(ctx.GlobalString("audit-log"), ctx.GlobalString("namespace"), payload, rec.Layers(), err); aerr != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", aerr)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("call to DecryptLayer failed: %w", err)
 	}
 
-	for {
-		_, err := io.CopyN(os.Stdout, r, 10*1024)
+	if space != nil {
+		r = space.Reader(r)
+	}
+	if ctx.GlobalBool("decompress") {
+		dr, err := compression.DecompressStream(r)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("could not copy data: %w", err)
+			return fmt.Errorf("could not decompress layer: %w", err)
 		}
+		defer dr.Close()
+		r = dr
+	}
+	if _, err := bufpool.Copy(os.Stdout, r); err != nil {
+		return fmt.Errorf("could not copy data: %w", err)
+	}
+	if space != nil {
+		return space.Err()
 	}
 	return nil
 }
 
+// newScratchSpace creates the private directory for the temporary files of
+// the decryption
+func newScratchSpace(ctx *cli.Context) (*scratch.Space, error) {
+	c := scratch.Config{Dir: ctx.GlobalString("scratch-dir"), NoDisk: ctx.GlobalBool("scratch-no-disk")}
+	if ctx.GlobalIsSet("scratch-limit") {
+		limit, err := units.RAMInBytes(ctx.GlobalString("scratch-limit"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid scratch limit: %w", err)
+		}
+		c.Limit = limit
+	}
+	return scratch.New(c)
+}
+
+// removeOnSignal removes the scratch space and exits if the decoder is
+// interrupted or terminated, until the returned function is called
+func removeOnSignal(s *scratch.Space) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-c:
+			s.Close()
+			fmt.Fprintf(os.Stderr, "decryption stopped by %s\n", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// sandboxWritable returns the paths the decoder writes to once it is sandboxed
+func sandboxWritable(ctx *cli.Context, space *scratch.Space) []string {
+	writable := ctx.GlobalStringSlice("sandbox-writable")
+	if space != nil {
+		// the private directory of the decoder is removed from its parent
+		writable = append(writable, filepath.Dir(space.Dir()))
+	} else {
+		writable = append(writable, os.TempDir())
+	}
+	if path := ctx.GlobalString("metrics-textfile"); path != "" {
+		writable = append(writable, filepath.Dir(path))
+	}
+	// the shared files are replaced by renaming a new file over them; their
+	// directories were checked to be writable by root only
+	for _, path := range stateFiles(ctx) {
+		writable = append(writable, filepath.Dir(path))
+	}
+	if path := ctx.GlobalString("audit-log"); path != "" && path != "syslog" {
+		writable = append(writable, path)
+	}
+	if home := ctx.GlobalString("gpg-homedir"); home != "" && ctx.GlobalBool("gpg-agent") {
+		writable = append(writable, home)
+	}
+	return writable
+}
+
+// sharedDecryptionKeys adds the keys of the decoder and of the namespace it
+// serves to the decryption configuration. The namespace comes from the
+// configuration of the decoder and never from the payload, which is set by the
+// containerd client.
+func sharedDecryptionKeys(ctx *cli.Context, decCc *encconfig.DecryptConfig) (*encconfig.DecryptConfig, error) {
+	// TODO: If decryption key path is set, get additional keys to augment payload keys
+	if ctx.GlobalIsSet("decryption-keys-path") {
+		keyPathCc, err := keydir.Load(ctx.GlobalString("decryption-keys-path"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get decryption keys in provided key path: %w", err)
+		}
+		decCc = combineDecryptionConfigs(keyPathCc.DecryptConfig, decCc)
+	}
+
+	if ns := ctx.GlobalString("namespace"); ctx.GlobalIsSet("namespace-keys-path") && ns != "" {
+		nsCc, err := getNamespaceDecryptionKeys(ctx.GlobalString("namespace-keys-path"), ns)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get decryption keys of namespace %s: %w", ns, err)
+		}
+		if nsCc != nil {
+			decCc = combineDecryptionConfigs(nsCc.DecryptConfig, decCc)
+		}
+	}
+	return decCc, nil
+}
+
+// reserveMemory reserves the memory for the decryption of the layer from the
+// budget shared by all decoders and limits the memory of the process to it
+func reserveMemory(ctx *cli.Context) (func(), error) {
+	limit, err := units.RAMInBytes(ctx.GlobalString("memory-limit"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory limit: %w", err)
+	}
+	n, err := units.RAMInBytes(ctx.GlobalString("memory-per-layer"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory per layer: %w", err)
+	}
+	b := &membudget.Budget{Path: ctx.GlobalString("memory-budget-file"), Limit: limit}
+	wctx, cancel := context.WithTimeout(context.Background(), ctx.GlobalDuration("memory-wait"))
+	defer cancel()
+	release, err := b.Reserve(wctx, n)
+	if err != nil {
+		return nil, fmt.Errorf("could not reserve memory for decryption: %w", err)
+	}
+	debug.SetMemoryLimit(n)
+	return release, nil
+}
+
 func getPayload() (*imgcrypt.Payload, error) {
 	data, err := readPayload()
 	if err != nil {
@@ -104,6 +615,9 @@ func getPayload() (*imgcrypt.Payload, error) {
 		return nil, fmt.Errorf("could not proto.Unmarshal() decrypt data: %w", err)
 	}
 	v, err := typeurl.UnmarshalAny(&anything)
+	// the serialized payload holds the keys passed by the client
+	securemem.Wipe(data)
+	securemem.Wipe(anything.Value)
 	if err != nil {
 		return nil, fmt.Errorf("could not UnmarshalAny() the decrypt data: %w", err)
 	}
@@ -0,0 +1,78 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/bufpool"
+	"github.com/containerd/imgcrypt/images/encryption/policy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// mediaTypeEnv holds the media type of the layer that containerd passes to
+// the stream processor
+const mediaTypeEnv = "STREAM_PROCESSOR_MEDIATYPE"
+
+// checkPolicy checks the layer against the rules of --policy that apply to
+// all images in the namespace of the decoder. The decoder is not told which
+// image the layer belongs to, and the payload naming it is set by the client,
+// so rules for image names or digests are left to the client.
+func checkPolicy(ctx *cli.Context, desc ocispec.Descriptor) error {
+	if !ctx.GlobalIsSet("policy") {
+		return nil
+	}
+	p, err := policy.Load(ctx.GlobalString("policy"))
+	if err != nil {
+		return err
+	}
+	li, err := encryption.GetLayerInfo(0, desc, nil)
+	if err != nil {
+		return err
+	}
+	return p.CheckLayer(ctx.GlobalString("namespace"), "", li)
+}
+
+// isPlaintextLayer returns whether containerd runs the decoder for a layer
+// that is not encrypted, which it does if the decoder is registered for
+// plaintext media types to enforce --policy
+func isPlaintextLayer() (string, bool) {
+	mediaType := os.Getenv(mediaTypeEnv)
+	return mediaType, mediaType != "" && !encryption.IsEncryptedDiff(context.Background(), mediaType)
+}
+
+// passPlaintext checks the plaintext layer against --policy and writes it
+// uncompressed to stdout
+func passPlaintext(ctx *cli.Context, mediaType string) error {
+	if err := checkPolicy(ctx, ocispec.Descriptor{MediaType: mediaType}); err != nil {
+		return err
+	}
+	r, err := compression.DecompressStream(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("could not decompress layer: %w", err)
+	}
+	defer r.Close()
+	if _, err := bufpool.Copy(os.Stdout, r); err != nil {
+		return fmt.Errorf("could not copy data: %w", err)
+	}
+	return nil
+}
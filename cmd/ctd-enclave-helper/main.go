@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/imgcrypt/images/encryption/enclave"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	Usage = "ctd-enclave-helper unwraps layer keys for ctd-decoder with a private key that never leaves the enclave it runs in"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "ctd-enclave-helper"
+	app.Usage = Usage
+	app.Action = run
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "Private key to unwrap layer keys with; this should be a file only readable inside the enclave, e.g. a Gramine encrypted file",
+		},
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "Address to listen on, as unix://<path> or tcp://<host:port>",
+			Value: "tcp://127.0.0.1:7300",
+		},
+		cli.BoolFlag{
+			Name:  "print-public-key",
+			Usage: "Print the public key to encrypt images for and exit",
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	keyFile := context.String("key")
+	if keyFile == "" {
+		return fmt.Errorf("a private key must be given with --key")
+	}
+	privKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+	var password []byte
+	if pwd := os.Getenv("IMGCRYPT_ENCLAVE_KEY_PASSWORD"); pwd != "" {
+		password = []byte(pwd)
+	}
+	srv, err := enclave.NewServer(privKey, password)
+	if err != nil {
+		return err
+	}
+	if context.Bool("print-public-key") {
+		_, err := os.Stdout.Write(srv.PublicKey())
+		return err
+	}
+
+	l, err := enclave.Listen(context.String("listen"))
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+	return srv.Serve(l)
+}
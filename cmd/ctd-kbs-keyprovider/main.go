@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	gocontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/imgcrypt/images/encryption/kbs"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	Usage = "ctd-kbs-keyprovider is an ocicrypt keyprovider that releases layer keys through a Key Broker Service after attestation"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "ctd-kbs-keyprovider"
+	app.Usage = Usage
+	app.Action = run
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "provider-name",
+			Usage: "Name of the keyprovider in the ocicrypt keyprovider configuration",
+			Value: "kbs",
+		},
+		cli.StringFlag{
+			Name:   "kbs-url",
+			Usage:  "URL of the Key Broker Service to get key encryption keys from",
+			EnvVar: "IMGCRYPT_KBS_URL",
+		},
+		cli.StringFlag{
+			Name:  "kbs-ca",
+			Usage: "CA certificate to verify the TLS certificate of the Key Broker Service with",
+		},
+		cli.StringFlag{
+			Name:  "tee",
+			Usage: "Type of the TEE to attest (\"tdx\", \"snp\" or \"sample\")",
+			Value: "tdx",
+		},
+		cli.StringFlag{
+			Name:  "evidence-command",
+			Usage: "Command printing the TEE evidence for the hex encoded report data passed as last argument; required for SEV-SNP",
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read keyprovider input: %w", err)
+	}
+	var batch keyprovider.Input
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return fmt.Errorf("failed to decode keyprovider input: %w", err)
+	}
+	switch batch.Operation {
+	case keyprovider.OpCapabilities, keyprovider.OpKeyWrapBatch, keyprovider.OpKeyUnwrapBatch:
+		output, err := runBatch(context, &batch)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(output)
+	}
+
+	var input ocikeyprovider.KeyProviderKeyWrapProtocolInput
+	if err := json.Unmarshal(data, &input); err != nil {
+		return fmt.Errorf("failed to decode keyprovider input: %w", err)
+	}
+	var output ocikeyprovider.KeyProviderKeyWrapProtocolOutput
+	switch input.Operation {
+	case ocikeyprovider.OpKeyWrap:
+		annotation, err := wrapKey(context, input.KeyWrapParams.Ec, input.KeyWrapParams.OptsData)
+		if err != nil {
+			return err
+		}
+		output.KeyWrapResults.Annotation = annotation
+	case ocikeyprovider.OpKeyUnwrap:
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		optsData, err := client.UnwrapKey(gocontext.Background(), input.KeyUnwrapParams.Annotation)
+		if err != nil {
+			return err
+		}
+		output.KeyUnwrapResults.OptsData = optsData
+	default:
+		return fmt.Errorf("unsupported operation %q", input.Operation)
+	}
+	return json.NewEncoder(os.Stdout).Encode(output)
+}
+
+// runBatch handles the operations of version 2 of the keyprovider protocol; all
+// keys of a batch are unwrapped within one attested session with the KBS
+func runBatch(context *cli.Context, input *keyprovider.Input) (*keyprovider.Output, error) {
+	output := &keyprovider.Output{Version: keyprovider.ProtocolVersion}
+	switch input.Operation {
+	case keyprovider.OpCapabilities:
+		output.Capabilities = []string{keyprovider.OpKeyWrapBatch, keyprovider.OpKeyUnwrapBatch}
+	case keyprovider.OpKeyWrapBatch:
+		params := input.KeyWrapBatchParams
+		if params == nil {
+			return nil, errors.New("missing keywrap batch parameters")
+		}
+		for _, optsData := range params.OptsData {
+			var r keyprovider.BatchResult
+			annotation, err := wrapKey(context, params.Ec, optsData)
+			if err != nil {
+				r.Error = err.Error()
+			}
+			r.Annotation = annotation
+			output.KeyWrapBatchResults = append(output.KeyWrapBatchResults, r)
+		}
+	case keyprovider.OpKeyUnwrapBatch:
+		params := input.KeyUnwrapBatchParams
+		if params == nil {
+			return nil, errors.New("missing keyunwrap batch parameters")
+		}
+		client, err := newClient(context)
+		if err != nil {
+			return nil, err
+		}
+		for _, annotation := range params.Annotations {
+			var r keyprovider.BatchResult
+			optsData, err := client.UnwrapKey(gocontext.Background(), annotation)
+			if err != nil {
+				r.Error = err.Error()
+			}
+			r.OptsData = optsData
+			output.KeyUnwrapBatchResults = append(output.KeyUnwrapBatchResults, r)
+		}
+	}
+	return output, nil
+}
+
+// wrapKey wraps the layer key with the key encryption key given in the
+// keyprovider recipient parameter
+func wrapKey(context *cli.Context, ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	if ec == nil {
+		return nil, errors.New("missing encryption config")
+	}
+	values := ec.Parameters[context.String("provider-name")]
+	if len(values) != 1 {
+		return nil, fmt.Errorf("expected one recipient for keyprovider %s, got %d", context.String("provider-name"), len(values))
+	}
+	kek, keyID, err := kbs.ParseWrapParameter(string(values[0]))
+	if err != nil {
+		return nil, err
+	}
+	p, err := kbs.Wrap(kek, keyID, optsData)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
+}
+
+func newClient(context *cli.Context) (*kbs.Client, error) {
+	url := context.String("kbs-url")
+	if url == "" {
+		return nil, errors.New("no KBS URL given")
+	}
+
+	var attester kbs.Attester
+	tee := context.String("tee")
+	switch {
+	case context.String("evidence-command") != "":
+		attester = kbs.CommandAttester{Tee: tee, Command: strings.Fields(context.String("evidence-command"))}
+	case tee == "tdx":
+		attester = kbs.TSMAttester{}
+	case tee == "sample":
+		attester = kbs.SampleAttester{}
+	default:
+		return nil, fmt.Errorf("an evidence command is required for TEE %q", tee)
+	}
+
+	var tlsConfig *tls.Config
+	if ca := context.String("kbs-ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KBS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return kbs.NewClient(url, attester, tlsConfig)
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package app
+
+import (
+	gocontext "context"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+	"github.com/urfave/cli"
+)
+
+// setupAudit installs the audit sink selected with --audit-log
+func setupAudit(context *cli.Context) error {
+	var (
+		sink audit.Sink
+		err  error
+	)
+	switch target := context.GlobalString("audit-log"); target {
+	case "":
+		return nil
+	case "syslog":
+		sink, err = audit.NewSyslogSink("ctr-enc")
+	case "events":
+		sink = audit.EventSink{Publisher: &clientPublisher{context: context}}
+	default:
+		sink, err = audit.NewFileSink(target)
+	}
+	if err != nil {
+		return err
+	}
+	audit.SetSink(sink)
+	return nil
+}
+
+// clientPublisher publishes events through a containerd client that is
+// connected upon the first event
+type clientPublisher struct {
+	context *cli.Context
+	once    sync.Once
+	client  *containerd.Client
+	err     error
+}
+
+func (cp *clientPublisher) Publish(ctx gocontext.Context, topic string, event events.Event) error {
+	cp.once.Do(func() {
+		cp.client, cp.err = containerd.New(cp.context.GlobalString("address"),
+			containerd.WithDefaultNamespace(cp.context.GlobalString("namespace")))
+	})
+	if cp.err != nil {
+		return cp.err
+	}
+	return cp.client.EventService().Publish(ctx, topic, event)
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/urfave/cli"
+)
+
+const errorFormatKey = "imgcrypt.error-format"
+
+// exit codes by class of error
+var exitCodes = map[imgenc.ErrorClass]int{
+	imgenc.ErrorClassUnknown:        1,
+	imgenc.ErrorClassKeyNotFound:    3,
+	imgenc.ErrorClassNotAuthorized:  4,
+	imgenc.ErrorClassUnwrapFailed:   5,
+	imgenc.ErrorClassRegistry:       6,
+	imgenc.ErrorClassIntegrity:      7,
+	imgenc.ErrorClassTimeLocked:     8,
+	imgenc.ErrorClassEncryptedLayer: 9,
+}
+
+// ExitCode returns the exit code for an error returned by a command
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[imgenc.ClassifyError(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+type jsonError struct {
+	Error    string            `json:"error"`
+	Class    imgenc.ErrorClass `json:"class"`
+	ExitCode int               `json:"exitCode"`
+	// Attempts are the attempts to unwrap the layer keys of an image the
+	// user is not authorized to use
+	Attempts []attempts.Layer `json:"attempts,omitempty"`
+}
+
+// HandleError writes an error returned by running the application to w in the
+// format selected with --error-format and returns the exit code
+func HandleError(app *cli.App, w io.Writer, err error) int {
+	code := ExitCode(err)
+	var authErr *imgenc.AuthorizationError
+	errors.As(err, &authErr)
+	if format, _ := app.Metadata[errorFormatKey].(string); format == "json" {
+		je := jsonError{
+			Error:    err.Error(),
+			Class:    imgenc.ClassifyError(err),
+			ExitCode: code,
+		}
+		if authErr != nil {
+			je.Attempts = authErr.Layers
+		}
+		_ = json.NewEncoder(w).Encode(je)
+		return code
+	}
+	fmt.Fprintf(w, "ctr: %s\n", err)
+	if authErr != nil {
+		for _, line := range attempts.Summary(authErr.Layers) {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return code
+}
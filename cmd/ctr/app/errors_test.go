@@ -0,0 +1,53 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+)
+
+func TestExitCode(t *testing.T) {
+	if code := ExitCode(nil); code != 0 {
+		t.Fatalf("expected exit code 0 without an error, got %d", code)
+	}
+	for _, class := range []imgenc.ErrorClass{
+		imgenc.ErrorClassUnknown,
+		imgenc.ErrorClassKeyNotFound,
+		imgenc.ErrorClassNotAuthorized,
+		imgenc.ErrorClassUnwrapFailed,
+		imgenc.ErrorClassRegistry,
+		imgenc.ErrorClassIntegrity,
+		imgenc.ErrorClassEncryptedLayer,
+		imgenc.ErrorClassTimeLocked,
+	} {
+		if exitCodes[class] == 0 {
+			t.Errorf("error class %s has no exit code", class)
+		}
+	}
+
+	err := fmt.Errorf("mount: %w", &imgenc.EncryptedLayerError{Op: "apply", Digest: "sha256:0123"})
+	if code := ExitCode(err); code != 9 {
+		t.Fatalf("expected exit code 9 for an encrypted layer, got %d", code)
+	}
+	if code := ExitCode(errors.New("failure")); code != 1 {
+		t.Fatalf("expected exit code 1 for other errors, got %d", code)
+	}
+}
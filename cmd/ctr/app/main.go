@@ -19,6 +19,7 @@ package app
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
 	"github.com/containerd/containerd/cmd/ctr/commands/events"
@@ -34,9 +35,22 @@ import (
 	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/version"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/bench"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/containers"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/doctor"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/images"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/keys"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/profiles"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/run"
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/kmip"
+	"github.com/containerd/imgcrypt/images/encryption/layercache"
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/timelock"
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	"github.com/containerd/imgcrypt/images/encryption/unwraporder"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"google.golang.org/grpc/grpclog"
@@ -76,7 +90,12 @@ containerd CLI
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "debug",
-			Usage: "enable debug output in logs",
+			Usage: "enable debug output in logs, including which keys were tried to decrypt layers",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: `format of logs, "text" or "json"`,
+			Value: "text",
 		},
 		cli.StringFlag{
 			Name:   "address, a",
@@ -98,14 +117,100 @@ containerd CLI
 			Value:  namespaces.Default,
 			EnvVar: namespaces.NamespaceEnvVar,
 		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "profile of encryption settings to use from the imgcrypt config file",
+			EnvVar: "IMGCRYPT_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "path to the imgcrypt config file; by default ~/.config/imgcrypt/config.yaml",
+			EnvVar: "IMGCRYPT_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:   "no-input",
+			Usage:  "never prompt for input such as passwords of private keys",
+			EnvVar: "IMGCRYPT_NO_INPUT",
+		},
+		cli.StringFlag{
+			Name: "error-format",
+			Usage: `format of errors, "text" or "json"; the exit code tells the kind of error:
+	1 other error, 3 key not found, 4 not authorized, 5 key unwrapping failed,
+	6 registry error, 7 integrity check failed, 8 layer keys are time-locked,
+	9 encrypted layer used where only plain layers are supported`,
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:   "key-usage-policy",
+			Usage:  "path of a policy with validity windows and revocations of decryption keys",
+			EnvVar: "IMGCRYPT_KEY_USAGE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "kmip-config",
+			Usage:  "path of the JSON configuration for connecting to KMIP servers, which enables kmip:<endpoint>/<key-id> recipients",
+			EnvVar: "IMGCRYPT_KMIP_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "ldap-config",
+			Usage:  "path of the JSON configuration of an LDAP directory that x509:<identity> and pgp recipients are looked up in",
+			EnvVar: "IMGCRYPT_LDAP_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "timelock-config",
+			Usage:  "path of the JSON configuration for connecting to the time-lock services of timelock:<unlock-time>@<service-url> recipients",
+			EnvVar: "IMGCRYPT_TIMELOCK_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:   "fips",
+			Usage:  "restrict image encryption and decryption to FIPS approved algorithms",
+			EnvVar: "IMGCRYPT_FIPS",
+		},
+		cli.StringFlag{
+			Name:   "algorithm-policy",
+			Usage:  "path of a policy restricting wrap schemes, RSA key sizes, curves and ciphers used for encryption and decryption",
+			EnvVar: "IMGCRYPT_ALGORITHM_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "unwrap-order",
+			Usage:  "path of a file setting the order in which the wrap schemes of layer keys are tried when decrypting",
+			EnvVar: "IMGCRYPT_UNWRAP_ORDER",
+		},
+		cli.StringFlag{
+			Name:   "unwrap-limits",
+			Usage:  "path of a file limiting the failed attempts to use the PINs of PKCS#11 tokens and the passphrases of private keys when decrypting",
+			EnvVar: "IMGCRYPT_UNWRAP_LIMITS",
+		},
+		cli.StringFlag{
+			Name:   "escrow-policy",
+			Usage:  "path of a policy naming escrow recipients that the layer keys of all encrypted images must be wrapped for",
+			EnvVar: "IMGCRYPT_ESCROW_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  `where to record key operations: a file, "syslog" or "events" for containerd events`,
+			EnvVar: "IMGCRYPT_AUDIT_LOG",
+		},
+		cli.StringFlag{
+			Name:   "layer-cache",
+			Usage:  "directory of encrypted layers reused when the same plain layers are encrypted again for the same recipients",
+			EnvVar: "IMGCRYPT_LAYER_CACHE",
+		},
+		cli.DurationFlag{
+			Name:   "layer-cache-max-age",
+			Usage:  "remove the layers of the layer cache that were not used for this long",
+			EnvVar: "IMGCRYPT_LAYER_CACHE_MAX_AGE",
+		},
 	}
 	app.Commands = append([]cli.Command{
 		plugins.Command,
 		versionCmd.Command,
+		bench.Command,
 		containers.Command,
 		content.Command,
+		doctor.Command,
 		events.Command,
 		images.Command,
+		keys.Command,
 		leases.Command,
 		namespacesCmd.Command,
 		pprof.Command,
@@ -116,9 +221,108 @@ containerd CLI
 		ociCmd.Command,
 	}, extraCmds...)
 	app.Before = func(context *cli.Context) error {
+		switch format := context.GlobalString("error-format"); format {
+		case "text", "json":
+			if app.Metadata == nil {
+				app.Metadata = map[string]interface{}{}
+			}
+			app.Metadata[errorFormatKey] = format
+		default:
+			return fmt.Errorf("unsupported error format %q", format)
+		}
 		if context.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		switch format := context.GlobalString("log-format"); format {
+		case "text":
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+		default:
+			return fmt.Errorf("unsupported log format %q", format)
+		}
+		if context.GlobalBool("fips") {
+			fips.Enable()
+		}
+		if err := setupAudit(context); err != nil {
+			return err
+		}
+		if path := context.GlobalString("kmip-config"); path != "" {
+			c, err := kmip.LoadConfig(path)
+			if err != nil {
+				return err
+			}
+			kmip.Install(c)
+		}
+		var tc *timelock.Config
+		if path := context.GlobalString("timelock-config"); path != "" {
+			c, err := timelock.LoadConfig(path)
+			if err != nil {
+				return err
+			}
+			tc = c
+		}
+		timelock.Install(tc)
+		if err := profiles.Setup(context); err != nil {
+			return err
+		}
+		// the settings given on the command line replace those of the profile
+		if path := context.GlobalString("algorithm-policy"); path != "" {
+			p, err := algpolicy.Load(path)
+			if err != nil {
+				return err
+			}
+			algpolicy.Set(p)
+		}
+		if path := context.GlobalString("unwrap-order"); path != "" {
+			o, err := unwraporder.Load(path)
+			if err != nil {
+				return err
+			}
+			unwraporder.Set(o)
+		}
+		if path := context.GlobalString("unwrap-limits"); path != "" {
+			l, err := unwraplimit.Load(path)
+			if err != nil {
+				return err
+			}
+			unwraplimit.Set(l)
+		}
+		if dir := context.GlobalString("layer-cache"); dir != "" {
+			c, err := layercache.Open(dir)
+			if err != nil {
+				return err
+			}
+			layercache.Set(c)
+		}
+		if maxAge := context.GlobalDuration("layer-cache-max-age"); maxAge > 0 {
+			if c := layercache.Current(); c != nil {
+				n, err := c.Prune(time.Now().Add(-maxAge))
+				if err != nil {
+					return fmt.Errorf("failed to prune layer cache: %w", err)
+				}
+				if n > 0 {
+					logrus.Debugf("removed %d unused layers from the layer cache", n)
+				}
+			}
+		}
+		if path := context.GlobalString("escrow-policy"); path != "" {
+			p, err := escrow.Load(path)
+			if err != nil {
+				return err
+			}
+			escrow.Set(p)
+		}
+		if path := context.GlobalString("ldap-config"); path != "" {
+			c, err := ldapkeys.LoadConfig(path)
+			if err != nil {
+				return err
+			}
+			d, err := ldapkeys.New(c)
+			if err != nil {
+				return err
+			}
+			ldapkeys.Set(d)
+		}
 		return nil
 	}
 	return app
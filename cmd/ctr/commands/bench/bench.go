@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/imgcrypt/images/encryption/bench"
+	"github.com/gobars/ocicrypt/blockcipher"
+
+	"github.com/urfave/cli"
+)
+
+// Command is the cli command for measuring the speed of encryption
+var Command = cli.Command{
+	Name:  "bench",
+	Usage: "measure the speed of layer ciphers and key wrap schemes on this host",
+	Description: `Measure the speed of layer ciphers and key wrap schemes on this host.
+
+	Each cipher encrypts and decrypts layer data of --size MiB, and each wrap
+	scheme wraps and unwraps a layer key with a freshly generated key, for at
+	least --time each. The throughput of the ciphers is reported in MB/s and the
+	time taken per key for the schemes. Profiles of the run can be written for
+	analysis with go tool pprof.
+`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "cipher",
+			Usage: fmt.Sprintf("a cipher to measure, by default all of %s", joinCiphers(bench.Ciphers())),
+		},
+		cli.StringSliceFlag{
+			Name:  "scheme",
+			Usage: fmt.Sprintf("a wrap scheme and key type to measure, by default all of %s", strings.Join(bench.Schemes(), ", ")),
+		},
+		cli.IntFlag{
+			Name:  "size",
+			Usage: "size of the layer data in MiB",
+			Value: bench.DefaultSize >> 20,
+		},
+		cli.DurationFlag{
+			Name:  "time",
+			Usage: "minimum time to repeat each operation for",
+			Value: bench.DefaultDuration,
+		},
+		cli.StringFlag{
+			Name:  "cpuprofile",
+			Usage: "write a CPU profile of the run to the file",
+		},
+		cli.StringFlag{
+			Name:  "memprofile",
+			Usage: "write a memory allocation profile of the run to the file",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the results in JSON format",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		opts := bench.Options{
+			Schemes:  context.StringSlice("scheme"),
+			Size:     int64(context.Int("size")) << 20,
+			Duration: context.Duration("time"),
+		}
+		if opts.Size <= 0 {
+			return fmt.Errorf("invalid size %d", context.Int("size"))
+		}
+		for _, c := range context.StringSlice("cipher") {
+			opts.Ciphers = append(opts.Ciphers, blockcipher.LayerCipherType(c))
+		}
+
+		if path := context.String("cpuprofile"); path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := pprof.StartCPUProfile(f); err != nil {
+				return err
+			}
+			defer pprof.StopCPUProfile()
+		}
+		results, err := bench.Run(opts)
+		if err != nil {
+			return err
+		}
+		if path := context.String("memprofile"); path != "" {
+			if err := writeHeapProfile(path); err != nil {
+				return err
+			}
+		}
+
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(results)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 1, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tOPERATION\tCOUNT\tMB/S\tPER OPERATION")
+		for _, r := range results {
+			throughput := "-"
+			if r.Bytes > 0 {
+				throughput = fmt.Sprintf("%.1f", r.MBPerSecond())
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Name, r.Operation, r.Count, throughput, r.PerOperation())
+		}
+		return w.Flush()
+	},
+}
+
+func joinCiphers(ciphers []blockcipher.LayerCipherType) string {
+	names := make([]string, len(ciphers))
+	for i, c := range ciphers {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ", ")
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
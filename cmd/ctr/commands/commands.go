@@ -214,7 +214,7 @@ var (
 			Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
 		}, cli.StringSliceFlag{
 			Name:  "key",
-			Usage: "A secret key's filename and an optional password separated by colon; this option may be provided multiple times",
+			Usage: "A secret key's filename, or - for the keys in the standard input, and an optional password separated by colon; this option may be provided multiple times",
 		}, cli.StringSliceFlag{
 			Name:  "dec-recipient",
 			Usage: "Recipient of the image; used only for PKCS7 and must be an x509 certificate",
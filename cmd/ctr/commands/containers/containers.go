@@ -55,7 +55,7 @@ var createCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create container",
 	ArgsUsage: "[flags] Image|RootFS CONTAINER [COMMAND] [ARG...]",
-	Flags:     append(append(commands.SnapshotterFlags, commands.ContainerFlags...), flags.ImageDecryptionFlags...),
+	Flags:     append(append(append(commands.SnapshotterFlags, commands.ContainerFlags...), flags.ImageDecryptionFlags...), append(flags.ImagePolicyFlags, flags.ImageVerifyFlags...)...),
 	Action: func(context *cli.Context) error {
 		var (
 			id     string
@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package doctor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/imgcrypt/images/encryption/doctor"
+
+	"github.com/urfave/cli"
+)
+
+// Command is the cli command for checking the environment of image encryption
+var Command = cli.Command{
+	Name:  "doctor",
+	Usage: "check the environment for image encryption and decryption",
+	Description: `Check the environment for image encryption and decryption.
+
+	Checks that GnuPG is installed, that the PKCS#11 modules of the ocicrypt
+	configuration load and have tokens, that the configured and discovered
+	keyproviders can be called, that the keys given with --key are recognized,
+	and that ctd-decoder is registered as stream processor in the containerd
+	configuration. For each problem found a remedy is suggested. The command
+	fails if any check finds an error.
+`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "a key file or directory of key files to check, such as the decryption keys path of the decoder",
+		},
+		cli.StringFlag{
+			Name:  "gpg-homedir",
+			Usage: "the GPG homedir to check",
+		},
+		cli.StringFlag{
+			Name:  "containerd-config",
+			Usage: "the containerd configuration file to check the decoder registration in",
+			Value: doctor.DefaultContainerdConfig,
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout for connecting to each keyprovider",
+			Value: doctor.DefaultTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the results in JSON format",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ctx, cancel := commands.AppContext(context)
+		defer cancel()
+
+		results := doctor.Run(ctx, doctor.Options{
+			Keys:             context.StringSlice("key"),
+			GPGHomedir:       context.String("gpg-homedir"),
+			ContainerdConfig: context.String("containerd-config"),
+			Timeout:          context.Duration("timeout"),
+		})
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				return err
+			}
+		} else {
+			for _, r := range results {
+				fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(r.Status)), r.Check, r.Message)
+				if r.Remedy != "" {
+					fmt.Printf("    remedy: %s\n", strings.ReplaceAll(r.Remedy, "\n", "\n      "))
+				}
+			}
+		}
+		if doctor.Failed(results) {
+			return errors.New("problems were found")
+		}
+		return nil
+	},
+}
@@ -29,16 +29,71 @@ var (
 		}, cli.StringFlag{
 			Name:  "gpg-version",
 			Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
+		}, cli.BoolFlag{
+			Name:  "gpg-agent",
+			Usage: "Have gpg-agent unwrap PGP wrapped keys, which allows using keys held on OpenPGP smartcards",
+		}, cli.StringFlag{
+			Name:  "gpg-passphrase-source",
+			Usage: "Give gpg-agent the passphrase of the PGP key through loopback pinentry, read from file:<path> or env:<variable>; implies --gpg-agent",
 		}, cli.BoolFlag{
 			Name:  "skip-decrypt-auth",
 			Usage: "Indicates if check authorization for use of images should be skipped i.e. for use in node key model",
 		},
 		cli.StringSliceFlag{
 			Name:  "key",
-			Usage: "A secret key's filename and an optional password separated by colon; this option may be provided multiple times",
+			Usage: "A secret key's filename, or - for the keys in the standard input, and an optional password separated by colon; this option may be provided multiple times",
 		}, cli.StringSliceFlag{
 			Name:  "dec-recipient",
 			Usage: "Recipient of the image; used only for PKCS7 and must be an x509 certificate",
+		}, cli.StringFlag{
+			Name:  "tenant",
+			Usage: "Tenant whose key set ctd-decoder decrypts the layers with when unpacking",
+		}, cli.StringSliceFlag{
+			Name:  "encryption-context",
+			Usage: "A key=value pair, such as repository=docker.io/library/app, that layer keys are bound to when encrypting and must be bound to when decrypting; this option may be provided multiple times",
+		},
+	}
+
+	// RecipientTrustFlags are cli flags needed when verifying the certificates of pkcs7 recipients
+	// and when looking up the keys of pgp recipients
+	RecipientTrustFlags = []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "recipient-ca",
+			Usage: "A file with CA certificates that pkcs7 recipient certificates must chain to; this option may be provided multiple times",
+		}, cli.BoolFlag{
+			Name:  "insecure-allow-unverified-recipient",
+			Usage: "Accept pkcs7 recipient certificates that are expired or do not chain to a CA given with --recipient-ca",
+		}, cli.DurationFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "Warn about pkcs7 and x509 recipient certificates expiring within this duration, 720h by default",
+		}, cli.BoolFlag{
+			Name:  "strict-cert-expiry",
+			Usage: "Refuse pkcs7 and x509 recipient certificates expiring within --cert-expiry-warning instead of warning about them",
+		}, cli.StringSliceFlag{
+			Name:  "pgp-key-lookup",
+			Usage: "Where to look up the keys of pgp recipients missing from the GPG keyring: \"wkd\" or the hkps:// URL of a keyserver; this option may be provided multiple times",
+		}, cli.StringSliceFlag{
+			Name:  "pgp-fingerprint",
+			Usage: "The fingerprint of a looked up pgp recipient key to use without confirmation; this option may be provided multiple times",
+		},
+	}
+
+	// ImageVerifyFlags are cli flags needed when verifying the signature of an image before its use
+	ImageVerifyFlags = []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "verify-key",
+			Usage: "A public key that the cosign signature of the image must be made with; this option may be provided multiple times",
+		}, cli.StringFlag{
+			Name:  "verify-command",
+			Usage: "A command, such as \"notation verify\", that must succeed when run with the digest reference of the image",
+		},
+	}
+
+	// ImagePolicyFlags are cli flags needed when checking the use of an image against a policy
+	ImagePolicyFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "policy",
+			Usage: "A policy file with rules on the encryption of images that must be met to use them",
 		},
 	}
 )
@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	"bufio"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/profiles"
+	"github.com/containerd/imgcrypt/images/crypt"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/urfave/cli"
+)
+
+var batchFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "from-file",
+		Usage: "Read the names of the images from a file with one name per line; use - for stdin",
+	}, cli.StringSliceFlag{
+		Name:  "filter",
+		Usage: "Select the images matching the filter, e.g. 'labels.\"env\"==prod'; this option may be provided multiple times, and the images must match all filters",
+	}, cli.IntFlag{
+		Name:  "concurrency",
+		Usage: "The maximum number of images to process concurrently",
+		Value: 4,
+	}, cli.StringFlag{
+		Name:  "suffix",
+		Usage: "Store the resulting images under their name with this suffix appended instead of replacing them",
+	}, cli.StringSliceFlag{
+		Name:  "platform",
+		Usage: "For which platform to process the images; by default all platforms are processed",
+	},
+}
+
+var encryptBatchCommand = cli.Command{
+	Name:      "encrypt-batch",
+	Usage:     "encrypt many images locally",
+	ArgsUsage: "[flags] [<local>, ...]",
+	Description: `Encrypt many images locally with the same recipients.
+
+	The images are given as arguments, read from a file with --from-file, or
+	selected with --filter; images selected with several --filter options
+	must match all of them. All layers of the images are encrypted, re-wrapping
+	the keys of layers that are already encrypted, which requires the private
+	keys passed with --key. By default each image is replaced with its encrypted
+	version.
+	A summary of the results is printed once all images have been processed.
+
+	If no --recipient is given, each image is encrypted for the default
+	recipients that the registries section of the configuration file sets for
+	its repository, or for those of the new name if --suffix is given.
+`,
+	Flags: append(append(append(commands.RegistryFlags, cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "Recipient of the images is the person who can decrypt them (i.e. jwe:/path/to/key)",
+	}), batchFlags...), append(flags.ImageDecryptionFlags, flags.RecipientTrustFlags...)...),
+	Action: func(context *cli.Context) error {
+		if len(ParseEncArgs(context).Recipient) == 0 && len(profiles.ConfigFromContext(context).Registries) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		return runBatch(context, true)
+	},
+}
+
+var decryptBatchCommand = cli.Command{
+	Name:      "decrypt-batch",
+	Usage:     "decrypt many images locally",
+	ArgsUsage: "[flags] [<local>, ...]",
+	Description: `Decrypt many images locally with the same keys.
+
+	The images are given as arguments, read from a file with --from-file, or
+	selected with --filter; images selected with several --filter options
+	must match all of them. By default each image is replaced with its decrypted
+	version.
+	A summary of the results is printed once all images have been processed.
+`,
+	Flags: append(append(commands.RegistryFlags, batchFlags...), flags.ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		return runBatch(context, false)
+	},
+}
+
+// batchResult holds the outcome of processing one image of a batch
+type batchResult struct {
+	name    string
+	newName string
+	status  string
+	err     error
+}
+
+// runBatch encrypts or decrypts all images selected on the command line
+func runBatch(context *cli.Context, encrypt bool) error {
+	client, ctx, cancel, err := commands.NewClient(context)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	if encrypt {
+		if ctx, err = withLayerCompression(ctx, context); err != nil {
+			return err
+		}
+	}
+
+	names, err := getBatchImageNames(client, ctx, context)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("no images given -- nothing to do")
+	}
+
+	concurrency := context.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d", concurrency)
+	}
+
+	var (
+		sem     = semaphore.NewWeighted(int64(concurrency))
+		wg      sync.WaitGroup
+		results = make([]batchResult, len(names))
+		args    = ParseEncArgs(context)
+	)
+	if args.PasswordPrompt != nil {
+		args.PasswordPrompt = img.CachingPasswordPrompt(args.PasswordPrompt)
+	}
+	if args.PINPrompt != nil {
+		args.PINPrompt = img.CachingPINPrompt(args.PINPrompt)
+	}
+	for i, name := range names {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer sem.Release(1)
+			defer wg.Done()
+			imgArgs := args
+			if encrypt {
+				var err error
+				imgArgs, _, err = RegistryEncArgs(context, args, name+context.String("suffix"))
+				if err == nil && len(imgArgs.Recipient) == 0 {
+					err = errors.New("no recipients given and no registry defaults match")
+				}
+				if err != nil {
+					results[i] = batchResult{name: name, err: err}
+					return
+				}
+			}
+			results[i] = batchCryptImage(client, ctx, imgArgs, name, context.String("suffix"), context.StringSlice("platform"), encrypt)
+		}(i, name)
+	}
+	wg.Wait()
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tRESULT\tSTATUS\t\n")
+	for _, r := range results {
+		status := r.status
+		if r.err != nil {
+			failed++
+			status = r.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", r.name, r.newName, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(results))
+	}
+	return nil
+}
+
+// batchCryptImage encrypts or decrypts all layers of a single image of a batch
+func batchCryptImage(client *containerd.Client, ctx gocontext.Context, args parsehelpers.EncArgs, name, suffix string, platformList []string, encrypt bool) batchResult {
+	r := batchResult{name: name}
+	if suffix != "" {
+		r.newName = name + suffix
+	}
+
+	_, descs, err := getImageLayerInfos(client, ctx, name, nil, platformList)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	orig, err := client.ImageService().Get(ctx, name)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	var cc encconfig.CryptoConfig
+	if encrypt {
+		cc, err = parsehelpers.CreateCryptoConfig(args, descs)
+	} else {
+		cc, err = parsehelpers.CreateDecryptCryptoConfig(args, descs)
+	}
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+
+	newImage, err := cryptImage(client, ctx, name, r.newName, &cc, nil, platformList, encrypt)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	r.newName = newImage.Name
+	if newImage.Target.Digest == orig.Target.Digest {
+		r.status = "unchanged"
+	} else if encrypt {
+		r.status = "encrypted"
+	} else {
+		r.status = "decrypted"
+	}
+	return r
+}
+
+// getBatchImageNames returns the names of the images given as arguments, in the file
+// passed with --from-file and matching all the filters passed with --filter
+func getBatchImageNames(client *containerd.Client, ctx gocontext.Context, context *cli.Context) ([]string, error) {
+	var names []string
+	seen := map[string]struct{}{}
+	add := func(name string) {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range context.Args() {
+		add(name)
+	}
+
+	if fileName := context.String("from-file"); fileName != "" {
+		f := os.Stdin
+		if fileName != "-" {
+			var err error
+			f, err = os.Open(fileName)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			add(line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", fileName, err)
+		}
+	}
+
+	if filters := context.StringSlice("filter"); len(filters) > 0 {
+		imgs, err := crypt.SelectImages(ctx, client.ImageService(), filters...)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range imgs {
+			add(img.Name)
+		}
+	}
+	return names, nil
+}
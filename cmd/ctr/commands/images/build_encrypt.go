@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/images/crypt"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/urfave/cli"
+)
+
+var buildEncryptCommand = cli.Command{
+	Name:      "build-encrypt",
+	Usage:     "build an image with BuildKit and store it encrypted",
+	ArgsUsage: "[flags] <name> [-- <buildctl build flags>...]",
+	Description: `Build an image with BuildKit and encrypt it before it is stored.
+
+	The flags after -- are passed to 'buildctl build', whose result is read as
+	an OCI image archive from its standard output. The archive is unpacked into
+	a temporary OCI image layout outside of containerd, the image is encrypted
+	there and only the encrypted image is stored in containerd under <name>, so
+	no plaintext image is ever created in the content store. The temporary
+	directory is removed afterwards; use --tmp-dir to keep it on a tmpfs.
+
+	ctr-enc images build-encrypt --recipient jwe:pubkey.pem docker.io/library/app:enc \
+	    -- --frontend dockerfile.v0 --local context=. --local dockerfile=.
+
+	With --input the OCI image archive is read from a file, or from the standard
+	input if it is -, instead of running buildctl:
+
+	docker buildx build --output type=oci,dest=- . | \
+	    ctr-enc images build-encrypt --input - --recipient jwe:pubkey.pem docker.io/library/app:enc
+
+	With --to-oci-layout the encrypted image is written to an OCI image layout
+	directory instead of containerd.
+
+	Recipients are given as for 'ctr-enc images encrypt'. If no --recipient is
+	given, the image is encrypted for the default recipients that the registries
+	section of the configuration file sets for the repository of <name>.
+`,
+	Flags: append(append(commands.RegistryFlags, cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "Recipient of the image is the person who can decrypt it in the form specified for encrypt (i.e. jwe:/path/to/key)",
+	}, cli.IntSliceFlag{
+		Name:  "layer",
+		Usage: "The layer to encrypt; this must be either the layer number or a negative number starting with -1 for topmost layer",
+	}, cli.StringSliceFlag{
+		Name:  "platform",
+		Usage: "For which platform to encrypt; by default encrytion is done for all platforms",
+	}, cli.StringFlag{
+		Name:  "input",
+		Usage: "Read the OCI image archive of the build result from a file, or from the standard input if -, instead of running buildctl",
+	}, cli.StringFlag{
+		Name:  "buildctl",
+		Usage: "The buildctl binary to run",
+		Value: "buildctl",
+	}, cli.StringFlag{
+		Name:  "buildkit-addr",
+		Usage: "The address of buildkitd passed to buildctl",
+	}, cli.StringFlag{
+		Name:  "tmp-dir",
+		Usage: "Directory for the temporary OCI image layout; by default the directory for temporary files is used",
+	}, cli.StringFlag{
+		Name:  "to-oci-layout",
+		Usage: "OCI image layout directory to write the encrypted image to instead of containerd",
+	}), append(flags.ImageDecryptionFlags, flags.RecipientTrustFlags...)...),
+	Action: func(context *cli.Context) error {
+		name := context.Args().First()
+		if name == "" {
+			return errors.New("please provide the name of the encrypted image")
+		}
+		buildArgs := context.Args().Tail()
+		if len(buildArgs) > 0 && buildArgs[0] == "--" {
+			buildArgs = buildArgs[1:]
+		}
+		input := context.String("input")
+		if input != "" && len(buildArgs) > 0 {
+			return errors.New("buildctl flags cannot be used together with --input")
+		}
+
+		args, defaults, err := RegistryEncArgs(context, ParseEncArgs(context), name)
+		if err != nil {
+			return err
+		}
+		if len(args.Recipient) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		if defaults != nil {
+			fmt.Printf("Encrypting for the default recipients of %s: %s\n", defaults.Match, strings.Join(defaults.Recipients, ", "))
+		}
+		pl, err := parsePlatformArray(context.StringSlice("platform"))
+		if err != nil {
+			return err
+		}
+		opts := crypt.Options{
+			EncArgs:   args,
+			Layers:    img.IntToInt32Array(context.IntSlice("layer")),
+			Platforms: pl,
+		}
+
+		var (
+			r     io.Reader
+			build *exec.Cmd
+		)
+		switch input {
+		case "":
+			buildctl := []string{"build"}
+			if addr := context.String("buildkit-addr"); addr != "" {
+				buildctl = []string{"--addr", addr, "build"}
+			}
+			buildctl = append(append(buildctl, buildArgs...), "--output", "type=oci,dest=-")
+			build = exec.Command(context.String("buildctl"), buildctl...)
+			build.Stderr = os.Stderr
+			stdout, err := build.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			if err := build.Start(); err != nil {
+				return fmt.Errorf("failed to run buildctl: %w", err)
+			}
+			defer func() {
+				_ = build.Process.Kill()
+				_ = build.Wait()
+			}()
+			r = stdout
+		case "-":
+			r = os.Stdin
+		default:
+			f, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		// waitBuild returns the error of the build once its output was read
+		waitBuild := func() error {
+			if build == nil {
+				return nil
+			}
+			// buildctl may still write the padding of the archive
+			_, _ = io.Copy(io.Discard, r)
+			if err := build.Wait(); err != nil {
+				return fmt.Errorf("buildctl failed: %w", err)
+			}
+			return nil
+		}
+
+		if dir := context.String("to-oci-layout"); dir != "" {
+			l, err := ocilayout.Open(dir)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			ctx, cancel := commands.AppContext(context)
+			defer cancel()
+			desc, err := crypt.EncryptArchive(ctx, r, context.String("tmp-dir"), l, opts)
+			if err != nil {
+				return err
+			}
+			if err := waitBuild(); err != nil {
+				return err
+			}
+			if err := l.Tag(name, desc); err != nil {
+				return err
+			}
+			fmt.Printf("Stored encrypted image %s in %s\n", name, dir)
+			return nil
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+		var desc ocispec.Descriptor
+		if desc, err = crypt.EncryptArchive(ctx, r, context.String("tmp-dir"), client.ContentStore(), opts); err != nil {
+			return err
+		}
+		if err := waitBuild(); err != nil {
+			return err
+		}
+		if err := createImage(ctx, client.ImageService(), images.Image{Name: name, Target: desc}); err != nil {
+			return err
+		}
+		fmt.Printf("Stored encrypted image %s\n", name)
+		return nil
+	},
+}
@@ -0,0 +1,419 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/images/encryption/transports"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/urfave/cli"
+)
+
+var copyCommand = cli.Command{
+	Name:      "copy",
+	Aliases:   []string{"cp"},
+	Usage:     "copy an image between namespaces, OCI image layouts, registries and other transports",
+	ArgsUsage: "[flags] <source> [<destination>]",
+	Description: `Copy an image between containerd namespaces or between containerd and an
+	OCI image layout directory.
+
+	The blobs of the image are copied as they are, so encrypted layers stay
+	encrypted, their annotations are preserved and no keys are needed. The
+	digest of each blob is verified while it is copied. The destination name
+	defaults to the source name.
+
+	By default the image is read from and written to the namespace given with
+	--namespace. Use --from-namespace or --from-oci-layout to read it from
+	another namespace or an OCI image layout, and --to-namespace or
+	--to-oci-layout to write it to another namespace or an OCI image layout,
+	which is created if it does not exist:
+
+	ctr-enc images copy --to-namespace prod docker.io/library/app:enc
+	ctr-enc images copy --to-oci-layout /mnt/usb/images docker.io/library/app:enc
+	ctr-enc images copy --from-oci-layout /mnt/usb/images docker.io/library/app:enc
+
+	The source and destination may also be given as the transport strings of
+	skopeo and podman, so that images are copied between them and containerd
+	without importing them first:
+
+	docker://<reference>        an image in a registry, reached with the registry flags
+	oci:<path>[:<ref>]          an image in an OCI image layout
+	dir:<path>                  an image in a directory as written by skopeo
+	containers-storage:<ref>    an image in the storage of podman and CRI-O, through --skopeo
+	docker-daemon:<ref>         an image of the local Docker engine, as a source only
+
+	Names without a transport refer to images in containerd, in the namespaces
+	given above. With --encrypt the selected layers are encrypted for the
+	recipients given with --recipient on the way, and with --decrypt they are
+	decrypted with the keys given with --key. The image is then changed in a
+	temporary OCI image layout in --tmp-dir, so that the plaintext image never
+	reaches the destination:
+
+	ctr-enc images copy docker://docker.io/library/app:latest oci:/mnt/usb/images:latest
+	ctr-enc images copy --encrypt --recipient jwe:pubkey.pem oci:/build/out:latest docker://registry.example.com/app:enc
+	ctr-enc images copy --decrypt --key privkey.pem docker://registry.example.com/app:enc containers-storage:app:latest
+
+	Since container storage keeps layers unpacked, encrypted layers can only be
+	written to it if skopeo can decrypt them; decrypt them with --decrypt
+	instead.
+`,
+	Flags: append(append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "from-namespace",
+			Usage: "Namespace to read the image from",
+		},
+		cli.StringFlag{
+			Name:  "from-oci-layout",
+			Usage: "OCI image layout directory to read the image from",
+		},
+		cli.StringFlag{
+			Name:  "to-namespace",
+			Usage: "Namespace to write the image to",
+		},
+		cli.StringFlag{
+			Name:  "to-oci-layout",
+			Usage: "OCI image layout directory to write the image to",
+		},
+		cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "Copy the manifests of a specific platform; by default those of the local platform are copied",
+			Value: &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Copy the manifests of all platforms",
+		},
+		cli.BoolFlag{
+			Name:  "encrypt",
+			Usage: "Encrypt the selected layers for the recipients while copying the image",
+		},
+		cli.BoolFlag{
+			Name:  "decrypt",
+			Usage: "Decrypt the selected layers with the keys while copying the image",
+		},
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "Recipient of the image encrypted with --encrypt in the form of the encrypt command (i.e. jwe:/path/to/key)",
+		},
+		cli.IntSliceFlag{
+			Name:  "layer",
+			Usage: "The layer to encrypt or decrypt; this must be either the layer number or a negative number starting with -1 for topmost layer",
+		},
+		cli.StringFlag{
+			Name:  "skopeo",
+			Usage: "The skopeo binary that copies containers-storage: images",
+			Value: "skopeo",
+		},
+		cli.StringFlag{
+			Name:  "docker-host",
+			Usage: "Address of the Docker engine that docker-daemon: images are read from; by default DOCKER_HOST or unix:///var/run/docker.sock",
+		},
+		cli.StringFlag{
+			Name:  "tmp-dir",
+			Usage: "Directory for the temporary OCI image layouts images are staged and changed in; by default the directory for temporary files is used",
+		},
+	}, commands.RegistryFlags...), append(flags.ImageDecryptionFlags, flags.RecipientTrustFlags...)...),
+	Action: func(context *cli.Context) error {
+		name := context.Args().First()
+		if name == "" {
+			return errors.New("please provide the name of an image to copy")
+		}
+		newName := context.Args().Get(1)
+		useTransports := transports.HasTransport(name) || transports.HasTransport(newName) || context.Bool("encrypt") || context.Bool("decrypt")
+		if newName == "" {
+			if transports.HasTransport(name) {
+				return errors.New("please provide the destination of the image")
+			}
+			newName = name
+		}
+		if context.String("from-namespace") != "" && context.String("from-oci-layout") != "" {
+			return errors.New("--from-namespace and --from-oci-layout cannot be used together")
+		}
+		if context.String("to-namespace") != "" && context.String("to-oci-layout") != "" {
+			return errors.New("--to-namespace and --to-oci-layout cannot be used together")
+		}
+
+		if context.Bool("encrypt") && context.Bool("decrypt") {
+			return errors.New("--encrypt and --decrypt cannot be used together")
+		}
+
+		var platform platforms.MatchComparer
+		pl, err := parsePlatformArray(context.StringSlice("platform"))
+		if err != nil {
+			return err
+		}
+		if !context.Bool("all-platforms") {
+			if len(pl) > 0 {
+				platform = platforms.Any(pl...)
+			} else {
+				platform = platforms.DefaultStrict()
+			}
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		if useTransports {
+			return copyWithTransports(client, ctx, context, name, newName, platform, pl)
+		}
+
+		var (
+			src    content.Provider
+			target ocispec.Descriptor
+		)
+		if dir := context.String("from-oci-layout"); dir != "" {
+			l, err := ocilayout.Open(dir)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			if target, err = l.Resolve(name); err != nil {
+				return err
+			}
+			src = l
+		} else {
+			srcCtx := ctx
+			if ns := context.String("from-namespace"); ns != "" {
+				srcCtx = namespaces.WithNamespace(ctx, ns)
+				src = &namespacedProvider{client.ContentStore(), ns}
+			} else {
+				src = client.ContentStore()
+			}
+			image, err := client.ImageService().Get(srcCtx, name)
+			if err != nil {
+				return err
+			}
+			target = image.Target
+		}
+
+		if dir := context.String("to-oci-layout"); dir != "" {
+			l, err := ocilayout.Open(dir)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			n, err := imgenc.CopyImage(ctx, src, l, target, platform)
+			if err != nil {
+				return err
+			}
+			if err := l.Tag(newName, target); err != nil {
+				return err
+			}
+			fmt.Printf("Copied %s to %s in %s (%d blobs)\n", name, newName, dir, n)
+			return nil
+		}
+
+		if ns := context.String("to-namespace"); ns != "" {
+			ctx = namespaces.WithNamespace(ctx, ns)
+		}
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+		n, err := imgenc.CopyImage(ctx, src, client.ContentStore(), target, platform)
+		if err != nil {
+			return err
+		}
+		if err := createImage(ctx, client.ImageService(), images.Image{Name: newName, Target: target}); err != nil {
+			return err
+		}
+		ns, _ := namespaces.Namespace(ctx)
+		fmt.Printf("Copied %s to %s in namespace %s (%d blobs)\n", name, newName, ns, n)
+		return nil
+	},
+}
+
+// copyWithTransports copies the image between the given transport strings or
+// names of images in containerd, encrypting or decrypting it on the way with
+// --encrypt or --decrypt
+func copyWithTransports(client *containerd.Client, ctx gocontext.Context, context *cli.Context, name, newName string, platform platforms.MatchComparer, pl []ocispec.Platform) error {
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+	topts := transports.Options{
+		Resolver:   resolver,
+		Skopeo:     context.String("skopeo"),
+		DockerHost: context.String("docker-host"),
+		TmpDir:     context.String("tmp-dir"),
+	}
+	srcNS := context.String("from-namespace")
+	if srcNS == "" {
+		srcNS, _ = namespaces.Namespace(ctx)
+	}
+	if ns := context.String("to-namespace"); ns != "" {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer done(ctx)
+
+	var src transports.Source
+	if ref, err := copyReference(name, context.String("from-oci-layout")); err != nil {
+		return err
+	} else if ref != nil {
+		if src, err = transports.NewSource(ctx, *ref, topts); err != nil {
+			return err
+		}
+	} else {
+		image, err := client.ImageService().Get(namespaces.WithNamespace(ctx, srcNS), name)
+		if err != nil {
+			return err
+		}
+		src = &containerdSource{Provider: &namespacedProvider{client.ContentStore(), srcNS}, target: image.Target}
+	}
+	defer src.Close()
+
+	var dst transports.Destination
+	if ref, err := copyReference(newName, context.String("to-oci-layout")); err != nil {
+		return err
+	} else if ref != nil {
+		if dst, err = transports.NewDestination(ctx, *ref, topts); err != nil {
+			return err
+		}
+	} else {
+		dst = &containerdDestination{client: client, name: newName}
+	}
+	defer dst.Close()
+
+	copts := transports.CopyOptions{Platform: platform, TmpDir: context.String("tmp-dir")}
+	args := ParseEncArgs(context)
+	opts := crypt.Options{
+		EncArgs:   args,
+		Layers:    img.IntToInt32Array(context.IntSlice("layer")),
+		Platforms: pl,
+	}
+	var desc ocispec.Descriptor
+	switch {
+	case context.Bool("encrypt"):
+		if len(args.Recipient) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		desc, err = crypt.EncryptCopy(ctx, src, dst, copts, opts)
+	case context.Bool("decrypt"):
+		desc, err = crypt.DecryptCopy(ctx, src, dst, copts, opts)
+	default:
+		desc, err = transports.Copy(ctx, src, dst, copts)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %s to %s (%s)\n", name, newName, desc.Digest)
+	return nil
+}
+
+// copyReference returns the reference of the transport string s, or of the
+// image named s in the OCI image layout in dir if given, or nil for the name
+// of an image in containerd
+func copyReference(s, dir string) (*transports.Reference, error) {
+	if transports.HasTransport(s) {
+		if dir != "" {
+			return nil, fmt.Errorf("%s cannot be used with an OCI image layout flag", s)
+		}
+		ref, err := transports.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		return &ref, nil
+	}
+	if dir != "" {
+		return &transports.Reference{Transport: transports.OCI, Path: dir, Name: s}, nil
+	}
+	return nil, nil
+}
+
+// containerdSource is an image in containerd to copy with the transports
+type containerdSource struct {
+	content.Provider
+	target ocispec.Descriptor
+}
+
+func (s *containerdSource) Target(ctx gocontext.Context) (ocispec.Descriptor, error) {
+	return s.target, nil
+}
+
+func (s *containerdSource) Close() error {
+	return nil
+}
+
+// containerdDestination stores an image copied with the transports in
+// containerd; the context of Put must hold a lease
+type containerdDestination struct {
+	client *containerd.Client
+	name   string
+}
+
+func (d *containerdDestination) Put(ctx gocontext.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error {
+	var m platforms.Matcher
+	if platform != nil {
+		m = platform
+	}
+	if _, err := imgenc.CopyImage(ctx, src, d.client.ContentStore(), desc, m); err != nil {
+		return err
+	}
+	return createImage(ctx, d.client.ImageService(), images.Image{Name: d.name, Target: desc})
+}
+
+func (d *containerdDestination) Close() error {
+	return nil
+}
+
+// namespacedProvider reads blobs from the content store in a fixed namespace
+type namespacedProvider struct {
+	content.Provider
+	namespace string
+}
+
+func (p *namespacedProvider) ReaderAt(ctx gocontext.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return p.Provider.ReaderAt(namespaces.WithNamespace(ctx, p.namespace), desc)
+}
+
+// createImage creates the image or updates the target of an existing image
+// with its name
+func createImage(ctx gocontext.Context, is images.Store, image images.Image) error {
+	if _, err := is.Create(ctx, image); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		if _, err := is.Update(ctx, image, "target"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,235 +18,401 @@ package images
 
 import (
 	gocontext "context"
-
+	"crypto"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/profiles"
+	"github.com/containerd/imgcrypt/images/crypt"
 	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/policy"
+	"github.com/containerd/imgcrypt/images/encryption/provenance"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
 	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
 	"github.com/urfave/cli"
 
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// LayerInfo holds information about an image layer
-type LayerInfo struct {
-	// The Number of this layer in the sequence; starting at 0
-	Index      uint32
-	Descriptor ocispec.Descriptor
+// cryptImage encrypts or decrypts an image with the given name and stores it either under the newName
+// or updates the existing one; the wrapped keys stored in a referrer of the image are used if there are any
+func cryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string, encrypt bool) (images.Image, error) {
+	pl, err := parsePlatformArray(platformList)
+	if err != nil {
+		return images.Image{}, err
+	}
+	image, err := client.ImageService().Get(ctx, name)
+	if err != nil {
+		return images.Image{}, err
+	}
+	target, hasKeys, err := keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	if hasKeys {
+		return crypt.ChangeImage(ctx, client, name, crypt.Options{NewName: newName, Layers: layers, Platforms: pl}, func(ctx gocontext.Context, cs content.Store, _ ocispec.Descriptor, lf imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+			if encrypt {
+				return imgenc.EncryptImage(ctx, cs, target, cc, lf)
+			}
+			return imgenc.DecryptImage(ctx, cs, target, cc, lf)
+		})
+	}
+	opts := crypt.Options{NewName: newName, CryptoConfig: cc, Layers: layers, Platforms: pl}
+	if encrypt {
+		return crypt.EncryptImage(ctx, client, name, opts)
+	}
+	return crypt.DecryptImage(ctx, client, name, opts)
 }
 
-// isUserSelectedLayer checks whether a layer is user-selected given its number
-// A layer can be described with its (positive) index number or its negative number.
-// The latter is counted relative to the topmost one (-1), the former relative to
-// the bottommost one (0).
-func isUserSelectedLayer(layerIndex, layersTotal int32, layers []int32) bool {
-	if len(layers) == 0 {
-		// convenience for the user; none given means 'all'
-		return true
-	}
-	negNumber := layerIndex - layersTotal
+func encryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string) (images.Image, error) {
+	return cryptImage(client, ctx, name, newName, cc, layers, platformList, true)
+}
 
-	for _, l := range layers {
-		if l == negNumber || l == layerIndex {
-			return true
-		}
-	}
-	return false
+func decryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string) (images.Image, error) {
+	return cryptImage(client, ctx, name, newName, cc, layers, platformList, false)
 }
 
-// isUserSelectedPlatform determines whether the platform matches one in
-// the array of user-provided platforms
-func isUserSelectedPlatform(platform *ocispec.Platform, platformList []ocispec.Platform) bool {
-	if len(platformList) == 0 {
-		// convenience for the user; none given means 'all'
-		return true
-	}
-	matcher := platforms.NewMatcher(*platform)
+// deletePlaintext removes the plaintext image orig, unless it was replaced by its encrypted
+// version, and deletes all of its blobs that are not referenced by any other image
+func deletePlaintext(client *containerd.Client, ctx gocontext.Context, orig images.Image, newName string) error {
+	s := client.ImageService()
 
-	for _, platform := range platformList {
-		if matcher.Match(platform) {
-			return true
+	if newName != "" && newName != orig.Name {
+		if err := s.Delete(ctx, orig.Name); err != nil {
+			return err
 		}
 	}
-	return false
-}
 
-func createLayerFilter(client *containerd.Client, ctx gocontext.Context, desc ocispec.Descriptor, layers []int32, platformList []ocispec.Platform) (imgenc.LayerFilter, error) {
-	alldescs, err := img.GetImageLayerDescriptors(ctx, client.ContentStore(), desc)
+	deleted, err := imgenc.DeleteImageResidue(ctx, client.ContentStore(), imgenc.LeaseGarbageCollector(client.LeasesService()), orig.Target)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	_, descs := filterLayerDescriptors(alldescs, layers, platformList)
-
-	lf := func(d ocispec.Descriptor) bool {
-		for _, desc := range descs {
-			if desc.Digest.String() == d.Digest.String() {
-				return true
-			}
-		}
-		return false
-	}
-	return lf, nil
+	fmt.Printf("Deleted %d plaintext blobs\n", len(deleted))
+	return nil
 }
 
-// cryptImage encrypts or decrypts an image with the given name and stores it either under the newName
-// or updates the existing one
-func cryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string, encrypt bool) (images.Image, error) {
+func getImageLayerInfos(client *containerd.Client, ctx gocontext.Context, name string, layers []int32, platformList []string) ([]crypt.Layer, []ocispec.Descriptor, error) {
 	s := client.ImageService()
 
 	image, err := s.Get(ctx, name)
 	if err != nil {
-		return images.Image{}, err
+		return nil, nil, err
 	}
 
 	pl, err := parsePlatformArray(platformList)
 	if err != nil {
-		return images.Image{}, err
+		return nil, nil, err
 	}
 
-	lf, err := createLayerFilter(client, ctx, image.Target, layers, pl)
+	target, _, err := keysidecar.Resolve(ctx, s, client.ContentStore(), image)
 	if err != nil {
-		return images.Image{}, err
+		return nil, nil, err
 	}
 
-	var (
-		modified bool
-		newSpec  ocispec.Descriptor
-	)
-
-	ctx, done, err := client.WithLease(ctx)
+	alldescs, err := crypt.ImageLayers(ctx, client.ContentStore(), target)
 	if err != nil {
-		return images.Image{}, err
+		return nil, nil, err
 	}
-	defer done(ctx)
 
-	if encrypt {
-		newSpec, modified, err = imgenc.EncryptImage(ctx, client.ContentStore(), image.Target, cc, lf)
-	} else {
-		newSpec, modified, err = imgenc.DecryptImage(ctx, client.ContentStore(), image.Target, cc, lf)
-	}
-	if err != nil {
-		return image, err
-	}
-	if !modified {
-		return image, nil
+	lis := crypt.SelectLayers(alldescs, layers, pl)
+	descs := make([]ocispec.Descriptor, 0, len(lis))
+	for i := range lis {
+		// the wrapped keys of layers with many recipients may be in a key blob
+		if lis[i].Descriptor, err = imgenc.ExpandKeys(ctx, client.ContentStore(), lis[i].Descriptor); err != nil {
+			return nil, nil, err
+		}
+		descs = append(descs, lis[i].Descriptor)
 	}
+	return lis, descs, nil
+}
 
-	image.Target = newSpec
+// parsePlatformArray parses an array of specifiers and converts them into an array of specs.Platform
+func parsePlatformArray(specifiers []string) ([]ocispec.Platform, error) {
+	var speclist []ocispec.Platform
 
-	// if newName is either empty or equal to the existing name, it's an update
-	if newName == "" || strings.Compare(image.Name, newName) == 0 {
-		// first Delete the existing and then Create a new one
-		// We have to do it this way since we have a newSpec!
-		err = s.Delete(ctx, image.Name)
+	for _, specifier := range specifiers {
+		spec, err := platforms.Parse(specifier)
 		if err != nil {
-			return images.Image{}, err
+			return []ocispec.Platform{}, err
 		}
-		newName = image.Name
+		speclist = append(speclist, spec)
 	}
-
-	image.Name = newName
-	return s.Create(ctx, image)
+	return speclist, nil
 }
 
-func encryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string) (images.Image, error) {
-	return cryptImage(client, ctx, name, newName, cc, layers, platformList, true)
+// LoadPolicy loads the authorization policy passed with --policy, if any
+func LoadPolicy(context *cli.Context) (*policy.Policy, error) {
+	path := context.String("policy")
+	if path == "" {
+		return nil, nil
+	}
+	return policy.Load(path)
 }
 
-func decryptImage(client *containerd.Client, ctx gocontext.Context, name, newName string, cc *encconfig.CryptoConfig, layers []int32, platformList []string) (images.Image, error) {
-	return cryptImage(client, ctx, name, newName, cc, layers, platformList, false)
+// LoadVerifier creates the verifier of image signatures passed with --verify-key and
+// --verify-command, if any
+func LoadVerifier(context *cli.Context) (signature.Verifier, error) {
+	var verifiers signature.Verifiers
+	if paths := context.StringSlice("verify-key"); len(paths) > 0 {
+		keys, err := signature.LoadCosignKeys(paths)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, signature.CosignVerifier{Keys: keys})
+	}
+	if command := strings.Fields(context.String("verify-command")); len(command) > 0 {
+		verifiers = append(verifiers, signature.CommandVerifier{Command: command})
+	}
+	if len(verifiers) == 0 {
+		return nil, nil
+	}
+	return verifiers, nil
 }
 
-func getImageLayerInfos(client *containerd.Client, ctx gocontext.Context, name string, layers []int32, platformList []string) ([]LayerInfo, []ocispec.Descriptor, error) {
-	s := client.ImageService()
-
-	image, err := s.Get(ctx, name)
+// loadSigningKey loads the key passed with --sign-key in the form <filename>[:<password>]
+// and asks for its password if needed
+func loadSigningKey(context *cli.Context) (crypto.Signer, error) {
+	parts := strings.SplitN(context.String("sign-key"), ":", 2)
+	data, err := os.ReadFile(parts[0])
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("unable to read signing key: %w", err)
 	}
-
-	pl, err := parsePlatformArray(platformList)
-	if err != nil {
-		return nil, nil, err
+	var password []byte
+	if len(parts) == 2 {
+		password, err = parsehelpers.ParsePassword(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := signature.LoadSigningKey(data, password)
+	prompt := ParseEncArgs(context).PasswordPrompt
+	for i := 0; encutils.IsPasswordError(err) && prompt != nil && i < 3; i++ {
+		password, err = prompt(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		key, err = signature.LoadSigningKey(data, password)
 	}
+	return key, err
+}
 
-	alldescs, err := img.GetImageLayerDescriptors(ctx, client.ContentStore(), image.Target)
+// signImage signs the encrypted image; if signing fails, the encrypted image is removed or,
+// if it replaced the original image, the original image is restored
+func signImage(client *containerd.Client, ctx gocontext.Context, encImage, orig images.Image, signer crypto.Signer) error {
+	ctx, done, err := client.WithLease(ctx)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	defer done(ctx)
 
-	lis, descs := filterLayerDescriptors(alldescs, layers, pl)
-	return lis, descs, nil
+	sigImage, err := signature.CosignSign(ctx, client.ImageService(), client.ContentStore(), encImage, signer)
+	if err == nil {
+		fmt.Printf("Signed %s with signature image %s\n", encImage.Target.Digest, sigImage.Name)
+		return nil
+	}
+	removeEncrypted(client, ctx, encImage, orig)
+	return fmt.Errorf("failed to sign encrypted image: %w", err)
 }
 
-func countLayers(descs []ocispec.Descriptor, platform *ocispec.Platform) int32 {
-	c := int32(0)
+// attestImage attaches a provenance attestation by the encryptor to the encrypted image,
+// signed with the signer if any; if attaching fails, the encrypted image is removed or,
+// if it replaced the original image, the original image is restored
+func attestImage(client *containerd.Client, ctx gocontext.Context, encImage, orig images.Image, encryptor string, signer crypto.Signer) error {
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer done(ctx)
 
-	for _, desc := range descs {
-		if desc.Platform == platform {
-			c = c + 1
+	st, err := provenance.NewStatement(ctx, client.ImageService(), client.ContentStore(), encImage, encryptor)
+	if err == nil {
+		var env provenance.Envelope
+		if env, err = provenance.Seal(st, signer); err == nil {
+			var index images.Image
+			if index, err = provenance.Attach(ctx, client.ImageService(), client.ContentStore(), encImage, env); err == nil {
+				fmt.Printf("Attached provenance attestation to %s in %s\n", encImage.Target.Digest, index.Name)
+				return nil
+			}
 		}
 	}
-
-	return c
+	removeEncrypted(client, ctx, encImage, orig)
+	return fmt.Errorf("failed to attach provenance attestation: %w", err)
 }
 
-func filterLayerDescriptors(alldescs []ocispec.Descriptor, layers []int32, pl []ocispec.Platform) ([]LayerInfo, []ocispec.Descriptor) {
-	var (
-		layerInfos  []LayerInfo
-		descs       []ocispec.Descriptor
-		curplat     *ocispec.Platform
-		layerIndex  int32
-		layersTotal int32
-	)
+// storeKeys stores the wrapped keys of the encrypted image in a referrer of the image as set by
+// storage, removing them from its layers unless both are kept; if that fails, the encrypted image
+// is removed or, if it replaced the original image, the original image is restored
+func storeKeys(client *containerd.Client, ctx gocontext.Context, encImage, orig images.Image, storage keysidecar.Storage) (images.Image, error) {
+	if storage == keysidecar.StorageAnnotations {
+		return encImage, nil
+	}
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer done(ctx)
 
-	for _, desc := range alldescs {
-		if curplat != desc.Platform {
-			curplat = desc.Platform
-			layerIndex = 0
-			layersTotal = countLayers(alldescs, desc.Platform)
-		} else {
-			layerIndex = layerIndex + 1
-		}
+	image, index, err := attachKeys(ctx, client.ImageService(), client.ContentStore(), encImage, storage)
+	if err != nil {
+		removeEncrypted(client, ctx, encImage, orig)
+		return images.Image{}, fmt.Errorf("failed to store wrapped keys: %w", err)
+	}
+	fmt.Printf("Stored wrapped keys of %s in %s\n", image.Target.Digest, index.Name)
+	return image, nil
+}
 
-		if isUserSelectedLayer(layerIndex, layersTotal, layers) && isUserSelectedPlatform(curplat, pl) {
-			li := LayerInfo{
-				Index:      uint32(layerIndex),
-				Descriptor: desc,
+// attachKeys attaches the wrapped keys of the image in a referrer, after removing them from
+// its layers if they are stored in the referrer only, and returns the image and the referrers
+// index
+func attachKeys(ctx gocontext.Context, s images.Store, cs content.Store, image images.Image, storage keysidecar.Storage) (images.Image, images.Image, error) {
+	keys, err := keysidecar.Collect(ctx, cs, image.Target)
+	if err != nil {
+		return images.Image{}, images.Image{}, err
+	}
+	if storage == keysidecar.StorageReferrer {
+		target, modified, err := keysidecar.Strip(ctx, cs, image.Target)
+		if err != nil {
+			return images.Image{}, images.Image{}, err
+		}
+		if modified {
+			image.Target = target
+			if image, err = s.Update(ctx, image, "target"); err != nil {
+				return images.Image{}, images.Image{}, err
 			}
-			descs = append(descs, desc)
-			layerInfos = append(layerInfos, li)
 		}
 	}
-	return layerInfos, descs
+	index, err := keysidecar.Attach(ctx, s, cs, image, keys)
+	return image, index, err
 }
 
-// parsePlatformArray parses an array of specifiers and converts them into an array of specs.Platform
-func parsePlatformArray(specifiers []string) ([]ocispec.Platform, error) {
-	var speclist []ocispec.Platform
+// removeEncrypted removes the encrypted image or, if it replaced the original image,
+// restores the original image
+func removeEncrypted(client *containerd.Client, ctx gocontext.Context, encImage, orig images.Image) {
+	s := client.ImageService()
+	var err error
+	if encImage.Name == orig.Name {
+		_, err = s.Update(ctx, orig, "target")
+	} else {
+		err = s.Delete(ctx, encImage.Name)
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to remove encrypted image")
+	}
+}
 
-	for _, specifier := range specifiers {
-		spec, err := platforms.Parse(specifier)
-		if err != nil {
-			return []ocispec.Platform{}, err
-		}
-		speclist = append(speclist, spec)
+// VerifyForUnpack verifies the signature of the image before its layers are unpacked and
+// adds the cosign signatures to the payload so that the decryption tool can verify them too
+func VerifyForUnpack(ctx gocontext.Context, client *containerd.Client, context *cli.Context, image images.Image, platform platforms.MatchComparer, data *imgcrypt.Payload) error {
+	v, err := LoadVerifier(context)
+	if err != nil || v == nil {
+		return err
 	}
-	return speclist, nil
+	if err := v.Verify(ctx, client.ImageService(), client.ContentStore(), image); err != nil {
+		return err
+	}
+	if len(context.StringSlice("verify-key")) == 0 {
+		return nil
+	}
+	return signature.AddToPayload(ctx, client.ImageService(), client.ContentStore(), image, platform, data)
+}
+
+// PayloadAnnotations returns the annotations of the decoder payload set on the
+// command line, such as the tenant whose keys ctd-decoder uses
+func PayloadAnnotations(context *cli.Context) map[string]string {
+	if tenant := context.String("tenant"); tenant != "" {
+		return map[string]string{imgcrypt.PayloadAnnotationTenant: tenant}
+	}
+	return nil
+}
+
+// withLayerCompression returns a context in which plain layers are compressed
+// as set by --layer-compression, or by the selected profile, when they are
+// encrypted
+func withLayerCompression(ctx gocontext.Context, context *cli.Context) (gocontext.Context, error) {
+	name := profiles.FromContext(context).LayerCompression
+	if context.IsSet("layer-compression") {
+		name = context.String("layer-compression")
+	}
+	if name == "" {
+		return ctx, nil
+	}
+	c, err := imgenc.ParseLayerCompression(name)
+	if err != nil {
+		return nil, err
+	}
+	return imgenc.WithLayerCompression(ctx, c), nil
 }
 
+// ParseEncArgs returns the encryption arguments given on the command line combined
+// with those of the selected profile. Passwords of private keys, PINs of pkcs11 keys and
+// the confirmation of looked up PGP keys are asked for on the terminal unless --no-input
+// is given.
 func ParseEncArgs(context *cli.Context) parsehelpers.EncArgs {
-	return parsehelpers.EncArgs{
+	args := profiles.FromContext(context).Apply(parsehelpers.EncArgs{
 		GPGHomedir:   context.String("gpg-homedir"),
 		GPGVersion:   context.String("gpg-version"),
 		Key:          context.StringSlice("key"),
 		Recipient:    context.StringSlice("recipient"),
 		DecRecipient: context.StringSlice("dec-recipient"),
+
+		RecipientGroups: profiles.ConfigFromContext(context).Groups,
+
+		GPGAgent:            context.Bool("gpg-agent"),
+		GPGPassphraseSource: context.String("gpg-passphrase-source"),
+
+		KeyUsagePolicy: context.GlobalString("key-usage-policy"),
+
+		RecipientCA:              context.StringSlice("recipient-ca"),
+		AllowUnverifiedRecipient: context.Bool("insecure-allow-unverified-recipient"),
+		CertExpiryWarning:        context.Duration("cert-expiry-warning"),
+		StrictCertExpiry:         context.Bool("strict-cert-expiry"),
+		ReportCertificate:        printRecipientCertificate,
+
+		KeyLookup:      context.StringSlice("pgp-key-lookup"),
+		PGPFingerprint: context.StringSlice("pgp-fingerprint"),
+
+		EncryptionContext: context.StringSlice("encryption-context"),
+	})
+	if !context.GlobalBool("no-input") && img.CanPrompt() {
+		args.PasswordPrompt = img.KeyPasswordPrompt
+		args.PINPrompt = img.PINPrompt
+		args.ConfirmKey = img.ConfirmKeyPrompt
+	}
+	return args
+}
+
+// printRecipientCertificate prints the subject, alternative names and expiry of the
+// certificate of a pkcs7 or x509 recipient, and a warning if it expires soon
+func printRecipientCertificate(rc parsehelpers.RecipientCertificate) {
+	fmt.Printf("Recipient %s: %s\n", rc.Recipient, rc)
+	if rc.Expiring {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", rc.Warning(time.Now()))
+	}
+}
+
+// RegistryEncArgs returns args with the default recipients configured for the
+// destination of the image with the given name added, unless recipients were
+// given with --recipient; the matching entry is returned if they were added
+func RegistryEncArgs(context *cli.Context, args parsehelpers.EncArgs, name string) (parsehelpers.EncArgs, *profiles.RegistryDefaults, error) {
+	if len(context.StringSlice("recipient")) > 0 {
+		return args, nil, nil
+	}
+	d, err := profiles.ConfigFromContext(context).RegistryDefaults(name)
+	if err != nil || d == nil {
+		return args, nil, err
 	}
+	args.Recipient = append(append([]string{}, args.Recipient...), d.Recipients...)
+	return args, d, nil
 }
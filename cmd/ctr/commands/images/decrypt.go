@@ -45,6 +45,7 @@ var decryptCommand = cli.Command{
 	- <filename>:<password>
 	- <filename>:pass=<password>
 	- <filename>:fd=<file descriptor>
+	- <filename>:keychain=<name of the item in the OS keychain>
 	- <filename>:filename=<password file>
 `,
 	Flags: append(append(commands.RegistryFlags, cli.IntSliceFlag{
@@ -90,6 +91,7 @@ var decryptCommand = cli.Command{
 		if err != nil {
 			return err
 		}
+		defer parsehelpers.ReleaseCryptoConfig(&cc)
 
 		_, err = decryptImage(client, ctx, local, newName, &cc, layers32, context.StringSlice("platform"))
 
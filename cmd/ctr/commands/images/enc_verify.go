@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/interop"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/provenance"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
+	encconfig "github.com/gobars/ocicrypt/config"
+
+	"github.com/urfave/cli"
+)
+
+var encVerifyCommand = cli.Command{
+	Name:      "enc-verify",
+	Usage:     "verify the consistency of an encrypted image",
+	ArgsUsage: "[flags] <local>",
+	Description: `Verify the internal consistency of an encrypted image.
+
+	Every encrypted layer must carry valid encryption annotations with wrapped
+	keys that can be parsed, the layer media types must be consistent with the
+	manifest and the annotations, and the locally available layer blobs must
+	match their digest and size. For layers encrypted with --chunk-hashes, the
+	byte ranges of the chunks of a blob that do not match their hashes are
+	listed.
+	With --authenticate the encrypted layers are also decrypted using the keys
+	passed with --key and --dec-recipient, or the keys found in the GPG keyring,
+	so that their payloads are authenticated.
+	If the wrapped keys are stored in a referrer of the image, those of the
+	latest referrer are verified.
+	With an escrow policy, the keys of the encrypted layers must also be wrapped
+	for all escrow recipients.
+	With --provenance the image must have a provenance attestation attached by
+	'encrypt --provenance' that records the recipients the image is encrypted
+	for; with --provenance-key it must be signed with one of the given public
+	keys.
+	With --compat the image must also strictly conform to the format of
+	ocicrypt that CRI-O and Podman decrypt: the encrypted layers must be in OCI
+	manifests, have the media types of ocicrypt, carry their wrapped keys in
+	the annotations with wrap schemes ocicrypt knows, use its layer cipher, and
+	their JWE wrapped keys may only use the algorithms it accepts. Keys stored
+	in key blobs or referrers and schemes such as jwe-hybrid and threshold are
+	reported, since those runtimes do not find them.
+	The command fails if any issue is found.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "authenticate",
+			Usage: "Decrypt the encrypted layers to authenticate their payloads",
+		}, cli.StringFlag{
+			Name:  "gpg-homedir",
+			Usage: "The GPG homedir to use; by default gpg uses ~/.gnupg",
+		}, cli.StringFlag{
+			Name:  "gpg-version",
+			Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
+		}, cli.BoolFlag{
+			Name:  "gpg-agent",
+			Usage: "Have gpg-agent unwrap PGP wrapped keys, which allows using keys held on OpenPGP smartcards",
+		}, cli.StringFlag{
+			Name:  "gpg-passphrase-source",
+			Usage: "Give gpg-agent the passphrase of the PGP key through loopback pinentry, read from file:<path> or env:<variable>; implies --gpg-agent",
+		}, cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "A secret key's filename, or - for the keys in the standard input, and an optional password separated by colon; this option may be provided multiple times",
+		}, cli.StringSliceFlag{
+			Name:  "dec-recipient",
+			Usage: "Recipient of the image; used only for PKCS7 and must be an x509 certificate",
+		}, cli.BoolFlag{
+			Name:  "compat",
+			Usage: "Check that the image conforms to the ocicrypt format that CRI-O and Podman decrypt",
+		}, cli.BoolFlag{
+			Name:  "provenance",
+			Usage: "Verify the provenance attestation of the image",
+		}, cli.StringSliceFlag{
+			Name:  "provenance-key",
+			Usage: "A public key that the provenance attestation must be signed with; this option may be provided multiple times",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image to verify")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		image, err := client.ImageService().Get(ctx, local)
+		if err != nil {
+			return err
+		}
+		target, _, err := keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), image)
+		if err != nil {
+			return err
+		}
+
+		var dc *encconfig.DecryptConfig
+		if context.Bool("authenticate") {
+			descs, err := img.GetImageLayerDescriptors(ctx, client.ContentStore(), target)
+			if err != nil {
+				return err
+			}
+			cc, err := parsehelpers.CreateDecryptCryptoConfig(ParseEncArgs(context), descs)
+			if err != nil {
+				return err
+			}
+			defer parsehelpers.ReleaseCryptoConfig(&cc)
+			dc = cc.DecryptConfig
+		}
+
+		issues, err := imgenc.VerifyImage(ctx, client.ContentStore(), target, dc)
+		if err != nil {
+			return err
+		}
+		if context.Bool("compat") {
+			// other runtimes only see the annotations of the image itself
+			compatIssues, err := interop.Check(ctx, client.ContentStore(), image.Target)
+			if err != nil {
+				return err
+			}
+			issues = append(issues, compatIssues...)
+		}
+		if context.Bool("provenance") || context.IsSet("provenance-key") {
+			keys, err := signature.LoadCosignKeys(context.StringSlice("provenance-key"))
+			if err != nil {
+				return err
+			}
+			st, err := provenance.Verify(ctx, client.ImageService(), client.ContentStore(), image, keys)
+			if err != nil {
+				issues = append(issues, imgenc.VerifyIssue{Digest: image.Target.Digest, Message: err.Error()})
+			} else {
+				fmt.Printf("%s: encrypted by %s on %s\n", local, st.Predicate.Encryptor, st.Predicate.Encrypted.Format(time.RFC3339))
+			}
+		}
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if len(issues) > 0 {
+			return fmt.Errorf("%w: image %s has %d issues", imgenc.ErrIntegrity, local, len(issues))
+		}
+		fmt.Printf("%s: OK\n", local)
+		return nil
+	},
+}
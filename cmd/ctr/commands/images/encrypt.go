@@ -17,21 +17,35 @@
 package images
 
 import (
+	gocontext "context"
+	"crypto"
 	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/chunkhash"
+	"github.com/containerd/imgcrypt/images/encryption/dockerdaemon"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/provenance"
 
+	units "github.com/docker/go-units"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
 
 var encryptCommand = cli.Command{
 	Name:      "encrypt",
 	Usage:     "encrypt an image locally",
-	ArgsUsage: "[flags] <local> <new name>",
+	ArgsUsage: "[flags] <local>|docker-daemon:<docker image> <new name>",
 	Description: `Encrypt an image locally.
 
 	Encrypt an image using public keys managed by GPG.
@@ -45,10 +59,127 @@ var encryptCommand = cli.Command{
 	to the list of recipients.
 	Once the image has been encrypted it may be pushed to a registry.
 
+	With --delete-plaintext the plaintext image is removed once the encrypted
+	image has been created and all its blobs that are not referenced by another
+	image, such as the plaintext layers, are deleted from the content store.
+
+	With --sign-key the encrypted image is signed with the given private key
+	and the cosign-compatible signature is stored in the image named after the
+	digest of the encrypted image, such as <name>:sha256-<hex>.sig. If signing
+	fails, the encrypted image is removed again. Use 'push --with-signature' to
+	push the image together with its signature.
+
+	With --provenance an in-toto attestation recording who encrypted the image,
+	when, for which recipients and with which version of imgcrypt is attached
+	to the encrypted image as an OCI referrer, listed by the index named after
+	the digest of the encrypted image, such as <name>:sha256-<hex>. It is signed
+	with --sign-key if given, and the encryptor defaults to user@host. Use
+	'push --with-provenance' to push it and 'enc-verify --provenance' to verify
+	it.
+
+	With --key-storage referrer the wrapped layer keys are removed from the
+	layer annotations and stored in an artifact attached to the encrypted image
+	as an OCI referrer, listed by the index named after the digest of the
+	image, such as <name>:sha256-<hex>; with --key-storage both they are kept
+	in the annotations as well. Adding or removing recipients of such an image
+	then attaches a new artifact and leaves its manifest, digest and signatures
+	unchanged, since the recipients of its encrypted layers are given by the
+	latest artifact. Images whose keys are stored in a referrer keep the way
+	their keys are stored unless --key-storage is given. Use 'push --with-referrers' and
+	'pull --with-referrers' to copy the artifacts along with the image.
+
+	If the annotations with the wrapped keys of a layer grow larger than
+	--max-key-annotations-size, 16KiB by default, as happens with many
+	recipients, the keys are stored in a separate blob that the layer references
+	instead, so that the manifest stays within the size limits of registries.
+	push, pull and decryption find the keys in the blob transparently.
+
     Recipients are declared with the protocol prefix as follows:
     - pgp:<email-address>
     - jwe:<public-key-file-path>
     - pkcs7:<x509-file-path>
+    - x509:<identity>, given --ldap-config
+    - pkcs11:<key-file-path> or pkcs11:token=<token>;object=<label>;type=public
+    - kmip:<endpoint>/<key-id>, given --kmip-config
+    - timelock:<unlock-time>@<service-url>
+    - threshold:<k>:<public-key-file-path>,<public-key-file-path>,...
+
+	With threshold:<k>:... the layer keys are split among the listed recipients
+	such that any k of their private keys, passed together with --key, are
+	needed to decrypt the image.
+
+	With timelock:<unlock-time>@<service-url> the layer keys are wrapped for the
+	key the time-lock service releases at the unlock time, given in RFC 3339
+	format or as Unix time; until then, decryption fails with exit code 8 unless
+	the image has other recipients.
+
+	With jwe:- the public keys are read from the standard input, and with
+	--key - the private keys; several keys are passed as consecutive PEM blocks.
+
+	With --encryption-context key=value the layer keys are bound to the given
+	pairs, such as the repository or tenant of the image; they are then only
+	unwrapped when the same pairs are given for decryption.
+
+	The certificates of pkcs7 recipients must be valid and chain to a CA certificate
+	given with --recipient-ca, unless --insecure-allow-unverified-recipient is passed.
+
+	The subject, alternative names and expiry of the certificates of pkcs7 and
+	x509 recipients are printed, with a warning for those expiring within
+	--cert-expiry-warning, 30 days by default; with --strict-cert-expiry they are
+	refused instead.
+
+	With --ldap-config the certificates of x509:<identity> recipients and the PGP
+	keys of pgp recipients missing from the keyring are looked up by identity in
+	an LDAP directory such as Active Directory. Certificates found there are
+	verified like those of pkcs7 recipients.
+
+	With docker-daemon:<docker image> as <local> the image is read from the
+	local Docker engine at --docker-host, DOCKER_HOST or the default socket,
+	as by docker save, and encrypted in a temporary OCI image layout, which
+	--tmp-dir can place on a tmpfs; only the encrypted image is stored in
+	containerd under <new name>, which must be given:
+
+	ctr-enc images encrypt --recipient jwe:pubkey.pem docker-daemon:app:latest docker.io/library/app:enc
+
+	Layers that are encrypted already, such as those of an encrypted base
+	image, get their keys wrapped for the recipients as well, which requires
+	a key of the layers passed with --key. With --encrypted-layers=rewrap
+	their keys are wrapped for the given recipients alone, and with
+	--encrypted-layers=keep they are left as they are, so that only their
+	previous recipients can decrypt them.
+
+	Encrypted layers cannot be compressed, so --layer-compression decides how
+	plain layers are compressed before they are encrypted: 'keep' encrypts
+	them as they are, 'none' decompresses them, which takes more space in the
+	registry but no CPU to decompress them after decryption, and 'zstd'
+	recompresses them with zstd, which decompresses faster than gzip. The
+	media types of the encrypted layers record the choice.
+
+	With --chunk-hashes the hashes of the chunks of each encrypted layer are
+	added to its annotations. Decryption then fails at the first corrupted
+	chunk instead of once the whole layer was read, and enc-verify reports the
+	byte ranges of the corrupted chunks of a layer.
+
+	With --previous the encrypted layers of the previous version of the image,
+	which was encrypted in this containerd, are reused for the plain layers
+	both versions share, if they were encrypted for the same recipients and
+	the escrow and algorithm policies allow them; only the new layers are
+	encrypted. --max-key-age limits how old the reused layer keys may be:
+
+	ctr-enc images encrypt --recipient jwe:pubkey.pem --previous app:enc app:latest app:enc
+
+	With --base the image, which was built on top of the decrypted layers of
+	the given encrypted base image, gets the encrypted layers of the base
+	image instead of the plain ones it shares with it, so that the base image
+	is never published as plaintext; only the layers added on top are
+	encrypted. --encrypted-layers decides what happens to the keys of the
+	base layers, such as keep to leave them to the vendor of the base image:
+
+	ctr-enc images encrypt --recipient jwe:pubkey.pem --base vendor/base:enc --encrypted-layers keep app:latest app:enc
+
+	If no --recipient is given, the image is encrypted for the default recipients
+	that the registries section of the configuration file sets for the repository
+	of <new name>, or of <local> if no new name is given.
 `,
 	Flags: append(append(commands.RegistryFlags, cli.StringSliceFlag{
 		Name:  "recipient",
@@ -62,7 +193,49 @@ var encryptCommand = cli.Command{
 	}, cli.StringSliceFlag{
 		Name:  "platform",
 		Usage: "For which platform to encrypt; by default encrytion is done for all platforms",
-	}), flags.ImageDecryptionFlags...),
+	}, cli.BoolFlag{
+		Name:  "delete-plaintext",
+		Usage: "Delete the plaintext image and its blobs once the encrypted image has been created",
+	}, cli.StringFlag{
+		Name:  "sign-key",
+		Usage: "A private key's filename and an optional password separated by colon to sign the encrypted image with",
+	}, cli.BoolFlag{
+		Name:  "provenance",
+		Usage: "Attach a provenance attestation to the encrypted image",
+	}, cli.StringFlag{
+		Name:  "key-storage",
+		Usage: "Where to store the wrapped layer keys: 'annotations', 'referrer' or 'both'",
+	}, cli.StringFlag{
+		Name:  "max-key-annotations-size",
+		Usage: "Size the wrapped keys of a layer may have in its annotations before they are stored in a separate blob, e.g. 16KiB; 0 never stores them in a blob",
+	}, cli.StringFlag{
+		Name:  "docker-host",
+		Usage: "Address of the Docker engine that docker-daemon: images are read from; by default DOCKER_HOST or unix:///var/run/docker.sock",
+	}, cli.StringFlag{
+		Name:  "tmp-dir",
+		Usage: "Directory for the temporary OCI image layout that docker-daemon: images are encrypted in; by default the directory for temporary files is used",
+	}, cli.StringFlag{
+		Name:  "encryptor",
+		Usage: "Who encrypts the image, as recorded by the provenance attestation; by default user@host",
+	}, cli.StringFlag{
+		Name:  "encrypted-layers",
+		Usage: "What to do with layers that are encrypted already: 'add' the recipients, which needs a key of the layers, 'rewrap' their keys for the recipients alone, or 'keep' them as they are",
+	}, cli.StringFlag{
+		Name:  "layer-compression",
+		Usage: "How plain layers are compressed before they are encrypted: 'keep' as they are, 'none' to store them uncompressed or 'zstd'",
+	}, cli.BoolFlag{
+		Name:  "chunk-hashes",
+		Usage: "Add the hashes of the chunks of each encrypted layer, so that corrupted parts of a layer can be located and fetched again",
+	}, cli.StringFlag{
+		Name:  "previous",
+		Usage: "Encrypted previous version of the image whose encrypted layers are reused for the plain layers both versions share",
+	}, cli.DurationFlag{
+		Name:  "max-key-age",
+		Usage: "Do not reuse encrypted layers of the previous version whose keys were wrapped longer ago than this",
+	}, cli.StringFlag{
+		Name:  "base",
+		Usage: "Encrypted base image the image was built on whose encrypted layers replace the plain layers both images share",
+	}), append(flags.ImageDecryptionFlags, flags.RecipientTrustFlags...)...),
 	Action: func(context *cli.Context) error {
 		local := context.Args().First()
 		if local == "" {
@@ -70,6 +243,9 @@ var encryptCommand = cli.Command{
 		}
 
 		newName := context.Args().Get(1)
+		if _, ok := dockerdaemon.Reference(local); ok && newName == "" {
+			return errors.New("please provide the name of the encrypted image of the Docker image")
+		}
 		if newName != "" {
 			fmt.Printf("Encrypting %s to %s\n", local, newName)
 		} else {
@@ -81,25 +257,213 @@ var encryptCommand = cli.Command{
 		}
 		defer cancel()
 
-		recipients := context.StringSlice("recipient")
-		if len(recipients) == 0 {
+		dest := newName
+		if dest == "" {
+			dest = local
+		}
+		args, defaults, err := RegistryEncArgs(context, ParseEncArgs(context), dest)
+		if err != nil {
+			return err
+		}
+		if len(args.Recipient) == 0 {
 			return errors.New("no recipients given -- nothing to do")
 		}
+		if defaults != nil {
+			fmt.Printf("Encrypting for the default recipients of %s: %s\n", defaults.Match, strings.Join(defaults.Recipients, ", "))
+		}
 
 		layers32 := img.IntToInt32Array(context.IntSlice("layer"))
 
-		_, descs, err := getImageLayerInfos(client, ctx, local, layers32, context.StringSlice("platform"))
+		storage, err := keysidecar.ParseStorage(context.String("key-storage"))
 		if err != nil {
 			return err
 		}
-
-		cc, err := parsehelpers.CreateCryptoConfig(ParseEncArgs(context), descs)
+		if context.IsSet("max-key-annotations-size") {
+			n, err := units.RAMInBytes(context.String("max-key-annotations-size"))
+			if err != nil {
+				return fmt.Errorf("invalid --max-key-annotations-size: %w", err)
+			}
+			ctx = imgenc.WithMaxKeyAnnotationsSize(ctx, n)
+		}
+		mode, err := imgenc.ParseEncryptedLayerMode(context.String("encrypted-layers"))
+		if err != nil {
+			return err
+		}
+		ctx = imgenc.WithEncryptedLayerMode(ctx, mode)
+		ctx, err = withLayerCompression(ctx, context)
 		if err != nil {
 			return err
 		}
+		ctx = chunkhash.WithEnabled(ctx, context.Bool("chunk-hashes"))
+
+		var signer crypto.Signer
+		if context.IsSet("sign-key") {
+			signer, err = loadSigningKey(context)
+			if err != nil {
+				return err
+			}
+		}
 
-		_, err = encryptImage(client, ctx, local, newName, &cc, layers32, context.StringSlice("platform"))
+		if previous := context.String("previous"); previous != "" {
+			if _, ok := dockerdaemon.Reference(local); ok {
+				return errors.New("--previous is not supported for images of the Docker engine")
+			}
+			prev, err := client.ImageService().Get(ctx, previous)
+			if err != nil {
+				return err
+			}
+			var n int
+			ctx, n, err = imgenc.WithPreviousImage(ctx, client.ContentStore(), prev.Target, imgenc.ReuseOptions{MaxKeyAge: context.Duration("max-key-age")})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Reusing up to %d encrypted layers of %s\n", n, previous)
+		}
 
-		return err
+		base := context.String("base")
+		if _, ok := dockerdaemon.Reference(local); ok && base != "" {
+			return errors.New("--base is not supported for images of the Docker engine")
+		}
+
+		var encImage, orig images.Image
+		if ref, ok := dockerdaemon.Reference(local); ok {
+			// the plaintext image stays in the Docker engine
+			orig = images.Image{Name: local}
+			if encImage, err = encryptDockerImage(client, ctx, context, ref, newName, args, layers32); err != nil {
+				return err
+			}
+		} else {
+			if orig, err = client.ImageService().Get(ctx, local); err != nil {
+				return err
+			}
+			if !context.IsSet("key-storage") {
+				_, hasKeys, err := keysidecar.Latest(ctx, client.ImageService(), client.ContentStore(), orig)
+				if err != nil {
+					return err
+				}
+				if hasKeys {
+					storage = keysidecar.StorageReferrer
+					if keys, err := keysidecar.Collect(ctx, client.ContentStore(), orig.Target); err == nil && len(keys.Layers) > 0 {
+						storage = keysidecar.StorageBoth
+					}
+				}
+			}
+			if base != "" {
+				encImage, err = encryptDerivedImage(client, ctx, context, local, newName, base, args, layers32)
+			} else {
+				encImage, err = encryptLocalImage(client, ctx, context, local, newName, args, layers32)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if encImage, err = storeKeys(client, ctx, encImage, orig, storage); err != nil {
+			return err
+		}
+		if signer != nil {
+			if err := signImage(client, ctx, encImage, orig, signer); err != nil {
+				return err
+			}
+		}
+		if context.Bool("provenance") {
+			encryptor := context.String("encryptor")
+			if encryptor == "" {
+				encryptor = provenance.DefaultEncryptor()
+			}
+			if err := attestImage(client, ctx, encImage, orig, encryptor, signer); err != nil {
+				return err
+			}
+		}
+		if !context.Bool("delete-plaintext") || orig.Target.Digest == "" {
+			return nil
+		}
+
+		return deletePlaintext(client, ctx, orig, newName)
 	},
 }
+
+// encryptLocalImage encrypts the image in containerd with the given name
+func encryptLocalImage(client *containerd.Client, ctx gocontext.Context, context *cli.Context, local, newName string, args parsehelpers.EncArgs, layers32 []int32) (images.Image, error) {
+	_, descs, err := getImageLayerInfos(client, ctx, local, layers32, context.StringSlice("platform"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	cc, err := parsehelpers.CreateCryptoConfig(args, descs)
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+	return encryptImage(client, ctx, local, newName, &cc, layers32, context.StringSlice("platform"))
+}
+
+// encryptDerivedImage encrypts the image in containerd with the given name that was built on
+// top of the decrypted layers of the encrypted image base, replacing the layers it shares with
+// base by the encrypted layers of base
+func encryptDerivedImage(client *containerd.Client, ctx gocontext.Context, context *cli.Context, local, newName, base string, args parsehelpers.EncArgs, layers32 []int32) (images.Image, error) {
+	baseImage, err := client.ImageService().Get(ctx, base)
+	if err != nil {
+		return images.Image{}, err
+	}
+	baseTarget, _, err := keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), baseImage)
+	if err != nil {
+		return images.Image{}, err
+	}
+	_, descs, err := getImageLayerInfos(client, ctx, local, layers32, context.StringSlice("platform"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	_, baseDescs, err := getImageLayerInfos(client, ctx, base, nil, context.StringSlice("platform"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	cc, err := parsehelpers.CreateCryptoConfig(args, append(descs, baseDescs...))
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+	pl, err := parsePlatformArray(context.StringSlice("platform"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	image, err := crypt.ChangeImage(ctx, client, local, crypt.Options{NewName: newName, Layers: layers32, Platforms: pl}, func(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor, lf imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+		return imgenc.EncryptDerivedImage(ctx, cs, desc, baseTarget, &cc, lf)
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	fmt.Printf("Reused the encrypted layers of %s\n", base)
+	return image, nil
+}
+
+// encryptDockerImage encrypts the image with the given reference in the Docker engine and stores
+// the encrypted image in containerd under newName; the plaintext image is only kept in a
+// temporary OCI image layout while it is encrypted
+func encryptDockerImage(client *containerd.Client, ctx gocontext.Context, context *cli.Context, ref, newName string, args parsehelpers.EncArgs, layers32 []int32) (images.Image, error) {
+	pl, err := parsePlatformArray(context.StringSlice("platform"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	d, err := dockerdaemon.New(context.String("docker-host"))
+	if err != nil {
+		return images.Image{}, err
+	}
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer done(ctx)
+	opts := crypt.Options{
+		EncArgs:   args,
+		Layers:    layers32,
+		Platforms: pl,
+	}
+	desc, err := crypt.EncryptDockerImage(ctx, d, ref, context.String("tmp-dir"), client.ContentStore(), opts)
+	if err != nil {
+		return images.Image{}, err
+	}
+	image := images.Image{Name: newName, Target: desc}
+	if err := createImage(ctx, client.ImageService(), image); err != nil {
+		return images.Image{}, err
+	}
+	return image, nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/images/archive"
 	"github.com/containerd/containerd/platforms"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
@@ -39,6 +40,8 @@ Tar output is formatted as an OCI archive, a Docker manifest is provided for the
 Use '--skip-manifest-json' to avoid including the Docker manifest.json file.
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
+The Docker manifest is not added for images with encrypted layers, which Docker
+cannot load; their layers are exported encrypted and described by the OCI index.
 `,
 	Flags: []cli.Flag{
 		cli.BoolFlag{
@@ -69,6 +72,7 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			return errors.New("please provide both an output filename and an image reference to export")
 		}
 
+		var platform platforms.MatchComparer
 		if pss := context.StringSlice("platform"); len(pss) > 0 {
 			var all []ocispec.Platform
 			for _, ps := range pss {
@@ -78,17 +82,15 @@ When '--all-platforms' is given all images in a manifest list must be available.
 				}
 				all = append(all, p)
 			}
-			exportOpts = append(exportOpts, archive.WithPlatform(platforms.Ordered(all...)))
+			platform = platforms.Ordered(all...)
 		} else {
-			exportOpts = append(exportOpts, archive.WithPlatform(platforms.DefaultStrict()))
+			platform = platforms.DefaultStrict()
 		}
+		exportOpts = append(exportOpts, archive.WithPlatform(platform))
 
 		if context.Bool("all-platforms") {
 			exportOpts = append(exportOpts, archive.WithAllPlatforms())
-		}
-
-		if context.Bool("skip-manifest-json") {
-			exportOpts = append(exportOpts, archive.WithSkipDockerManifest())
+			platform = nil
 		}
 
 		if context.Bool("skip-non-distributable") {
@@ -106,6 +108,27 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			exportOpts = append(exportOpts, archive.WithImage(is, img))
 		}
 
+		skipManifest := context.Bool("skip-manifest-json")
+		for _, name := range images {
+			if skipManifest {
+				break
+			}
+			img, err := is.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			err = imgenc.CheckDockerExport(ctx, client.ContentStore(), img.Target, platform)
+			if errors.Is(err, imgenc.ErrEncryptedLayer) {
+				fmt.Fprintf(context.App.ErrWriter, "Not adding Docker manifest.json: %s has encrypted layers, which Docker cannot load\n", name)
+				skipManifest = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if skipManifest {
+			exportOpts = append(exportOpts, archive.WithSkipDockerManifest())
+		}
+
 		var w io.WriteCloser
 		if out == "-" {
 			w = os.Stdout
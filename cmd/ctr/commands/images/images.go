@@ -52,7 +52,18 @@ var Command = cli.Command{
 		setLabelsCommand,
 		encryptCommand,
 		decryptCommand,
+		migrateCommand,
+		copyCommand,
+		encryptBatchCommand,
+		decryptBatchCommand,
 		layerinfoCommand,
+		encVerifyCommand,
+		recipientsCommand,
+		provisionKeysCommand,
+		injectKeysCommand,
+		pruneCommand,
+		buildEncryptCommand,
+		inventoryCommand,
 	},
 }
 
@@ -169,9 +169,11 @@ decrypting the image later on.
 			if err != nil {
 				return err
 			}
+			defer parsehelpers.ReleaseCryptoConfig(&cc)
 
 			ltdd := imgcrypt.Payload{
 				DecryptConfig: *cc.DecryptConfig,
+				Annotations:   PayloadAnnotations(context),
 			}
 			opts := encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))
 			log.G(ctx).Debugf("unpacking %d images", len(imgs))
@@ -0,0 +1,193 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	gocontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/inventory"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
+
+	"github.com/urfave/cli"
+)
+
+var inventoryCommand = cli.Command{
+	Name:      "inventory",
+	Usage:     "report the encryption of images and their compliance with policies",
+	ArgsUsage: "[flags] [<filter>, ...]",
+	Description: `Report the encryption of the images of the namespace, or of all tags in
+	the catalog of a registry given with --registry.
+
+	For each image, the report shows how many of its layers across all
+	platforms are encrypted, with which key wrapping schemes and for which
+	recipients. With a policy given with --policy or an escrow policy, it also
+	shows whether the image complies with them and the violations.
+	Images that cannot be scanned are reported with an error.
+
+	The report is written as JSON or, with --format csv, as CSV. The images of
+	the namespace can be selected with the filters of "images list".
+`,
+	Flags: append(append(commands.RegistryFlags, flags.ImagePolicyFlags...), cli.StringFlag{
+		Name:  "format",
+		Usage: "Output format (\"json\" or \"csv\")",
+		Value: "json",
+	}, cli.StringFlag{
+		Name:  "registry",
+		Usage: "The registry whose catalog to scan instead of the images of the namespace",
+	}),
+	Action: func(context *cli.Context) error {
+		format := context.String("format")
+		if format != "json" && format != "csv" {
+			return fmt.Errorf("unsupported output format %q", format)
+		}
+		registry := context.String("registry")
+		if registry != "" && context.NArg() > 0 {
+			return errors.New("filters cannot be used with --registry")
+		}
+		pol, err := LoadPolicy(context)
+		if err != nil {
+			return err
+		}
+		var ap imgenc.AuthorizationPolicy
+		if pol != nil {
+			ap = pol
+		}
+
+		var report []inventory.Image
+		if registry != "" {
+			ctx, cancel := commands.AppContext(context)
+			defer cancel()
+			report, err = scanRegistry(ctx, context, registry, ap)
+		} else {
+			client, ctx, cancel, err := commands.NewClient(context)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			imgs, err := client.ImageService().List(ctx, context.Args()...)
+			if err != nil {
+				return err
+			}
+			for _, i := range imgs {
+				// the wrapped keys stored in a referrer of the image are reported as its own
+				target, _, err := keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), i)
+				if err != nil {
+					report = append(report, inventory.Image{Name: i.Name, Digest: i.Target.Digest, Error: err.Error()})
+					continue
+				}
+				entry := inventory.Scan(ctx, client.ContentStore(), images.Image{Name: i.Name, Target: target}, ap)
+				entry.Digest = i.Target.Digest
+				report = append(report, entry)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if format == "csv" {
+			return inventory.WriteCSV(os.Stdout, report)
+		}
+		return inventory.WriteJSON(os.Stdout, report)
+	},
+}
+
+// scanRegistry scans the images of all tags in the catalog of the registry
+func scanRegistry(ctx gocontext.Context, context *cli.Context, registry string, ap imgenc.AuthorizationPolicy) ([]inventory.Image, error) {
+	hosts, err := registryHosts(ctx, context)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := inventory.Catalog(ctx, hosts, registry)
+	if err != nil {
+		return nil, err
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	var report []inventory.Image
+	for _, ref := range refs {
+		name, desc, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			report = append(report, inventory.Image{Name: ref, Error: err.Error()})
+			continue
+		}
+		fetcher, err := resolver.Fetcher(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		report = append(report, inventory.Scan(ctx, inventory.FetchProvider(fetcher), images.Image{Name: name, Target: desc}, ap))
+	}
+	return report, nil
+}
+
+// registryHosts configures the registry hosts like the resolver of pull and
+// push, from the registry flags
+func registryHosts(ctx gocontext.Context, context *cli.Context) (docker.RegistryHosts, error) {
+	username, secret, _ := strings.Cut(context.String("user"), ":")
+	if username != "" && secret == "" {
+		pwd, err := img.PromptPassword("Password: ")
+		if err != nil {
+			return nil, err
+		}
+		secret = string(pwd)
+	} else if username == "" {
+		secret = context.String("refresh")
+	}
+
+	options := config.HostOptions{
+		Credentials: func(string) (string, string, error) {
+			return username, secret, nil
+		},
+	}
+	if context.Bool("plain-http") {
+		options.DefaultScheme = "http"
+	}
+	if dir := context.String("hosts-dir"); dir != "" {
+		options.HostDir = config.HostDirFromRoot(dir)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: context.Bool("skip-verify")}
+	if path := context.String("tlscacert"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to load TLS CAs from %q: invalid data", path)
+		}
+	}
+	if cert, key := context.String("tlscert"), context.String("tlskey"); cert != "" || key != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client credentials: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+	options.DefaultTLS = tlsConfig
+	return config.ConfigureHosts(ctx, options), nil
+}
@@ -17,20 +17,25 @@
 package images
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"sort"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/containerd/containerd/cmd/ctr/commands"
-	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
 	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
 
 	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
 )
 
 var layerinfoCommand = cli.Command{
@@ -45,6 +50,24 @@ var layerinfoCommand = cli.Command{
 	associated with and can retrieve information for them separately. If no
 	layers or platforms are specified, infomration for all layers and all
 	platforms will be retrieved.
+
+	With --check-keys the layers are checked against the private keys passed
+	with --key and --dec-recipient, or the keys found in the GPG keyring, and
+	those layers that cannot be decrypted with them are flagged. For the others
+	the scheme and the recipient, such as the key ID, of the wrapped key that
+	the keys unwrap are shown. The command fails if any of the layers cannot
+	be decrypted.
+
+	The CONTEXT column shows the encryption context the layer keys are bound
+	to, as recorded in the key metadata; with --check-keys, layers whose keys
+	are not bound to the context given with --encryption-context cannot be
+	decrypted.
+
+	If the wrapped keys are stored in a referrer of the image, the recipients
+	of the latest referrer are shown.
+
+	With an escrow policy, the ESCROW column shows whether the keys of the
+	encrypted layers are wrapped for all escrow recipients.
 `,
 	Flags: append(commands.RegistryFlags, cli.IntSliceFlag{
 		Name:  "layer",
@@ -61,6 +84,22 @@ var layerinfoCommand = cli.Command{
 	}, cli.BoolFlag{
 		Name:  "n",
 		Usage: "Do not resolve PGP key IDs to email addresses",
+	}, cli.StringFlag{
+		Name:  "output",
+		Usage: "Output format (\"text\", \"json\" or \"yaml\")",
+		Value: "text",
+	}, cli.BoolFlag{
+		Name:  "check-keys",
+		Usage: "Check whether the layers can be decrypted with the available keys",
+	}, cli.StringSliceFlag{
+		Name:  "key",
+		Usage: "A secret key's filename, or - for the keys in the standard input, and an optional password separated by colon; this option may be provided multiple times",
+	}, cli.StringSliceFlag{
+		Name:  "dec-recipient",
+		Usage: "Recipient of the image; used only for PKCS7 and must be an x509 certificate",
+	}, cli.StringSliceFlag{
+		Name:  "encryption-context",
+		Usage: "A key=value pair that the layer keys must be bound to for --check-keys; this option may be provided multiple times",
 	}),
 	Action: func(context *cli.Context) error {
 		local := context.Args().First()
@@ -75,7 +114,7 @@ var layerinfoCommand = cli.Command{
 
 		layers32 := img.IntToInt32Array(context.IntSlice("layer"))
 
-		LayerInfos, _, err := getImageLayerInfos(client, ctx, local, layers32, context.StringSlice("platform"))
+		LayerInfos, descs, err := getImageLayerInfos(client, ctx, local, layers32, context.StringSlice("platform"))
 		if err != nil {
 			return err
 		}
@@ -89,32 +128,139 @@ var layerinfoCommand = cli.Command{
 			gpgClient, _ = parsehelpers.CreateGPGClient(ParseEncArgs(context))
 		}
 
-		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight)
-		fmt.Fprintf(w, "#\tDIGEST\tPLATFORM\tSIZE\tENCRYPTION\tRECIPIENTS\t\n")
+		checkKeys := context.Bool("check-keys")
+		var cc encconfig.CryptoConfig
+		if checkKeys {
+			cc, err = parsehelpers.CreateDecryptCryptoConfig(ParseEncArgs(context), descs)
+			if err != nil {
+				return err
+			}
+			defer parsehelpers.ReleaseCryptoConfig(&cc)
+		}
+
+		var infos []imgenc.LayerInfo
+		undecryptable := 0
 		for _, layer := range LayerInfos {
-			var recipients []string
-			var schemes []string
-			for scheme, wrappedKeys := range ocicrypt.GetWrappedKeysMap(layer.Descriptor) {
-				schemes = append(schemes, scheme)
-				keywrapper := ocicrypt.GetKeyWrapper(scheme)
-				if keywrapper != nil {
-					addRecipients, err := keywrapper.GetRecipients(wrappedKeys)
-					if err != nil {
-						return err
-					}
-					if scheme == "pgp" && gpgClient != nil {
-						addRecipients = gpgClient.ResolveRecipients(addRecipients)
-					}
-					recipients = append(recipients, addRecipients...)
-				} else {
-					recipients = append(recipients, fmt.Sprintf("No %s KeyWrapper", scheme))
+			li, err := imgenc.GetLayerInfo(layer.Index, layer.Descriptor, gpgClient)
+			if err != nil {
+				return err
+			}
+			if checkKeys {
+				li.CheckDecryption(cc.DecryptConfig, layer.Descriptor)
+				if !*li.Decryptable {
+					undecryptable++
 				}
 			}
-			sort.Strings(schemes)
-			sort.Strings(recipients)
-			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t\n", layer.Index, layer.Descriptor.Digest.String(), platforms.Format(*layer.Descriptor.Platform), layer.Descriptor.Size, strings.Join(schemes, ","), strings.Join(recipients, ", "))
+			infos = append(infos, li)
+		}
+
+		if err := printLayerInfos(context.String("output"), infos, checkKeys); err != nil {
+			return err
+		}
+		if undecryptable > 0 {
+			return fmt.Errorf("%w: %d of %d layers cannot be decrypted with the available keys", imgenc.ErrKeyNotFound, undecryptable, len(infos))
 		}
-		w.Flush()
 		return nil
 	},
 }
+
+func printLayerInfos(format string, infos []imgenc.LayerInfo, checkKeys bool) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	case "yaml":
+		return yaml.NewEncoder(os.Stdout).Encode(infos)
+	case "", "text":
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+
+	showKeyIDs, showContext := false, false
+	for _, li := range infos {
+		showKeyIDs = showKeyIDs || len(li.KeyIDs()) > 0
+		showContext = showContext || len(li.EncryptionContext) > 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "#\tDIGEST\tPLATFORM\tSIZE\tENCRYPTION\tRECIPIENTS\t")
+	if showKeyIDs {
+		fmt.Fprintf(w, "KEY IDS\t")
+	}
+	if showContext {
+		fmt.Fprintf(w, "CONTEXT\t")
+	}
+	if checkKeys {
+		fmt.Fprintf(w, "DECRYPTABLE\tUNWRAPPED BY\t")
+	}
+	if fips.Enabled() {
+		fmt.Fprintf(w, "FIPS\t")
+	}
+	showEscrow := escrow.Current() != nil
+	if showEscrow {
+		fmt.Fprintf(w, "ESCROW\t")
+	}
+	fmt.Fprintf(w, "\n")
+	for _, li := range infos {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t", li.Index, li.Digest.String(), li.Platform, li.Size, strings.Join(li.Schemes(), ","), strings.Join(li.Recipients(), ", "))
+		if showKeyIDs {
+			var ids []string
+			for _, id := range li.KeyIDs() {
+				ids = append(ids, shortKeyID(id))
+			}
+			fmt.Fprintf(w, "%s\t", strings.Join(ids, ", "))
+		}
+		if showContext {
+			c := "-"
+			if len(li.EncryptionContext) > 0 {
+				c = enccontext.Context(li.EncryptionContext).String()
+			}
+			fmt.Fprintf(w, "%s\t", c)
+		}
+		if checkKeys {
+			decryptable := "no"
+			if *li.Decryptable {
+				decryptable = "yes"
+			}
+			unwrappedBy := "-"
+			if li.UnwrapScheme != "" {
+				// threshold recipients are the key IDs of the shares
+				var ids []string
+				for _, id := range strings.Split(li.UnwrapRecipient, ",") {
+					ids = append(ids, shortKeyID(id))
+				}
+				unwrappedBy = strings.TrimSpace(li.UnwrapScheme + " " + strings.Join(ids, ","))
+			}
+			fmt.Fprintf(w, "%s\t%s\t", decryptable, unwrappedBy)
+		}
+		if li.FIPSApproved != nil {
+			approved := "no"
+			if *li.FIPSApproved {
+				approved = "yes"
+			}
+			fmt.Fprintf(w, "%s\t", approved)
+		}
+		if showEscrow {
+			compliant := "-"
+			if li.EscrowCompliant != nil {
+				compliant = "no"
+				if *li.EscrowCompliant {
+					compliant = "yes"
+				}
+			}
+			fmt.Fprintf(w, "%s\t", compliant)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return w.Flush()
+}
+
+// shortKeyID shortens the digest in a key ID or hint for display in a table
+func shortKeyID(id string) string {
+	i := strings.LastIndexByte(id, ':')
+	if i < 0 || len(id)-i-1 <= 12 {
+		return id
+	}
+	return id[:i+13]
+}
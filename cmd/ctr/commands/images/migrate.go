@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+
+	"github.com/urfave/cli"
+)
+
+var migrateCommand = cli.Command{
+	Name:      "migrate",
+	Usage:     "add versioned key metadata to the encrypted layers of an image",
+	ArgsUsage: "[flags] <local> [<new name>]",
+	Description: `Add versioned key metadata to the encrypted layers of an image.
+
+	Layers encrypted by older versions only carry their wrapped keys, whose
+	schemes, algorithms and recipients have to be derived by parsing them.
+	This command derives the metadata once and stores it in the
+	org.opencontainers.image.enc.meta annotation of each encrypted layer that
+	does not have it yet. The layer keys are neither unwrapped nor wrapped
+	again, so no keys are needed, and the layer data is not changed.
+
+	Layers encrypted by this version already have the metadata; images whose
+	layers all have it are left unchanged.
+`,
+	Flags: []cli.Flag{
+		cli.IntSliceFlag{
+			Name:  "layer",
+			Usage: "The layer to migrate; this must be either the layer number or a negative number starting with -1 for topmost layer",
+		},
+		cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "For which platform to migrate; by default all platforms are migrated",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image to migrate")
+		}
+		newName := context.Args().Get(1)
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		layers32 := img.IntToInt32Array(context.IntSlice("layer"))
+		orig, err := client.ImageService().Get(ctx, local)
+		if err != nil {
+			return err
+		}
+		pl, err := parsePlatformArray(context.StringSlice("platform"))
+		if err != nil {
+			return err
+		}
+		image, err := crypt.ChangeImage(ctx, client, local, crypt.Options{NewName: newName, Layers: layers32, Platforms: pl}, imgenc.MigrateImage)
+		if err != nil {
+			return err
+		}
+		if image.Target.Digest == orig.Target.Digest {
+			fmt.Printf("%s already has key metadata\n", local)
+			return nil
+		}
+		fmt.Printf("Added key metadata to %s\n", image.Name)
+		return nil
+	},
+}
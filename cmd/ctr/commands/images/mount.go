@@ -26,6 +26,7 @@ import (
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption"
 	"github.com/opencontainers/image-spec/identity"
 	"github.com/urfave/cli"
 )
@@ -101,7 +102,8 @@ When you are done, use the unmount command.
 		}
 
 		i := containerd.NewImageWithPlatform(client, img, platforms.Only(p))
-		if err := i.Unpack(ctx, snapshotter); err != nil {
+		// encrypted layers are only unpacked with their keys by pull and run
+		if err := i.Unpack(ctx, snapshotter, encryption.WithUnpackConfigApplyOpts(encryption.WithEncryptedLayerCheck())); err != nil {
 			return fmt.Errorf("error unpacking image: %w", err)
 		}
 
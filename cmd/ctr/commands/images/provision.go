@@ -0,0 +1,226 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/urfave/cli"
+)
+
+var provisionKeysCommand = cli.Command{
+	Name:      "provision-keys",
+	Usage:     "wrap the layer keys of an encrypted image for new recipients into a file",
+	ArgsUsage: "[flags] <local> <file>",
+	Description: `Wrap the layer keys of an encrypted image for new recipients into a file.
+
+	The layer keys are unwrapped with --key and wrapped for the recipients
+	given with --recipient, such as the nodes of a new fleet. Only the new
+	wrapped keys and their metadata are written to <file>, or to the standard
+	output if <file> is -; the image is left as it is and its layer data is not
+	read. The file can be handed to whoever manages the image, who adds the
+	keys to it with 'inject-keys' without access to any private key.
+
+	Recipients are given as for 'encrypt'. The escrow recipients of an escrow
+	policy are not added again, since they already hold keys of the image.
+`,
+	Flags: append(append([]cli.Flag{cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "Recipient to wrap the layer keys for, in the form given for 'encrypt' (i.e. jwe:/path/to/key)",
+	}}, flags.ImageDecryptionFlags...), flags.RecipientTrustFlags...),
+	Action: func(context *cli.Context) error {
+		local, out := context.Args().Get(0), context.Args().Get(1)
+		if local == "" || out == "" {
+			return errors.New("please provide the name of an image and the file to write the keys to")
+		}
+		args := ParseEncArgs(context)
+		if len(args.Recipient) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		if len(args.Key) == 0 && !args.GPGAgent {
+			return errors.New("a key of the image is needed to wrap its layer keys; use --key")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		image, err := client.ImageService().Get(ctx, local)
+		if err != nil {
+			return err
+		}
+		target, _, err := keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), image)
+		if err != nil {
+			return err
+		}
+		_, descs, err := getImageLayerInfos(client, ctx, local, nil, nil)
+		if err != nil {
+			return err
+		}
+		// the escrow recipients already hold wrapped keys of the image
+		escrow.Set(nil)
+		cc, err := parsehelpers.CreateCryptoConfig(args, descs)
+		if err != nil {
+			return err
+		}
+		defer parsehelpers.ReleaseCryptoConfig(&cc)
+		keys, err := keysidecar.Provision(ctx, client.ContentStore(), target, &cc)
+		if err != nil {
+			return err
+		}
+		p, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return err
+		}
+		if out == "-" {
+			_, err = fmt.Println(string(p))
+			return err
+		}
+		if err := os.WriteFile(out, append(p, '\n'), 0o644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote the keys of %d layers of %s for %d recipients to %s\n", len(keys.Layers), local, len(args.Recipient), out)
+		return nil
+	},
+}
+
+var injectKeysCommand = cli.Command{
+	Name:      "inject-keys",
+	Usage:     "add wrapped layer keys written by provision-keys to an encrypted image",
+	ArgsUsage: "[flags] <local> <file> [<new name>]",
+	Description: `Add wrapped layer keys written by provision-keys to an encrypted image.
+
+	The wrapped keys in <file>, or read from the standard input if <file> is -,
+	are added to those of the layers of the image, so that their recipients
+	can decrypt it. No private key is needed.
+
+	With --key-storage annotations the keys are added to the annotations of the
+	layers, which changes the manifest of the image and its digest; the image is
+	stored under <new name> if given or replaced. With --key-storage referrer an
+	artifact with the keys of the latest wrapped keys artifact of the image, or
+	of its layers, and the added keys is attached to the image, whose manifest,
+	digest and signatures stay unchanged. Images whose keys are stored in a
+	referrer get a new artifact unless --key-storage is given.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key-storage",
+			Usage: "Where to add the wrapped layer keys: 'annotations' or 'referrer'",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		local, in, newName := context.Args().Get(0), context.Args().Get(1), context.Args().Get(2)
+		if local == "" || in == "" {
+			return errors.New("please provide the name of an image and the file with the keys")
+		}
+		keys, err := readProvisionedKeys(in)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		s := client.ImageService()
+		image, err := s.Get(ctx, local)
+		if err != nil {
+			return err
+		}
+		storage, err := keysidecar.ParseStorage(context.String("key-storage"))
+		if err != nil {
+			return err
+		}
+		if !context.IsSet("key-storage") {
+			if _, hasKeys, err := keysidecar.Latest(ctx, s, client.ContentStore(), image); err != nil {
+				return err
+			} else if hasKeys {
+				storage = keysidecar.StorageReferrer
+			}
+		}
+
+		switch storage {
+		case keysidecar.StorageAnnotations:
+			injected, err := crypt.ChangeImage(ctx, client, local, crypt.Options{NewName: newName}, func(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor, _ imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+				return keysidecar.Inject(ctx, cs, desc, keys)
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Added wrapped keys to %d layers of %s, now %s\n", len(keys.Layers), injected.Name, injected.Target.Digest)
+		case keysidecar.StorageReferrer:
+			if newName != "" {
+				return errors.New("a new name cannot be given when the keys are attached in a referrer")
+			}
+			ctx, done, err := client.WithLease(ctx)
+			if err != nil {
+				return err
+			}
+			defer done(ctx)
+			index, err := keysidecar.Extend(ctx, s, client.ContentStore(), image, keys)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Stored wrapped keys of %s in %s\n", image.Target.Digest, index.Name)
+		default:
+			return fmt.Errorf("keys cannot be added with key storage %q; use %q or %q", storage, keysidecar.StorageAnnotations, keysidecar.StorageReferrer)
+		}
+		return nil
+	},
+}
+
+// readProvisionedKeys reads the wrapped keys written by provision-keys from
+// the file, or from the standard input if it is -
+func readProvisionedKeys(path string) (keysidecar.Keys, error) {
+	var (
+		p   []byte
+		err error
+	)
+	if path == "-" {
+		p, err = io.ReadAll(os.Stdin)
+	} else {
+		p, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return keysidecar.Keys{}, err
+	}
+	keys, err := keysidecar.Decode(p)
+	if err != nil {
+		return keysidecar.Keys{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(keys.Layers) == 0 {
+		return keysidecar.Keys{}, fmt.Errorf("%s holds no wrapped keys", path)
+	}
+	return keys, nil
+}
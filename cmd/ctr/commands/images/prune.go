@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/urfave/cli"
+)
+
+var pruneCommand = cli.Command{
+	Name:      "prune",
+	Usage:     "remove plaintext residue of locally encrypted or decrypted images",
+	ArgsUsage: "[flags] [<ref>, ...]",
+	Description: `Remove plaintext residue of locally encrypted or decrypted images.
+
+	Encrypting an image locally leaves the plaintext layers it was created from
+	in the content store. This command finds those plaintext layers for the given
+	encrypted images, or for all images if none are given, and has the garbage
+	collection of containerd delete the ones that are no longer referenced by
+	any image; other garbage is collected as well.
+	With --decrypted, decrypted layers whose encrypted parent layer has been
+	removed from the content store are deleted instead.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "decrypted",
+			Usage: "Delete decrypted layers whose encrypted parent layer no longer exists",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only show the blobs that would be deleted",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		var (
+			cs     = client.ContentStore()
+			is     = client.ImageService()
+			dgsts  []digest.Digest
+			dryRun = context.Bool("dry-run")
+		)
+
+		if context.Bool("decrypted") {
+			dgsts, err = imgenc.OrphanedDecryptedBlobs(ctx, cs)
+			if err != nil {
+				return err
+			}
+		} else {
+			names := context.Args()
+			if len(names) == 0 {
+				imgs, err := is.List(ctx)
+				if err != nil {
+					return err
+				}
+				for _, img := range imgs {
+					names = append(names, img.Name)
+				}
+			}
+			for _, name := range names {
+				img, err := is.Get(ctx, name)
+				if err != nil {
+					return err
+				}
+				ds, err := imgenc.PlaintextBlobs(ctx, cs, img.Target)
+				if err != nil {
+					return fmt.Errorf("unable to find plaintext blobs of %s: %w", name, err)
+				}
+				dgsts = append(dgsts, ds...)
+			}
+		}
+
+		if dryRun {
+			refs, err := imgenc.ReferencedBlobs(ctx, cs, is)
+			if err != nil {
+				return err
+			}
+			for _, d := range dgsts {
+				if _, ok := refs[d]; !ok {
+					fmt.Printf("Would delete %s\n", d)
+				}
+			}
+			return nil
+		}
+
+		deleted, err := imgenc.DeleteUnreferencedBlobs(ctx, cs, imgenc.LeaseGarbageCollector(client.LeasesService()), dgsts)
+		for _, d := range deleted {
+			fmt.Printf("Deleted %s\n", d)
+		}
+		fmt.Printf("Deleted %d blobs\n", len(deleted))
+		return err
+	},
+}
@@ -23,13 +23,17 @@ import (
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/imgcrypt"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
 	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/referrers"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
 
 	"github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -48,6 +52,14 @@ command. As part of this process, we do the following:
 1. Fetch all resources into containerd.
 2. Prepare the snapshot filesystem with the pulled resources.
 3. Register metadata for the image.
+
+With --with-referrers the referrers of the image are fetched as well, as
+listed by the referrers API of the registry or, if the registry does not
+support it, by the index named after the digest of the image, such as
+<name>:sha256-<hex>. If the
+wrapped keys of the encrypted layers are stored in a referrer, as done by
+'encrypt --key-storage referrer', the layers are decrypted with the keys of the
+latest one.
 `,
 	Flags: append(append(append(commands.RegistryFlags, append(commands.SnapshotterFlags, commands.LabelFlag)...),
 		cli.StringSliceFlag{
@@ -71,7 +83,11 @@ command. As part of this process, we do the following:
 			Name:  "max-concurrent-downloads",
 			Usage: "Set the max concurrent downloads for each pull",
 		},
-	), flags.ImageDecryptionFlags...,
+		cli.BoolFlag{
+			Name:  "with-referrers",
+			Usage: "Fetch the referrers of the image, such as wrapped keys and provenance attestations",
+		},
+	), append(append(flags.ImageDecryptionFlags, flags.ImagePolicyFlags...), flags.ImageVerifyFlags...)...,
 	),
 	Action: func(context *cli.Context) error {
 		var (
@@ -103,6 +119,49 @@ command. As part of this process, we do the following:
 			return err
 		}
 
+		// the key blobs of layers with many recipients are not fetched by containerd
+		fetcher, err := config.Resolver.Fetcher(ctx, img.Name)
+		if err != nil {
+			return err
+		}
+		if err := encryption.FetchKeyBlobs(ctx, client.ContentStore(), fetcher, img.Target); err != nil {
+			return fmt.Errorf("failed to fetch key blobs: %w", err)
+		}
+
+		if len(context.StringSlice("verify-key")) > 0 {
+			sigRef, err := signature.CosignSignatureTag(img.Name, img.Target.Digest)
+			if err != nil {
+				return err
+			}
+			if _, err := content.Fetch(ctx, client, sigRef, config); err != nil {
+				return fmt.Errorf("failed to fetch signature %s: %w", sigRef, err)
+			}
+		}
+
+		unpackImg := img
+		if context.Bool("with-referrers") {
+			hosts, err := registryHosts(ctx, context)
+			if err != nil {
+				return err
+			}
+			if _, err := referrers.Fetch(ctx, hosts, fetcher, client.ImageService(), client.ContentStore(), img); errdefs.IsNotFound(err) {
+				// the registry has no referrers API, so they are listed by the referrers tag
+				indexRef, err := referrers.Tag(img.Name, img.Target.Digest)
+				if err != nil {
+					return err
+				}
+				if _, err := content.Fetch(ctx, client, indexRef, config); err != nil && !errdefs.IsNotFound(err) {
+					return fmt.Errorf("failed to fetch referrers %s: %w", indexRef, err)
+				}
+			} else if err != nil {
+				return err
+			}
+			// the layers are unpacked with the wrapped keys of the latest referrer, if any
+			if unpackImg.Target, _, err = keysidecar.Resolve(ctx, client.ImageService(), client.ContentStore(), img); err != nil {
+				return err
+			}
+		}
+
 		log.G(ctx).WithField("image", ref).Debug("unpacking")
 
 		// TODO: Show unpack status
@@ -130,16 +189,47 @@ command. As part of this process, we do the following:
 		if err != nil {
 			return err
 		}
+		defer parsehelpers.ReleaseCryptoConfig(&cc)
 		ltdd := imgcrypt.Payload{
 			DecryptConfig: *cc.DecryptConfig,
+			Annotations:   PayloadAnnotations(context),
 		}
 		opts := encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))
 
+		pol, err := LoadPolicy(context)
+		if err != nil {
+			return err
+		}
+
 		start := time.Now()
 		for _, platform := range p {
+			if pol != nil {
+				if err := encryption.CheckAuthorizationPolicy(ctx, client.ContentStore(), img.Name, unpackImg.Target, platforms.Only(platform), pol); err != nil {
+					if derr := client.ImageService().Delete(ctx, img.Name); derr != nil {
+						log.G(ctx).WithError(derr).Warn("failed to remove image")
+					}
+					return err
+				}
+			}
+			if err := VerifyForUnpack(ctx, client, context, img, platforms.Only(platform), &ltdd); err != nil {
+				if derr := client.ImageService().Delete(ctx, img.Name); derr != nil {
+					log.G(ctx).WithError(derr).Warn("failed to remove image")
+				}
+				return err
+			}
+			if err := encryption.PrefetchProviderKeys(ctx, client.ContentStore(), unpackImg, platforms.Only(platform), &ltdd); err != nil {
+				return err
+			}
+			if err := encryption.AddKeyBlobs(ctx, client.ContentStore(), unpackImg, platforms.Only(platform), &ltdd); err != nil {
+				return err
+			}
 			fmt.Printf("unpacking %s %s...\n", platforms.Format(platform), img.Target.Digest)
-			i := containerd.NewImageWithPlatform(client, img, platforms.Only(platform))
-			err = i.Unpack(ctx, context.String("snapshotter"), opts)
+			i := containerd.NewImageWithPlatform(client, unpackImg, platforms.Only(platform))
+			unpackOpts := []containerd.UnpackOpt{opts}
+			if pol != nil {
+				unpackOpts = append(unpackOpts, encryption.WithUnpackConfigApplyOpts(pol.ApplyOpt(encryption.ImageReference(img.Name, img.Target.Digest))))
+			}
+			err = i.Unpack(ctx, context.String("snapshotter"), unpackOpts...)
 			if err != nil {
 				return err
 			}
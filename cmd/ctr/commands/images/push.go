@@ -35,6 +35,9 @@ import (
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/referrers"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
@@ -71,6 +74,12 @@ var pushCommand = cli.Command{
 	}, cli.BoolFlag{
 		Name:  "allow-non-distributable-blobs",
 		Usage: "Allow pushing blobs that are marked as non-distributable",
+	}, cli.BoolFlag{
+		Name:  "with-signature",
+		Usage: "Also push the cosign signature image created with 'encrypt --sign-key'",
+	}, cli.BoolFlag{
+		Name:  "with-referrers, with-provenance",
+		Usage: "Also push the referrers of the image, such as the provenance attestation created with 'encrypt --provenance' and the wrapped keys stored with 'encrypt --key-storage referrer'",
 	}),
 	Action: func(context *cli.Context) error {
 		var (
@@ -162,6 +171,10 @@ var pushCommand = cli.Command{
 			ropts := []containerd.RemoteOpt{
 				containerd.WithResolver(resolver),
 				containerd.WithImageHandler(handler),
+				// the key blobs of layers with many recipients are pushed along with the layers
+				containerd.WithImageHandlerWrapper(func(h images.Handler) images.Handler {
+					return imgenc.KeyBlobChildren(h)
+				}),
 			}
 
 			if context.IsSet("max-concurrent-uploaded-layers") {
@@ -169,7 +182,45 @@ var pushCommand = cli.Command{
 				ropts = append(ropts, containerd.WithMaxConcurrentUploadedLayers(mcu))
 			}
 
-			return client.Push(ctx, ref, desc, ropts...)
+			if err := client.Push(ctx, ref, desc, ropts...); err != nil {
+				return err
+			}
+			if local == "" {
+				local = ref
+			}
+			if context.Bool("with-signature") {
+				sigName, err := signature.CosignSignatureTag(local, desc.Digest)
+				if err != nil {
+					return err
+				}
+				sigImage, err := client.ImageService().Get(ctx, sigName)
+				if err != nil {
+					return fmt.Errorf("unable to get signature image: %w", err)
+				}
+				sigRef, err := signature.CosignSignatureTag(ref, desc.Digest)
+				if err != nil {
+					return err
+				}
+				if err := client.Push(ctx, sigRef, sigImage.Target, ropts...); err != nil {
+					return err
+				}
+			}
+			if context.Bool("with-referrers") {
+				indexName, err := referrers.Tag(local, desc.Digest)
+				if err != nil {
+					return err
+				}
+				index, err := client.ImageService().Get(ctx, indexName)
+				if err != nil {
+					return fmt.Errorf("unable to get referrers: %w", err)
+				}
+				indexRef, err := referrers.Tag(ref, desc.Digest)
+				if err != nil {
+					return err
+				}
+				return client.Push(ctx, indexRef, index.Target, ropts...)
+			}
+			return nil
 		})
 
 		// don't show progress if debug mode is set
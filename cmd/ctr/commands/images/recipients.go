@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package images
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/gobars/ocicrypt"
+
+	"github.com/urfave/cli"
+)
+
+var recipientsFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "platform",
+		Usage: "For which platform to get the recipients; by default all platforms are considered",
+	}, cli.StringFlag{
+		Name:  "gpg-homedir",
+		Usage: "The GPG homedir to use; by default gpg uses ~/.gnupg",
+	}, cli.StringFlag{
+		Name:  "gpg-version",
+		Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
+	}, cli.BoolFlag{
+		Name:  "n",
+		Usage: "Do not resolve PGP key IDs to email addresses",
+	},
+}
+
+var recipientsCommand = cli.Command{
+	Name:  "recipients",
+	Usage: "list and compare the recipients of encrypted images",
+	Subcommands: cli.Commands{
+		recipientsListCommand,
+		recipientsDiffCommand,
+	},
+}
+
+var recipientsListCommand = cli.Command{
+	Name:      "list",
+	Usage:     "list the recipients across all layers of an encrypted image",
+	ArgsUsage: "[flags] <local>",
+	Flags:     recipientsFlags,
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		infos, err := getEncLayerInfos(client, ctx, context, local)
+		if err != nil {
+			return err
+		}
+		for _, r := range imgenc.ImageRecipients(infos) {
+			fmt.Println(r)
+		}
+		return nil
+	},
+}
+
+var recipientsDiffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "show the recipients added and removed per layer between two images",
+	ArgsUsage: "[flags] <from> <to>",
+	Description: `Show the recipients added and removed per layer between two images.
+
+	Layers are matched by platform and layer number, so the command can be used
+	to audit that an image was re-encrypted for the expected set of recipients,
+	for example after a key rotation.
+`,
+	Flags: recipientsFlags,
+	Action: func(context *cli.Context) error {
+		from, to := context.Args().Get(0), context.Args().Get(1)
+		if from == "" || to == "" {
+			return errors.New("please provide the names of two images")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		fromInfos, err := getEncLayerInfos(client, ctx, context, from)
+		if err != nil {
+			return err
+		}
+		toInfos, err := getEncLayerInfos(client, ctx, context, to)
+		if err != nil {
+			return err
+		}
+
+		diffs := imgenc.DiffRecipients(fromInfos, toInfos)
+		if len(diffs) == 0 {
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(w, "#\tPLATFORM\tADDED\tREMOVED\t\n")
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t\n", d.Index, d.Platform, strings.Join(d.Added, ", "), strings.Join(d.Removed, ", "))
+		}
+		return w.Flush()
+	},
+}
+
+// getEncLayerInfos gets the encryption information of the layers of an image for
+// the platforms selected on the command line
+func getEncLayerInfos(client *containerd.Client, ctx gocontext.Context, context *cli.Context, name string) ([]imgenc.LayerInfo, error) {
+	layerInfos, _, err := getImageLayerInfos(client, ctx, name, nil, context.StringSlice("platform"))
+	if err != nil {
+		return nil, err
+	}
+
+	var gpgClient ocicrypt.GPGClient
+	if !context.Bool("n") {
+		// create a GPG client to resolve keyIds to names
+		gpgClient, _ = parsehelpers.CreateGPGClient(ParseEncArgs(context))
+	}
+
+	var infos []imgenc.LayerInfo
+	for _, layer := range layerInfos {
+		li, err := imgenc.GetLayerInfo(layer.Index, layer.Descriptor, gpgClient)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, li)
+	}
+	return infos, nil
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	encutils "github.com/gobars/ocicrypt/utils"
+	"golang.org/x/term"
+)
+
+// CanPrompt returns true if the user can be asked for input on the terminal
+func CanPrompt() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// PromptPassword asks for a password on the terminal without echoing it
+func PromptPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	pwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read password: %w", err)
+	}
+	return pwd, nil
+}
+
+// PromptNewPassword asks for a new password on the terminal and for its confirmation
+func PromptNewPassword(prompt string) ([]byte, error) {
+	pwd, err := PromptPassword(prompt)
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := PromptPassword("Confirm password: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pwd, confirm) {
+		return nil, errors.New("passwords do not match")
+	}
+	return pwd, nil
+}
+
+// KeyPasswordPrompt asks for the password of the given private key file
+func KeyPasswordPrompt(keyfile string) ([]byte, error) {
+	return PromptPassword(fmt.Sprintf("Enter password for %s: ", keyfile))
+}
+
+// PINPrompt asks for the PIN of the token holding the pkcs11 key with the given URI
+func PINPrompt(uri string) ([]byte, error) {
+	return PromptPassword(fmt.Sprintf("Enter PIN for %s: ", uri))
+}
+
+// CachingPINPrompt wraps a PIN prompt so that concurrent callers are asked one at a
+// time and the PIN of a key is only asked for once
+func CachingPINPrompt(prompt func(string) ([]byte, error)) func(string) ([]byte, error) {
+	var (
+		mu    sync.Mutex
+		cache = map[string][]byte{}
+	)
+	return func(uri string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if pin, ok := cache[uri]; ok {
+			return pin, nil
+		}
+		pin, err := prompt(uri)
+		if err != nil {
+			return nil, err
+		}
+		cache[uri] = pin
+		return pin, nil
+	}
+}
+
+// ConfirmKeyPrompt shows the fingerprint and user IDs of a PGP key looked up for
+// recipient and asks whether it may be used
+func ConfirmKeyPrompt(recipient, fingerprint string, userIDs []string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "Found PGP key for %s\n  fingerprint: %s\n", recipient, fingerprint)
+	for _, id := range userIDs {
+		fmt.Fprintf(os.Stderr, "  user ID:     %s\n", id)
+	}
+	fmt.Fprint(os.Stderr, "Use this key? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false, fmt.Errorf("could not read answer: %w", err)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// CachingPasswordPrompt wraps a password prompt so that concurrent callers are asked
+// one at a time and a password that opens a key file is only asked for once
+func CachingPasswordPrompt(prompt func(string) ([]byte, error)) func(string) ([]byte, error) {
+	var (
+		mu    sync.Mutex
+		cache = map[string][]byte{}
+	)
+	return func(keyfile string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if pwd, ok := cache[keyfile]; ok {
+			return pwd, nil
+		}
+		pwd, err := prompt(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		if data, err := os.ReadFile(keyfile); err == nil {
+			if _, err := encutils.IsPrivateKey(data, pwd); !encutils.IsPasswordError(err) {
+				cache[keyfile] = pwd
+			}
+		}
+		return pwd, nil
+	}
+}
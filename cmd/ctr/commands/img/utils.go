@@ -18,66 +18,17 @@ package img
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/errdefs"
-	"github.com/containerd/containerd/images"
-	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/crypt"
 
-	encocispec "github.com/gobars/ocicrypt/spec"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // GetImageLayerDescriptors gets the image layer Descriptors of an image; the array contains
 // a list of Descriptors belonging to one platform followed by lists of other platforms
 func GetImageLayerDescriptors(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-	var lis []ocispec.Descriptor
-
-	ds := platforms.DefaultSpec()
-	platform := &ds
-
-	switch desc.MediaType {
-	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex,
-		images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
-		children, err := images.Children(ctx, cs, desc)
-		if err != nil {
-			if errdefs.IsNotFound(err) {
-				return []ocispec.Descriptor{}, nil
-			}
-			return []ocispec.Descriptor{}, err
-		}
-
-		if desc.Platform != nil {
-			platform = desc.Platform
-		}
-
-		for _, child := range children {
-			var tmp []ocispec.Descriptor
-
-			switch child.MediaType {
-			case images.MediaTypeDockerSchema2LayerGzip, images.MediaTypeDockerSchema2Layer,
-				ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerZstd, ocispec.MediaTypeImageLayer,
-				encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerEnc,
-				encocispec.MediaTypeLayerZstdEnc:
-				tdesc := child
-				tdesc.Platform = platform
-				tmp = append(tmp, tdesc)
-			default:
-				tmp, err = GetImageLayerDescriptors(ctx, cs, child)
-			}
-
-			if err != nil {
-				return []ocispec.Descriptor{}, err
-			}
-
-			lis = append(lis, tmp...)
-		}
-	case images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
-	default:
-		return nil, fmt.Errorf("unhandled media type %s: %w", desc.MediaType, errdefs.ErrInvalidArgument)
-	}
-	return lis, nil
+	return crypt.ImageLayers(ctx, cs, desc)
 }
 
 // IntToInt32Array converts an array of int's to int32's
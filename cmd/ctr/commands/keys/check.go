@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/profiles"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+
+	"github.com/urfave/cli"
+)
+
+var checkRecipientsCommand = cli.Command{
+	Name:      "check-recipients",
+	Usage:     "check that images can be encrypted for recipients",
+	ArgsUsage: "[flags] <recipient> [<recipient>, ...]",
+	Description: `Check that images can be encrypted for recipients without encrypting anything.
+
+	The recipients are given in the format of --recipient. Their keys are loaded
+	and checked against the algorithm policy, certificates and PGP keys must be
+	valid and not expire soon, pkcs7 certificates must chain to a recipient CA,
+	PGP keys must be in the keyring or be found by the key lookup, and
+	keyproviders and KMIP servers must be reachable. The command fails if any
+	recipient cannot be used, which makes it suitable for CI pipelines.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "gpg-homedir",
+			Usage: "The GPG homedir to use; by default gpg uses ~/.gnupg",
+		}, cli.StringFlag{
+			Name:  "gpg-version",
+			Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
+		}, cli.StringSliceFlag{
+			Name:  "recipient-ca",
+			Usage: "File with CA certificates that pkcs7 recipient certificates must chain to",
+		}, cli.BoolFlag{
+			Name:  "insecure-allow-unverified-recipient",
+			Usage: "Do not verify pkcs7 recipient certificates",
+		}, cli.DurationFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "Warn about certificates expiring within this duration, 720h by default",
+		}, cli.BoolFlag{
+			Name:  "strict-cert-expiry",
+			Usage: "Report certificates expiring within --cert-expiry-warning as errors",
+		}, cli.StringSliceFlag{
+			Name:  "pgp-key-lookup",
+			Usage: "Where to look up PGP keys missing from the keyring: wkd or the hkps:// URL of a keyserver",
+		}, cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the report in JSON format",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return errors.New("please provide a recipient")
+		}
+		opts := []parsehelpers.Option{
+			parsehelpers.WithGPGHomedir(context.String("gpg-homedir")),
+			parsehelpers.WithGPGVersion(context.String("gpg-version")),
+			parsehelpers.WithRecipientCAs(context.StringSlice("recipient-ca")...),
+			parsehelpers.WithPGPKeyLookup(context.StringSlice("pgp-key-lookup")...),
+			parsehelpers.WithRecipientGroups(profiles.ConfigFromContext(context).Groups),
+			parsehelpers.WithCertExpiryWarning(context.Duration("cert-expiry-warning"), context.Bool("strict-cert-expiry")),
+		}
+		if context.Bool("insecure-allow-unverified-recipient") {
+			opts = append(opts, parsehelpers.WithUnverifiedRecipients())
+		}
+		ctx, cancel := commands.AppContext(context)
+		defer cancel()
+
+		report, err := parsehelpers.CheckRecipients(ctx, context.Args(), opts...)
+		if len(report.Recipients) == 0 {
+			return err
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+			return err
+		}
+		for _, rr := range report.Recipients {
+			status := "ok"
+			if !rr.Valid() {
+				status = "error"
+			}
+			fmt.Printf("%s\t%s\t%s\n", rr.Recipient, rr.Scheme, status)
+			for _, e := range rr.Errors {
+				fmt.Printf("  error: %s\n", e)
+			}
+			for _, w := range rr.Warnings {
+				fmt.Printf("  warning: %s\n", w)
+			}
+		}
+		return err
+	},
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+
+	"github.com/urfave/cli"
+)
+
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Aliases:   []string{"inspect-key"},
+	Usage:     "identify key and certificate files",
+	ArgsUsage: "[flags] <file>[:<password>] [<file>, ...]",
+	Description: `Identify key and certificate files.
+
+	Shows how a file is classified by the parsers of recipients and private keys,
+	its algorithm, fingerprint, certificate subject and validity or GPG key IDs,
+	and the command line arguments the file can be passed with. For files that
+	are not recognized the reasons why each parser rejected them are shown.
+	The password of an encrypted private key may be passed in any of the formats
+	accepted by --key.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the information in JSON format",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return errors.New("please provide a key file")
+		}
+		var infos []keyinfo.KeyInfo
+		unknown := 0
+		for _, arg := range context.Args() {
+			path, password := arg, []byte(nil)
+			if parts := strings.SplitN(arg, ":", 2); len(parts) == 2 {
+				var err error
+				path = parts[0]
+				password, err = parsehelpers.ParsePassword(parts[1])
+				if err != nil {
+					return err
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			ki := keyinfo.Inspect(path, data, password)
+			if ki.Kind == keyinfo.KindUnknown {
+				unknown++
+			}
+			infos = append(infos, ki)
+		}
+
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(infos); err != nil {
+				return err
+			}
+		} else {
+			for i, ki := range infos {
+				if i > 0 {
+					fmt.Println()
+				}
+				if err := printKeyInfo(context.Args()[i], ki); err != nil {
+					return err
+				}
+			}
+		}
+		if unknown > 0 {
+			return fmt.Errorf("%d files could not be identified", unknown)
+		}
+		return nil
+	},
+}
+
+func printKeyInfo(name string, ki keyinfo.KeyInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	line := func(label, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", label, value)
+		}
+	}
+	line("File", strings.SplitN(name, ":", 2)[0])
+	line("Type", ki.Kind)
+	line("Algorithm", ki.Algorithm)
+	if ki.Encrypted {
+		line("Encrypted", "yes")
+	}
+	line("Fingerprint", ki.Fingerprint)
+	line("Subject", ki.Subject)
+	line("Issuer", ki.Issuer)
+	if ki.NotBefore != nil {
+		line("Not before", ki.NotBefore.Format(time.RFC3339))
+	}
+	if ki.NotAfter != nil {
+		validity := ki.NotAfter.Format(time.RFC3339)
+		if ki.Expired(time.Now()) {
+			validity += " (not valid now)"
+		}
+		line("Not after", validity)
+	}
+	line("Key IDs", strings.Join(ki.KeyIDs, ", "))
+	line("Identities", strings.Join(ki.Identities, ", "))
+	line("PKCS#11 URI", ki.Pkcs11URI)
+	for _, u := range ki.Usage {
+		line("Use with", u)
+	}
+	for _, p := range ki.Problems {
+		line("Note", p)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,326 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/img"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/profiles"
+	"github.com/containerd/imgcrypt/images/encryption/keygen"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/pkcs11pool"
+
+	"github.com/urfave/cli"
+)
+
+// Command is the cli command for managing keys
+var Command = cli.Command{
+	Name:  "keys",
+	Usage: "manage keys for image encryption",
+	Subcommands: cli.Commands{
+		generateCommand,
+		generatePkcs11Command,
+		inspectCommand,
+		checkRecipientsCommand,
+	},
+}
+
+var generateCommand = cli.Command{
+	Name:      "generate",
+	Aliases:   []string{"keygen"},
+	Usage:     "generate a key pair for encrypting images",
+	ArgsUsage: "[flags] <name>",
+	Description: `Generate a key pair for encrypting images.
+
+	The private key is written to <name>.pem and the public key to <name>.pub.pem.
+	The public key is used as recipient with jwe:<name>.pub.pem and the private key
+	is passed to decryption with --key <name>.pem.
+	With --cert a self-signed certificate is also written to <name>.crt.pem for use
+	as recipient with pkcs7:<name>.crt.pem and with --dec-recipient.
+	Keys of type x25519-mlkem768 combine X25519 with the post-quantum ML-KEM-768;
+	they are also used with jwe: and --key, but only decoders supporting the
+	jwe-hybrid scheme can decrypt layers for them.
+
+	With --pkcs11-uri no key is generated; instead a key file <name>.yaml
+	referencing the existing key object on a PKCS#11 token is written, which is
+	used as recipient with pkcs11:<name>.yaml and as private key with --key.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "The type of key to generate, \"rsa\", \"ecdsa\" or \"x25519-mlkem768\"",
+			Value: keygen.KeyTypeRSA,
+		}, cli.IntFlag{
+			Name:  "bits",
+			Usage: "The size of RSA keys",
+			Value: keygen.DefaultRSABits,
+		}, cli.StringFlag{
+			Name:  "curve",
+			Usage: "The curve of ECDSA keys, \"P-256\", \"P-384\" or \"P-521\"",
+			Value: keygen.DefaultCurve,
+		}, cli.BoolFlag{
+			Name:  "encrypt-key",
+			Usage: "Protect the private key with a password that is asked for on the terminal",
+		}, cli.StringFlag{
+			Name:  "password",
+			Usage: "Protect the private key with the password in the format used by --key (pass=, file=, fd=, keychain=)",
+		}, cli.BoolFlag{
+			Name:  "cert",
+			Usage: "Also create a self-signed certificate for use with pkcs7",
+		}, cli.StringFlag{
+			Name:  "subject",
+			Usage: "The common name of the certificate; by default the name of the key",
+		}, cli.DurationFlag{
+			Name:  "validity",
+			Usage: "The validity period of the certificate",
+			Value: 365 * 24 * time.Hour,
+		}, cli.StringFlag{
+			Name:  "pkcs11-uri",
+			Usage: "Write a key file for the key object on a PKCS#11 token with this URI instead of generating a key",
+		}, cli.StringSliceFlag{
+			Name:  "pkcs11-env",
+			Usage: "An environment variable in the form NAME=VALUE to set for the PKCS#11 module; this option may be provided multiple times",
+		}, cli.BoolFlag{
+			Name:  "force",
+			Usage: "Overwrite existing files",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		name := context.Args().First()
+		if name == "" {
+			return errors.New("please provide a name for the key")
+		}
+
+		if uri := context.String("pkcs11-uri"); uri != "" {
+			env, err := pkcs11Env(context)
+			if err != nil {
+				return err
+			}
+			data, err := keygen.Pkcs11KeyFile(uri, env)
+			if err != nil {
+				return err
+			}
+			return writeKeyFiles(context.Bool("force"), keyFile{name + ".yaml", data, 0600})
+		}
+
+		password, err := getNewPassword(context)
+		if err != nil {
+			return err
+		}
+		kp, err := keygen.GenerateKeyPair(keygen.Options{
+			Type:     context.String("type"),
+			Bits:     context.Int("bits"),
+			Curve:    context.String("curve"),
+			Password: password,
+		})
+		if err != nil {
+			return err
+		}
+
+		files := []keyFile{
+			{name + ".pem", kp.Private, 0600},
+			{name + ".pub.pem", kp.Public, 0644},
+		}
+		if context.Bool("cert") {
+			subject := context.String("subject")
+			if subject == "" {
+				subject = name
+			}
+			cert, err := kp.SelfSignedCertificate(subject, context.Duration("validity"))
+			if err != nil {
+				return err
+			}
+			files = append(files, keyFile{name + ".crt.pem", cert, 0644})
+		}
+		if err := writeKeyFiles(context.Bool("force"), files...); err != nil {
+			return err
+		}
+
+		fmt.Printf("Encrypt with:  --recipient jwe:%s.pub.pem\n", name)
+		if context.Bool("cert") {
+			fmt.Printf("           or  --recipient pkcs7:%s.crt.pem\n", name)
+		}
+		fmt.Printf("Decrypt with:  --key %s.pem\n", name)
+		return nil
+	},
+}
+
+var generatePkcs11Command = cli.Command{
+	Name:      "generate-pkcs11",
+	Usage:     "generate a key pair inside a PKCS#11 token",
+	ArgsUsage: "[flags] <name>",
+	Description: `Generate a key pair inside a PKCS#11 token, so that the private key never
+	exists outside of it.
+
+	The token is selected by the query attributes module-name or module-path and
+	the path attributes token or slot-id of --pkcs11-uri; a URI naming no module
+	uses the only module allowed by the ocicrypt configuration. The object and id
+	attributes name the new key objects and must not name existing objects. The
+	PIN is taken from the pin-value or pin-source attributes or asked for.
+
+	The key file of the private key is written to <name>.yaml, the one of the
+	public key to <name>.pub.yaml and the public key to <name>.pub.pem. The public
+	key is used as recipient with pkcs11:<name>.pub.pem, which does not need the
+	token, and the private key is passed to decryption with --key <name>.yaml.
+	The pkcs11 scheme only wraps layer keys with RSA keys.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "pkcs11-uri",
+			Usage: "The PKCS#11 URI of the token and of the key objects to generate",
+		}, cli.StringFlag{
+			Name:  "type",
+			Usage: "The type of key to generate, \"rsa\" or \"ecdsa\"",
+			Value: keygen.KeyTypeRSA,
+		}, cli.IntFlag{
+			Name:  "bits",
+			Usage: "The size of RSA keys",
+			Value: keygen.DefaultRSABits,
+		}, cli.StringFlag{
+			Name:  "curve",
+			Usage: "The curve of ECDSA keys, \"P-256\", \"P-384\" or \"P-521\"",
+			Value: keygen.DefaultCurve,
+		}, cli.StringSliceFlag{
+			Name:  "pkcs11-env",
+			Usage: "An environment variable in the form NAME=VALUE to set for the PKCS#11 module; this option may be provided multiple times",
+		}, cli.BoolFlag{
+			Name:  "force",
+			Usage: "Overwrite existing files",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		name := context.Args().First()
+		if name == "" {
+			return errors.New("please provide a name for the key")
+		}
+		uri := context.String("pkcs11-uri")
+		if uri == "" {
+			return errors.New("please provide the PKCS#11 URI of the key with --pkcs11-uri")
+		}
+		env, err := pkcs11Env(context)
+		if err != nil {
+			return err
+		}
+		names := []string{name + ".yaml", name + ".pub.yaml", name + ".pub.pem"}
+		// the files are checked before the keys are generated on the token
+		if err := checkKeyFiles(context.Bool("force"), names...); err != nil {
+			return err
+		}
+
+		p11conf, err := parsehelpers.LoadPkcs11Config(profiles.FromContext(context).Pkcs11Config)
+		if err != nil {
+			return err
+		}
+		if uri, err = parsehelpers.Pkcs11URIWithModule(uri, p11conf); err != nil {
+			return err
+		}
+		if !context.GlobalBool("no-input") && img.CanPrompt() {
+			pkcs11pool.PINCallback = img.PINPrompt
+		}
+		kp, err := keygen.GeneratePkcs11KeyPair(uri, env, p11conf, keygen.Options{
+			Type:  context.String("type"),
+			Bits:  context.Int("bits"),
+			Curve: context.String("curve"),
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeKeyFiles(true,
+			keyFile{names[0], kp.Private, 0600},
+			keyFile{names[1], kp.Public, 0644},
+			keyFile{names[2], kp.PublicPEM, 0644},
+		); err != nil {
+			return err
+		}
+
+		if strings.ToLower(context.String("type")) == keygen.KeyTypeECDSA {
+			fmt.Println("The pkcs11 scheme cannot wrap layer keys with EC keys")
+			return nil
+		}
+		fmt.Printf("Encrypt with:  --recipient pkcs11:%s.pub.pem\n", name)
+		fmt.Printf("           or  --recipient pkcs11:%s.pub.yaml\n", name)
+		fmt.Printf("Decrypt with:  --key %s.yaml\n", name)
+		return nil
+	},
+}
+
+// pkcs11Env returns the environment variables given with --pkcs11-env
+func pkcs11Env(context *cli.Context) (map[string]string, error) {
+	env := map[string]string{}
+	for _, e := range context.StringSlice("pkcs11-env") {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid environment variable %q", e)
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
+
+// getNewPassword returns the password to protect a new private key with, if any
+func getNewPassword(context *cli.Context) ([]byte, error) {
+	if pwd := context.String("password"); pwd != "" {
+		return parsehelpers.ParsePassword(pwd)
+	}
+	if !context.Bool("encrypt-key") {
+		return nil, nil
+	}
+	if context.GlobalBool("no-input") || !img.CanPrompt() {
+		return nil, errors.New("a password must be given with --password when input is disabled")
+	}
+	return img.PromptNewPassword("Enter password for the private key: ")
+}
+
+type keyFile struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+// writeKeyFiles writes all files or, if any of them exists and force is not set, none
+func writeKeyFiles(force bool, files ...keyFile) error {
+	for _, f := range files {
+		if err := checkKeyFiles(force, f.name); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := os.WriteFile(f.name, f.data, f.mode); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", f.name)
+	}
+	return nil
+}
+
+// checkKeyFiles returns an error if any of the files exists and force is not set
+func checkKeyFiles(force bool, names ...string) error {
+	if force {
+		return nil
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			return fmt.Errorf("%s already exists; use --force to overwrite it", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package profiles implements named sets of encryption settings that are read from
+// a configuration file and can be selected on the command line, for example:
+//
+//	default-profile: dev
+//	profiles:
+//	  prod:
+//	    recipients:
+//	      - jwe:/etc/imgcrypt/prod-pub.pem
+//	      - pgp:release@example.com
+//	    keys:
+//	      - /etc/imgcrypt/prod-priv.pem
+//	    gpg-homedir: /etc/imgcrypt/gnupg
+//	    pkcs11-config: /etc/imgcrypt/pkcs11.yaml
+//	    keyprovider-config: /etc/imgcrypt/keyprovider.json
+//	    fips: true
+//	    algorithm-policy: /etc/imgcrypt/algorithms.yaml
+//	    unwrap-order: /etc/imgcrypt/unwrap-order.yaml
+//	    layer-cache: /var/cache/imgcrypt/layers
+//	    layer-compression: zstd
+//	    escrow-policy: /etc/imgcrypt/escrow.yaml
+//	    cert-expiry-warning: 2160h
+//	    strict-cert-expiry: true
+//	    ldap-config: /etc/imgcrypt/ldap.json
+//	registries:
+//	  - match: registry.example.com/prod/*
+//	    recipients:
+//	      - jwe:/etc/imgcrypt/prod-pub.pem
+//	  - match: registry.example.com
+//	    recipients:
+//	      - group:dev
+//	groups:
+//	  dev:
+//	    - jwe:/etc/imgcrypt/dev-pub.pem
+//	    - pgp:dev-team@example.com
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/layercache"
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/unwraporder"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Profile holds a named set of encryption settings
+type Profile struct {
+	Recipients          []string      `yaml:"recipients,omitempty"`
+	DecRecipients       []string      `yaml:"dec-recipients,omitempty"`
+	Keys                []string      `yaml:"keys,omitempty"`
+	GPGHomedir          string        `yaml:"gpg-homedir,omitempty"`
+	GPGVersion          string        `yaml:"gpg-version,omitempty"`
+	GPGAgent            bool          `yaml:"gpg-agent,omitempty"`
+	GPGPassphraseSource string        `yaml:"gpg-passphrase-source,omitempty"`
+	Pkcs11Config        string        `yaml:"pkcs11-config,omitempty"`
+	KeyProviderConfig   string        `yaml:"keyprovider-config,omitempty"`
+	KeyUsagePolicy      string        `yaml:"key-usage-policy,omitempty"`
+	RecipientCAs        []string      `yaml:"recipient-cas,omitempty"`
+	CertExpiryWarning   time.Duration `yaml:"cert-expiry-warning,omitempty"`
+	StrictCertExpiry    bool          `yaml:"strict-cert-expiry,omitempty"`
+	FIPS                bool          `yaml:"fips,omitempty"`
+	AlgorithmPolicy     string        `yaml:"algorithm-policy,omitempty"`
+	UnwrapOrder         string        `yaml:"unwrap-order,omitempty"`
+	LayerCache          string        `yaml:"layer-cache,omitempty"`
+	LayerCompression    string        `yaml:"layer-compression,omitempty"`
+	EscrowPolicy        string        `yaml:"escrow-policy,omitempty"`
+	LDAPConfig          string        `yaml:"ldap-config,omitempty"`
+}
+
+// Config is the content of the configuration file
+type Config struct {
+	// The profile used if none is selected on the command line
+	DefaultProfile string             `yaml:"default-profile,omitempty"`
+	Profiles       map[string]Profile `yaml:"profiles,omitempty"`
+	// Default recipients of images by their destination
+	Registries []RegistryDefaults `yaml:"registries,omitempty"`
+	// Groups of recipients that recipients given as group:<name> expand to
+	Groups map[string][]string `yaml:"groups,omitempty"`
+}
+
+// RegistryDefaults holds the recipients that images whose names match a
+// pattern are encrypted for if no recipients are given on the command line
+type RegistryDefaults struct {
+	// Match is a pattern in the syntax of path.Match that is matched against
+	// the normalized repository of an image, such as docker.io/library/alpine,
+	// and against its leading path components, so that a registry or
+	// namespace matches all repositories below it
+	Match      string   `yaml:"match"`
+	Recipients []string `yaml:"recipients"`
+}
+
+// matches returns whether the pattern matches the repository or one of its
+// leading path components
+func (r RegistryDefaults) matches(repo string) (bool, error) {
+	for prefix := repo; ; {
+		ok, err := path.Match(r.Match, prefix)
+		if err != nil || ok {
+			return ok, err
+		}
+		i := strings.LastIndexByte(prefix, '/')
+		if i < 0 {
+			return false, nil
+		}
+		prefix = prefix[:i]
+	}
+}
+
+// RegistryDefaults returns the first entry of the registry defaults whose
+// pattern matches the image name, or nil if none does; names that are not
+// image references, which cannot be pushed, match no entry
+func (c *Config) RegistryDefaults(name string) (*RegistryDefaults, error) {
+	if len(c.Registries) == 0 {
+		return nil, nil
+	}
+	ref, err := docker.ParseDockerRef(name)
+	if err != nil {
+		return nil, nil
+	}
+	for i, r := range c.Registries {
+		ok, err := r.matches(ref.Name())
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry pattern %q: %w", r.Match, err)
+		}
+		if ok {
+			return &c.Registries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// DefaultPath returns the default location of the configuration file,
+// $XDG_CONFIG_HOME/imgcrypt/config.yaml or ~/.config/imgcrypt/config.yaml
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "imgcrypt", "config.yaml"), nil
+}
+
+// Load reads the configuration file at the given path. A missing file yields
+// an empty configuration.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Get returns the profile with the given name or the default profile if name is
+// empty. If no name is given and there is no default profile, an empty profile
+// is returned.
+func (c *Config) Get(name string) (Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+		if name == "" {
+			return Profile{}, nil
+		}
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %q is not defined", name)
+	}
+	return p, nil
+}
+
+// Apply returns the EncArgs with the settings of the profile added. Recipients and
+// keys of the profile are added to those in args, while the GPG settings of the
+// profile are only used if args has none.
+func (p Profile) Apply(args parsehelpers.EncArgs) parsehelpers.EncArgs {
+	args.Recipient = append(append([]string{}, p.Recipients...), args.Recipient...)
+	args.DecRecipient = append(append([]string{}, p.DecRecipients...), args.DecRecipient...)
+	args.Key = append(append([]string{}, p.Keys...), args.Key...)
+	args.RecipientCA = append(append([]string{}, p.RecipientCAs...), args.RecipientCA...)
+	if args.GPGHomedir == "" {
+		args.GPGHomedir = p.GPGHomedir
+	}
+	if args.GPGVersion == "" {
+		args.GPGVersion = p.GPGVersion
+	}
+	args.GPGAgent = args.GPGAgent || p.GPGAgent
+	if args.GPGPassphraseSource == "" {
+		args.GPGPassphraseSource = p.GPGPassphraseSource
+	}
+	if args.KeyUsagePolicy == "" {
+		args.KeyUsagePolicy = p.KeyUsagePolicy
+	}
+	if args.CertExpiryWarning == 0 {
+		args.CertExpiryWarning = p.CertExpiryWarning
+	}
+	args.StrictCertExpiry = args.StrictCertExpiry || p.StrictCertExpiry
+	if args.Pkcs11Config == "" {
+		args.Pkcs11Config = p.Pkcs11Config
+	}
+	return args
+}
+
+// SetEnv enables the FIPS mode, the algorithm policy, the unwrap order, the layer cache, the
+// escrow policy, the LDAP directory and the keyprovider configuration file if the profile sets
+// them. The PKCS#11 configuration file is passed with the EncArgs by Apply and the layer
+// compression with the context of the encryption instead, and the environment of the process
+// is left as it is.
+func (p Profile) SetEnv() error {
+	if p.FIPS {
+		fips.Enable()
+	}
+	if p.AlgorithmPolicy != "" {
+		ap, err := algpolicy.Load(p.AlgorithmPolicy)
+		if err != nil {
+			return err
+		}
+		algpolicy.Set(ap)
+	}
+	if p.UnwrapOrder != "" {
+		o, err := unwraporder.Load(p.UnwrapOrder)
+		if err != nil {
+			return err
+		}
+		unwraporder.Set(o)
+	}
+	if p.LayerCache != "" {
+		c, err := layercache.Open(p.LayerCache)
+		if err != nil {
+			return err
+		}
+		layercache.Set(c)
+	}
+	if p.EscrowPolicy != "" {
+		ep, err := escrow.Load(p.EscrowPolicy)
+		if err != nil {
+			return err
+		}
+		escrow.Set(ep)
+	}
+	if p.LDAPConfig != "" {
+		c, err := ldapkeys.LoadConfig(p.LDAPConfig)
+		if err != nil {
+			return err
+		}
+		d, err := ldapkeys.New(c)
+		if err != nil {
+			return err
+		}
+		ldapkeys.Set(d)
+	}
+	if p.KeyProviderConfig != "" {
+		keyprovider.SetConfigPath(p.KeyProviderConfig)
+	}
+	return nil
+}
+
+const (
+	metadataKey       = "imgcrypt.profile"
+	configMetadataKey = "imgcrypt.config"
+)
+
+// Setup loads the profile selected with the global --profile and --config flags,
+// applies its environment and stores it and the configuration in the metadata of
+// the application
+func Setup(context *cli.Context) error {
+	path := context.GlobalString("config")
+	if path == "" {
+		var err error
+		path, err = DefaultPath()
+		if err != nil {
+			// without a config directory there is no config file
+			return nil
+		}
+	}
+	c, err := Load(path)
+	if err != nil {
+		return err
+	}
+	p, err := c.Get(context.GlobalString("profile"))
+	if err != nil {
+		return err
+	}
+	if err := p.SetEnv(); err != nil {
+		return err
+	}
+	if context.App.Metadata == nil {
+		context.App.Metadata = map[string]interface{}{}
+	}
+	context.App.Metadata[metadataKey] = p
+	context.App.Metadata[configMetadataKey] = c
+	return nil
+}
+
+// FromContext returns the profile stored by Setup
+func FromContext(context *cli.Context) Profile {
+	if context.App == nil {
+		return Profile{}
+	}
+	p, _ := context.App.Metadata[metadataKey].(Profile)
+	return p
+}
+
+// ConfigFromContext returns the configuration stored by Setup, or an empty one
+func ConfigFromContext(context *cli.Context) *Config {
+	if context.App != nil {
+		if c, ok := context.App.Metadata[configMetadataKey].(*Config); ok {
+			return c
+		}
+	}
+	return &Config{}
+}
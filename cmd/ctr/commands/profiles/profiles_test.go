@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package profiles
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+)
+
+const testConfig = `default-profile: dev
+profiles:
+  dev:
+    recipients:
+      - jwe:/etc/imgcrypt/dev-pub.pem
+  prod:
+    recipients:
+      - jwe:/etc/imgcrypt/prod-pub.pem
+    keys:
+      - /etc/imgcrypt/prod-priv.pem
+    gpg-homedir: /etc/imgcrypt/gnupg
+    pkcs11-config: /etc/imgcrypt/pkcs11.yaml
+registries:
+  - match: registry.example.com/prod/*
+    recipients:
+      - jwe:/etc/imgcrypt/prod-pub.pem
+  - match: registry.example.com
+    recipients:
+      - group:dev
+`
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.Get(""); err != nil || !reflect.DeepEqual(p, Profile{}) {
+		t.Fatalf("expected an empty profile from a missing file, got %+v, %v", p, err)
+	}
+
+	c, err = Load(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Recipients, []string{"jwe:/etc/imgcrypt/dev-pub.pem"}) {
+		t.Fatalf("expected the default profile, got %+v", p)
+	}
+	if _, err := c.Get("staging"); err == nil || !strings.Contains(err.Error(), "not defined") {
+		t.Fatalf("expected an undefined profile to be refused, got %v", err)
+	}
+
+	if _, err := Load(writeConfig(t, "profiles: [")); err == nil {
+		t.Fatal("expected a malformed file to be refused")
+	}
+}
+
+func TestApply(t *testing.T) {
+	c, err := Load(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Get("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := p.Apply(parsehelpers.EncArgs{
+		Recipient: []string{"jwe:extra-pub.pem"},
+		Key:       []string{"extra-priv.pem"},
+	})
+	if !reflect.DeepEqual(args.Recipient, []string{"jwe:/etc/imgcrypt/prod-pub.pem", "jwe:extra-pub.pem"}) {
+		t.Fatalf("expected the recipients of the profile and the command line, got %v", args.Recipient)
+	}
+	if !reflect.DeepEqual(args.Key, []string{"/etc/imgcrypt/prod-priv.pem", "extra-priv.pem"}) {
+		t.Fatalf("expected the keys of the profile and the command line, got %v", args.Key)
+	}
+	if args.GPGHomedir != "/etc/imgcrypt/gnupg" || args.Pkcs11Config != "/etc/imgcrypt/pkcs11.yaml" {
+		t.Fatalf("expected the settings of the profile, got %+v", args)
+	}
+
+	// settings given on the command line take precedence
+	args = p.Apply(parsehelpers.EncArgs{GPGHomedir: "/home/user/.gnupg", Pkcs11Config: "pkcs11.yaml"})
+	if args.GPGHomedir != "/home/user/.gnupg" || args.Pkcs11Config != "pkcs11.yaml" {
+		t.Fatalf("expected the settings of the command line, got %+v", args)
+	}
+}
+
+func TestRegistryDefaults(t *testing.T) {
+	c, err := Load(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		match string
+	}{
+		{"registry.example.com/prod/app:1", "registry.example.com/prod/*"},
+		{"registry.example.com/dev/app:1", "registry.example.com"},
+		{"docker.io/library/alpine:latest", ""},
+		{"not a reference", ""},
+	} {
+		r, err := c.RegistryDefaults(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		match := ""
+		if r != nil {
+			match = r.Match
+		}
+		if match != tc.match {
+			t.Fatalf("%s: expected the entry %q, got %q", tc.name, tc.match, match)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	t.Setenv("OCICRYPT_CONFIG", "")
+	t.Setenv("OCICRYPT_KEYPROVIDER_CONFIG", "")
+	defer keyprovider.SetConfigPath("")
+
+	p := Profile{
+		Pkcs11Config:      "/etc/imgcrypt/pkcs11.yaml",
+		KeyProviderConfig: "/etc/imgcrypt/keyprovider.json",
+	}
+	if err := p.SetEnv(); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"OCICRYPT_CONFIG", "OCICRYPT_KEYPROVIDER_CONFIG"} {
+		if v := os.Getenv(env); v != "" {
+			t.Fatalf("expected %s to be left unset, got %q", env, v)
+		}
+	}
+	if path := keyprovider.ConfigPath(); path != p.KeyProviderConfig {
+		t.Fatalf("expected the keyprovider configuration of the profile, got %q", path)
+	}
+}
@@ -20,9 +20,13 @@ import (
 	"context"
 	gocontext "context"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/containerd/console"
 	"github.com/containerd/containerd"
@@ -35,6 +39,9 @@ import (
 	"github.com/containerd/containerd/oci"
 	gocni "github.com/containerd/go-cni"
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/flags"
+	"github.com/containerd/imgcrypt/cmd/ctr/commands/images"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -128,9 +135,13 @@ var Command = cli.Command{
 			Name:  "cni",
 			Usage: "enable cni networking for the container",
 		},
+		cli.StringFlag{
+			Name:  "preflight",
+			Usage: "report to stderr with which keys the layers of an encrypted image are unwrapped before running it (\"text\" or \"json\")",
+		},
 	}, append(platformRunFlags,
 		append(append(append(commands.SnapshotterFlags, []cli.Flag{commands.SnapshotterLabels}...),
-			commands.ContainerFlags...), flags.ImageDecryptionFlags...)...)...),
+			commands.ContainerFlags...), append(append(flags.ImageDecryptionFlags, flags.ImagePolicyFlags...), flags.ImageVerifyFlags...)...)...)...),
 	Action: func(context *cli.Context) error {
 		var (
 			err error
@@ -257,6 +268,67 @@ var Command = cli.Command{
 	},
 }
 
+// preflight writes to stderr with which schemes and keys the keys of the
+// encrypted layers of the image are unwrapped with the keys given on the
+// command line, and how long it takes, if --preflight is given; an error is
+// returned if a layer key cannot be unwrapped
+func preflight(ctx gocontext.Context, client *containerd.Client, context *cli.Context, image containerd.Image) error {
+	format := context.String("preflight")
+	switch format {
+	case "":
+		return nil
+	case "text", "json":
+	default:
+		return fmt.Errorf("unsupported preflight format %q", format)
+	}
+	cc, err := parsehelpers.CreateDecryptCryptoConfig(images.ParseEncArgs(context), nil)
+	if err != nil {
+		return err
+	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+	report, err := imgenc.Preflight(ctx, client.ContentStore(), image.Target(), image.Platform(), cc.DecryptConfig)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stderr)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Image string `json:"image"`
+			*imgenc.PreflightReport
+		}{image.Name(), report}); err != nil {
+			return err
+		}
+		return report.Err()
+	}
+
+	fmt.Fprintf(os.Stderr, "Preflight of %s: %d encrypted layers in %s\n", image.Name(), len(report.Layers), report.Duration.Round(time.Millisecond))
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tPLATFORM\tSCHEME\tKEY IDS\tDURATION\tATTEMPTS\t")
+	for _, l := range report.Layers {
+		scheme := l.Scheme
+		if scheme == "" {
+			scheme = "-"
+		}
+		if l.Authorization {
+			scheme += " (authorization)"
+		}
+		keyIDs := strings.Join(l.KeyIDs, ",")
+		if keyIDs == "" {
+			keyIDs = "-"
+		}
+		var tried []string
+		for _, a := range l.Attempts {
+			tried = append(tried, fmt.Sprintf("%s#%d:%s", a.Scheme, a.Index, a.Reason))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t\n", l.Digest, l.Platform, scheme, keyIDs, l.Duration.Round(time.Microsecond), strings.Join(tried, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return report.Err()
+}
+
 func fullID(ctx context.Context, c containerd.Container) string {
 	id := c.ID()
 	ns, ok := namespaces.Namespace(ctx)
@@ -43,6 +43,7 @@ import (
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/images"
 	"github.com/containerd/imgcrypt/images/encryption"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
@@ -104,6 +105,11 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 		spec  containerd.NewContainerOpts
 	)
 
+	pol, err := images.LoadPolicy(context)
+	if err != nil {
+		return nil, err
+	}
+
 	if config {
 		cOpts = append(cOpts, containerd.WithContainerLabels(commands.LabelArgs(context.StringSlice("label"))))
 		opts = append(opts, oci.WithSpecFromFile(context.String("config")))
@@ -144,6 +150,10 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 				image = containerd.NewImage(client, i)
 			}
 
+			if err := preflight(ctx, client, context, image); err != nil {
+				return nil, err
+			}
+
 			unpacked, err := image.IsUnpacked(ctx, snapshotter)
 			if err != nil {
 				return nil, err
@@ -153,12 +163,26 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 				if err != nil {
 					return nil, err
 				}
+				defer parsehelpers.ReleaseCryptoConfig(&cc)
 
 				ltdd := imgcrypt.Payload{
 					DecryptConfig: *cc.DecryptConfig,
+					Annotations:   images.PayloadAnnotations(context),
+				}
+				if err := images.VerifyForUnpack(ctx, client, context, image.Metadata(), image.Platform(), &ltdd); err != nil {
+					return nil, err
+				}
+				if err := encryption.PrefetchProviderKeys(ctx, client.ContentStore(), image.Metadata(), image.Platform(), &ltdd); err != nil {
+					return nil, err
 				}
-				opts := encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))
-				if err := image.Unpack(ctx, snapshotter, opts); err != nil {
+				if err := encryption.AddKeyBlobs(ctx, client.ContentStore(), image.Metadata(), image.Platform(), &ltdd); err != nil {
+					return nil, err
+				}
+				unpackOpts := []containerd.UnpackOpt{encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))}
+				if pol != nil {
+					unpackOpts = append(unpackOpts, encryption.WithUnpackConfigApplyOpts(pol.ApplyOpt(encryption.ImageReference(image.Name(), image.Target().Digest))))
+				}
+				if err := image.Unpack(ctx, snapshotter, unpackOpts...); err != nil {
 					return nil, err
 				}
 			}
@@ -367,11 +391,24 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 	if err != nil {
 		return nil, err
 	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+
+	v, err := images.LoadVerifier(context)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		cOpts = append(cOpts, signature.WithSignatureVerification(v))
+	}
 
 	if !context.IsSet("skip-decrypt-auth") {
 		cOpts = append(cOpts, encryption.WithAuthorizationCheck(cc.DecryptConfig))
 	}
 
+	if pol != nil {
+		cOpts = append(cOpts, encryption.WithAuthorizationPolicy(pol))
+	}
+
 	// oci.WithImageConfig (WithUsername, WithUserID) depends on access to rootfs for resolving via
 	// the /etc/{passwd,group} files. So cOpts needs to have precedence over opts.
 	return client.NewContainer(ctx, id, cOpts...)
@@ -30,6 +30,7 @@ import (
 	"github.com/containerd/imgcrypt/cmd/ctr/commands/images"
 	"github.com/containerd/imgcrypt/images/encryption"
 	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
@@ -54,6 +55,11 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 		config = context.IsSet("config")
 	)
 
+	pol, err := images.LoadPolicy(context)
+	if err != nil {
+		return nil, err
+	}
+
 	if config {
 		id = context.Args().First()
 		opts = append(opts, oci.WithSpecFromFile(context.String("config")))
@@ -85,6 +91,10 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 		if err != nil {
 			return nil, err
 		}
+		if err := preflight(ctx, client, context, image); err != nil {
+			return nil, err
+		}
+
 		unpacked, err := image.IsUnpacked(ctx, snapshotter)
 		if err != nil {
 			return nil, err
@@ -94,12 +104,26 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 			if err != nil {
 				return nil, err
 			}
+			defer parsehelpers.ReleaseCryptoConfig(&cc)
 
 			ltdd := imgcrypt.Payload{
 				DecryptConfig: *cc.DecryptConfig,
+				Annotations:   images.PayloadAnnotations(context),
+			}
+			if err := images.VerifyForUnpack(ctx, client, context, image.Metadata(), image.Platform(), &ltdd); err != nil {
+				return nil, err
+			}
+			if err := encryption.PrefetchProviderKeys(ctx, client.ContentStore(), image.Metadata(), image.Platform(), &ltdd); err != nil {
+				return nil, err
 			}
-			opts := encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))
-			if err := image.Unpack(ctx, snapshotter, opts); err != nil {
+			if err := encryption.AddKeyBlobs(ctx, client.ContentStore(), image.Metadata(), image.Platform(), &ltdd); err != nil {
+				return nil, err
+			}
+			unpackOpts := []containerd.UnpackOpt{encryption.WithUnpackConfigApplyOpts(encryption.WithDecryptedUnpack(&ltdd))}
+			if pol != nil {
+				unpackOpts = append(unpackOpts, encryption.WithUnpackConfigApplyOpts(pol.ApplyOpt(encryption.ImageReference(image.Name(), image.Target().Digest))))
+			}
+			if err := image.Unpack(ctx, snapshotter, unpackOpts...); err != nil {
 				return nil, err
 			}
 		}
@@ -169,10 +193,23 @@ func NewContainer(ctx gocontext.Context, client *containerd.Client, context *cli
 	if err != nil {
 		return nil, err
 	}
+	defer parsehelpers.ReleaseCryptoConfig(&cc)
+	v, err := images.LoadVerifier(context)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		cOpts = append(cOpts, signature.WithSignatureVerification(v))
+	}
+
 	if !context.IsSet("skip-decrypt-auth") {
 		cOpts = append(cOpts, encryption.WithAuthorizationCheck(cc.DecryptConfig))
 	}
 
+	if pol != nil {
+		cOpts = append(cOpts, encryption.WithAuthorizationPolicy(pol))
+	}
+
 	return client.NewContainer(ctx, id, cOpts...)
 }
 
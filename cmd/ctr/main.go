@@ -17,7 +17,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/containerd/containerd/pkg/seed"
@@ -32,10 +31,9 @@ func init() {
 }
 
 func main() {
-	app := app.New()
-	app.Commands = append(app.Commands, pluginCmds...)
-	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "ctr: %s\n", err)
-		os.Exit(1)
+	a := app.New()
+	a.Commands = append(a.Commands, pluginCmds...)
+	if err := a.Run(os.Args); err != nil {
+		os.Exit(app.HandleError(a, os.Stderr, err))
 	}
 }
@@ -0,0 +1,216 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/nodekeys"
+	"github.com/containerd/imgcrypt/images/encryption/status"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	Usage = "imgcrypt-agent fetches the decryption keys of the node from a key server, installs them for ctd-decoder and keeps them rotated"
+)
+
+func main() {
+	hostname, _ := os.Hostname()
+
+	app := cli.NewApp()
+	app.Name = "imgcrypt-agent"
+	app.Usage = Usage
+	app.Action = run
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "server",
+			Usage:  "URL of the key server to fetch the keys from",
+			EnvVar: "IMGCRYPT_AGENT_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "node",
+			Usage:  "Name of the node to fetch the keys of",
+			EnvVar: "NODE_NAME",
+			Value:  hostname,
+		},
+		cli.StringFlag{
+			Name:  "keys-dir",
+			Usage: "Directory to install the keys in; this is the --decryption-keys-path of ctd-decoder",
+			Value: "/etc/containerd/ocicrypt/keys",
+		},
+		cli.StringFlag{
+			Name:  "identity",
+			Usage: "How the node authenticates: \"token\" with a bootstrap token, \"gcp\" or \"aws\" with the identity of the instance",
+			Value: "token",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "File holding the bootstrap token for --identity token",
+		},
+		cli.StringFlag{
+			Name:  "audience",
+			Usage: "Audience of the instance identity token for --identity gcp; defaults to --server",
+		},
+		cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "CA certificates to verify the key server with",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Client certificate for mutual TLS with the key server",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key of the client certificate",
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Usage: "How often to fetch the keys unless the key server sets the interval",
+			Value: nodekeys.DefaultInterval,
+		},
+		cli.BoolFlag{
+			Name:  "once",
+			Usage: "Install the keys once and exit, e.g. in an init container",
+		},
+		cli.StringFlag{
+			Name:  "status-socket",
+			Usage: "Unix socket to serve the status of image decryption on the node on, for monitoring agents; without --server only the status is served",
+		},
+		cli.StringFlag{
+			Name:  "status-file",
+			Usage: "File the decoders record their decryptions in, the --status-file of ctd-decoder",
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(context *cli.Context) error {
+	server := context.String("server")
+	if server == "" && context.String("status-socket") == "" {
+		return fmt.Errorf("the key server must be given with --server")
+	}
+	if server == "" {
+		ctx, cancel := signalContext()
+		defer cancel()
+		return serveStatus(ctx, context)
+	}
+	node := context.String("node")
+	if node == "" {
+		return fmt.Errorf("the node name must be given with --node")
+	}
+
+	var creds nodekeys.Credentials
+	switch identity := context.String("identity"); identity {
+	case "token":
+		if context.String("token-file") == "" {
+			return fmt.Errorf("a bootstrap token must be given with --token-file")
+		}
+		creds = nodekeys.TokenFile{Path: context.String("token-file")}
+	case "gcp":
+		audience := context.String("audience")
+		if audience == "" {
+			audience = server
+		}
+		creds = nodekeys.GCPIdentity{Audience: audience}
+	case "aws":
+		creds = nodekeys.AWSIdentity{}
+	default:
+		return fmt.Errorf("unknown identity %q; use token, gcp or aws", identity)
+	}
+
+	tlsConfig := keyprovider.TLSConfig{
+		CAFile:   context.String("ca-file"),
+		CertFile: context.String("tls-cert"),
+		KeyFile:  context.String("tls-key"),
+	}
+	cfg, err := tlsConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	agent := &nodekeys.Agent{
+		Client: &nodekeys.Client{
+			URL:         server,
+			Node:        node,
+			Credentials: creds,
+			HTTPClient: &http.Client{
+				Transport: &http.Transport{TLSClientConfig: cfg, Proxy: http.ProxyFromEnvironment},
+			},
+		},
+		Dir:      context.String("keys-dir"),
+		Interval: context.Duration("interval"),
+	}
+
+	if context.Bool("once") {
+		_, err := agent.Sync(gocontext.Background())
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	errs := make(chan error, 1)
+	if context.String("status-socket") != "" {
+		go func() {
+			if err := serveStatus(ctx, context); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	if err := agent.Run(ctx); err != nil && err != gocontext.Canceled {
+		return err
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// signalContext returns a context that is canceled on SIGINT and SIGTERM
+func signalContext() (gocontext.Context, gocontext.CancelFunc) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// serveStatus serves the status of the keys in --keys-dir and of the
+// decryptions recorded in --status-file on --status-socket until ctx is done
+func serveStatus(ctx gocontext.Context, context *cli.Context) error {
+	opts := status.Options{Keys: []string{context.String("keys-dir")}}
+	if path := context.String("status-file"); path != "" {
+		opts.Tracker = &status.Tracker{Path: path}
+	}
+	return status.Serve(ctx, context.String("status-socket"), status.Handler(opts))
+}
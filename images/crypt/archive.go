@@ -0,0 +1,137 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/dockerdaemon"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptArchive encrypts the selected layers of the image in the OCI image
+// archive read from r, such as the result of a BuildKit build with --output
+// type=oci,dest=-, for the recipients of the options and copies the encrypted
+// image to dst; the descriptor of the encrypted image is returned. The archive
+// must hold a single image. It is unpacked into a temporary OCI image layout
+// in tmpDir, or the default directory for temporary files if empty, which is
+// removed before returning, so that the plaintext image never reaches dst.
+// NewName of the options is not used.
+func EncryptArchive(ctx context.Context, r io.Reader, tmpDir string, dst content.Ingester, opts Options) (ocispec.Descriptor, error) {
+	return encryptInLayout(ctx, tmpDir, dst, opts, func(l *ocilayout.Layout) (ocispec.Descriptor, error) {
+		idx, err := l.ImportArchive(ctx, r)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if len(idx.Manifests) != 1 {
+			return ocispec.Descriptor{}, fmt.Errorf("expected an OCI image archive with a single image, got %d", len(idx.Manifests))
+		}
+		desc := idx.Manifests[0]
+		// the name annotations belong to the index of the archive
+		desc.Annotations = nil
+		return desc, nil
+	})
+}
+
+// EncryptDockerImage encrypts the selected layers of the image with the given
+// reference in the Docker engine d for the recipients of the options and
+// copies the encrypted image to dst, like EncryptArchive does with the
+// archive the engine saves the image to; the descriptor of the encrypted
+// image is returned. NewName of the options is not used.
+func EncryptDockerImage(ctx context.Context, d *dockerdaemon.Client, ref, tmpDir string, dst content.Ingester, opts Options) (ocispec.Descriptor, error) {
+	return encryptInLayout(ctx, tmpDir, dst, opts, func(l *ocilayout.Layout) (ocispec.Descriptor, error) {
+		r, err := d.Save(ctx, ref)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer r.Close()
+		return dockerdaemon.Import(ctx, r, l.Store())
+	})
+}
+
+// encryptInLayout encrypts the image that load stores in a temporary OCI image
+// layout in tmpDir and copies the encrypted image to dst; the layout is
+// removed before returning, so that the plaintext image never reaches dst
+func encryptInLayout(ctx context.Context, tmpDir string, dst content.Ingester, opts Options, load func(*ocilayout.Layout) (ocispec.Descriptor, error)) (ocispec.Descriptor, error) {
+	dir, err := os.MkdirTemp(tmpDir, "imgcrypt-archive-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.RemoveAll(dir)
+	l, err := ocilayout.Open(dir)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer l.Close()
+
+	desc, err := load(l)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc, err := encryptStored(ctx, l.Store(), desc, opts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := encryption.CopyImage(ctx, l, dst, newDesc, nil); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return newDesc, nil
+}
+
+// encryptStored encrypts the selected layers of the image with the given
+// target descriptor in cs for the recipients of the options and returns the
+// descriptor of the encrypted image
+func encryptStored(ctx context.Context, cs content.Store, desc ocispec.Descriptor, opts Options) (ocispec.Descriptor, error) {
+	cc := opts.CryptoConfig
+	if cc == nil {
+		args, err := opts.encArgs()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if len(args.Recipient) == 0 {
+			return ocispec.Descriptor{}, errors.New("no recipients given")
+		}
+		all, err := ImageLayers(ctx, cs, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		var descs []ocispec.Descriptor
+		for _, layer := range SelectLayers(all, opts.Layers, opts.Platforms) {
+			descs = append(descs, layer.Descriptor)
+		}
+		c, err := parsehelpers.CreateCryptoConfig(args, descs)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		cc = &c
+		defer parsehelpers.ReleaseCryptoConfig(cc)
+	}
+	lf, err := LayerFilter(ctx, cs, desc, opts.Layers, opts.Platforms)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc, _, err := encryption.EncryptImage(ctx, cs, desc, cc, lf)
+	return newDesc, err
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/dockerdaemon"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociArchive returns an OCI image archive of an image with one layer, as
+// BuildKit writes it, and the descriptor of that layer
+func ociArchive(t *testing.T) ([]byte, ocispec.Descriptor) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		add("blobs/sha256/"+desc.Digest.Encoded(), data)
+		return desc
+	}
+	marshal := func(v interface{}) []byte {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	layer := blob(ocispec.MediaTypeImageLayer, []byte("plaintext layer data"))
+	config := blob(ocispec.MediaTypeImageConfig, marshal(ocispec.Image{OS: "linux", Architecture: "amd64"}))
+	manifest := blob(ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	}))
+	manifest.Annotations = map[string]string{ocispec.AnnotationRefName: "latest"}
+	add(ocispec.ImageLayoutFile, marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}))
+	add("index.json", marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifest},
+	}))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), layer
+}
+
+// writePublicKey writes the public key of a new RSA key to a file and
+// returns its path
+func writePublicKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(t.TempDir(), "pub.pem")
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pubFile
+}
+
+func TestEncryptArchive(t *testing.T) {
+	ctx := context.Background()
+	pubFile := writePublicKey(t)
+
+	archive, layer := ociArchive(t)
+	dst, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	tmpDir := t.TempDir()
+	opts := Options{EncOpts: []parsehelpers.Option{parsehelpers.WithRecipients("jwe:" + pubFile)}}
+	desc, err := EncryptArchive(ctx, bytes.NewReader(archive), tmpDir, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Annotations != nil {
+		t.Fatalf("expected the name annotations of the archive to be dropped, got %v", desc.Annotations)
+	}
+
+	layers, err := ImageLayers(ctx, dst, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || !encryption.IsEncryptedDiff(ctx, layers[0].MediaType) {
+		t.Fatalf("expected an encrypted layer, got %+v", layers)
+	}
+	if _, err := dst.Store().Info(ctx, layer.Digest); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected the plaintext layer not to be copied, got %v", err)
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the temporary OCI image layout to be removed, found %d entries", len(entries))
+	}
+
+	if _, err := EncryptArchive(ctx, bytes.NewReader(archive), tmpDir, dst, Options{}); err == nil {
+		t.Fatal("expected an error without recipients")
+	}
+	if _, err := EncryptArchive(ctx, bytes.NewReader(archive[:512]), tmpDir, dst, opts); err == nil {
+		t.Fatal("expected an error for a truncated archive")
+	}
+}
+
+func TestEncryptDockerImage(t *testing.T) {
+	ctx := context.Background()
+	pubFile := writePublicKey(t)
+
+	layer := []byte("plaintext layer data")
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"abc/layer.tar", layer},
+		{"config.json", config},
+		{"manifest.json", []byte(`[{"Config":"config.json","RepoTags":["app:latest"],"Layers":["abc/layer.tar"]}]`)},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/app:latest/get" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	d, err := dockerdaemon.New("tcp://" + strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	opts := Options{EncOpts: []parsehelpers.Option{parsehelpers.WithRecipients("jwe:" + pubFile)}}
+	desc, err := EncryptDockerImage(ctx, d, "app:latest", t.TempDir(), dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := ImageLayers(ctx, dst, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || !encryption.IsEncryptedDiff(ctx, layers[0].MediaType) {
+		t.Fatalf("expected an encrypted layer, got %+v", layers)
+	}
+	if _, err := dst.Store().Info(ctx, digest.FromBytes(layer)); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected the plaintext layer not to be copied, got %v", err)
+	}
+	if _, err := EncryptDockerImage(ctx, d, "other:latest", t.TempDir(), dst, opts); !errors.Is(err, dockerdaemon.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package crypt encrypts and decrypts images stored in containerd with one
+// call, doing what ctr-enc does: it selects the layers, creates the crypto
+// configuration from recipients and keys given as on the command line,
+// rewrites the manifests and stores the result as an image.
+//
+// The package is separate from the root imgcrypt package, which the
+// encryption package depends on for the decoder payload.
+package crypt
+
+import (
+	"context"
+	"errors"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+	"github.com/containerd/imgcrypt/images/encryption/chunkhash"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Options configure the encryption or decryption of an image
+type Options struct {
+	// NewName is the name the result is stored under; by default the image
+	// is replaced
+	NewName string
+	// EncOpts set the recipients and keys in the formats of the ctr-enc
+	// flags, such as parsehelpers.WithRecipients("jwe:pubkey.pem") or
+	// parsehelpers.WithKeys("privkey.pem:pass=secret")
+	EncOpts []parsehelpers.Option
+	// EncArgs are used if no EncOpts are given, such as those returned by
+	// parsehelpers.NewEncArgs
+	EncArgs parsehelpers.EncArgs
+	// CryptoConfig is used instead of one created from EncOpts if set
+	CryptoConfig *encconfig.CryptoConfig
+	// Layers selects layers by their index counted from the bottommost one
+	// (0) or by their negative index counted from the topmost one (-1); all
+	// layers are selected if empty
+	Layers []int32
+	// Platforms selects the platforms whose layers are changed; all
+	// platforms are selected if empty
+	Platforms []ocispec.Platform
+	// MaxKeyAnnotationsSize is the size the annotations with the wrapped keys
+	// of a layer may have before they are stored in a key blob when it is
+	// encrypted; encryption.DefaultMaxKeyAnnotationsSize is used if it is 0,
+	// and the keys are never moved to a key blob if it is negative
+	MaxKeyAnnotationsSize int64
+	// LayerCompression is how plain layers are compressed before they are
+	// encrypted; they are encrypted as they are compressed if it is empty
+	LayerCompression encryption.LayerCompression
+	// ChunkHashes adds the hashes of the chunks of each encrypted layer to
+	// its annotations
+	ChunkHashes bool
+}
+
+// encArgs returns the arguments set by EncOpts, or EncArgs if there are none
+func (opts Options) encArgs() (parsehelpers.EncArgs, error) {
+	if len(opts.EncOpts) == 0 {
+		return opts.EncArgs, nil
+	}
+	return parsehelpers.NewEncArgs(opts.EncOpts...)
+}
+
+// Op changes the layers of an image selected by the layer filter and returns
+// the new target of the image and whether it was changed
+type Op func(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf encryption.LayerFilter) (ocispec.Descriptor, bool, error)
+
+// EncryptImage encrypts the selected layers of the image with the given name
+// for the recipients of the options. Layers that are already encrypted get
+// the recipients added, which requires one of their keys.
+func EncryptImage(ctx context.Context, client *containerd.Client, name string, opts Options) (images.Image, error) {
+	cc := opts.CryptoConfig
+	if cc == nil {
+		args, err := opts.encArgs()
+		if err != nil {
+			return images.Image{}, err
+		}
+		if len(args.Recipient) == 0 {
+			return images.Image{}, errors.New("no recipients given")
+		}
+		descs, err := selectedLayers(ctx, client, name, opts)
+		if err != nil {
+			return images.Image{}, err
+		}
+		c, err := parsehelpers.CreateCryptoConfig(args, descs)
+		if err != nil {
+			return images.Image{}, err
+		}
+		cc = &c
+		defer parsehelpers.ReleaseCryptoConfig(cc)
+	}
+	if opts.MaxKeyAnnotationsSize != 0 {
+		ctx = encryption.WithMaxKeyAnnotationsSize(ctx, opts.MaxKeyAnnotationsSize)
+	}
+	if opts.LayerCompression != "" {
+		ctx = encryption.WithLayerCompression(ctx, opts.LayerCompression)
+	}
+	if opts.ChunkHashes {
+		ctx = chunkhash.WithEnabled(ctx, true)
+	}
+	return ChangeImage(ctx, client, name, opts, func(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf encryption.LayerFilter) (ocispec.Descriptor, bool, error) {
+		return encryption.EncryptImage(ctx, cs, desc, cc, lf)
+	})
+}
+
+// DecryptImage decrypts the selected layers of the image with the given name
+// with the keys of the options
+func DecryptImage(ctx context.Context, client *containerd.Client, name string, opts Options) (images.Image, error) {
+	cc := opts.CryptoConfig
+	if cc == nil {
+		args, err := opts.encArgs()
+		if err != nil {
+			return images.Image{}, err
+		}
+		descs, err := selectedLayers(ctx, client, name, opts)
+		if err != nil {
+			return images.Image{}, err
+		}
+		c, err := parsehelpers.CreateDecryptCryptoConfig(args, descs)
+		if err != nil {
+			return images.Image{}, err
+		}
+		cc = &c
+		defer parsehelpers.ReleaseCryptoConfig(cc)
+	}
+	return ChangeImage(ctx, client, name, opts, func(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf encryption.LayerFilter) (ocispec.Descriptor, bool, error) {
+		return encryption.DecryptImage(ctx, cs, desc, cc, lf)
+	})
+}
+
+// ChangeImage applies op to the selected layers of the image with the given
+// name under a lease and stores the result under the new name of the options
+// or replaces the image; the image is returned unchanged if op did not change
+// it. Only Layers, Platforms and NewName of the options are used.
+func ChangeImage(ctx context.Context, client *containerd.Client, name string, opts Options, op Op) (images.Image, error) {
+	s := client.ImageService()
+
+	image, err := s.Get(ctx, name)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	lf, err := LayerFilter(ctx, client.ContentStore(), image.Target, opts.Layers, opts.Platforms)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer done(ctx)
+	ctx = audit.WithImage(ctx, name)
+
+	newSpec, modified, err := op(ctx, client.ContentStore(), image.Target, lf)
+	if err != nil {
+		return image, err
+	}
+	if !modified {
+		return image, nil
+	}
+
+	image.Target = newSpec
+
+	newName := opts.NewName
+	// if newName is either empty or equal to the existing name, it's an update
+	if newName == "" || image.Name == newName {
+		// first Delete the existing and then Create a new one
+		// We have to do it this way since we have a newSpec!
+		if err := s.Delete(ctx, image.Name); err != nil {
+			return images.Image{}, err
+		}
+		newName = image.Name
+	}
+
+	image.Name = newName
+	return s.Create(ctx, image)
+}
+
+// selectedLayers returns the descriptors of the layers of the image selected
+// by the options
+func selectedLayers(ctx context.Context, client *containerd.Client, name string, opts Options) ([]ocispec.Descriptor, error) {
+	image, err := client.ImageService().Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	all, err := ImageLayers(ctx, client.ContentStore(), image.Target)
+	if err != nil {
+		return nil, err
+	}
+	var descs []ocispec.Descriptor
+	for _, l := range SelectLayers(all, opts.Layers, opts.Platforms) {
+		descs = append(descs, l.Descriptor)
+	}
+	return descs, nil
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ExporterAttrPrefix prefixes the exporter attributes that configure the
+// encryption of an exported image, such as
+// --output type=image,name=app:enc,encryption.recipient=jwe:pubkey.pem with
+// buildctl. Attributes without the prefix belong to the exporter and are
+// ignored.
+const ExporterAttrPrefix = "encryption."
+
+// ExportHook encrypts the image with the given target descriptor, whose blobs
+// are in cs, as an exporter is about to export it and returns the descriptor
+// of the encrypted image, whose new blobs are written to cs
+type ExportHook func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error)
+
+// ExporterOptions returns the options for the encryption of an image set by
+// the exporter attributes with ExporterAttrPrefix, and whether there are any.
+// The attributes, without the prefix, are:
+//
+//	recipient, recipient.<suffix>   a recipient in the format of --recipient
+//	key, key.<suffix>               a private key in the format of --key
+//	layer                           comma-separated indexes of the layers
+//	platform                        comma-separated platforms
+//	context.<key>                   a pair of the encryption context
+//	gpg-homedir, gpg-version        as --gpg-homedir and --gpg-version
+//	recipient-ca, recipient-ca.<suffix>
+//	                                as --recipient-ca
+//	insecure-allow-unverified-recipient
+//	                                as --insecure-allow-unverified-recipient
+//
+// Since attribute values may contain commas, such as threshold recipients,
+// each recipient, key and CA file is given in an attribute of its own, which
+// are used in the order of their suffixes.
+func ExporterOptions(attrs map[string]string) (Options, bool, error) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		if strings.HasPrefix(name, ExporterAttrPrefix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return Options{}, false, nil
+	}
+	sort.Strings(names)
+
+	var (
+		opts     Options
+		encOpts  []parsehelpers.Option
+		pairs    []string
+		multiple = func(attr, name string) bool {
+			return attr == name || strings.HasPrefix(attr, name+".")
+		}
+	)
+	for _, name := range names {
+		attr, value := strings.TrimPrefix(name, ExporterAttrPrefix), attrs[name]
+		switch {
+		case multiple(attr, "recipient"):
+			encOpts = append(encOpts, parsehelpers.WithRecipients(value))
+		case multiple(attr, "key"):
+			encOpts = append(encOpts, parsehelpers.WithKeys(value))
+		case multiple(attr, "recipient-ca"):
+			encOpts = append(encOpts, parsehelpers.WithRecipientCAs(value))
+		case strings.HasPrefix(attr, "context."):
+			pairs = append(pairs, strings.TrimPrefix(attr, "context.")+"="+value)
+		case attr == "layer":
+			for _, s := range strings.Split(value, ",") {
+				i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+				if err != nil {
+					return Options{}, true, fmt.Errorf("exporter attribute %s: invalid layer %q", name, s)
+				}
+				opts.Layers = append(opts.Layers, int32(i))
+			}
+		case attr == "platform":
+			for _, s := range strings.Split(value, ",") {
+				p, err := platforms.Parse(strings.TrimSpace(s))
+				if err != nil {
+					return Options{}, true, fmt.Errorf("exporter attribute %s: %w", name, err)
+				}
+				opts.Platforms = append(opts.Platforms, p)
+			}
+		case attr == "gpg-homedir":
+			encOpts = append(encOpts, parsehelpers.WithGPGHomedir(value))
+		case attr == "gpg-version":
+			encOpts = append(encOpts, parsehelpers.WithGPGVersion(value))
+		case attr == "insecure-allow-unverified-recipient":
+			allow, err := strconv.ParseBool(value)
+			if err != nil {
+				return Options{}, true, fmt.Errorf("exporter attribute %s: %w", name, err)
+			}
+			if allow {
+				encOpts = append(encOpts, parsehelpers.WithUnverifiedRecipients())
+			}
+		default:
+			return Options{}, true, fmt.Errorf("unknown exporter attribute %s", name)
+		}
+	}
+	if len(pairs) > 0 {
+		encOpts = append(encOpts, parsehelpers.WithEncryptionContext(pairs...))
+	}
+	// the arguments are checked now rather than when the image is exported
+	args, err := parsehelpers.NewEncArgs(encOpts...)
+	if err != nil {
+		return Options{}, true, err
+	}
+	if len(args.Recipient) == 0 {
+		return Options{}, true, fmt.Errorf("no recipients given with exporter attribute %srecipient", ExporterAttrPrefix)
+	}
+	opts.EncOpts = encOpts
+	return opts, true, nil
+}
+
+// NewExportHook returns the hook that encrypts exported images as set by the
+// exporter attributes with ExporterAttrPrefix, or nil if there are none, so
+// that build systems encrypt images with the recipients and annotations of
+// ctr-enc as part of their export
+func NewExportHook(attrs map[string]string) (ExportHook, error) {
+	opts, ok, err := ExporterOptions(attrs)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+		return encryptStored(ctx, cs, desc, opts)
+	}, nil
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExporterOptions(t *testing.T) {
+	if _, ok, err := ExporterOptions(map[string]string{"name": "app", "push": "true"}); ok || err != nil {
+		t.Fatalf("expected no options without encryption attributes, got %v, %v", ok, err)
+	}
+
+	opts, ok, err := ExporterOptions(map[string]string{
+		"name":                          "app",
+		"encryption.recipient.1":        "jwe:b.pem",
+		"encryption.recipient.0":        "threshold:2:x.pem,y.pem,z.pem",
+		"encryption.layer":              "0, -1",
+		"encryption.platform":           "linux/amd64,linux/arm64",
+		"encryption.context.repository": "app",
+		"encryption.insecure-allow-unverified-recipient": "true",
+	})
+	if err != nil || !ok {
+		t.Fatalf("expected options, got %v, %v", ok, err)
+	}
+	args, err := opts.encArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args.Recipient) != 2 || args.Recipient[0] != "threshold:2:x.pem,y.pem,z.pem" || args.Recipient[1] != "jwe:b.pem" {
+		t.Fatalf("expected the recipients in the order of their suffixes, got %v", args.Recipient)
+	}
+	if len(args.EncryptionContext) != 1 || args.EncryptionContext[0] != "repository=app" || !args.AllowUnverifiedRecipient {
+		t.Fatalf("unexpected arguments %+v", args)
+	}
+	if len(opts.Layers) != 2 || opts.Layers[1] != -1 || len(opts.Platforms) != 2 || opts.Platforms[1].Architecture != "arm64" {
+		t.Fatalf("unexpected layers %v or platforms %v", opts.Layers, opts.Platforms)
+	}
+
+	for _, attrs := range []map[string]string{
+		{"encryption.recipient": "rsa:key.pem"},
+		{"encryption.recipient": "jwe:a.pem", "encryption.layer": "top"},
+		{"encryption.recipient": "jwe:a.pem", "encryption.compression": "zstd"},
+		{"encryption.key": "priv.pem"},
+	} {
+		if _, ok, err := ExporterOptions(attrs); !ok || err == nil {
+			t.Fatalf("expected an error for %v", attrs)
+		}
+	}
+}
+
+func TestExportHook(t *testing.T) {
+	ctx := context.Background()
+	if hook, err := NewExportHook(map[string]string{"name": "app"}); hook != nil || err != nil {
+		t.Fatalf("expected no hook without encryption attributes, got %v", err)
+	}
+	hook, err := NewExportHook(map[string]string{"encryption.recipient": "jwe:" + writePublicKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, _ := ociArchive(t)
+	l, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	idx, err := l.ImportArchive(ctx, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{MediaType: idx.Manifests[0].MediaType, Digest: idx.Manifests[0].Digest, Size: idx.Manifests[0].Size}
+	newDesc, err := hook(ctx, l.Store(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := ImageLayers(ctx, l, newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newDesc.Digest == desc.Digest || len(layers) != 1 || !encryption.IsEncryptedDiff(ctx, layers[0].MediaType) {
+		t.Fatalf("expected the exported image to be encrypted, got %+v", layers)
+	}
+}
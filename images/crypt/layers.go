@@ -0,0 +1,191 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/nydus"
+	encocispec "github.com/gobars/ocicrypt/spec"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layer is a layer of an image with its position
+type Layer struct {
+	// The Number of this layer in the sequence; starting at 0
+	Index      uint32
+	Descriptor ocispec.Descriptor
+}
+
+// ImageLayers returns the layers of an image; the layers of one platform are
+// followed by those of the other platforms, and the layers of each platform
+// share the same Platform pointer
+func ImageLayers(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var lis []ocispec.Descriptor
+
+	ds := platforms.DefaultSpec()
+	platform := &ds
+
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		children, err := images.Children(ctx, cs, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return []ocispec.Descriptor{}, nil
+			}
+			return []ocispec.Descriptor{}, err
+		}
+
+		if desc.Platform != nil {
+			platform = desc.Platform
+		}
+
+		for _, child := range children {
+			var tmp []ocispec.Descriptor
+
+			switch child.MediaType {
+			case images.MediaTypeDockerSchema2LayerGzip, images.MediaTypeDockerSchema2Layer,
+				ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerZstd, ocispec.MediaTypeImageLayer,
+				encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerEnc, encocispec.MediaTypeLayerZstdEnc,
+				encocispec.MediaTypeLayerNonDistributableGzipEnc, encocispec.MediaTypeLayerNonDistributableEnc,
+				encocispec.MediaTypeLayerNonDistributableZstdEnc,
+				images.MediaTypeDockerSchema2LayerForeignGzip, images.MediaTypeDockerSchema2LayerForeign,
+				ocispec.MediaTypeImageLayerNonDistributableGzip, ocispec.MediaTypeImageLayerNonDistributableZstd,
+				ocispec.MediaTypeImageLayerNonDistributable, nydus.MediaTypeBlob:
+				tdesc := child
+				tdesc.Platform = platform
+				tmp = append(tmp, tdesc)
+			default:
+				tmp, err = ImageLayers(ctx, cs, child)
+			}
+
+			if err != nil {
+				return []ocispec.Descriptor{}, err
+			}
+
+			lis = append(lis, tmp...)
+		}
+	case images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
+	default:
+		return nil, fmt.Errorf("unhandled media type %s: %w", desc.MediaType, errdefs.ErrInvalidArgument)
+	}
+	return lis, nil
+}
+
+// SelectLayers returns the layers returned by ImageLayers that are selected by
+// their index and platform. A layer is selected by its index counted from the
+// bottommost one (0) or by its negative index counted from the topmost one
+// (-1); if no indexes or platforms are given, all are selected.
+func SelectLayers(all []ocispec.Descriptor, layers []int32, pl []ocispec.Platform) []Layer {
+	var (
+		selected    []Layer
+		curplat     *ocispec.Platform
+		layerIndex  int32
+		layersTotal int32
+	)
+
+	for _, desc := range all {
+		if curplat != desc.Platform {
+			curplat = desc.Platform
+			layerIndex = 0
+			layersTotal = countLayers(all, desc.Platform)
+		} else {
+			layerIndex = layerIndex + 1
+		}
+
+		if isSelectedLayer(layerIndex, layersTotal, layers) && isSelectedPlatform(curplat, pl) {
+			selected = append(selected, Layer{
+				Index:      uint32(layerIndex),
+				Descriptor: desc,
+			})
+		}
+	}
+	return selected
+}
+
+// LayerFilter returns a filter for the layers of the image selected by their
+// index and platform as by SelectLayers
+func LayerFilter(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, layers []int32, pl []ocispec.Platform) (encryption.LayerFilter, error) {
+	all, err := ImageLayers(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := SelectLayers(all, layers, pl)
+
+	lf := func(d ocispec.Descriptor) bool {
+		for _, l := range selected {
+			if l.Descriptor.Digest == d.Digest {
+				return true
+			}
+		}
+		return false
+	}
+	return lf, nil
+}
+
+// isSelectedLayer checks whether a layer is selected given its number
+func isSelectedLayer(layerIndex, layersTotal int32, layers []int32) bool {
+	if len(layers) == 0 {
+		// convenience for the user; none given means 'all'
+		return true
+	}
+	negNumber := layerIndex - layersTotal
+
+	for _, l := range layers {
+		if l == negNumber || l == layerIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelectedPlatform determines whether the platform matches one in the
+// array of selected platforms
+func isSelectedPlatform(platform *ocispec.Platform, platformList []ocispec.Platform) bool {
+	if len(platformList) == 0 {
+		// convenience for the user; none given means 'all'
+		return true
+	}
+	matcher := platforms.NewMatcher(*platform)
+
+	for _, platform := range platformList {
+		if matcher.Match(platform) {
+			return true
+		}
+	}
+	return false
+}
+
+func countLayers(descs []ocispec.Descriptor, platform *ocispec.Platform) int32 {
+	c := int32(0)
+
+	for _, desc := range descs {
+		if desc.Platform == platform {
+			c = c + 1
+		}
+	}
+
+	return c
+}
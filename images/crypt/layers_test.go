@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/nydus"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeJSON(t *testing.T, cs content.Ingester, mediaType string, v interface{}) ocispec.Descriptor {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testutil.WriteBlob(t, cs, mediaType, data)
+}
+
+func TestSelectLayers(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := func(s string) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString(s), Size: int64(len(s))}
+	}
+	manifest := func(os string, layers ...ocispec.Descriptor) ocispec.Descriptor {
+		config := writeJSON(t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{OS: os, Architecture: "amd64"})
+		desc := writeJSON(t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    layers,
+		})
+		desc.Platform = &ocispec.Platform{OS: os, Architecture: "amd64"}
+		return desc
+	}
+	index := writeJSON(t, cs, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			manifest("linux", layer("l0"), layer("l1")),
+			manifest("windows", layer("w0"), layer("w1")),
+		},
+	})
+
+	all, err := ImageLayers(ctx, cs, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("expected 4 layers, got %d", len(all))
+	}
+
+	selected := SelectLayers(all, []int32{-1}, []ocispec.Platform{{OS: "windows", Architecture: "amd64"}})
+	if len(selected) != 1 || selected[0].Index != 1 || selected[0].Descriptor.Digest != digest.FromString("w1") {
+		t.Fatalf("expected the topmost windows layer to be selected, got %+v", selected)
+	}
+
+	lf, err := LayerFilter(ctx, cs, index, []int32{0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lf(layer("l0")) || !lf(layer("w0")) || lf(layer("l1")) {
+		t.Fatal("expected the bottommost layers of all platforms to be selected")
+	}
+
+	if _, err := ImageLayers(ctx, cs, ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2Config}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageLayersMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := writeJSON(t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{OS: "linux", Architecture: "amd64"})
+
+	for _, tc := range []struct {
+		mediaType string
+		isLayer   bool
+	}{
+		{mediaType: images.MediaTypeDockerSchema2LayerGzip, isLayer: true},
+		{mediaType: ocispec.MediaTypeImageLayerZstd, isLayer: true},
+		{mediaType: images.MediaTypeDockerSchema2LayerForeignGzip, isLayer: true},
+		{mediaType: ocispec.MediaTypeImageLayerNonDistributableGzip, isLayer: true},
+		// the data blobs of Nydus images are layers too
+		{mediaType: nydus.MediaTypeBlob, isLayer: true},
+		{mediaType: "application/vnd.example.unknown", isLayer: false},
+	} {
+		child := ocispec.Descriptor{MediaType: tc.mediaType, Digest: digest.FromString(tc.mediaType), Size: 1}
+		desc := writeJSON(t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ocispec.Descriptor{child},
+		})
+		all, err := ImageLayers(ctx, cs, desc)
+		if !tc.isLayer {
+			if !errdefs.IsInvalidArgument(err) {
+				t.Fatalf("expected %s to be rejected, got %v", tc.mediaType, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 || all[0].Digest != child.Digest {
+			t.Fatalf("expected %s to be a layer, got %+v", tc.mediaType, all)
+		}
+	}
+}
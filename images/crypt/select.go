@@ -0,0 +1,37 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+)
+
+// SelectImages returns the images of the store that match all of the filters,
+// in the syntax of `ctr images list`, or all images if no filter is given.
+// Unlike List of images.Store, which returns the images that match any of its
+// filters, each filter narrows the selection, so that adding a filter never
+// selects more images to be changed.
+func SelectImages(ctx context.Context, is images.Store, filters ...string) ([]images.Image, error) {
+	if len(filters) == 0 {
+		return is.List(ctx)
+	}
+	// the conditions of a single filter separated by commas must all match
+	return is.List(ctx, strings.Join(filters, ","))
+}
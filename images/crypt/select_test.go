@@ -0,0 +1,88 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSelectImages(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "meta.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	is := metadata.NewImageStore(metadata.NewDB(db, cs, nil))
+
+	for _, img := range []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"prod-app", map[string]string{"env": "prod", "team": "app"}},
+		{"prod-db", map[string]string{"env": "prod", "team": "db"}},
+		{"dev-app", map[string]string{"env": "dev", "team": "app"}},
+	} {
+		target := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(img.name), Size: 1}
+		if _, err := is.Create(ctx, images.Image{Name: img.name, Labels: img.labels, Target: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		filters []string
+		names   []string
+	}{
+		{nil, []string{"dev-app", "prod-app", "prod-db"}},
+		{[]string{`labels."env"==prod`}, []string{"prod-app", "prod-db"}},
+		{[]string{`labels."env"==prod`, `labels."team"==app`}, []string{"prod-app"}},
+		{[]string{`labels."env"==prod`, `labels."team"==web`}, nil},
+	} {
+		imgs, err := SelectImages(ctx, is, tc.filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, img := range imgs {
+			names = append(names, img.Name)
+		}
+		sort.Strings(names)
+		if len(names) != len(tc.names) {
+			t.Fatalf("filters %v: expected %v, got %v", tc.filters, tc.names, names)
+		}
+		for i := range names {
+			if names[i] != tc.names[i] {
+				t.Fatalf("filters %v: expected %v, got %v", tc.filters, tc.names, names)
+			}
+		}
+	}
+}
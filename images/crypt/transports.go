@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/transports"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptCopy copies the image of src to dst and encrypts its selected layers
+// for the recipients of the options on the way, in a temporary OCI image
+// layout in TmpDir of the copy options, so that the plaintext image never
+// reaches dst; the descriptor of the encrypted image is returned. NewName of
+// the options and Transform of the copy options are not used.
+func EncryptCopy(ctx context.Context, src transports.Source, dst transports.Destination, copts transports.CopyOptions, opts Options) (ocispec.Descriptor, error) {
+	copts.Transform = func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+		return encryptStored(ctx, cs, desc, opts)
+	}
+	return transports.Copy(ctx, src, dst, copts)
+}
+
+// DecryptCopy copies the image of src to dst and decrypts its selected layers
+// with the keys of the options on the way, like EncryptCopy
+func DecryptCopy(ctx context.Context, src transports.Source, dst transports.Destination, copts transports.CopyOptions, opts Options) (ocispec.Descriptor, error) {
+	copts.Transform = func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+		return decryptStored(ctx, cs, desc, opts)
+	}
+	return transports.Copy(ctx, src, dst, copts)
+}
+
+// decryptStored decrypts the selected layers of the image with the given
+// target descriptor in cs with the keys of the options and returns the
+// descriptor of the decrypted image
+func decryptStored(ctx context.Context, cs content.Store, desc ocispec.Descriptor, opts Options) (ocispec.Descriptor, error) {
+	cc := opts.CryptoConfig
+	if cc == nil {
+		args, err := opts.encArgs()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		all, err := ImageLayers(ctx, cs, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		var descs []ocispec.Descriptor
+		for _, layer := range SelectLayers(all, opts.Layers, opts.Platforms) {
+			descs = append(descs, layer.Descriptor)
+		}
+		c, err := parsehelpers.CreateDecryptCryptoConfig(args, descs)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		cc = &c
+		defer parsehelpers.ReleaseCryptoConfig(cc)
+	}
+	lf, err := LayerFilter(ctx, cs, desc, opts.Layers, opts.Platforms)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc, _, err := encryption.DecryptImage(ctx, cs, desc, cc, lf)
+	return newDesc, err
+}
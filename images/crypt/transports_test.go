@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/images/encryption/transports"
+)
+
+// copyTransports copies the image between the transport strings with op
+func copyTransports(t *testing.T, src, dst string, opts Options, op func(context.Context, transports.Source, transports.Destination, transports.CopyOptions, Options) error) {
+	t.Helper()
+	ctx := context.Background()
+	srcRef, err := transports.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstRef, err := transports.Parse(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := transports.NewSource(ctx, srcRef, transports.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d, err := transports.NewDestination(ctx, dstRef, transports.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := op(ctx, s, d, transports.CopyOptions{TmpDir: t.TempDir()}, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecryptCopy(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDir := t.TempDir()
+	pubFile := filepath.Join(keyDir, "pub.pem")
+	privFile := filepath.Join(keyDir, "priv.pem")
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, layer := ociArchive(t)
+	srcDir := t.TempDir()
+	l, err := ocilayout.Open(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := l.ImportArchive(ctx, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Tag("latest", idx.Manifests[0]); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	encDir := filepath.Join(t.TempDir(), "enc")
+	copyTransports(t, "oci:"+srcDir+":latest", "dir:"+encDir, Options{
+		EncOpts: []parsehelpers.Option{parsehelpers.WithRecipients("jwe:" + pubFile)},
+	}, func(ctx context.Context, s transports.Source, d transports.Destination, copts transports.CopyOptions, opts Options) error {
+		_, err := EncryptCopy(ctx, s, d, copts, opts)
+		return err
+	})
+	if _, err := os.Stat(filepath.Join(encDir, layer.Digest.Encoded())); !os.IsNotExist(err) {
+		t.Fatalf("expected the plaintext layer not to be copied, got %v", err)
+	}
+
+	decDir := t.TempDir()
+	copyTransports(t, "dir:"+encDir, "oci:"+decDir+":latest", Options{
+		EncOpts: []parsehelpers.Option{parsehelpers.WithKeys(privFile)},
+	}, func(ctx context.Context, s transports.Source, d transports.Destination, copts transports.CopyOptions, opts Options) error {
+		_, err := DecryptCopy(ctx, s, d, copts, opts)
+		return err
+	})
+	l, err = ocilayout.Open(decDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	desc, err := l.Resolve("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := ImageLayers(ctx, l, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || encryption.IsEncryptedDiff(ctx, layers[0].MediaType) || layers[0].Digest != layer.Digest {
+		t.Fatalf("expected the plaintext layer after decryption, got %+v", layers)
+	}
+}
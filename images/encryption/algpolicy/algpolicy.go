@@ -0,0 +1,178 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package algpolicy restricts the algorithms with which image layers are
+// encrypted and decrypted: the key wrapping schemes and JWE key management
+// algorithms, the minimum size of RSA keys, the elliptic curves and the layer
+// ciphers. A policy file looks like:
+//
+//	schemes: [jwe, pkcs7, pkcs11, provider.*]
+//	jwe-algorithms: [RSA-OAEP-256, ECDH-ES+A256KW]
+//	min-rsa-bits: 3072
+//	curves: [P-256, P-384]
+//	ciphers: [AES_256_CTR_HMAC_SHA256]
+//
+// Lists that are empty allow everything. Without a policy file the default
+// policy applies, which only requires RSA keys of DefaultMinRSABits.
+package algpolicy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultMinRSABits is the minimum size of RSA keys if the policy sets none
+const DefaultMinRSABits = 2048
+
+// ErrNotAllowed is wrapped by the errors about algorithms and keys that the
+// policy does not allow
+var ErrNotAllowed = errors.New("not allowed by the algorithm policy")
+
+// Policy holds the algorithms that may be used for encryption and decryption
+type Policy struct {
+	// Schemes lists the allowed key wrapping schemes such as jwe, pkcs7, pgp,
+	// pkcs11, jwe-hybrid, threshold, kmip and provider.<name>; a trailing '*' matches
+	// all schemes with the prefix
+	Schemes []string `yaml:"schemes,omitempty"`
+	// JWEAlgorithms lists the allowed JWE key management algorithms, of
+	// RSA-OAEP, RSA-OAEP-256 and ECDH-ES+A256KW
+	JWEAlgorithms []string `yaml:"jwe-algorithms,omitempty"`
+	// MinRSABits is the minimum size of RSA keys; DefaultMinRSABits if zero
+	MinRSABits int `yaml:"min-rsa-bits,omitempty"`
+	// Curves lists the allowed elliptic curves, of P-256, P-384 and P-521
+	Curves []string `yaml:"curves,omitempty"`
+	// Ciphers lists the allowed layer ciphers, such as AES_256_CTR_HMAC_SHA256
+	Ciphers []string `yaml:"ciphers,omitempty"`
+}
+
+// Load reads an algorithm policy
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read algorithm policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse algorithm policy %s: %w", path, err)
+	}
+	if p.MinRSABits < 0 {
+		return nil, fmt.Errorf("invalid min-rsa-bits %d in algorithm policy %s", p.MinRSABits, path)
+	}
+	return &p, nil
+}
+
+var current atomic.Pointer[Policy]
+
+// Set makes the policy apply to the rest of the process; nil restores the
+// default policy
+func Set(p *Policy) {
+	current.Store(p)
+}
+
+// Current returns the policy that applies
+func Current() *Policy {
+	if p := current.Load(); p != nil {
+		return p
+	}
+	return &Policy{}
+}
+
+func (p *Policy) minRSABits() int {
+	if p.MinRSABits == 0 {
+		return DefaultMinRSABits
+	}
+	return p.MinRSABits
+}
+
+// allowed returns whether the name is in the list, which allows everything if
+// empty and may hold prefixes followed by '*'
+func allowed(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, a := range list {
+		if strings.HasSuffix(a, "*") && strings.HasPrefix(name, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckScheme returns an error if the policy does not allow layer keys to be
+// wrapped with the scheme
+func (p *Policy) CheckScheme(scheme string) error {
+	if !allowed(p.Schemes, scheme) {
+		return fmt.Errorf("wrap scheme %s is %w; allowed are %s", scheme, ErrNotAllowed, strings.Join(p.Schemes, ", "))
+	}
+	return nil
+}
+
+// CheckJWEAlgorithm returns an error if the policy does not allow layer keys
+// to be wrapped with the JWE key management algorithm
+func (p *Policy) CheckJWEAlgorithm(alg string) error {
+	if !allowed(p.JWEAlgorithms, alg) {
+		return fmt.Errorf("JWE key wrapping %s is %w; allowed are %s", alg, ErrNotAllowed, strings.Join(p.JWEAlgorithms, ", "))
+	}
+	return nil
+}
+
+// CheckRSABits returns an error if the policy does not allow RSA keys of the size
+func (p *Policy) CheckRSABits(bits int) error {
+	if bits < p.minRSABits() {
+		return fmt.Errorf("RSA keys of %d bits are %w; at least %d bits are required", bits, ErrNotAllowed, p.minRSABits())
+	}
+	return nil
+}
+
+// CheckCurve returns an error if the policy does not allow the elliptic curve
+func (p *Policy) CheckCurve(curve string) error {
+	if !allowed(p.Curves, curve) {
+		return fmt.Errorf("EC keys on curve %s are %w; allowed are %s", curve, ErrNotAllowed, strings.Join(p.Curves, ", "))
+	}
+	return nil
+}
+
+// CheckPublicKey returns an error if the policy does not allow layer keys to
+// be wrapped for the key. Only RSA and EC keys are restricted.
+func (p *Policy) CheckPublicKey(key crypto.PublicKey) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return p.CheckRSABits(k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return p.CheckCurve(k.Curve.Params().Name)
+	}
+	return nil
+}
+
+// CheckCipher returns an error if the policy does not allow layers to be
+// encrypted with the cipher, as named in their public options
+func (p *Policy) CheckCipher(cipher string) error {
+	if !allowed(p.Ciphers, cipher) {
+		return fmt.Errorf("layer cipher %s is %w; allowed are %s", cipher, ErrNotAllowed, strings.Join(p.Ciphers, ", "))
+	}
+	return nil
+}
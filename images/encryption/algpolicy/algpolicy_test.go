@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package algpolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Current()
+	if err := p.CheckPublicKey(&rsa1024.PublicKey); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected 1024 bit RSA key to be refused, got %v", err)
+	}
+	if err := p.CheckPublicKey(&rsa2048.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{p.CheckScheme("pgp"), p.CheckCurve("P-521"), p.CheckCipher("AES_256_CTR_HMAC_SHA256")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "algorithms.yaml")
+	data := []byte("schemes: [jwe, provider.*]\nmin-rsa-bits: 3072\ncurves: [P-384]\n")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scheme := range []string{"jwe", "provider.kms"} {
+		if err := p.CheckScheme(scheme); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := p.CheckScheme("pgp"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expected pgp to be refused, got %v", err)
+	}
+	if err := p.CheckRSABits(2048); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expected 2048 bit RSA keys to be refused, got %v", err)
+	}
+	if err := p.CheckCurve("P-256"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expected P-256 to be refused, got %v", err)
+	}
+}
+
+func TestAllowedJWE(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, []jose.Recipient{
+		{Algorithm: jose.RSA_OAEP, Key: &rsaKey.PublicKey},
+		{Algorithm: jose.ECDH_ES_A256KW, Key: &ecKey.PublicKey},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt([]byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(obj.FullSerialize())
+
+	p := &Policy{JWEAlgorithms: []string{"ECDH-ES+A256KW"}}
+	allowed, err := p.allowedJWE(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwe struct {
+		Recipients []json.RawMessage `json:"recipients"`
+	}
+	if err := json.Unmarshal(allowed, &jwe); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwe.Recipients) != 1 {
+		t.Fatalf("expected only the EC recipient to remain, got %d", len(jwe.Recipients))
+	}
+
+	p = &Policy{MinRSABits: 3072, Curves: []string{"P-384"}}
+	if _, err := p.allowedJWE(data); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected all recipients to be refused, got %v", err)
+	}
+}
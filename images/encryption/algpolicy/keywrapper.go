@@ -0,0 +1,304 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package algpolicy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	encutils "github.com/gobars/ocicrypt/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// restrictedSchemes are the schemes of the key wrappers whose keys and
+// algorithms are restricted, with the parameters holding their recipients
+var restrictedSchemes = map[string][]string{
+	"jwe":        {"pubkeys"},
+	"pkcs11":     {"pkcs11-pubkeys", "pkcs11-yamls"},
+	"pkcs7":      {"x509s"},
+	"pgp":        {"gpg-recipients"},
+	"jwe-hybrid": {"jwe-hybrid-pubkeys"},
+}
+
+// keyWrapper restricts a key wrapper to the algorithms and keys allowed by
+// the current policy
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers registered with ocicrypt so that they are
+// restricted by the current policy. It must be called after the other key
+// wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for scheme := range restrictedSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	p := Current()
+	for _, param := range restrictedSchemes[kw.scheme] {
+		if len(ec.Parameters[param]) > 0 {
+			if err := p.CheckScheme(kw.scheme); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.checkRecipients(kw.scheme, ec.Parameters); err != nil {
+		return nil, err
+	}
+	wrapped, err := kw.KeyWrapper.WrapKeys(ec, optsData)
+	if err != nil || wrapped == nil || kw.scheme != "jwe" {
+		return wrapped, err
+	}
+	// the key management algorithm is chosen by ocicrypt, or by the FIPS mode
+	jwe, err := parseJWE(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range jwe.recipients {
+		if err := p.checkJWERecipient(r); err != nil {
+			return nil, err
+		}
+	}
+	return wrapped, nil
+}
+
+// checkRecipients returns an error if a public key the layer key is wrapped
+// for is not allowed
+func (p *Policy) checkRecipients(scheme string, params map[string][][]byte) error {
+	switch scheme {
+	case "jwe":
+		for _, data := range params["pubkeys"] {
+			key, err := encutils.ParsePublicKey(data, "JWE")
+			if err != nil {
+				return err
+			}
+			if err := p.CheckPublicKey(key); err != nil {
+				return err
+			}
+		}
+	case "pkcs11":
+		for _, data := range params["pkcs11-pubkeys"] {
+			key, err := encutils.ParsePublicKey(data, "PKCS11")
+			if err != nil {
+				return err
+			}
+			if err := p.CheckPublicKey(key); err != nil {
+				return err
+			}
+		}
+	case "pkcs7":
+		for _, data := range params["x509s"] {
+			cert, err := encutils.ParseCertificate(data, "PKCS7")
+			if err != nil {
+				return err
+			}
+			if err := p.CheckPublicKey(cert.PublicKey); err != nil {
+				return fmt.Errorf("certificate %s: %w", cert.Subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, wrapped []byte) ([]byte, error) {
+	p := Current()
+	if err := p.CheckScheme(kw.scheme); err != nil {
+		return nil, err
+	}
+	if kw.scheme == "jwe" {
+		var err error
+		if wrapped, err = p.allowedJWE(wrapped); err != nil {
+			return nil, err
+		}
+	}
+	return kw.KeyWrapper.UnwrapKey(dc, wrapped)
+}
+
+// Filter returns the descriptor without the wrapped keys of the schemes that
+// the policy does not allow, so that decryption does not attempt them, or an
+// error describing why none of the wrapped keys may be used
+func (p *Policy) Filter(desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var errs []error
+	annotations := make(map[string]string, len(desc.Annotations))
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	wrappedKeys := ocicrypt.GetWrappedKeysMap(desc)
+	for scheme := range wrappedKeys {
+		if err := p.CheckScheme(scheme); err != nil {
+			delete(annotations, ocicrypt.GetKeyWrapper(scheme).GetAnnotationID())
+			errs = append(errs, err)
+		}
+	}
+	if len(wrappedKeys) > 0 && len(errs) == len(wrappedKeys) {
+		return ocispec.Descriptor{}, fmt.Errorf("the layer key cannot be unwrapped: %w", errors.Join(errs...))
+	}
+	desc.Annotations = annotations
+	return desc, nil
+}
+
+// jweHeader holds the header parameters of a JWE recipient that select its
+// algorithms
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Epk *struct {
+		Crv string `json:"crv"`
+	} `json:"epk,omitempty"`
+}
+
+func (h *jweHeader) merge(other jweHeader) {
+	if h.Alg == "" {
+		h.Alg = other.Alg
+	}
+	if h.Epk == nil {
+		h.Epk = other.Epk
+	}
+}
+
+type jweRecipient struct {
+	header       jweHeader
+	encryptedKey string
+	raw          map[string]json.RawMessage
+}
+
+type parsedJWE struct {
+	fields     map[string]json.RawMessage
+	recipients []jweRecipient
+	// flattened is set for the flattened serialization with a single recipient
+	flattened bool
+}
+
+func parseJWE(data []byte) (*parsedJWE, error) {
+	jwe := parsedJWE{}
+	if err := json.Unmarshal(data, &jwe.fields); err != nil {
+		return nil, fmt.Errorf("could not parse JWE: %w", err)
+	}
+	var shared jweHeader
+	if raw, ok := jwe.fields["protected"]; ok {
+		var b64 string
+		if err := json.Unmarshal(raw, &b64); err != nil {
+			return nil, fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+		protected, err := base64.RawURLEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode protected header of JWE: %w", err)
+		}
+		if err := json.Unmarshal(protected, &shared); err != nil {
+			return nil, fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+	}
+	if raw, ok := jwe.fields["unprotected"]; ok {
+		var unprotected jweHeader
+		if err := json.Unmarshal(raw, &unprotected); err != nil {
+			return nil, fmt.Errorf("could not parse unprotected header of JWE: %w", err)
+		}
+		shared.merge(unprotected)
+	}
+
+	recipient := func(raw map[string]json.RawMessage) jweRecipient {
+		r := jweRecipient{raw: raw}
+		if h, ok := raw["header"]; ok {
+			_ = json.Unmarshal(h, &r.header)
+		}
+		r.header.merge(shared)
+		if ek, ok := raw["encrypted_key"]; ok {
+			_ = json.Unmarshal(ek, &r.encryptedKey)
+		}
+		return r
+	}
+
+	raw, ok := jwe.fields["recipients"]
+	if !ok {
+		jwe.flattened = true
+		jwe.recipients = []jweRecipient{recipient(jwe.fields)}
+		return &jwe, nil
+	}
+	var recipients []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &recipients); err != nil {
+		return nil, fmt.Errorf("could not parse recipients of JWE: %w", err)
+	}
+	for _, r := range recipients {
+		jwe.recipients = append(jwe.recipients, recipient(r))
+	}
+	return &jwe, nil
+}
+
+// checkJWERecipient returns an error if the policy does not allow the key
+// wrapping of the JWE recipient
+func (p *Policy) checkJWERecipient(r jweRecipient) error {
+	if err := p.CheckJWEAlgorithm(r.header.Alg); err != nil {
+		return err
+	}
+	if r.header.Epk != nil {
+		return p.CheckCurve(r.header.Epk.Crv)
+	}
+	if strings.HasPrefix(r.header.Alg, "RSA") {
+		// the RSA encrypted key is as long as the modulus
+		ek, err := base64.RawURLEncoding.DecodeString(r.encryptedKey)
+		if err != nil {
+			return fmt.Errorf("could not decode encrypted key of JWE: %w", err)
+		}
+		return p.CheckRSABits(len(ek) * 8)
+	}
+	return nil
+}
+
+// allowedJWE returns the JSON serialized JWE without the recipients whose key
+// wrapping the policy does not allow
+func (p *Policy) allowedJWE(data []byte) ([]byte, error) {
+	jwe, err := parseJWE(data)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		allowed []map[string]json.RawMessage
+		errs    []error
+	)
+	for _, r := range jwe.recipients {
+		if err := p.checkJWERecipient(r); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		allowed = append(allowed, r.raw)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no JWE recipient may be used: %w", errors.Join(errs...))
+	}
+	if len(errs) == 0 || jwe.flattened {
+		return data, nil
+	}
+	if jwe.fields["recipients"], err = json.Marshal(allowed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jwe.fields)
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package atrest keeps unpacked layers encrypted at rest on the node.
+//
+// The root directory of a snapshotter is protected with a filesystem-level
+// encryption policy (fscrypt) before the snapshotter creates any snapshot in it.
+// All snapshot directories inherit the policy, so file contents and names are
+// only ever written to disk encrypted and are transparently decrypted by the
+// kernel while the key is present in the filesystem keyring.
+package atrest
+
+import (
+	"context"
+	"crypto/sha512"
+	"errors"
+	"sync"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// ErrNotSupported is returned if filesystem-level encryption is not supported
+// on this platform
+var ErrNotSupported = errors.New("encryption at rest is not supported on this platform")
+
+// KeySize is the size of the master key used for the encryption policy
+const KeySize = sha512.Size
+
+// KeyFromSecret derives a master key of KeySize bytes from the given secret
+func KeyFromSecret(secret []byte) []byte {
+	key := sha512.Sum512(secret)
+	return key[:]
+}
+
+// Setup applies an encryption policy using the given master key to the empty
+// directory dir and returns the identifier of the key. Setup is idempotent for a
+// directory that already uses the same key.
+func Setup(dir string, key []byte) ([]byte, error) {
+	return setup(dir, key)
+}
+
+// Unlock adds the master key to the keyring of the filesystem dir is located on
+// so that the contents of directories protected with it become accessible.
+func Unlock(dir string, key []byte) error {
+	_, err := addKey(dir, key)
+	return err
+}
+
+type snapshotter struct {
+	snapshots.Snapshotter
+
+	root      string
+	key       []byte
+	unlockKey func(dir string, key []byte) error
+
+	mu       sync.Mutex
+	unlocked bool
+}
+
+// NewSnapshotter wraps a snapshotter whose root directory has been set up with
+// Setup and makes sure that the key is available before any snapshot or the
+// metadata of the snapshotter, which are all stored below the root, are
+// accessed.
+func NewSnapshotter(sn snapshots.Snapshotter, root string, key []byte) snapshots.Snapshotter {
+	return &snapshotter{
+		Snapshotter: sn,
+		root:        root,
+		key:         key,
+		unlockKey:   Unlock,
+	}
+}
+
+// unlock adds the key to the filesystem keyring unless it was added before; a
+// failure is retried by the next call
+func (s *snapshotter) unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unlocked {
+		return nil
+	}
+	if err := s.unlockKey(s.root, s.key); err != nil {
+		return err
+	}
+	s.unlocked = true
+	return nil
+}
+
+func (s *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	if err := s.unlock(); err != nil {
+		return snapshots.Info{}, err
+	}
+	return s.Snapshotter.Stat(ctx, key)
+}
+
+func (s *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	if err := s.unlock(); err != nil {
+		return snapshots.Info{}, err
+	}
+	return s.Snapshotter.Update(ctx, info, fieldpaths...)
+}
+
+func (s *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	if err := s.unlock(); err != nil {
+		return snapshots.Usage{}, err
+	}
+	return s.Snapshotter.Usage(ctx, key)
+}
+
+func (s *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	if err := s.unlock(); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Mounts(ctx, key)
+}
+
+func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.unlock(); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	if err := s.unlock(); err != nil {
+		return nil, err
+	}
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if err := s.unlock(); err != nil {
+		return err
+	}
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s *snapshotter) Remove(ctx context.Context, key string) error {
+	if err := s.unlock(); err != nil {
+		return err
+	}
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func (s *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error {
+	if err := s.unlock(); err != nil {
+		return err
+	}
+	return s.Snapshotter.Walk(ctx, fn, filters...)
+}
+
+// Cleanup removes the directories of removed snapshots if the wrapped
+// snapshotter removes them asynchronously
+func (s *snapshotter) Cleanup(ctx context.Context) error {
+	c, ok := s.Snapshotter.(snapshots.Cleaner)
+	if !ok {
+		return nil
+	}
+	if err := s.unlock(); err != nil {
+		return err
+	}
+	return c.Cleanup(ctx)
+}
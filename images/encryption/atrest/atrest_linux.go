@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package atrest
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// addKey adds the key to the filesystem keyring and returns its identifier
+func addKey(dir string, key []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes long", KeySize)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the raw key immediately follows the argument structure
+	argSize := int(unsafe.Sizeof(unix.FscryptAddKeyArg{}))
+	buf := make([]byte, argSize+len(key))
+	defer func() {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}()
+	arg := (*unix.FscryptAddKeyArg)(unsafe.Pointer(&buf[0]))
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = uint32(len(key))
+	copy(buf[argSize:], key)
+
+	if err := ioctl(f, unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, fmt.Errorf("could not add key to filesystem keyring of %s: %w", dir, err)
+	}
+	id := make([]byte, unix.FSCRYPT_KEY_IDENTIFIER_SIZE)
+	copy(id, arg.Key_spec.U[:])
+	return id, nil
+}
+
+func setup(dir string, key []byte) ([]byte, error) {
+	id, err := addKey(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+	}
+	copy(policy.Master_key_identifier[:], id)
+
+	if err := ioctl(f, unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&policy)); err != nil {
+		switch err {
+		case unix.EEXIST:
+			return nil, fmt.Errorf("%s is already protected with a different key: %w", dir, err)
+		case unix.ENOTEMPTY:
+			return nil, fmt.Errorf("%s must be empty to be protected: %w", dir, err)
+		case unix.EOPNOTSUPP, unix.ENOTTY:
+			return nil, fmt.Errorf("filesystem of %s does not support encryption: %w", dir, ErrNotSupported)
+		}
+		return nil, fmt.Errorf("could not set encryption policy on %s: %w", dir, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package atrest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// countingSnapshotter counts the calls of each method
+type countingSnapshotter struct {
+	calls map[string]int
+}
+
+func (c *countingSnapshotter) Stat(context.Context, string) (snapshots.Info, error) {
+	c.calls["Stat"]++
+	return snapshots.Info{}, nil
+}
+
+func (c *countingSnapshotter) Update(_ context.Context, info snapshots.Info, _ ...string) (snapshots.Info, error) {
+	c.calls["Update"]++
+	return info, nil
+}
+
+func (c *countingSnapshotter) Usage(context.Context, string) (snapshots.Usage, error) {
+	c.calls["Usage"]++
+	return snapshots.Usage{}, nil
+}
+
+func (c *countingSnapshotter) Mounts(context.Context, string) ([]mount.Mount, error) {
+	c.calls["Mounts"]++
+	return nil, nil
+}
+
+func (c *countingSnapshotter) Prepare(context.Context, string, string, ...snapshots.Opt) ([]mount.Mount, error) {
+	c.calls["Prepare"]++
+	return nil, nil
+}
+
+func (c *countingSnapshotter) View(context.Context, string, string, ...snapshots.Opt) ([]mount.Mount, error) {
+	c.calls["View"]++
+	return nil, nil
+}
+
+func (c *countingSnapshotter) Commit(context.Context, string, string, ...snapshots.Opt) error {
+	c.calls["Commit"]++
+	return nil
+}
+
+func (c *countingSnapshotter) Remove(context.Context, string) error {
+	c.calls["Remove"]++
+	return nil
+}
+
+func (c *countingSnapshotter) Walk(context.Context, snapshots.WalkFunc, ...string) error {
+	c.calls["Walk"]++
+	return nil
+}
+
+func (c *countingSnapshotter) Cleanup(context.Context) error {
+	c.calls["Cleanup"]++
+	return nil
+}
+
+func (c *countingSnapshotter) Close() error {
+	c.calls["Close"]++
+	return nil
+}
+
+// operations calls every method of the snapshotter that accesses its root
+func operations(sn snapshots.Snapshotter) map[string]func() error {
+	ctx := context.Background()
+	return map[string]func() error{
+		"Stat":    func() error { _, err := sn.Stat(ctx, "a"); return err },
+		"Update":  func() error { _, err := sn.Update(ctx, snapshots.Info{Name: "a"}); return err },
+		"Usage":   func() error { _, err := sn.Usage(ctx, "a"); return err },
+		"Mounts":  func() error { _, err := sn.Mounts(ctx, "a"); return err },
+		"Prepare": func() error { _, err := sn.Prepare(ctx, "a", ""); return err },
+		"View":    func() error { _, err := sn.View(ctx, "a", ""); return err },
+		"Commit":  func() error { return sn.Commit(ctx, "b", "a") },
+		"Remove":  func() error { return sn.Remove(ctx, "b") },
+		"Walk":    func() error { return sn.Walk(ctx, func(context.Context, snapshots.Info) error { return nil }) },
+		"Cleanup": func() error { return sn.(snapshots.Cleaner).Cleanup(ctx) },
+	}
+}
+
+func TestSnapshotterUnlocks(t *testing.T) {
+	inner := &countingSnapshotter{calls: make(map[string]int)}
+	sn := NewSnapshotter(inner, "/var/lib/snapshotter", KeyFromSecret([]byte("secret"))).(*snapshotter)
+	errLocked := errors.New("key not available")
+	sn.unlockKey = func(string, []byte) error { return errLocked }
+
+	for name, op := range operations(sn) {
+		if err := op(); !errors.Is(err, errLocked) {
+			t.Fatalf("expected %s to fail without the key, got %v", name, err)
+		}
+		if inner.calls[name] != 0 {
+			t.Fatalf("expected %s not to reach the snapshotter without the key", name)
+		}
+	}
+
+	// a failed unlock is retried, a successful one is not repeated
+	unlocks := 0
+	sn.unlockKey = func(dir string, key []byte) error {
+		if dir != "/var/lib/snapshotter" || len(key) != KeySize {
+			t.Fatalf("unexpected unlock of %s with a key of %d bytes", dir, len(key))
+		}
+		unlocks++
+		return nil
+	}
+	for name, op := range operations(sn) {
+		if err := op(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if inner.calls[name] != 1 {
+			t.Fatalf("expected %s to reach the snapshotter once, got %d", name, inner.calls[name])
+		}
+	}
+	if unlocks != 1 {
+		t.Fatalf("expected the key to be added once, got %d", unlocks)
+	}
+	if err := sn.Close(); err != nil || inner.calls["Close"] != 1 {
+		t.Fatalf("expected Close to be passed on, got %v", err)
+	}
+}
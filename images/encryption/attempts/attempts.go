@@ -0,0 +1,370 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package attempts records the attempts to unwrap the keys of layers with
+// the key wrappers of all schemes and why each of them failed, so that the
+// failure to use an image can be explained in detail instead of by the single
+// error that ocicrypt returns.
+//
+// Attempts are recorded for the DecryptConfig bound to a Recorder with Bind;
+// key wrappers are called without a context, so the DecryptConfig they are
+// called with identifies the operation.
+package attempts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/matched"
+	"github.com/containerd/imgcrypt/images/encryption/timelock"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reason tells why an attempt to unwrap a layer key failed
+type Reason string
+
+const (
+	// ReasonUnwrapped means that the layer key was unwrapped
+	ReasonUnwrapped Reason = "unwrapped"
+	// ReasonNoKey means that no private key of the scheme was given, so the
+	// wrapped key was not tried
+	ReasonNoKey Reason = "no-key"
+	// ReasonWrongKey means that none of the given private keys fits
+	ReasonWrongKey Reason = "wrong-key"
+	// ReasonBadPassword means that the password of a private key is wrong or missing
+	ReasonBadPassword Reason = "bad-password"
+	// ReasonUnreachable means that a keyprovider or key service could not be reached
+	ReasonUnreachable Reason = "unreachable"
+	// ReasonPolicyDenied means that the algorithm policy, the FIPS mode or a
+	// keyprovider call policy did not allow the attempt
+	ReasonPolicyDenied Reason = "policy-denied"
+	// ReasonTimeLocked means that the unlock time of a time-locked key has not come
+	ReasonTimeLocked Reason = "time-locked"
+	// ReasonContextMismatch means that the layer key is not bound to the
+	// expected encryption context
+	ReasonContextMismatch Reason = "context-mismatch"
+	// ReasonLockedOut means that the PIN or passphrase was not tried since
+	// too many wrong ones were tried before
+	ReasonLockedOut Reason = "locked-out"
+	// ReasonUnknown is any other failure
+	ReasonUnknown Reason = "unknown"
+)
+
+// Attempt is an attempt to unwrap one wrapped key of a layer
+type Attempt struct {
+	Scheme string `json:"scheme"`
+	// Index is the position of the wrapped key among those of the scheme
+	Index  int    `json:"index"`
+	Reason Reason `json:"reason"`
+	Error  string `json:"error,omitempty"`
+	// Recipient is the recipient whose wrapped key was unwrapped, such as
+	// the ID of the key, as reported by the key wrapper of the scheme; it is
+	// only set for the attempt that unwrapped the layer key
+	Recipient string `json:"recipient,omitempty"`
+	// Duration is the time the key wrapper took; it is not set for schemes
+	// that were not tried
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Layer holds the attempts to unwrap the key of a layer
+type Layer struct {
+	Digest    digest.Digest `json:"digest"`
+	Unwrapped bool          `json:"unwrapped"`
+	Attempts  []Attempt     `json:"attempts"`
+}
+
+// Recorder records the attempts to unwrap the keys of layers
+type Recorder struct {
+	mu     sync.Mutex
+	layers []*Layer
+}
+
+var (
+	boundMu sync.Mutex
+	bound   = make(map[*encconfig.DecryptConfig]*Recorder)
+)
+
+// Bind records the attempts made with dc in a new Recorder until the returned
+// function is called
+func Bind(dc *encconfig.DecryptConfig) (*Recorder, func()) {
+	r := &Recorder{}
+	boundMu.Lock()
+	bound[dc] = r
+	boundMu.Unlock()
+	return r, func() {
+		boundMu.Lock()
+		defer boundMu.Unlock()
+		if bound[dc] == r {
+			delete(bound, dc)
+		}
+	}
+}
+
+func recorderOf(dc *encconfig.DecryptConfig) *Recorder {
+	boundMu.Lock()
+	defer boundMu.Unlock()
+	return bound[dc]
+}
+
+// BeginLayer starts the recording of the attempts to unwrap the key of the
+// layer with dc, if a Recorder is bound to it; the schemes of the layer for
+// which no private keys are given are recorded as not tried
+func BeginLayer(dc *encconfig.DecryptConfig, desc ocispec.Descriptor) {
+	r := recorderOf(dc)
+	if r == nil {
+		return
+	}
+	l := &Layer{Digest: desc.Digest, Attempts: []Attempt{}}
+	wrappedKeys := ocicrypt.GetWrappedKeysMap(desc)
+	schemes := make([]string, 0, len(wrappedKeys))
+	for scheme := range wrappedKeys {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	for _, scheme := range schemes {
+		kw := ocicrypt.GetKeyWrapper(scheme)
+		if kw == nil || !kw.NoPossibleKeys(dc.Parameters) {
+			continue
+		}
+		for i := range strings.Split(wrappedKeys[scheme], ",") {
+			l.Attempts = append(l.Attempts, Attempt{Scheme: scheme, Index: i, Reason: ReasonNoKey})
+		}
+	}
+	r.mu.Lock()
+	r.layers = append(r.layers, l)
+	r.mu.Unlock()
+}
+
+// Layers returns the layers whose keys were attempted to be unwrapped, in the
+// order they were
+func (r *Recorder) Layers() []Layer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	layers := make([]Layer, 0, len(r.layers))
+	for _, l := range r.layers {
+		c := *l
+		c.Attempts = append([]Attempt{}, l.Attempts...)
+		layers = append(layers, c)
+	}
+	return layers
+}
+
+func (r *Recorder) record(scheme, recipient string, err error, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.layers) == 0 {
+		return
+	}
+	l := r.layers[len(r.layers)-1]
+	a := Attempt{Scheme: scheme, Reason: ReasonUnwrapped, Duration: d}
+	for _, prev := range l.Attempts {
+		if prev.Scheme == scheme {
+			a.Index++
+		}
+	}
+	if err != nil {
+		a.Reason = Classify(err)
+		a.Error = err.Error()
+	} else {
+		l.Unwrapped = true
+		a.Recipient = recipient
+	}
+	l.Attempts = append(l.Attempts, a)
+}
+
+// UnwrappedBy returns the attempt that unwrapped the key of the layer, if any
+func (l *Layer) UnwrappedBy() (Attempt, bool) {
+	for _, a := range l.Attempts {
+		if a.Reason == ReasonUnwrapped {
+			return a, true
+		}
+	}
+	return Attempt{}, false
+}
+
+// Classify returns why a key wrapper failed to unwrap a layer key
+func Classify(err error) Reason {
+	var (
+		netErr net.Error
+		urlErr *url.Error
+	)
+	switch {
+	case err == nil:
+		return ReasonUnwrapped
+	case errors.Is(err, enccontext.ErrMismatch):
+		return ReasonContextMismatch
+	case errors.Is(err, timelock.ErrLocked):
+		return ReasonTimeLocked
+	case errors.Is(err, unwraplimit.ErrLockedOut):
+		return ReasonLockedOut
+	case errors.Is(err, algpolicy.ErrNotAllowed), errors.Is(err, fips.ErrNotApproved):
+		return ReasonPolicyDenied
+	case errors.Is(err, keyprovider.ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded), errors.Is(err, exec.ErrNotFound),
+		errors.As(err, &netErr), errors.As(err, &urlErr):
+		return ReasonUnreachable
+	}
+	// keyproviders return gRPC errors wrapped with their name
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		se, ok := e.(interface{ GRPCStatus() *status.Status })
+		if !ok {
+			continue
+		}
+		switch se.GRPCStatus().Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return ReasonUnreachable
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return ReasonPolicyDenied
+		}
+		break
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range reasonMessages {
+		for _, s := range m.messages {
+			if strings.Contains(msg, s) {
+				return m.reason
+			}
+		}
+	}
+	return ReasonUnknown
+}
+
+// messages of errors by reason, since ocicrypt and keyproviders do not export
+// their errors
+var reasonMessages = []struct {
+	reason   Reason
+	messages []string
+}{
+	// pkcs11pool joins the errors of the keys it tries
+	{ReasonLockedOut, []string{
+		unwraplimit.ErrLockedOut.Error(),
+	}},
+	{ReasonBadPassword, []string{
+		"wrong password",
+		"missing password",
+		"incorrect passphrase",
+		"incorrect pin",
+	}},
+	{ReasonUnreachable, []string{
+		"error while dialing",
+		"connection refused",
+		"no such host",
+		"code = unavailable",
+		"unreachable",
+	}},
+	{ReasonWrongKey, []string{
+		"no suitable",
+		"could not find",
+		"no enveloped recipient",
+		"error in cryptographic primitive",
+		"decryption error",
+		"incorrect key",
+		"not found",
+		"could not be used",
+		"no matching",
+	}},
+}
+
+// builtinSchemes are the schemes of the key wrappers whose attempts are
+// recorded, in addition to those of the keyproviders
+var builtinSchemes = []string{"jwe", "pkcs7", "pgp", "pkcs11", "jwe-hybrid", "threshold"}
+
+// keyWrapper records the attempts of a key wrapper to unwrap layer keys
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var (
+	installMu    sync.Mutex
+	installed    = make(map[string]bool)
+	decorateOnce sync.Once
+)
+
+// Install wraps the key wrappers registered with ocicrypt so that their
+// attempts are recorded. It must be called after the other key wrappers are
+// installed, so that their failures are recorded too; those of the
+// keyproviders are wrapped whenever they are registered.
+func Install() {
+	installMu.Lock()
+	defer installMu.Unlock()
+	for _, scheme := range builtinSchemes {
+		if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil && !installed[scheme] {
+			ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			installed[scheme] = true
+		}
+	}
+	decorateOnce.Do(func() {
+		keyprovider.Decorate(func(scheme string, kw keywrap.KeyWrapper) keywrap.KeyWrapper {
+			return &keyWrapper{kw, scheme}
+		})
+	})
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	r := recorderOf(dc)
+	if r == nil {
+		return kw.KeyWrapper.UnwrapKey(dc, annotation)
+	}
+	// the key wrapper of the scheme reports the recipient it unwrapped the
+	// key of to the context bound to dc
+	ctx, t := matched.Track(tracing.Context(dc))
+	unbind := tracing.Bind(ctx, dc)
+	start := time.Now()
+	optsData, err := kw.KeyWrapper.UnwrapKey(dc, annotation)
+	d := time.Since(start)
+	unbind()
+	r.record(kw.scheme, t.Recipient(), err, d)
+	return optsData, err
+}
+
+// Summary returns one line per attempt, such as
+// "sha256:0123...: jwe #0: wrong-key: <error>"
+func Summary(layers []Layer) []string {
+	var lines []string
+	for _, l := range layers {
+		for _, a := range l.Attempts {
+			line := fmt.Sprintf("%s: %s #%d: %s", l.Digest, a.Scheme, a.Index, a.Reason)
+			if a.Recipient != "" {
+				line += " by " + a.Recipient
+			}
+			if a.Error != "" {
+				line += ": " + a.Error
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
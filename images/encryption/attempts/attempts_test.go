@@ -0,0 +1,55 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package attempts
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/timelock"
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected Reason
+	}{
+		{err: nil, expected: ReasonUnwrapped},
+		{err: errors.New("JWE: Wrong password: could not decrypt private key"), expected: ReasonBadPassword},
+		{err: errors.New("go-jose/go-jose: error in cryptographic primitive"), expected: ReasonWrongKey},
+		{err: errors.New("pkcs7: no enveloped recipient for provided certificate"), expected: ReasonWrongKey},
+		{err: fmt.Errorf("keyprovider kms: %w", status.Error(codes.Unavailable, "connection closed")), expected: ReasonUnreachable},
+		{err: fmt.Errorf("keyprovider kbs: %w", status.Error(codes.PermissionDenied, "attestation failed")), expected: ReasonPolicyDenied},
+		{err: fmt.Errorf("RSA-OAEP: %w", algpolicy.ErrNotAllowed), expected: ReasonPolicyDenied},
+		{err: fmt.Errorf("keyprovider timelock: %w", &timelock.LockedError{UnlockTime: time.Now().Add(time.Hour)}), expected: ReasonTimeLocked},
+		{err: fmt.Errorf("%w: bound to tenant=a", enccontext.ErrMismatch), expected: ReasonContextMismatch},
+		{err: fmt.Errorf("JWE: %w: 5 wrong passphrases for key", unwraplimit.ErrLockedOut), expected: ReasonLockedOut},
+		{err: errors.New("could not find a pkcs11 key for decryption: pkcs11:token=t: could not login to device: locked out after failed attempts: wrong pin"), expected: ReasonLockedOut},
+		{err: errors.New("something else"), expected: ReasonUnknown},
+	} {
+		if actual := Classify(tc.err); actual != tc.expected {
+			t.Fatalf("%v: expected %s, got %s", tc.err, tc.expected, actual)
+		}
+	}
+}
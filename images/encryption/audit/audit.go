@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package audit emits records of the key operations done on encrypted images
+package audit
+
+import (
+	"context"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/typeurl"
+	"github.com/opencontainers/go-digest"
+)
+
+// RecordURI is the type URL of a Record published as containerd event
+const RecordURI = "io.containerd.imgcrypt.audit.v1.Record"
+
+func init() {
+	typeurl.Register(&Record{}, RecordURI)
+}
+
+// Operation is the kind of key operation that is audited
+type Operation string
+
+const (
+	// OpWrap is the wrapping of a layer key for recipients during encryption
+	OpWrap Operation = "wrap"
+	// OpUnwrap is the unwrapping of a layer key during decryption
+	OpUnwrap Operation = "unwrap"
+	// OpAuthorize is the check whether an image may be used
+	OpAuthorize Operation = "authorize"
+)
+
+// Record describes a single key operation
+type Record struct {
+	Time       time.Time     `json:"time"`
+	Operation  Operation     `json:"operation"`
+	User       string        `json:"user,omitempty"`
+	Namespace  string        `json:"namespace,omitempty"`
+	Tenant     string        `json:"tenant,omitempty"`
+	Image      string        `json:"image,omitempty"`
+	Layer      digest.Digest `json:"layer,omitempty"`
+	Schemes    []string      `json:"schemes,omitempty"`
+	Recipients []string      `json:"recipients,omitempty"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Sink receives audit records
+type Sink interface {
+	Emit(ctx context.Context, rec Record) error
+}
+
+var (
+	defaultSink Sink
+	sinkMu      sync.RWMutex
+)
+
+// SetSink sets the sink that receives the records of all operations for which
+// the context does not carry a sink; nil disables auditing
+func SetSink(s Sink) {
+	sinkMu.Lock()
+	defaultSink = s
+	sinkMu.Unlock()
+}
+
+type (
+	sinkKey  struct{}
+	imageKey struct{}
+	userKey  struct{}
+)
+
+// WithSink returns a context whose operations are audited to the given sink
+func WithSink(ctx context.Context, s Sink) context.Context {
+	return context.WithValue(ctx, sinkKey{}, s)
+}
+
+// WithImage returns a context whose records refer to the image with the given name
+func WithImage(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, imageKey{}, name)
+}
+
+// WithUser returns a context whose records name the given user; by default the
+// user running the process is recorded
+func WithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userKey{}, name)
+}
+
+func sinkFromContext(ctx context.Context) Sink {
+	if s, ok := ctx.Value(sinkKey{}).(Sink); ok {
+		return s
+	}
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	return defaultSink
+}
+
+// Enabled returns whether operations in the context are audited
+func Enabled(ctx context.Context) bool {
+	return sinkFromContext(ctx) != nil
+}
+
+var (
+	userOnce    sync.Once
+	processUser string
+)
+
+func currentUser() string {
+	userOnce.Do(func() {
+		if u, err := user.Current(); err == nil {
+			processUser = u.Username
+		}
+	})
+	return processUser
+}
+
+// Emit completes the record with the time and the information carried by the
+// context and passes it to the sink. Errors of the sink are logged, they do not
+// fail the audited operation.
+func Emit(ctx context.Context, rec Record, err error) {
+	s := sinkFromContext(ctx)
+	if s == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	if rec.User == "" {
+		rec.User, _ = ctx.Value(userKey{}).(string)
+		if rec.User == "" {
+			rec.User = currentUser()
+		}
+	}
+	if rec.Namespace == "" {
+		rec.Namespace, _ = namespaces.Namespace(ctx)
+	}
+	if rec.Image == "" {
+		rec.Image, _ = ctx.Value(imageKey{}).(string)
+	}
+	rec.Success = err == nil
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := s.Emit(ctx, rec); err != nil {
+		logging.G(ctx).Warn("failed to emit audit record", "error", err)
+	}
+}
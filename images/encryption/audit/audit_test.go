@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestEmitFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	ctx := namespaces.WithNamespace(context.Background(), "tenant-a")
+	if Enabled(ctx) {
+		t.Fatal("auditing must be disabled without a sink")
+	}
+	ctx = WithUser(WithImage(WithSink(ctx, sink), "docker.io/library/busybox:enc"), "alice")
+
+	Emit(ctx, Record{Operation: OpWrap, Recipients: []string{"jwe:key.pem"}}, nil)
+	Emit(ctx, Record{Operation: OpUnwrap}, errors.New("no suitable key"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	if !recs[0].Success || recs[0].User != "alice" || recs[0].Namespace != "tenant-a" || recs[0].Image != "docker.io/library/busybox:enc" || recs[0].Time.IsZero() {
+		t.Fatalf("unexpected record %+v", recs[0])
+	}
+	if recs[1].Success || recs[1].Error != "no suitable key" {
+		t.Fatalf("unexpected record %+v", recs[1])
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/events"
+)
+
+// EventTopic is the topic audit records are published on as containerd events
+const EventTopic = "/imgcrypt/audit"
+
+// FileSink appends records as JSON lines to a file
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileSink opens the file at path for appending records
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Emit appends the record to the file
+func (fs *FileSink) Emit(_ context.Context, rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, err = fs.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file
+func (fs *FileSink) Close() error {
+	return fs.f.Close()
+}
+
+// EventSink publishes records as containerd events on EventTopic
+type EventSink struct {
+	Publisher events.Publisher
+}
+
+// Emit publishes the record
+func (es EventSink) Emit(ctx context.Context, rec Record) error {
+	return es.Publisher.Publish(ctx, EventTopic, &rec)
+}
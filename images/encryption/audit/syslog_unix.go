@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogSink sends records as JSON to the local syslog daemon
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the local syslog daemon and tags the records with tag
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Emit sends the record; failed operations are logged with warning priority
+func (ss *SyslogSink) Emit(_ context.Context, rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if !rec.Success {
+		return ss.w.Warning(string(data))
+	}
+	return ss.w.Info(string(data))
+}
+
+// Close closes the connection to the syslog daemon
+func (ss *SyslogSink) Close() error {
+	return ss.w.Close()
+}
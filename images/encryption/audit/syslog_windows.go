@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"errors"
+)
+
+// SyslogSink is not supported on Windows
+type SyslogSink struct{}
+
+// NewSyslogSink returns an error since there is no syslog on Windows
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
+
+// Emit does nothing
+func (ss *SyslogSink) Emit(_ context.Context, rec Record) error {
+	return nil
+}
+
+// Close does nothing
+func (ss *SyslogSink) Close() error {
+	return nil
+}
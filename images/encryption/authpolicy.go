@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AuthorizationPolicy decides whether an image may be used based on the encryption
+// of its layers, in addition to the check that the keys for using it are available
+type AuthorizationPolicy interface {
+	// Authorize returns an error if the image with the given reference and
+	// layers must not be used; the reference is built with ImageReference
+	Authorize(ctx context.Context, name string, layers []LayerInfo) error
+}
+
+// ImageReference returns the name of an image pinned to the digest of its
+// target. Names can be given to any image, so authorization policies are passed
+// this reference to be able to match images by their content.
+func ImageReference(name string, target digest.Digest) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@" + target.String()
+}
+
+// CheckAuthorizationPolicy checks the layers of the image for the given platform against the policy
+func CheckAuthorizationPolicy(ctx context.Context, cs content.Store, name string, desc ocispec.Descriptor, platform platforms.MatchComparer, policy AuthorizationPolicy) error {
+	manifest, err := images.Manifest(ctx, cs, desc, platform)
+	if err != nil {
+		return err
+	}
+	var layers []LayerInfo
+	for i, l := range manifest.Layers {
+		l, err := ExpandKeys(ctx, cs, l)
+		if err != nil {
+			return err
+		}
+		li, err := GetLayerInfo(uint32(i), l, nil)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, li)
+	}
+	err = policy.Authorize(ctx, ImageReference(name, desc.Digest), layers)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrNotAuthorized, err)
+	}
+	audit.Emit(ctx, audit.Record{Operation: audit.OpAuthorize, Image: name}, err)
+	return err
+}
+
+// WithAuthorizationPolicy checks the image of a container against the policy upon
+// creation of the container
+func WithAuthorizationPolicy(policy AuthorizationPolicy) containerd.NewContainerOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		image, err := client.ImageService().Get(ctx, c.Image)
+		if errdefs.IsNotFound(err) {
+			// allow creation of container without a existing image
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return CheckAuthorizationPolicy(ctx, client.ContentStore(), image.Name, image.Target, platforms.Default(), policy)
+	}
+}
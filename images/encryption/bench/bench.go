@@ -0,0 +1,329 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bench measures how fast layers are encrypted and decrypted with
+// each cipher and how fast layer keys are wrapped and unwrapped with each
+// wrap scheme on the current host, to guide the choice of cipher and scheme
+// and to spot regressions.
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/keygen"
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/blockcipher"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// Operations measured
+const (
+	OpEncrypt = "encrypt"
+	OpDecrypt = "decrypt"
+	OpWrap    = "wrap"
+	OpUnwrap  = "unwrap"
+)
+
+const (
+	// DefaultSize is the default size of the layer data encrypted
+	DefaultSize = 64 << 20
+	// DefaultDuration is the default minimum time each operation is repeated for
+	DefaultDuration = time.Second
+)
+
+// Result is the outcome of repeating an operation
+type Result struct {
+	// Name is the cipher or the wrap scheme and key type
+	Name      string        `json:"name"`
+	Operation string        `json:"operation"`
+	Count     int           `json:"count"`
+	Bytes     int64         `json:"bytes,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// MBPerSecond returns the throughput in MB (10^6 bytes) per second
+func (r Result) MBPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / 1e6 / r.Duration.Seconds()
+}
+
+// PerOperation returns the average time taken by an operation
+func (r Result) PerOperation() time.Duration {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Duration / time.Duration(r.Count)
+}
+
+// Options select what is measured
+type Options struct {
+	// Ciphers to measure; all of Ciphers() if empty
+	Ciphers []blockcipher.LayerCipherType
+	// Schemes to measure by name; all of Schemes() if empty
+	Schemes []string
+	// Size is the size of the layer data; DefaultSize if zero
+	Size int64
+	// Duration is the minimum time each operation is repeated for;
+	// DefaultDuration if zero
+	Duration time.Duration
+}
+
+// Ciphers returns the layer ciphers that can be measured, which are those
+// ocicrypt encrypts layers with
+func Ciphers() []blockcipher.LayerCipherType {
+	h, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		return nil
+	}
+	var ciphers []blockcipher.LayerCipherType
+	for _, typ := range []blockcipher.LayerCipherType{blockcipher.AES256CTR, blockcipher.SM4128CTR} {
+		if _, _, err := h.Encrypt(bytes.NewReader(nil), typ); err == nil {
+			ciphers = append(ciphers, typ)
+		}
+	}
+	return ciphers
+}
+
+// scheme sets up the wrapping of layer keys with a scheme and key type
+type scheme struct {
+	name    string
+	wrapper string
+	setup   func() (*encconfig.EncryptConfig, *encconfig.DecryptConfig, error)
+}
+
+var schemes = []scheme{
+	{"jwe/rsa-2048", "jwe", keyPairSetup(keygen.Options{Type: keygen.KeyTypeRSA, Bits: 2048}, false)},
+	{"jwe/rsa-4096", "jwe", keyPairSetup(keygen.Options{Type: keygen.KeyTypeRSA, Bits: 4096}, false)},
+	{"jwe/ecdsa-p256", "jwe", keyPairSetup(keygen.Options{Type: keygen.KeyTypeECDSA, Curve: "P-256"}, false)},
+	{"jwe/ecdsa-p384", "jwe", keyPairSetup(keygen.Options{Type: keygen.KeyTypeECDSA, Curve: "P-384"}, false)},
+	{"pkcs7/rsa-2048", "pkcs7", keyPairSetup(keygen.Options{Type: keygen.KeyTypeRSA, Bits: 2048}, true)},
+	{"jwe-hybrid/x25519-mlkem768", hybrid.Scheme, hybridSetup},
+}
+
+// Schemes returns the names of the wrap schemes and key types that can be
+// measured
+func Schemes() []string {
+	names := make([]string, len(schemes))
+	for i, s := range schemes {
+		names[i] = s.name
+	}
+	return names
+}
+
+func keyPairSetup(opts keygen.Options, pkcs7 bool) func() (*encconfig.EncryptConfig, *encconfig.DecryptConfig, error) {
+	return func() (*encconfig.EncryptConfig, *encconfig.DecryptConfig, error) {
+		kp, err := keygen.GenerateKeyPair(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		dcc, err := encconfig.DecryptWithPrivKeys([][]byte{kp.Private}, [][]byte{nil})
+		if err != nil {
+			return nil, nil, err
+		}
+		if !pkcs7 {
+			ecc, err := encconfig.EncryptWithJwe([][]byte{kp.Public})
+			if err != nil {
+				return nil, nil, err
+			}
+			return ecc.EncryptConfig, dcc.DecryptConfig, nil
+		}
+		cert, err := kp.SelfSignedCertificate("imgcrypt-bench", time.Hour)
+		if err != nil {
+			return nil, nil, err
+		}
+		ecc, err := encconfig.EncryptWithPkcs7([][]byte{cert})
+		if err != nil {
+			return nil, nil, err
+		}
+		xcc, err := encconfig.DecryptWithX509s([][]byte{cert})
+		if err != nil {
+			return nil, nil, err
+		}
+		cc := encconfig.CombineCryptoConfigs([]encconfig.CryptoConfig{dcc, xcc})
+		return ecc.EncryptConfig, cc.DecryptConfig, nil
+	}
+}
+
+func hybridSetup() (*encconfig.EncryptConfig, *encconfig.DecryptConfig, error) {
+	hybrid.Install()
+	priv, pub, err := hybrid.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return hybrid.EncryptWithPublicKeys([][]byte{pub}).EncryptConfig, hybrid.DecryptWithPrivateKeys([][]byte{priv}).DecryptConfig, nil
+}
+
+// Run measures the selected ciphers and schemes; schemes that are not
+// supported by the build, such as jwe-hybrid before Go 1.24, are skipped
+func Run(opts Options) ([]Result, error) {
+	if opts.Size == 0 {
+		opts.Size = DefaultSize
+	}
+	if opts.Duration == 0 {
+		opts.Duration = DefaultDuration
+	}
+	ciphers := opts.Ciphers
+	if len(ciphers) == 0 {
+		ciphers = Ciphers()
+	}
+	names := opts.Schemes
+	if len(names) == 0 {
+		names = Schemes()
+	}
+	var results []Result
+	for _, c := range ciphers {
+		r, err := Cipher(c, opts.Size, opts.Duration)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	for _, name := range names {
+		r, err := Scheme(name, opts.Duration)
+		if errors.Is(err, hybrid.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
+// repeat calls op until d has elapsed, at least once
+func repeat(d time.Duration, op func() error) (int, time.Duration, error) {
+	start := time.Now()
+	n := 0
+	for {
+		if err := op(); err != nil {
+			return 0, 0, err
+		}
+		n++
+		if elapsed := time.Since(start); elapsed >= d {
+			return n, elapsed, nil
+		}
+	}
+}
+
+// zeroReader reads zeros; the speed of the ciphers does not depend on the data
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Cipher measures the encryption and decryption of layer data of the given
+// size with the cipher
+func Cipher(typ blockcipher.LayerCipherType, size int64, d time.Duration) ([]Result, error) {
+	h, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		return nil, err
+	}
+	encrypt := func(w io.Writer) (blockcipher.LayerBlockCipherOptions, error) {
+		r, fin, err := h.Encrypt(io.LimitReader(zeroReader{}, size), typ)
+		if err != nil {
+			return blockcipher.LayerBlockCipherOptions{}, err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return blockcipher.LayerBlockCipherOptions{}, err
+		}
+		return fin()
+	}
+
+	n, elapsed, err := repeat(d, func() error {
+		_, err := encrypt(io.Discard)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encrypting with %s: %w", typ, err)
+	}
+	results := []Result{{Name: string(typ), Operation: OpEncrypt, Count: n, Bytes: int64(n) * size, Duration: elapsed}}
+
+	var ciphertext bytes.Buffer
+	opts, err := encrypt(&ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting with %s: %w", typ, err)
+	}
+	n, elapsed, err = repeat(d, func() error {
+		r, _, err := h.Decrypt(bytes.NewReader(ciphertext.Bytes()), opts)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with %s: %w", typ, err)
+	}
+	return append(results, Result{Name: string(typ), Operation: OpDecrypt, Count: n, Bytes: int64(n) * size, Duration: elapsed}), nil
+}
+
+// Scheme measures the wrapping and unwrapping of a layer key with the named
+// wrap scheme and key type, one of Schemes()
+func Scheme(name string, d time.Duration) ([]Result, error) {
+	var s *scheme
+	for i := range schemes {
+		if schemes[i].name == name {
+			s = &schemes[i]
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("unknown scheme %q", name)
+	}
+	ec, dc, err := s.setup()
+	if err != nil {
+		return nil, err
+	}
+	kw := ocicrypt.GetKeyWrapper(s.wrapper)
+	if kw == nil {
+		return nil, fmt.Errorf("no key wrapper for scheme %s", s.wrapper)
+	}
+	optsData, err := json.Marshal(blockcipher.PrivateLayerBlockCipherOptions{SymmetricKey: make([]byte, 32)})
+	if err != nil {
+		return nil, err
+	}
+
+	var annotation []byte
+	n, elapsed, err := repeat(d, func() error {
+		annotation, err = kw.WrapKeys(ec, optsData)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("wrapping with %s: %w", name, err)
+	}
+	results := []Result{{Name: name, Operation: OpWrap, Count: n, Duration: elapsed}}
+
+	n, elapsed, err = repeat(d, func() error {
+		_, err := kw.UnwrapKey(dc, annotation)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping with %s: %w", name, err)
+	}
+	return append(results, Result{Name: name, Operation: OpUnwrap, Count: n, Duration: elapsed}), nil
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/blockcipher"
+)
+
+func TestRun(t *testing.T) {
+	results, err := Run(Options{
+		Schemes:  []string{"jwe/ecdsa-p256", "pkcs7/rsa-2048"},
+		Size:     64 << 10,
+		Duration: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 2*len(Ciphers()) + 2*2
+	if len(results) != want {
+		t.Fatalf("got %d results, want %d", len(results), want)
+	}
+	for _, r := range results {
+		if r.Count == 0 || r.Duration <= 0 {
+			t.Errorf("%s %s was not measured", r.Name, r.Operation)
+		}
+		if (r.Operation == OpEncrypt || r.Operation == OpDecrypt) && r.MBPerSecond() <= 0 {
+			t.Errorf("%s %s has no throughput", r.Name, r.Operation)
+		}
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	if _, err := Scheme("rot13", 1); err == nil {
+		t.Fatal("expected an error for an unknown scheme")
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	const size = 1 << 20
+	for _, typ := range Ciphers() {
+		b.Run(string(typ), func(b *testing.B) {
+			h, err := blockcipher.NewLayerBlockCipherHandler()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				r, fin, err := h.Encrypt(io.LimitReader(zeroReader{}, size), typ)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := fin(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	const size = 1 << 20
+	for _, typ := range Ciphers() {
+		b.Run(string(typ), func(b *testing.B) {
+			h, err := blockcipher.NewLayerBlockCipherHandler()
+			if err != nil {
+				b.Fatal(err)
+			}
+			r, fin, err := h.Encrypt(io.LimitReader(zeroReader{}, size), typ)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var ciphertext bytes.Buffer
+			if _, err := io.Copy(&ciphertext, r); err != nil {
+				b.Fatal(err)
+			}
+			opts, err := fin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, _, err := h.Decrypt(bytes.NewReader(ciphertext.Bytes()), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnwrap(b *testing.B) {
+	optsData, err := json.Marshal(blockcipher.PrivateLayerBlockCipherOptions{SymmetricKey: make([]byte, 32)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, s := range schemes {
+		b.Run(s.name, func(b *testing.B) {
+			ec, dc, err := s.setup()
+			if errors.Is(err, hybrid.ErrUnsupported) {
+				b.Skip(err)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			kw := ocicrypt.GetKeyWrapper(s.wrapper)
+			annotation, err := kw.WrapKeys(ec, optsData)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := kw.UnwrapKey(dc, annotation); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
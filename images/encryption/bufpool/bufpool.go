@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bufpool provides reusable buffers for streaming layer data, so that
+// concurrent encryption and decryption of layers do not allocate a buffer for
+// every layer or, as io.Copy does in some cases, for every chunk.
+package bufpool
+
+import (
+	"io"
+	"sync"
+)
+
+// Size is the size of the pooled buffers. The layer ciphers encrypt and
+// decrypt as much data as the buffer they are read into holds, so it is the
+// size of the chunks layer data is processed in.
+const Size = 256 << 10
+
+var pool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, Size)
+		return &b
+	},
+}
+
+// Get returns a buffer of Size bytes from the pool
+func Get() *[]byte {
+	return pool.Get().(*[]byte)
+}
+
+// Put returns a buffer obtained from Get to the pool
+func Put(b *[]byte) {
+	pool.Put(b)
+}
+
+// readerOnly and writerOnly hide the io.WriterTo and io.ReaderFrom
+// implementations that would make io.CopyBuffer ignore the pooled buffer
+type (
+	readerOnly struct{ io.Reader }
+	writerOnly struct{ io.Writer }
+)
+
+// Copy copies from src to dst until EOF or an error, through a pooled buffer,
+// and returns the number of bytes copied
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := Get()
+	defer Put(b)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *b)
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bufpool
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("layer data "), 3*Size/10)
+	var out bytes.Buffer
+	n, err := Copy(&out, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("copied %d bytes, want %d", n, len(data))
+	}
+}
+
+func TestCopyReusesBuffers(t *testing.T) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := make([]byte, 4*Size)
+	r := bytes.NewReader(data)
+	// *os.File implements io.ReaderFrom, with which io.Copy would allocate
+	// a buffer for each copy
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(data)
+		if _, err := Copy(f, io.LimitReader(r, int64(len(data)))); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 3 {
+		t.Fatalf("got %v allocations per copy", allocs)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package chunkhash describes the data of an encrypted layer by the hashes of
+// its chunks and the root of a hash tree over them, held in an annotation of
+// the layer. The digest of a layer and the HMAC of ocicrypt only tell that a
+// layer is corrupted once all of it was read; the chunk hashes tell which
+// chunks are, so that corruption is detected while the layer is streamed and
+// only the corrupted byte ranges need to be fetched again.
+//
+// Chunks are hashed with SHA-256. The leaves of the tree are the chunk hashes
+// and each inner node is the SHA-256 of a 0x01 byte followed by its two
+// children; a node without a sibling is carried up as it is.
+package chunkhash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Annotation holds the Tree of an encrypted layer as JSON; like all
+	// annotations of the encryption it is removed on decryption
+	Annotation = "org.opencontainers.image.enc.chunks"
+
+	// Version is the version of the trees written by this package
+	Version = 1
+
+	// MinChunkSize is the smallest size of the chunks
+	MinChunkSize = 1 << 20
+	// MaxChunks is how many chunks layers are split into at most, which
+	// bounds the size of the annotation to about 44KiB
+	MaxChunks = 1024
+)
+
+// ErrCorrupted is returned when the data of a layer does not match its chunk
+// hashes
+var ErrCorrupted = errors.New("layer data does not match its chunk hashes")
+
+type enabledKey struct{}
+
+// WithEnabled returns a context in which the chunk hashes of layers are added
+// when they are encrypted if e is set
+func WithEnabled(ctx context.Context, e bool) context.Context {
+	return context.WithValue(ctx, enabledKey{}, e)
+}
+
+// Enabled returns whether the chunk hashes of layers are added in ctx
+func Enabled(ctx context.Context) bool {
+	e, _ := ctx.Value(enabledKey{}).(bool)
+	return e
+}
+
+// Tree describes the data of a layer by the hashes of its chunks
+type Tree struct {
+	Version int `json:"version"`
+	// ChunkSize is the size of all chunks but the last one
+	ChunkSize int64 `json:"chunkSize"`
+	// Size is the size of the layer data
+	Size int64 `json:"size"`
+	// Root is the root of the hash tree over the chunk hashes
+	Root digest.Digest `json:"root"`
+	// Chunks are the SHA-256 hashes of the chunks, one after the other
+	Chunks []byte `json:"chunks"`
+}
+
+// ChunkSize returns the chunk size for layer data of the given size: the
+// smallest power of two of at least MinChunkSize that splits it into at most
+// MaxChunks chunks
+func ChunkSize(size int64) int64 {
+	chunkSize := int64(MinChunkSize)
+	for (size+chunkSize-1)/chunkSize > MaxChunks {
+		chunkSize <<= 1
+	}
+	return chunkSize
+}
+
+// Count returns the number of chunks
+func (t *Tree) Count() int {
+	return len(t.Chunks) / sha256.Size
+}
+
+// Chunk returns the hash of chunk i
+func (t *Tree) Chunk(i int) []byte {
+	return t.Chunks[i*sha256.Size : (i+1)*sha256.Size]
+}
+
+// Range returns the offset and length of chunk i in the layer data, such as
+// for fetching it again with an HTTP range request
+func (t *Tree) Range(i int) (offset, length int64) {
+	offset = int64(i) * t.ChunkSize
+	length = t.ChunkSize
+	if offset+length > t.Size {
+		length = t.Size - offset
+	}
+	return offset, length
+}
+
+// VerifyChunk returns whether data is chunk i of the layer
+func (t *Tree) VerifyChunk(i int, data []byte) bool {
+	if i < 0 || i >= t.Count() {
+		return false
+	}
+	if _, length := t.Range(i); int64(len(data)) != length {
+		return false
+	}
+	h := sha256.Sum256(data)
+	return bytes.Equal(h[:], t.Chunk(i))
+}
+
+// Validate checks that the chunk hashes cover the size of the layer data and
+// match the root
+func (t *Tree) Validate() error {
+	if t.Version != Version {
+		return fmt.Errorf("unsupported chunk hashes version %d", t.Version)
+	}
+	if t.ChunkSize <= 0 || t.Size < 0 {
+		return fmt.Errorf("invalid chunk size %d or layer size %d", t.ChunkSize, t.Size)
+	}
+	if len(t.Chunks)%sha256.Size != 0 {
+		return fmt.Errorf("chunk hashes have invalid length %d", len(t.Chunks))
+	}
+	if want := (t.Size + t.ChunkSize - 1) / t.ChunkSize; int64(t.Count()) != want {
+		return fmt.Errorf("%d chunk hashes for %d chunks", t.Count(), want)
+	}
+	if root := root(t.Chunks); root != t.Root {
+		return fmt.Errorf("chunk hashes do not match root %s", t.Root)
+	}
+	return nil
+}
+
+// root returns the root of the hash tree over the chunk hashes
+func root(chunks []byte) digest.Digest {
+	level := make([][]byte, 0, len(chunks)/sha256.Size)
+	for i := 0; i+sha256.Size <= len(chunks); i += sha256.Size {
+		level = append(level, chunks[i:i+sha256.Size])
+	}
+	if len(level) == 0 {
+		return digest.NewDigestFromBytes(digest.SHA256, sha256.New().Sum(nil))
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return digest.NewDigestFromBytes(digest.SHA256, level[0])
+}
+
+// Read returns the chunk hashes of the layer and whether it has any
+func Read(desc ocispec.Descriptor) (*Tree, bool, error) {
+	s, ok := desc.Annotations[Annotation]
+	if !ok {
+		return nil, false, nil
+	}
+	var t Tree
+	if err := json.Unmarshal([]byte(s), &t); err != nil {
+		return nil, false, fmt.Errorf("could not parse annotation %s: %w", Annotation, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, false, fmt.Errorf("annotation %s: %w", Annotation, err)
+	}
+	if t.Size != desc.Size {
+		return nil, false, fmt.Errorf("annotation %s describes %d bytes, but the layer has %d", Annotation, t.Size, desc.Size)
+	}
+	return &t, true, nil
+}
+
+// Annotate sets the chunk hashes annotation of the layer
+func Annotate(desc *ocispec.Descriptor, t *Tree) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if desc.Annotations == nil {
+		desc.Annotations = make(map[string]string)
+	}
+	desc.Annotations[Annotation] = string(data)
+	return nil
+}
+
+// Hasher hashes the chunks of the layer data written to it
+type Hasher struct {
+	chunkSize int64
+	h         hash.Hash
+	n         int64
+	size      int64
+	chunks    []byte
+}
+
+// NewHasher returns a Hasher splitting the data into chunks of chunkSize
+func NewHasher(chunkSize int64) *Hasher {
+	return &Hasher{chunkSize: chunkSize, h: sha256.New()}
+}
+
+// Write hashes p
+func (hr *Hasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := hr.chunkSize - hr.n
+		if int64(len(p)) < n {
+			n = int64(len(p))
+		}
+		hr.h.Write(p[:n])
+		hr.n += n
+		hr.size += n
+		p = p[n:]
+		if hr.n == hr.chunkSize {
+			hr.chunks = hr.h.Sum(hr.chunks)
+			hr.h.Reset()
+			hr.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Tree returns the chunk hashes of the data written so far
+func (hr *Hasher) Tree() *Tree {
+	chunks := append([]byte{}, hr.chunks...)
+	if hr.n > 0 {
+		chunks = hr.h.Sum(chunks)
+	}
+	return &Tree{
+		Version:   Version,
+		ChunkSize: hr.chunkSize,
+		Size:      hr.size,
+		Root:      root(chunks),
+		Chunks:    chunks,
+	}
+}
+
+// CorruptedChunkError is returned for a chunk whose data does not match its
+// hash
+type CorruptedChunkError struct {
+	Chunk  int
+	Offset int64
+	Length int64
+}
+
+func (e *CorruptedChunkError) Error() string {
+	return fmt.Sprintf("chunk %d at bytes %d-%d: %v", e.Chunk, e.Offset, e.Offset+e.Length-1, ErrCorrupted)
+}
+
+func (e *CorruptedChunkError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// verifyingReader checks each chunk once it was read
+type verifyingReader struct {
+	r     io.Reader
+	t     *Tree
+	h     hash.Hash
+	chunk int
+	n     int64
+	err   error
+}
+
+// NewVerifyingReader returns a reader of the layer data read from r that
+// returns a CorruptedChunkError as soon as a chunk was read that does not
+// match its hash, or an error if the data is longer or shorter than the tree
+// describes. The data of a chunk is returned before it is verified.
+func NewVerifyingReader(r io.Reader, t *Tree) io.Reader {
+	return &verifyingReader{r: r, t: t, h: sha256.New()}
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.r.Read(p)
+	for b := p[:n]; len(b) > 0; {
+		if vr.chunk >= vr.t.Count() {
+			vr.err = fmt.Errorf("layer data is longer than %d bytes: %w", vr.t.Size, ErrCorrupted)
+			return n, vr.err
+		}
+		_, length := vr.t.Range(vr.chunk)
+		m := length - vr.n
+		if int64(len(b)) < m {
+			m = int64(len(b))
+		}
+		vr.h.Write(b[:m])
+		vr.n += m
+		b = b[m:]
+		if vr.n == length {
+			if !bytes.Equal(vr.h.Sum(nil), vr.t.Chunk(vr.chunk)) {
+				offset, _ := vr.t.Range(vr.chunk)
+				vr.err = &CorruptedChunkError{Chunk: vr.chunk, Offset: offset, Length: length}
+				return n, vr.err
+			}
+			vr.h.Reset()
+			vr.chunk++
+			vr.n = 0
+		}
+	}
+	if err == io.EOF && vr.chunk < vr.t.Count() {
+		vr.err = fmt.Errorf("layer data is shorter than %d bytes: %w", vr.t.Size, ErrCorrupted)
+		return n, vr.err
+	}
+	return n, err
+}
+
+// Verify reads the layer data from r and returns the chunks that do not
+// match their hashes; an error is only returned if r could not be read
+func (t *Tree) Verify(r io.Reader) ([]int, error) {
+	var corrupted []int
+	buf := make([]byte, 32<<10)
+	h := sha256.New()
+	chunk, n := 0, int64(0)
+	for {
+		m, err := r.Read(buf)
+		for b := buf[:m]; len(b) > 0 && chunk < t.Count(); {
+			_, length := t.Range(chunk)
+			k := length - n
+			if int64(len(b)) < k {
+				k = int64(len(b))
+			}
+			h.Write(b[:k])
+			n += k
+			b = b[k:]
+			if n == length {
+				if !bytes.Equal(h.Sum(nil), t.Chunk(chunk)) {
+					corrupted = append(corrupted, chunk)
+				}
+				h.Reset()
+				chunk++
+				n = 0
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// chunks that are missing or incomplete do not match either
+	for ; chunk < t.Count(); chunk++ {
+		corrupted = append(corrupted, chunk)
+	}
+	return corrupted, nil
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chunkhash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		size, chunkSize int64
+	}{
+		{0, MinChunkSize},
+		{MaxChunks * MinChunkSize, MinChunkSize},
+		{MaxChunks*MinChunkSize + 1, 2 * MinChunkSize},
+		{64 << 30, 64 << 20},
+	} {
+		if got := ChunkSize(tc.size); got != tc.chunkSize {
+			t.Errorf("ChunkSize(%d) = %d, expected %d", tc.size, got, tc.chunkSize)
+		}
+	}
+}
+
+func testTree(t *testing.T, data []byte, chunkSize int64) *Tree {
+	t.Helper()
+	h := NewHasher(chunkSize)
+	// odd writes cross the chunk boundaries
+	for b := data; len(b) > 0; {
+		n := 7
+		if n > len(b) {
+			n = len(b)
+		}
+		h.Write(b[:n])
+		b = b[n:]
+	}
+	tree := h.Tree()
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestTree(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	tree := testTree(t, data, 64)
+	if tree.Count() != 16 || tree.Size != 1000 {
+		t.Fatalf("expected 16 chunks of 1000 bytes, got %d of %d", tree.Count(), tree.Size)
+	}
+	if offset, length := tree.Range(15); offset != 960 || length != 40 {
+		t.Fatalf("expected the last chunk at 960 with 40 bytes, got %d, %d", offset, length)
+	}
+	if !tree.VerifyChunk(15, data[960:]) || tree.VerifyChunk(14, data[960:]) {
+		t.Fatal("expected only the data of a chunk to verify")
+	}
+
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := Annotate(&desc, tree); err != nil {
+		t.Fatal(err)
+	}
+	read, ok, err := Read(desc)
+	if err != nil || !ok || read.Root != tree.Root {
+		t.Fatalf("expected the tree to be read back, got %v, %v", ok, err)
+	}
+
+	tampered := *tree
+	tampered.Chunks = append([]byte{}, tree.Chunks...)
+	tampered.Chunks[0] ^= 1
+	if err := tampered.Validate(); err == nil {
+		t.Fatal("expected chunk hashes that do not match the root to be refused")
+	}
+	desc.Size++
+	if _, _, err := Read(desc); err == nil {
+		t.Fatal("expected chunk hashes of a layer of another size to be refused")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	tree := testTree(t, data, 64)
+
+	if corrupted, err := tree.Verify(bytes.NewReader(data)); err != nil || len(corrupted) != 0 {
+		t.Fatalf("expected no corrupted chunks, got %v, %v", corrupted, err)
+	}
+	if _, err := io.Copy(io.Discard, NewVerifyingReader(bytes.NewReader(data), tree)); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[100] ^= 1
+	corrupt[999] ^= 1
+	corrupted, err := tree.Verify(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 2 || corrupted[0] != 1 || corrupted[1] != 15 {
+		t.Fatalf("expected chunks 1 and 15 to be corrupted, got %v", corrupted)
+	}
+	_, err = io.Copy(io.Discard, NewVerifyingReader(bytes.NewReader(corrupt), tree))
+	var cce *CorruptedChunkError
+	if !errors.As(err, &cce) || cce.Chunk != 1 || !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected chunk 1 to be reported as corrupted, got %v", err)
+	}
+
+	if corrupted, _ := tree.Verify(bytes.NewReader(data[:900])); len(corrupted) != 2 {
+		t.Fatalf("expected the missing chunks to be reported, got %v", corrupted)
+	}
+	if _, err := io.Copy(io.Discard, NewVerifyingReader(bytes.NewReader(data[:900]), tree)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected truncated data to be refused, got %v", err)
+	}
+	if _, err := io.Copy(io.Discard, NewVerifyingReader(bytes.NewReader(append(data, 0)), tree)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected overlong data to be refused, got %v", err)
+	}
+}
@@ -22,9 +22,14 @@ import (
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
 	"github.com/containerd/typeurl"
 
 	encconfig "github.com/gobars/ocicrypt/config"
@@ -33,8 +38,14 @@ import (
 
 // WithDecryptedUnpack allows to pass parameters the 'layertool' needs to the applier
 func WithDecryptedUnpack(data *imgcrypt.Payload) diff.ApplyOpt {
-	return func(_ context.Context, desc ocispec.Descriptor, c *diff.ApplyConfig) error {
+	return func(ctx context.Context, desc ocispec.Descriptor, c *diff.ApplyConfig) error {
 		data.Descriptor = desc
+		if tenant, ok := TenantFromContext(ctx); ok {
+			if data.Annotations == nil {
+				data.Annotations = make(map[string]string)
+			}
+			data.Annotations[imgcrypt.PayloadAnnotationTenant] = tenant
+		}
 		anything, err := typeurl.MarshalAny(data)
 		if err != nil {
 			return fmt.Errorf("failed to marshal payload: %w", err)
@@ -47,6 +58,52 @@ func WithDecryptedUnpack(data *imgcrypt.Payload) diff.ApplyOpt {
 	}
 }
 
+// WithEncryptedLayerCheck fails the application of encrypted layers with an
+// EncryptedLayerError unless they are passed to a decoder, which is done by
+// WithDecryptedUnpack; without the decoder, the applier would fail with an
+// unknown media type. It must be given after the other ApplyOpts.
+func WithEncryptedLayerCheck() diff.ApplyOpt {
+	return func(ctx context.Context, desc ocispec.Descriptor, c *diff.ApplyConfig) error {
+		if !IsEncryptedDiff(ctx, desc.MediaType) {
+			return nil
+		}
+		for _, id := range imgcrypt.PayloadToolIDs {
+			if _, ok := c.ProcessorPayloads[id]; ok {
+				return nil
+			}
+		}
+		return &EncryptedLayerError{
+			Op:        "apply",
+			Digest:    desc.Digest,
+			MediaType: desc.MediaType,
+			Reason:    "no decryption keys were given for unpacking",
+		}
+	}
+}
+
+// PrefetchProviderKeys unwraps the keyprovider wrapped keys of the layers of the
+// image for the platform with batch calls and adds them to the payload, so that
+// the decoder does not call the keyproviders once per layer
+func PrefetchProviderKeys(ctx context.Context, cs content.Store, image images.Image, platform platforms.MatchComparer, data *imgcrypt.Payload) error {
+	manifest, err := images.Manifest(ctx, cs, image.Target, platform)
+	if err != nil {
+		return err
+	}
+	var encrypted []ocispec.Descriptor
+	for _, layer := range manifest.Layers {
+		if IsEncryptedDiff(ctx, layer.MediaType) {
+			if expanded, err := ExpandKeys(ctx, cs, layer); err == nil {
+				layer = expanded
+			}
+			encrypted = append(encrypted, layer)
+		}
+	}
+	for _, k := range keyprovider.UnwrapBatch(ctx, &data.DecryptConfig, encrypted) {
+		data.UnwrappedKeys = append(data.UnwrappedKeys, imgcrypt.UnwrappedKey(k))
+	}
+	return nil
+}
+
 // WithUnpackConfigApplyOpts allows to pass an ApplyOpt
 func WithUnpackConfigApplyOpts(opt diff.ApplyOpt) containerd.UnpackOpt {
 	return func(_ context.Context, uc *containerd.UnpackConfig) error {
@@ -75,6 +132,6 @@ func WithAuthorizationCheck(dc *encconfig.DecryptConfig) containerd.NewContainer
 			return err
 		}
 
-		return CheckAuthorization(ctx, client.ContentStore(), image.Target, dc)
+		return CheckAuthorization(audit.WithImage(ctx, image.Name), client.ContentStore(), image.Target, dc)
 	}
 }
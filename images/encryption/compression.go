@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/bufpool"
+	"github.com/gobars/ocicrypt/blockcipher"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerCompression is how plain layers are compressed when they are
+// encrypted. Encrypted data cannot be compressed, so layers are compressed
+// before encryption or not at all; uncompressed layers take more space in the
+// registry but no CPU to decompress once decrypted.
+type LayerCompression string
+
+const (
+	// CompressionKeep encrypts layers as they are compressed
+	CompressionKeep LayerCompression = "keep"
+	// CompressionNone decompresses layers before they are encrypted, so that
+	// they are stored as encrypted tar files
+	CompressionNone LayerCompression = "none"
+	// CompressionZstd recompresses layers that are not compressed with zstd
+	// before they are encrypted, so that they decompress faster than gzip
+	CompressionZstd LayerCompression = "zstd"
+)
+
+// ParseLayerCompression returns the LayerCompression with the given name; the
+// empty name is CompressionKeep
+func ParseLayerCompression(s string) (LayerCompression, error) {
+	switch c := LayerCompression(s); c {
+	case "":
+		return CompressionKeep, nil
+	case CompressionKeep, CompressionNone, CompressionZstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("unsupported layer compression %q, expected %q, %q or %q", s, CompressionKeep, CompressionNone, CompressionZstd)
+}
+
+type layerCompressionKey struct{}
+
+// WithLayerCompression returns a context in which plain layers are compressed
+// as set by c when they are encrypted
+func WithLayerCompression(ctx context.Context, c LayerCompression) context.Context {
+	return context.WithValue(ctx, layerCompressionKey{}, c)
+}
+
+// layerCompression returns the compression set by WithLayerCompression, or
+// CompressionKeep
+func layerCompression(ctx context.Context) LayerCompression {
+	if c, ok := ctx.Value(layerCompressionKey{}).(LayerCompression); ok && c != "" {
+		return c
+	}
+	return CompressionKeep
+}
+
+// convertedMediaType returns the media type that the plain layer with the
+// given media type is converted to before it is encrypted with the layer
+// compression c, and whether it is converted
+func convertedMediaType(mediaType string, c LayerCompression) (string, bool) {
+	var compressed, zstd bool
+	switch mediaType {
+	case images.MediaTypeDockerSchema2LayerGzip, ocispec.MediaTypeImageLayerGzip:
+		compressed = true
+	case ocispec.MediaTypeImageLayerZstd:
+		compressed, zstd = true, true
+	case images.MediaTypeDockerSchema2Layer, ocispec.MediaTypeImageLayer:
+	default:
+		return "", false
+	}
+	switch {
+	case c == CompressionNone && compressed:
+		return ocispec.MediaTypeImageLayer, true
+	case c == CompressionZstd && !zstd:
+		return ocispec.MediaTypeImageLayerZstd, true
+	}
+	return "", false
+}
+
+// layerFormat identifies the cipher and the compression that the plain layer
+// desc is encrypted with, for the keys of reusable encrypted layers
+func layerFormat(ctx context.Context, desc ocispec.Descriptor) string {
+	f := string(blockcipher.AES256CTR)
+	if mediaType, ok := convertedMediaType(desc.MediaType, layerCompression(ctx)); ok {
+		f += "+" + mediaType
+	}
+	return f
+}
+
+// convertLayer returns a reader of the data of the plain layer desc read from
+// ra, decompressed and compressed again for the media type, and the
+// descriptor of the converted data. The layer is converted twice: once for
+// the digest of the converted data, which ocicrypt records in the encrypted
+// layer before it reads the data, and once more by the returned reader, which
+// fails if the data does not match that digest.
+func convertLayer(ra content.ReaderAt, desc ocispec.Descriptor, mediaType string) (ocispec.Descriptor, io.ReadCloser, error) {
+	r, err := convertedReader(content.NewReader(ra), mediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	digester := digest.Canonical.Digester()
+	size, err := bufpool.Copy(digester.Hash(), r)
+	r.Close()
+	if err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to convert layer %s to %s: %w", desc.Digest, mediaType, err)
+	}
+	converted := ocispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: desc.Annotations,
+		Platform:    desc.Platform,
+	}
+	if r, err = convertedReader(content.NewReader(ra), mediaType); err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	return converted, &verifiedReader{ReadCloser: r, desc: converted, digester: digest.Canonical.Digester()}, nil
+}
+
+// convertedReader returns a reader of the layer data read from r converted to
+// the media type
+func convertedReader(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	dec, err := compression.DecompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != ocispec.MediaTypeImageLayerZstd {
+		return dec, nil
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := compression.CompressStream(pw, compression.Zstd)
+		if err == nil {
+			_, err = bufpool.Copy(w, dec)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return &pipeReader{PipeReader: pr, dec: dec, done: done}, nil
+}
+
+// pipeReader closes the decompression of the data it is compressed from once
+// the compression stopped
+type pipeReader struct {
+	*io.PipeReader
+	dec  io.Closer
+	done <-chan struct{}
+}
+
+func (pr *pipeReader) Close() error {
+	pr.PipeReader.Close()
+	<-pr.done
+	return pr.dec.Close()
+}
+
+// verifiedReader fails at the end of the data if it does not match desc
+type verifiedReader struct {
+	io.ReadCloser
+	desc     ocispec.Descriptor
+	digester digest.Digester
+	n        int64
+}
+
+func (vr *verifiedReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	vr.digester.Hash().Write(p[:n])
+	vr.n += int64(n)
+	if err == io.EOF && (vr.n != vr.desc.Size || vr.digester.Digest() != vr.desc.Digest) {
+		return n, fmt.Errorf("converted layer does not match digest %s of its first conversion", vr.desc.Digest)
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encocispec "github.com/gobars/ocicrypt/spec"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestEncryptImageLayerCompression(t *testing.T) {
+	ctx := context.Background()
+	plain := bytes.Repeat([]byte("layer data "), 1000)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(plain)
+	w.Close()
+
+	all := func(ocispec.Descriptor) bool { return true }
+	ecc, dcc := testutil.CryptoConfigs(t)
+	for _, tc := range []struct {
+		compression LayerCompression
+		encrypted   string
+		decrypted   string
+	}{
+		{CompressionKeep, encocispec.MediaTypeLayerGzipEnc, images.MediaTypeDockerSchema2LayerGzip},
+		{CompressionNone, encocispec.MediaTypeLayerEnc, images.MediaTypeDockerSchema2Layer},
+		{CompressionZstd, encocispec.MediaTypeLayerZstdEnc, ocispec.MediaTypeImageLayerZstd},
+	} {
+		t.Run(string(tc.compression), func(t *testing.T) {
+			ctx := WithLayerCompression(ctx, tc.compression)
+
+			cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+			layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayerGzip, gz.Bytes())
+			mb, err := json.Marshal(ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    config,
+				Layers:    []ocispec.Descriptor{layer},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+			encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := images.Manifest(ctx, cs, encrypted, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Layers[0].MediaType != tc.encrypted {
+				t.Fatalf("expected an encrypted layer of type %s, got %s", tc.encrypted, m.Layers[0].MediaType)
+			}
+
+			decrypted, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, err = images.Manifest(ctx, cs, decrypted, nil); err != nil {
+				t.Fatal(err)
+			}
+			if m.Layers[0].MediaType != tc.decrypted {
+				t.Fatalf("expected a decrypted layer of type %s, got %s", tc.decrypted, m.Layers[0].MediaType)
+			}
+			ra, err := cs.ReaderAt(ctx, m.Layers[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ra.Close()
+			r, err := compression.DecompressStream(content.NewReader(ra))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, plain) {
+				t.Fatal("expected the decrypted layer to hold the data of the plain layer")
+			}
+		})
+	}
+}
+
+func TestParseLayerCompression(t *testing.T) {
+	if c, err := ParseLayerCompression(""); err != nil || c != CompressionKeep {
+		t.Fatalf("expected the layers to be kept as they are by default, got %q, %v", c, err)
+	}
+	if _, err := ParseLayerCompression("gzip"); err == nil {
+		t.Fatal("expected an unsupported layer compression to be refused")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CopyImage copies the blobs of the image with the given target descriptor
+// from src to dst as they are, so that encrypted layers and their annotations
+// are preserved and no keys are needed; key blobs are copied along with the
+// layers referencing them. The digest of each blob is verified while it is
+// written. Only the manifests of the platforms matched by platform are copied,
+// or all if it is nil; non-distributable layers that src does not have are
+// skipped. If dst is a content.Manager, the garbage collection labels
+// of the copied blobs are set. The number of copied blobs is returned.
+func CopyImage(ctx context.Context, src content.Provider, dst content.Ingester, desc ocispec.Descriptor, platform platforms.Matcher) (int, error) {
+	var n int
+	copyBlob := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		ra, err := src.ReaderAt(ctx, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) && images.IsNonDistributable(desc.MediaType) {
+				return nil, images.ErrSkipDesc
+			}
+			return nil, fmt.Errorf("failed to read %s: %w", desc.Digest, err)
+		}
+		defer ra.Close()
+		cw, err := content.OpenWriter(ctx, dst, content.WithRef("copy-"+desc.Digest.String()), content.WithDescriptor(desc))
+		if err != nil {
+			if errdefs.IsAlreadyExists(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		defer cw.Close()
+		if err := content.Copy(ctx, cw, content.NewReader(ra), desc.Size, desc.Digest); err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", desc.Digest, err)
+		}
+		n++
+		return nil, nil
+	})
+	children := KeyBlobChildren(images.ChildrenHandler(src))
+	if cm, ok := dst.(content.Manager); ok {
+		children = images.SetChildrenLabels(cm, children)
+	}
+	handler := images.Handlers(copyBlob, children)
+	if platform != nil {
+		handler = images.FilterPlatforms(handler, platform)
+	}
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return n, err
+	}
+	return n, nil
+}
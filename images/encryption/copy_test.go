@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// labelStore keeps the labels of a local content store in memory
+type labelStore map[digest.Digest]map[string]string
+
+func (ls labelStore) Get(d digest.Digest) (map[string]string, error) {
+	return ls[d], nil
+}
+
+func (ls labelStore) Set(d digest.Digest, labels map[string]string) error {
+	ls[d] = labels
+	return nil
+}
+
+func (ls labelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	labels := ls[d]
+	if labels == nil {
+		labels = make(map[string]string)
+		ls[d] = labels
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	return labels, nil
+}
+
+func TestCopyImage(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	src, err := local.NewStore(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, src, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, src, "application/vnd.oci.image.layer.v1.tar+gzip+encrypted", []byte("encrypted layer"))
+	layer.Annotations = map[string]string{"org.opencontainers.image.enc.keys.jwe": "d3JhcHBlZA=="}
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, src, ocispec.MediaTypeImageManifest, mb)
+
+	layoutDir := t.TempDir()
+	l, err := ocilayout.Open(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := CopyImage(ctx, src, l, manifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 blobs to be copied, got %d", n)
+	}
+	if err := l.Tag("example.com/app:v1", manifest); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := os.Stat(filepath.Join(layoutDir, "ingest")); !os.IsNotExist(err) {
+		t.Fatal("expected the ingest directory to be removed from the OCI image layout")
+	}
+
+	l, err = ocilayout.Open(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	desc, err := l.Resolve("example.com/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyImage(ctx, l, dst, desc, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, dst, desc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Annotations["org.opencontainers.image.enc.keys.jwe"] != "d3JhcHBlZA==" {
+		t.Fatal("expected the annotations of the encrypted layer to be preserved")
+	}
+	info, err := dst.Info(ctx, manifest.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Labels["containerd.io/gc.ref.content.l.0"] != layer.Digest.String() {
+		t.Fatalf("expected the manifest to reference its layer for garbage collection, got labels %v", info.Labels)
+	}
+
+	// a corrupted blob is not copied
+	p := filepath.Join(srcDir, "blobs", "sha256", layer.Digest.Encoded())
+	if err := os.Chmod(p, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("corrupted layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupted, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyImage(ctx, src, corrupted, manifest, nil); ClassifyError(err) != ErrorClassIntegrity {
+		t.Fatalf("expected copying a corrupted blob to fail its verification, got %v", err)
+	}
+}
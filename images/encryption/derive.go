@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptDerivedImage encrypts the image desc that was built on top of the
+// decrypted layers of the encrypted image base, such as a vendor base image
+// that may be decrypted but not published as plaintext. The layers desc shares
+// with base, as given by the diff IDs of their configs, are replaced by the
+// encrypted layers of base, whose keys are then handled as set by
+// WithEncryptedLayerMode; only the layers added on top are encrypted anew.
+// The layers of base are selected by the filter if the layers they replace
+// are.
+func EncryptDerivedImage(ctx context.Context, cs content.Store, desc, base ocispec.Descriptor, cc *encconfig.CryptoConfig, lf LayerFilter) (ocispec.Descriptor, bool, error) {
+	replaced := make(map[digest.Digest]ocispec.Descriptor)
+	derived, err := rebaseImage(ctx, cs, desc, base, replaced)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	newDesc, _, err := EncryptImage(ctx, cs, derived, cc, func(d ocispec.Descriptor) bool {
+		if plain, ok := replaced[d.Digest]; ok {
+			return lf(plain)
+		}
+		return lf(d)
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	return newDesc, true, nil
+}
+
+// rebaseImage returns the image desc with the layers it shares with base
+// replaced by those of base, and records the replaced layers by the digests
+// of the layers that replace them
+func rebaseImage(ctx context.Context, cs content.Store, desc, base ocispec.Descriptor, replaced map[digest.Digest]ocispec.Descriptor) (ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		b, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		newIndex := ocispec.Index{Versioned: index.Versioned, Annotations: index.Annotations}
+		for _, m := range index.Manifests {
+			nm, err := rebaseImage(ctx, cs, m, base, replaced)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			newIndex.Manifests = append(newIndex.Manifests, nm)
+		}
+		return writeIndex(ctx, cs, newIndex)
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		return rebaseManifest(ctx, cs, desc, base, replaced)
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("unhandled media type: %s", desc.MediaType)
+	}
+}
+
+// rebaseManifest replaces the layers the manifest desc shares with the
+// manifest of base for the same platform
+func rebaseManifest(ctx context.Context, cs content.Store, desc, base ocispec.Descriptor, replaced map[digest.Digest]ocispec.Descriptor) (ocispec.Descriptor, error) {
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	diffIDs, config, err := layerDiffIDs(ctx, cs, manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	platform := ocispec.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if desc.Platform != nil {
+		platform = *desc.Platform
+	}
+	baseManifest, err := images.Manifest(ctx, cs, base, platforms.Only(platform))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest of the base image for %s: %w", platforms.Format(platform), err)
+	}
+	baseDiffIDs, _, err := layerDiffIDs(ctx, cs, baseManifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(baseDiffIDs) > len(diffIDs) {
+		return ocispec.Descriptor{}, fmt.Errorf("image for %s has fewer layers than its base image", platforms.Format(platform))
+	}
+	for i, diffID := range baseDiffIDs {
+		if diffIDs[i] != diffID {
+			return ocispec.Descriptor{}, fmt.Errorf("image for %s is not derived from the base image: layer %d differs", platforms.Format(platform), i)
+		}
+	}
+
+	layers := make([]ocispec.Descriptor, 0, len(manifest.Layers))
+	for i, layer := range baseManifest.Layers {
+		replaced[layer.Digest] = manifest.Layers[i]
+		layers = append(layers, layer)
+	}
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Layers = append(layers, manifest.Layers[len(layers):]...)
+	return writeManifest(ctx, cs, manifest, desc.Platform)
+}
+
+// layerDiffIDs returns the diff IDs of the layers of manifest with its config; the
+// layers must all have one
+func layerDiffIDs(ctx context.Context, cs content.Store, manifest ocispec.Manifest) ([]digest.Digest, ocispec.Image, error) {
+	var config ocispec.Image
+	b, err := content.ReadBlob(ctx, cs, manifest.Config)
+	if err != nil {
+		return nil, config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, config, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, config, errors.New("image has layers without a diff ID, such as foreign layers or the data blobs of Nydus images")
+	}
+	return config.RootFS.DiffIDs, config, nil
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeLayeredImage writes an image with uncompressed layers of the given data
+func writeLayeredImage(t *testing.T, cs content.Store, data ...string) ocispec.Descriptor {
+	t.Helper()
+	config := ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       ocispec.RootFS{Type: "layers"},
+	}
+	var layers []ocispec.Descriptor
+	for _, d := range data {
+		layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte(d))
+		layers = append(layers, layer)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.Digest)
+	}
+	cb, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, cb),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+}
+
+func TestEncryptDerivedImage(t *testing.T) {
+	ctx := context.Background()
+	all := func(ocispec.Descriptor) bool { return true }
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendorEcc, vendorDcc := testutil.CryptoConfigs(t)
+	ecc, dcc := testutil.CryptoConfigs(t)
+
+	base, _, err := EncryptImage(ctx, cs, writeLayeredImage(t, cs, "base layer"), &vendorEcc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseManifest, err := images.Manifest(ctx, cs, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := writeLayeredImage(t, cs, "base layer", "app layer")
+
+	// the keys of the base layers are left to the vendor
+	kept, modified, err := EncryptDerivedImage(WithEncryptedLayerMode(ctx, EncryptedLayersKeep), cs, derived, base, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("expected the derived image to be modified")
+	}
+	m, err := images.Manifest(ctx, cs, kept, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 2 || m.Layers[0].Digest != baseManifest.Layers[0].Digest {
+		t.Fatalf("expected the encrypted base layer to be reused, got %v", m.Layers)
+	}
+	if !IsEncryptedDiff(ctx, m.Layers[1].MediaType) {
+		t.Fatal("expected the app layer to be encrypted")
+	}
+	if _, _, err := DecryptImage(ctx, cs, kept, &dcc, func(d ocispec.Descriptor) bool { return d.Digest == m.Layers[1].Digest }); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptImage(ctx, cs, kept, &dcc, all); err == nil {
+		t.Fatal("expected the base layer to remain encrypted for the vendor alone")
+	}
+
+	// with a key of the base layers they are encrypted for the team as well
+	add := ecc
+	addEc := *ecc.EncryptConfig
+	addEc.DecryptConfig = *vendorDcc.DecryptConfig
+	add.EncryptConfig = &addEc
+	added, _, err := EncryptDerivedImage(ctx, cs, derived, base, &add, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = images.Manifest(ctx, cs, added, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != baseManifest.Layers[0].Digest {
+		t.Fatal("expected the data of the base layer to be left as it is")
+	}
+	for _, cc := range []*encconfig.CryptoConfig{&dcc, &vendorDcc} {
+		if _, _, err := DecryptImage(ctx, cs, added, cc, func(d ocispec.Descriptor) bool { return d.Digest == m.Layers[0].Digest }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := DecryptImage(ctx, cs, added, &dcc, all); err != nil {
+		t.Fatal(err)
+	}
+
+	other := writeLayeredImage(t, cs, "other base layer", "app layer")
+	if _, _, err := EncryptDerivedImage(ctx, cs, other, base, &add, all); err == nil {
+		t.Fatal("expected an image that is not derived from the base image to be refused")
+	}
+}
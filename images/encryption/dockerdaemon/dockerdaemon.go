@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package dockerdaemon reads images from a local Docker engine, so that they
+// can be encrypted without importing them into containerd first. Images are
+// saved through the Engine API, as by docker save, and the archive is
+// converted by Import into an image in a content store.
+//
+// The engine is reached at DOCKER_HOST, which may be a unix:// or tcp://
+// address, or at its default socket /var/run/docker.sock. TLS connections to
+// the engine are not supported.
+package dockerdaemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// Prefix marks image names that refer to images of the Docker engine,
+	// such as docker-daemon:alpine:latest
+	Prefix = "docker-daemon:"
+
+	// DefaultHost is the address of the Docker engine if DOCKER_HOST is not set
+	DefaultHost = "unix:///var/run/docker.sock"
+)
+
+// ErrNotFound is returned for images the Docker engine does not have
+var ErrNotFound = errors.New("image not found in the Docker engine")
+
+// Reference returns the reference of the image in the Docker engine that name
+// refers to and whether it has Prefix
+func Reference(name string) (string, bool) {
+	if !strings.HasPrefix(name, Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, Prefix), true
+}
+
+// Client talks to the Engine API of a Docker engine
+type Client struct {
+	host string
+	http *http.Client
+}
+
+// New returns a client of the Docker engine at host, a unix:// or tcp://
+// address; if host is empty, DOCKER_HOST or DefaultHost is used
+func New(host string) (*Client, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Docker host %q: %w", host, err)
+	}
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		host = "http://docker"
+	case "tcp":
+		host = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker host %q; use a unix:// or tcp:// address", host)
+	}
+	return &Client{host: host, http: &http.Client{Transport: transport}}, nil
+}
+
+// Save returns the archive of the image with the given reference in the
+// format of docker save; the caller must close it
+func (c *Client) Save(ctx context.Context, ref string) (io.ReadCloser, error) {
+	if ref == "" {
+		return nil, errors.New("no Docker image given")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+"/images/"+url.PathEscape(ref)+"/get", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the Docker engine: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	// the engine describes errors in a JSON object
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	return nil, fmt.Errorf("could not save %s from the Docker engine: %s", ref, e.Message)
+}
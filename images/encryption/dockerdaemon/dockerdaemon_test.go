@@ -0,0 +1,185 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dockerdaemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// saveArchive returns an archive as docker save writes it before Docker 25,
+// with a plain and a gzip compressed layer
+func saveArchive(t *testing.T) ([]byte, [][]byte, []byte) {
+	t.Helper()
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write([]byte("second layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layers := [][]byte{[]byte("first layer"), gz.Bytes()}
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	manifest, err := json.Marshal([]saveManifest{{
+		Config:   configName,
+		RepoTags: []string{"app:latest"},
+		Layers:   []string{"aaa/layer.tar", "bbb/layer.tar"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("aaa/VERSION", []byte("1.0"))
+	add("aaa/json", []byte("{}"))
+	add("aaa/layer.tar", layers[0])
+	add("bbb/layer.tar", layers[1])
+	add(configName, config)
+	add("repositories", []byte(`{"app":{"latest":"bbb"}}`))
+	add("manifest.json", manifest)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), layers, config
+}
+
+// engine serves the archive of the image app:latest like the Engine API
+func engine(archive []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/app:latest/get" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"reference does not exist"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		_, _ = w.Write(archive)
+	})
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	archive, layers, config := saveArchive(t)
+	l, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	desc, err := Import(ctx, bytes.NewReader(archive), l.Store())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := content.ReadBlob(ctx, l.Store(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.Digest != digest.FromBytes(config) || manifest.Config.MediaType != images.MediaTypeDockerSchema2Config {
+		t.Fatalf("unexpected config %+v", manifest.Config)
+	}
+	mediaTypes := []string{images.MediaTypeDockerSchema2Layer, images.MediaTypeDockerSchema2LayerGzip}
+	if len(manifest.Layers) != len(layers) {
+		t.Fatalf("got %d layers, want %d", len(manifest.Layers), len(layers))
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest != digest.FromBytes(layers[i]) || layer.MediaType != mediaTypes[i] {
+			t.Fatalf("unexpected layer %d %+v", i, layer)
+		}
+		if _, err := l.Store().Info(ctx, layer.Digest); err != nil {
+			t.Fatalf("layer %d not stored: %v", i, err)
+		}
+	}
+
+	if _, err := Import(ctx, bytes.NewReader(archive[:1024]), l.Store()); err == nil {
+		t.Fatal("imported a truncated archive")
+	}
+}
+
+func TestSave(t *testing.T) {
+	archive, _, _ := saveArchive(t)
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(engine(archive))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+	c, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Save(context.Background(), "app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Fatal("the saved archive differs from the one served")
+	}
+	if _, err := c.Save(context.Background(), "other:latest"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("ssh://user@host"); err == nil {
+		t.Fatal("created a client for an unsupported host")
+	}
+	for name, want := range map[string]string{"docker-daemon:alpine:3": "alpine:3", "alpine:3": ""} {
+		if ref, ok := Reference(name); ref != want || ok != (want != "") {
+			t.Errorf("Reference(%q) = %q, %v", name, ref, ok)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dockerdaemon
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestFile lists the images of a docker save archive
+const manifestFile = "manifest.json"
+
+// maxManifestSize limits the size of the manifest.json of an archive
+const maxManifestSize = 1 << 20
+
+// saveManifest is an entry of the manifest.json of a docker save archive
+type saveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// file is a file of an archive written to the content store
+type file struct {
+	digest    digest.Digest
+	size      int64
+	mediaType string
+}
+
+// Import writes the image in the docker save archive read from r to cs and
+// returns the descriptor of its manifest. The archive must hold a single
+// image. Its config and layers are kept as they are, so the manifest is a
+// Docker schema 2 manifest of the uncompressed layers that docker save
+// writes, or of compressed ones if the engine stores them compressed. Both
+// the archives of Docker 25 and later, which are also OCI image layouts, and
+// those of earlier versions are read.
+func Import(ctx context.Context, r io.Reader, cs content.Ingester) (ocispec.Descriptor, error) {
+	var (
+		manifests []saveManifest
+		files     = make(map[string]file)
+	)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not read Docker image archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch {
+		case name == manifestFile:
+			if hdr.Size > maxManifestSize {
+				return ocispec.Descriptor{}, fmt.Errorf("%s of Docker image archive is too large", manifestFile)
+			}
+			if err := json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("could not parse %s of Docker image archive: %w", manifestFile, err)
+			}
+		case !isContent(name):
+			continue
+		default:
+			f, err := writeFile(ctx, cs, name, tr)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			files[name] = f
+		}
+	}
+	if manifests == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("no %s in Docker image archive", manifestFile)
+	}
+	if len(manifests) != 1 {
+		return ocispec.Descriptor{}, fmt.Errorf("expected a Docker image archive with a single image, got %d", len(manifests))
+	}
+	m := manifests[0]
+
+	config, ok := files[path.Clean(m.Config)]
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("config %s of Docker image archive not found", m.Config)
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config: ocispec.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2Config,
+			Digest:    config.digest,
+			Size:      config.size,
+		},
+		Layers: make([]ocispec.Descriptor, 0, len(m.Layers)),
+	}
+	for _, l := range m.Layers {
+		layer, ok := files[path.Clean(l)]
+		if !ok {
+			return ocispec.Descriptor{}, fmt.Errorf("layer %s of Docker image archive not found", l)
+		}
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType: layer.mediaType,
+			Digest:    layer.digest,
+			Size:      layer.size,
+		})
+	}
+	p, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	if err := content.WriteBlob(ctx, cs, "docker-manifest-"+desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return desc, nil
+}
+
+// isContent returns whether the file of an archive may be a config or layer,
+// as opposed to the metadata that docker save writes for older clients
+func isContent(name string) bool {
+	switch name {
+	case "repositories", "index.json", "oci-layout":
+		return false
+	}
+	base := path.Base(name)
+	return name != ".." && !strings.HasPrefix(name, "../") && base != "json" && base != "VERSION"
+}
+
+// writeFile writes a file of an archive to cs; layers are told apart by their
+// media type, which records their compression
+func writeFile(ctx context.Context, cs content.Ingester, name string, r io.Reader) (file, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	mediaType := images.MediaTypeDockerSchema2Layer
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		mediaType = ocispec.MediaTypeImageLayerZstd
+	}
+
+	w, err := content.OpenWriter(ctx, cs, content.WithRef("docker-import-"+name))
+	if err != nil {
+		return file{}, err
+	}
+	defer w.Close()
+	n, err := io.Copy(w, br)
+	if err != nil {
+		return file{}, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	dgst := w.Digest()
+	if err := w.Commit(ctx, n, ""); err != nil && !errdefs.IsAlreadyExists(err) {
+		return file{}, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return file{digest: dgst, size: n, mediaType: mediaType}, nil
+}
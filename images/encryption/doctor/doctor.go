@@ -0,0 +1,427 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package doctor checks the environment image encryption depends on, such as
+// GPG, PKCS#11 modules, keyproviders, key files and the registration of the
+// decoder with containerd, and suggests how to fix what it finds.
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/gpgclient"
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/pkcs11pool"
+	encocispec "github.com/gobars/ocicrypt/spec"
+	"github.com/pelletier/go-toml"
+)
+
+// Status is the outcome of a check
+type Status string
+
+// Outcomes of checks
+const (
+	StatusOK      Status = "ok"
+	StatusWarning Status = "warning"
+	StatusError   Status = "error"
+	StatusSkipped Status = "skipped"
+)
+
+// Result is the outcome of a check with what to do about it
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Remedy  string `json:"remedy,omitempty"`
+}
+
+// DefaultContainerdConfig is the default location of the containerd configuration
+const DefaultContainerdConfig = "/etc/containerd/config.toml"
+
+// DefaultTimeout bounds the time spent connecting to a keyprovider
+const DefaultTimeout = 5 * time.Second
+
+// Options select what is checked
+type Options struct {
+	// Keys are key files, or directories of them, that must be usable
+	Keys []string
+	// GPGHomedir is the GPG home directory; the default one is used if empty
+	GPGHomedir string
+	// ContainerdConfig is the containerd configuration the decoder must be
+	// registered in; DefaultContainerdConfig is used if empty
+	ContainerdConfig string
+	// Timeout bounds the time spent connecting to each keyprovider;
+	// DefaultTimeout is used if zero
+	Timeout time.Duration
+}
+
+// Run runs all checks
+func Run(ctx context.Context, opts Options) []Result {
+	if opts.ContainerdConfig == "" {
+		opts.ContainerdConfig = DefaultContainerdConfig
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	var results []Result
+	results = append(results, CheckGPG(ctx, opts.GPGHomedir)...)
+	results = append(results, CheckPkcs11Modules()...)
+	results = append(results, CheckKeyProviders(ctx, opts.Timeout)...)
+	results = append(results, CheckKeys(opts.Keys)...)
+	results = append(results, CheckDecoder(opts.ContainerdConfig)...)
+	return results
+}
+
+// Failed returns whether any of the results is an error
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == StatusError {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckGPG checks that a GPG client is installed and that the home
+// directory, the given one or the default one, and the gpg-agent are usable
+func CheckGPG(ctx context.Context, homedir string) []Result {
+	const check = "gpg"
+	d, err := gpgclient.Detect(ctx, "", homedir)
+	if errors.Is(err, gpgclient.ErrNotFound) {
+		return []Result{{
+			Check:   check,
+			Status:  StatusWarning,
+			Message: "no gpg2 or gpg executable found in PATH; pgp recipients and GPG keys cannot be used",
+			Remedy:  "install GnuPG 2, for example the gnupg2 package, if images are encrypted for pgp recipients",
+		}}
+	}
+	if err != nil {
+		return []Result{{
+			Check:   check,
+			Status:  StatusError,
+			Message: err.Error(),
+			Remedy:  "reinstall GnuPG",
+		}}
+	}
+	results := []Result{{Check: check, Status: StatusOK, Message: fmt.Sprintf("%s: GnuPG %s", d.Program, d.Version)}}
+	if d.Major < 2 {
+		results[0].Status = StatusWarning
+		results[0].Remedy = "GnuPG 1 cannot use the gpg-agent; install GnuPG 2"
+	}
+	if d.Keyboxd {
+		results = append(results, Result{
+			Check:   check,
+			Status:  StatusOK,
+			Message: fmt.Sprintf("public keys of %s are kept by keyboxd and are exported with gpg", d.Homedir),
+		})
+	}
+	for _, p := range d.Problems {
+		r := Result{Check: check, Status: StatusWarning, Message: p.Error()}
+		switch {
+		case errors.Is(p, gpgclient.ErrHomedir):
+			r.Status = StatusError
+			r.Remedy = "pass the directory holding pubring.kbx or secring.gpg with --gpg-homedir"
+		case errors.Is(p, gpgclient.ErrHomedirPermissions):
+			r.Remedy = fmt.Sprintf("chown the home directory to the user running imgcrypt and chmod 700 %s", d.Homedir)
+		case errors.Is(p, gpgclient.ErrAgent):
+			r.Remedy = "run gpgconf --kill gpg-agent to remove a stale socket, or use a home directory with a shorter path"
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// CheckPkcs11Modules loads the PKCS#11 modules named in the ocicrypt
+// configuration file and checks that they have tokens
+func CheckPkcs11Modules() []Result {
+	const check = "pkcs11"
+	file := pkcs11pool.ConfigFile()
+	if file == "" {
+		return []Result{{Check: check, Status: StatusSkipped, Message: "no ocicrypt configuration file with PKCS#11 modules"}}
+	}
+	policy, err := pkcs11pool.LoadModulePolicy(file)
+	if err != nil {
+		return []Result{{
+			Check:   check,
+			Status:  StatusError,
+			Message: err.Error(),
+			Remedy:  fmt.Sprintf("fix the pkcs11 section of %s", file),
+		}}
+	}
+	var modules []string
+	seen := make(map[string]bool)
+	for _, p := range policy.AllowedModulePaths {
+		if !strings.HasSuffix(p, "/") && !seen[p] {
+			modules, seen[p] = append(modules, p), true
+		}
+	}
+	for p := range policy.ModuleSHA256 {
+		if !seen[p] {
+			modules, seen[p] = append(modules, p), true
+		}
+	}
+	sort.Strings(modules)
+	if len(modules) == 0 {
+		return []Result{{Check: check, Status: StatusSkipped, Message: fmt.Sprintf("%s names no PKCS#11 module files", file)}}
+	}
+	var results []Result
+	for _, module := range modules {
+		slots, err := pkcs11pool.ProbeModule(module)
+		switch {
+		case err != nil:
+			results = append(results, Result{
+				Check:   check,
+				Status:  StatusError,
+				Message: err.Error(),
+				Remedy:  fmt.Sprintf("install the module or correct its path and digest in %s", file),
+			})
+		case slots == 0:
+			results = append(results, Result{
+				Check:   check,
+				Status:  StatusWarning,
+				Message: fmt.Sprintf("PKCS#11 module %s has no token present", module),
+				Remedy:  "connect the token or initialize one, for example with softhsm2-util --init-token",
+			})
+		default:
+			results = append(results, Result{
+				Check:   check,
+				Status:  StatusOK,
+				Message: fmt.Sprintf("PKCS#11 module %s loaded with %d token(s)", module, slots),
+			})
+		}
+	}
+	return results
+}
+
+// CheckKeyProviders checks that the configured and discovered keyproviders
+// can be called
+func CheckKeyProviders(ctx context.Context, timeout time.Duration) []Result {
+	const check = "keyprovider"
+	if _, err := keyprovider.LoadConfig(); err != nil {
+		return []Result{{
+			Check:   check,
+			Status:  StatusError,
+			Message: err.Error(),
+			Remedy:  "fix " + keyprovider.ConfigPath(),
+		}}
+	}
+	providers := keyprovider.Install()
+	if len(providers) == 0 {
+		return []Result{{Check: check, Status: StatusSkipped, Message: "no keyproviders configured or discovered"}}
+	}
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var results []Result
+	for _, name := range names {
+		p := providers[name]
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		err := p.Ping(pctx)
+		cancel()
+		if err != nil {
+			remedy := "check that the command is installed and in PATH"
+			if p.Config.Grpc != "" {
+				remedy = fmt.Sprintf("check that the keyprovider listens on %s and its TLS settings and token", p.Config.Grpc)
+			}
+			results = append(results, Result{
+				Check:   check,
+				Status:  StatusError,
+				Message: fmt.Sprintf("keyprovider %s cannot be called: %v", name, err),
+				Remedy:  remedy,
+			})
+			continue
+		}
+		results = append(results, Result{Check: check, Status: StatusOK, Message: fmt.Sprintf("keyprovider %s responds", name)})
+	}
+	return results
+}
+
+// CheckKeys checks that the key files, and the files in key directories,
+// are recognized and usable
+func CheckKeys(paths []string) []Result {
+	const check = "keys"
+	var results []Result
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			results = append(results, Result{Check: check, Status: StatusError, Message: err.Error(), Remedy: "correct the path of the key"})
+			continue
+		}
+		files := []string{path}
+		if fi.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				results = append(results, Result{Check: check, Status: StatusError, Message: err.Error()})
+				continue
+			}
+			files = files[:0]
+			for _, e := range entries {
+				if e.Type().IsRegular() {
+					files = append(files, filepath.Join(path, e.Name()))
+				}
+			}
+			if len(files) == 0 {
+				results = append(results, Result{
+					Check:   check,
+					Status:  StatusWarning,
+					Message: fmt.Sprintf("key directory %s is empty", path),
+					Remedy:  "place the private keys for decryption in the directory",
+				})
+			}
+		}
+		for _, file := range files {
+			results = append(results, checkKeyFile(check, file))
+		}
+	}
+	return results
+}
+
+func checkKeyFile(check, file string) Result {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Result{Check: check, Status: StatusError, Message: err.Error(), Remedy: "make the key readable by the user running the decryption"}
+	}
+	ki := keyinfo.Inspect(file, data, nil)
+	switch {
+	case ki.Kind == keyinfo.KindUnknown:
+		return Result{
+			Check:   check,
+			Status:  StatusError,
+			Message: fmt.Sprintf("%s is not a recognized key: %s", file, strings.Join(ki.Problems, "; ")),
+			Remedy:  fmt.Sprintf("run ctr keys inspect %s for details", file),
+		}
+	case ki.Expired(time.Now()):
+		return Result{
+			Check:   check,
+			Status:  StatusWarning,
+			Message: fmt.Sprintf("%s is a certificate that is not valid now", file),
+			Remedy:  "renew the certificate",
+		}
+	case ki.Encrypted:
+		return Result{
+			Check:   check,
+			Status:  StatusWarning,
+			Message: fmt.Sprintf("%s is an encrypted %s", file, ki.Kind),
+			Remedy:  "pass its password with --key <file>:pass=<password>; the decoder of containerd cannot use it",
+		}
+	case len(ki.Problems) > 0:
+		return Result{Check: check, Status: StatusWarning, Message: fmt.Sprintf("%s: %s", file, strings.Join(ki.Problems, "; "))}
+	}
+	msg := fmt.Sprintf("%s is a %s", file, ki.Kind)
+	if ki.Algorithm != "" {
+		msg += " (" + ki.Algorithm + ")"
+	}
+	return Result{Check: check, Status: StatusOK, Message: msg}
+}
+
+// decoderMediaTypes are the media types a stream processor must accept to
+// decrypt the layers imgcrypt produces
+var decoderMediaTypes = []string{encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerEnc}
+
+// CheckDecoder checks that ctd-decoder is registered as stream processor for
+// encrypted layers in the containerd configuration at path and can be found
+func CheckDecoder(path string) []Result {
+	const check = "decoder"
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Result{{Check: check, Status: StatusSkipped, Message: fmt.Sprintf("containerd configuration %s not found", path)}}
+		}
+		return []Result{{Check: check, Status: StatusError, Message: fmt.Sprintf("could not read containerd configuration: %v", err)}}
+	}
+	remedy := fmt.Sprintf(`add to %s:
+[stream_processors."io.containerd.ocicrypt.decoder.v1.tar.gzip"]
+  accepts = ["%s"]
+  returns = "application/vnd.oci.image.layer.v1.tar+gzip"
+  path = "ctd-decoder"
+  args = ["--decryption-keys-path", "/etc/containerd/ocicrypt/keys"]
+and restart containerd`, path, encocispec.MediaTypeLayerGzipEnc)
+
+	accepted := make(map[string]bool)
+	var results []Result
+	if sps, ok := tree.Get("stream_processors").(*toml.Tree); ok {
+		for _, name := range sps.Keys() {
+			sp, ok := sps.GetPath([]string{name}).(*toml.Tree)
+			if !ok {
+				continue
+			}
+			decoder, _ := sp.Get("path").(string)
+			if filepath.Base(decoder) != "ctd-decoder" {
+				continue
+			}
+			if _, err := exec.LookPath(decoder); err != nil {
+				results = append(results, Result{
+					Check:   check,
+					Status:  StatusError,
+					Message: fmt.Sprintf("stream processor %s runs %s, which cannot be found: %v", name, decoder, err),
+					Remedy:  "install ctd-decoder in the PATH of containerd or give its absolute path",
+				})
+			}
+			if accepts, ok := sp.Get("accepts").([]interface{}); ok {
+				for _, a := range accepts {
+					if s, ok := a.(string); ok {
+						accepted[s] = true
+					}
+				}
+			}
+		}
+	}
+	if len(accepted) == 0 && len(results) == 0 {
+		return []Result{{
+			Check:   check,
+			Status:  StatusError,
+			Message: fmt.Sprintf("ctd-decoder is not registered as stream processor in %s", path),
+			Remedy:  remedy,
+		}}
+	}
+	var missing []string
+	for _, mt := range decoderMediaTypes {
+		if !accepted[mt] {
+			missing = append(missing, mt)
+		}
+	}
+	if len(missing) > 0 {
+		results = append(results, Result{
+			Check:   check,
+			Status:  StatusWarning,
+			Message: fmt.Sprintf("no ctd-decoder stream processor accepts %s", strings.Join(missing, ", ")),
+			Remedy:  "register a stream processor for each encrypted media type in use",
+		})
+	}
+	if km, ok := tree.GetPath([]string{"plugins", "io.containerd.grpc.v1.cri", "image_decryption", "key_model"}).(string); ok && km != "node" {
+		results = append(results, Result{
+			Check:   check,
+			Status:  StatusWarning,
+			Message: fmt.Sprintf("the CRI plugin uses key model %q", km),
+			Remedy:  `set key_model = "node" in [plugins."io.containerd.grpc.v1.cri".image_decryption] for Kubernetes to pull encrypted images`,
+		})
+	}
+	if len(results) == 0 {
+		results = append(results, Result{Check: check, Status: StatusOK, Message: fmt.Sprintf("ctd-decoder is registered in %s", path)})
+	}
+	return results
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package doctor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDecoder(t *testing.T) {
+	dir := t.TempDir()
+	decoder := filepath.Join(dir, "ctd-decoder")
+	writeFile(t, decoder, "#!/bin/sh\n")
+	if err := os.Chmod(decoder, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, config string
+		want         Status
+		message      string
+	}{
+		{
+			name: "registered",
+			config: `[stream_processors]
+  [stream_processors."io.containerd.ocicrypt.decoder.v1.tar.gzip"]
+    accepts = ["application/vnd.oci.image.layer.v1.tar+gzip+encrypted"]
+    path = "` + decoder + `"
+  [stream_processors."io.containerd.ocicrypt.decoder.v1.tar"]
+    accepts = ["application/vnd.oci.image.layer.v1.tar+encrypted"]
+    path = "` + decoder + `"
+`,
+			want: StatusOK,
+		},
+		{
+			name:    "not registered",
+			config:  "version = 2\n",
+			want:    StatusError,
+			message: "not registered",
+		},
+		{
+			name: "missing binary",
+			config: `[stream_processors."io.containerd.ocicrypt.decoder.v1.tar.gzip"]
+  accepts = ["application/vnd.oci.image.layer.v1.tar+gzip+encrypted", "application/vnd.oci.image.layer.v1.tar+encrypted"]
+  path = "` + filepath.Join(dir, "missing", "ctd-decoder") + `"
+`,
+			want:    StatusError,
+			message: "cannot be found",
+		},
+		{
+			name: "missing media type",
+			config: `[stream_processors."io.containerd.ocicrypt.decoder.v1.tar.gzip"]
+  accepts = ["application/vnd.oci.image.layer.v1.tar+gzip+encrypted"]
+  path = "` + decoder + `"
+`,
+			want:    StatusWarning,
+			message: "application/vnd.oci.image.layer.v1.tar+encrypted",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "config.toml")
+			writeFile(t, path, tc.config)
+			results := CheckDecoder(path)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1: %+v", len(results), results)
+			}
+			if results[0].Status != tc.want || !strings.Contains(results[0].Message, tc.message) {
+				t.Fatalf("got %+v, want status %s with message containing %q", results[0], tc.want, tc.message)
+			}
+		})
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "key.pem"), string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not a key")
+
+	results := CheckKeys([]string{dir})
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	byFile := make(map[string]Status)
+	for _, r := range results {
+		byFile[strings.Fields(r.Message)[0]] = r.Status
+	}
+	if s := byFile[filepath.Join(dir, "key.pem")]; s != StatusOK {
+		t.Errorf("got status %s for the private key, want ok", s)
+	}
+	if s := byFile[filepath.Join(dir, "notes.txt")]; s != StatusError {
+		t.Errorf("got status %s for the text file, want error", s)
+	}
+	if !Failed(results) {
+		t.Error("results with an error did not fail")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package enccontext binds wrapped layer keys to an encryption context, a set
+// of key-value pairs such as the repository or the tenant an image belongs to.
+//
+// The context is added to the layer options that the key wrappers of all
+// schemes wrap, so it is protected like the layer key itself; decoders that
+// do not know about it ignore it. A layer key is only unwrapped if the
+// context it is bound to equals the context expected by the DecryptConfig, so
+// that a wrapped key copied onto an image of another repository or tenant
+// fails to unwrap there, and so does a key that is not bound to a context
+// where one is expected.
+package enccontext
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// Parameter is the EncryptConfig parameter holding the context the layer keys
+// are bound to, and the DecryptConfig parameter holding the expected context
+const Parameter = "encryption-context"
+
+// optsField is the field of the layer options holding the context
+const optsField = "context"
+
+// ErrMismatch is returned when a layer key is not bound to the expected context
+var ErrMismatch = errors.New("encryption context mismatch")
+
+// Context is a set of key-value pairs that layer keys are bound to
+type Context map[string]string
+
+// Parse returns the context given as key=value pairs
+func Parse(pairs []string) (Context, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	c := make(Context)
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid encryption context %q: expected key=value", pair)
+		}
+		if _, dup := c[k]; dup {
+			return nil, fmt.Errorf("invalid encryption context: %s is given more than once", k)
+		}
+		c[k] = v
+	}
+	return c, nil
+}
+
+// String returns the sorted key=value pairs of the context
+func (c Context) String() string {
+	if len(c) == 0 {
+		return "no encryption context"
+	}
+	pairs := make([]string, 0, len(c))
+	for k, v := range c {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Equal returns whether both contexts hold the same pairs
+func (c Context) Equal(o Context) bool {
+	if len(c) != len(o) {
+		return false
+	}
+	for k, v := range c {
+		if w, ok := o[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Set sets the context in the parameters of an EncryptConfig or
+// DecryptConfig, replacing any context set before
+func Set(params map[string][][]byte, c Context) {
+	if len(c) == 0 {
+		delete(params, Parameter)
+		return
+	}
+	data, _ := json.Marshal(c)
+	params[Parameter] = [][]byte{data}
+}
+
+// FromParameters returns the context set in the parameters of an
+// EncryptConfig or DecryptConfig
+func FromParameters(params map[string][][]byte) (Context, error) {
+	values := params[Parameter]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	var c Context
+	if err := json.Unmarshal(values[0], &c); err != nil {
+		return nil, fmt.Errorf("invalid %s parameter: %w", Parameter, err)
+	}
+	return c, nil
+}
+
+// builtinSchemes are the schemes of the key wrappers that are always bound,
+// in addition to those of the keyproviders
+var builtinSchemes = []string{"jwe", "pkcs7", "pgp", "pkcs11", "jwe-hybrid", "threshold"}
+
+// keyWrapper binds the layer keys wrapped by a key wrapper to the context of
+// the EncryptConfig and checks it when unwrapping them
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var (
+	installMu    sync.Mutex
+	installed    = make(map[string]bool)
+	decorateOnce sync.Once
+)
+
+// Install wraps the key wrappers registered with ocicrypt so that the layer
+// keys they wrap are bound to the encryption context. It must be called after
+// the key wrappers of the built-in schemes are registered; those of the
+// keyproviders are wrapped whenever they are registered.
+func Install() {
+	installMu.Lock()
+	defer installMu.Unlock()
+	for _, scheme := range builtinSchemes {
+		if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil && !installed[scheme] {
+			ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			installed[scheme] = true
+		}
+	}
+	decorateOnce.Do(func() {
+		keyprovider.Decorate(func(scheme string, kw keywrap.KeyWrapper) keywrap.KeyWrapper {
+			return &keyWrapper{kw, scheme}
+		})
+	})
+}
+
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	c, err := FromParameters(ec.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) > 0 {
+		// a layer whose keys are rewrapped keeps its context unless another
+		// one is given
+		if optsData, err = bind(optsData, c); err != nil {
+			return nil, err
+		}
+	}
+	return kw.KeyWrapper.WrapKeys(ec, optsData)
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, err := kw.KeyWrapper.UnwrapKey(dc, annotation)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := FromParameters(dc.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := Bound(optsData)
+	if err != nil {
+		return nil, err
+	}
+	if !bound.Equal(expected) {
+		return nil, fmt.Errorf("%w: the %s wrapped layer key is bound to %s, but %s was expected", ErrMismatch, kw.scheme, bound, expected)
+	}
+	return optsData, nil
+}
+
+// bind adds the context to the layer options
+func bind(optsData []byte, c Context) ([]byte, error) {
+	var opts map[string]json.RawMessage
+	if err := json.Unmarshal(optsData, &opts); err != nil {
+		return nil, fmt.Errorf("could not bind the layer key to the encryption context: %w", err)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	opts[optsField] = data
+	return json.Marshal(opts)
+}
+
+// Bound returns the context the unwrapped layer options are bound to
+func Bound(optsData []byte) (Context, error) {
+	var opts struct {
+		Context Context `json:"context"`
+	}
+	if err := json.Unmarshal(optsData, &opts); err != nil {
+		return nil, fmt.Errorf("could not parse the layer options: %w", err)
+	}
+	return opts.Context, nil
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package enccontext
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]string{"tenant=acme", "repository=docker.io/library/app", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.String(); s != "empty=,repository=docker.io/library/app,tenant=acme" {
+		t.Fatalf("unexpected context %s", s)
+	}
+	for _, pairs := range [][]string{{"tenant"}, {"=acme"}, {"tenant=a", "tenant=b"}} {
+		if _, err := Parse(pairs); err == nil {
+			t.Fatalf("expected %q to be rejected", pairs)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	optsData := []byte(`{"symkey":"c2VjcmV0","cipheroptions":{"nonce":"bm9uY2U="},"digest":"sha256:0123"}`)
+	c := Context{"tenant": "acme"}
+	bound, err := bind(optsData, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Bound(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(c) {
+		t.Fatalf("expected context %s, got %s", c, got)
+	}
+	// the layer options are kept as they were
+	var before, after map[string]json.RawMessage
+	if err := json.Unmarshal(optsData, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(bound, &after); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range before {
+		if string(after[k]) != string(v) {
+			t.Fatalf("expected %s to be kept, got %s", k, after[k])
+		}
+	}
+	if got, err := Bound(optsData); err != nil || got != nil {
+		t.Fatalf("expected no context for unbound options, got %v, %v", got, err)
+	}
+}
+
+func TestParameters(t *testing.T) {
+	params := make(map[string][][]byte)
+	c := Context{"repository": "docker.io/library/app"}
+	Set(params, c)
+	got, err := FromParameters(params)
+	if err != nil || !got.Equal(c) {
+		t.Fatalf("expected context %s, got %v, %v", c, got, err)
+	}
+	Set(params, nil)
+	if _, ok := params[Parameter]; ok {
+		t.Fatal("expected the context to be removed")
+	}
+}
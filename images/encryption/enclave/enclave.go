@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package enclave unwraps JWE wrapped layer keys with a private key that is
+// held by a helper running inside an SGX enclave, for example under Gramine,
+// so that the private key is never present in the memory of the node.
+package enclave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/uniformunwrap"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// ParameterName is the DecryptConfig parameter holding the addresses of enclave helpers
+const ParameterName = "enclave-addresses"
+
+// Operations of the enclave helper protocol
+const (
+	OpUnwrap    = "unwrap"
+	OpPublicKey = "publickey"
+)
+
+// Timeout limits the time a single call into an enclave helper may take
+var Timeout = 30 * time.Second
+
+// Request is sent to an enclave helper as a single JSON object per connection
+type Request struct {
+	Op         string `json:"op"`
+	Annotation []byte `json:"annotation,omitempty"`
+}
+
+// Response is the answer of an enclave helper to a Request
+type Response struct {
+	OptsData  []byte `json:"optsdata,omitempty"`
+	PublicKey []byte `json:"publickey,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// splitAddress returns the network and address of an enclave helper given as
+// unix://<path>, tcp://<host:port> or as a plain socket path
+func splitAddress(address string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		return "tcp", strings.TrimPrefix(address, "tcp://"), nil
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	}
+	return "", "", fmt.Errorf("invalid enclave address %q", address)
+}
+
+// Listen listens on an enclave helper address
+func Listen(address string) (net.Listener, error) {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, addr)
+}
+
+func call(ctx context.Context, address string, req Request) (*Response, error) {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to enclave helper: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to enclave helper: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response of enclave helper: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("enclave helper: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// UnwrapKey has the enclave helper at address unwrap a JWE annotation
+func UnwrapKey(ctx context.Context, address string, annotation []byte) ([]byte, error) {
+	resp, err := call(ctx, address, Request{Op: OpUnwrap, Annotation: annotation})
+	if err != nil {
+		return nil, err
+	}
+	return resp.OptsData, nil
+}
+
+// PublicKey returns the PEM encoded public key of the enclave helper at
+// address, which is the recipient to encrypt images for
+func PublicKey(ctx context.Context, address string) ([]byte, error) {
+	resp, err := call(ctx, address, Request{Op: OpPublicKey})
+	if err != nil {
+		return nil, err
+	}
+	return resp.PublicKey, nil
+}
+
+// WithAddresses adds the addresses of enclave helpers to the DecryptConfig
+func WithAddresses(dc *encconfig.DecryptConfig, addresses []string) {
+	if dc.Parameters == nil {
+		dc.Parameters = make(map[string][][]byte)
+	}
+	for _, a := range addresses {
+		dc.Parameters[ParameterName] = append(dc.Parameters[ParameterName], []byte(a))
+	}
+}
+
+// keyWrapper tries the enclave helpers of the DecryptConfig before the
+// private keys passed to the JWE key wrapper
+type keyWrapper struct {
+	keywrap.KeyWrapper
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	var errs []string
+	for _, address := range dc.Parameters[ParameterName] {
+		optsData, err := UnwrapKey(context.Background(), string(address), annotation)
+		if err == nil {
+			return optsData, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if !kw.KeyWrapper.NoPossibleKeys(dc.Parameters) {
+		return kw.KeyWrapper.UnwrapKey(dc, annotation)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no enclave helper configured")
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(dcparameters[ParameterName]) == 0 && kw.KeyWrapper.NoPossibleKeys(dcparameters)
+}
+
+var installOnce sync.Once
+
+// Install registers the enclave unwrapper for JWE wrapped keys with ocicrypt
+func Install() {
+	installOnce.Do(func() {
+		uniformunwrap.Install()
+		ocicrypt.RegisterKeyWrapper("jwe", &keyWrapper{ocicrypt.GetKeyWrapper("jwe")})
+	})
+}
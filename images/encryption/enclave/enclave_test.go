@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+func TestEnclaveUnwrap(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	srv, err := NewServer(privPEM, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "enclave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := "unix://" + filepath.Join(dir, "helper.sock")
+	l, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	pub, err := PublicKey(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwe := ocicrypt.GetKeyWrapper("jwe")
+	optsData := []byte("layer key")
+	annotation, err := jwe.WrapKeys(&encconfig.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pub}},
+	}, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kw := &keyWrapper{jwe}
+	dc := &encconfig.DecryptConfig{}
+	if !kw.NoPossibleKeys(dc.Parameters) {
+		t.Fatal("expected no possible keys without enclave addresses")
+	}
+	WithAddresses(dc, []string{address})
+	if kw.NoPossibleKeys(dc.Parameters) {
+		t.Fatal("expected enclave address to be a possible key")
+	}
+	got, err := kw.UnwrapKey(dc, annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, optsData) {
+		t.Fatalf("unwrapped %q, want %q", got, optsData)
+	}
+
+	if _, err := kw.UnwrapKey(dc, []byte("garbage")); err == nil {
+		t.Fatal("expected unwrapping of an invalid annotation to fail")
+	}
+}
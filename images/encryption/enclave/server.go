@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package enclave
+
+import (
+	"crypto"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/uniformunwrap"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/crypto/jose"
+	"github.com/gobars/ocicrypt/crypto/x509"
+	"github.com/gobars/ocicrypt/utils"
+)
+
+// Server is the enclave side of the protocol; it is run inside the enclave
+// with a private key that is only accessible to it, e.g. a Gramine encrypted file
+type Server struct {
+	dc        encconfig.DecryptConfig
+	publicKey []byte
+}
+
+// NewServer creates a server that unwraps keys with the given private key
+func NewServer(privKey, password []byte) (*Server, error) {
+	uniformunwrap.Install()
+	key, err := utils.ParsePrivateKey(privKey, password, "JWE")
+	if err != nil {
+		return nil, err
+	}
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return &Server{
+		dc: encconfig.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {privKey},
+				"privkeys-passwords": {password},
+			},
+		},
+		publicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+	}, nil
+}
+
+// PublicKey returns the PEM encoded public key of the server
+func (s *Server) PublicKey() []byte {
+	return s.publicKey
+}
+
+// Serve handles connections on l until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	var resp Response
+	switch req.Op {
+	case OpUnwrap:
+		optsData, err := ocicrypt.GetKeyWrapper("jwe").UnwrapKey(&s.dc, req.Annotation)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.OptsData = optsData
+	case OpPublicKey:
+		resp.PublicKey = s.publicKey
+	default:
+		resp.Error = fmt.Sprintf("unsupported operation %q", req.Op)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptedLayerMode is what the encryption of an image does with the layers
+// that are encrypted already, such as those of an encrypted base image
+type EncryptedLayerMode string
+
+const (
+	// EncryptedLayersAdd wraps the layer keys for the new recipients as well,
+	// which requires a key of the layers; this is the default
+	EncryptedLayersAdd EncryptedLayerMode = "add"
+	// EncryptedLayersRewrap wraps the layer keys for the new recipients
+	// alone, replacing the wrapped keys of the layers, which requires a key
+	// of the layers
+	EncryptedLayersRewrap EncryptedLayerMode = "rewrap"
+	// EncryptedLayersKeep leaves the layers as they are, so that only their
+	// recipients can decrypt them
+	EncryptedLayersKeep EncryptedLayerMode = "keep"
+)
+
+// ParseEncryptedLayerMode returns the EncryptedLayerMode with the given name;
+// the empty name is EncryptedLayersAdd
+func ParseEncryptedLayerMode(s string) (EncryptedLayerMode, error) {
+	switch m := EncryptedLayerMode(s); m {
+	case "":
+		return EncryptedLayersAdd, nil
+	case EncryptedLayersAdd, EncryptedLayersRewrap, EncryptedLayersKeep:
+		return m, nil
+	}
+	return "", fmt.Errorf("unsupported mode %q for encrypted layers, expected %q, %q or %q", s, EncryptedLayersAdd, EncryptedLayersRewrap, EncryptedLayersKeep)
+}
+
+type encryptedLayerModeKey struct{}
+
+// WithEncryptedLayerMode returns a context in which the encryption of an
+// image handles the layers that are encrypted already as set by m
+func WithEncryptedLayerMode(ctx context.Context, m EncryptedLayerMode) context.Context {
+	return context.WithValue(ctx, encryptedLayerModeKey{}, m)
+}
+
+// encryptedLayerMode returns the mode set by WithEncryptedLayerMode, or
+// EncryptedLayersAdd
+func encryptedLayerMode(ctx context.Context) EncryptedLayerMode {
+	if m, ok := ctx.Value(encryptedLayerModeKey{}).(EncryptedLayerMode); ok && m != "" {
+		return m
+	}
+	return EncryptedLayersAdd
+}
+
+// dropPreviousKeys removes the wrapped keys that the encrypted layer desc had
+// from the annotations of newDesc, to which the keys of the new recipients
+// were added, so that the layer key is only wrapped for the new recipients
+func dropPreviousKeys(desc ocispec.Descriptor, newDesc *ocispec.Descriptor) error {
+	for k, v := range newDesc.Annotations {
+		if !strings.HasPrefix(k, keysAnnotationPrefix) {
+			continue
+		}
+		if added := newEntries(desc.Annotations[k], v); added != "" {
+			newDesc.Annotations[k] = added
+		} else {
+			delete(newDesc.Annotations, k)
+		}
+	}
+	if !hasWrappedKeys(*newDesc) {
+		return fmt.Errorf("no wrapped keys produced for layer %s", desc.Digest)
+	}
+	return nil
+}
@@ -24,19 +24,38 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+	"github.com/containerd/imgcrypt/images/encryption/chunkhash"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/layercache"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/metrics"
+	"github.com/containerd/imgcrypt/images/encryption/nydus"
+	"github.com/containerd/imgcrypt/images/encryption/status"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/containerd/imgcrypt/images/encryption/unwraporder"
 
 	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/blockcipher"
 	encconfig "github.com/gobars/ocicrypt/config"
 	encocispec "github.com/gobars/ocicrypt/spec"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type cryptoOp int
@@ -45,6 +64,7 @@ const (
 	cryptoOpEncrypt    cryptoOp = iota
 	cryptoOpDecrypt             = iota
 	cryptoOpUnwrapOnly          = iota
+	cryptoOpRewrite             = iota
 )
 
 // LayerFilter allows to select Layers by certain criteria
@@ -60,7 +80,9 @@ func isLocalPlatform(platform *ocispec.Platform) bool {
 // IsEncryptedDiff returns true if mediaType is a known encrypted media type.
 func IsEncryptedDiff(_ context.Context, mediaType string) bool {
 	switch mediaType {
-	case encocispec.MediaTypeLayerZstdEnc, encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerEnc:
+	case encocispec.MediaTypeLayerZstdEnc, encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerEnc,
+		encocispec.MediaTypeLayerNonDistributableZstdEnc, encocispec.MediaTypeLayerNonDistributableGzipEnc,
+		encocispec.MediaTypeLayerNonDistributableEnc:
 		return true
 	}
 	return false
@@ -79,14 +101,21 @@ func HasEncryptedLayer(ctx context.Context, layerInfos []ocispec.Descriptor) boo
 // encryptLayer encrypts the layer using the CryptoConfig and creates a new OCI Descriptor.
 // A call to this function may also only manipulate the wrapped keys list.
 // The caller is expected to store the returned encrypted data and OCI Descriptor
-func encryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc ocispec.Descriptor) (ocispec.Descriptor, io.Reader, ocicrypt.EncryptLayerFinalizer, error) {
+func encryptLayer(cc *encconfig.CryptoConfig, dataReader io.Reader, desc ocispec.Descriptor) (ocispec.Descriptor, io.Reader, ocicrypt.EncryptLayerFinalizer, error) {
 	var (
 		size int64
 		d    digest.Digest
 		err  error
 	)
 
-	encLayerReader, encLayerFinalizer, err := ocicrypt.EncryptLayer(cc.EncryptConfig, ocicrypt.ReaderFromReaderAt(dataReader), desc)
+	installKeyWrappers()
+	if !IsEncryptedDiff(context.Background(), desc.MediaType) {
+		// ocicrypt encrypts plain layers with its default cipher
+		if err := algpolicy.Current().CheckCipher(string(blockcipher.AES256CTR)); err != nil {
+			return ocispec.Descriptor{}, nil, nil, err
+		}
+	}
+	encLayerReader, encLayerFinalizer, err := ocicrypt.EncryptLayer(cc.EncryptConfig, dataReader, desc)
 	if err != nil {
 		return ocispec.Descriptor{}, nil, nil, err
 	}
@@ -117,6 +146,12 @@ func encryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc
 		newDesc.MediaType = encocispec.MediaTypeLayerZstdEnc
 	case encocispec.MediaTypeLayerEnc:
 		newDesc.MediaType = encocispec.MediaTypeLayerEnc
+	case encocispec.MediaTypeLayerNonDistributableGzipEnc:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableGzipEnc
+	case encocispec.MediaTypeLayerNonDistributableZstdEnc:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableZstdEnc
+	case encocispec.MediaTypeLayerNonDistributableEnc:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableEnc
 
 	// TODO: Mediatypes to be added in ocispec
 	case ocispec.MediaTypeImageLayerGzip:
@@ -125,6 +160,12 @@ func encryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc
 		newDesc.MediaType = encocispec.MediaTypeLayerZstdEnc
 	case ocispec.MediaTypeImageLayer:
 		newDesc.MediaType = encocispec.MediaTypeLayerEnc
+	case ocispec.MediaTypeImageLayerNonDistributableGzip:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableGzipEnc
+	case ocispec.MediaTypeImageLayerNonDistributableZstd:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableZstdEnc
+	case ocispec.MediaTypeImageLayerNonDistributable:
+		newDesc.MediaType = encocispec.MediaTypeLayerNonDistributableEnc
 
 	default:
 		return ocispec.Descriptor{}, nil, nil, fmt.Errorf("unsupporter layer MediaType: %s", desc.MediaType)
@@ -135,11 +176,44 @@ func encryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc
 
 // DecryptLayer decrypts the layer using the DecryptConfig and creates a new OCI Descriptor.
 // The caller is expected to store the returned plain data and OCI Descriptor
-func DecryptLayer(dc *encconfig.DecryptConfig, dataReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (ocispec.Descriptor, io.Reader, digest.Digest, error) {
-	resultReader, layerDigest, err := ocicrypt.DecryptLayer(dc, dataReader, desc, unwrapOnly)
+func DecryptLayer(dc *encconfig.DecryptConfig, dataReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (_ ocispec.Descriptor, _ io.Reader, _ digest.Digest, err error) {
+	ctx, span := tracing.Start(tracing.Context(dc), "imgcrypt.DecryptLayer", layerAttributes(desc)...)
+	defer func() { tracing.End(span, err) }()
+	defer tracing.Bind(ctx, dc)()
+
+	installKeyWrappers()
+	if fips.Enabled() {
+		cipher, err := layerCipher(desc)
+		if err != nil {
+			return ocispec.Descriptor{}, nil, "", err
+		}
+		if err := fips.CheckCipher(string(cipher)); err != nil {
+			return ocispec.Descriptor{}, nil, "", err
+		}
+	}
+	desc, err = applyAlgorithmPolicy(desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, "", err
+	}
+	// corrupted layer data is detected at the first corrupted chunk instead
+	// of by the HMAC once the whole layer was read
+	if t, ok, err := chunkhash.Read(desc); err != nil {
+		return ocispec.Descriptor{}, nil, "", err
+	} else if ok {
+		dataReader = chunkhash.NewVerifyingReader(dataReader, t)
+	}
+	defer keymeta.Register(desc)()
+	attempts.BeginLayer(dc, desc)
+	resultReader, layerDigest, err := decryptInOrder(dc, dataReader, desc, unwrapOnly)
+	if err != nil && !unwrapOnly {
+		metrics.DecryptionFailed(string(ClassifyError(err)))
+		_ = status.Current().Failed(string(ClassifyError(err)))
+	}
 	if err != nil || unwrapOnly {
 		return ocispec.Descriptor{}, nil, "", err
 	}
+	resultReader = metrics.CountReader(resultReader, classifyErrorString)
+	resultReader = status.TrackReader(resultReader, classifyErrorString)
 
 	newDesc := ocispec.Descriptor{
 		Size:     0,
@@ -153,16 +227,86 @@ func DecryptLayer(dc *encconfig.DecryptConfig, dataReader io.Reader, desc ocispe
 		newDesc.MediaType = ocispec.MediaTypeImageLayerZstd
 	case encocispec.MediaTypeLayerEnc:
 		newDesc.MediaType = images.MediaTypeDockerSchema2Layer
+	case encocispec.MediaTypeLayerNonDistributableGzipEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributableGzip
+	case encocispec.MediaTypeLayerNonDistributableZstdEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributableZstd
+	case encocispec.MediaTypeLayerNonDistributableEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributable
 	default:
 		return ocispec.Descriptor{}, nil, "", fmt.Errorf("unsupporter layer MediaType: %s", desc.MediaType)
 	}
 	return newDesc, resultReader, layerDigest, nil
 }
 
+func classifyErrorString(err error) string {
+	return string(ClassifyError(err))
+}
+
+// applyAlgorithmPolicy returns an error if the algorithm policy does not allow
+// the cipher of the layer or any of the schemes its key is wrapped with, and
+// otherwise the descriptor without the wrapped keys of disallowed schemes
+func applyAlgorithmPolicy(desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	installKeyWrappers()
+	policy := algpolicy.Current()
+	if cipher, err := layerCipher(desc); err == nil {
+		if err := policy.CheckCipher(string(cipher)); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	return policy.Filter(desc)
+}
+
+// decryptInOrder decrypts the layer with ocicrypt, trying the wrapped keys of
+// one scheme after the other in the order set by unwraporder. ocicrypt only
+// reads the layer data once the layer key is unwrapped, so the data can be
+// passed to each attempt. Schemes without keys configured for them are
+// skipped, and the attempts end early after the failure of a scheme that the
+// order stops on.
+func decryptInOrder(dc *encconfig.DecryptConfig, dataReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (io.Reader, digest.Digest, error) {
+	if dc == nil {
+		return ocicrypt.DecryptLayer(dc, dataReader, desc, unwrapOnly)
+	}
+	order := unwraporder.Current()
+	stages := order.Stages(desc)
+	var errs []error
+	for _, stage := range stages {
+		if ocicrypt.GetKeyWrapper(stage.Scheme).NoPossibleKeys(dc.Parameters) {
+			continue
+		}
+		r, d, err := ocicrypt.DecryptLayer(dc, dataReader, stage.Desc, unwrapOnly)
+		if err == nil {
+			return r, d, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", stage.Scheme, err))
+		if order.StopsOnFailure(stage.Scheme) {
+			logging.G(tracing.Context(dc)).Debug("not trying further wrap schemes after failure", "scheme", stage.Scheme)
+			break
+		}
+	}
+	if len(errs) == 0 {
+		// none of the schemes can be tried; ocicrypt describes why
+		if len(stages) == 0 {
+			if order.Exclusive && len(ocicrypt.GetWrappedKeysMap(desc)) > 0 {
+				return nil, "", fmt.Errorf("layer %s has no wrapped key of the schemes in the unwrap order", desc.Digest)
+			}
+			return ocicrypt.DecryptLayer(dc, dataReader, desc, unwrapOnly)
+		}
+		return ocicrypt.DecryptLayer(dc, dataReader, stages[0].Desc, unwrapOnly)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
 // decryptLayer decrypts the layer using the CryptoConfig and creates a new OCI Descriptor.
 // The caller is expected to store the returned plain data and OCI Descriptor
 func decryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc ocispec.Descriptor, unwrapOnly bool) (ocispec.Descriptor, io.Reader, error) {
-	resultReader, d, err := ocicrypt.DecryptLayer(cc.DecryptConfig, ocicrypt.ReaderFromReaderAt(dataReader), desc, unwrapOnly)
+	desc, err := applyAlgorithmPolicy(desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer keymeta.Register(desc)()
+	attempts.BeginLayer(cc.DecryptConfig, desc)
+	resultReader, d, err := decryptInOrder(cc.DecryptConfig, ocicrypt.ReaderFromReaderAt(dataReader), desc, unwrapOnly)
 	if err != nil || unwrapOnly {
 		return ocispec.Descriptor{}, nil, err
 	}
@@ -180,6 +324,12 @@ func decryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc
 		newDesc.MediaType = ocispec.MediaTypeImageLayerZstd
 	case encocispec.MediaTypeLayerEnc:
 		newDesc.MediaType = images.MediaTypeDockerSchema2Layer
+	case encocispec.MediaTypeLayerNonDistributableGzipEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributableGzip
+	case encocispec.MediaTypeLayerNonDistributableZstdEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributableZstd
+	case encocispec.MediaTypeLayerNonDistributableEnc:
+		newDesc.MediaType = ocispec.MediaTypeImageLayerNonDistributable
 	default:
 		return ocispec.Descriptor{}, nil, fmt.Errorf("unsupporter layer MediaType: %s", desc.MediaType)
 	}
@@ -187,29 +337,109 @@ func decryptLayer(cc *encconfig.CryptoConfig, dataReader content.ReaderAt, desc
 }
 
 // cryptLayer handles the changes due to encryption or decryption of a layer
-func cryptLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, cc *encconfig.CryptoConfig, cryptoOp cryptoOp) (ocispec.Descriptor, error) {
+func cryptLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, cc *encconfig.CryptoConfig, cryptoOp cryptoOp) (_ ocispec.Descriptor, err error) {
 	var (
 		resultReader      io.Reader
 		newDesc           ocispec.Descriptor
 		encLayerFinalizer ocicrypt.EncryptLayerFinalizer
 	)
 
+	ctx, span := tracing.Start(ctx, cryptoOp.spanName(), layerAttributes(desc)...)
+	defer func() { tracing.End(span, err) }()
+	if cc.EncryptConfig != nil {
+		defer tracing.Bind(ctx, cc.EncryptConfig)()
+	}
+	if cc.DecryptConfig != nil {
+		defer tracing.Bind(ctx, cc.DecryptConfig)()
+	}
+
+	// the wrapped keys of layers with many recipients may be in a key blob
+	if desc, err = ExpandKeys(ctx, cs, desc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if cryptoOp == cryptoOpEncrypt && IsEncryptedDiff(ctx, desc.MediaType) && !hasWrappedKeys(desc) {
+		// ocicrypt would encrypt the layer a second time
+		return ocispec.Descriptor{}, fmt.Errorf("layer %s is encrypted already but its wrapped keys are not in its annotations", desc.Digest)
+	}
+
+	// plain layers encrypted before with the same parameters are reused from
+	// the previous version of the image or the layer cache
+	cache := layercache.Current()
+	var encKey string
+	if cryptoOp == cryptoOpEncrypt && !IsEncryptedDiff(ctx, desc.MediaType) {
+		encKey = layercache.Key(desc.Digest, cc.EncryptConfig, layerFormat(ctx, desc))
+		if newDesc, ok := reusePrevious(ctx, cs, encKey, desc); ok {
+			return newDesc, nil
+		}
+		if cache != nil {
+			if newDesc, ok := reuseLayer(ctx, cs, cache, encKey, desc); ok {
+				return newDesc, nil
+			}
+		}
+	}
+
 	dataReader, err := cs.ReaderAt(ctx, desc)
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
 	defer dataReader.Close()
 
+	plainDesc := desc
 	if cryptoOp == cryptoOpEncrypt {
-		newDesc, resultReader, encLayerFinalizer, err = encryptLayer(cc, dataReader, desc)
+		plainReader := io.Reader(ocicrypt.ReaderFromReaderAt(dataReader))
+		if mediaType, ok := convertedMediaType(desc.MediaType, layerCompression(ctx)); ok && !IsEncryptedDiff(ctx, desc.MediaType) {
+			var r io.ReadCloser
+			if plainDesc, r, err = convertLayer(dataReader, desc, mediaType); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			defer r.Close()
+			plainReader = r
+			logging.G(ctx).Debug("converted layer before encryption", "layer", desc.Digest, "mediatype", mediaType, "digest", plainDesc.Digest)
+		}
+		newDesc, resultReader, encLayerFinalizer, err = encryptLayer(cc, plainReader, plainDesc)
+		if err != nil {
+			auditLayer(ctx, audit.OpWrap, desc, err)
+			if IsEncryptedDiff(ctx, desc.MediaType) {
+				err = fmt.Errorf("layer %s is encrypted already and wrapping its key for the new recipients needs a key of the layer, or leave it as it is with encrypted layer mode %q: %w", desc.Digest, EncryptedLayersKeep, err)
+			}
+		}
 	} else {
 		newDesc, resultReader, err = decryptLayer(cc, dataReader, desc, cryptoOp == cryptoOpUnwrapOnly)
+		auditLayer(ctx, audit.OpUnwrap, desc, err)
 	}
 	if err != nil || cryptoOp == cryptoOpUnwrapOnly {
 		return ocispec.Descriptor{}, err
 	}
 
 	newDesc.Annotations = ocicrypt.FilterOutAnnotations(desc.Annotations)
+	var hasher *chunkhash.Hasher
+	if cryptoOp == cryptoOpEncrypt && resultReader == nil {
+		// layers whose keys are only wrapped again keep their data
+		if v, ok := desc.Annotations[chunkhash.Annotation]; ok {
+			newDesc.Annotations[chunkhash.Annotation] = v
+		}
+	} else if cryptoOp == cryptoOpEncrypt && chunkhash.Enabled(ctx) {
+		hasher = chunkhash.NewHasher(chunkhash.ChunkSize(plainDesc.Size))
+		resultReader = io.TeeReader(resultReader, hasher)
+	}
+
+	// finalize adds the wrapped keys to the annotations once the layer data
+	// was read, if it was encrypted
+	wrapped := encLayerFinalizer != nil
+	finalize := func() error {
+		if encLayerFinalizer == nil {
+			return nil
+		}
+		annotations, err := encLayerFinalizer()
+		encLayerFinalizer = nil
+		if err != nil {
+			return fmt.Errorf("error getting annotations from encLayer finalizer: %w", err)
+		}
+		for k, v := range annotations {
+			newDesc.Annotations[k] = v
+		}
+		return nil
+	}
 
 	// some operations, such as changing recipients, may not touch the layer at all
 	if resultReader != nil {
@@ -222,32 +452,220 @@ func cryptLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor,
 			ref = fmt.Sprintf("blob-%d-%d", rand.Int(), rand.Int())
 		}
 
+		// the labels are set when the blob is committed; they record where
+		// the blob came from so that residue can be cleaned up later, and
+		// those of encrypted layers describe the wrapped keys, which are only
+		// known once the layer was read
+		labels := func() (map[string]string, error) {
+			if cryptoOp == cryptoOpDecrypt {
+				return map[string]string{
+					LabelSchema:          LabelSchemaVersion,
+					LabelEncryptedSource: desc.Digest.String(),
+				}, nil
+			}
+			if err := finalize(); err != nil {
+				return nil, err
+			}
+			l, err := encryptedLayerLabels(newDesc)
+			if err != nil {
+				return nil, err
+			}
+			if !IsEncryptedDiff(ctx, desc.MediaType) {
+				l[LabelPlaintextSource] = desc.Digest.String()
+				l[LabelEncryption] = encKey
+			}
+			return l, nil
+		}
+
+		wctx, wspan := tracing.Start(ctx, "imgcrypt.WriteLayer")
 		if haveDigest {
-			if err := content.WriteBlob(ctx, cs, ref, resultReader, newDesc); err != nil {
-				return ocispec.Descriptor{}, fmt.Errorf("failed to write config: %w", err)
+			// only decrypted layers have a digest ahead of time
+			var l map[string]string
+			if l, err = labels(); err == nil {
+				err = writeLabelledBlob(wctx, cs, ref, resultReader, newDesc, l)
 			}
-		} else {
-			newDesc.Digest, newDesc.Size, err = ingestReader(ctx, cs, ref, resultReader)
 			if err != nil {
-				return ocispec.Descriptor{}, err
+				err = fmt.Errorf("failed to write config: %w", err)
 			}
+		} else {
+			newDesc.Digest, newDesc.Size, err = ingestReader(wctx, cs, ref, resultReader, labels)
+		}
+		if err == nil {
+			wspan.SetAttributes(layerAttributes(newDesc)...)
+		}
+		tracing.End(wspan, err)
+		if err != nil {
+			return ocispec.Descriptor{}, err
 		}
 	}
 
 	// After performing encryption, call finalizer to get annotations
-	if encLayerFinalizer != nil {
-		annotations, err := encLayerFinalizer()
+	if wrapped {
+		if err := finalize(); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if IsEncryptedDiff(ctx, desc.MediaType) && encryptedLayerMode(ctx) == EncryptedLayersRewrap {
+			if err := dropPreviousKeys(desc, &newDesc); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+		}
+		md, err := keymeta.New(newDesc, cc.EncryptConfig, time.Now())
 		if err != nil {
-			return ocispec.Descriptor{}, fmt.Errorf("error getting annotations from encLayer finalizer: %w", err)
+			return ocispec.Descriptor{}, err
 		}
-		for k, v := range annotations {
-			newDesc.Annotations[k] = v
+		if prev, err := keymeta.Read(desc); err == nil && md.Context == nil {
+			// rewrapped layer keys keep their encryption context
+			md.Context = prev.Context
+		}
+		if p := escrow.Current(); p != nil {
+			if err := p.Check(md); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("layer %s: %w", desc.Digest, err)
+			}
+		}
+		if err := keymeta.Annotate(&newDesc, md); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if hasher != nil {
+			if err := chunkhash.Annotate(&newDesc, hasher.Tree()); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+		}
+		auditLayer(ctx, audit.OpWrap, newDesc, nil)
+		if cache != nil && encKey != "" {
+			storeLayer(ctx, cs, cache, encKey, newDesc)
+		}
+		if newDesc, err = spillKeys(ctx, cs, newDesc); err != nil {
+			return ocispec.Descriptor{}, err
 		}
 	}
 	return newDesc, err
 }
 
-func ingestReader(ctx context.Context, cs content.Ingester, ref string, r io.Reader) (digest.Digest, int64, error) {
+// encAnnotationPrefix prefixes the annotations of encrypted layers, such as
+// those with the wrapped keys, the block cipher options and the key metadata
+const encAnnotationPrefix = "org.opencontainers.image.enc."
+
+// reuseLayer writes the encrypted layer that the cache holds for the key to
+// cs and returns its descriptor for the plain layer desc; false is returned
+// if the cache has no usable layer, so that desc is encrypted instead
+func reuseLayer(ctx context.Context, cs content.Store, cache *layercache.Cache, key string, desc ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	cached, r, err := cache.Get(key)
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			logging.G(ctx).Warn("could not read the layer cache, encrypting the layer", "layer", desc.Digest, "error", err)
+		}
+		return ocispec.Descriptor{}, false
+	}
+	defer r.Close()
+
+	newDesc, err := adoptLayer(ctx, cs, desc, cached, key, r)
+	if err != nil {
+		logging.G(ctx).Warn("could not reuse the cached encrypted layer, encrypting the layer", "layer", desc.Digest, "error", err)
+		_ = cache.Remove(key)
+		return ocispec.Descriptor{}, false
+	}
+	logging.G(ctx).Info("reused the cached encrypted layer", "layer", desc.Digest, "encrypted", newDesc.Digest)
+	return newDesc, true
+}
+
+// adoptLayer returns the descriptor of the encrypted layer enc, which was
+// encrypted from the plain layer desc with the parameters identified by key,
+// in place of encrypting desc anew. The blob of enc is written from r, or
+// only labelled if r is nil because it is in cs already. The wrapped keys of
+// enc are checked against the escrow policy and recorded in the audit log as
+// if they were wrapped now.
+func adoptLayer(ctx context.Context, cs content.Store, desc, enc ocispec.Descriptor, key string, r io.Reader) (ocispec.Descriptor, error) {
+	newDesc := enc
+	newDesc.Platform = desc.Platform
+	newDesc.Annotations = ocicrypt.FilterOutAnnotations(desc.Annotations)
+	for k, v := range enc.Annotations {
+		if strings.HasPrefix(k, encAnnotationPrefix) {
+			newDesc.Annotations[k] = v
+		}
+	}
+	if p := escrow.Current(); p != nil {
+		md, err := keymeta.Read(newDesc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := p.Check(md); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	labels, err := encryptedLayerLabels(newDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	labels[LabelPlaintextSource] = desc.Digest.String()
+	labels[LabelEncryption] = key
+	if r != nil {
+		err = writeLabelledBlob(ctx, cs, "layer-"+newDesc.Digest.String(), r, newDesc, labels)
+	} else {
+		err = updateLabels(ctx, cs, newDesc.Digest, labels)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if newDesc, err = spillKeys(ctx, cs, newDesc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	auditLayer(ctx, audit.OpWrap, newDesc, nil)
+	return newDesc, nil
+}
+
+// storeLayer stores the encrypted layer with the given descriptor, whose blob
+// is in cs, in the cache under the key; failures are only logged, since the
+// layer was encrypted nevertheless
+func storeLayer(ctx context.Context, cs content.Store, cache *layercache.Cache, key string, desc ocispec.Descriptor) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err == nil {
+		err = cache.Put(key, desc, content.NewReader(ra))
+		ra.Close()
+	}
+	if err != nil {
+		logging.G(ctx).Warn("could not store the encrypted layer in the layer cache", "layer", desc.Digest, "error", err)
+	}
+}
+
+// spanName returns the name of the span of the operation on a layer
+func (op cryptoOp) spanName() string {
+	switch op {
+	case cryptoOpEncrypt:
+		return "imgcrypt.EncryptLayer"
+	case cryptoOpUnwrapOnly:
+		return "imgcrypt.UnwrapLayerKey"
+	}
+	return "imgcrypt.DecryptLayer"
+}
+
+// layerAttributes returns the span attributes describing the layer
+func layerAttributes(desc ocispec.Descriptor) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("imgcrypt.layer.digest", desc.Digest.String()),
+		attribute.String("imgcrypt.layer.media_type", desc.MediaType),
+		attribute.Int64("imgcrypt.layer.size", desc.Size),
+	}
+}
+
+// auditLayer emits the audit record of a key operation on the layer with the given descriptor
+func auditLayer(ctx context.Context, op audit.Operation, desc ocispec.Descriptor, err error) {
+	if !audit.Enabled(ctx) {
+		return
+	}
+	rec := audit.Record{
+		Operation: op,
+		Layer:     desc.Digest,
+	}
+	if li, lerr := GetLayerInfo(0, desc, nil); lerr == nil {
+		rec.Schemes = li.Schemes()
+		rec.Recipients = li.Recipients()
+	}
+	audit.Emit(ctx, rec, err)
+}
+
+// ingestReader writes the blob read from r and commits it with the labels
+// returned by labels once r was read
+func ingestReader(ctx context.Context, cs content.Store, ref string, r io.Reader, labels func() (map[string]string, error)) (digest.Digest, int64, error) {
 	cw, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
 	if err != nil {
 		return "", 0, fmt.Errorf("failed to open writer: %w", err)
@@ -263,15 +681,28 @@ func ingestReader(ctx context.Context, cs content.Ingester, ref string, r io.Rea
 		return "", 0, fmt.Errorf("failed to get state: %w", err)
 	}
 
-	if err := cw.Commit(ctx, st.Offset, ""); err != nil {
+	l, err := labels()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := cw.Commit(ctx, st.Offset, "", content.WithLabels(l)); err != nil {
 		if !errdefs.IsAlreadyExists(err) {
 			return "", 0, fmt.Errorf("failed commit on ref %q: %w", ref, err)
 		}
+		if err := updateLabels(ctx, cs, cw.Digest(), l); err != nil {
+			return "", 0, err
+		}
 	}
 
 	return cw.Digest(), st.Offset, nil
 }
 
+// hasBlob returns whether the data of desc are in the content store
+func hasBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor) bool {
+	_, err := cs.Info(ctx, desc.Digest)
+	return err == nil
+}
+
 // Encrypt or decrypt all the Children of a given descriptor
 func cryptChildren(ctx context.Context, cs content.Store, desc ocispec.Descriptor, cc *encconfig.CryptoConfig, lf LayerFilter, cryptoOp cryptoOp, _ *ocispec.Platform) (ocispec.Descriptor, bool, error) {
 	children, err := images.Children(ctx, cs, desc)
@@ -282,11 +713,35 @@ func cryptChildren(ctx context.Context, cs content.Store, desc ocispec.Descripto
 		return ocispec.Descriptor{}, false, err
 	}
 
+	if cryptoOp == cryptoOpDecrypt {
+		var encrypted []ocispec.Descriptor
+		for _, child := range children {
+			if IsEncryptedDiff(ctx, child.MediaType) && lf(child) {
+				if expanded, err := ExpandKeys(ctx, cs, child); err == nil {
+					child = expanded
+				}
+				encrypted = append(encrypted, child)
+			}
+		}
+		defer keyprovider.Prefetch(ctx, cc.DecryptConfig, encrypted)()
+	}
+
+	if cryptoOp == cryptoOpEncrypt && nydus.IsImage(children) {
+		logging.G(ctx).Info("encrypting the bootstrap layer of a Nydus image, its data blobs are left as they are")
+	}
+
 	var newLayers []ocispec.Descriptor
 	var config ocispec.Descriptor
 	modified := false
 
 	for _, child := range children {
+		if nydus.IsBlob(child) {
+			// nydusd reads the data blobs chunk by chunk, so they are never
+			// encrypted as a whole; the keys of encrypted chunks are held by
+			// the bootstrap layer
+			newLayers = append(newLayers, child)
+			continue
+		}
 		// we only encrypt child layers and have to update their parents if encryption happened
 		switch child.MediaType {
 		case images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
@@ -304,9 +759,24 @@ func cryptChildren(ctx context.Context, cs content.Store, desc ocispec.Descripto
 			} else {
 				newLayers = append(newLayers, child)
 			}
-		case encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerZstdEnc, encocispec.MediaTypeLayerEnc:
-			// this one can be decrypted but also its recipients list changed
-			if lf(child) {
+		case encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerZstdEnc, encocispec.MediaTypeLayerEnc,
+			encocispec.MediaTypeLayerNonDistributableGzipEnc, encocispec.MediaTypeLayerNonDistributableZstdEnc,
+			encocispec.MediaTypeLayerNonDistributableEnc:
+			// this one can be decrypted, its recipients list changed or its annotations rewritten
+			if cryptoOp == cryptoOpRewrite {
+				if lf(child) {
+					nl, m, err := rewriterFrom(ctx)(child)
+					if err != nil {
+						return ocispec.Descriptor{}, false, err
+					}
+					modified = modified || m
+					child = nl
+				}
+				newLayers = append(newLayers, child)
+			} else if lf(child) && cryptoOp == cryptoOpEncrypt && encryptedLayerMode(ctx) == EncryptedLayersKeep {
+				logging.G(ctx).Info("leaving the layer that is encrypted already as it is", "layer", child.Digest)
+				newLayers = append(newLayers, child)
+			} else if lf(child) {
 				nl, err := cryptLayer(ctx, cs, child, cc, cryptoOp)
 				if err != nil || cryptoOp == cryptoOpUnwrapOnly {
 					return ocispec.Descriptor{}, false, err
@@ -316,8 +786,25 @@ func cryptChildren(ctx context.Context, cs content.Store, desc ocispec.Descripto
 			} else {
 				newLayers = append(newLayers, child)
 			}
+		case ocispec.MediaTypeImageLayerNonDistributable, ocispec.MediaTypeImageLayerNonDistributableGzip,
+			ocispec.MediaTypeImageLayerNonDistributableZstd:
+			// non-distributable layers are only encrypted if they were fetched
+			// into the local content store; the encrypted layer stays
+			// non-distributable but is no longer found at the URLs of the
+			// plain one
+			if cryptoOp == cryptoOpEncrypt && lf(child) && hasBlob(ctx, cs, child) {
+				nl, err := cryptLayer(ctx, cs, child, cc, cryptoOp)
+				if err != nil {
+					return ocispec.Descriptor{}, false, err
+				}
+				modified = true
+				newLayers = append(newLayers, nl)
+			} else {
+				newLayers = append(newLayers, child)
+			}
 		case images.MediaTypeDockerSchema2LayerForeign, images.MediaTypeDockerSchema2LayerForeignGzip:
-			// never encrypt/decrypt
+			// never encrypt/decrypt; foreign layers, such as Windows base layers, are
+			// fetched from their URLs and are typically not in the local content store
 			newLayers = append(newLayers, child)
 		default:
 			return ocispec.Descriptor{}, false, fmt.Errorf("bad/unhandled MediaType %s in encryptChildren", child.MediaType)
@@ -333,33 +820,46 @@ func cryptChildren(ctx context.Context, cs content.Store, desc ocispec.Descripto
 			Layers: newLayers,
 		}
 
-		mb, err := json.MarshalIndent(newManifest, "", "   ")
+		newDesc, err := writeManifest(ctx, cs, newManifest, desc.Platform)
 		if err != nil {
-			return ocispec.Descriptor{}, false, fmt.Errorf("failed to marshal image: %w", err)
+			return ocispec.Descriptor{}, false, err
 		}
+		return newDesc, true, nil
+	}
 
-		newDesc := ocispec.Descriptor{
-			MediaType: ocispec.MediaTypeImageManifest,
-			Size:      int64(len(mb)),
-			Digest:    digest.Canonical.FromBytes(mb),
-			Platform:  desc.Platform,
-		}
+	return desc, modified, nil
+}
 
-		labels := map[string]string{}
-		labels["containerd.io/gc.ref.content.0"] = newManifest.Config.Digest.String()
-		for i, ch := range newManifest.Layers {
-			labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = ch.Digest.String()
-		}
+// writeManifest writes manifest to the content store with the labels that keep
+// its config, layers and key blobs from being garbage collected
+func writeManifest(ctx context.Context, cs content.Store, manifest ocispec.Manifest, platform *ocispec.Platform) (ocispec.Descriptor, error) {
+	mb, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to marshal image: %w", err)
+	}
 
-		ref := fmt.Sprintf("manifest-%s", newDesc.Digest.String())
+	newDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Size:      int64(len(mb)),
+		Digest:    digest.Canonical.FromBytes(mb),
+		Platform:  platform,
+	}
 
-		if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(mb), newDesc, content.WithLabels(labels)); err != nil {
-			return ocispec.Descriptor{}, false, fmt.Errorf("failed to write config: %w", err)
-		}
-		return newDesc, true, nil
+	labels := map[string]string{}
+	labels["containerd.io/gc.ref.content.0"] = manifest.Config.Digest.String()
+	for i, ch := range manifest.Layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = ch.Digest.String()
+	}
+	for i, blob := range keyBlobs(manifest.Layers) {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.k.%d", i)] = blob.Digest.String()
 	}
 
-	return desc, modified, nil
+	ref := fmt.Sprintf("manifest-%s", newDesc.Digest.String())
+
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(mb), newDesc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return newDesc, nil
 }
 
 // cryptManifest encrypts or decrypts the children of a top level manifest
@@ -419,32 +919,42 @@ func cryptManifestList(ctx context.Context, cs content.Store, desc ocispec.Descr
 			Manifests: newManifests,
 		}
 
-		mb, err := json.MarshalIndent(newIndex, "", "   ")
+		newDesc, err := writeIndex(ctx, cs, newIndex)
 		if err != nil {
-			return ocispec.Descriptor{}, false, fmt.Errorf("failed to marshal index: %w", err)
+			return ocispec.Descriptor{}, false, err
 		}
+		return newDesc, true, nil
+	}
 
-		// digest
-		newDesc := ocispec.Descriptor{
-			MediaType: ocispec.MediaTypeImageIndex,
-			Size:      int64(len(mb)),
-			Digest:    digest.Canonical.FromBytes(mb),
-		}
+	return desc, false, nil
+}
 
-		labels := map[string]string{}
-		for i, m := range newIndex.Manifests {
-			labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i)] = m.Digest.String()
-		}
+// writeIndex writes index to the content store with the labels that keep its
+// manifests from being garbage collected
+func writeIndex(ctx context.Context, cs content.Store, index ocispec.Index) (ocispec.Descriptor, error) {
+	mb, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to marshal index: %w", err)
+	}
 
-		ref := fmt.Sprintf("index-%s", newDesc.Digest.String())
+	// digest
+	newDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Size:      int64(len(mb)),
+		Digest:    digest.Canonical.FromBytes(mb),
+	}
 
-		if err = content.WriteBlob(ctx, cs, ref, bytes.NewReader(mb), newDesc, content.WithLabels(labels)); err != nil {
-			return ocispec.Descriptor{}, false, fmt.Errorf("failed to write index: %w", err)
-		}
-		return newDesc, true, nil
+	labels := map[string]string{}
+	for i, m := range index.Manifests {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i)] = m.Digest.String()
 	}
 
-	return desc, false, nil
+	ref := fmt.Sprintf("index-%s", newDesc.Digest.String())
+
+	if err = content.WriteBlob(ctx, cs, ref, bytes.NewReader(mb), newDesc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write index: %w", err)
+	}
+	return newDesc, nil
 }
 
 // cryptImage is the dispatcher to encrypt/decrypt an image; it accepts either an OCI descriptor
@@ -473,6 +983,54 @@ func DecryptImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor
 	return cryptImage(ctx, cs, desc, cc, lf, cryptoOpDecrypt)
 }
 
+// MigrateImage adds version 2 key metadata, derived from the wrapped keys, to
+// the encrypted layers without it; no keys are needed since the layer keys are
+// neither unwrapped nor wrapped again
+func MigrateImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf LayerFilter) (ocispec.Descriptor, bool, error) {
+	return RewriteImage(ctx, cs, desc, lf, migrateLayer)
+}
+
+// LayerRewriter returns the descriptor of an encrypted layer with changed
+// annotations and whether it changed; the layer data is left as it is
+type LayerRewriter func(desc ocispec.Descriptor) (ocispec.Descriptor, bool, error)
+
+type rewriterKey struct{}
+
+func rewriterFrom(ctx context.Context) LayerRewriter {
+	return ctx.Value(rewriterKey{}).(LayerRewriter)
+}
+
+// RewriteImage rewrites the descriptors of the encrypted layers of the image
+// that the filter selects with rw, without reading their data, and writes the
+// manifests and indexes referring to them; it returns the new descriptor of
+// the image and whether any layer changed
+func RewriteImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf LayerFilter, rw LayerRewriter) (ocispec.Descriptor, bool, error) {
+	ctx = context.WithValue(ctx, rewriterKey{}, rw)
+	return cryptImage(ctx, cs, desc, &encconfig.CryptoConfig{}, lf, cryptoOpRewrite)
+}
+
+// migrateLayer returns the layer with version 2 key metadata and whether it
+// had to be added
+func migrateLayer(desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+	if _, ok := desc.Annotations[keymeta.Annotation]; ok {
+		return desc, false, nil
+	}
+	md, err := keymeta.Derive(desc)
+	if err != nil {
+		return ocispec.Descriptor{}, false, fmt.Errorf("layer %s: %w", desc.Digest, err)
+	}
+	md.Version = keymeta.Version2
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	desc.Annotations = annotations
+	if err := keymeta.Annotate(&desc, md); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	return desc, true, nil
+}
+
 // GetImageEncryptConverter returns a converter function for image encryption
 func GetImageEncryptConverter(cc *encconfig.CryptoConfig, lf LayerFilter) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
@@ -498,6 +1056,7 @@ func GetImageDecryptConverter(cc *encconfig.CryptoConfig, lf LayerFilter) conver
 // CheckAuthorization checks whether a user has the right keys to be allowed to access an image (every layer)
 // It takes decrypting of the layers only as far as decrypting the asymmetrically encrypted data
 // The decryption is only done for the current platform
+// If the user is not authorized, an *AuthorizationError with the attempts to unwrap the layer keys is returned
 func CheckAuthorization(ctx context.Context, cs content.Store, desc ocispec.Descriptor, dc *encconfig.DecryptConfig) error {
 	cc := encconfig.InitDecryption(dc.Parameters)
 
@@ -505,9 +1064,17 @@ func CheckAuthorization(ctx context.Context, cs content.Store, desc ocispec.Desc
 		return true
 	}
 
+	rec, unbind := attempts.Bind(cc.DecryptConfig)
 	_, _, err := cryptImage(ctx, cs, desc, &cc, lf, cryptoOpUnwrapOnly)
+	unbind()
 	if err != nil {
-		return fmt.Errorf("you are not authorized to use this image: %w", err)
+		err = &AuthorizationError{Layers: rec.Layers(), Err: err}
+		for _, l := range rec.Layers() {
+			for _, a := range l.Attempts {
+				logging.G(ctx).Debug("layer key unwrap attempt", "layer", l.Digest, "scheme", a.Scheme, "index", a.Index, "reason", a.Reason, "error", a.Error)
+			}
+		}
 	}
-	return nil
+	audit.Emit(ctx, audit.Record{Operation: audit.OpAuthorize}, err)
+	return err
 }
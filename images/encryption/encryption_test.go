@@ -0,0 +1,706 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/chunkhash"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/layercache"
+	"github.com/containerd/imgcrypt/images/encryption/nydus"
+	"github.com/containerd/imgcrypt/images/encryption/threshold"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encocispec "github.com/gobars/ocicrypt/spec"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCryptNydusImage(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	blob := testutil.WriteBlob(t, cs, nydus.MediaTypeBlob, []byte("nydus data blob"))
+	blob.Annotations = map[string]string{nydus.AnnotationBlob: "true"}
+	bootstrap := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("nydus bootstrap"))
+	bootstrap.Annotations = map[string]string{nydus.AnnotationBootstrap: "true"}
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{blob, bootstrap},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+
+	encrypted, modified, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("expected the bootstrap layer to be encrypted")
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != blob.Digest || m.Layers[0].MediaType != nydus.MediaTypeBlob {
+		t.Fatal("expected the data blob to be left as it is")
+	}
+	if !IsEncryptedDiff(ctx, m.Layers[1].MediaType) || !nydus.IsBootstrap(m.Layers[1]) {
+		t.Fatalf("expected an encrypted bootstrap layer, got %+v", m.Layers[1])
+	}
+
+	decrypted, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = images.Manifest(ctx, cs, decrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != blob.Digest || m.Layers[1].Digest != bootstrap.Digest || !nydus.IsBootstrap(m.Layers[1]) {
+		t.Fatal("expected the decrypted image to have the original layers")
+	}
+}
+
+func TestCryptNonDistributableLayers(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"windows"}`))
+	// the base layer was not pulled, so it is only found at its URL
+	base := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    digest.FromString("base layer"),
+		Size:      10,
+		URLs:      []string{"https://example.com/base"},
+	}
+	pulled := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayerNonDistributableGzip, []byte("pulled layer"))
+	foreign := testutil.WriteBlob(t, cs, images.MediaTypeDockerSchema2LayerForeignGzip, []byte("foreign layer"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{base, pulled, foreign},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != base.Digest || m.Layers[2].Digest != foreign.Digest {
+		t.Fatal("expected the missing and the foreign layer to be left as they are")
+	}
+	if m.Layers[1].MediaType != encocispec.MediaTypeLayerNonDistributableGzipEnc || len(m.Layers[1].URLs) != 0 {
+		t.Fatalf("expected an encrypted non-distributable layer without URLs, got %+v", m.Layers[1])
+	}
+
+	decrypted, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = images.Manifest(ctx, cs, decrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[1].Digest != pulled.Digest || m.Layers[1].MediaType != ocispec.MediaTypeImageLayerNonDistributableGzip {
+		t.Fatalf("expected the decrypted non-distributable layer, got %+v", m.Layers[1])
+	}
+}
+
+// writeTestImage writes a manifest with a single plain layer to a new store
+func writeTestImage(t *testing.T) (content.Store, ocispec.Descriptor) {
+	t.Helper()
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("layer data"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+}
+
+func TestEncryptImageEscrow(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrowPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	escrowFile := filepath.Join(t.TempDir(), "recovery-pub.pem")
+	if err := os.WriteFile(escrowFile, escrowPub, 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := escrow.New([]string{"jwe:" + escrowFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrow.Set(p)
+	defer escrow.Set(nil)
+
+	all := func(ocispec.Descriptor) bool { return true }
+	ecc, _ := testutil.CryptoConfigs(t)
+	if _, _, err := EncryptImage(ctx, cs, manifest, &ecc, all); !errors.Is(err, escrow.ErrMissing) {
+		t.Fatalf("expected encryption without the escrow recipient to fail, got %v", err)
+	}
+
+	ecc.EncryptConfig.Parameters["pubkeys"] = append(ecc.EncryptConfig.Parameters["pubkeys"], escrowPub)
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.EscrowCompliant == nil || !*li.EscrowCompliant {
+		t.Fatalf("expected the layer to be escrow compliant, missing %v", li.MissingEscrow)
+	}
+}
+
+func TestEncryptImageLayerCache(t *testing.T) {
+	ctx := context.Background()
+	cache, err := layercache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	layercache.Set(cache)
+	defer layercache.Set(nil)
+
+	all := func(ocispec.Descriptor) bool { return true }
+	ecc, dcc := testutil.CryptoConfigs(t)
+	encryptedLayer := func(ecc *encconfig.CryptoConfig) ocispec.Descriptor {
+		t.Helper()
+		cs, manifest := writeTestImage(t)
+		encrypted, _, err := EncryptImage(ctx, cs, manifest, ecc, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := images.Manifest(ctx, cs, encrypted, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := cs.Info(ctx, m.Layers[0].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Labels[LabelPlaintextSource] == "" || info.Labels[LabelRecipients] == "" {
+			t.Fatalf("expected the labels of an encrypted layer, got %v", info.Labels)
+		}
+		if _, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all); err != nil {
+			t.Fatal(err)
+		}
+		return m.Layers[0]
+	}
+
+	first := encryptedLayer(&ecc)
+	second := encryptedLayer(&ecc)
+	if first.Digest != second.Digest {
+		t.Fatalf("expected the encrypted layer %s to be reused, got %s", first.Digest, second.Digest)
+	}
+
+	other, _ := testutil.CryptoConfigs(t)
+	other.EncryptConfig.Parameters["pubkeys"] = append(other.EncryptConfig.Parameters["pubkeys"], ecc.EncryptConfig.Parameters["pubkeys"]...)
+	if third := encryptedLayer(&other); third.Digest == first.Digest {
+		t.Fatal("expected the layer to be encrypted anew for other recipients")
+	}
+}
+
+func TestEncryptImageWithPreviousImage(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	ecc, dcc := testutil.CryptoConfigs(t)
+	encryptedLayer := func(ctx context.Context, ecc *encconfig.CryptoConfig) (ocispec.Descriptor, ocispec.Descriptor) {
+		t.Helper()
+		encrypted, _, err := EncryptImage(ctx, cs, manifest, ecc, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := images.Manifest(ctx, cs, encrypted, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted, m.Layers[0]
+	}
+
+	previous, first := encryptedLayer(ctx, &ecc)
+	info, err := cs.Info(ctx, first.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Labels[LabelEncryption] == "" {
+		t.Fatalf("expected the encryption label on the encrypted layer, got %v", info.Labels)
+	}
+
+	pctx, n, err := WithPreviousImage(ctx, cs, previous, ReuseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected one reusable layer, got %d", n)
+	}
+	encrypted, second := encryptedLayer(pctx, &ecc)
+	if second.Digest != first.Digest {
+		t.Fatalf("expected the encrypted layer %s to be reused, got %s", first.Digest, second.Digest)
+	}
+	if _, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := testutil.CryptoConfigs(t)
+	if _, third := encryptedLayer(pctx, &other); third.Digest == first.Digest {
+		t.Fatal("expected the layer to be encrypted anew for other recipients")
+	}
+
+	pctx, _, err = WithPreviousImage(ctx, cs, previous, ReuseOptions{MaxKeyAge: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fourth := encryptedLayer(pctx, &ecc); fourth.Digest == first.Digest {
+		t.Fatal("expected the layer to be encrypted anew once its keys are too old")
+	}
+}
+
+func TestEncryptImageChunkHashes(t *testing.T) {
+	ctx := chunkhash.WithEnabled(context.Background(), true)
+	cs, manifest := writeTestImage(t)
+
+	all := func(ocispec.Descriptor) bool { return true }
+	ecc, dcc := testutil.CryptoConfigs(t)
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := m.Layers[0]
+	if _, ok, err := chunkhash.Read(layer); err != nil || !ok {
+		t.Fatalf("expected the chunk hashes of the layer, got %v, %v", ok, err)
+	}
+	if _, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := content.ReadBlob(ctx, cs, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	_, r, _, err := DecryptLayer(dcc.DecryptConfig, bytes.NewReader(data), layer, false)
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if !errors.Is(err, chunkhash.ErrCorrupted) {
+		t.Fatalf("expected the corrupted chunk to be detected, got %v", err)
+	}
+}
+
+func TestEncryptImageEncryptedLayers(t *testing.T) {
+	ctx := context.Background()
+	all := func(ocispec.Descriptor) bool { return true }
+	baseEcc, baseDcc := testutil.CryptoConfigs(t)
+	ecc, dcc := testutil.CryptoConfigs(t)
+	store, manifest := writeTestImage(t)
+	base, _, err := EncryptImage(ctx, store, manifest, &baseEcc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseManifest, err := images.Manifest(ctx, store, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a key of the layer its key cannot be wrapped for others
+	if _, _, err := EncryptImage(ctx, store, base, &ecc, all); err == nil || !strings.Contains(err.Error(), string(EncryptedLayersKeep)) {
+		t.Fatalf("expected the encryption to fail for lack of a key, got %v", err)
+	}
+
+	kept, modified, err := EncryptImage(WithEncryptedLayerMode(ctx, EncryptedLayersKeep), store, base, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified || kept.Digest != base.Digest {
+		t.Fatal("expected the encrypted layers to be left as they are")
+	}
+
+	rewrap := ecc
+	rewrapEc := *ecc.EncryptConfig
+	rewrapEc.DecryptConfig = *baseDcc.DecryptConfig
+	rewrap.EncryptConfig = &rewrapEc
+	rewrapped, _, err := EncryptImage(WithEncryptedLayerMode(ctx, EncryptedLayersRewrap), store, base, &rewrap, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, store, rewrapped, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != baseManifest.Layers[0].Digest {
+		t.Fatal("expected the layer data to be left as it is")
+	}
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(li.Recipients()) != 1 {
+		t.Fatalf("expected the layer key to be wrapped for the new recipient alone, got %v", li.Recipients())
+	}
+	if _, _, err := DecryptImage(ctx, store, rewrapped, &dcc, all); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptImage(ctx, store, rewrapped, &baseDcc, all); err == nil {
+		t.Fatal("expected the previous recipient to be unable to decrypt the layer")
+	}
+}
+
+func TestEncryptImageThreshold(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	var pubKeys, privKeys [][]byte
+	for i := 0; i < 3; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+		privKeys = append(privKeys, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	}
+	ecc, err := threshold.EncryptWithGroups(threshold.Group{Threshold: 2, PublicKeys: pubKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(li.Recipients()) != 3 || len(li.KeyIDs()) != 3 {
+		t.Fatalf("expected three threshold recipients, got %v", li.Recipients())
+	}
+
+	one, err := encconfig.DecryptWithPrivKeys(privKeys[:1], [][]byte{nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptImage(ctx, cs, encrypted, &one, all); err == nil {
+		t.Fatal("expected decryption with one of three keys to fail")
+	}
+	two, err := encconfig.DecryptWithPrivKeys(privKeys[1:], [][]byte{nil, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _, err := DecryptImage(ctx, cs, encrypted, &two, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := images.Manifest(ctx, cs, manifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = images.Manifest(ctx, cs, decrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != orig.Layers[0].Digest {
+		t.Fatal("expected the decrypted layer to be the original layer")
+	}
+}
+
+func TestEncryptImageEncryptionContext(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	bound := enccontext.Context{"repository": "docker.io/library/app", "tenant": "acme"}
+	enccontext.Set(ecc.EncryptConfig.Parameters, bound)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enccontext.Context(li.EncryptionContext).Equal(bound) {
+		t.Fatalf("expected the layer info to show context %s, got %v", bound, li.EncryptionContext)
+	}
+
+	for _, tc := range []struct {
+		expected enccontext.Context
+		ok       bool
+	}{
+		{expected: nil, ok: false},
+		{expected: enccontext.Context{"repository": "docker.io/library/other", "tenant": "acme"}, ok: false},
+		{expected: enccontext.Context{"repository": "docker.io/library/app"}, ok: false},
+		{expected: bound, ok: true},
+	} {
+		enccontext.Set(dcc.DecryptConfig.Parameters, tc.expected)
+		_, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all)
+		if tc.ok && err != nil {
+			t.Fatalf("expected decryption with context %s to succeed: %v", tc.expected, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), enccontext.ErrMismatch.Error())) {
+			t.Fatalf("expected decryption with context %s to fail with a mismatch, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestDecryptLayerEncryptionContextMismatch(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	enccontext.Set(ecc.EncryptConfig.Parameters, enccontext.Context{"tenant": "acme"})
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := m.Layers[0]
+	data, err := content.ReadBlob(ctx, cs, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream processor decrypts single layers, so the context is checked
+	// there as well
+	enccontext.Set(dcc.DecryptConfig.Parameters, enccontext.Context{"tenant": "other"})
+	if _, _, _, err := DecryptLayer(dcc.DecryptConfig, bytes.NewReader(data), layer, false); err == nil || !strings.Contains(err.Error(), enccontext.ErrMismatch.Error()) {
+		t.Fatalf("expected the layer key bound to another context to be rejected, got %v", err)
+	}
+	enccontext.Set(dcc.DecryptConfig.Parameters, enccontext.Context{"tenant": "acme"})
+	_, r, _, err := DecryptLayer(dcc.DecryptConfig, bytes.NewReader(data), layer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "layer data" {
+		t.Fatalf("unexpected layer data %q", plain)
+	}
+}
+
+func TestCheckAuthorizationAttempts(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	_, other := testutil.CryptoConfigs(t)
+	enccontext.Set(ecc.EncryptConfig.Parameters, enccontext.Context{"tenant": "acme"})
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dc     *encconfig.DecryptConfig
+		reason attempts.Reason
+	}{
+		{dc: &encconfig.DecryptConfig{Parameters: map[string][][]byte{}}, reason: attempts.ReasonNoKey},
+		{dc: other.DecryptConfig, reason: attempts.ReasonWrongKey},
+		{dc: dcc.DecryptConfig, reason: attempts.ReasonContextMismatch},
+	} {
+		err := CheckAuthorization(ctx, cs, encrypted, tc.dc)
+		var authErr *AuthorizationError
+		if !errors.As(err, &authErr) || !errors.Is(err, ErrNotAuthorized) {
+			t.Fatalf("expected an AuthorizationError, got %v", err)
+		}
+		if len(authErr.Layers) != 1 || authErr.Layers[0].Unwrapped {
+			t.Fatalf("expected one layer whose key was not unwrapped, got %+v", authErr.Layers)
+		}
+		a := authErr.Layers[0].Attempts
+		if len(a) != 1 || a[0].Scheme != "jwe" || a[0].Reason != tc.reason {
+			t.Fatalf("expected a %s jwe attempt, got %+v", tc.reason, a)
+		}
+	}
+
+	enccontext.Set(dcc.DecryptConfig.Parameters, enccontext.Context{"tenant": "acme"})
+	if err := CheckAuthorization(ctx, cs, encrypted, dcc.DecryptConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDecryptionRecipient(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	ecc, _ := testutil.CryptoConfigs(t)
+	other, dcc := testutil.CryptoConfigs(t)
+	_, unrelated := testutil.CryptoConfigs(t)
+	ecc.EncryptConfig.Parameters["pubkeys"] = append(ecc.EncryptConfig.Parameters["pubkeys"], other.EncryptConfig.Parameters["pubkeys"]...)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := encutils.ParsePrivateKey(dcc.DecryptConfig.Parameters["privkeys"][0], nil, "JWE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"privkeys":           append(unrelated.DecryptConfig.Parameters["privkeys"], dcc.DecryptConfig.Parameters["privkeys"]...),
+		"privkeys-passwords": {nil, nil},
+	}}
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li.CheckDecryption(dc, m.Layers[0])
+	if li.Decryptable == nil || !*li.Decryptable {
+		t.Fatal("expected the layer to be decryptable")
+	}
+	if li.UnwrapScheme != "jwe" || li.UnwrapRecipient != keymeta.PrivateKeyID(priv) {
+		t.Fatalf("expected the layer key to be unwrapped by jwe %s, got %s %s", keymeta.PrivateKeyID(priv), li.UnwrapScheme, li.UnwrapRecipient)
+	}
+
+	li.CheckDecryption(unrelated.DecryptConfig, m.Layers[0])
+	if *li.Decryptable || li.UnwrapScheme != "" || li.UnwrapRecipient != "" {
+		t.Fatalf("expected the layer not to be decryptable, got %+v", li)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	_, other := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Preflight(ctx, cs, encrypted, nil, dcc.DecryptConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Layers) != 1 || report.Err() != nil {
+		t.Fatalf("expected one unwrapped layer, got %+v", report.Layers)
+	}
+	l := report.Layers[0]
+	if !l.Authorization || l.Scheme != "jwe" || len(l.KeyIDs) != 1 || l.Duration <= 0 {
+		t.Fatalf("expected the layer key to be unwrapped with the jwe key, got %+v", l)
+	}
+	if len(l.Attempts) != 1 || l.Attempts[0].Reason != attempts.ReasonUnwrapped || l.Attempts[0].Duration <= 0 {
+		t.Fatalf("expected one timed successful attempt, got %+v", l.Attempts)
+	}
+
+	report, err = Preflight(ctx, cs, encrypted, nil, other.DecryptConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Layers[0].Scheme != "" || report.Layers[0].Error == "" || !errors.Is(report.Err(), ErrNotAuthorized) {
+		t.Fatalf("expected the layer key not to be unwrapped with another key, got %+v", report.Layers[0])
+	}
+}
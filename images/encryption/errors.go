@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// ErrNotAuthorized is returned if the keys for using an image are not available
+	ErrNotAuthorized = errors.New("you are not authorized to use this image")
+	// ErrKeyNotFound is returned if no key for decrypting a layer was given
+	ErrKeyNotFound = errors.New("no key available for decryption")
+	// ErrIntegrity is returned if the content of an image is inconsistent or corrupted
+	ErrIntegrity = errors.New("integrity check failed")
+	// ErrEncryptedLayer is returned if an encrypted layer is used where only
+	// plain layers are supported
+	ErrEncryptedLayer = errors.New("layer is encrypted")
+)
+
+// EncryptedLayerError reports an encrypted layer that an operation cannot use
+type EncryptedLayerError struct {
+	// Op is the operation, such as applying the layer
+	Op string
+	// Digest is the digest of the layer
+	Digest digest.Digest
+	// MediaType is the media type of the layer
+	MediaType string
+	// Reason explains why the layer cannot be used
+	Reason string
+}
+
+func (e *EncryptedLayerError) Error() string {
+	return fmt.Sprintf("%s: layer %s is encrypted (%s): %s", e.Op, e.Digest, e.MediaType, e.Reason)
+}
+
+// Is makes an EncryptedLayerError match ErrEncryptedLayer
+func (e *EncryptedLayerError) Is(target error) bool {
+	return target == ErrEncryptedLayer
+}
+
+// AuthorizationError reports that the keys of an image could not be unwrapped,
+// with the attempts made to unwrap them
+type AuthorizationError struct {
+	// Layers holds the attempts per layer
+	Layers []attempts.Layer
+	// Err is the error returned by ocicrypt
+	Err error
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrNotAuthorized, e.Err)
+}
+
+// Unwrap makes an AuthorizationError match ErrNotAuthorized and the error
+// returned by ocicrypt
+func (e *AuthorizationError) Unwrap() []error {
+	return []error{ErrNotAuthorized, e.Err}
+}
+
+// ErrorClass is the kind of failure an error represents
+type ErrorClass string
+
+const (
+	// ErrorClassUnknown is any failure not covered by another class
+	ErrorClassUnknown ErrorClass = "unknown"
+	// ErrorClassKeyNotFound means that no key for decrypting a layer was given
+	ErrorClassKeyNotFound ErrorClass = "key-not-found"
+	// ErrorClassNotAuthorized means that the user may not use an image
+	ErrorClassNotAuthorized ErrorClass = "not-authorized"
+	// ErrorClassUnwrapFailed means that keys were given but none could unwrap the layer key
+	ErrorClassUnwrapFailed ErrorClass = "unwrap-failed"
+	// ErrorClassRegistry means that the communication with a registry failed
+	ErrorClassRegistry ErrorClass = "registry"
+	// ErrorClassIntegrity means that content is corrupted or inconsistent
+	ErrorClassIntegrity ErrorClass = "integrity"
+	// ErrorClassEncryptedLayer means that an encrypted layer was used where
+	// only plain layers are supported
+	ErrorClassEncryptedLayer ErrorClass = "encrypted-layer"
+	// ErrorClassTimeLocked means that layer keys cannot be unwrapped before
+	// the unlock time of their time-lock recipients
+	ErrorClassTimeLocked ErrorClass = "time-locked"
+)
+
+// messages of ocicrypt errors by class, since ocicrypt does not export its errors
+var errorMessages = []struct {
+	class    ErrorClass
+	messages []string
+}{
+	{ErrorClassIntegrity, []string{
+		"could not properly decrypt byte stream",
+		"digest of decrypted layer",
+		"unexpected commit digest",
+	}},
+	{ErrorClassTimeLocked, []string{
+		"time-locked until",
+	}},
+	{ErrorClassKeyNotFound, []string{
+		"missing private key needed for decryption",
+		"no private keys found",
+	}},
+	{ErrorClassUnwrapFailed, []string{
+		"none of the private keys could be used for decryption",
+		"no suitable private key found",
+		"wrong password",
+		"missing password",
+		"locked out after failed attempts",
+	}},
+	{ErrorClassRegistry, []string{
+		"failed to resolve reference",
+		"failed to do request",
+		"unexpected status",
+	}},
+}
+
+// ClassifyError determines the kind of failure an error represents. The most
+// specific class is returned, so an authorization failure caused by a missing
+// key is classified as ErrorClassKeyNotFound.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	switch {
+	case errors.Is(err, ErrIntegrity), errors.Is(err, signature.ErrNoValidSignature), errdefs.IsFailedPrecondition(err) && strings.Contains(err.Error(), "digest"):
+		return ErrorClassIntegrity
+	case errors.Is(err, ErrKeyNotFound):
+		return ErrorClassKeyNotFound
+	case errors.Is(err, ErrEncryptedLayer):
+		return ErrorClassEncryptedLayer
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, em := range errorMessages {
+		for _, m := range em.messages {
+			if strings.Contains(msg, m) {
+				return em.class
+			}
+		}
+	}
+
+	var (
+		netErr net.Error
+		urlErr *url.Error
+	)
+	switch {
+	case errors.Is(err, docker.ErrInvalidAuthorization), errors.As(err, &netErr), errors.As(err, &urlErr):
+		return ErrorClassRegistry
+	case errors.Is(err, ErrNotAuthorized):
+		return ErrorClassNotAuthorized
+	}
+	return ErrorClassUnknown
+}
@@ -0,0 +1,45 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	var testcases = []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{err: errors.New("something"), expected: ErrorClassUnknown},
+		{err: fmt.Errorf("%w: %w", ErrNotAuthorized, errors.New("missing private key needed for decryption:\n")), expected: ErrorClassKeyNotFound},
+		{err: fmt.Errorf("%w: %w", ErrNotAuthorized, errors.New("no suitable key unwrapper found or none of the private keys could be used for decryption:\n")), expected: ErrorClassUnwrapFailed},
+		{err: fmt.Errorf("%w: %w", ErrNotAuthorized, errors.New("other")), expected: ErrorClassNotAuthorized},
+		{err: fmt.Errorf("%w: %w", ErrNotAuthorized, errors.New("none of the private keys could be used for decryption:\nkeyprovider timelock: layer key is time-locked until 2030-01-01T00:00:00Z (30h0m0s from now)")), expected: ErrorClassTimeLocked},
+		{err: fmt.Errorf("layer: %w", ErrIntegrity), expected: ErrorClassIntegrity},
+		{err: fmt.Errorf("unpack: %w", &EncryptedLayerError{Op: "apply", Digest: "sha256:0123", MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"}), expected: ErrorClassEncryptedLayer},
+		{err: errors.New("failed to resolve reference \"docker.io/library/foo:latest\": not found"), expected: ErrorClassRegistry},
+	}
+
+	for _, tc := range testcases {
+		if actual := ClassifyError(tc.err); actual != tc.expected {
+			t.Fatalf("%q: expected %s, but got %s", tc.err, tc.expected, actual)
+		}
+	}
+}
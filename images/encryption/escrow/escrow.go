@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package escrow requires that the layer keys of all encrypted images are also
+// wrapped for designated escrow recipients, such as a corporate recovery key,
+// so that images stay recoverable when their other recipients lose their keys.
+// A policy file looks like:
+//
+//	recipients:
+//	  - jwe:/etc/imgcrypt/recovery-pub.pem
+//	  - provider:vault:transit/recovery
+//
+// Escrow recipients are recognized in the key metadata of layers, so they must
+// be jwe or pkcs7 recipients, pkcs11 recipients given as public key files, or
+// keyprovider and kmip recipients with a key reference.
+package escrow
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrMissing is wrapped by the errors about layer keys that are not wrapped
+// for all escrow recipients
+var ErrMissing = errors.New("layer key is not wrapped for the escrow recipients")
+
+// Policy holds the recipients the layer keys of all images must be wrapped for
+type Policy struct {
+	// Recipients are given like --recipient
+	Recipients []string `yaml:"recipients"`
+
+	keys []key
+}
+
+// key is how an escrow recipient appears in the key metadata of a layer
+type key struct {
+	recipient string
+	scheme    string
+	keyID     string
+	hint      string
+}
+
+// Load reads an escrow policy and the keys of its recipients
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read escrow policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse escrow policy %s: %w", path, err)
+	}
+	if len(p.Recipients) == 0 {
+		return nil, fmt.Errorf("escrow policy %s has no recipients", path)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("escrow policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// New returns a policy for the given recipients
+func New(recipients []string) (*Policy, error) {
+	p := &Policy{Recipients: recipients}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) compile() error {
+	p.keys = nil
+	for _, r := range p.Recipients {
+		k, err := parseRecipient(r)
+		if err != nil {
+			return fmt.Errorf("escrow recipient %s: %w", r, err)
+		}
+		p.keys = append(p.keys, k)
+	}
+	return nil
+}
+
+func parseRecipient(recipient string) (key, error) {
+	protocol, value, ok := strings.Cut(recipient, ":")
+	if !ok || value == "" {
+		return key{}, errors.New("invalid recipient format")
+	}
+	k := key{recipient: recipient, scheme: protocol}
+	switch protocol {
+	case "jwe", "pkcs11":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return key{}, err
+		}
+		if !encutils.IsPublicKey(data) {
+			return key{}, errors.New("escrow keys must be given as public key files")
+		}
+		pub, err := encutils.ParsePublicKey(data, strings.ToUpper(protocol))
+		if err != nil {
+			return key{}, err
+		}
+		if k.keyID, err = keymeta.KeyID(pub); err != nil {
+			return key{}, err
+		}
+	case "pkcs7":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return key{}, err
+		}
+		cert, err := encutils.ParseCertificate(data, "PKCS7")
+		if err != nil {
+			return key{}, err
+		}
+		if k.keyID, err = keymeta.KeyID(cert.PublicKey); err != nil {
+			return key{}, err
+		}
+	case "provider", "kmip":
+		name, ref := protocol, value
+		if protocol == "provider" {
+			if name, ref, ok = strings.Cut(value, ":"); !ok || ref == "" {
+				return key{}, errors.New("keyprovider escrow recipients need a key reference, as provider:<name>:<reference>")
+			}
+		}
+		k.scheme = "provider." + name
+		k.hint = keymeta.RecipientHint([]byte(ref))
+	default:
+		return key{}, fmt.Errorf("%s recipients cannot be escrow recipients; use jwe, pkcs7, pkcs11, provider or kmip", protocol)
+	}
+	return k, nil
+}
+
+var current atomic.Pointer[Policy]
+
+// Set makes the policy apply to the rest of the process; nil disables escrow
+func Set(p *Policy) {
+	current.Store(p)
+}
+
+// Current returns the policy that applies, or nil if escrow is not required
+func Current() *Policy {
+	return current.Load()
+}
+
+// Missing returns the escrow recipients that the key metadata of a layer has
+// no wrapped key for
+func (p *Policy) Missing(md *keymeta.Metadata) []string {
+	var missing []string
+	for _, k := range p.keys {
+		if !k.in(md) {
+			missing = append(missing, k.recipient)
+		}
+	}
+	return missing
+}
+
+// Check returns an error wrapping ErrMissing if the layer key is not wrapped
+// for all escrow recipients
+func (p *Policy) Check(md *keymeta.Metadata) error {
+	if missing := p.Missing(md); len(missing) > 0 {
+		return fmt.Errorf("%w %s", ErrMissing, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (k key) in(md *keymeta.Metadata) bool {
+	if md == nil {
+		return false
+	}
+	for _, mk := range md.Keys {
+		if mk.Scheme != k.scheme {
+			continue
+		}
+		if (k.keyID != "" && mk.KeyID == k.keyID) || (k.hint != "" && mk.Hint == k.hint) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package escrow
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+)
+
+func writePublicKey(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "recovery-pub.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := keymeta.KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, id
+}
+
+func TestMissing(t *testing.T) {
+	dir := t.TempDir()
+	pubFile, keyID := writePublicKey(t, dir)
+	policyFile := filepath.Join(dir, "escrow.yaml")
+	policy := "recipients:\n  - jwe:" + pubFile + "\n  - provider:vault:transit/recovery\n"
+	if err := os.WriteFile(policyFile, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := &keymeta.Metadata{Version: keymeta.Version2, Keys: []keymeta.Key{
+		{Scheme: "jwe", KeyID: "sha256:other"},
+		{Scheme: "provider.vault", Hint: keymeta.RecipientHint([]byte("transit/recovery"))},
+	}}
+	if missing := p.Missing(md); !reflect.DeepEqual(missing, []string{"jwe:" + pubFile}) {
+		t.Fatalf("missing %v", missing)
+	}
+	if err := p.Check(md); !errors.Is(err, ErrMissing) {
+		t.Fatalf("expected ErrMissing, got %v", err)
+	}
+
+	md.Keys = append(md.Keys, keymeta.Key{Scheme: "jwe", KeyID: keyID})
+	if err := p.Check(md); err != nil {
+		t.Fatal(err)
+	}
+	if missing := p.Missing(nil); len(missing) != 2 {
+		t.Fatalf("expected all recipients to be missing without metadata, got %v", missing)
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	pubFile, _ := writePublicKey(t, t.TempDir())
+	for _, recipients := range [][]string{
+		{"pgp:recovery@example.com"},
+		{"provider:vault"},
+		{"jwe:" + filepath.Join(t.TempDir(), "missing.pem")},
+		{"jwe"},
+	} {
+		if _, err := New(recipients); err == nil {
+			t.Fatalf("expected %v to be rejected", recipients)
+		}
+	}
+	if _, err := New([]string{"jwe:" + pubFile, "kmip:kmip.example.com:5696/recovery"}); err != nil {
+		t.Fatal(err)
+	}
+}
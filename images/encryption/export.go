@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptedLayers returns the encrypted layers of the manifests of the image
+// for the platforms matched by platform, or of all manifests if it is nil.
+// Manifests that are not available locally are skipped.
+func EncryptedLayers(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, platform platforms.Matcher) ([]ocispec.Descriptor, error) {
+	var encrypted []ocispec.Descriptor
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if IsEncryptedDiff(ctx, desc.MediaType) {
+			encrypted = append(encrypted, desc)
+			return nil, nil
+		}
+		children, err := images.Children(ctx, cs, desc)
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return children, err
+	})
+	var h images.Handler = handler
+	if platform != nil {
+		h = images.FilterPlatforms(handler, platform)
+	}
+	if err := images.Walk(ctx, h, desc); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// CheckDockerExport returns an EncryptedLayerError if the image has encrypted
+// layers for the platforms matched by platform. The manifest.json of Docker
+// archives lists the layers as plain tar files, so Docker would load the
+// encrypted layers as corrupt layers; OCI archives describe them correctly.
+func CheckDockerExport(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, platform platforms.Matcher) error {
+	encrypted, err := EncryptedLayers(ctx, cs, desc, platform)
+	if err != nil {
+		return err
+	}
+	if len(encrypted) > 0 {
+		return &EncryptedLayerError{
+			Op:        "export Docker manifest",
+			Digest:    encrypted[0].Digest,
+			MediaType: encrypted[0].MediaType,
+			Reason:    "Docker cannot load encrypted layers",
+		}
+	}
+	return nil
+}
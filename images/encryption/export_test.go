@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckDockerExport(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+	if err := CheckDockerExport(ctx, cs, manifest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ecc, _ := testutil.CryptoConfigs(t)
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, func(ocispec.Descriptor) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckDockerExport(ctx, cs, encrypted, nil)
+	var ele *EncryptedLayerError
+	if !errors.Is(err, ErrEncryptedLayer) || !errors.As(err, &ele) || !IsEncryptedDiff(ctx, ele.MediaType) {
+		t.Fatalf("expected an EncryptedLayerError, got %v", err)
+	}
+}
+
+func TestWithEncryptedLayerCheck(t *testing.T) {
+	ctx := context.Background()
+	desc := ocispec.Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted", Digest: "sha256:0123"}
+	var c diff.ApplyConfig
+	if err := WithEncryptedLayerCheck()(ctx, desc, &c); !errors.Is(err, ErrEncryptedLayer) {
+		t.Fatalf("expected an encrypted layer without keys to be refused, got %v", err)
+	}
+	if err := WithDecryptedUnpack(&imgcrypt.Payload{})(ctx, desc, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithEncryptedLayerCheck()(ctx, desc, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithEncryptedLayerCheck()(ctx, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip}, &diff.ApplyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
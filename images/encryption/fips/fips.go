@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fips implements the FIPS mode, in which image layers are only
+// encrypted and decrypted with FIPS 140 approved algorithms: AES-256-CTR with
+// HMAC-SHA256 for the layer data and RSA-OAEP with SHA-256 or ECDH on the
+// P-256 and P-384 curves for wrapping layer keys. Wrap schemes using other
+// algorithms are refused.
+//
+// The mode is enabled by building with the fips tag, by setting IMGCRYPT_FIPS
+// to true or by calling Enable. It only restricts the algorithms imgcrypt
+// chooses; compliance still requires a validated cryptographic module, such
+// as a Go toolchain built with BoringCrypto.
+package fips
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// EnvVar enables the FIPS mode if set to true
+const EnvVar = "IMGCRYPT_FIPS"
+
+// ErrNotApproved is wrapped by the errors about algorithms and keys that are
+// not FIPS approved
+var ErrNotApproved = errors.New("not FIPS approved")
+
+var enabled atomic.Bool
+
+// Enable enables the FIPS mode for the rest of the process
+func Enable() {
+	enabled.Store(true)
+}
+
+// Enabled returns whether the FIPS mode is enabled
+func Enabled() bool {
+	if buildTag || enabled.Load() {
+		return true
+	}
+	on, _ := strconv.ParseBool(os.Getenv(EnvVar))
+	return on
+}
+
+// Mode describes the FIPS mode for diagnostics
+func Mode() string {
+	switch {
+	case buildTag:
+		return "enabled by build"
+	case Enabled():
+		return "enabled"
+	default:
+		return "disabled"
+	}
+}
+
+// CheckScheme returns an error if the wrap scheme cannot be used in FIPS mode.
+// Keyproviders and KMIP servers wrap layer keys themselves and must be
+// validated on their own.
+func CheckScheme(scheme string) error {
+	switch {
+	case scheme == "jwe", scheme == "pkcs11", scheme == "kmip", strings.HasPrefix(scheme, "provider."):
+		return nil
+	}
+	return fmt.Errorf("wrap scheme %s is %w", scheme, ErrNotApproved)
+}
+
+// CheckPublicKey returns an error if layer keys must not be wrapped for the
+// key in FIPS mode, which allows RSA keys of at least 2048 bits and EC keys
+// on the P-256 and P-384 curves
+func CheckPublicKey(key crypto.PublicKey) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA keys of %d bits are %w", k.N.BitLen(), ErrNotApproved)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() {
+			return fmt.Errorf("EC keys on curve %s are %w", k.Curve.Params().Name, ErrNotApproved)
+		}
+		return nil
+	}
+	return fmt.Errorf("keys of type %T are %w", key, ErrNotApproved)
+}
+
+// CheckCipher returns an error if layers encrypted with the cipher, as named
+// in their public options, cannot be decrypted in FIPS mode
+func CheckCipher(cipher string) error {
+	if cipher != "AES_256_CTR_HMAC_SHA256" {
+		return fmt.Errorf("layer cipher %s is %w", cipher, ErrNotApproved)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fips
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+func TestCheckPublicKey(t *testing.T) {
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPublicKey(&rsa2048.PublicKey); err != nil {
+		t.Error(err)
+	}
+	if err := CheckPublicKey(&p384.PublicKey); err != nil {
+		t.Error(err)
+	}
+	for _, key := range []interface{}{&rsa1024.PublicKey, &p521.PublicKey} {
+		if err := CheckPublicKey(key); !errors.Is(err, ErrNotApproved) {
+			t.Errorf("%T: expected key to be refused, got %v", key, err)
+		}
+	}
+
+	for scheme, approved := range map[string]bool{"jwe": true, "pkcs11": true, "provider.kms": true, "pgp": false, "pkcs7": false} {
+		if err := CheckScheme(scheme); (err == nil) != approved {
+			t.Errorf("%s: unexpected %v", scheme, err)
+		}
+	}
+	if CheckCipher("AES_256_CTR_HMAC_SHA256") != nil || CheckCipher("SM4_128_CTR_HMAC_SM3") == nil {
+		t.Error("expected only AES to be approved")
+	}
+}
+
+func TestJWE(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	wrapped, err := wrapJWE([][]byte{pubPEM}, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWrappedKey("jwe", wrapped); err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := jose.ParseEncrypted(string(wrapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := jwe.Decrypt(key); err != nil || !bytes.Equal(plaintext, []byte("layer key")) {
+		t.Fatalf("got %q, %v", plaintext, err)
+	}
+
+	// a recipient wrapped with RSA-OAEP, which uses sha1, is dropped
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, []jose.Recipient{
+		{Algorithm: jose.RSA_OAEP, Key: &other.PublicKey},
+		{Algorithm: jose.RSA_OAEP_256, Key: &key.PublicKey},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := encrypter.Encrypt([]byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err := approvedJWE([]byte(obj.FullSerialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Recipients []json.RawMessage `json:"recipients"`
+	}
+	if err := json.Unmarshal(approved, &parsed); err != nil || len(parsed.Recipients) != 1 {
+		t.Fatalf("expected 1 recipient, got %d, %v", len(parsed.Recipients), err)
+	}
+	if jwe, err = jose.ParseEncrypted(string(approved)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, plaintext, err := jwe.DecryptMulti(key); err != nil || !bytes.Equal(plaintext, []byte("layer key")) {
+		t.Fatalf("got %q, %v", plaintext, err)
+	}
+
+	encrypter, err = jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: &key.PublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj, err = encrypter.Encrypt([]byte("layer key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWrappedKey("jwe", []byte(obj.FullSerialize())); !errors.Is(err, ErrNotApproved) {
+		t.Fatalf("expected RSA-OAEP to be refused, got %v", err)
+	}
+}
+
+func TestPkcs11Blob(t *testing.T) {
+	blob := []byte(`{"version":0,"recipients":[{"version":0,"blob":"AAAA"},{"version":0,"blob":"BBBB","hash":"sha256"}]}`)
+	approved, err := approvedPkcs11Blob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed pkcs11Blob
+	if err := json.Unmarshal(approved, &parsed); err != nil || len(parsed.Recipients) != 1 || parsed.Recipients[0].Blob != "BBBB" {
+		t.Fatalf("unexpected blob %s, %v", approved, err)
+	}
+	if err := CheckWrappedKey("pkcs11", []byte(`{"version":0,"recipients":[{"version":0,"blob":"AAAA","hash":"sha1"}]}`)); !errors.Is(err, ErrNotApproved) {
+		t.Fatalf("expected sha1 to be refused, got %v", err)
+	}
+	if err := CheckWrappedKey("pgp", []byte("packet")); !errors.Is(err, ErrNotApproved) {
+		t.Fatalf("expected pgp to be refused, got %v", err)
+	}
+}
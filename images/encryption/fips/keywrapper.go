@@ -0,0 +1,301 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fips
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+// guardedSchemes are the schemes of the key wrappers that are restricted in
+// FIPS mode, with the parameters holding their recipients
+var guardedSchemes = map[string][]string{
+	"jwe":    {"pubkeys"},
+	"pkcs11": {"pkcs11-pubkeys", "pkcs11-yamls"},
+	"pkcs7":  {"x509s"},
+	"pgp":    {"gpg-recipients"},
+
+	hybrid.Scheme: {hybrid.ParameterPublicKeys},
+}
+
+// keyWrapper restricts a key wrapper to FIPS approved algorithms while the
+// FIPS mode is enabled
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers registered with ocicrypt so that they are
+// restricted to FIPS approved algorithms while the FIPS mode is enabled. It
+// must be called after the other key wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for scheme := range guardedSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	if !Enabled() {
+		return kw.KeyWrapper.WrapKeys(ec, optsData)
+	}
+	switch kw.scheme {
+	case "jwe":
+		return wrapJWE(ec.Parameters["pubkeys"], optsData)
+	case "pkcs11":
+		if strings.EqualFold(os.Getenv("OCICRYPT_OAEP_HASHALG"), "sha1") {
+			return nil, fmt.Errorf("RSA-OAEP with sha1 is %w", ErrNotApproved)
+		}
+		for _, data := range ec.Parameters["pkcs11-pubkeys"] {
+			key, err := encutils.ParsePublicKey(data, "PKCS11")
+			if err != nil {
+				return nil, err
+			}
+			if err := CheckPublicKey(key); err != nil {
+				return nil, err
+			}
+		}
+		return kw.KeyWrapper.WrapKeys(ec, optsData)
+	}
+	for _, param := range guardedSchemes[kw.scheme] {
+		if len(ec.Parameters[param]) > 0 {
+			return nil, CheckScheme(kw.scheme)
+		}
+	}
+	return nil, nil
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, wrapped []byte) ([]byte, error) {
+	if !Enabled() {
+		return kw.KeyWrapper.UnwrapKey(dc, wrapped)
+	}
+	approved, err := approvedWrappedKey(kw.scheme, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return kw.KeyWrapper.UnwrapKey(dc, approved)
+}
+
+// CheckWrappedKey returns an error if the layer key wrapped with the scheme
+// cannot be unwrapped in FIPS mode
+func CheckWrappedKey(scheme string, wrapped []byte) error {
+	_, err := approvedWrappedKey(scheme, wrapped)
+	return err
+}
+
+// approvedWrappedKey returns the wrapped layer key reduced to the recipients
+// whose keys are wrapped with FIPS approved algorithms
+func approvedWrappedKey(scheme string, wrapped []byte) ([]byte, error) {
+	if err := CheckScheme(scheme); err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "jwe":
+		return approvedJWE(wrapped)
+	case "pkcs11":
+		return approvedPkcs11Blob(wrapped)
+	}
+	return wrapped, nil
+}
+
+// wrapJWE wraps the layer key like ocicrypt, but with RSA-OAEP-256 instead of
+// RSA-OAEP, which uses sha1
+func wrapJWE(pubKeys [][]byte, optsData []byte) ([]byte, error) {
+	var recipients []jose.Recipient
+	for _, data := range pubKeys {
+		key, err := encutils.ParsePublicKey(data, "JWE")
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckPublicKey(key); err != nil {
+			return nil, err
+		}
+		alg := jose.RSA_OAEP_256
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			alg = jose.ECDH_ES_A256KW
+		} else if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("keys of type %T are %w", key, ErrNotApproved)
+		}
+		recipients = append(recipients, jose.Recipient{Algorithm: alg, Key: key})
+	}
+	// no recipients is not an error
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, recipients, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jose.NewMultiEncrypter failed: %w", err)
+	}
+	jwe, err := encrypter.Encrypt(optsData)
+	if err != nil {
+		return nil, fmt.Errorf("JWE Encrypt failed: %w", err)
+	}
+	return []byte(jwe.FullSerialize()), nil
+}
+
+// jweHeader holds the header parameters of a JWE that select its algorithms
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Epk *struct {
+		Crv string `json:"crv"`
+	} `json:"epk,omitempty"`
+}
+
+func (h *jweHeader) merge(other jweHeader) {
+	if h.Alg == "" {
+		h.Alg = other.Alg
+	}
+	if h.Enc == "" {
+		h.Enc = other.Enc
+	}
+	if h.Epk == nil {
+		h.Epk = other.Epk
+	}
+}
+
+func (h *jweHeader) approved() bool {
+	switch h.Alg {
+	case "RSA-OAEP-256":
+		return true
+	case "ECDH-ES+A256KW":
+		return h.Epk != nil && (h.Epk.Crv == "P-256" || h.Epk.Crv == "P-384")
+	}
+	return false
+}
+
+// approvedJWE returns the JSON serialized JWE without the recipients whose
+// keys are not wrapped with FIPS approved algorithms
+func approvedJWE(data []byte) ([]byte, error) {
+	var jwe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return nil, fmt.Errorf("could not parse JWE: %w", err)
+	}
+	var shared jweHeader
+	if raw, ok := jwe["protected"]; ok {
+		var b64 string
+		if err := json.Unmarshal(raw, &b64); err != nil {
+			return nil, fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+		protected, err := base64.RawURLEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode protected header of JWE: %w", err)
+		}
+		if err := json.Unmarshal(protected, &shared); err != nil {
+			return nil, fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+	}
+	if raw, ok := jwe["unprotected"]; ok {
+		var unprotected jweHeader
+		if err := json.Unmarshal(raw, &unprotected); err != nil {
+			return nil, fmt.Errorf("could not parse unprotected header of JWE: %w", err)
+		}
+		shared.merge(unprotected)
+	}
+	if shared.Enc != "A256GCM" {
+		return nil, fmt.Errorf("JWE content encryption %s is %w", shared.Enc, ErrNotApproved)
+	}
+
+	recipientHeader := func(raw json.RawMessage) jweHeader {
+		var h jweHeader
+		if raw != nil {
+			_ = json.Unmarshal(raw, &h)
+		}
+		h.merge(shared)
+		return h
+	}
+
+	raw, ok := jwe["recipients"]
+	if !ok {
+		// flattened serialization with a single recipient
+		if h := recipientHeader(jwe["header"]); !h.approved() {
+			return nil, fmt.Errorf("JWE key wrapping %s is %w", h.Alg, ErrNotApproved)
+		}
+		return data, nil
+	}
+	var recipients, approved []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &recipients); err != nil {
+		return nil, fmt.Errorf("could not parse recipients of JWE: %w", err)
+	}
+	for _, r := range recipients {
+		if h := recipientHeader(r["header"]); h.approved() {
+			approved = append(approved, r)
+		}
+	}
+	if len(approved) == 0 {
+		return nil, fmt.Errorf("the key wrapping of all JWE recipients is %w", ErrNotApproved)
+	}
+	if len(approved) == len(recipients) {
+		return data, nil
+	}
+	var err error
+	if jwe["recipients"], err = json.Marshal(approved); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jwe)
+}
+
+// pkcs11Blob is the JSON format of layer keys wrapped with the pkcs11 scheme
+type pkcs11Blob struct {
+	Version    uint `json:"version"`
+	Recipients []struct {
+		Version uint   `json:"version"`
+		Blob    string `json:"blob"`
+		Hash    string `json:"hash,omitempty"`
+	} `json:"recipients"`
+}
+
+// approvedPkcs11Blob returns the pkcs11 blob without the recipients whose
+// keys are wrapped with RSA-OAEP with sha1, which an empty hash stands for
+func approvedPkcs11Blob(data []byte) ([]byte, error) {
+	var blob pkcs11Blob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("could not parse pkcs11 blob: %w", err)
+	}
+	recipients := blob.Recipients[:0]
+	for _, r := range blob.Recipients {
+		if r.Hash == "sha256" {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("RSA-OAEP with sha1 is %w", ErrNotApproved)
+	}
+	if len(recipients) == len(blob.Recipients) {
+		return data, nil
+	}
+	blob.Recipients = recipients
+	return json.Marshal(&blob)
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// LabelPlaintextSource is set on an encrypted layer blob and holds the digest
+	// of the plaintext layer it was created from
+	LabelPlaintextSource = "io.containerd.imgcrypt.plaintext"
+	// LabelEncryptedSource is set on a decrypted layer blob and holds the digest
+	// of the encrypted layer it was created from
+	LabelEncryptedSource = "io.containerd.imgcrypt.encrypted"
+)
+
+// ReferencedBlobs returns the digests of all blobs that are referenced by any image
+// in the image store. Blobs that are referenced but not locally available, such as
+// those of platforms that were not pulled, are included as well.
+func ReferencedBlobs(ctx context.Context, cs content.Store, is images.Store) (map[digest.Digest]struct{}, error) {
+	imgs, err := is.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[digest.Digest]struct{}{}
+	for _, img := range imgs {
+		dgsts, err := imageBlobs(ctx, cs, img.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk image %s: %w", img.Name, err)
+		}
+		for _, d := range dgsts {
+			refs[d] = struct{}{}
+		}
+	}
+	return refs, nil
+}
+
+// imageBlobs returns the digests of all blobs referenced from the given descriptor
+func imageBlobs(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		dgsts = append(dgsts, desc.Digest)
+		children, err := images.Children(ctx, cs, desc)
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return children, err
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, err
+	}
+	return dgsts, nil
+}
+
+// PlaintextBlobs returns the digests of the locally available plaintext layers that
+// the encrypted layers of the given image were created from
+func PlaintextBlobs(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]digest.Digest, error) {
+	return sourceBlobs(ctx, cs, desc, LabelPlaintextSource)
+}
+
+// OrphanedDecryptedBlobs returns the digests of the decrypted layers whose encrypted
+// parent layer no longer exists in the content store
+func OrphanedDecryptedBlobs(ctx context.Context, cs content.Store) ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	err := cs.Walk(ctx, func(info content.Info) error {
+		source, err := digest.Parse(info.Labels[LabelEncryptedSource])
+		if err != nil {
+			return nil
+		}
+		if _, err := cs.Info(ctx, source); err != nil {
+			if errdefs.IsNotFound(err) {
+				dgsts = append(dgsts, info.Digest)
+				return nil
+			}
+			return err
+		}
+		return nil
+	}, fmt.Sprintf("labels.%q", LabelEncryptedSource))
+	if err != nil {
+		return nil, err
+	}
+	return dgsts, nil
+}
+
+// sourceBlobs collects the source digests recorded in the given label on the layers
+// of an image, skipping sources that are not locally available
+func sourceBlobs(ctx context.Context, cs content.Store, desc ocispec.Descriptor, label string) ([]digest.Digest, error) {
+	dgsts, err := imageBlobs(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var sources []digest.Digest
+	for _, d := range dgsts {
+		info, err := cs.Info(ctx, d)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		source, err := digest.Parse(info.Labels[label])
+		if err != nil {
+			continue
+		}
+		if _, err := cs.Info(ctx, source); err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// GarbageCollector runs the garbage collection of a content store, which
+// deletes the blobs that are neither referenced by an image or other content
+// nor held by a lease
+type GarbageCollector func(ctx context.Context) error
+
+// LeaseGarbageCollector returns a GarbageCollector that has containerd collect
+// garbage by synchronously deleting a new lease
+func LeaseGarbageCollector(lm leases.Manager) GarbageCollector {
+	return func(ctx context.Context) error {
+		l, err := lm.Create(ctx, leases.WithRandomID(), leases.WithExpiration(time.Hour))
+		if err != nil {
+			return err
+		}
+		return lm.Delete(ctx, l, leases.SynchronousDelete)
+	}
+}
+
+// DeleteImageResidue deletes the blobs reachable from the given image target, typically
+// the target an image had before it was encrypted, that are no longer referenced by any
+// image. It returns the digests of the deleted blobs.
+func DeleteImageResidue(ctx context.Context, cs content.Store, gc GarbageCollector, desc ocispec.Descriptor) ([]digest.Digest, error) {
+	dgsts, err := imageBlobs(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	return DeleteUnreferencedBlobs(ctx, cs, gc, dgsts)
+}
+
+// DeleteUnreferencedBlobs deletes those of the given blobs from the content store that
+// are not referenced by any image. The blobs are left to the garbage collection, which
+// checks their references and deletes them atomically, so that blobs of images that are
+// created or pulled meanwhile are kept; other garbage is collected as well. It returns
+// the digests of the deleted blobs.
+func DeleteUnreferencedBlobs(ctx context.Context, cs content.Store, gc GarbageCollector, dgsts []digest.Digest) ([]digest.Digest, error) {
+	var present []digest.Digest
+	seen := map[digest.Digest]struct{}{}
+	for _, d := range dgsts {
+		if _, ok := seen[d]; ok {
+			continue
+		}
+		seen[d] = struct{}{}
+		if _, err := cs.Info(ctx, d); err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		present = append(present, d)
+	}
+	if len(present) == 0 {
+		return nil, nil
+	}
+	if err := gc(ctx); err != nil {
+		return nil, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+	var deleted []digest.Digest
+	for _, d := range present {
+		if _, err := cs.Info(ctx, d); err != nil {
+			if errdefs.IsNotFound(err) {
+				deleted = append(deleted, d)
+				continue
+			}
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
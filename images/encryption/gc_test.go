@@ -0,0 +1,270 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/imgcrypt/internal/contentutil"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newMetadataDB returns a namespaced context with a new containerd metadata
+// database and its garbage collection
+func newMetadataDB(t *testing.T) (context.Context, *metadata.DB, GarbageCollector) {
+	t.Helper()
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb, err := bolt.Open(filepath.Join(t.TempDir(), "meta.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bdb.Close() })
+	db := metadata.NewDB(bdb, cs, nil)
+	if err := db.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	gc := func(ctx context.Context) error {
+		_, err := db.GarbageCollect(ctx)
+		return err
+	}
+	return ctx, db, gc
+}
+
+// writeTestManifest writes a manifest with the given config and layers and
+// the labels by which the garbage collection of containerd finds them
+func writeTestManifest(t *testing.T, cs content.Ingester, config ocispec.Descriptor, layers ...ocispec.Descriptor) ocispec.Descriptor {
+	t.Helper()
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"containerd.io/gc.ref.content.0": config.Digest.String()}
+	for i, l := range layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i+1)] = l.Digest.String()
+	}
+	desc, err := contentutil.WriteBlob(namespaces.WithNamespace(context.Background(), "default"), cs, ocispec.MediaTypeImageManifest, mb, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func sortedDigests(dgsts []digest.Digest) []digest.Digest {
+	sorted := append([]digest.Digest{}, dgsts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func equalDigests(a, b []digest.Digest) bool {
+	a, b = sortedDigests(a), sortedDigests(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDeleteUnreferencedBlobs(t *testing.T) {
+	ctx, db, gc := newMetadataDB(t)
+	cs, is := db.ContentStore(), metadata.NewImageStore(db)
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	shared := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("shared layer"))
+	own := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("own layer"))
+	other := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("other layer"))
+	// a layer of the other image that was never pulled
+	missing := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("missing layer"), Size: 13}
+	residue := writeTestManifest(t, cs, config, shared, own)
+	kept := writeTestManifest(t, cs, config, shared, other, missing)
+	if _, err := is.Create(ctx, images.Image{Name: "kept", Target: kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := ReferencedBlobs(ctx, cs, is)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []digest.Digest{kept.Digest, config.Digest, shared.Digest, other.Digest, missing.Digest} {
+		if _, ok := refs[d]; !ok {
+			t.Fatalf("expected %s to be referenced", d)
+		}
+	}
+	if _, ok := refs[own.Digest]; ok {
+		t.Fatal("expected the layer of the residue not to be referenced")
+	}
+
+	candidates := []digest.Digest{residue.Digest, config.Digest, shared.Digest, own.Digest, own.Digest, missing.Digest}
+	deleted, err := DeleteUnreferencedBlobs(ctx, cs, gc, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalDigests(deleted, []digest.Digest{residue.Digest, own.Digest}) {
+		t.Fatalf("expected only the manifest and the own layer of the residue to be deleted, got %v", deleted)
+	}
+	for _, d := range []digest.Digest{kept.Digest, config.Digest, shared.Digest, other.Digest} {
+		if _, err := cs.Info(ctx, d); err != nil {
+			t.Fatalf("expected %s to be kept: %v", d, err)
+		}
+	}
+
+	// deleting again finds nothing left to delete
+	deleted, err = DeleteUnreferencedBlobs(ctx, cs, gc, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("expected nothing to be deleted, got %v", deleted)
+	}
+}
+
+func TestDeleteUnreferencedBlobsLease(t *testing.T) {
+	ctx, db, gc := newMetadataDB(t)
+	cs, lm := db.ContentStore(), metadata.NewLeaseManager(db)
+	// a blob that is being pulled for an image that is not created yet is
+	// held by the lease of the pull
+	l, err := lm.Create(ctx, leases.WithRandomID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("pulled layer"))
+	if err := lm.AddResource(ctx, l, leases.Resource{ID: pulled.Digest.String(), Type: "content"}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := DeleteUnreferencedBlobs(ctx, cs, gc, []digest.Digest{pulled.Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("expected the leased blob to be kept, got %v", deleted)
+	}
+}
+
+func TestPlaintextBlobs(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), labelStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	plain := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("plaintext layer"))
+	encrypted := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer+"+encrypted", []byte("encrypted layer"))
+	gone := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer+"+encrypted", []byte("encrypted layer of a deleted plaintext"))
+	decrypted := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("decrypted layer"))
+	orphan := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("decrypted layer of a deleted encrypted layer"))
+	label := func(desc ocispec.Descriptor, key string, source digest.Digest) {
+		t.Helper()
+		info := content.Info{Digest: desc.Digest, Labels: map[string]string{key: source.String()}}
+		if _, err := cs.Update(ctx, info, "labels."+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	label(encrypted, LabelPlaintextSource, plain.Digest)
+	label(gone, LabelPlaintextSource, digest.FromString("deleted plaintext"))
+	label(decrypted, LabelEncryptedSource, encrypted.Digest)
+	label(orphan, LabelEncryptedSource, digest.FromString("deleted encrypted layer"))
+	manifest := writeTestManifest(t, cs, config, encrypted, gone)
+
+	dgsts, err := PlaintextBlobs(ctx, cs, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalDigests(dgsts, []digest.Digest{plain.Digest}) {
+		t.Fatalf("expected the available plaintext layer, got %v", dgsts)
+	}
+
+	dgsts, err = OrphanedDecryptedBlobs(ctx, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalDigests(dgsts, []digest.Digest{orphan.Digest}) {
+		t.Fatalf("expected the orphaned decrypted layer, got %v", dgsts)
+	}
+}
+
+func TestDeleteImageResidue(t *testing.T) {
+	ctx, db, gc := newMetadataDB(t)
+	cs, is := db.ContentStore(), metadata.NewImageStore(db)
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	base := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("base layer"))
+	app := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("app layer"))
+	baseManifest := writeTestManifest(t, cs, config, base)
+	orig := writeTestManifest(t, cs, config, base, app)
+
+	// the image is replaced by its encrypted version, the base image it was
+	// built on is still there
+	ecc, _ := testutil.CryptoConfigs(t)
+	onlyApp := func(desc ocispec.Descriptor) bool { return desc.Digest == app.Digest }
+	encrypted, _, err := EncryptImage(ctx, cs, orig, &ecc, onlyApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range []images.Image{{Name: "base", Target: baseManifest}, {Name: "app", Target: encrypted}} {
+		if _, err := is.Create(ctx, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := DeleteImageResidue(ctx, cs, gc, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalDigests(deleted, []digest.Digest{orig.Digest, app.Digest}) {
+		t.Fatalf("expected only the plaintext manifest and app layer to be deleted, got %v", deleted)
+	}
+	for _, d := range []digest.Digest{base.Digest, baseManifest.Digest} {
+		if _, err := cs.Info(ctx, d); err != nil {
+			t.Fatalf("expected %s, which is still referenced, to be kept: %v", d, err)
+		}
+	}
+	dgsts, err := imageBlobs(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dgsts {
+		if _, err := cs.Info(ctx, d); err != nil {
+			t.Fatalf("expected the blobs of the encrypted image to be kept: %v", err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package gpgagent unwraps PGP wrapped layer keys by handing the PGP packets
+// to gpg, so that the private key operation is done by gpg-agent. This allows
+// using keys that cannot be exported from the keyring, such as keys held on
+// OpenPGP smartcards or YubiKeys.
+package gpgagent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/gpgclient"
+	"github.com/containerd/imgcrypt/images/encryption/pgpcache"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// ParameterName is the DecryptConfig parameter holding the GnuPG home
+// directories whose gpg-agent is used; an empty directory stands for the
+// default one
+const ParameterName = "gpg-agent-homedirs"
+
+// PassphraseParameterName is the DecryptConfig parameter holding the
+// passphrases given to gpg with loopback pinentry for the home directories
+// of ParameterName at the same index
+const PassphraseParameterName = "gpg-agent-passphrases"
+
+// Program is the gpg binary that is run
+var Program = "gpg"
+
+// Timeout limits the time a single decryption may take, including the time
+// the user needs to enter the PIN of a smartcard
+var Timeout = 2 * time.Minute
+
+// UnwrapKey has gpg decrypt the PGP packet of a layer key with the keys
+// available to the gpg-agent of homedir
+func UnwrapKey(ctx context.Context, homedir string, packet []byte) ([]byte, error) {
+	return UnwrapKeyWithPassphrase(ctx, homedir, packet, nil)
+}
+
+// UnwrapKeyWithPassphrase is UnwrapKey with the passphrase of the key given
+// to gpg through loopback pinentry instead of having gpg-agent ask for it; a
+// nil passphrase leaves it to gpg-agent
+func UnwrapKeyWithPassphrase(ctx context.Context, homedir string, packet, passphrase []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	// not --quiet, which hides the reason decrypting the key failed for
+	args := []string{"--batch", "--no-tty"}
+	if homedir != "" {
+		args = append(args, "--homedir", homedir)
+	}
+	var extraFiles []*os.File
+	if passphrase != nil {
+		rfile, wfile, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("could not create pipe: %w", err)
+		}
+		defer rfile.Close()
+		go func() {
+			_, _ = wfile.Write(passphrase)
+			wfile.Close()
+		}()
+		extraFiles = []*os.File{rfile}
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-fd", "3")
+	}
+	args = append(args, "--decrypt")
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, Program, args...)
+	cmd.Stdin = bytes.NewReader(packet)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = extraFiles
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg failed to decrypt key: %w", gpgclient.NewError(Program, args, stderr.String(), err))
+	}
+	return stdout.Bytes(), nil
+}
+
+// WithAgent adds the gpg-agent of homedir, or of the default home directory
+// if it is empty, to the DecryptConfig
+func WithAgent(dc *encconfig.DecryptConfig, homedir string) {
+	withAgent(dc, homedir, nil)
+}
+
+// WithAgentPassphrase adds the gpg-agent of homedir to the DecryptConfig like
+// WithAgent and has gpg unprotect the key with the passphrase through
+// loopback pinentry, so that no pinentry is shown and the agent need not have
+// the passphrase cached
+func WithAgentPassphrase(dc *encconfig.DecryptConfig, homedir string, passphrase []byte) {
+	if passphrase == nil {
+		passphrase = []byte{}
+	}
+	withAgent(dc, homedir, passphrase)
+}
+
+func withAgent(dc *encconfig.DecryptConfig, homedir string, passphrase []byte) {
+	if dc.Parameters == nil {
+		dc.Parameters = make(map[string][][]byte)
+	}
+	passphrases := dc.Parameters[PassphraseParameterName]
+	if passphrase != nil || len(passphrases) > 0 {
+		// the passphrases are those of the home directories at the same
+		// index; nil stands for none
+		for len(passphrases) < len(dc.Parameters[ParameterName]) {
+			passphrases = append(passphrases, nil)
+		}
+		dc.Parameters[PassphraseParameterName] = append(passphrases, passphrase)
+	}
+	dc.Parameters[ParameterName] = append(dc.Parameters[ParameterName], []byte(homedir))
+}
+
+// passphrase returns the passphrase of the gpg-agent at index i of the
+// DecryptConfig, or nil if it has none
+func passphrase(dcparameters map[string][][]byte, i int) []byte {
+	if passphrases := dcparameters[PassphraseParameterName]; i < len(passphrases) {
+		return passphrases[i]
+	}
+	return nil
+}
+
+// ReadPassphraseSource reads a passphrase from src, which is either
+// file:<absolute path> or env:<variable>, like the pin-source attribute of
+// pkcs11 URIs
+func ReadPassphraseSource(src string) ([]byte, error) {
+	scheme, value, ok := strings.Cut(src, ":")
+	if !ok {
+		scheme, value = "file", src
+	}
+	switch scheme {
+	case "env":
+		passphrase, ok := os.LookupEnv(value)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", value)
+		}
+		return []byte(passphrase), nil
+	case "file":
+		if !filepath.IsAbs(value) {
+			return nil, fmt.Errorf("passphrase file %s is not an absolute path", value)
+		}
+		passphrase, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase file: %w", err)
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	default:
+		return nil, fmt.Errorf("unsupported passphrase source %q: expected file:<path> or env:<variable>", src)
+	}
+}
+
+// keyWrapper tries the private keys passed to the PGP key wrapper before
+// the gpg-agents of the DecryptConfig
+type keyWrapper struct {
+	keywrap.KeyWrapper
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, packet []byte) ([]byte, error) {
+	var errs unwrapErrors
+	if !kw.KeyWrapper.NoPossibleKeys(dc.Parameters) {
+		optsData, err := kw.KeyWrapper.UnwrapKey(dc, packet)
+		if err == nil {
+			return optsData, nil
+		}
+		errs = append(errs, err)
+	}
+	for i, homedir := range dc.Parameters[ParameterName] {
+		optsData, err := UnwrapKeyWithPassphrase(context.Background(), string(homedir), packet, passphrase(dc.Parameters, i))
+		if err == nil {
+			return optsData, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no PGP private key or gpg-agent configured")
+	}
+	return nil, errs
+}
+
+// unwrapErrors are the errors of the attempts to unwrap a key
+type unwrapErrors []error
+
+func (e unwrapErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e unwrapErrors) Unwrap() []error {
+	return e
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(dcparameters[ParameterName]) == 0 && kw.KeyWrapper.NoPossibleKeys(dcparameters)
+}
+
+var installOnce sync.Once
+
+// Install registers the gpg-agent unwrapper for PGP wrapped keys with ocicrypt
+func Install() {
+	installOnce.Do(func() {
+		pgpcache.Install()
+		ocicrypt.RegisterKeyWrapper("pgp", &keyWrapper{ocicrypt.GetKeyWrapper("pgp")})
+	})
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gpgagent
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/imgcrypt/images/encryption/gpgclient"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+func TestUnwrapWithAgent(t *testing.T) {
+	if _, err := exec.LookPath(Program); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	homedir, err := os.MkdirTemp("", "gpgagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(homedir)
+	gpg := func(args ...string) []byte {
+		out, err := exec.Command(Program, append([]string{"--homedir", homedir, "--batch"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("gpg %v: %v", args, err)
+		}
+		return out
+	}
+	gpg("--passphrase", "", "--pinentry-mode", "loopback", "--quick-gen-key", "Test <test@example.com>", "rsa2048", "cert,sign,encr", "never")
+	defer exec.Command("gpgconf", "--homedir", homedir, "--kill", "gpg-agent").Run()
+	pubring := gpg("--export", "test@example.com")
+
+	ec := &encconfig.EncryptConfig{Parameters: map[string][][]byte{
+		"gpg-pubkeyringfile": {pubring},
+		"gpg-recipients":     {[]byte("test@example.com")},
+	}}
+	packet, err := ocicrypt.GetKeyWrapper("pgp").WrapKeys(ec, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Install()
+	kw := ocicrypt.GetKeyWrapper("pgp")
+	dc := &encconfig.DecryptConfig{}
+	if !kw.NoPossibleKeys(dc.Parameters) {
+		t.Fatal("expected no possible keys without gpg-agent")
+	}
+	WithAgent(dc, homedir)
+	if kw.NoPossibleKeys(dc.Parameters) {
+		t.Fatal("expected gpg-agent to be a possible key")
+	}
+	optsData, err := kw.UnwrapKey(dc, packet)
+	if err != nil || !bytes.Equal(optsData, []byte("layer key")) {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+
+	other := &encconfig.DecryptConfig{}
+	WithAgent(other, t.TempDir())
+	if _, err := kw.UnwrapKey(other, packet); err == nil {
+		t.Fatal("expected unwrapping with a gpg-agent without the key to fail")
+	}
+}
+
+func TestUnwrapWithPassphrase(t *testing.T) {
+	if _, err := exec.LookPath(Program); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	homedir, err := os.MkdirTemp("", "gpgagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(homedir)
+	gpg := func(args ...string) []byte {
+		out, err := exec.Command(Program, append([]string{"--homedir", homedir, "--batch"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("gpg %v: %v", args, err)
+		}
+		return out
+	}
+	gpg("--passphrase", "secret", "--pinentry-mode", "loopback", "--quick-gen-key", "Test <test@example.com>", "rsa2048", "cert,sign,encr", "never")
+	defer exec.Command("gpgconf", "--homedir", homedir, "--kill", "gpg-agent").Run()
+	// the agent must not have the passphrase cached from the key generation
+	if err := exec.Command("gpgconf", "--homedir", homedir, "--reload", "gpg-agent").Run(); err != nil {
+		t.Skipf("cannot reload gpg-agent: %v", err)
+	}
+	pubring := gpg("--export", "test@example.com")
+
+	ec := &encconfig.EncryptConfig{Parameters: map[string][][]byte{
+		"gpg-pubkeyringfile": {pubring},
+		"gpg-recipients":     {[]byte("test@example.com")},
+	}}
+	packet, err := ocicrypt.GetKeyWrapper("pgp").WrapKeys(ec, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Install()
+	kw := ocicrypt.GetKeyWrapper("pgp")
+	wrong := &encconfig.DecryptConfig{}
+	WithAgentPassphrase(wrong, homedir, []byte("wrong"))
+	if _, err := kw.UnwrapKey(wrong, packet); !errors.Is(err, gpgclient.ErrBadPassphrase) {
+		t.Fatalf("expected a bad passphrase, got %v", err)
+	}
+
+	dc := &encconfig.DecryptConfig{}
+	WithAgent(dc, t.TempDir())
+	WithAgentPassphrase(dc, homedir, []byte("secret"))
+	if p := dc.Parameters[PassphraseParameterName]; len(p) != 2 || p[0] != nil {
+		t.Fatalf("expected the passphrase to be that of the second home directory, got %q", p)
+	}
+	optsData, err := kw.UnwrapKey(dc, packet)
+	if err != nil || !bytes.Equal(optsData, []byte("layer key")) {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+}
+
+func TestReadPassphraseSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_GPG_PASSPHRASE", "from-env")
+	for src, expected := range map[string]string{
+		"file:" + file:            "from-file",
+		file:                      "from-file",
+		"env:TEST_GPG_PASSPHRASE": "from-env",
+	} {
+		passphrase, err := ReadPassphraseSource(src)
+		if err != nil || string(passphrase) != expected {
+			t.Fatalf("%s: got %q, %v", src, passphrase, err)
+		}
+	}
+	for _, src := range []string{"env:TEST_GPG_UNSET", "file:passphrase", "https://example.com/passphrase"} {
+		if _, err := ReadPassphraseSource(src); err == nil {
+			t.Fatalf("expected %s to be rejected", src)
+		}
+	}
+}
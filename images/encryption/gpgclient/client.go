@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gpgclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/gobars/ocicrypt"
+)
+
+// Client runs the gpg found by Detect
+type Client struct {
+	d *Detection
+}
+
+var _ ocicrypt.GPGClient = &Client{}
+
+// New returns a Client for the gpg of the requested version, which is v1, v2
+// or empty for any, using the given home directory or the default one
+func New(gpgVersion, homedir string) (*Client, error) {
+	d, err := Detect(context.Background(), gpgVersion, homedir)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{d: d}, nil
+}
+
+// Detection returns what was found about the GnuPG installation
+func (c *Client) Detection() *Detection {
+	return c.d
+}
+
+// run runs gpg with the arguments and returns its standard output, or an
+// Error classifying the failure
+func (c *Client) run(stdin []byte, extraFiles []*os.File, args ...string) ([]byte, error) {
+	if c.d.homedirArg != "" {
+		args = append([]string{"--homedir", c.d.homedirArg}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.d.Program, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = extraFiles
+	if err := cmd.Run(); err != nil {
+		return nil, NewError(c.d.Program, args, stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// GetGPGPrivateKey exports the secret key with the given key ID, unprotecting
+// it with the passphrase with GnuPG 2
+func (c *Client) GetGPGPrivateKey(keyid uint64, passphrase string) ([]byte, error) {
+	id := fmt.Sprintf("0x%x", keyid)
+	if c.d.Major < 2 {
+		return c.export(c.run(nil, nil, "--batch", "--export-secret-key", id))
+	}
+	rfile, wfile, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pipe: %w", err)
+	}
+	defer rfile.Close()
+	go func() {
+		_, _ = wfile.Write([]byte(passphrase))
+		wfile.Close()
+	}()
+	return c.export(c.run(nil, []*os.File{rfile}, "--pinentry-mode", "loopback", "--batch", "--passphrase-fd", "3", "--export-secret-key", id))
+}
+
+// export returns an error if gpg exported nothing, which it does without
+// failing if the key is not in the keyring
+func (c *Client) export(data []byte, err error) ([]byte, error) {
+	if err == nil && len(data) == 0 {
+		return nil, &Error{Program: c.d.Program, Args: []string{"--export-secret-key"}, Err: ErrNoSecretKey}
+	}
+	return data, err
+}
+
+// ReadGPGPubRingFile exports the public keys of the keyring
+func (c *Client) ReadGPGPubRingFile() ([]byte, error) {
+	return c.run(nil, nil, "--batch", "--export")
+}
+
+func (c *Client) getKeyDetails(option string, keyid uint64) ([]byte, bool, error) {
+	details, err := c.run(nil, nil, "--batch", option, fmt.Sprintf("0x%x", keyid))
+	return details, err == nil, err
+}
+
+// GetSecretKeyDetails lists the secret key with the given key ID and returns
+// whether it exists
+func (c *Client) GetSecretKeyDetails(keyid uint64) ([]byte, bool, error) {
+	return c.getKeyDetails("-K", keyid)
+}
+
+// GetKeyDetails lists the public key with the given key ID and returns
+// whether it exists
+func (c *Client) GetKeyDetails(keyid uint64) ([]byte, bool, error) {
+	return c.getKeyDetails("-k", keyid)
+}
+
+var emailPattern = regexp.MustCompile(`uid\s+\[.*\]\s.*\s<(?P<email>.+)>`)
+
+// ResolveRecipients replaces the key IDs among the recipients by the email
+// address of their keys, if they are in the keyring
+func (c *Client) ResolveRecipients(recipients []string) []string {
+	var result []string
+	for _, recipient := range recipients {
+		keyid, err := strconv.ParseUint(recipient, 0, 64)
+		if err != nil {
+			result = append(result, recipient)
+			continue
+		}
+		details, found, _ := c.GetKeyDetails(keyid)
+		m := emailPattern.FindSubmatch(details)
+		if !found || m == nil {
+			result = append(result, recipient)
+			continue
+		}
+		result = append(result, string(m[1]))
+	}
+	return result
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package gpgclient finds the gpg executable, determines its version, the
+// GnuPG home directory and the socket of its gpg-agent, and provides a
+// GPGClient for ocicrypt that runs the executable found. ocicrypt expects
+// GnuPG 2 to be installed as gpg2 and treats any gpg as GnuPG 1, so on systems
+// that install only GnuPG 2 as gpg it exports secret keys in a way that
+// fails; gpgclient handles both and classifies the failures of gpg instead of
+// returning its output as error.
+package gpgclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/pgpkeys"
+)
+
+// DetectTimeout bounds the time each gpg command run for the detection may
+// take
+var DetectTimeout = 10 * time.Second
+
+// maxSocketPath is the length of the path of a unix socket at most, which
+// gpg fails to connect to the agent beyond
+const maxSocketPath = 107
+
+// Detection is what was found about the GnuPG installation
+type Detection struct {
+	// Program is the path of the gpg executable
+	Program string
+	// Version is the version of GnuPG, such as 2.4.3
+	Version string
+	// Major and Minor are the components of Version
+	Major, Minor int
+	// Homedir is the GnuPG home directory
+	Homedir string
+	// Keyboxd is whether the public keys are kept by keyboxd, as GnuPG 2.4
+	// does by default
+	Keyboxd bool
+	// AgentSocket is the socket of the gpg-agent of the home directory;
+	// GnuPG 1 does not use one
+	AgentSocket string
+	// AgentRunning is whether a gpg-agent accepts connections on the socket;
+	// gpg starts one when needed if none is running
+	AgentRunning bool
+	// Problems are the issues found with the home directory and the agent
+	// that may make some operations fail
+	Problems []error
+
+	// homedirArg is the home directory to pass to gpg, if one was given
+	homedirArg string
+}
+
+// candidates returns the names gpg is looked up by for the version, which is
+// v1, v2 or empty for any, in the order of preference
+func candidates(gpgVersion string) ([]string, int, error) {
+	switch gpgVersion {
+	case "v1":
+		return []string{"gpg1", "gpg"}, 1, nil
+	case "v2":
+		return []string{"gpg2", "gpg"}, 2, nil
+	case "":
+		return []string{"gpg2", "gpg", "gpg1"}, 0, nil
+	}
+	return nil, 0, fmt.Errorf("unknown gpg version %q, must be v1 or v2", gpgVersion)
+}
+
+// Detect finds gpg in the requested version, which is v1, v2 or empty for
+// any with GnuPG 2 preferred, and checks the home directory, which is the
+// default one if empty, and the agent; problems that do not prevent running
+// gpg are returned as Problems of the Detection
+func Detect(ctx context.Context, gpgVersion, homedir string) (*Detection, error) {
+	names, major, err := candidates(gpgVersion)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		d        *Detection
+		mismatch []string
+	)
+	for _, name := range names {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		c, err := probe(ctx, path)
+		if err != nil {
+			continue
+		}
+		if major != 0 && c.Major != major {
+			mismatch = append(mismatch, fmt.Sprintf("%s is GnuPG %s", path, c.Version))
+			continue
+		}
+		d = c
+		break
+	}
+	if d == nil {
+		if len(mismatch) > 0 {
+			return nil, fmt.Errorf("%w: %s requested but %s", ErrVersionMismatch, gpgVersion, strings.Join(mismatch, ", "))
+		}
+		return nil, fmt.Errorf("%w in PATH: looked for %s", ErrNotFound, strings.Join(names, ", "))
+	}
+
+	if homedir != "" {
+		d.Homedir, d.homedirArg = homedir, homedir
+	} else if d.Homedir == "" {
+		if d.Homedir, err = pgpkeys.Homedir(""); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHomedir, err)
+		}
+	}
+	// gpg creates the default home directory when it is first used
+	if _, err := os.Stat(d.Homedir); d.homedirArg != "" || !errors.Is(err, os.ErrNotExist) {
+		if err := checkHomedir(d.Homedir); err != nil {
+			d.Problems = append(d.Problems, err)
+		}
+	}
+	if d.Major >= 2 {
+		d.Keyboxd = pgpkeys.UsesKeyboxd(d.Homedir)
+		d.detectAgent(ctx)
+	}
+	return d, nil
+}
+
+// probe runs gpg --version and returns the version and home directory
+func probe(ctx context.Context, path string) (*Detection, error) {
+	ctx, cancel := context.WithTimeout(ctx, DetectTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+	d := &Detection{Program: path}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for first := true; s.Scan(); first = false {
+		line := s.Text()
+		if first {
+			// gpg (GnuPG) 2.4.3
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("unexpected output of %s --version", path)
+			}
+			d.Version = fields[len(fields)-1]
+			d.Major, d.Minor, err = parseVersion(d.Version)
+			if err != nil {
+				return nil, err
+			}
+		} else if h := strings.TrimPrefix(line, "Home:"); h != line {
+			d.Homedir = strings.TrimSpace(h)
+		}
+	}
+	return d, nil
+}
+
+func parseVersion(v string) (major, minor int, err error) {
+	parts := strings.SplitN(v, ".", 3)
+	major, err = strconv.Atoi(parts[0])
+	if err == nil && len(parts) > 1 {
+		minor, err = strconv.Atoi(parts[1])
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected gpg version %q", v)
+	}
+	return major, minor, nil
+}
+
+// detectAgent determines the socket of the agent with gpgconf, or assumes the
+// default one in the home directory, and checks whether it can be connected to
+func (d *Detection) detectAgent(ctx context.Context) {
+	d.AgentSocket = filepath.Join(d.Homedir, "S.gpg-agent")
+	gpgconf := filepath.Join(filepath.Dir(d.Program), "gpgconf")
+	if _, err := os.Stat(gpgconf); err != nil {
+		gpgconf = "gpgconf"
+	}
+	args := []string{"--list-dirs", "agent-socket"}
+	if d.homedirArg != "" {
+		args = append([]string{"--homedir", d.homedirArg}, args...)
+	}
+	cctx, cancel := context.WithTimeout(ctx, DetectTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(cctx, gpgconf, args...).Output(); err == nil {
+		if s := strings.TrimSpace(string(out)); s != "" {
+			d.AgentSocket = s
+		}
+	}
+
+	if len(d.AgentSocket) > maxSocketPath {
+		d.Problems = append(d.Problems, fmt.Errorf("%w: socket name too long: %s", ErrAgent, d.AgentSocket))
+		return
+	}
+	fi, err := os.Stat(d.AgentSocket)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		d.Problems = append(d.Problems, fmt.Errorf("%w: %v", ErrAgent, err))
+		return
+	case fi.Mode()&os.ModeSocket == 0:
+		d.Problems = append(d.Problems, fmt.Errorf("%w: %s is not a socket", ErrAgent, d.AgentSocket))
+		return
+	}
+	conn, err := net.DialTimeout("unix", d.AgentSocket, DetectTimeout)
+	if err != nil {
+		d.Problems = append(d.Problems, fmt.Errorf("%w: stale socket %s: %v", ErrAgent, d.AgentSocket, err))
+		return
+	}
+	conn.Close()
+	d.AgentRunning = true
+}
+
+// Problem returns the first problem that is err, or nil
+func (d *Detection) Problem(err error) error {
+	for _, p := range d.Problems {
+		if errors.Is(p, err) {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gpgclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors gpg failures are classified as
+var (
+	// ErrNotFound is returned if no gpg executable was found
+	ErrNotFound = errors.New("no gpg executable found")
+	// ErrVersionMismatch is returned if gpg was found but not in the
+	// requested version
+	ErrVersionMismatch = errors.New("gpg is not of the requested version")
+	// ErrHomedir is returned if the GnuPG home directory does not exist or
+	// cannot be accessed
+	ErrHomedir = errors.New("GnuPG home directory is not accessible")
+	// ErrHomedirPermissions is returned if the GnuPG home directory is owned
+	// by another user or accessible by others, which gpg refuses or warns about
+	ErrHomedirPermissions = errors.New("unsafe permissions on GnuPG home directory")
+	// ErrAgent is returned if gpg cannot reach or start its gpg-agent
+	ErrAgent = errors.New("gpg-agent is not available")
+	// ErrNoSecretKey is returned if the secret key is not in the keyring
+	ErrNoSecretKey = errors.New("secret key not available")
+	// ErrBadPassphrase is returned if the passphrase of a key is wrong
+	ErrBadPassphrase = errors.New("bad passphrase")
+)
+
+// Error is a failure of running gpg
+type Error struct {
+	// Program is the gpg executable that was run
+	Program string
+	// Args are the arguments it was run with
+	Args []string
+	// Stderr is what it wrote to its standard error
+	Stderr string
+	// Err is one of the errors of this package the failure was classified
+	// as, or the error of running gpg
+	Err error
+}
+
+// NewError returns the Error of running program with args, which failed with
+// err after writing stderr, classified by what gpg wrote
+func NewError(program string, args []string, stderr string, err error) *Error {
+	return &Error{Program: program, Args: args, Stderr: stderr, Err: classify(stderr, err)}
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Program, strings.Join(e.Args, " "), e.Err)
+	if line := lastLine(e.Stderr); line != "" {
+		msg += ": " + line
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// stderrErrors map messages of gpg to the errors they are classified as; the
+// first match wins
+var stderrErrors = []struct {
+	message string
+	err     error
+}{
+	{"bad passphrase", ErrBadPassphrase},
+	{"no secret key", ErrNoSecretKey},
+	{"secret key not available", ErrNoSecretKey},
+	{"unsafe permissions on homedir", ErrHomedirPermissions},
+	{"unsafe ownership on homedir", ErrHomedirPermissions},
+	{"socket name too long", ErrAgent},
+	{"can't connect to the agent", ErrAgent},
+	{"no agent running", ErrAgent},
+	{"no gpg-agent running", ErrAgent},
+	{"connecting agent failed", ErrAgent},
+	{"problem with the agent", ErrAgent},
+	{"inappropriate ioctl for device", ErrAgent},
+	{"permission denied", ErrHomedir},
+	{"no such file or directory", ErrHomedir},
+}
+
+// classify returns the error the standard error of gpg indicates, or err
+func classify(stderr string, err error) error {
+	s := strings.ToLower(stderr)
+	for _, se := range stderrErrors {
+		if strings.Contains(s, se.message) {
+			return se.err
+		}
+	}
+	return err
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gpgclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// fakeGPG installs a gpg script of the given version into an empty PATH that
+// answers with the given stderr and exit code to anything but --version
+func fakeGPG(t *testing.T, name, version, homedir, stderr string, code int) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("gpg is faked with a shell script")
+	}
+	bin := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+case "$*" in
+*--version*) echo "gpg (GnuPG) %s"; echo "Home: %s"; exit 0;;
+esac
+printf '%%s' '%s' >&2
+exit %d
+`, version, homedir, stderr, code)
+	if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	return bin
+}
+
+func TestDetect(t *testing.T) {
+	ctx := context.Background()
+	homedir := t.TempDir()
+	if err := os.Chmod(homedir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	fakeGPG(t, "gpg", "2.4.3", homedir, "", 0)
+
+	d, err := Detect(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(d.Program) != "gpg" || d.Major != 2 || d.Minor != 4 || d.Homedir != homedir {
+		t.Fatalf("unexpected detection %+v", d)
+	}
+	if d.AgentSocket != filepath.Join(homedir, "S.gpg-agent") || d.AgentRunning || len(d.Problems) != 0 {
+		t.Fatalf("unexpected agent detection %+v", d)
+	}
+	if _, err := Detect(ctx, "v2", ""); err != nil {
+		t.Fatalf("expected gpg to be used as GnuPG 2: %v", err)
+	}
+	if _, err := Detect(ctx, "v1", ""); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected a version mismatch, got %v", err)
+	}
+	t.Setenv("PATH", t.TempDir())
+	if _, err := Detect(ctx, "", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected gpg not to be found, got %v", err)
+	}
+}
+
+func TestDetectProblems(t *testing.T) {
+	ctx := context.Background()
+	homedir := t.TempDir()
+	if err := os.Chmod(homedir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fakeGPG(t, "gpg2", "2.2.40", "", "", 0)
+
+	d, err := Detect(ctx, "", homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Problem(ErrHomedirPermissions) == nil {
+		t.Fatalf("expected the permissions of the home directory to be a problem, got %v", d.Problems)
+	}
+
+	d, err = Detect(ctx, "", filepath.Join(homedir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Problem(ErrHomedir) == nil {
+		t.Fatalf("expected the missing home directory to be a problem, got %v", d.Problems)
+	}
+
+	l, err := net.Listen("unix", filepath.Join(homedir, "S.gpg-agent"))
+	if err != nil {
+		t.Skipf("cannot listen on unix socket: %v", err)
+	}
+	d, err = Detect(ctx, "", homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.AgentRunning {
+		t.Fatalf("expected the agent to be found running, got %v", d.Problems)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	d, err = Detect(ctx, "", homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.AgentRunning || d.Problem(ErrAgent) == nil {
+		t.Fatalf("expected the stale agent socket to be a problem, got %v", d.Problems)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	homedir := t.TempDir()
+	for _, tc := range []struct {
+		stderr string
+		code   int
+		err    error
+	}{
+		{"gpg: error reading key: No secret key\n", 2, ErrNoSecretKey},
+		{"gpg: key 0x1234: error receiving key from agent: Bad passphrase - skipped\n", 2, ErrBadPassphrase},
+		{"gpg: WARNING: unsafe permissions on homedir '/x'\n", 2, ErrHomedirPermissions},
+		{"gpg: problem with the agent: No pinentry\n", 2, ErrAgent},
+		{"", 0, ErrNoSecretKey},
+	} {
+		fakeGPG(t, "gpg", "2.2.40", homedir, tc.stderr, tc.code)
+		c, err := New("", homedir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.GetGPGPrivateKey(0x1234, "secret")
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expected %v for %q, got %v", tc.err, tc.stderr, err)
+		}
+		var gerr *Error
+		if !errors.As(err, &gerr) {
+			t.Fatalf("expected a gpg error, got %T", err)
+		}
+	}
+}
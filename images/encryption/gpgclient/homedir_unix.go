@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gpgclient
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// checkHomedir checks that the home directory can be read and is neither
+// owned by another user nor accessible by others, which gpg warns about
+func checkHomedir(homedir string) error {
+	fi, err := os.Stat(homedir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrHomedir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrHomedir, homedir)
+	}
+	f, err := os.Open(homedir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrHomedir, err)
+	}
+	_, err = f.Readdirnames(1)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%w: %v", ErrHomedir, err)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%w: %s is owned by uid %d", ErrHomedirPermissions, homedir, st.Uid)
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("%w: %s has mode %#o, gpg expects 0700", ErrHomedirPermissions, homedir, perm)
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package hybrid wraps layer keys in JWEs for recipients holding a hybrid
+// X25519 and ML-KEM-768 key pair, so that the layer keys stay protected if
+// either algorithm is broken, including by a quantum computer decrypting
+// images recorded today.
+//
+// The wrapped keys are stored under their own annotation, so that decoders
+// without support for the scheme do not mistake them for classic JWEs; they
+// find no key for the layer unless it also has classic recipients.
+package hybrid
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/matched"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	josecipher "github.com/go-jose/go-jose/v3/cipher"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+const (
+	// Scheme is the name of the key wrapping scheme
+	Scheme = "jwe-hybrid"
+	// AnnotationID is the annotation holding the wrapped keys
+	AnnotationID = "org.opencontainers.image.enc.keys.jwe-hybrid"
+	// Algorithm is the JWE key management algorithm of the recipients
+	Algorithm = "X25519MLKEM768+A256KW"
+
+	// ParameterPublicKeys is the EncryptConfig parameter holding recipient keys
+	ParameterPublicKeys = "jwe-hybrid-pubkeys"
+	// ParameterPrivateKeys is the DecryptConfig parameter holding private keys
+	ParameterPrivateKeys = "jwe-hybrid-privkeys"
+
+	// PEM block types of the keys
+	publicKeyType  = "X25519 MLKEM768 PUBLIC KEY"
+	privateKeyType = "X25519 MLKEM768 PRIVATE KEY"
+
+	// a public key is the ML-KEM-768 encapsulation key followed by the
+	// X25519 public key, a private key the 64 byte ML-KEM-768 seed followed
+	// by the X25519 private key
+	publicKeySize  = 1184 + 32
+	privateKeySize = 64 + 32
+)
+
+// ErrUnsupported is returned by builds without ML-KEM support
+var ErrUnsupported = errors.New("X25519+ML-KEM-768 hybrid key wrapping requires imgcrypt to be built with Go 1.24 or later")
+
+// IsPublicKey returns whether data is a PEM encoded hybrid public key
+func IsPublicKey(data []byte) bool {
+	_, err := parseKey(data, publicKeyType, publicKeySize)
+	return err == nil
+}
+
+// IsPrivateKey returns whether data is a PEM encoded hybrid private key
+func IsPrivateKey(data []byte) bool {
+	_, err := parseKey(data, privateKeyType, privateKeySize)
+	return err == nil
+}
+
+func parseKey(data []byte, blockType string, size int) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("not a PEM encoded %s", strings.ToLower(blockType))
+	}
+	if len(block.Bytes) != size {
+		return nil, fmt.Errorf("%s has %d bytes, expected %d", strings.ToLower(blockType), len(block.Bytes), size)
+	}
+	return block.Bytes, nil
+}
+
+// keyID identifies a recipient by the digest of its public key
+func keyID(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// EncryptWithPublicKeys returns the CryptoConfig encrypting for the hybrid
+// public keys
+func EncryptWithPublicKeys(pubKeys [][]byte) encconfig.CryptoConfig {
+	return encconfig.CryptoConfig{
+		EncryptConfig: &encconfig.EncryptConfig{
+			Parameters: map[string][][]byte{
+				ParameterPublicKeys: pubKeys,
+			},
+			DecryptConfig: encconfig.DecryptConfig{},
+		},
+	}
+}
+
+// DecryptWithPrivateKeys returns the CryptoConfig decrypting with the hybrid
+// private keys
+func DecryptWithPrivateKeys(privKeys [][]byte) encconfig.CryptoConfig {
+	dc := encconfig.DecryptConfig{
+		Parameters: map[string][][]byte{
+			ParameterPrivateKeys: privKeys,
+		},
+	}
+	return encconfig.CryptoConfig{
+		EncryptConfig: &encconfig.EncryptConfig{
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}
+}
+
+// jweJSON is the general JWE JSON serialization of a wrapped key
+type jweJSON struct {
+	Protected  string         `json:"protected"`
+	Recipients []jweRecipient `json:"recipients"`
+	IV         string         `json:"iv"`
+	Ciphertext string         `json:"ciphertext"`
+	Tag        string         `json:"tag"`
+}
+
+type jweRecipient struct {
+	Header       jweHeader `json:"header"`
+	EncryptedKey string    `json:"encrypted_key"`
+}
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// Ek holds the ML-KEM-768 ciphertext followed by the ephemeral X25519 public key
+	Ek string `json:"ek"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// protectedHeader is the protected header of all wrapped keys, which is
+// authenticated as additional data of the content encryption
+var protectedHeader = b64.EncodeToString([]byte(`{"enc":"A256GCM"}`))
+
+type keyWrapper struct{}
+
+var installOnce sync.Once
+
+// Install registers the hybrid key wrapper with ocicrypt
+func Install() {
+	installOnce.Do(func() {
+		ocicrypt.RegisterKeyWrapper(Scheme, &keyWrapper{})
+	})
+}
+
+func (kw *keyWrapper) GetAnnotationID() string {
+	return AnnotationID
+}
+
+// WrapKeys wraps the optsData for the hybrid public keys of the EncryptConfig
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	pubKeys := ec.Parameters[ParameterPublicKeys]
+	if len(pubKeys) == 0 {
+		return nil, nil
+	}
+
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, iv, optsData, []byte(protectedHeader))
+	tagStart := len(sealed) - aead.Overhead()
+
+	jwe := jweJSON{
+		Protected:  protectedHeader,
+		IV:         b64.EncodeToString(iv),
+		Ciphertext: b64.EncodeToString(sealed[:tagStart]),
+		Tag:        b64.EncodeToString(sealed[tagStart:]),
+	}
+	for _, data := range pubKeys {
+		pub, err := parseKey(data, publicKeyType, publicKeySize)
+		if err != nil {
+			return nil, err
+		}
+		kek, ek, err := encapsulate(pub)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := josecipher.KeyWrap(block, cek)
+		if err != nil {
+			return nil, err
+		}
+		jwe.Recipients = append(jwe.Recipients, jweRecipient{
+			Header: jweHeader{
+				Alg: Algorithm,
+				Kid: keyID(pub),
+				Ek:  b64.EncodeToString(ek),
+			},
+			EncryptedKey: b64.EncodeToString(wrapped),
+		})
+	}
+	return json.Marshal(&jwe)
+}
+
+// UnwrapKey unwraps the optsData with one of the hybrid private keys of the
+// DecryptConfig
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	jwe, err := parseJWE(annotation)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range dc.Parameters[ParameterPrivateKeys] {
+		// a key that cannot be parsed does not keep the others from being
+		// tried
+		priv, err := parseKey(data, privateKeyType, privateKeySize)
+		if err != nil {
+			logging.G(tracing.Context(dc)).Debug("skipping hybrid private key that cannot be parsed", "error", err)
+			continue
+		}
+		kid, err := privateKeyID(priv)
+		if err != nil {
+			logging.G(tracing.Context(dc)).Debug("skipping hybrid private key without a key id", "error", err)
+			continue
+		}
+		for _, r := range jwe.Recipients {
+			if r.Header.Alg != Algorithm || r.Header.Kid != kid {
+				continue
+			}
+			optsData, err := unwrapRecipient(jwe, r, priv)
+			if err == nil {
+				logging.G(tracing.Context(dc)).Debug("hybrid recipient matched", "kid", kid)
+				matched.Report(tracing.Context(dc), kid)
+				return optsData, nil
+			}
+			logging.G(tracing.Context(dc)).Debug("hybrid recipient matched the key id but could not be unwrapped", "kid", kid, "error", err)
+		}
+	}
+	return nil, errors.New("no suitable private key found for decryption of the X25519+ML-KEM-768 hybrid JWE")
+}
+
+func unwrapRecipient(jwe *jweJSON, r jweRecipient, priv []byte) ([]byte, error) {
+	ek, err := b64.DecodeString(r.Header.Ek)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := decapsulate(priv, ek)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := b64.DecodeString(r.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := josecipher.KeyUnwrap(block, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	var parts [3][]byte
+	for i, s := range []string{jwe.IV, jwe.Ciphertext, jwe.Tag} {
+		if parts[i], err = b64.DecodeString(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(parts[0]) != aead.NonceSize() {
+		return nil, errors.New("invalid IV")
+	}
+	return aead.Open(nil, parts[0], append(parts[1], parts[2]...), []byte(jwe.Protected))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseJWE(annotation []byte) (*jweJSON, error) {
+	var jwe jweJSON
+	if err := json.Unmarshal(annotation, &jwe); err != nil {
+		return nil, fmt.Errorf("could not parse hybrid JWE: %w", err)
+	}
+	if jwe.Protected != protectedHeader {
+		return nil, errors.New("hybrid JWE has an unsupported protected header")
+	}
+	if len(jwe.Recipients) == 0 {
+		return nil, errors.New("hybrid JWE has no recipients")
+	}
+	return &jwe, nil
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(dcparameters[ParameterPrivateKeys]) == 0
+}
+
+func (kw *keyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters[ParameterPrivateKeys]
+}
+
+func (kw *keyWrapper) GetKeyIdsFromPacket(string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the key IDs of the recipients of the wrapped keys
+func (kw *keyWrapper) GetRecipients(b64jwes string) ([]string, error) {
+	var recipients []string
+	for _, b64jwe := range strings.Split(b64jwes, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64jwe)
+		if err != nil {
+			return nil, err
+		}
+		jwe, err := parseJWE(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range jwe.Recipients {
+			recipients = append(recipients, "[jwe-hybrid] "+r.Header.Kid)
+		}
+	}
+	return recipients, nil
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hybrid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func generateKey(t *testing.T) ([]byte, []byte) {
+	priv, pub, err := GenerateKey()
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestKeyFormat(t *testing.T) {
+	priv, pub := generateKey(t)
+
+	if !IsPrivateKey(priv) || IsPublicKey(priv) {
+		t.Fatal("expected a hybrid private key")
+	}
+	if !IsPublicKey(pub) || IsPrivateKey(pub) {
+		t.Fatal("expected a hybrid public key")
+	}
+	if IsPublicKey([]byte("-----BEGIN X25519 MLKEM768 PUBLIC KEY-----\nAAAA\n-----END X25519 MLKEM768 PUBLIC KEY-----\n")) {
+		t.Fatal("a truncated key must not be accepted")
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	priv1, pub1 := generateKey(t)
+	priv2, pub2 := generateKey(t)
+	priv3, _ := generateKey(t)
+
+	kw := &keyWrapper{}
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+
+	ec := EncryptWithPublicKeys([][]byte{pub1, pub2}).EncryptConfig
+	wrapped, err := kw.WrapKeys(ec, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, priv := range [][]byte{priv1, priv2} {
+		dc := DecryptWithPrivateKeys([][]byte{priv}).DecryptConfig
+		unwrapped, err := kw.UnwrapKey(dc, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, optsData) {
+			t.Fatalf("unwrapped %q, expected %q", unwrapped, optsData)
+		}
+	}
+
+	dc := DecryptWithPrivateKeys([][]byte{priv3}).DecryptConfig
+	if _, err := kw.UnwrapKey(dc, wrapped); err == nil {
+		t.Fatal("expected unwrapping with a key that is not a recipient to fail")
+	}
+
+	// a key that cannot be parsed is skipped
+	dc = DecryptWithPrivateKeys([][]byte{[]byte("not a key"), priv2}).DecryptConfig
+	if unwrapped, err := kw.UnwrapKey(dc, wrapped); err != nil || !bytes.Equal(unwrapped, optsData) {
+		t.Fatalf("expected the key after an unparsable one to unwrap, got %q, %v", unwrapped, err)
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wrapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || !strings.HasPrefix(recipients[0], "[jwe-hybrid] ") {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+}
+
+func TestUnwrapTampered(t *testing.T) {
+	priv, pub := generateKey(t)
+
+	kw := &keyWrapper{}
+	wrapped, err := kw.WrapKeys(EncryptWithPublicKeys([][]byte{pub}).EncryptConfig, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(wrapped, []byte(`"ciphertext":"`), []byte(`"ciphertext":"AA`), 1)
+
+	dc := DecryptWithPrivateKeys([][]byte{priv}).DecryptConfig
+	if _, err := kw.UnwrapKey(dc, tampered); err == nil {
+		t.Fatal("expected unwrapping a tampered JWE to fail")
+	}
+}
@@ -0,0 +1,136 @@
+//go:build go1.24
+// +build go1.24
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hybrid
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha3"
+	"encoding/pem"
+	"errors"
+)
+
+// combinerLabel separates the derived key from other uses of the shared
+// secrets; it is the label of the X-Wing KEM, MLKEM768-X25519 of
+// draft-ietf-hpke-pq
+var combinerLabel = []byte(`\.//^\`)
+
+// GenerateKey creates a hybrid key pair and returns the PEM encoded private
+// and public keys
+func GenerateKey() ([]byte, []byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, err
+	}
+	xk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv := append(dk.Bytes(), xk.Bytes()...)
+	pub := append(dk.EncapsulationKey().Bytes(), xk.PublicKey().Bytes()...)
+	return pem.EncodeToMemory(&pem.Block{Type: privateKeyType, Bytes: priv}),
+		pem.EncodeToMemory(&pem.Block{Type: publicKeyType, Bytes: pub}), nil
+}
+
+// combine derives the key encryption key from the shared secrets of both
+// algorithms, so that it is secret as long as either of them is secure. It is
+// the combiner of X-Wing, which hashes the label after the shared secrets, the
+// X25519 ciphertext and public key; the keys are not X-Wing keys though, which
+// are expanded from a single seed.
+func combine(ssM, ssX, ctX, pkX []byte) []byte {
+	var data []byte
+	for _, b := range [][]byte{ssM, ssX, ctX, pkX, combinerLabel} {
+		data = append(data, b...)
+	}
+	sum := sha3.Sum256(data)
+	return sum[:]
+}
+
+// encapsulate returns a key encryption key for the public key and the
+// encapsulation from which the private key recovers it
+func encapsulate(pub []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(pub[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, nil, err
+	}
+	pkX, err := ecdh.X25519().NewPublicKey(pub[mlkem.EncapsulationKeySize768:])
+	if err != nil {
+		return nil, nil, err
+	}
+	ssM, ctM := ek.Encapsulate()
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ssX, err := eph.ECDH(pkX)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctX := eph.PublicKey().Bytes()
+	return combine(ssM, ssX, ctX, pkX.Bytes()), append(ctM, ctX...), nil
+}
+
+// decapsulate recovers the key encryption key from the encapsulation
+func decapsulate(priv, enc []byte) ([]byte, error) {
+	if len(enc) != mlkem.CiphertextSize768+32 {
+		return nil, errors.New("invalid encapsulated key")
+	}
+	dk, xk, err := privateKeys(priv)
+	if err != nil {
+		return nil, err
+	}
+	ssM, err := dk.Decapsulate(enc[:mlkem.CiphertextSize768])
+	if err != nil {
+		return nil, err
+	}
+	ctX := enc[mlkem.CiphertextSize768:]
+	ephX, err := ecdh.X25519().NewPublicKey(ctX)
+	if err != nil {
+		return nil, err
+	}
+	ssX, err := xk.ECDH(ephX)
+	if err != nil {
+		return nil, err
+	}
+	return combine(ssM, ssX, ctX, xk.PublicKey().Bytes()), nil
+}
+
+// privateKeyID returns the key ID of the public key of the private key
+func privateKeyID(priv []byte) (string, error) {
+	dk, xk, err := privateKeys(priv)
+	if err != nil {
+		return "", err
+	}
+	return keyID(append(dk.EncapsulationKey().Bytes(), xk.PublicKey().Bytes()...)), nil
+}
+
+func privateKeys(priv []byte) (*mlkem.DecapsulationKey768, *ecdh.PrivateKey, error) {
+	dk, err := mlkem.NewDecapsulationKey768(priv[:mlkem.SeedSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	xk, err := ecdh.X25519().NewPrivateKey(priv[mlkem.SeedSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk, xk, nil
+}
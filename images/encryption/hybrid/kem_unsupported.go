@@ -0,0 +1,37 @@
+//go:build !go1.24
+// +build !go1.24
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hybrid
+
+// GenerateKey is not supported without ML-KEM
+func GenerateKey() ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupported
+}
+
+func encapsulate([]byte) ([]byte, []byte, error) {
+	return nil, nil, ErrUnsupported
+}
+
+func decapsulate([]byte, []byte) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func privateKeyID([]byte) (string, error) {
+	return "", ErrUnsupported
+}
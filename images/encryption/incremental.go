@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/gobars/ocicrypt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReuseOptions limit which encrypted layers of a previous version of an
+// image are reused
+type ReuseOptions struct {
+	// MaxKeyAge is how long after their keys were wrapped the layers are
+	// reused, so that layer keys are still replaced now and then; layers are
+	// reused regardless of their age if it is zero
+	MaxKeyAge time.Duration
+}
+
+type previousKey struct{}
+
+// previousImage holds the reusable encrypted layers of a previous version of
+// an image by the value of their LabelEncryption
+type previousImage struct {
+	layers map[string]ocispec.Descriptor
+	opts   ReuseOptions
+}
+
+// WithPreviousImage returns a context in which the encryption of an image
+// reuses the encrypted layers of the previous version of the image desc,
+// such as the one built the night before, for the plain layers the new
+// version shares with it, instead of encrypting them again. A layer is only
+// reused if it was encrypted in cs from the same plain layer with the same
+// recipients, encryption context and cipher, as recorded by LabelEncryption,
+// and if the escrow and algorithm policies and the options allow it; the
+// other layers are encrypted as usual. The number of reusable layers is
+// returned.
+func WithPreviousImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor, opts ReuseOptions) (context.Context, int, error) {
+	descs, err := EncryptedLayers(ctx, cs, desc, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read previous image: %w", err)
+	}
+	prev := &previousImage{layers: make(map[string]ocispec.Descriptor), opts: opts}
+	for _, desc := range descs {
+		info, err := cs.Info(ctx, desc.Digest)
+		if errdefs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if key := info.Labels[LabelEncryption]; key != "" {
+			prev.layers[key] = desc
+		}
+	}
+	return context.WithValue(ctx, previousKey{}, prev), len(prev.layers), nil
+}
+
+// reusePrevious returns the descriptor of the encrypted layer of the previous
+// image that was encrypted from the plain layer desc with the parameters
+// identified by key; false is returned if there is none or it may not be
+// reused, so that desc is encrypted instead
+func reusePrevious(ctx context.Context, cs content.Store, key string, desc ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	prev, _ := ctx.Value(previousKey{}).(*previousImage)
+	if prev == nil {
+		return ocispec.Descriptor{}, false
+	}
+	enc, ok := prev.layers[key]
+	if !ok {
+		return ocispec.Descriptor{}, false
+	}
+	enc, err := ExpandKeys(ctx, cs, enc)
+	if err == nil {
+		err = prev.check(enc)
+	}
+	var newDesc ocispec.Descriptor
+	if err == nil {
+		newDesc, err = adoptLayer(ctx, cs, desc, enc, key, nil)
+	}
+	if err != nil {
+		logging.G(ctx).Info("not reusing the encrypted layer of the previous image, encrypting the layer", "layer", desc.Digest, "previous", enc.Digest, "reason", err)
+		return ocispec.Descriptor{}, false
+	}
+	logging.G(ctx).Info("reused the encrypted layer of the previous image", "layer", desc.Digest, "encrypted", newDesc.Digest)
+	return newDesc, true
+}
+
+// check returns an error if the encrypted layer may not be reused because of
+// the age of its keys or the algorithm policy
+func (prev *previousImage) check(enc ocispec.Descriptor) error {
+	if prev.opts.MaxKeyAge > 0 {
+		md, err := keymeta.Read(enc)
+		if err != nil {
+			return err
+		}
+		if md.Created == nil {
+			return fmt.Errorf("the time its keys were wrapped is unknown")
+		}
+		if age := time.Since(*md.Created); age > prev.opts.MaxKeyAge {
+			return fmt.Errorf("its keys were wrapped %s ago", age.Round(time.Second))
+		}
+	}
+	policy := algpolicy.Current()
+	if cipher, err := layerCipher(enc); err == nil {
+		if err := policy.CheckCipher(string(cipher)); err != nil {
+			return err
+		}
+	}
+	for scheme := range ocicrypt.GetWrappedKeysMap(enc) {
+		if err := policy.CheckScheme(scheme); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package interop checks that encrypted images use only the format of
+// ocicrypt that the container runtimes built on containers/image, such as
+// CRI-O and Podman, decrypt, so that images encrypted by imgcrypt are known
+// to run there before they are deployed.
+//
+// imgcrypt extends that format: its wrap schemes such as jwe-hybrid and
+// threshold, key blobs, keys stored in referrers and the SM4 layer cipher
+// are unknown to upstream ocicrypt. Annotations that upstream ocicrypt
+// ignores without affecting decryption, such as the key metadata, are not
+// reported.
+package interop
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/gobars/ocicrypt/blockcipher"
+	encocispec "github.com/gobars/ocicrypt/spec"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	keysPrefix        = "org.opencontainers.image.enc.keys."
+	annotationPubOpts = "org.opencontainers.image.enc.pubopts"
+)
+
+// Schemes are the wrap schemes of upstream ocicrypt; keyprovider schemes,
+// provider.<name>, are supported as well when the runtime is configured with
+// the provider
+var Schemes = []string{"jwe", "pkcs7", "pgp", "pkcs11"}
+
+// JWEAlgorithms are the JWE key management algorithms upstream ocicrypt
+// accepts
+var JWEAlgorithms = []string{"RSA-OAEP", "RSA-OAEP-256", "ECDH-ES+A128KW", "ECDH-ES+A192KW", "ECDH-ES+A256KW"}
+
+// JWEEncryptions are the JWE content encryption algorithms upstream ocicrypt
+// accepts
+var JWEEncryptions = []string{"A128GCM", "A192GCM", "A256GCM", "A128CBC-HS256", "A192CBC-HS384", "A256CBC-HS512"}
+
+// mediaTypes are the media types of encrypted layers of upstream ocicrypt
+var mediaTypes = []string{
+	encocispec.MediaTypeLayerEnc, encocispec.MediaTypeLayerGzipEnc, encocispec.MediaTypeLayerZstdEnc,
+	encocispec.MediaTypeLayerNonDistributableEnc, encocispec.MediaTypeLayerNonDistributableGzipEnc,
+	encocispec.MediaTypeLayerNonDistributableZstdEnc,
+}
+
+// Check returns where the encrypted layers of the image with the given target
+// descriptor diverge from the format of upstream ocicrypt: their media types,
+// the annotations with their wrapped keys and block cipher options, and the
+// headers of JWE wrapped keys. Only the manifests in cs are checked; the
+// layer blobs are not read. An error is only returned if the image could not
+// be checked.
+func Check(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) ([]imgenc.VerifyIssue, error) {
+	var issues []imgenc.VerifyIssue
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsManifestType(desc.MediaType) {
+			children, err := images.Children(ctx, cs, desc)
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return children, err
+		}
+		p, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(p, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal manifest %s: %w", desc.Digest, err)
+		}
+		for _, layer := range manifest.Layers {
+			for _, msg := range CheckLayer(desc.MediaType, layer) {
+				issues = append(issues, imgenc.VerifyIssue{Digest: layer.Digest, Message: msg})
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
+// CheckLayer returns where a layer of a manifest with the given media type
+// diverges from the format of upstream ocicrypt
+func CheckLayer(manifestMediaType string, desc ocispec.Descriptor) []string {
+	var msgs []string
+	add := func(format string, a ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, a...))
+	}
+	if !imgenc.IsEncryptedDiff(context.Background(), desc.MediaType) {
+		if strings.HasSuffix(desc.MediaType, "+encrypted") {
+			add("encrypted layer media type %s is not one of ocicrypt", desc.MediaType)
+		}
+		return msgs
+	}
+	if manifestMediaType == images.MediaTypeDockerSchema2Manifest {
+		add("encrypted layer in a Docker manifest; only OCI manifests may have encrypted layers")
+	}
+	if !contains(mediaTypes, desc.MediaType) {
+		add("encrypted layer media type %s is not one of ocicrypt", desc.MediaType)
+	}
+
+	var keyNames []string
+	for name := range desc.Annotations {
+		if strings.HasPrefix(name, keysPrefix) {
+			keyNames = append(keyNames, name)
+		}
+	}
+	sort.Strings(keyNames)
+	supported := 0
+	for _, name := range keyNames {
+		scheme := strings.TrimPrefix(name, keysPrefix)
+		if !contains(Schemes, scheme) && !strings.HasPrefix(scheme, "provider.") {
+			add("keys wrapped with scheme %s are ignored by ocicrypt, so its recipients cannot decrypt the layer", scheme)
+			continue
+		}
+		supported++
+		for i, b64 := range strings.Split(desc.Annotations[name], ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				add("key %d wrapped with scheme %s is not valid base64: %v", i, scheme, err)
+				continue
+			}
+			if scheme == "jwe" {
+				if err := checkJWE(wrapped); err != nil {
+					add("key %d wrapped with scheme jwe: %v", i, err)
+				}
+			}
+		}
+	}
+	if supported == 0 {
+		msg := "encrypted layer has no keys wrapped with a scheme of ocicrypt in its annotations"
+		if _, ok := desc.Annotations[imgenc.AnnotationKeyBlob]; ok {
+			msg += "; ocicrypt does not read keys stored in a key blob"
+		} else if len(keyNames) == 0 {
+			msg += "; ocicrypt does not read keys stored in a referrer"
+		}
+		add("%s", msg)
+	}
+
+	if err := checkPubOpts(desc.Annotations[annotationPubOpts]); err != nil {
+		add("%v", err)
+	}
+	return msgs
+}
+
+// checkPubOpts checks that the public block cipher options name the cipher of
+// ocicrypt
+func checkPubOpts(b64 string) error {
+	if b64 == "" {
+		return fmt.Errorf("encrypted layer is missing annotation %s", annotationPubOpts)
+	}
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return fmt.Errorf("annotation %s is not valid base64: %w", annotationPubOpts, err)
+	}
+	var pubOpts blockcipher.PublicLayerBlockCipherOptions
+	if err := json.Unmarshal(data, &pubOpts); err != nil {
+		return fmt.Errorf("annotation %s cannot be parsed: %w", annotationPubOpts, err)
+	}
+	if pubOpts.CipherType != blockcipher.AES256CTR {
+		return fmt.Errorf("layer cipher %s is not supported by ocicrypt, which only knows %s", pubOpts.CipherType, blockcipher.AES256CTR)
+	}
+	if len(pubOpts.Hmac) == 0 {
+		return fmt.Errorf("annotation %s has no HMAC of the layer", annotationPubOpts)
+	}
+	return nil
+}
+
+// jweHeader holds the header parameters of a JWE that are checked
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+}
+
+// checkJWE checks that a JWE in the JSON serialization, as ocicrypt writes
+// them, only uses algorithms ocicrypt accepts
+func checkJWE(data []byte) error {
+	var jwe struct {
+		Protected   string     `json:"protected"`
+		Unprotected *jweHeader `json:"unprotected"`
+		Header      *jweHeader `json:"header"`
+		Recipients  []struct {
+			Header *jweHeader `json:"header"`
+		} `json:"recipients"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return fmt.Errorf("not a JWE in the JSON serialization: %w", err)
+	}
+	if jwe.Ciphertext == "" {
+		return fmt.Errorf("JWE has no ciphertext")
+	}
+	var shared jweHeader
+	if jwe.Protected != "" {
+		protected, err := base64.RawURLEncoding.DecodeString(jwe.Protected)
+		if err != nil {
+			return fmt.Errorf("could not decode protected header of JWE: %w", err)
+		}
+		if err := json.Unmarshal(protected, &shared); err != nil {
+			return fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+	}
+	shared.merge(jwe.Unprotected)
+	if !contains(JWEEncryptions, shared.Enc) {
+		return fmt.Errorf("JWE content encryption %q is not accepted by ocicrypt", shared.Enc)
+	}
+	headers := []*jweHeader{jwe.Header}
+	if len(jwe.Recipients) > 0 {
+		headers = headers[:0]
+		for _, r := range jwe.Recipients {
+			headers = append(headers, r.Header)
+		}
+	}
+	for _, h := range headers {
+		alg := shared.Alg
+		if h != nil && h.Alg != "" {
+			alg = h.Alg
+		}
+		if !contains(JWEAlgorithms, alg) {
+			return fmt.Errorf("JWE key management algorithm %q is not accepted by ocicrypt", alg)
+		}
+	}
+	return nil
+}
+
+// merge fills the parameters h does not have from other
+func (h *jweHeader) merge(other *jweHeader) {
+	if other == nil {
+		return
+	}
+	if h.Alg == "" {
+		h.Alg = other.Alg
+	}
+	if h.Enc == "" {
+		h.Enc = other.Enc
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
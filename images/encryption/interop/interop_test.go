@@ -0,0 +1,187 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interop
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/parsehelpers"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// encryptedLayer returns the descriptor of a layer encrypted for a new JWE
+// recipient
+func encryptedLayer(t *testing.T) ocispec.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(t.TempDir(), "pub.pem")
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("plaintext layer"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+	args, err := parsehelpers.NewEncArgs(parsehelpers.WithRecipients("jwe:" + pubFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := parsehelpers.CreateCryptoConfig(args, []ocispec.Descriptor{layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, _, err := imgenc.EncryptImage(ctx, cs, manifest, &cc, func(ocispec.Descriptor) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues, err := Check(ctx, cs, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatalf("expected an image encrypted for a JWE recipient to be compatible, got %v", issues)
+	}
+	m, err := images.Manifest(ctx, cs, desc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Layers[0]
+}
+
+func TestCheckLayer(t *testing.T) {
+	layer := encryptedLayer(t)
+	with := func(change func(d *ocispec.Descriptor)) ocispec.Descriptor {
+		d := layer
+		d.Annotations = make(map[string]string)
+		for k, v := range layer.Annotations {
+			d.Annotations[k] = v
+		}
+		change(&d)
+		return d
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		desc     ocispec.Descriptor
+		want     string
+	}{
+		{
+			name:     "docker manifest",
+			manifest: images.MediaTypeDockerSchema2Manifest,
+			desc:     layer,
+			want:     "Docker manifest",
+		},
+		{
+			name: "media type",
+			desc: with(func(d *ocispec.Descriptor) { d.MediaType = images.MediaTypeDockerSchema2LayerGzip + "+encrypted" }),
+			want: "media type",
+		},
+		{
+			name: "unknown scheme",
+			desc: with(func(d *ocispec.Descriptor) { d.Annotations[keysPrefix+"threshold"] = b64("{}") }),
+			want: "scheme threshold are ignored",
+		},
+		{
+			name: "key blob",
+			desc: with(func(d *ocispec.Descriptor) {
+				delete(d.Annotations, keysPrefix+"jwe")
+				d.Annotations[imgenc.AnnotationKeyBlob] = "{}"
+			}),
+			want: "key blob",
+		},
+		{
+			name: "referrer",
+			desc: with(func(d *ocispec.Descriptor) { delete(d.Annotations, keysPrefix+"jwe") }),
+			want: "referrer",
+		},
+		{
+			name: "cipher",
+			desc: with(func(d *ocispec.Descriptor) {
+				d.Annotations[annotationPubOpts] = b64(`{"cipher":"SM4_128_CTR_HMAC_SM3","hmac":"aG1hYw=="}`)
+			}),
+			want: "SM4_128_CTR_HMAC_SM3",
+		},
+		{
+			name: "jwe algorithm",
+			desc: with(func(d *ocispec.Descriptor) {
+				protected := base64.RawURLEncoding.EncodeToString([]byte(`{"enc":"A256GCM"}`))
+				d.Annotations[keysPrefix+"jwe"] = b64(`{"protected":"` + protected + `","recipients":[{"header":{"alg":"RSA1_5"}}],"ciphertext":"x"}`)
+			}),
+			want: `"RSA1_5"`,
+		},
+		{
+			name: "jwe encryption",
+			desc: with(func(d *ocispec.Descriptor) {
+				d.Annotations[keysPrefix+"jwe"] = b64(`{"unprotected":{"enc":"XC20P"},"header":{"alg":"RSA-OAEP"},"ciphertext":"x"}`)
+			}),
+			want: `"XC20P"`,
+		},
+	}
+	for _, tc := range tests {
+		manifest := tc.manifest
+		if manifest == "" {
+			manifest = ocispec.MediaTypeImageManifest
+		}
+		msgs := CheckLayer(manifest, tc.desc)
+		if len(msgs) != 1 || !strings.Contains(msgs[0], tc.want) {
+			t.Errorf("%s: expected one issue about %q, got %q", tc.name, tc.want, msgs)
+		}
+	}
+	if msgs := CheckLayer(ocispec.MediaTypeImageManifest, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip}); len(msgs) != 0 {
+		t.Errorf("expected no issues for a plain layer, got %q", msgs)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package inventory reports the encryption of images, such as those of a
+// containerd namespace or of a registry catalog: per image, whether and with
+// which schemes its layers are encrypted, for which recipients, and whether it
+// complies with the authorization and escrow policies, in JSON or CSV for
+// dashboards and audits.
+package inventory
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/opencontainers/go-digest"
+)
+
+// Image is the inventory entry of an image
+type Image struct {
+	Name      string        `json:"name"`
+	Namespace string        `json:"namespace,omitempty"`
+	Digest    digest.Digest `json:"digest"`
+	// The number of layers across all platforms
+	Layers          int `json:"layers"`
+	EncryptedLayers int `json:"encryptedLayers"`
+	// Whether any layer is encrypted
+	Encrypted bool `json:"encrypted"`
+	// The sorted wrap schemes and recipients across all encrypted layers
+	Schemes    []string `json:"schemes,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	// Whether the image complies with the policies; only set if a policy was
+	// checked
+	Compliant  *bool    `json:"compliant,omitempty"`
+	Violations []string `json:"violations,omitempty"`
+	// Why the image could not be scanned
+	Error string `json:"error,omitempty"`
+}
+
+// Scan returns the inventory entry of the image, whose manifests are read from
+// cs. The image is checked against the authorization policy, if any, and
+// against the escrow policy, if one is set. Errors are recorded in the entry,
+// so that one broken image does not stop the inventory.
+func Scan(ctx context.Context, cs content.Provider, img images.Image, policy imgenc.AuthorizationPolicy) Image {
+	namespace, _ := namespaces.Namespace(ctx)
+	entry := Image{
+		Name:      img.Name,
+		Namespace: namespace,
+		Digest:    img.Target.Digest,
+	}
+	all, err := crypt.ImageLayers(ctx, cs, img.Target)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	schemes := make(map[string]bool)
+	recipients := make(map[string]bool)
+	var infos []imgenc.LayerInfo
+	checked := policy != nil
+	for _, l := range crypt.SelectLayers(all, nil, nil) {
+		desc, err := imgenc.ExpandKeys(ctx, cs, l.Descriptor)
+		if err != nil {
+			entry.Error = err.Error()
+			return entry
+		}
+		li, err := imgenc.GetLayerInfo(l.Index, desc, nil)
+		if err != nil {
+			entry.Error = err.Error()
+			return entry
+		}
+		infos = append(infos, li)
+		entry.Layers++
+		if len(li.Encryption) == 0 {
+			continue
+		}
+		entry.EncryptedLayers++
+		for _, s := range li.Schemes() {
+			schemes[s] = true
+		}
+		for _, r := range li.Recipients() {
+			recipients[r] = true
+		}
+		if li.EscrowCompliant != nil {
+			checked = true
+			if !*li.EscrowCompliant {
+				entry.Violations = append(entry.Violations, fmt.Sprintf("layer %s is not encrypted for escrow recipients %s", li.Digest, strings.Join(li.MissingEscrow, ", ")))
+			}
+		}
+	}
+	entry.Encrypted = entry.EncryptedLayers > 0
+	entry.Schemes = sortedKeys(schemes)
+	entry.Recipients = sortedKeys(recipients)
+
+	if policy != nil {
+		if err := policy.Authorize(ctx, imgenc.ImageReference(img.Name, img.Target.Digest), infos); err != nil {
+			entry.Violations = append(entry.Violations, err.Error())
+		}
+	}
+	if checked {
+		compliant := len(entry.Violations) == 0
+		entry.Compliant = &compliant
+	}
+	return entry
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteJSON writes the inventory as a JSON array
+func WriteJSON(w io.Writer, inventory []Image) error {
+	if inventory == nil {
+		inventory = []Image{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(inventory)
+}
+
+// csvHeader holds the columns of the CSV inventory; lists are separated by
+// semicolons and the compliance of images that were not checked is empty
+var csvHeader = []string{"namespace", "name", "digest", "layers", "encrypted_layers", "encrypted", "schemes", "recipients", "compliant", "violations", "error"}
+
+// WriteCSV writes the inventory as CSV with a header line
+func WriteCSV(w io.Writer, inventory []Image) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, img := range inventory {
+		compliant := ""
+		if img.Compliant != nil {
+			compliant = strconv.FormatBool(*img.Compliant)
+		}
+		if err := cw.Write([]string{
+			img.Namespace,
+			img.Name,
+			img.Digest.String(),
+			strconv.Itoa(img.Layers),
+			strconv.Itoa(img.EncryptedLayers),
+			strconv.FormatBool(img.Encrypted),
+			strings.Join(img.Schemes, ";"),
+			strings.Join(img.Recipients, ";"),
+			compliant,
+			strings.Join(img.Violations, ";"),
+			img.Error,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImages writes an image with a single plain layer and its encrypted
+// counterpart to a new store
+func testImages(t *testing.T) (content.Store, images.Image, images.Image) {
+	t.Helper()
+	ctx := context.Background()
+	layout, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := layout.Store()
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("layer data"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := images.Image{Name: "example.com/app:plain", Target: testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)}
+
+	ecc, _ := testutil.CryptoConfigs(t)
+	target, _, err := imgenc.EncryptImage(ctx, cs, plain.Target, &ecc, func(ocispec.Descriptor) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, plain, images.Image{Name: "example.com/app:enc", Target: target}
+}
+
+// denyPlain denies images with plain layers
+type denyPlain struct{}
+
+func (denyPlain) Authorize(_ context.Context, name string, layers []imgenc.LayerInfo) error {
+	for _, l := range layers {
+		if len(l.Encryption) == 0 {
+			return fmt.Errorf("%s has plain layer %s", name, l.Digest)
+		}
+	}
+	return nil
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	cs, plain, encrypted := testImages(t)
+
+	entry := Scan(ctx, cs, encrypted, nil)
+	if entry.Error != "" || !entry.Encrypted || entry.Layers != 1 || entry.EncryptedLayers != 1 {
+		t.Fatalf("expected an encrypted image with one layer, got %+v", entry)
+	}
+	if strings.Join(entry.Schemes, ",") != "jwe" || len(entry.Recipients) != 1 || entry.Compliant != nil {
+		t.Fatalf("expected one jwe recipient and no compliance, got %+v", entry)
+	}
+
+	entry = Scan(ctx, cs, encrypted, denyPlain{})
+	if entry.Compliant == nil || !*entry.Compliant || len(entry.Violations) != 0 {
+		t.Fatalf("expected the encrypted image to comply, got %+v", entry)
+	}
+	entry = Scan(ctx, cs, plain, denyPlain{})
+	if entry.Encrypted || entry.EncryptedLayers != 0 || entry.Compliant == nil || *entry.Compliant || len(entry.Violations) != 1 {
+		t.Fatalf("expected the plain image not to comply, got %+v", entry)
+	}
+
+	missing := images.Image{Name: "missing", Target: ocispec.Descriptor{MediaType: "application/unknown", Digest: digest.FromString("missing")}}
+	if entry = Scan(ctx, cs, missing, nil); entry.Error == "" {
+		t.Fatalf("expected an error for an image that cannot be scanned, got %+v", entry)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	compliant := false
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Image{{
+		Name:            "example.com/app:1",
+		Digest:          digest.FromString("manifest"),
+		Layers:          2,
+		EncryptedLayers: 1,
+		Encrypted:       true,
+		Schemes:         []string{"jwe", "pkcs7"},
+		Compliant:       &compliant,
+		Violations:      []string{"layer is not encrypted"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "namespace,name,digest,layers,encrypted_layers,encrypted,schemes,recipients,compliant,violations,error\n" +
+		",example.com/app:1," + digest.FromString("manifest").String() + ",2,1,true,jwe;pkcs7,,false,layer is not encrypted,\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected CSV:\n%s", buf.String())
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/_catalog" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/_catalog?last=app&n=100>; rel="next"`)
+			fmt.Fprint(w, `{"repositories":["app"]}`)
+		case r.URL.Path == "/v2/_catalog":
+			fmt.Fprint(w, `{"repositories":["team/tool"]}`)
+		case r.URL.Path == "/v2/app/tags/list":
+			fmt.Fprint(w, `{"name":"app","tags":["1","2"]}`)
+		case r.URL.Path == "/v2/team/tool/tags/list":
+			fmt.Fprint(w, `{"name":"team/tool","tags":["latest"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := func(string) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{Client: srv.Client(), Host: u.Host, Scheme: "http", Path: "/v2"}}, nil
+	}
+
+	refs, err := Catalog(context.Background(), hosts, "registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "registry.example.com/app:1 registry.example.com/app:2 registry.example.com/team/tool:latest"
+	if strings.Join(refs, " ") != want {
+		t.Fatalf("expected %s, got %v", want, refs)
+	}
+}
+
+// mapFetcher fetches blobs from a map
+type mapFetcher map[digest.Digest][]byte
+
+func (f mapFetcher) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	data, ok := f[desc.Digest]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+var _ remotes.Fetcher = mapFetcher{}
+
+func TestFetchProvider(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("manifest")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	p := FetchProvider(mapFetcher{desc.Digest: data})
+	read, err := content.ReadBlob(ctx, p, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("expected %q, got %q", data, read)
+	}
+
+	tampered := FetchProvider(mapFetcher{desc.Digest: []byte("tampered")})
+	if _, err := content.ReadBlob(ctx, tampered, desc); err == nil {
+		t.Fatal("expected a blob not matching its digest to be refused")
+	}
+}
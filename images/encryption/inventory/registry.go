@@ -0,0 +1,202 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pageSize is the number of entries requested per page of the catalog
+const pageSize = 100
+
+// Catalog returns the references of all tags of all repositories of the
+// registry, such as "registry.example.com/app:1", as listed by its catalog
+// API; the registry must allow listing its catalog
+func Catalog(ctx context.Context, hosts docker.RegistryHosts, registry string) ([]string, error) {
+	hs, err := hosts(registry)
+	if err != nil {
+		return nil, err
+	}
+	if len(hs) == 0 {
+		return nil, fmt.Errorf("no hosts configured for registry %s", registry)
+	}
+	// mirrors come first, the registry itself last
+	h := hs[len(hs)-1]
+	base := fmt.Sprintf("%s://%s%s", h.Scheme, h.Host, h.Path)
+
+	var repos []string
+	err = list(docker.WithScope(ctx, "registry:catalog:*"), h, fmt.Sprintf("%s/_catalog?n=%d", base, pageSize), func(page listPage) {
+		repos = append(repos, page.Repositories...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the catalog of %s: %w", registry, err)
+	}
+
+	var refs []string
+	for _, repo := range repos {
+		rctx := docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull", repo))
+		err := list(rctx, h, fmt.Sprintf("%s/%s/tags/list?n=%d", base, repo, pageSize), func(page listPage) {
+			for _, tag := range page.Tags {
+				refs = append(refs, fmt.Sprintf("%s/%s:%s", registry, repo, tag))
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the tags of %s/%s: %w", registry, repo, err)
+		}
+	}
+	return refs, nil
+}
+
+// listPage is a page of the catalog or of the tags of a repository
+type listPage struct {
+	Repositories []string `json:"repositories"`
+	Tags         []string `json:"tags"`
+}
+
+// list calls fn with each page of a paginated list, following the links to
+// the next pages
+func list(ctx context.Context, h docker.RegistryHost, u string, fn func(listPage)) error {
+	for u != "" {
+		resp, err := get(ctx, h, u)
+		if err != nil {
+			return err
+		}
+		var page listPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid response from %s: %w", u, err)
+		}
+		fn(page)
+		if u, err = nextPage(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextPage returns the URL of the next page from the Link header, if any
+func nextPage(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start, end := strings.IndexByte(link, '<'), strings.IndexByte(link, '>')
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid Link header %q", link)
+	}
+	next, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return "", fmt.Errorf("invalid Link header %q: %w", link, err)
+	}
+	return resp.Request.URL.ResolveReference(next).String(), nil
+}
+
+// get requests u from the registry host, authorizing the request once the
+// registry asked for it
+func get(ctx context.Context, h docker.RegistryHost, u string) (*http.Response, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for retried := false; ; retried = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		for k, v := range h.Header {
+			req.Header[k] = v
+		}
+		if h.Authorizer != nil {
+			if err := h.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && h.Authorizer != nil && !retried {
+			err := h.Authorizer.AddResponses(ctx, []*http.Response{resp})
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status from GET %s: %s", u, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// FetchProvider returns a provider of the blobs fetched with f, which reads
+// each blob entirely into memory and verifies its digest; it is meant for the
+// small manifests and indexes read by Scan
+func FetchProvider(f remotes.Fetcher) content.Provider {
+	return fetchProvider{f}
+}
+
+type fetchProvider struct {
+	f remotes.Fetcher
+}
+
+func (p fetchProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	rc, err := p.f.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != desc.Size {
+		return nil, fmt.Errorf("blob %s has unexpected size %d", desc.Digest, len(data))
+	}
+	if desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("blob %s does not match its digest", desc.Digest)
+	}
+	return blobReaderAt{bytes.NewReader(data)}, nil
+}
+
+// blobReaderAt reads a blob held in memory
+type blobReaderAt struct {
+	*bytes.Reader
+}
+
+func (blobReaderAt) Close() error {
+	return nil
+}
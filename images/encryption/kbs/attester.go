@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Attester produces the evidence of the TEE that is sent to the KBS
+type Attester interface {
+	// TEE returns the type of the TEE as known to the KBS, e.g. "snp" or "tdx"
+	TEE() string
+	// Evidence returns the evidence with the given report data bound into it
+	Evidence(ctx context.Context, reportData []byte) (string, error)
+}
+
+// SampleAttester produces evidence for the sample verifier of the KBS; it
+// provides no security and is meant for testing only
+type SampleAttester struct{}
+
+// TEE implements Attester
+func (SampleAttester) TEE() string {
+	return "sample"
+}
+
+// Evidence implements Attester
+func (SampleAttester) Evidence(_ context.Context, reportData []byte) (string, error) {
+	b, err := json.Marshal(map[string]string{
+		"svn":         "1",
+		"report_data": base64.StdEncoding.EncodeToString(reportData),
+	})
+	return string(b), err
+}
+
+// CommandAttester runs an external program to get the evidence; the report
+// data is appended hex encoded to the command and the evidence is read from
+// its standard output
+type CommandAttester struct {
+	Tee     string
+	Command []string
+}
+
+// TEE implements Attester
+func (a CommandAttester) TEE() string {
+	return a.Tee
+}
+
+// Evidence implements Attester
+func (a CommandAttester) Evidence(ctx context.Context, reportData []byte) (string, error) {
+	if len(a.Command) == 0 {
+		return "", errors.New("no evidence command given")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.Command[0], append(a.Command[1:], hex.EncodeToString(reportData))...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("evidence command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
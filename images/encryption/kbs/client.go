@@ -0,0 +1,283 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kbs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+)
+
+// ProtocolVersion is the version of the KBS protocol spoken by the client
+const ProtocolVersion = "0.1.0"
+
+// ErrAttestationFailed is returned if the KBS did not accept the evidence of the TEE
+var ErrAttestationFailed = errors.New("attestation failed")
+
+// Client fetches resources from a KBS using the request-challenge-attestation-response
+// protocol; the session established by attestation is reused for later requests
+type Client struct {
+	url      string
+	attester Attester
+	http     *http.Client
+	key      *rsa.PrivateKey
+}
+
+// NewClient creates a client for the KBS at url; tlsConfig may be nil
+func NewClient(url string, attester Attester, tlsConfig *tls.Config) (*Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TEE key: %w", err)
+	}
+	return &Client{
+		url:      strings.TrimSuffix(url, "/"),
+		attester: attester,
+		http: &http.Client{
+			Jar:       jar,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		key: key,
+	}, nil
+}
+
+type request struct {
+	Version     string `json:"version"`
+	TEE         string `json:"tee"`
+	ExtraParams string `json:"extra-params"`
+}
+
+type challenge struct {
+	Nonce       string `json:"nonce"`
+	ExtraParams string `json:"extra-params"`
+}
+
+type attestation struct {
+	TEEPubKey   map[string]string `json:"tee-pubkey"`
+	TEEEvidence string            `json:"tee-evidence"`
+}
+
+type response struct {
+	Protected    string `json:"protected"`
+	EncryptedKey string `json:"encrypted_key"`
+	IV           string `json:"iv"`
+	Ciphertext   string `json:"ciphertext"`
+	Tag          string `json:"tag"`
+}
+
+// GetResource returns the resource at <repository>/<type>/<tag>, attesting the
+// TEE first if there is no session with the KBS yet
+func (c *Client) GetResource(ctx context.Context, path string) ([]byte, error) {
+	resp, err := c.getResource(ctx, path)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		if err := c.attest(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = c.getResource(ctx, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get resource %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, fmt.Errorf("failed to get resource %s: %w", path, err)
+	}
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to decode resource %s: %w", path, err)
+	}
+	data, err := c.decrypt(&r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt resource %s: %w", path, err)
+	}
+	return data, nil
+}
+
+func (c *Client) getResource(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/kbs/v0/resource/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+// attest runs the authentication and attestation steps of the protocol
+func (c *Client) attest(ctx context.Context) error {
+	var ch challenge
+	if err := c.post(ctx, "auth", request{Version: ProtocolVersion, TEE: c.attester.TEE()}, &ch); err != nil {
+		return fmt.Errorf("KBS authentication failed: %w", err)
+	}
+
+	pub := c.publicKey()
+	reportData, err := RuntimeDataHash(ch.Nonce, pub)
+	if err != nil {
+		return err
+	}
+	evidence, err := c.attester.Evidence(ctx, reportData)
+	if err != nil {
+		return fmt.Errorf("failed to get %s evidence: %w", c.attester.TEE(), err)
+	}
+	if err := c.post(ctx, "attest", attestation{TEEPubKey: pub, TEEEvidence: evidence}, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrAttestationFailed, err)
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/kbs/v0/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("KBS returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// publicKey returns the JWK of the TEE key the KBS encrypts resources with
+func (c *Client) publicKey() map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"alg": "RSA-OAEP",
+		"n":   base64.RawURLEncoding.EncodeToString(c.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(c.key.E)).Bytes()),
+	}
+}
+
+// RuntimeDataHash returns the report data that binds the nonce of the KBS
+// challenge and the TEE public key into the evidence
+func RuntimeDataHash(nonce string, teePubKey map[string]string) ([]byte, error) {
+	runtimeData, err := json.Marshal(map[string]interface{}{
+		"nonce":      nonce,
+		"tee-pubkey": teePubKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.Sum384(runtimeData)
+	return h[:], nil
+}
+
+// decrypt decrypts a resource the KBS returned as JWE encrypted for the TEE key
+func (c *Client) decrypt(r *response) ([]byte, error) {
+	header, err := base64.RawURLEncoding.DecodeString(r.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+	if h.Enc != "A256GCM" {
+		return nil, fmt.Errorf("unsupported content encryption %q", h.Enc)
+	}
+
+	var fields [4][]byte
+	for i, s := range []string{r.EncryptedKey, r.IV, r.Ciphertext, r.Tag} {
+		if fields[i], err = base64.RawURLEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("invalid JWE encoding: %w", err)
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := fields[0], fields[1], fields[2], fields[3]
+
+	var cek []byte
+	switch h.Alg {
+	case "RSA-OAEP":
+		cek, err = rsa.DecryptOAEP(sha1.New(), nil, c.key, encryptedKey, nil)
+	case "RSA-OAEP-256":
+		cek, err = rsa.DecryptOAEP(sha256.New(), nil, c.key, encryptedKey, nil)
+	case "RSA1_5":
+		cek, err = rsa.DecryptPKCS1v15(nil, c.key, encryptedKey)
+	default:
+		return nil, fmt.Errorf("unsupported key encryption %q", h.Alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content key: %w", err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, iv, append(ciphertext, tag...), []byte(r.Protected))
+}
+
+// UnwrapKey unwraps the layer key of a keyprovider annotation with the key
+// encryption key released by the KBS
+func (c *Client) UnwrapKey(ctx context.Context, annotation []byte) ([]byte, error) {
+	var p AnnotationPacket
+	if err := json.Unmarshal(annotation, &p); err != nil {
+		return nil, fmt.Errorf("invalid annotation packet: %w", err)
+	}
+	path, err := ResourcePath(p.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := c.GetResource(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return Unwrap(kek, &p)
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kbs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeKBS serves a single resource to sessions that passed sample attestation
+func fakeKBS(t *testing.T, path string, resource []byte) *httptest.Server {
+	const nonce = "test-nonce"
+	attested := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kbs/v0/auth", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "kbs-session-id", Value: "1"})
+		json.NewEncoder(w).Encode(challenge{Nonce: nonce})
+	})
+	var teeKey *rsa.PublicKey
+	mux.HandleFunc("/kbs/v0/attest", func(w http.ResponseWriter, r *http.Request) {
+		var a attestation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ev struct {
+			ReportData string `json:"report_data"`
+		}
+		json.Unmarshal([]byte(a.TEEEvidence), &ev)
+		rd, _ := base64.StdEncoding.DecodeString(ev.ReportData)
+		want, _ := RuntimeDataHash(nonce, a.TEEPubKey)
+		if _, err := r.Cookie("kbs-session-id"); err != nil || !bytes.Equal(rd, want) {
+			http.Error(w, "evidence does not match", http.StatusUnauthorized)
+			return
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(a.TEEPubKey["n"])
+		e, _ := base64.RawURLEncoding.DecodeString(a.TEEPubKey["e"])
+		teeKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		attested = true
+	})
+	mux.HandleFunc("/kbs/v0/resource/"+path, func(w http.ResponseWriter, r *http.Request) {
+		if !attested {
+			http.Error(w, "not attested", http.StatusUnauthorized)
+			return
+		}
+		cek := make([]byte, 32)
+		iv := make([]byte, 12)
+		rand.Read(cek)
+		rand.Read(iv)
+		ek, _ := rsa.EncryptOAEP(sha1.New(), rand.Reader, teeKey, cek, nil)
+		protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A256GCM"}`))
+		block, _ := aes.NewCipher(cek)
+		aead, _ := cipher.NewGCM(block)
+		sealed := aead.Seal(nil, iv, resource, []byte(protected))
+		ct, tag := sealed[:len(resource)], sealed[len(resource):]
+		json.NewEncoder(w).Encode(response{
+			Protected:    protected,
+			EncryptedKey: base64.RawURLEncoding.EncodeToString(ek),
+			IV:           base64.RawURLEncoding.EncodeToString(iv),
+			Ciphertext:   base64.RawURLEncoding.EncodeToString(ct),
+			Tag:          base64.RawURLEncoding.EncodeToString(tag),
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+type badAttester struct{ SampleAttester }
+
+func (badAttester) Evidence(ctx context.Context, _ []byte) (string, error) {
+	return SampleAttester{}.Evidence(ctx, make([]byte, 48))
+}
+
+func TestUnwrapKey(t *testing.T) {
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+
+	p, err := Wrap(kek, "kbs:///default/key/1", optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotation, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := fakeKBS(t, "default/key/1", kek)
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, SampleAttester{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.UnwrapKey(context.Background(), annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, optsData) {
+		t.Fatalf("unwrapped %q, want %q", got, optsData)
+	}
+
+	c, err = NewClient(srv.URL, badAttester{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv2 := fakeKBS(t, "default/key/1", kek)
+	defer srv2.Close()
+	c.url = srv2.URL
+	if _, err := c.UnwrapKey(context.Background(), annotation); !errors.Is(err, ErrAttestationFailed) {
+		t.Fatalf("expected attestation failure, got %v", err)
+	}
+}
+
+func TestResourcePath(t *testing.T) {
+	for keyID, want := range map[string]string{
+		"kbs:///default/key/1":         "default/key/1",
+		"kbs://kbs.example:8080/a/b/c": "a/b/c",
+		"repo/type/tag":                "repo/type/tag",
+		"kbs:///default/key":           "",
+		"kbs:///default/../key":        "",
+	} {
+		got, err := ResourcePath(keyID)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", keyID)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v; want %q", keyID, got, err, want)
+		}
+	}
+}
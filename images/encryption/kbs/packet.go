@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kbs releases layer keys through the Key Broker Service (KBS) of
+// confidential containers. Layer keys are wrapped with a key encryption key
+// that is held by the KBS and only handed out after remote attestation of the
+// TEE the container runs in.
+package kbs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WrapTypeA256GCM is the only supported wrap type of annotation packets
+const WrapTypeA256GCM = "A256GCM"
+
+// AnnotationPacket is the keyprovider annotation of a layer key wrapped with a
+// KBS resource; it has the format used by the confidential containers
+// Attestation Agent, so images can be decrypted by either.
+type AnnotationPacket struct {
+	KeyID       string `json:"kid"`
+	WrappedData string `json:"wrapped_data"`
+	IV          string `json:"iv"`
+	WrapType    string `json:"wrap_type"`
+}
+
+// Wrap encrypts optsData with the 256 bit key encryption key kek that is
+// stored in the KBS under keyID
+func Wrap(kek []byte, keyID string, optsData []byte) (*AnnotationPacket, error) {
+	if _, err := ResourcePath(keyID); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return &AnnotationPacket{
+		KeyID:       keyID,
+		WrappedData: base64.StdEncoding.EncodeToString(aead.Seal(nil, iv, optsData, nil)),
+		IV:          base64.StdEncoding.EncodeToString(iv),
+		WrapType:    WrapTypeA256GCM,
+	}, nil
+}
+
+// Unwrap decrypts the layer key of the packet with the key encryption key
+func Unwrap(kek []byte, p *AnnotationPacket) ([]byte, error) {
+	if p.WrapType != WrapTypeA256GCM {
+		return nil, fmt.Errorf("unsupported wrap type %q", p.WrapType)
+	}
+	data, err := base64.StdEncoding.DecodeString(p.WrappedData)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped data is not valid base64: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(p.IV)
+	if err != nil {
+		return nil, fmt.Errorf("iv is not valid base64: %w", err)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("iv has invalid size %d", len(iv))
+	}
+	optsData, err := aead.Open(nil, iv, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key %s: %w", p.KeyID, err)
+	}
+	return optsData, nil
+}
+
+func newGCM(kek []byte) (cipher.AEAD, error) {
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("key encryption key must be 32 bytes, got %d", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ResourcePath returns the <repository>/<type>/<tag> path of a KBS resource
+// given as kbs:///<repository>/<type>/<tag>, kbs://<host>/<repository>/<type>/<tag>
+// or as the plain path
+func ResourcePath(keyID string) (string, error) {
+	path := keyID
+	if strings.HasPrefix(path, "kbs://") {
+		path = strings.TrimPrefix(path, "kbs://")
+		i := strings.Index(path, "/")
+		if i < 0 {
+			return "", fmt.Errorf("invalid KBS resource %q", keyID)
+		}
+		path = path[i+1:]
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid KBS resource %q: expected <repository>/<type>/<tag>", keyID)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return "", fmt.Errorf("invalid KBS resource %q", keyID)
+		}
+	}
+	return path, nil
+}
+
+// ParseWrapParameter parses a keyprovider recipient parameter of the form
+// keypath=<file>::keyid=<kbs resource> and reads the key encryption key from
+// the file
+func ParseWrapParameter(param string) (kek []byte, keyID string, err error) {
+	var keyPath string
+	for _, kv := range strings.Split(param, "::") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, "", fmt.Errorf("invalid parameter %q", kv)
+		}
+		switch k {
+		case "keypath":
+			keyPath = v
+		case "keyid":
+			keyID = v
+		case "algorithm":
+			if v != WrapTypeA256GCM {
+				return nil, "", fmt.Errorf("unsupported algorithm %q", v)
+			}
+		default:
+			return nil, "", fmt.Errorf("unknown parameter %q", k)
+		}
+	}
+	if keyPath == "" || keyID == "" {
+		return nil, "", errors.New("keypath and keyid must be given")
+	}
+	kek, err = os.ReadFile(keyPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key encryption key: %w", err)
+	}
+	return kek, keyID, nil
+}
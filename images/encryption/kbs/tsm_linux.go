@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kbs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultTSMReportDir is where the kernel's configfs-tsm interface is mounted
+const DefaultTSMReportDir = "/sys/kernel/config/tsm/report"
+
+// TSMAttester gets a TDX quote through the configfs-tsm interface of the
+// kernel (Linux 6.7 and later)
+type TSMAttester struct {
+	// Dir is the configfs-tsm report directory; DefaultTSMReportDir if empty
+	Dir string
+}
+
+// TEE implements Attester
+func (TSMAttester) TEE() string {
+	return "tdx"
+}
+
+// Evidence implements Attester
+func (a TSMAttester) Evidence(_ context.Context, reportData []byte) (string, error) {
+	quote, err := a.report(reportData)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(struct {
+		CCEventLog *string `json:"cc_eventlog"`
+		Quote      string  `json:"quote"`
+	}{
+		Quote: base64.StdEncoding.EncodeToString(quote),
+	})
+	return string(b), err
+}
+
+func (a TSMAttester) report(reportData []byte) ([]byte, error) {
+	dir := a.Dir
+	if dir == "" {
+		dir = DefaultTSMReportDir
+	}
+	entry, err := os.MkdirTemp(dir, "imgcrypt-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TSM report: %w", err)
+	}
+	defer os.Remove(entry)
+
+	inblob := make([]byte, 64)
+	copy(inblob, reportData)
+	if err := os.WriteFile(filepath.Join(entry, "inblob"), inblob, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write TSM report data: %w", err)
+	}
+	if provider, err := os.ReadFile(filepath.Join(entry, "provider")); err == nil {
+		if p := strings.TrimSpace(string(provider)); p != "tdx_guest" {
+			return nil, fmt.Errorf("TSM provider %q is not supported", p)
+		}
+	}
+	outblob, err := os.ReadFile(filepath.Join(entry, "outblob"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSM report: %w", err)
+	}
+	return outblob, nil
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kbs
+
+import (
+	"context"
+	"errors"
+)
+
+// TSMAttester is only supported on Linux
+type TSMAttester struct {
+	Dir string
+}
+
+// TEE implements Attester
+func (TSMAttester) TEE() string {
+	return "tdx"
+}
+
+// Evidence implements Attester
+func (TSMAttester) Evidence(context.Context, []byte) (string, error) {
+	return "", errors.New("TSM attestation is only supported on Linux")
+}
@@ -0,0 +1,296 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// AnnotationKeyBlob is set on an encrypted layer whose wrapped keys were
+	// too large for the annotations and holds the descriptor of the blob they
+	// were stored in instead
+	AnnotationKeyBlob = "org.opencontainers.image.enc.keyblob"
+	// MediaTypeKeyBlob is the media type of a blob holding the annotations
+	// with the wrapped keys of a layer
+	MediaTypeKeyBlob = "application/vnd.dev.imgcrypt.layer-keys.v1+json"
+
+	// DefaultMaxKeyAnnotationsSize is the size the annotations with the
+	// wrapped keys of a layer may have before they are stored in a key blob;
+	// it is reached with about 20 RSA recipients
+	DefaultMaxKeyAnnotationsSize = 16 << 10
+
+	// keysAnnotationPrefix prefixes the annotations with wrapped keys
+	keysAnnotationPrefix = "org.opencontainers.image.enc.keys."
+)
+
+type maxKeyAnnotationsSizeKey struct{}
+
+// WithMaxKeyAnnotationsSize returns a context in which the annotations with
+// the wrapped keys of a layer may have n bytes before they are stored in a key
+// blob when the layer is encrypted; with 0 or less they are never moved to a
+// key blob
+func WithMaxKeyAnnotationsSize(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxKeyAnnotationsSizeKey{}, n)
+}
+
+// maxKeyAnnotationsSize returns the size set by WithMaxKeyAnnotationsSize, or
+// DefaultMaxKeyAnnotationsSize
+func maxKeyAnnotationsSize(ctx context.Context) int64 {
+	if n, ok := ctx.Value(maxKeyAnnotationsSizeKey{}).(int64); ok {
+		return n
+	}
+	return DefaultMaxKeyAnnotationsSize
+}
+
+// hasWrappedKeys returns whether the layer has wrapped keys in its annotations
+func hasWrappedKeys(desc ocispec.Descriptor) bool {
+	for k := range desc.Annotations {
+		if strings.HasPrefix(k, keysAnnotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyBlob returns the descriptor of the key blob holding the wrapped keys of
+// the layer and whether there is one
+func KeyBlob(desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+	v, ok := desc.Annotations[AnnotationKeyBlob]
+	if !ok {
+		return ocispec.Descriptor{}, false, nil
+	}
+	var blob ocispec.Descriptor
+	if err := json.Unmarshal([]byte(v), &blob); err != nil {
+		return ocispec.Descriptor{}, false, fmt.Errorf("invalid key blob of layer %s: %w", desc.Digest, err)
+	}
+	if blob.MediaType != MediaTypeKeyBlob {
+		return ocispec.Descriptor{}, false, fmt.Errorf("key blob of layer %s has unsupported media type %q", desc.Digest, blob.MediaType)
+	}
+	if err := blob.Digest.Validate(); err != nil {
+		return ocispec.Descriptor{}, false, fmt.Errorf("invalid key blob of layer %s: %w", desc.Digest, err)
+	}
+	return blob, true, nil
+}
+
+// spillKeys stores the wrapped keys of the layer in a key blob written to cs
+// if their annotations are larger than the size set by
+// WithMaxKeyAnnotationsSize, and returns the
+// descriptor of the layer referencing the blob instead
+func spillKeys(ctx context.Context, cs content.Ingester, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	limit := maxKeyAnnotationsSize(ctx)
+	if limit <= 0 {
+		return desc, nil
+	}
+	keys := make(map[string]string)
+	size := 0
+	for k, v := range desc.Annotations {
+		if strings.HasPrefix(k, keysAnnotationPrefix) {
+			keys[k] = v
+			size += len(k) + len(v)
+		}
+	}
+	if int64(size) <= limit {
+		return desc, nil
+	}
+	p, err := json.Marshal(keys)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	blob := ocispec.Descriptor{
+		MediaType: MediaTypeKeyBlob,
+		Digest:    digest.Canonical.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	ref := fmt.Sprintf("keyblob-%s", blob.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(p), blob); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write key blob: %w", err)
+	}
+	r, err := json.Marshal(blob)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	a := make(map[string]string)
+	for k, v := range desc.Annotations {
+		if _, ok := keys[k]; !ok {
+			a[k] = v
+		}
+	}
+	a[AnnotationKeyBlob] = string(r)
+	desc.Annotations = a
+	logging.G(ctx).Info("stored the wrapped keys of the layer in a key blob", "layer", desc.Digest, "size", size, "blob", blob.Digest)
+	return desc, nil
+}
+
+// expandKeys returns the descriptor of the layer with the wrapped keys in p,
+// the data of its key blob
+func expandKeys(desc, blob ocispec.Descriptor, p []byte) (ocispec.Descriptor, error) {
+	if blob.Digest.Algorithm().FromBytes(p) != blob.Digest {
+		return ocispec.Descriptor{}, fmt.Errorf("key blob %s of layer %s does not match its digest", blob.Digest, desc.Digest)
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(p, &keys); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid key blob %s of layer %s: %w", blob.Digest, desc.Digest, err)
+	}
+	a := make(map[string]string)
+	for k, v := range desc.Annotations {
+		if k != AnnotationKeyBlob {
+			a[k] = v
+		}
+	}
+	for k, v := range keys {
+		if !strings.HasPrefix(k, keysAnnotationPrefix) {
+			return ocispec.Descriptor{}, fmt.Errorf("key blob %s of layer %s holds annotation %s, which is not a wrapped key", blob.Digest, desc.Digest, k)
+		}
+		a[k] = v
+	}
+	desc.Annotations = a
+	return desc, nil
+}
+
+// ExpandKeys returns the descriptor of the layer with the wrapped keys of the
+// key blob it references, which is read from cs. Layers without a key blob
+// and layers that have wrapped keys in their annotations, such as those merged
+// from a referrer, are returned as they are.
+func ExpandKeys(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	blob, ok, err := KeyBlob(desc)
+	if err != nil || !ok || hasWrappedKeys(desc) {
+		return desc, err
+	}
+	p, err := content.ReadBlob(ctx, cs, blob)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read key blob %s of layer %s: %w", blob.Digest, desc.Digest, err)
+	}
+	return expandKeys(desc, blob, p)
+}
+
+// ExpandKeysFrom returns the descriptor of the layer with the wrapped keys of
+// the key blob it references, which is looked up among blobs, such as the key
+// blobs passed to the decoder in the payload
+func ExpandKeysFrom(desc ocispec.Descriptor, blobs [][]byte) (ocispec.Descriptor, error) {
+	blob, ok, err := KeyBlob(desc)
+	if err != nil || !ok || hasWrappedKeys(desc) {
+		return desc, err
+	}
+	for _, p := range blobs {
+		if blob.Digest.Algorithm().FromBytes(p) == blob.Digest {
+			return expandKeys(desc, blob, p)
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("key blob %s of layer %s not found: %w", blob.Digest, desc.Digest, errdefs.ErrNotFound)
+}
+
+// keyBlobs returns the descriptors of the key blobs referenced by the layers
+func keyBlobs(layers []ocispec.Descriptor) []ocispec.Descriptor {
+	var blobs []ocispec.Descriptor
+	for _, l := range layers {
+		if blob, ok, err := KeyBlob(l); err == nil && ok {
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs
+}
+
+// KeyBlobChildren returns a handler that adds the key blobs referenced by the
+// layers among the children returned by f, so that they are copied, pushed
+// and fetched along with the layers
+func KeyBlobChildren(f images.Handler) images.HandlerFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := f.Handle(ctx, desc)
+		if err != nil || !images.IsManifestType(desc.MediaType) {
+			return children, err
+		}
+		return append(children, keyBlobs(children)...), nil
+	}
+}
+
+// AddKeyBlobs adds the key blobs referenced by the encrypted layers of the
+// image for the platform to the payload, so that the decoder finds the
+// wrapped keys of those layers
+func AddKeyBlobs(ctx context.Context, cs content.Provider, image images.Image, platform platforms.MatchComparer, data *imgcrypt.Payload) error {
+	manifest, err := images.Manifest(ctx, cs, image.Target, platform)
+	if err != nil {
+		return err
+	}
+	for _, blob := range keyBlobs(manifest.Layers) {
+		p, err := content.ReadBlob(ctx, cs, blob)
+		if err != nil {
+			return fmt.Errorf("failed to read key blob %s: %w", blob.Digest, err)
+		}
+		data.KeyBlobs = append(data.KeyBlobs, p)
+	}
+	return nil
+}
+
+// FetchKeyBlobs fetches the key blobs referenced by the layers of the
+// manifests of the image with the given target that are in cs, which
+// fetching an image with containerd leaves out, and sets the garbage
+// collection labels of the manifests referencing them
+func FetchKeyBlobs(ctx context.Context, cs content.Store, fetcher remotes.Fetcher, desc ocispec.Descriptor) error {
+	fetch := remotes.FetchHandler(cs, fetcher)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch {
+		case desc.MediaType == MediaTypeKeyBlob:
+			return fetch(ctx, desc)
+		case images.IsIndexType(desc.MediaType):
+			children, err := images.Children(ctx, cs, desc)
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return children, err
+		case images.IsManifestType(desc.MediaType):
+			children, err := images.Children(ctx, cs, desc)
+			if errdefs.IsNotFound(err) {
+				// the manifests of other platforms are not fetched
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			blobs := keyBlobs(children)
+			if len(blobs) == 0 {
+				return nil, nil
+			}
+			info := content.Info{Digest: desc.Digest, Labels: make(map[string]string)}
+			var fields []string
+			for i, blob := range blobs {
+				k := fmt.Sprintf("containerd.io/gc.ref.content.k.%d", i)
+				info.Labels[k] = blob.Digest.String()
+				fields = append(fields, "labels."+k)
+			}
+			if _, err := cs.Update(ctx, info, fields...); err != nil {
+				return nil, err
+			}
+			return blobs, nil
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
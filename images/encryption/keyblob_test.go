@@ -0,0 +1,126 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestKeyBlob(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	ecc, dcc := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+
+	encrypted, _, err := EncryptImage(WithMaxKeyAnnotationsSize(ctx, 64), cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := content.ReadBlob(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(mp, &m); err != nil {
+		t.Fatal(err)
+	}
+	layer := m.Layers[0]
+	if hasWrappedKeys(layer) {
+		t.Fatal("wrapped keys kept in the annotations of the layer")
+	}
+	blob, ok, err := KeyBlob(layer)
+	if err != nil || !ok {
+		t.Fatalf("layer references no key blob: %v", err)
+	}
+	info, err := cs.Info(ctx, encrypted.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Labels["containerd.io/gc.ref.content.k.0"] != blob.Digest.String() {
+		t.Fatalf("manifest does not keep the key blob from garbage collection: %v", info.Labels)
+	}
+
+	children, err := KeyBlobChildren(images.ChildrenHandler(cs)).Handle(ctx, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := children[len(children)-1]; last.Digest != blob.Digest {
+		t.Fatalf("key blob not among the children of the manifest: %v", children)
+	}
+
+	// decryption reads the wrapped keys from the key blob
+	if _, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all); err != nil {
+		t.Fatalf("failed to decrypt layer with key blob: %v", err)
+	}
+	if issues, err := VerifyImage(ctx, cs, encrypted, dcc.DecryptConfig); err != nil || len(issues) > 0 {
+		t.Fatalf("got issues %v and error %v", issues, err)
+	}
+
+	// the decoder gets the key blobs with the payload
+	var payload imgcrypt.Payload
+	image := images.Image{Name: "app", Target: encrypted}
+	if err := AddKeyBlobs(ctx, cs, image, platforms.All, &payload); err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := ExpandKeysFrom(layer, payload.KeyBlobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasWrappedKeys(expanded) || expanded.Annotations[AnnotationKeyBlob] != "" {
+		t.Fatalf("wrapped keys not restored: %v", expanded.Annotations)
+	}
+	if _, err := ExpandKeysFrom(layer, nil); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("got %v for a missing key blob", err)
+	}
+	if _, err := ExpandKeysFrom(layer, [][]byte{[]byte(`{}`)}); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("got %v for a key blob with another digest", err)
+	}
+}
+
+func TestKeyBlobBelowLimit(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	ecc, _ := testutil.CryptoConfigs(t)
+
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, func(ocispec.Descriptor) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, platforms.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := m.Layers[0]
+	if !hasWrappedKeys(layer) {
+		t.Fatal("wrapped keys of a single recipient moved out of the annotations")
+	}
+	if _, ok, _ := KeyBlob(layer); ok {
+		t.Fatal("layer references a key blob")
+	}
+}
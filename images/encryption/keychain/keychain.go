@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keychain reads the passwords of private keys from the keychain of the
+// operating system: the macOS Keychain, the Secret Service on Linux and other
+// Unix systems, and the Windows Credential Manager. Automation can then keep
+// passwords out of files and command lines.
+package keychain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned if the keychain has no password of the given name
+var ErrNotFound = errors.New("password not found in keychain")
+
+// Lookup returns the password stored in the keychain under name, which is the
+// service of a generic password in the macOS Keychain, the value of the
+// "service" attribute of a Secret Service item, or the target name of a
+// generic credential in the Windows Credential Manager
+func Lookup(name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("no keychain item name given")
+	}
+	pwd, err := lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("keychain item %s: %w", name, err)
+	}
+	return pwd, nil
+}
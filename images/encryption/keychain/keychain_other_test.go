@@ -0,0 +1,53 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keychain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupSecretService(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1 $2 $3" = "lookup service node-key" ] || exit 1
+printf 'secret\n'
+`
+	if err := os.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	pwd, err := Lookup("node-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pwd) != "secret" {
+		t.Errorf("expected password without trailing newline, got %q", pwd)
+	}
+	if _, err := Lookup("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := Lookup(""); err == nil {
+		t.Error("expected an error for an empty name")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keydir reads decryption keys from a directory, as given to
+// ctd-decoder with --decryption-keys-path, and watches the directory so that
+// long running programs pick up added, rotated and removed keys.
+package keydir
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	encconfig "github.com/gobars/ocicrypt/config"
+	cryptUtils "github.com/gobars/ocicrypt/utils"
+)
+
+// Load reads the keys from the files in dir and its subdirectories.
+//
+// Files and directories whose names begin with a dot are ignored, so that
+// keys can be rotated by writing them to a temporary file that is renamed,
+// or by swapping the hidden data directory of a mounted Kubernetes secret.
+// Symbolic links are followed if they point into dir.
+func Load(dir string) (encconfig.CryptoConfig, error) {
+	var cc encconfig.CryptoConfig
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return cc, err
+	}
+
+	base64Keys := make([]string, 0)
+	var hybridKeys [][]byte
+
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if path, err = resolveLink(root, path); err != nil {
+				return err
+			}
+		}
+
+		privateKey, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if hybrid.IsPrivateKey(privateKey) {
+			hybridKeys = append(hybridKeys, privateKey)
+			return nil
+		}
+
+		// TODO - Remove the need to covert to base64. The ocicrypt library
+		// should provide a method to directly process the private keys
+		base64Keys = append(base64Keys, b64.StdEncoding.EncodeToString(privateKey))
+		return nil
+	}
+
+	if err := filepath.Walk(root, walkFn); err != nil {
+		return cc, err
+	}
+
+	sortedDc := make(map[string][][]byte)
+	if len(base64Keys) > 0 {
+		sortedDc, err = cryptUtils.SortDecryptionKeys(strings.Join(base64Keys, ","))
+		if err != nil {
+			return cc, err
+		}
+	}
+	if len(hybridKeys) > 0 {
+		sortedDc[hybrid.ParameterPrivateKeys] = hybridKeys
+	}
+
+	return encconfig.InitDecryption(sortedDc), nil
+}
+
+// resolveLink resolves the symbolic link at path and makes sure that it points
+// to a regular file within root
+func resolveLink(root, path string) (string, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("symbolic link %s in decryption keys path points outside of it", path)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("symbolic link %s in decryption keys path does not point to a file", path)
+	}
+	return target, nil
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keydir
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+func writeKey(t *testing.T, path string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func numKeys(dc *encconfig.DecryptConfig) int {
+	return len(dc.Parameters["privkeys"])
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, filepath.Join(dir, "key.pem"))
+	// a temporary file of a rotation
+	writeKey(t, filepath.Join(dir, ".key.pem.tmp"))
+	// the layout of a mounted Kubernetes secret
+	if err := os.Mkdir(filepath.Join(dir, "..2024_01_01"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, filepath.Join(dir, "..2024_01_01", "secret.pem"))
+	if err := os.Symlink("..2024_01_01", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "secret.pem"), filepath.Join(dir, "secret.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := numKeys(cc.DecryptConfig); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+}
+
+func TestLoadLinkOutside(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "key.pem")
+	writeKey(t, outside)
+	if err := os.Symlink(outside, filepath.Join(dir, "key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatal("expected a link outside of the directory to be rejected")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, filepath.Join(dir, "key1.pem"))
+
+	w, err := Watch(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if n := numKeys(w.DecryptConfig()); n != 1 {
+		t.Fatalf("expected 1 key, got %d", n)
+	}
+
+	wait := func(expected int) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case <-w.Reloads():
+				if w.Err() != nil {
+					t.Fatal(w.Err())
+				}
+				if numKeys(w.DecryptConfig()) == expected {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("expected %d keys, got %d", expected, numKeys(w.DecryptConfig()))
+			}
+		}
+	}
+
+	writeKey(t, filepath.Join(dir, "key2.pem"))
+	wait(2)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	wait(2)
+	writeKey(t, filepath.Join(dir, "sub", "key3.pem"))
+	wait(3)
+
+	if err := os.Remove(filepath.Join(dir, "key1.pem")); err != nil {
+		t.Fatal(err)
+	}
+	wait(2)
+
+	// a key that cannot be parsed keeps the keys loaded before in use
+	if err := os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Reloads():
+	case <-time.After(5 * time.Second):
+		t.Fatal("keys were not reloaded")
+	}
+	if w.Err() == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if n := numKeys(w.DecryptConfig()); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keydir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/fsnotify/fsnotify"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// reloadDelay is how long to wait for further changes of the directory before
+// reloading the keys, so that a rotation of several files is picked up at once
+const reloadDelay = 100 * time.Millisecond
+
+// Watcher holds the keys of a directory and reloads them when the directory
+// changes
+type Watcher struct {
+	dir     string
+	fsw     *fsnotify.Watcher
+	mu      sync.RWMutex
+	dc      *encconfig.DecryptConfig
+	err     error
+	reloads chan struct{}
+	done    chan struct{}
+}
+
+// Watch loads the keys of dir and reloads them whenever files in it are
+// added, changed or removed, until the watcher is closed
+func Watch(dir string) (*Watcher, error) {
+	cc, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		dir:     dir,
+		fsw:     fsw,
+		dc:      cc.DecryptConfig,
+		reloads: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if err := w.addDirs(); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// DecryptConfig returns the DecryptConfig with the keys last loaded
+func (w *Watcher) DecryptConfig() *encconfig.DecryptConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.dc
+}
+
+// Err returns the error of the last reload, if it failed; the keys loaded
+// before remain in use until the directory is valid again
+func (w *Watcher) Err() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.err
+}
+
+// Reloads returns a channel receiving a value after each reload
+func (w *Watcher) Reloads() <-chan struct{} {
+	return w.reloads
+}
+
+// Close stops watching the directory
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.fsw.Close()
+}
+
+// addDirs watches dir and its subdirectories, including hidden ones since
+// Kubernetes rotates secrets by swapping a hidden directory
+func (w *Watcher) addDirs() error {
+	return filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.fsw.Add(path)
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) run() {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					_ = w.addDirs()
+				}
+			}
+			timer = time.After(reloadDelay)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			logging.G(context.Background()).Warn("error watching decryption keys", "dir", w.dir, "error", err)
+			timer = time.After(reloadDelay)
+		case <-timer:
+			timer = nil
+			w.reload()
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	cc, err := Load(w.dir)
+	w.mu.Lock()
+	w.err = err
+	if err == nil {
+		w.dc = cc.DecryptConfig
+	}
+	w.mu.Unlock()
+	l := logging.G(context.Background())
+	if err != nil {
+		l.Error("could not reload decryption keys, keeping the keys loaded before", "dir", w.dir, "error", err)
+	} else {
+		l.Info("reloaded decryption keys", "dir", w.dir)
+	}
+	select {
+	case w.reloads <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keygen creates key material in the formats accepted for recipients and
+// private keys.
+package keygen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/pkcs11pool"
+	"github.com/gobars/ocicrypt/crypto/pkcs11"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// KeyTypeRSA selects RSA keys, usable with the jwe and pkcs7 schemes
+	KeyTypeRSA = "rsa"
+	// KeyTypeECDSA selects elliptic curve keys, usable with the jwe scheme
+	KeyTypeECDSA = "ecdsa"
+	// KeyTypeEd25519 selects Ed25519 keys, which are signature-only keys
+	KeyTypeEd25519 = "ed25519"
+	// KeyTypeX25519MLKEM768 selects hybrid X25519 and ML-KEM-768 keys, usable
+	// with the jwe scheme for post-quantum protection of layer keys
+	KeyTypeX25519MLKEM768 = "x25519-mlkem768"
+
+	// DefaultRSABits is the default size of RSA keys
+	DefaultRSABits = 3072
+	// DefaultCurve is the default curve of ECDSA keys
+	DefaultCurve = "P-256"
+)
+
+// ErrSignatureOnlyKey is returned for key types that cannot wrap layer keys
+var ErrSignatureOnlyKey = errors.New("ed25519 keys can only sign and cannot be used to encrypt images; use rsa or ecdsa")
+
+// Options describes the key pair to generate
+type Options struct {
+	// Type is one of KeyTypeRSA, KeyTypeECDSA, KeyTypeX25519MLKEM768; the
+	// default is KeyTypeRSA
+	Type string
+	// Bits is the size of RSA keys
+	Bits int
+	// Curve is the name of the curve of ECDSA keys, one of P-256, P-384 and P-521
+	Curve string
+	// Password, if given, is used to encrypt the private key; hybrid keys
+	// cannot be encrypted
+	Password []byte
+}
+
+// KeyPair holds a generated key pair
+type KeyPair struct {
+	// Private is the PEM-encoded private key in PKCS#8 format, or in the
+	// format of the hybrid package for hybrid keys
+	Private []byte
+	// Public is the PEM-encoded public key in PKIX format, or in the format
+	// of the hybrid package for hybrid keys
+	Public []byte
+
+	key crypto.Signer
+}
+
+// GenerateKeyPair creates a key pair for use with the jwe or pkcs7 scheme; hybrid
+// keys can only be used with the jwe scheme
+func GenerateKeyPair(opts Options) (*KeyPair, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch strings.ToLower(opts.Type) {
+	case "", KeyTypeRSA:
+		bits := opts.Bits
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		key, err = rsa.GenerateKey(rand.Reader, bits)
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		curve, err = parseCurve(opts.Curve)
+		if err != nil {
+			return nil, err
+		}
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyTypeEd25519:
+		return nil, ErrSignatureOnlyKey
+	case KeyTypeX25519MLKEM768:
+		if len(opts.Password) > 0 {
+			return nil, errors.New("hybrid private keys cannot be protected with a password")
+		}
+		priv, pub, err := hybrid.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate key: %w", err)
+		}
+		return &KeyPair{Private: priv, Public: pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", opts.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privDER,
+	}
+	if len(opts.Password) > 0 {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, privDER, opts.Password, x509.PEMCipherAES256) //nolint:staticcheck // ignore SA1019, the only encrypted format ocicrypt reads
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt private key: %w", err)
+		}
+	}
+
+	return &KeyPair{
+		Private: pem.EncodeToMemory(block),
+		Public: pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pubDER,
+		}),
+		key: key,
+	}, nil
+}
+
+func parseCurve(name string) (elliptic.Curve, error) {
+	switch strings.ToUpper(name) {
+	case "", DefaultCurve:
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve %q", name)
+}
+
+// SelfSignedCertificate creates a PEM-encoded self-signed certificate for the RSA key
+// pair as needed for pkcs7 recipients and for --dec-recipient
+func (kp *KeyPair) SelfSignedCertificate(commonName string, validity time.Duration) ([]byte, error) {
+	if _, ok := kp.key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("pkcs7 certificates require an RSA key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, kp.key.Public(), kp.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), nil
+}
+
+// Pkcs11KeyFile creates the key file referencing an object on a PKCS#11 token that
+// is passed as recipient or private key. The environment variables are set for
+// the PKCS#11 module when the key is used.
+func Pkcs11KeyFile(uri string, env map[string]string) ([]byte, error) {
+	if _, err := pkcs11.ParsePkcs11Uri(uri); err != nil {
+		return nil, err
+	}
+	var kf pkcs11.Pkcs11KeyFile
+	kf.Pkcs11.Uri = uri
+	kf.Module.Env = env
+	data, err := yaml.Marshal(&kf)
+	if err != nil {
+		return nil, err
+	}
+	if !encutils.IsPkcs11PrivateKey(data) {
+		return nil, errors.New("could not create a valid pkcs11 key file")
+	}
+	return data, nil
+}
+
+// Pkcs11KeyPair holds the key files of a key pair generated on a PKCS#11 token
+type Pkcs11KeyPair struct {
+	// Private is the pkcs11 key file of the private key object
+	Private []byte
+	// Public is the pkcs11 key file of the public key object
+	Public []byte
+	// PublicPEM is the PEM-encoded public key in PKIX format, which is used as
+	// recipient with pkcs11: without access to the token
+	PublicPEM []byte
+}
+
+// GeneratePkcs11KeyPair generates a key pair inside the PKCS#11 token selected
+// by the URI, whose object and id attributes name the new key objects and
+// whose query attributes select the module and PIN; the module must be allowed
+// by the configuration. The private key never leaves the token. The password
+// of the options is not used.
+func GeneratePkcs11KeyPair(uri string, env map[string]string, p11conf *pkcs11.Pkcs11Config, opts Options) (*Pkcs11KeyPair, error) {
+	p11uri, err := pkcs11.ParsePkcs11Uri(uri)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p11uri.GetPathAttribute("type", false); ok {
+		return nil, errors.New("the pkcs11 URI of a new key pair must not have a type attribute")
+	}
+	p11uri.SetEnvMap(env)
+	p11uri.SetModuleDirectories(p11conf.ModuleDirectories)
+	p11uri.SetAllowedModulePaths(p11conf.AllowedModulePaths)
+
+	var spec pkcs11pool.KeyPairSpec
+	switch strings.ToLower(opts.Type) {
+	case "", KeyTypeRSA:
+		spec.Bits = opts.Bits
+		if spec.Bits == 0 {
+			spec.Bits = DefaultRSABits
+		}
+	case KeyTypeECDSA:
+		if spec.Curve, err = parseCurve(opts.Curve); err != nil {
+			return nil, err
+		}
+	case KeyTypeEd25519:
+		return nil, ErrSignatureOnlyKey
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", opts.Type)
+	}
+	pub, err := pkcs11pool.GenerateKeyPair(p11uri, spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key on PKCS#11 token: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var kp Pkcs11KeyPair
+	for _, f := range []struct {
+		objectType string
+		data       *[]byte
+	}{{"private", &kp.Private}, {"public", &kp.Public}} {
+		if err := p11uri.AddPathAttribute("type", f.objectType); err != nil {
+			return nil, err
+		}
+		s, err := p11uri.Format()
+		if err != nil {
+			return nil, err
+		}
+		p11uri.RemovePathAttribute("type")
+		if *f.data, err = Pkcs11KeyFile(s, env); err != nil {
+			return nil, err
+		}
+	}
+	kp.PublicPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	})
+	return &kp, nil
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keygen
+
+import (
+	"testing"
+	"time"
+
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	for _, opts := range []Options{
+		{Type: KeyTypeRSA, Bits: 2048},
+		{Type: KeyTypeECDSA, Password: []byte("secret")},
+	} {
+		kp, err := GenerateKeyPair(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := encutils.IsPrivateKey(kp.Private, opts.Password); !ok {
+			t.Fatalf("%s: private key not accepted: %v", opts.Type, err)
+		}
+		if _, err := encutils.IsPrivateKey(kp.Private, nil); len(opts.Password) > 0 && !encutils.IsPasswordError(err) {
+			t.Fatalf("%s: expected password error, got %v", opts.Type, err)
+		}
+		if !encutils.IsPublicKey(kp.Public) {
+			t.Fatalf("%s: public key not accepted", opts.Type)
+		}
+		if opts.Type == KeyTypeRSA {
+			cert, err := kp.SelfSignedCertificate("test", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !encutils.IsCertificate(cert) {
+				t.Fatal("certificate not accepted")
+			}
+		}
+	}
+
+	if _, err := GenerateKeyPair(Options{Type: KeyTypeEd25519}); err != ErrSignatureOnlyKey {
+		t.Fatalf("expected ErrSignatureOnlyKey, got %v", err)
+	}
+}
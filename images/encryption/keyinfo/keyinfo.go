@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keyinfo identifies key and certificate files the way the recipient and
+// private key parsers classify them.
+package keyinfo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/gobars/ocicrypt/crypto/pkcs11"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Kinds of key files
+const (
+	KindPrivateKey        = "private key"
+	KindPublicKey         = "public key"
+	KindCertificate       = "x509 certificate"
+	KindPkcs11KeyFile     = "pkcs11 key file"
+	KindGPGPrivateKeyRing = "gpg private key ring"
+	KindGPGPublicKeyRing  = "gpg public key ring"
+	KindUnknown           = "unknown"
+)
+
+// KeyInfo describes a key or certificate file
+type KeyInfo struct {
+	Kind      string `json:"kind" yaml:"kind"`
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	// Encrypted is set for private keys that are protected with a password
+	Encrypted bool `json:"encrypted,omitempty" yaml:"encrypted,omitempty"`
+	// Fingerprint is the SHA-256 digest of the DER-encoded public key
+	Fingerprint string     `json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+	Subject     string     `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Issuer      string     `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	NotBefore   *time.Time `json:"notBefore,omitempty" yaml:"notBefore,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+	// KeyIDs holds the IDs of the keys in a GPG key ring
+	KeyIDs     []string `json:"keyIds,omitempty" yaml:"keyIds,omitempty"`
+	Identities []string `json:"identities,omitempty" yaml:"identities,omitempty"`
+	Pkcs11URI  string   `json:"pkcs11Uri,omitempty" yaml:"pkcs11Uri,omitempty"`
+	// Usage lists the command line arguments the file can be passed with
+	Usage []string `json:"usage,omitempty" yaml:"usage,omitempty"`
+	// Problems lists why the file is not accepted in other roles
+	Problems []string `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// Expired returns true if the file is a certificate that is not valid at the given time
+func (ki *KeyInfo) Expired(now time.Time) bool {
+	return (ki.NotAfter != nil && now.After(*ki.NotAfter)) || (ki.NotBefore != nil && now.Before(*ki.NotBefore))
+}
+
+// Inspect classifies the content of the key file at path in the same order as the
+// private key and recipient parsers do. The password is only needed to inspect
+// the algorithm of an encrypted private key.
+func Inspect(path string, data []byte, password []byte) KeyInfo {
+	ki := KeyInfo{Kind: KindUnknown}
+
+	if p11, err := pkcs11.ParsePkcs11KeyFile(data); err == nil {
+		ki.Kind = KindPkcs11KeyFile
+		if _, ok := p11.Uri.GetQueryAttribute("pin-value", false); ok {
+			ki.Problems = append(ki.Problems, "the pkcs11 URI holds the PIN in clear text; use pin-source=env:<variable> or pin-source=file:<path> instead")
+			p11.Uri.RemoveQueryAttribute("pin-value")
+		}
+		ki.Pkcs11URI, _ = p11.Uri.Format()
+		ki.Usage = []string{"--recipient pkcs11:" + path, "--key " + path}
+		return ki
+	}
+
+	priv, err := encutils.ParsePrivateKey(data, password, "")
+	if err == nil || encutils.IsPasswordError(err) {
+		ki.Kind = KindPrivateKey
+		ki.Encrypted = isEncryptedPEM(data)
+		if err == nil {
+			if signer, ok := priv.(interface{ Public() crypto.PublicKey }); ok {
+				describePublicKey(&ki, signer.Public())
+			}
+		} else {
+			ki.Problems = append(ki.Problems, "the private key is encrypted; a password is needed to use it")
+		}
+		usage := "--key " + path
+		if ki.Encrypted {
+			usage += ":pass=<password>"
+		}
+		ki.Usage = []string{usage}
+		return ki
+	}
+	ki.Problems = append(ki.Problems, "not a private key: "+parseProblem(data, err))
+
+	if entities, err := openpgp.ReadKeyRing(bytes.NewReader(data)); err == nil && len(entities) > 0 {
+		ki.Kind = KindGPGPublicKeyRing
+		for _, e := range entities {
+			if e.PrivateKey != nil {
+				ki.Kind = KindGPGPrivateKeyRing
+			}
+			ki.KeyIDs = append(ki.KeyIDs, e.PrimaryKey.KeyIdString())
+			for _, sk := range e.Subkeys {
+				ki.KeyIDs = append(ki.KeyIDs, sk.PublicKey.KeyIdString())
+			}
+			for name := range e.Identities {
+				ki.Identities = append(ki.Identities, name)
+			}
+		}
+		ki.Problems = nil
+		if fips.Enabled() {
+			ki.Problems = append(ki.Problems, "GPG keys cannot be used in FIPS mode")
+		}
+		if ki.Kind == KindGPGPrivateKeyRing {
+			ki.Usage = []string{"--key " + path}
+		} else {
+			ki.Problems = append(ki.Problems, "public GPG keys must be imported into the GPG keyring and are passed as --recipient pgp:<email>")
+		}
+		return ki
+	}
+
+	cert, err := encutils.ParseCertificate(data, "")
+	if err == nil {
+		ki.Kind = KindCertificate
+		ki.Subject = cert.Subject.String()
+		ki.Issuer = cert.Issuer.String()
+		ki.NotBefore = &cert.NotBefore
+		ki.NotAfter = &cert.NotAfter
+		ki.Problems = nil
+		describePublicKey(&ki, cert.PublicKey)
+		if fips.Enabled() {
+			ki.Problems = append(ki.Problems, "the certificate cannot be used as pkcs7 recipient in FIPS mode")
+		}
+		ki.Usage = []string{"--recipient pkcs7:" + path, "--dec-recipient " + path}
+		return ki
+	}
+	ki.Problems = append(ki.Problems, "not an x509 certificate: "+parseProblem(data, err))
+
+	pub, err := encutils.ParsePublicKey(data, "")
+	if err == nil {
+		ki.Kind = KindPublicKey
+		ki.Problems = nil
+		describePublicKey(&ki, pub)
+		ki.Usage = []string{"--recipient jwe:" + path}
+		if _, ok := pub.(*rsa.PublicKey); ok {
+			ki.Usage = append(ki.Usage, "--recipient pkcs11:"+path)
+		}
+		return ki
+	}
+	ki.Problems = append(ki.Problems, "not a public key: "+parseProblem(data, err))
+	return ki
+}
+
+// describePublicKey sets the algorithm and fingerprint of a public key and,
+// in FIPS mode, records keys that are not FIPS approved as problems
+func describePublicKey(ki *KeyInfo, pub interface{}) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		ki.Algorithm = fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		ki.Algorithm = "ECDSA-" + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		ki.Algorithm = "Ed25519"
+		ki.Problems = append(ki.Problems, "Ed25519 keys cannot be used to encrypt images")
+	default:
+		ki.Algorithm = strings.TrimPrefix(fmt.Sprintf("%T", pub), "*")
+	}
+	if fips.Enabled() {
+		if err := fips.CheckPublicKey(pub); err != nil {
+			ki.Problems = append(ki.Problems, err.Error())
+		}
+	}
+	if der, err := x509.MarshalPKIXPublicKey(pub); err == nil {
+		sum := sha256.Sum256(der)
+		ki.Fingerprint = "SHA256:" + hex.EncodeToString(sum[:])
+	}
+}
+
+// isEncryptedPEM returns true if data holds a password-protected PEM block
+func isEncryptedPEM(data []byte) bool {
+	return bytes.Contains(data, []byte("Proc-Type: 4,ENCRYPTED"))
+}
+
+// parseProblem explains why a parser rejected data. Errors of parsers that fall back
+// to other formats for data that is not PEM encoded only describe the last format
+// tried, so they are replaced with a summary.
+func parseProblem(data []byte, err error) string {
+	if block, _ := pem.Decode(data); block == nil {
+		return "the data is neither PEM encoded nor in any of the other supported formats"
+	}
+	return strings.TrimPrefix(err.Error(), ": ")
+}
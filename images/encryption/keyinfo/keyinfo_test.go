@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyinfo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keygen"
+)
+
+func TestInspect(t *testing.T) {
+	kp, err := keygen.GenerateKeyPair(keygen.Options{Type: keygen.KeyTypeECDSA, Password: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv := Inspect("key.pem", kp.Private, nil)
+	if priv.Kind != KindPrivateKey || !priv.Encrypted || priv.Algorithm != "" {
+		t.Fatalf("unexpected info for encrypted private key: %+v", priv)
+	}
+	priv = Inspect("key.pem", kp.Private, []byte("secret"))
+	if priv.Algorithm != "ECDSA-P-256" {
+		t.Fatalf("unexpected info for private key: %+v", priv)
+	}
+
+	pub := Inspect("key.pub.pem", kp.Public, nil)
+	if pub.Kind != KindPublicKey || pub.Fingerprint != priv.Fingerprint || pub.Usage[0] != "--recipient jwe:key.pub.pem" {
+		t.Fatalf("unexpected info for public key: %+v", pub)
+	}
+
+	kp, err = keygen.GenerateKeyPair(keygen.Options{Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := kp.SelfSignedCertificate("test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := Inspect("key.crt.pem", cert, nil)
+	if ci.Kind != KindCertificate || ci.Algorithm != "RSA-2048" || ci.Expired(time.Now()) || !ci.Expired(time.Now().Add(2*time.Hour)) {
+		t.Fatalf("unexpected info for certificate: %+v", ci)
+	}
+
+	if ui := Inspect("garbage", []byte("garbage"), nil); ui.Kind != KindUnknown || len(ui.Problems) != 3 {
+		t.Fatalf("unexpected info for garbage: %+v", ui)
+	}
+}
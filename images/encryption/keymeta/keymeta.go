@@ -0,0 +1,541 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keymeta describes the wrapped keys of an encrypted layer in a
+// versioned annotation: the wrap scheme, algorithm and its parameters and the
+// key ID of each recipient, and when the layer keys were wrapped.
+//
+// Layers encrypted before the annotation was introduced, version 1, only have
+// the wrapped keys themselves; their metadata is derived by parsing them.
+// Version 2 metadata is written when layer keys are wrapped, so that readers
+// do not depend on the format of the wrapped keys of each scheme, and holds
+// the key IDs and hints that let decryptors try the right private key first.
+package keymeta
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/threshold"
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/blockcipher"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocix509 "github.com/gobars/ocicrypt/crypto/x509"
+	encutils "github.com/gobars/ocicrypt/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Annotation holds the metadata of the wrapped keys of a layer as JSON;
+	// like all annotations of the encryption it is removed on decryption
+	Annotation = "org.opencontainers.image.enc.meta"
+
+	// Version1 is the version of metadata derived from the wrapped keys
+	Version1 = 1
+	// Version2 is the version of the metadata written by this package
+	Version2 = 2
+
+	annotationPubOpts = "org.opencontainers.image.enc.pubopts"
+)
+
+// ErrUnsupportedVersion is returned for metadata written in a newer version
+var ErrUnsupportedVersion = errors.New("unsupported key metadata version")
+
+// Metadata describes the wrapped keys of a layer
+type Metadata struct {
+	Version int `json:"version"`
+	// Created is when the layer keys were wrapped; unknown for version 1
+	Created *time.Time `json:"created,omitempty"`
+	// Cipher is the cipher the layer data is encrypted with
+	Cipher string `json:"cipher,omitempty"`
+	Keys   []Key  `json:"keys"`
+	// Context is the encryption context the layer keys are bound to, recorded
+	// for audit; it is authenticated only when a layer key is unwrapped
+	Context map[string]string `json:"context,omitempty"`
+	// Groups are the recipient groups the layer keys were wrapped for with
+	// the recipients they had when the layer was encrypted, described like
+	// Keys
+	Groups map[string][]Key `json:"groups,omitempty"`
+}
+
+// Key describes the layer key wrapped for one recipient, or for all recipients
+// of schemes whose wrapped keys do not tell them apart
+type Key struct {
+	Scheme string `json:"scheme"`
+	// Algorithm is the key management algorithm, e.g. RSA-OAEP or ECDH-ES+A256KW
+	Algorithm string `json:"algorithm,omitempty"`
+	// Parameters of the algorithm, such as the curve or the RSA key size
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// KeyID identifies the key of the recipient, see KeyID
+	KeyID string `json:"keyId,omitempty"`
+	// Hint helps to find the key of the recipient without revealing who the
+	// recipient is, such as the digest of the subject of a certificate or of
+	// the key reference given to a keyprovider
+	Hint string `json:"hint,omitempty"`
+}
+
+// Read returns the metadata of the layer from its annotation, or derives it
+// from the wrapped keys for layers without one
+func Read(desc ocispec.Descriptor) (*Metadata, error) {
+	s, ok := desc.Annotations[Annotation]
+	if !ok {
+		return Derive(desc)
+	}
+	var md Metadata
+	if err := json.Unmarshal([]byte(s), &md); err != nil {
+		return nil, fmt.Errorf("could not parse annotation %s: %w", Annotation, err)
+	}
+	if md.Version > Version2 {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, md.Version)
+	}
+	return &md, nil
+}
+
+// Derive returns version 1 metadata derived from the wrapped keys of the layer
+func Derive(desc ocispec.Descriptor) (*Metadata, error) {
+	hybrid.Install()
+	threshold.Install()
+	md := &Metadata{Version: Version1, Keys: []Key{}}
+	if b64 := desc.Annotations[annotationPubOpts]; b64 != "" {
+		var pubOpts blockcipher.PublicLayerBlockCipherOptions
+		if data, err := base64.StdEncoding.DecodeString(b64); err == nil && json.Unmarshal(data, &pubOpts) == nil {
+			md.Cipher = string(pubOpts.CipherType)
+		}
+	}
+	wrappedKeys := ocicrypt.GetWrappedKeysMap(desc)
+	schemes := make([]string, 0, len(wrappedKeys))
+	for scheme := range wrappedKeys {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	for _, scheme := range schemes {
+		keys, err := describe(scheme, wrappedKeys[scheme])
+		if err != nil {
+			return nil, fmt.Errorf("could not describe %s wrapped keys: %w", scheme, err)
+		}
+		md.Keys = append(md.Keys, keys...)
+	}
+	return md, nil
+}
+
+// New returns version 2 metadata of the layer whose keys were just wrapped
+// with the EncryptConfig, with the key IDs of the recipients it holds
+func New(desc ocispec.Descriptor, ec *encconfig.EncryptConfig, created time.Time) (*Metadata, error) {
+	md, err := Derive(desc)
+	if err != nil {
+		return nil, err
+	}
+	md.Version = Version2
+	created = created.UTC()
+	md.Created = &created
+	if ec == nil {
+		return md, nil
+	}
+	if c, err := enccontext.FromParameters(ec.Parameters); err == nil && len(c) > 0 {
+		md.Context = c
+	}
+	if data := ec.Parameters[groupsParameter]; len(data) > 0 {
+		if err := json.Unmarshal(data[0], &md.Groups); err != nil {
+			return nil, fmt.Errorf("invalid recipient groups: %w", err)
+		}
+	}
+	// the wrapped keys are in the order of the recipients
+	setKeyIDs(md, "jwe", keyIDs(ec.Parameters["pubkeys"], "JWE"))
+	setKeyIDs(md, "pkcs11", keyIDs(ec.Parameters["pkcs11-pubkeys"], "PKCS11"))
+	// a PKCS#7 envelope does not tell its recipients apart
+	var pkcs7Keys []Key
+	for _, cert := range certificates(ec.Parameters["x509s"]) {
+		k := Key{Scheme: "pkcs7", Algorithm: "PKCS7", Hint: hint("subject", cert.RawSubject)}
+		k.KeyID, _ = KeyID(cert.PublicKey)
+		pkcs7Keys = append(pkcs7Keys, k)
+	}
+	md.expand("pkcs7", pkcs7Keys)
+	// keyproviders wrap the layer key for all their recipients at once
+	for _, k := range md.Keys {
+		name := strings.TrimPrefix(k.Scheme, "provider.")
+		if name == k.Scheme {
+			continue
+		}
+		var keys []Key
+		for _, r := range ec.Parameters[name] {
+			keys = append(keys, Key{Scheme: k.Scheme, Hint: RecipientHint(r)})
+		}
+		md.expand(k.Scheme, keys)
+	}
+	return md, nil
+}
+
+// Annotate sets the metadata annotation of the layer
+func Annotate(desc *ocispec.Descriptor, md *Metadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	if desc.Annotations == nil {
+		desc.Annotations = make(map[string]string)
+	}
+	desc.Annotations[Annotation] = string(data)
+	return nil
+}
+
+// Append returns the metadata of the wrapped keys of md followed by those of
+// other, which were wrapped for additional recipients with the same layer key
+// and appended to the wrapped keys of md scheme by scheme
+func Append(md, other *Metadata) *Metadata {
+	merged := *md
+	merged.Version = Version2
+	if merged.Created == nil {
+		merged.Created = other.Created
+	}
+	if merged.Cipher == "" {
+		merged.Cipher = other.Cipher
+	}
+	if merged.Context == nil {
+		merged.Context = other.Context
+	}
+	if len(other.Groups) > 0 {
+		merged.Groups = make(map[string][]Key, len(md.Groups)+len(other.Groups))
+		for name, keys := range md.Groups {
+			merged.Groups[name] = keys
+		}
+		for name, keys := range other.Groups {
+			if _, ok := merged.Groups[name]; !ok {
+				merged.Groups[name] = keys
+			}
+		}
+	}
+	byScheme := make(map[string][]Key)
+	for _, k := range append(append([]Key{}, md.Keys...), other.Keys...) {
+		byScheme[k.Scheme] = append(byScheme[k.Scheme], k)
+	}
+	schemes := make([]string, 0, len(byScheme))
+	for scheme := range byScheme {
+		schemes = append(schemes, scheme)
+	}
+	// the keys are ordered by scheme like those of Derive
+	sort.Strings(schemes)
+	merged.Keys = make([]Key, 0, len(md.Keys)+len(other.Keys))
+	for _, scheme := range schemes {
+		merged.Keys = append(merged.Keys, byScheme[scheme]...)
+	}
+	return &merged
+}
+
+// groupsParameter is the EncryptConfig parameter holding the members of the
+// recipient groups
+const groupsParameter = "imgcrypt-recipient-groups"
+
+// SetGroups records the members of the recipient groups the layer keys are
+// wrapped for in the parameters of an EncryptConfig, for the metadata of the
+// layers
+func SetGroups(params map[string][][]byte, groups map[string][]Key) error {
+	data, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	params[groupsParameter] = [][]byte{data}
+	return nil
+}
+
+// PublicKeyID returns the ID of the public key in data, which is a public key
+// or a certificate
+func PublicKeyID(data []byte) (string, error) {
+	if key, err := encutils.ParsePublicKey(data, "recipient"); err == nil {
+		return KeyID(key)
+	}
+	cert, err := encutils.ParseCertificate(data, "recipient")
+	if err != nil {
+		return "", err
+	}
+	return KeyID(cert.PublicKey)
+}
+
+// KeyID returns the ID of a public key, the SHA-256 digest of its DER encoded
+// SubjectPublicKeyInfo, so that keys are identified the same way regardless
+// of whether they are given as public keys or in certificates
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// keyIDs returns the IDs of the public keys, or nil if one cannot be parsed
+func keyIDs(pubKeys [][]byte, prefix string) []string {
+	var ids []string
+	for _, data := range pubKeys {
+		key, err := encutils.ParsePublicKey(data, prefix)
+		if err != nil {
+			return nil
+		}
+		id, err := KeyID(key)
+		if err != nil {
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// certificates returns the parsed certificates, or nil if one cannot be parsed
+func certificates(certs [][]byte) []*ocix509.Certificate {
+	var parsed []*ocix509.Certificate
+	for _, data := range certs {
+		cert, err := encutils.ParseCertificate(data, "PKCS7")
+		if err != nil {
+			return nil
+		}
+		parsed = append(parsed, cert)
+	}
+	return parsed
+}
+
+// RecipientHint returns the hint of the key wrapped by a keyprovider for the
+// key reference it was given as recipient
+func RecipientHint(ref []byte) string {
+	return hint("recipient", ref)
+}
+
+// hint returns a hint of the given kind holding the digest of data
+func hint(kind string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return kind + ":sha256:" + hex.EncodeToString(sum[:])
+}
+
+// expand replaces the single key of a scheme whose wrapped key does not tell
+// its recipients apart with the given keys, one for each recipient
+func (md *Metadata) expand(scheme string, keys []Key) {
+	if len(keys) == 0 {
+		return
+	}
+	var n int
+	for _, k := range md.Keys {
+		if k.Scheme == scheme {
+			n++
+		}
+	}
+	if n != 1 {
+		return
+	}
+	expanded := make([]Key, 0, len(md.Keys)+len(keys)-1)
+	for _, k := range md.Keys {
+		if k.Scheme == scheme {
+			expanded = append(expanded, keys...)
+		} else {
+			expanded = append(expanded, k)
+		}
+	}
+	md.Keys = expanded
+}
+
+// setKeyIDs sets the key IDs of the keys of the scheme if there are as many
+// IDs as keys
+func setKeyIDs(md *Metadata, scheme string, ids []string) {
+	var idx []int
+	for i, k := range md.Keys {
+		if k.Scheme == scheme {
+			idx = append(idx, i)
+		}
+	}
+	if len(ids) == 0 || len(ids) != len(idx) {
+		return
+	}
+	for n, i := range idx {
+		md.Keys[i].KeyID = ids[n]
+	}
+}
+
+// describe returns the keys of the comma separated, base64 encoded wrapped
+// keys of the scheme
+func describe(scheme, b64s string) ([]Key, error) {
+	if scheme == "pgp" {
+		ids, err := ocicrypt.GetKeyWrapper(scheme).GetRecipients(b64s)
+		if err != nil {
+			return nil, err
+		}
+		var keys []Key
+		for _, id := range ids {
+			keys = append(keys, Key{Scheme: scheme, Algorithm: "OpenPGP", KeyID: id})
+		}
+		return keys, nil
+	}
+	var keys []Key
+	for _, b64 := range strings.Split(b64s, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, err
+		}
+		switch scheme {
+		case "jwe", "jwe-hybrid":
+			ks, err := describeJWE(scheme, data)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, ks...)
+		case "pkcs11":
+			ks, err := describePkcs11(data)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, ks...)
+		case "pkcs7":
+			keys = append(keys, Key{Scheme: scheme, Algorithm: "PKCS7"})
+		case threshold.Scheme:
+			ks, err := describeThreshold(data)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, ks...)
+		default:
+			// keyproviders and other schemes wrap keys in their own formats
+			keys = append(keys, Key{Scheme: scheme})
+		}
+	}
+	return keys, nil
+}
+
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Epk *struct {
+		Crv string `json:"crv"`
+	} `json:"epk,omitempty"`
+}
+
+func (h *jweHeader) merge(other jweHeader) {
+	if h.Alg == "" {
+		h.Alg = other.Alg
+	}
+	if h.Kid == "" {
+		h.Kid = other.Kid
+	}
+	if h.Epk == nil {
+		h.Epk = other.Epk
+	}
+}
+
+type jweRecipient struct {
+	Header       jweHeader `json:"header"`
+	EncryptedKey string    `json:"encrypted_key"`
+}
+
+// describeJWE returns a key for each recipient of the JSON serialized JWE
+func describeJWE(scheme string, data []byte) ([]Key, error) {
+	var jwe struct {
+		Protected   string          `json:"protected"`
+		Unprotected jweHeader       `json:"unprotected"`
+		Recipients  []jweRecipient  `json:"recipients"`
+		Header      jweHeader       `json:"header"`
+		Key         json.RawMessage `json:"encrypted_key"`
+	}
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return nil, fmt.Errorf("could not parse JWE: %w", err)
+	}
+	var shared jweHeader
+	if jwe.Protected != "" {
+		protected, err := base64.RawURLEncoding.DecodeString(jwe.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode protected header of JWE: %w", err)
+		}
+		if err := json.Unmarshal(protected, &shared); err != nil {
+			return nil, fmt.Errorf("could not parse protected header of JWE: %w", err)
+		}
+	}
+	shared.merge(jwe.Unprotected)
+	recipients := jwe.Recipients
+	if recipients == nil {
+		// flattened serialization with a single recipient
+		r := jweRecipient{Header: jwe.Header}
+		_ = json.Unmarshal(jwe.Key, &r.EncryptedKey)
+		recipients = []jweRecipient{r}
+	}
+	var keys []Key
+	for _, r := range recipients {
+		r.Header.merge(shared)
+		k := Key{Scheme: scheme, Algorithm: r.Header.Alg, KeyID: r.Header.Kid}
+		switch {
+		case r.Header.Epk != nil && r.Header.Epk.Crv != "":
+			k.Parameters = map[string]string{"curve": r.Header.Epk.Crv}
+		case strings.HasPrefix(r.Header.Alg, "RSA"):
+			// the RSA encrypted key is as long as the modulus
+			if ek, err := base64.RawURLEncoding.DecodeString(r.EncryptedKey); err == nil {
+				k.Parameters = map[string]string{"bits": strconv.Itoa(len(ek) * 8)}
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// describeThreshold returns a key for each recipient of a share of the
+// threshold wrapped keys
+func describeThreshold(data []byte) ([]Key, error) {
+	var wk struct {
+		Groups []struct {
+			Threshold int `json:"threshold"`
+			Shares    []struct {
+				Kid string `json:"kid"`
+				Alg string `json:"alg"`
+			} `json:"shares"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(data, &wk); err != nil {
+		return nil, fmt.Errorf("could not parse threshold wrapped keys: %w", err)
+	}
+	var keys []Key
+	for _, g := range wk.Groups {
+		params := map[string]string{"threshold": strconv.Itoa(g.Threshold), "shares": strconv.Itoa(len(g.Shares))}
+		for _, s := range g.Shares {
+			keys = append(keys, Key{Scheme: threshold.Scheme, Algorithm: s.Alg, KeyID: s.Kid, Parameters: params})
+		}
+	}
+	return keys, nil
+}
+
+// describePkcs11 returns a key for each recipient of a pkcs11 blob
+func describePkcs11(data []byte) ([]Key, error) {
+	var blob struct {
+		Recipients []struct {
+			Hash string `json:"hash,omitempty"`
+		} `json:"recipients"`
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("could not parse pkcs11 blob: %w", err)
+	}
+	var keys []Key
+	for _, r := range blob.Recipients {
+		hash := r.Hash
+		if hash == "" {
+			hash = "sha1"
+		}
+		keys = append(keys, Key{Scheme: "pkcs11", Algorithm: "RSA-OAEP", Parameters: map[string]string{"hash": hash}})
+	}
+	return keys, nil
+}
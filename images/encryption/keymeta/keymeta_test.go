@@ -0,0 +1,189 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keymeta
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func publicKeyPEM(t *testing.T, pub interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// encryptLayer encrypts a layer for the public keys and returns its descriptor
+func encryptLayer(t *testing.T, pubKeys ...[]byte) (ocispec.Descriptor, *encconfig.EncryptConfig) {
+	t.Helper()
+	cc, err := encconfig.EncryptWithJwe(pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("layer")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	r, finalizer, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	desc.Annotations, err = finalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc, cc.EncryptConfig
+}
+
+func TestDeriveAndNew(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, ec := encryptLayer(t, publicKeyPEM(t, &rsaKey.PublicKey), publicKeyPEM(t, &ecKey.PublicKey))
+
+	md, err := Read(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Version != Version1 || md.Created != nil {
+		t.Fatalf("expected derived version 1 metadata, got %+v", md)
+	}
+	if md.Cipher != "AES_256_CTR_HMAC_SHA256" {
+		t.Fatalf("unexpected cipher %q", md.Cipher)
+	}
+	if len(md.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %+v", md.Keys)
+	}
+	if k := md.Keys[0]; k.Scheme != "jwe" || k.Algorithm != "RSA-OAEP" || k.Parameters["bits"] != "2048" || k.KeyID != "" {
+		t.Fatalf("unexpected RSA key %+v", k)
+	}
+	if k := md.Keys[1]; k.Algorithm != "ECDH-ES+A256KW" || k.Parameters["curve"] != "P-384" {
+		t.Fatalf("unexpected EC key %+v", k)
+	}
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	md, err = New(desc, ec, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Annotate(&desc, md); err != nil {
+		t.Fatal(err)
+	}
+	md, err = Read(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Version != Version2 || md.Created == nil || !md.Created.Equal(created) {
+		t.Fatalf("expected version 2 metadata created at %s, got %+v", created, md)
+	}
+	for i, pub := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		id, err := KeyID(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Keys[i].KeyID != id {
+			t.Fatalf("expected key ID %s for key %d, got %s", id, i, md.Keys[i].KeyID)
+		}
+	}
+
+	groups := map[string][]Key{"team": {{Scheme: "jwe", KeyID: md.Keys[0].KeyID}, {Scheme: "pgp", Hint: "sha256:00"}}}
+	if err := SetGroups(ec.Parameters, groups); err != nil {
+		t.Fatal(err)
+	}
+	md, err = New(desc, ec, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md.Groups, groups) {
+		t.Fatalf("expected groups %+v, got %+v", groups, md.Groups)
+	}
+}
+
+func TestReadUnsupportedVersion(t *testing.T) {
+	desc := ocispec.Descriptor{Annotations: map[string]string{Annotation: `{"version":3,"keys":[]}`}}
+	if _, err := Read(desc); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	md := &Metadata{
+		Version: Version1,
+		Cipher:  "AES_256_CTR_HMAC_SHA256",
+		Keys: []Key{
+			{Scheme: "jwe", KeyID: "a"},
+			{Scheme: "provider.kms", Hint: "ref:1"},
+		},
+	}
+	other := &Metadata{
+		Version: Version2,
+		Created: &created,
+		Keys: []Key{
+			{Scheme: "jwe", KeyID: "b"},
+			{Scheme: "pkcs7", KeyID: "c"},
+		},
+		Groups: map[string][]Key{"nodes": {{Scheme: "jwe", KeyID: "b"}}},
+	}
+	merged := Append(md, other)
+	want := []Key{
+		{Scheme: "jwe", KeyID: "a"},
+		{Scheme: "jwe", KeyID: "b"},
+		{Scheme: "pkcs7", KeyID: "c"},
+		{Scheme: "provider.kms", Hint: "ref:1"},
+	}
+	if !reflect.DeepEqual(merged.Keys, want) {
+		t.Fatalf("expected keys %+v, got %+v", want, merged.Keys)
+	}
+	if merged.Version != Version2 || merged.Created == nil || !merged.Created.Equal(created) || merged.Cipher != md.Cipher {
+		t.Fatalf("unexpected metadata %+v", merged)
+	}
+	if len(merged.Groups["nodes"]) != 1 {
+		t.Fatalf("expected the groups of the appended metadata, got %+v", merged.Groups)
+	}
+	if len(md.Keys) != 2 || md.Version != Version1 {
+		t.Fatal("Append changed its argument")
+	}
+}
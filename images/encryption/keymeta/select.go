@@ -0,0 +1,315 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keymeta
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/crypto/jose"
+	"github.com/gobars/ocicrypt/keywrap"
+	encutils "github.com/gobars/ocicrypt/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// selectingSchemes are the schemes that try all private keys in the
+// "privkeys" parameter, with the prefix ocicrypt parses their keys with
+var selectingSchemes = map[string]string{
+	"jwe":   "JWE",
+	"pkcs7": "PKCS7",
+}
+
+var (
+	registeredMu sync.Mutex
+	// registered holds the key IDs of the recipients of the wrapped keys
+	// of the layers being decrypted, by the digest of the wrapped keys
+	registered = make(map[[sha256.Size]byte][]string)
+)
+
+// Register makes the key IDs in the metadata of the layer available to the
+// key wrappers installed by Install until the returned function is called
+func Register(desc ocispec.Descriptor) func() {
+	md, err := Read(desc)
+	if err != nil || md.Version < Version2 {
+		return func() {}
+	}
+	var ks [][sha256.Size]byte
+	registeredMu.Lock()
+	for scheme, b64s := range ocicrypt.GetWrappedKeysMap(desc) {
+		if _, ok := selectingSchemes[scheme]; !ok {
+			continue
+		}
+		ids := md.keyIDs(scheme)
+		if ids == nil {
+			continue
+		}
+		for _, b64 := range strings.Split(b64s, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				continue
+			}
+			k := sha256.Sum256(wrapped)
+			registered[k] = ids
+			ks = append(ks, k)
+		}
+	}
+	registeredMu.Unlock()
+	return func() {
+		registeredMu.Lock()
+		defer registeredMu.Unlock()
+		for _, k := range ks {
+			delete(registered, k)
+		}
+	}
+}
+
+// keyIDs returns the key IDs of the recipients of the scheme, or nil if any of
+// them is unknown
+func (md *Metadata) keyIDs(scheme string) []string {
+	var ids []string
+	for _, k := range md.Keys {
+		if k.Scheme != scheme {
+			continue
+		}
+		if k.KeyID == "" {
+			return nil
+		}
+		ids = append(ids, k.KeyID)
+	}
+	return ids
+}
+
+// keyWrapper tries the private keys that the key metadata names as recipients
+// before all others, so that keys of other recipients are neither tried nor
+// parsed, which fails for keys whose password is not known, and never tries
+// keys whose type or size does not fit any recipient of the wrapped key
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers of the schemes that try every private key so
+// that they skip the keys that cannot unwrap a wrapped key and first try those
+// that the metadata of the layer registered with Register names as
+// recipients. It must be called after the other key wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for scheme := range selectingSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, wrapped []byte) ([]byte, error) {
+	registeredMu.Lock()
+	ids := registered[sha256.Sum256(wrapped)]
+	registeredMu.Unlock()
+	fit := fitting(kw.scheme, wrapped)
+	if ids == nil && fit == nil {
+		return kw.KeyWrapper.UnwrapKey(dc, wrapped)
+	}
+	ctx := tracing.Context(dc)
+	l := logging.G(ctx)
+	prefix := selectingSchemes[kw.scheme]
+	recipients, candidates := selectPrivateKeys(dc, ids, fit, prefix)
+	total := len(dc.Parameters["privkeys"])
+	n := len(candidates.Parameters["privkeys"])
+	if n == 0 && total > 0 {
+		l.Debug("no private key fits the recipients of the wrapped key", "scheme", kw.scheme, "keys", total)
+		return nil, fmt.Errorf("%s: no suitable private key found for decryption: none of the %d private keys fits the recipients", prefix, total)
+	}
+	if recipients != nil {
+		l.Debug("trying private keys that are recipients according to the key metadata", "scheme", kw.scheme, "keys", len(recipients.Parameters["privkeys"]), "of", total)
+		optsData, err := kw.unwrapKey(ctx, recipients, wrapped)
+		if err == nil {
+			return optsData, nil
+		}
+		// the metadata is not authenticated and may be wrong
+		l.Debug("unwrapping with the selected private keys failed, trying all fitting keys", "scheme", kw.scheme, "error", err)
+	} else if ids != nil {
+		l.Debug("no private key is a recipient according to the key metadata", "scheme", kw.scheme)
+	}
+	if n < total {
+		l.Debug("skipping private keys that do not fit the recipients of the wrapped key", "scheme", kw.scheme, "skipped", total-n, "of", total)
+	}
+	return kw.unwrapKey(ctx, candidates, wrapped)
+}
+
+// unwrapKey unwraps the key with the private keys of dc, a copy of the
+// configuration bound to ctx
+func (kw *keyWrapper) unwrapKey(ctx context.Context, dc *encconfig.DecryptConfig, wrapped []byte) ([]byte, error) {
+	defer tracing.Bind(ctx, dc)()
+	return kw.KeyWrapper.UnwrapKey(dc, wrapped)
+}
+
+// fitting returns a function that reports whether a parsed private key can be
+// used to unwrap the wrapped key of the scheme judging by its type and size,
+// or nil if that cannot be told
+func fitting(scheme string, wrapped []byte) func(key interface{}) bool {
+	switch scheme {
+	case "pkcs7":
+		// PKCS7 envelopes only have RSA recipients
+		return func(key interface{}) bool {
+			_, ok := key.(*rsa.PrivateKey)
+			return ok
+		}
+	case "jwe":
+		recipients, err := describeJWE(scheme, wrapped)
+		if err != nil {
+			return nil
+		}
+		return func(key interface{}) bool {
+			for _, r := range recipients {
+				if fits(r, key) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return nil
+}
+
+// fits returns whether the private key can unwrap the key of the JWE recipient
+func fits(r Key, key interface{}) bool {
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	switch {
+	case strings.HasPrefix(r.Algorithm, "RSA"):
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			// the bits of a recipient are those of the modulus in whole bytes
+			bits := r.Parameters["bits"]
+			return bits == "" || bits == strconv.Itoa((k.N.BitLen()+7)/8*8)
+		case *ecdsa.PrivateKey:
+			return false
+		}
+	case strings.HasPrefix(r.Algorithm, "ECDH-ES"):
+		switch k := key.(type) {
+		case *ecdsa.PrivateKey:
+			curve := r.Parameters["curve"]
+			return curve == "" || curve == k.Curve.Params().Name
+		case *rsa.PrivateKey:
+			return false
+		}
+	}
+	return true
+}
+
+// selectPrivateKeys returns copies of dc with the private keys that may be
+// used to unwrap a key. The first one holds the keys whose public keys are
+// among the recipients with the given key IDs, followed by those that cannot
+// be parsed, such as keys whose password is not known; it is nil if no key is
+// known to be a recipient. The second one holds all keys that fit the
+// recipients according to fit, if given, followed by those that cannot be
+// parsed.
+func selectPrivateKeys(dc *encconfig.DecryptConfig, ids []string, fit func(key interface{}) bool, prefix string) (*encconfig.DecryptConfig, *encconfig.DecryptConfig) {
+	recipientIDs := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		recipientIDs[id] = struct{}{}
+	}
+	passwords := dc.Parameters["privkeys-passwords"]
+	var recipients, candidates, unknown privateKeys
+	for i, priv := range dc.Parameters["privkeys"] {
+		var pwd []byte
+		if i < len(passwords) {
+			pwd = passwords[i]
+		}
+		key, err := encutils.ParsePrivateKey(priv, pwd, prefix)
+		if err != nil {
+			unknown.add(priv, pwd)
+			continue
+		}
+		if fit != nil && !fit(key) {
+			continue
+		}
+		candidates.add(priv, pwd)
+		if _, ok := recipientIDs[PrivateKeyID(key)]; ok {
+			recipients.add(priv, pwd)
+		}
+	}
+	candidates.append(unknown)
+	if len(recipients.keys) == 0 {
+		return nil, candidates.config(dc)
+	}
+	recipients.append(unknown)
+	return recipients.config(dc), candidates.config(dc)
+}
+
+// privateKeys are private keys with their passwords
+type privateKeys struct {
+	keys, passwords [][]byte
+}
+
+func (pk *privateKeys) add(key, password []byte) {
+	pk.keys = append(pk.keys, key)
+	pk.passwords = append(pk.passwords, password)
+}
+
+func (pk *privateKeys) append(other privateKeys) {
+	pk.keys = append(pk.keys, other.keys...)
+	pk.passwords = append(pk.passwords, other.passwords...)
+}
+
+// config returns a copy of dc with the private keys
+func (pk *privateKeys) config(dc *encconfig.DecryptConfig) *encconfig.DecryptConfig {
+	params := make(map[string][][]byte, len(dc.Parameters))
+	for k, v := range dc.Parameters {
+		params[k] = v
+	}
+	params["privkeys"] = pk.keys
+	if len(dc.Parameters["privkeys-passwords"]) > 0 {
+		params["privkeys-passwords"] = pk.passwords
+	}
+	return &encconfig.DecryptConfig{Parameters: params}
+}
+
+// PrivateKeyID returns the key ID of the public key of the parsed private key,
+// or an empty string if it is not known
+func PrivateKeyID(key interface{}) string {
+	var pub crypto.PublicKey
+	switch k := key.(type) {
+	case crypto.Signer:
+		pub = k.Public()
+	case *jose.JSONWebKey:
+		pub = k.Public().Key
+	default:
+		return ""
+	}
+	id, err := KeyID(pub)
+	if err != nil {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keymeta
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSelectPrivateKeys(t *testing.T) {
+	var keys []*rsa.PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	recipient, other, locked := keys[0], keys[1], keys[2]
+
+	desc, ec := encryptLayer(t, publicKeyPEM(t, &recipient.PublicKey))
+	md, err := New(desc, ec, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Annotate(&desc, md); err != nil {
+		t.Fatal(err)
+	}
+
+	//nolint:staticcheck // encrypted PEM blocks are what users pass
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(locked), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPEM := func(k *rsa.PrivateKey) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	}
+	// without the selection, the locked key with the wrong password would be
+	// tried first and fail the unwrapping
+	dc := &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"privkeys":           {pem.EncodeToMemory(block), privPEM(other), privPEM(recipient)},
+		"privkeys-passwords": {[]byte("wrong"), nil, nil},
+	}}
+
+	selected, _ := selectPrivateKeys(dc, md.keyIDs("jwe"), nil, "JWE")
+	if selected == nil || len(selected.Parameters["privkeys"]) != 2 {
+		t.Fatal("expected the recipient and the locked key to be selected")
+	}
+	if !bytes.Equal(selected.Parameters["privkeys"][0], privPEM(recipient)) {
+		t.Fatal("expected the recipient key to be tried first")
+	}
+
+	Install()
+	defer Register(desc)()
+	if _, _, err := ocicrypt.DecryptLayer(dc, nil, desc, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFittingPrivateKeys(t *testing.T) {
+	recipient, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	larger, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER})
+	privPEM := func(k *rsa.PrivateKey) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	}
+
+	// layers encrypted before the key metadata existed are read as version 1
+	desc, _ := encryptLayer(t, publicKeyPEM(t, &recipient.PublicKey))
+	wrapped := wrappedKey(t, desc, "jwe")
+
+	dc := &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"privkeys":           {ecPEM, privPEM(larger), privPEM(recipient)},
+		"privkeys-passwords": {nil, nil, nil},
+	}}
+	_, candidates := selectPrivateKeys(dc, nil, fitting("jwe", wrapped), "JWE")
+	if keys := candidates.Parameters["privkeys"]; len(keys) != 1 || !bytes.Equal(keys[0], privPEM(recipient)) {
+		t.Fatalf("expected only the 2048 bit RSA key to fit, got %d keys", len(keys))
+	}
+
+	Install()
+	if _, _, err := ocicrypt.DecryptLayer(dc, nil, desc, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dc.Parameters["privkeys"] = [][]byte{ecPEM, privPEM(larger)}
+	dc.Parameters["privkeys-passwords"] = [][]byte{nil, nil}
+	kw := ocicrypt.GetKeyWrapper("jwe")
+	if _, err := kw.UnwrapKey(dc, wrapped); err == nil || !strings.Contains(err.Error(), "none of the 2 private keys fits") {
+		t.Fatalf("expected the unwrapping to fail without trying keys, got %v", err)
+	}
+}
+
+// wrappedKey returns the single wrapped key of the scheme of the layer
+func wrappedKey(t *testing.T, desc ocispec.Descriptor, scheme string) []byte {
+	t.Helper()
+	b64s := ocicrypt.GetWrappedKeysMap(desc)[scheme]
+	wrapped, err := base64.StdEncoding.DecodeString(b64s)
+	if err != nil || strings.Contains(b64s, ",") {
+		t.Fatalf("expected a single wrapped %s key", scheme)
+	}
+	return wrapped
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	keyproviderconfig "github.com/gobars/ocicrypt/config/keyprovider-config"
+)
+
+// Config is the ocicrypt keyprovider configuration with the settings imgcrypt
+// adds for securing gRPC providers; ocicrypt ignores these settings
+type Config struct {
+	KeyProviders map[string]ProviderConfig `json:"key-providers"`
+}
+
+// ProviderConfig configures a single keyprovider
+type ProviderConfig struct {
+	keyproviderconfig.KeyProviderAttrs
+	// TLS enables TLS for a gRPC provider
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// TokenFile holds a bearer token sent to a gRPC provider with every call;
+	// it is read for every call so that it can be rotated
+	TokenFile string `json:"token-file,omitempty"`
+	// Policy bounds the time spent calling the provider
+	Policy *CallPolicy `json:"policy,omitempty"`
+}
+
+// TLSConfig holds the TLS settings of a client of a gRPC provider or key server
+type TLSConfig struct {
+	// CAFile is a bundle of CA certificates to verify the provider with; the
+	// system roots are used if it is empty
+	CAFile string `json:"ca-file,omitempty"`
+	// CertFile and KeyFile are the client certificate and key for mutual TLS
+	CertFile   string `json:"cert-file,omitempty"`
+	KeyFile    string `json:"key-file,omitempty"`
+	ServerName string `json:"server-name,omitempty"`
+}
+
+// CallPolicy configures the timeout, retries and circuit breaker of calls to
+// a provider
+type CallPolicy struct {
+	// Timeout bounds each attempt at calling the provider
+	Timeout Duration `json:"timeout,omitempty"`
+	// Retries is the number of times a failed call is retried, waiting Backoff
+	// before the first retry and doubling the wait up to MaxBackoff after that
+	Retries    int      `json:"retries,omitempty"`
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max-backoff,omitempty"`
+	// FailureThreshold is the number of consecutive failed calls after which
+	// calls fail immediately for Cooldown, before a single call is let through
+	// to probe the provider; zero disables the circuit breaker
+	FailureThreshold int      `json:"failure-threshold,omitempty"`
+	Cooldown         Duration `json:"cooldown,omitempty"`
+}
+
+// Duration is a time.Duration given as a string such as "1m30s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var configPath atomic.Pointer[string]
+
+// SetConfigPath makes LoadConfig read the keyprovider configuration from path
+// instead of the file named by OCICRYPT_KEYPROVIDER_CONFIG; it must be called
+// before Install
+func SetConfigPath(path string) {
+	configPath.Store(&path)
+}
+
+// ConfigPath returns the path of the keyprovider configuration, the one set
+// with SetConfigPath or else the one named by OCICRYPT_KEYPROVIDER_CONFIG
+func ConfigPath() string {
+	if p := configPath.Load(); p != nil && *p != "" {
+		return *p
+	}
+	return os.Getenv(keyproviderconfig.ENVVARNAME)
+}
+
+// LoadConfig loads the keyprovider configuration at ConfigPath; it returns
+// nil if there is none
+func LoadConfig() (*Config, error) {
+	filename := ConfigPath()
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse keyprovider configuration %s: %w", filename, err)
+	}
+	for name, pc := range c.KeyProviders {
+		if err := pc.validate(); err != nil {
+			return nil, fmt.Errorf("keyprovider %s: %w", name, err)
+		}
+	}
+	return &c, nil
+}
+
+func (pc *ProviderConfig) validate() error {
+	if pc.Policy != nil {
+		if err := pc.Policy.validate(); err != nil {
+			return err
+		}
+	}
+	if pc.TLS == nil && pc.TokenFile == "" {
+		return nil
+	}
+	if pc.Grpc == "" {
+		return errors.New("tls and token-file are only supported for grpc providers")
+	}
+	if pc.TokenFile != "" && pc.TLS == nil {
+		return errors.New("a bearer token is only sent over TLS")
+	}
+	if (pc.TLS.CertFile == "") != (pc.TLS.KeyFile == "") {
+		return errors.New("cert-file and key-file must be given together")
+	}
+	return nil
+}
+
+func (cp *CallPolicy) validate() error {
+	if cp.Timeout < 0 || cp.Backoff < 0 || cp.MaxBackoff < 0 || cp.Cooldown < 0 {
+		return errors.New("policy durations must not be negative")
+	}
+	if cp.Retries < 0 || cp.FailureThreshold < 0 {
+		return errors.New("retries and failure-threshold must not be negative")
+	}
+	return nil
+}
+
+// managed returns whether the provider needs to be called by imgcrypt rather
+// than by ocicrypt
+func (pc *ProviderConfig) managed() bool {
+	return pc.TLS != nil || pc.Policy != nil
+}
+
+// ClientConfig builds the client TLS configuration
+func (c *TLSConfig) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", path)
+	}
+	return token, nil
+}
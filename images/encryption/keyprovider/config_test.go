@@ -0,0 +1,48 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "keyprovider.json")
+	if err := os.WriteFile(configFile, []byte(`{"key-providers":{"test":{"cmd":{"path":"/bin/true"}}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OCICRYPT_KEYPROVIDER_CONFIG", filepath.Join(dir, "missing.json"))
+	defer SetConfigPath("")
+
+	if c, err := LoadConfig(); err != nil || c != nil {
+		t.Fatalf("expected no configuration, got %+v, %v", c, err)
+	}
+	SetConfigPath(configFile)
+	c, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.KeyProviders["test"].Command == nil {
+		t.Fatalf("expected the configuration at the path set, got %+v", c)
+	}
+	if os.Getenv("OCICRYPT_KEYPROVIDER_CONFIG") == configFile {
+		t.Fatal("expected the environment to be left as it is")
+	}
+}
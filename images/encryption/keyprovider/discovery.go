@@ -0,0 +1,72 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+)
+
+const (
+	// DefaultDiscoveryDir is the directory scanned for the unix sockets of
+	// gRPC keyproviders
+	DefaultDiscoveryDir = "/run/imgcrypt/providers"
+	// DiscoveryDirEnv overrides DefaultDiscoveryDir; an empty value disables
+	// discovery
+	DiscoveryDirEnv = "IMGCRYPT_KEYPROVIDER_DIR"
+
+	handshakeTimeout = 2 * time.Second
+)
+
+func discoveryDir() string {
+	if dir, ok := os.LookupEnv(DiscoveryDirEnv); ok {
+		return dir
+	}
+	return DefaultDiscoveryDir
+}
+
+// Discover returns the gRPC keyproviders listening on the <name>.sock unix
+// sockets in dir; as a handshake each is sent the capabilities operation,
+// and only those answering it with the batch protocol version are returned
+func Discover(ctx context.Context, dir string) map[string]*Provider {
+	found := make(map[string]*Provider)
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sock"))
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".sock")
+		p := &Provider{Name: name}
+		p.Config.Grpc = "unix://" + path
+
+		hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		out, err := p.call(hctx, Input{Version: ProtocolVersion, Operation: OpCapabilities})
+		cancel()
+		if err != nil || out.Version < ProtocolVersion {
+			logging.G(ctx).Debug("ignoring socket that failed the keyprovider handshake", "socket", path, "error", err)
+			continue
+		}
+		p.once.Do(func() { p.caps = out })
+		found[name] = p
+	}
+	return found
+}
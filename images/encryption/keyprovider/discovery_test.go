@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+	keyproviderpb "github.com/gobars/ocicrypt/utils/keyprovider"
+	"google.golang.org/grpc"
+)
+
+// socketServer answers the handshake and unwraps keys if batch is set, and
+// only knows the per-layer protocol otherwise
+type socketServer struct {
+	keyproviderpb.UnimplementedKeyProviderServiceServer
+	batch bool
+}
+
+func (s *socketServer) UnWrapKey(_ context.Context, in *keyproviderpb.KeyProviderKeyWrapProtocolInput) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+	var batch Input
+	json.Unmarshal(in.KeyProviderKeyWrapProtocolInput, &batch)
+	var out interface{}
+	if batch.Operation == OpCapabilities {
+		if !s.batch {
+			return nil, errors.New("unknown operation")
+		}
+		out = Output{Version: ProtocolVersion}
+	} else {
+		var input ocikeyprovider.KeyProviderKeyWrapProtocolInput
+		if err := json.Unmarshal(in.KeyProviderKeyWrapProtocolInput, &input); err != nil {
+			return nil, err
+		}
+		var o ocikeyprovider.KeyProviderKeyWrapProtocolOutput
+		o.KeyUnwrapResults.OptsData = append([]byte("key-"), input.KeyUnwrapParams.Annotation...)
+		out = o
+	}
+	data, err := json.Marshal(out)
+	return &keyproviderpb.KeyProviderKeyWrapProtocolOutput{KeyProviderKeyWrapProtocolOutput: data}, err
+}
+
+func serveSocket(t *testing.T, path string, s *socketServer) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	keyproviderpb.RegisterKeyProviderServiceServer(srv, s)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	serveSocket(t, filepath.Join(dir, "good.sock"), &socketServer{batch: true})
+	serveSocket(t, filepath.Join(dir, "legacy.sock"), &socketServer{})
+	if err := os.WriteFile(filepath.Join(dir, "file.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	found := Discover(context.Background(), dir)
+	if len(found) != 1 || found["good"] == nil {
+		t.Fatalf("expected to discover only the good provider, got %v", found)
+	}
+
+	kw := &providerKeyWrapper{p: found["good"]}
+	optsData, err := kw.UnwrapKey(&encconfig.DecryptConfig{}, []byte("a1"))
+	if err != nil || string(optsData) != "key-a1" {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+}
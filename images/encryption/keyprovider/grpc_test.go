@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+	keyproviderpb "github.com/gobars/ocicrypt/utils/keyprovider"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testServer struct {
+	keyproviderpb.UnimplementedKeyProviderServiceServer
+}
+
+func (*testServer) UnWrapKey(ctx context.Context, in *keyproviderpb.KeyProviderKeyWrapProtocolInput) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer secret" {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	var input ocikeyprovider.KeyProviderKeyWrapProtocolInput
+	if err := json.Unmarshal(in.KeyProviderKeyWrapProtocolInput, &input); err != nil {
+		return nil, err
+	}
+	var out ocikeyprovider.KeyProviderKeyWrapProtocolOutput
+	out.KeyUnwrapResults.OptsData = append([]byte("key-"), input.KeyUnwrapParams.Annotation...)
+	data, err := json.Marshal(out)
+	return &keyproviderpb.KeyProviderKeyWrapProtocolOutput{KeyProviderKeyWrapProtocolOutput: data}, err
+}
+
+// writeCert creates a certificate signed by parent, or a self-signed CA if
+// parent is nil, and writes it and its key to dir
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key
+}
+
+func TestGrpcMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	keyproviderpb.RegisterKeyProviderServiceServer(srv, &testServer{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	pc := ProviderConfig{
+		TLS: &TLSConfig{
+			CAFile:   filepath.Join(dir, "ca.pem"),
+			CertFile: filepath.Join(dir, "client.pem"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		},
+		TokenFile: tokenFile,
+	}
+	pc.Grpc = l.Addr().String()
+	if err := pc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	kw := &providerKeyWrapper{p: &Provider{Name: "test", Config: pc}}
+	dc := &encconfig.DecryptConfig{}
+
+	optsData, err := kw.UnwrapKey(dc, []byte("a1"))
+	if err != nil || string(optsData) != "key-a1" {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+
+	// without a client certificate the handshake fails
+	noCert := pc
+	noCert.TLS = &TLSConfig{CAFile: pc.TLS.CAFile}
+	kw = &providerKeyWrapper{p: &Provider{Name: "test", Config: noCert}}
+	if _, err := kw.UnwrapKey(dc, []byte("a1")); err == nil {
+		t.Fatal("expected call without client certificate to fail")
+	}
+
+	// with a wrong token the call is rejected
+	if err := os.WriteFile(tokenFile, []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kw = &providerKeyWrapper{p: &Provider{Name: "test", Config: pc}}
+	if _, err := kw.UnwrapKey(dc, []byte("a1")); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated error, got %v", err)
+	}
+
+	noTLS := ProviderConfig{TokenFile: tokenFile}
+	noTLS.Grpc = pc.Grpc
+	if err := noTLS.validate(); err == nil {
+		t.Fatal("expected a token without TLS to be rejected")
+	}
+}
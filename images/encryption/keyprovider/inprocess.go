@@ -0,0 +1,137 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// KeyProvider wraps and unwraps layer keys within the process; it is the Go
+// counterpart of a keyprovider command or gRPC server
+type KeyProvider interface {
+	// WrapKey wraps the layer key described by optsData for the recipients
+	// given to the provider in ec.Parameters and returns the annotation
+	WrapKey(ctx context.Context, ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error)
+	// UnwrapKey returns the layer key described by optsData that was wrapped
+	// into annotation
+	UnwrapKey(ctx context.Context, dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error)
+}
+
+var (
+	registeredMu sync.RWMutex
+	registered   = make(map[string]KeyProvider)
+)
+
+// RegisterKeyProvider makes impl the keyprovider with the given name, taking
+// precedence over a provider of that name in the keyprovider configuration;
+// it must be called before images are encrypted or decrypted, typically from
+// an init function
+func RegisterKeyProvider(name string, impl KeyProvider) {
+	registeredMu.Lock()
+	registered[name] = impl
+	registeredMu.Unlock()
+	register("provider."+name, &prefetchingKeyWrapper{&inProcessKeyWrapper{name: name, impl: impl}, "provider." + name})
+}
+
+// isRegistered returns whether the named provider was registered in-process
+func isRegistered(name string) bool {
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+	_, ok := registered[name]
+	return ok
+}
+
+// inProcessKeyWrapper calls a KeyProvider registered with RegisterKeyProvider
+type inProcessKeyWrapper struct {
+	noKeys
+	name string
+	impl KeyProvider
+}
+
+func (kw *inProcessKeyWrapper) GetAnnotationID() string {
+	return AnnotationPrefix + kw.name
+}
+
+func (kw *inProcessKeyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	if _, ok := ec.Parameters[kw.name]; !ok {
+		return nil, nil
+	}
+	annotation, err := kw.impl.WrapKey(tracing.Context(ec), ec, optsData)
+	if err != nil {
+		return nil, fmt.Errorf("keyprovider %s: %w", kw.name, err)
+	}
+	return annotation, nil
+}
+
+func (kw *inProcessKeyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, err := kw.impl.UnwrapKey(tracing.Context(dc), dc, annotation)
+	if err != nil {
+		return nil, fmt.Errorf("keyprovider %s: %w", kw.name, err)
+	}
+	return optsData, nil
+}
+
+// Decorator wraps the key wrapper of the keyprovider with the given scheme
+type Decorator func(scheme string, kw keywrap.KeyWrapper) keywrap.KeyWrapper
+
+var (
+	decoratorsMu sync.Mutex
+	decorators   []Decorator
+)
+
+// Decorate wraps the key wrappers of all keyproviders with d, both those
+// registered so far and those registered later, since keyproviders may be
+// registered at any time; decorators are applied in the order they are added
+func Decorate(d Decorator) {
+	Install()
+	decoratorsMu.Lock()
+	defer decoratorsMu.Unlock()
+	decorators = append(decorators, d)
+	names := make(map[string]bool)
+	for name := range providers {
+		names[name] = true
+	}
+	registeredMu.RLock()
+	for name := range registered {
+		names[name] = true
+	}
+	registeredMu.RUnlock()
+	for name := range names {
+		scheme := "provider." + name
+		if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+			ocicrypt.RegisterKeyWrapper(scheme, d(scheme, kw))
+		}
+	}
+}
+
+// register registers the key wrapper of a keyprovider with ocicrypt, wrapped
+// by the decorators
+func register(scheme string, kw keywrap.KeyWrapper) {
+	decoratorsMu.Lock()
+	defer decoratorsMu.Unlock()
+	for _, d := range decorators {
+		kw = d(scheme, kw)
+	}
+	ocicrypt.RegisterKeyWrapper(scheme, kw)
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// reversingProvider "wraps" keys by reversing them
+type reversingProvider struct{}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+func (reversingProvider) WrapKey(_ context.Context, _ *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	return reverse(optsData), nil
+}
+
+func (reversingProvider) UnwrapKey(_ context.Context, _ *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	if len(annotation) == 0 {
+		return nil, errors.New("empty annotation")
+	}
+	return reverse(annotation), nil
+}
+
+func TestRegisterKeyProvider(t *testing.T) {
+	RegisterKeyProvider("inproc", reversingProvider{})
+
+	kw := ocicrypt.GetKeyWrapper("provider.inproc")
+	if kw == nil {
+		t.Fatal("key wrapper was not registered")
+	}
+	if id := kw.GetAnnotationID(); id != AnnotationPrefix+"inproc" {
+		t.Fatalf("got annotation ID %s", id)
+	}
+
+	annotation, err := kw.WrapKeys(&encconfig.EncryptConfig{}, []byte("key"))
+	if err != nil || annotation != nil {
+		t.Fatalf("expected no annotation without recipients, got %q, %v", annotation, err)
+	}
+	ec := &encconfig.EncryptConfig{Parameters: map[string][][]byte{"inproc": {[]byte("Enabled")}}}
+	annotation, err = kw.WrapKeys(ec, []byte("key"))
+	if err != nil || !bytes.Equal(annotation, []byte("yek")) {
+		t.Fatalf("got %q, %v", annotation, err)
+	}
+
+	dc := &encconfig.DecryptConfig{}
+	optsData, err := kw.UnwrapKey(dc, annotation)
+	if err != nil || !bytes.Equal(optsData, []byte("key")) {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+	if _, err := kw.UnwrapKey(dc, nil); err == nil {
+		t.Fatal("expected provider error to be returned")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestHelperProvider is run as the keyprovider command by TestPrefetch
+func TestHelperProvider(t *testing.T) {
+	logFile := os.Getenv("IMGCRYPT_TEST_KEYPROVIDER_LOG")
+	if logFile == "" {
+		return
+	}
+	data, _ := io.ReadAll(os.Stdin)
+	var in Input
+	json.Unmarshal(data, &in)
+
+	f, _ := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	fmt.Fprintln(f, in.Operation)
+	f.Close()
+
+	var out interface{}
+	switch in.Operation {
+	case OpCapabilities:
+		out = Output{Version: ProtocolVersion, Capabilities: []string{OpKeyUnwrapBatch}, MaxBatchSize: 2}
+	case OpKeyUnwrapBatch:
+		o := Output{Version: ProtocolVersion}
+		for _, a := range in.KeyUnwrapBatchParams.Annotations {
+			o.KeyUnwrapBatchResults = append(o.KeyUnwrapBatchResults, BatchResult{OptsData: append([]byte("key-"), a...)})
+		}
+		out = o
+	default:
+		var v1 ocikeyprovider.KeyProviderKeyWrapProtocolInput
+		json.Unmarshal(data, &v1)
+		o := ocikeyprovider.KeyProviderKeyWrapProtocolOutput{}
+		o.KeyUnwrapResults.OptsData = append([]byte("key-"), v1.KeyUnwrapParams.Annotation...)
+		out = o
+	}
+	json.NewEncoder(os.Stdout).Encode(out)
+	os.Exit(0)
+}
+
+func TestPrefetch(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "calls")
+	config, err := json.Marshal(map[string]interface{}{
+		"key-providers": map[string]interface{}{
+			"test": map[string]interface{}{
+				"cmd": map[string]interface{}{
+					"path": os.Args[0],
+					"args": []string{"-test.run=^TestHelperProvider$"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "ocicrypt.conf")
+	if err := os.WriteFile(configFile, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OCICRYPT_KEYPROVIDER_CONFIG", configFile)
+	t.Setenv("IMGCRYPT_TEST_KEYPROVIDER_LOG", logFile)
+
+	var descs []ocispec.Descriptor
+	for _, a := range []string{"a1", "a2", "a3"} {
+		descs = append(descs, ocispec.Descriptor{
+			Annotations: map[string]string{AnnotationPrefix + "test": base64.StdEncoding.EncodeToString([]byte(a))},
+		})
+	}
+	dc := &encconfig.DecryptConfig{Parameters: map[string][][]byte{"test": {[]byte("Enabled")}}}
+
+	release := Prefetch(context.Background(), dc, descs)
+	defer release()
+
+	calls := func() []string {
+		data, _ := os.ReadFile(logFile)
+		return strings.Fields(string(data))
+	}
+	want := []string{OpCapabilities, OpKeyUnwrapBatch, OpKeyUnwrapBatch}
+	if got := calls(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+
+	kw := ocicrypt.GetKeyWrapper("provider.test")
+	optsData, err := kw.UnwrapKey(dc, []byte("a2"))
+	if err != nil || string(optsData) != "key-a2" {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+	if n := len(calls()); n != len(want) {
+		t.Fatalf("prefetched key was not used, got %d calls", n)
+	}
+
+	// the key was used up, so the provider is called for it again
+	optsData, err = kw.UnwrapKey(dc, []byte("a2"))
+	if err != nil || string(optsData) != "key-a2" {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+	if n := len(calls()); n != len(want)+1 {
+		t.Fatalf("expected a per-layer call, got %d calls", n)
+	}
+}
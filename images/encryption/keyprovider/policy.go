@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned without calling a provider that failed too often
+var ErrCircuitOpen = errors.New("keyprovider circuit breaker is open")
+
+const (
+	defaultBackoff    = 200 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+	defaultCooldown   = 30 * time.Second
+)
+
+// breaker is a circuit breaker counting consecutive failed calls
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns whether a call may be made; once the cooldown has passed a
+// single call is allowed to probe the provider
+func (b *breaker) allow(threshold int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold <= 0 || b.failures < threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) record(err error, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if threshold > 0 && b.failures >= threshold {
+		b.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// exchange sends input to the provider under its call policy; wrap selects
+// the WrapKey method of gRPC providers
+func (p *Provider) exchange(ctx context.Context, wrap bool, input []byte) ([]byte, error) {
+	cp := p.Config.Policy
+	if cp == nil {
+		return p.send(ctx, wrap, input)
+	}
+	cooldown := time.Duration(cp.Cooldown)
+	if cooldown == 0 {
+		cooldown = defaultCooldown
+	}
+	if !p.breaker.allow(cp.FailureThreshold) {
+		return nil, ErrCircuitOpen
+	}
+
+	backoff, maxBackoff := time.Duration(cp.Backoff), time.Duration(cp.MaxBackoff)
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	var (
+		data []byte
+		err  error
+	)
+	for attempt := 0; ; attempt++ {
+		data, err = p.attempt(ctx, wrap, input)
+		if err == nil || attempt >= cp.Retries || !retryable(err) {
+			break
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			err = ctx.Err()
+		case <-t.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	p.breaker.record(err, cp.FailureThreshold, cooldown)
+	return data, err
+}
+
+// attempt makes a single call bounded by the timeout of the call policy
+func (p *Provider) attempt(ctx context.Context, wrap bool, input []byte) ([]byte, error) {
+	if p.Config.Policy == nil {
+		return p.send(ctx, wrap, input)
+	}
+	if timeout := time.Duration(p.Config.Policy.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return p.send(ctx, wrap, input)
+}
+
+// retryable returns whether a failed call may succeed when retried; requests
+// the provider rejected as invalid or unauthorized are not retried
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	keyproviderconfig "github.com/gobars/ocicrypt/config/keyprovider-config"
+)
+
+func shellProvider(script string, cp *CallPolicy) *Provider {
+	p := &Provider{Name: "test"}
+	p.Config.Command = &keyproviderconfig.Command{Path: "/bin/sh", Args: []string{"-c", script}}
+	p.Config.Policy = cp
+	return p
+}
+
+func TestCallPolicy(t *testing.T) {
+	ctx := context.Background()
+	marker := filepath.Join(t.TempDir(), "called")
+
+	// the first call fails and is retried
+	p := shellProvider("if [ -e "+marker+" ]; then cat; else touch "+marker+"; exit 1; fi",
+		&CallPolicy{Retries: 1, Backoff: Duration(time.Millisecond)})
+	data, err := p.exchange(ctx, false, []byte("input"))
+	if err != nil || string(data) != "input" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	// a hanging provider is cut off by the timeout
+	p = shellProvider("exec sleep 10", &CallPolicy{Timeout: Duration(100 * time.Millisecond)})
+	start := time.Now()
+	if _, err := p.exchange(ctx, false, nil); err == nil {
+		t.Fatal("expected call to time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("call took %v despite timeout", d)
+	}
+
+	// consecutive failures open the circuit until the cooldown has passed
+	p = shellProvider("exit 1", &CallPolicy{FailureThreshold: 2, Cooldown: Duration(100 * time.Millisecond)})
+	for i := 0; i < 2; i++ {
+		if _, err := p.exchange(ctx, false, nil); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: expected provider failure, got %v", i, err)
+		}
+	}
+	if _, err := p.exchange(ctx, false, nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	p.Config.Command.Args[1] = "cat"
+	if data, err := p.exchange(ctx, false, []byte("probe")); err != nil || string(data) != "probe" {
+		t.Fatalf("probe: got %q, %v", data, err)
+	}
+	if _, err := p.exchange(ctx, false, nil); err != nil {
+		t.Fatalf("expected closed circuit, got %v", err)
+	}
+}
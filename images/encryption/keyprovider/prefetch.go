@@ -0,0 +1,226 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/metrics"
+	"github.com/containerd/imgcrypt/images/encryption/securemem"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationPrefix prefixes the names of the keyprovider annotations of layers
+const AnnotationPrefix = "org.opencontainers.image.enc.keys.provider."
+
+var (
+	installOnce sync.Once
+	providers   map[string]*Provider
+
+	cacheMu sync.Mutex
+	cache   = make(map[[sha256.Size]byte][]byte)
+)
+
+// Install replaces the keyprovider key wrappers of ocicrypt with ones that use
+// the layer keys unwrapped ahead of time by Prefetch and that call providers
+// with imgcrypt's TLS settings and call policy when configured to, adds the
+// providers found by Discover, and returns them all; providers registered
+// with RegisterKeyProvider are left alone and configured providers take
+// precedence over discovered ones
+func Install() map[string]*Provider {
+	installOnce.Do(func() {
+		providers = make(map[string]*Provider)
+		c, err := LoadConfig()
+		if err != nil {
+			logging.G(context.Background()).Error("failed to load keyprovider configuration", "error", err)
+			return
+		}
+		if c != nil {
+			for name, pc := range c.KeyProviders {
+				if isRegistered(name) {
+					continue
+				}
+				p := &Provider{Name: name, Config: pc}
+				providers[name] = p
+				var kw keywrap.KeyWrapper
+				if pc.managed() {
+					kw = &providerKeyWrapper{p: p}
+				} else {
+					kw = ocikeyprovider.NewKeyWrapper(name, pc.KeyProviderAttrs)
+				}
+				register("provider."+name, &prefetchingKeyWrapper{kw, "provider." + name})
+			}
+		}
+		if dir := discoveryDir(); dir != "" {
+			for name, p := range Discover(context.Background(), dir) {
+				if _, ok := providers[name]; ok || isRegistered(name) {
+					continue
+				}
+				providers[name] = p
+				register("provider."+name, &prefetchingKeyWrapper{&providerKeyWrapper{p: p}, "provider." + name})
+			}
+		}
+	})
+	return providers
+}
+
+// UnwrappedKey is a layer key unwrapped ahead of time with the annotation it
+// was unwrapped from
+type UnwrappedKey struct {
+	Annotation []byte
+	OptsData   []byte
+}
+
+// UnwrapBatch unwraps the keyprovider wrapped keys of the given layers with one
+// batch call per provider, for those providers that support it; the keys of
+// other providers and those that failed are left to the per-layer unwrapping
+func UnwrapBatch(ctx context.Context, dc *encconfig.DecryptConfig, descs []ocispec.Descriptor) []UnwrappedKey {
+	var keys []UnwrappedKey
+	for name, p := range Install() {
+		if isRegistered(name) {
+			continue
+		}
+		var annotations [][]byte
+		for _, desc := range descs {
+			b64s := desc.Annotations[AnnotationPrefix+name]
+			if b64s == "" {
+				continue
+			}
+			for _, b64 := range strings.Split(b64s, ",") {
+				if a, err := base64.StdEncoding.DecodeString(b64); err == nil {
+					annotations = append(annotations, a)
+				}
+			}
+		}
+		if len(annotations) < 2 || !p.Supports(ctx, OpKeyUnwrapBatch) {
+			continue
+		}
+		results, err := p.UnwrapKeys(ctx, dc, annotations)
+		if err != nil {
+			logging.G(ctx).Debug("batch unwrapping failed, falling back to unwrapping per layer", "provider", name, "error", err)
+			continue
+		}
+		for i, r := range results {
+			if r.Error == "" && r.OptsData != nil {
+				keys = append(keys, UnwrappedKey{Annotation: annotations[i], OptsData: r.OptsData})
+			}
+		}
+	}
+	return keys
+}
+
+// Seed makes the keys available once each to the per-layer unwrapping of
+// ocicrypt with the given DecryptConfig; the keys are moved out of the Go heap
+// and the returned function drops those that were not used and zeroes all
+func Seed(dc *encconfig.DecryptConfig, keys []UnwrappedKey) func() {
+	Install()
+	ks := make([][sha256.Size]byte, 0, len(keys))
+	protected := make([][]byte, 0, len(keys))
+	cacheMu.Lock()
+	for _, key := range keys {
+		k := cacheKey(dc, key.Annotation)
+		optsData, err := securemem.Protect(key.OptsData)
+		if err != nil {
+			optsData = key.OptsData
+		}
+		cache[k] = optsData
+		ks = append(ks, k)
+		protected = append(protected, optsData)
+	}
+	cacheMu.Unlock()
+	return func() {
+		cacheMu.Lock()
+		for _, k := range ks {
+			delete(cache, k)
+		}
+		cacheMu.Unlock()
+		for _, optsData := range protected {
+			securemem.Release(optsData)
+		}
+	}
+}
+
+// Prefetch unwraps the keys of the layers with UnwrapBatch and seeds them for
+// their per-layer unwrapping
+func Prefetch(ctx context.Context, dc *encconfig.DecryptConfig, descs []ocispec.Descriptor) func() {
+	return Seed(dc, UnwrapBatch(ctx, dc, descs))
+}
+
+// cacheKey binds a prefetched key to the annotation and the DecryptConfig it
+// was unwrapped with
+func cacheKey(dc *encconfig.DecryptConfig, annotation []byte) [sha256.Size]byte {
+	h := sha256.New()
+	params, _ := json.Marshal(dc.Parameters)
+	h.Write(params)
+	h.Write([]byte{0})
+	h.Write(annotation)
+	var k [sha256.Size]byte
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// prefetchingKeyWrapper unwraps keys from the prefetched keys before calling
+// the provider, and records the lookups and the time taken by the provider
+type prefetchingKeyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+func (kw *prefetchingKeyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) (annotation []byte, err error) {
+	ctx, span := tracing.Start(tracing.Context(ec), "imgcrypt.WrapKeys", tracing.SchemeKey.String(kw.scheme))
+	defer func() { tracing.End(span, err) }()
+	defer tracing.Bind(ctx, ec)()
+	return kw.KeyWrapper.WrapKeys(ec, optsData)
+}
+
+func (kw *prefetchingKeyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) (optsData []byte, err error) {
+	k := cacheKey(dc, annotation)
+	cacheMu.Lock()
+	optsData, ok := cache[k]
+	delete(cache, k)
+	cacheMu.Unlock()
+	metrics.CacheLookup(ok)
+	l := logging.G(tracing.Context(dc))
+	if ok {
+		l.Debug("using layer key unwrapped ahead of time", "scheme", kw.scheme)
+		return optsData, nil
+	}
+	ctx, span := tracing.Start(tracing.Context(dc), "imgcrypt.UnwrapKey", tracing.SchemeKey.String(kw.scheme))
+	defer func() { tracing.End(span, err) }()
+	defer tracing.Bind(ctx, dc)()
+	start := time.Now()
+	defer func() { metrics.ObserveUnwrap(kw.scheme, time.Since(start)) }()
+	l.Debug("attempting to unwrap layer key", "scheme", kw.scheme)
+	optsData, err = kw.KeyWrapper.UnwrapKey(dc, annotation)
+	if err != nil {
+		l.Debug("unwrapping layer key failed", "scheme", kw.scheme, "error", err)
+		return nil, err
+	}
+	l.Debug("unwrapped layer key", "scheme", kw.scheme)
+	return optsData, nil
+}
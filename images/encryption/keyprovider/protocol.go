@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keyprovider implements version 2 of the keyprovider protocol, which
+// wraps and unwraps the keys of many layers in a single call to a provider.
+// Providers announce support for it with the capabilities operation; providers
+// that do not know it are used with the per-layer protocol of ocicrypt.
+package keyprovider
+
+import (
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// ProtocolVersion is the version of the batch protocol
+const ProtocolVersion = 2
+
+// Operations of the batch protocol
+const (
+	OpCapabilities   = "capabilities"
+	OpKeyWrapBatch   = "keywrap-batch"
+	OpKeyUnwrapBatch = "keyunwrap-batch"
+)
+
+// Input is the message sent to a provider; like the messages of the per-layer
+// protocol it is passed as JSON on stdin of command providers and in the
+// input bytes of the WrapKey and UnWrapKey methods of gRPC providers
+type Input struct {
+	Version              int                   `json:"version"`
+	Operation            string                `json:"op"`
+	KeyWrapBatchParams   *KeyWrapBatchParams   `json:"keywrapbatchparams,omitempty"`
+	KeyUnwrapBatchParams *KeyUnwrapBatchParams `json:"keyunwrapbatchparams,omitempty"`
+}
+
+// KeyWrapBatchParams holds the layer keys to wrap for the recipients of ec
+type KeyWrapBatchParams struct {
+	Ec       *encconfig.EncryptConfig `json:"ec"`
+	OptsData [][]byte                 `json:"optsdata"`
+}
+
+// KeyUnwrapBatchParams holds the annotations to unwrap the layer keys of
+type KeyUnwrapBatchParams struct {
+	Dc          *encconfig.DecryptConfig `json:"dc"`
+	Annotations [][]byte                 `json:"annotations"`
+}
+
+// Output is the answer of a provider to an Input
+type Output struct {
+	Version int `json:"version"`
+	// Capabilities lists the batch operations the provider supports
+	Capabilities []string `json:"capabilities,omitempty"`
+	// MaxBatchSize limits the number of items per call; 0 means no limit
+	MaxBatchSize          int           `json:"maxbatchsize,omitempty"`
+	KeyWrapBatchResults   []BatchResult `json:"keywrapbatchresults,omitempty"`
+	KeyUnwrapBatchResults []BatchResult `json:"keyunwrapbatchresults,omitempty"`
+}
+
+// BatchResult is the result for one item of a batch, in the order of the input
+type BatchResult struct {
+	Annotation []byte `json:"annotation,omitempty"`
+	OptsData   []byte `json:"optsdata,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	encconfig "github.com/gobars/ocicrypt/config"
+	keyproviderconfig "github.com/gobars/ocicrypt/config/keyprovider-config"
+	keyproviderpb "github.com/gobars/ocicrypt/utils/keyprovider"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrBatchNotSupported is returned if a provider does not support a batch operation
+var ErrBatchNotSupported = errors.New("batch operation not supported by keyprovider")
+
+// Provider is a keyprovider as configured in the ocicrypt keyprovider configuration
+type Provider struct {
+	Name   string
+	Config ProviderConfig
+
+	once    sync.Once
+	caps    *Output
+	breaker breaker
+}
+
+// Capabilities returns the batch capabilities of the provider; they are
+// negotiated on first use, and a provider that only speaks the per-layer
+// protocol has none
+func (p *Provider) Capabilities(ctx context.Context) *Output {
+	p.once.Do(func() {
+		out, err := p.call(ctx, Input{Version: ProtocolVersion, Operation: OpCapabilities})
+		if err != nil || out.Version < ProtocolVersion {
+			out = &Output{}
+		}
+		p.caps = out
+	})
+	return p.caps
+}
+
+// Supports returns whether the provider supports the given batch operation
+func (p *Provider) Supports(ctx context.Context, op string) bool {
+	for _, c := range p.Capabilities(ctx).Capabilities {
+		if c == op {
+			return true
+		}
+	}
+	return false
+}
+
+// WrapKeys wraps the given layer keys with as few calls as the provider allows
+func (p *Provider) WrapKeys(ctx context.Context, ec *encconfig.EncryptConfig, optsData [][]byte) ([]BatchResult, error) {
+	return p.batch(ctx, OpKeyWrapBatch, len(optsData), func(i, j int) (Input, func(*Output) []BatchResult) {
+		return Input{
+			Version:            ProtocolVersion,
+			Operation:          OpKeyWrapBatch,
+			KeyWrapBatchParams: &KeyWrapBatchParams{Ec: ec, OptsData: optsData[i:j]},
+		}, func(o *Output) []BatchResult {
+			return o.KeyWrapBatchResults
+		}
+	})
+}
+
+// UnwrapKeys unwraps the given annotations with as few calls as the provider allows
+func (p *Provider) UnwrapKeys(ctx context.Context, dc *encconfig.DecryptConfig, annotations [][]byte) ([]BatchResult, error) {
+	return p.batch(ctx, OpKeyUnwrapBatch, len(annotations), func(i, j int) (Input, func(*Output) []BatchResult) {
+		return Input{
+			Version:              ProtocolVersion,
+			Operation:            OpKeyUnwrapBatch,
+			KeyUnwrapBatchParams: &KeyUnwrapBatchParams{Dc: dc, Annotations: annotations[i:j]},
+		}, func(o *Output) []BatchResult {
+			return o.KeyUnwrapBatchResults
+		}
+	})
+}
+
+func (p *Provider) batch(ctx context.Context, op string, n int, input func(i, j int) (Input, func(*Output) []BatchResult)) ([]BatchResult, error) {
+	if !p.Supports(ctx, op) {
+		return nil, fmt.Errorf("%s: %w", p.Name, ErrBatchNotSupported)
+	}
+	size := p.Capabilities(ctx).MaxBatchSize
+	if size <= 0 {
+		size = n
+	}
+	results := make([]BatchResult, 0, n)
+	for i := 0; i < n; i += size {
+		j := i + size
+		if j > n {
+			j = n
+		}
+		in, get := input(i, j)
+		out, err := p.call(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("keyprovider %s: %w", p.Name, err)
+		}
+		r := get(out)
+		if len(r) != j-i {
+			return nil, fmt.Errorf("keyprovider %s returned %d results for %d items", p.Name, len(r), j-i)
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
+func (p *Provider) call(ctx context.Context, in Input) (*Output, error) {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if in.Operation == OpCapabilities {
+		// providers that do not know the operation fail, which must
+		// neither be retried nor trip the circuit breaker
+		data, err = p.attempt(ctx, false, input)
+	} else {
+		data, err = p.exchange(ctx, in.Operation == OpKeyWrapBatch, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out Output
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal keyprovider output: %w", err)
+	}
+	return &out, nil
+}
+
+// send sends input to the provider and returns its output
+func (p *Provider) send(ctx context.Context, wrap bool, input []byte) (output []byte, err error) {
+	ctx, span := tracing.Start(ctx, "imgcrypt.keyprovider.Call",
+		attribute.String("imgcrypt.keyprovider", p.Name),
+		attribute.Bool("imgcrypt.keyprovider.wrap", wrap))
+	defer func() { tracing.End(span, err) }()
+	switch {
+	case p.Config.Command != nil:
+		return runCommand(ctx, p.Config.Command, input)
+	case p.Config.Grpc != "":
+		return p.callGrpc(ctx, wrap, input)
+	}
+	return nil, errors.New("unsupported keyprovider invocation; supported invocation methods are grpc and cmd")
+}
+
+func runCommand(ctx context.Context, command *keyproviderconfig.Command, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command.Path, command.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Ping checks that the provider can be called: that its command can be found
+// or that a connection to its gRPC server can be established before ctx is
+// done
+func (p *Provider) Ping(ctx context.Context) error {
+	switch {
+	case p.Config.Command != nil:
+		_, err := exec.LookPath(p.Config.Command.Path)
+		return err
+	case p.Config.Grpc != "":
+		creds, err := p.transportCredentials()
+		if err != nil {
+			return err
+		}
+		if p.Config.TokenFile != "" {
+			if _, err := readToken(p.Config.TokenFile); err != nil {
+				return err
+			}
+		}
+		cc, err := grpc.DialContext(ctx, p.Config.Grpc, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+		if err != nil {
+			return fmt.Errorf("error while dialing rpc server: %w", err)
+		}
+		return cc.Close()
+	}
+	return errors.New("unsupported keyprovider invocation; supported invocation methods are grpc and cmd")
+}
+
+// transportCredentials returns the credentials for connecting to the gRPC
+// server of the provider
+func (p *Provider) transportCredentials() (credentials.TransportCredentials, error) {
+	if p.Config.TLS == nil {
+		return insecure.NewCredentials(), nil
+	}
+	cfg, err := p.Config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+func (p *Provider) callGrpc(ctx context.Context, wrap bool, input []byte) ([]byte, error) {
+	creds, err := p.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if p.Config.TokenFile != "" {
+		token, err := readToken(p.Config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	cc, err := grpc.DialContext(ctx, p.Config.Grpc, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error while dialing rpc server: %w", err)
+	}
+	defer cc.Close()
+
+	client := keyproviderpb.NewKeyProviderServiceClient(cc)
+	req := &keyproviderpb.KeyProviderKeyWrapProtocolInput{KeyProviderKeyWrapProtocolInput: input}
+	var out *keyproviderpb.KeyProviderKeyWrapProtocolOutput
+	if wrap {
+		out, err = client.WrapKey(ctx, req)
+	} else {
+		out, err = client.UnWrapKey(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.GetKeyProviderKeyWrapProtocolOutput(), nil
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocikeyprovider "github.com/gobars/ocicrypt/keywrap/keyprovider"
+)
+
+// providerKeyWrapper speaks the per-layer keyprovider protocol with a provider
+// configured with imgcrypt's settings
+type providerKeyWrapper struct {
+	noKeys
+	p *Provider
+}
+
+func (kw *providerKeyWrapper) GetAnnotationID() string {
+	return AnnotationPrefix + kw.p.Name
+}
+
+func (kw *providerKeyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	if _, ok := ec.Parameters[kw.p.Name]; !ok {
+		return nil, nil
+	}
+	out, err := kw.exchange(tracing.Context(ec), true, ocikeyprovider.KeyProviderKeyWrapProtocolInput{
+		Operation:     ocikeyprovider.OpKeyWrap,
+		KeyWrapParams: ocikeyprovider.KeyWrapParams{Ec: ec, OptsData: optsData},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.KeyWrapResults.Annotation, nil
+}
+
+func (kw *providerKeyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	out, err := kw.exchange(tracing.Context(dc), false, ocikeyprovider.KeyProviderKeyWrapProtocolInput{
+		Operation:       ocikeyprovider.OpKeyUnwrap,
+		KeyUnwrapParams: ocikeyprovider.KeyUnwrapParams{Dc: dc, Annotation: annotation},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.KeyUnwrapResults.OptsData, nil
+}
+
+func (kw *providerKeyWrapper) exchange(ctx context.Context, wrap bool, in ocikeyprovider.KeyProviderKeyWrapProtocolInput) (*ocikeyprovider.KeyProviderKeyWrapProtocolOutput, error) {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	data, err := kw.p.exchange(ctx, wrap, input)
+	if err != nil {
+		return nil, fmt.Errorf("keyprovider %s: %w", kw.p.Name, err)
+	}
+	var out ocikeyprovider.KeyProviderKeyWrapProtocolOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal keyprovider output: %w", err)
+	}
+	return &out, nil
+}
+
+// noKeys implements the parts of keywrap.KeyWrapper that deal with private
+// keys and recipients held in the image, which keyproviders do not have
+type noKeys struct{}
+
+func (noKeys) NoPossibleKeys(map[string][][]byte) bool {
+	return false
+}
+
+func (noKeys) GetPrivateKeys(map[string][][]byte) [][]byte {
+	return nil
+}
+
+func (noKeys) GetKeyIdsFromPacket(string) ([]uint64, error) {
+	return nil, nil
+}
+
+func (noKeys) GetRecipients(string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keysidecar stores the wrapped keys of the encrypted layers of an
+// image in a referrer artifact of the image, instead of or in addition to the
+// annotations of the layers. The recipients of the image can then be changed
+// by attaching an artifact with rewrapped keys, without changing the manifest
+// of the image, its digest or its signatures.
+//
+// Tools that only read the annotations of layers see the layers of an image
+// whose keys were moved to an artifact as encrypted layers without keys;
+// Resolve returns a manifest with the keys of the latest artifact merged into
+// the layers for them.
+package keysidecar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/referrers"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ArtifactType is the artifact type of the referrers holding wrapped keys
+	ArtifactType = "application/vnd.dev.imgcrypt.keys.v1+json"
+	// MediaType is the media type of the blob holding the wrapped keys
+	MediaType = "application/vnd.dev.imgcrypt.keys.v1+json"
+	// Version is the version of the format of the wrapped keys
+	Version = 1
+
+	// keysPrefix prefixes the annotations holding wrapped keys
+	keysPrefix = "org.opencontainers.image.enc.keys."
+)
+
+// Storage selects where the wrapped keys of an image are stored
+type Storage string
+
+const (
+	// StorageAnnotations keeps the wrapped keys in the annotations of the layers only
+	StorageAnnotations Storage = "annotations"
+	// StorageReferrer moves the wrapped keys to a referrer artifact
+	StorageReferrer Storage = "referrer"
+	// StorageBoth keeps the wrapped keys in the annotations and copies them
+	// to a referrer artifact
+	StorageBoth Storage = "both"
+)
+
+// ParseStorage parses the name of a key storage
+func ParseStorage(s string) (Storage, error) {
+	switch st := Storage(s); st {
+	case StorageAnnotations, StorageReferrer, StorageBoth:
+		return st, nil
+	case "":
+		return StorageAnnotations, nil
+	}
+	return "", fmt.Errorf("unknown key storage %q; use %q, %q or %q", s, StorageAnnotations, StorageReferrer, StorageBoth)
+}
+
+// Keys holds the wrapped keys of the encrypted layers of an image
+type Keys struct {
+	Version int `json:"version"`
+	// The annotations holding the wrapped keys and their metadata by the
+	// digest of the layer
+	Layers map[digest.Digest]map[string]string `json:"layers"`
+}
+
+// IsKeyAnnotation returns whether the layer annotation holds wrapped keys or
+// their metadata, which are stored in the artifact
+func IsKeyAnnotation(k string) bool {
+	return strings.HasPrefix(k, keysPrefix) || k == keymeta.Annotation
+}
+
+// Collect returns the wrapped keys of the encrypted layers of the image,
+// including those stored in key blobs
+func Collect(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (Keys, error) {
+	layers, err := crypt.ImageLayers(ctx, cs, desc)
+	if err != nil {
+		return Keys{}, err
+	}
+	keys := Keys{Version: Version, Layers: make(map[digest.Digest]map[string]string)}
+	for _, l := range layers {
+		if !imgenc.IsEncryptedDiff(ctx, l.MediaType) {
+			continue
+		}
+		if l, err = imgenc.ExpandKeys(ctx, cs, l); err != nil {
+			return Keys{}, err
+		}
+		for k, v := range l.Annotations {
+			if !IsKeyAnnotation(k) {
+				continue
+			}
+			if keys.Layers[l.Digest] == nil {
+				keys.Layers[l.Digest] = make(map[string]string)
+			}
+			keys.Layers[l.Digest][k] = v
+		}
+	}
+	return keys, nil
+}
+
+// withoutKeys returns the annotations without those holding wrapped keys
+func withoutKeys(annotations map[string]string) map[string]string {
+	a := make(map[string]string)
+	for k, v := range annotations {
+		if !IsKeyAnnotation(k) {
+			a[k] = v
+		}
+	}
+	return a
+}
+
+func all(ocispec.Descriptor) bool {
+	return true
+}
+
+// Strip removes the wrapped keys from the annotations of the encrypted layers
+// of the image and returns the new descriptor of the image and whether it
+// changed
+func Strip(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+	return imgenc.RewriteImage(ctx, cs, desc, all, func(l ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		a := withoutKeys(l.Annotations)
+		if len(a) == len(l.Annotations) {
+			return l, false, nil
+		}
+		l.Annotations = a
+		return l, true, nil
+	})
+}
+
+// Merge replaces the wrapped keys in the annotations of the encrypted layers
+// of the image with those in keys and returns the new descriptor of the image
+// and whether it changed; layers without keys in keys are left as they are
+func Merge(ctx context.Context, cs content.Store, desc ocispec.Descriptor, keys Keys) (ocispec.Descriptor, bool, error) {
+	return imgenc.RewriteImage(ctx, cs, desc, all, func(l ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		lk, ok := keys.Layers[l.Digest]
+		if !ok {
+			return l, false, nil
+		}
+		a := withoutKeys(l.Annotations)
+		for k, v := range lk {
+			if IsKeyAnnotation(k) {
+				a[k] = v
+			}
+		}
+		l.Annotations = a
+		return l, true, nil
+	})
+}
+
+// Attach stores the keys in an artifact referring to the image and returns the
+// referrers index of the image
+func Attach(ctx context.Context, is images.Store, cs content.Store, image images.Image, keys Keys) (images.Image, error) {
+	p, err := json.Marshal(keys)
+	if err != nil {
+		return images.Image{}, err
+	}
+	return referrers.Attach(ctx, is, cs, image, ArtifactType, MediaType, p, nil)
+}
+
+// Latest returns the keys of the artifact referring to the image that was
+// attached last and whether there is one
+func Latest(ctx context.Context, is images.Store, cs content.Store, image images.Image) (Keys, bool, error) {
+	artifacts, err := referrers.List(ctx, is, cs, image, ArtifactType, MediaType)
+	if err != nil || len(artifacts) == 0 {
+		return Keys{}, false, err
+	}
+	latest := artifacts[0]
+	for _, a := range artifacts[1:] {
+		if !a.Created.Before(latest.Created) {
+			latest = a
+		}
+	}
+	keys, err := Decode(latest.Data)
+	if err != nil {
+		return Keys{}, false, fmt.Errorf("wrapped keys %s: %w", latest.Descriptor.Digest, err)
+	}
+	return keys, true, nil
+}
+
+// Decode parses wrapped keys in the format of the artifacts
+func Decode(data []byte) (Keys, error) {
+	var keys Keys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return Keys{}, fmt.Errorf("invalid wrapped keys: %w", err)
+	}
+	if keys.Version > Version {
+		return Keys{}, fmt.Errorf("unsupported version %d of wrapped keys", keys.Version)
+	}
+	return keys, nil
+}
+
+// Resolve returns the descriptor of the image with the keys of the latest
+// artifact referring to it merged into its layers, and whether there is such
+// an artifact; without one, the target of the image is returned
+func Resolve(ctx context.Context, is images.Store, cs content.Store, image images.Image) (ocispec.Descriptor, bool, error) {
+	keys, ok, err := Latest(ctx, is, cs, image)
+	if err != nil || !ok {
+		return image.Target, false, err
+	}
+	desc, _, err := Merge(ctx, cs, image.Target, keys)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	return desc, true, nil
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keysidecar
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encconfig "github.com/gobars/ocicrypt/config"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerHasKeys returns whether the single layer of the image has wrapped keys
+// in its annotations
+func layerHasKeys(t *testing.T, cs content.Store, desc ocispec.Descriptor) bool {
+	t.Helper()
+	layers, err := crypt.ImageLayers(context.Background(), cs, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("got %d layers, want 1", len(layers))
+	}
+	for k := range layers[0].Annotations {
+		if IsKeyAnnotation(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSidecar(t *testing.T) {
+	ctx := context.Background()
+	layout, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := layout.Store()
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("layer data"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	encrypted, _, err := imgenc.EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := Collect(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Layers) != 1 {
+		t.Fatalf("got keys of %d layers, want 1", len(keys.Layers))
+	}
+
+	stripped, modified, err := Strip(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified || layerHasKeys(t, cs, stripped) {
+		t.Fatal("wrapped keys not removed from the layer")
+	}
+	image := images.Image{Name: "registry.example.com/app:1", Target: stripped}
+	is := testutil.ImageStore{image.Name: image}
+
+	// without an artifact, the image resolves to itself
+	desc, ok, err := Resolve(ctx, is, cs, image)
+	if err != nil || ok || desc.Digest != stripped.Digest {
+		t.Fatalf("got %s, %v, %v for an image without wrapped keys artifact", desc.Digest, ok, err)
+	}
+	if _, _, err := imgenc.DecryptImage(ctx, cs, stripped, &dcc, all); err == nil {
+		t.Fatal("decrypted an image without wrapped keys")
+	}
+
+	if _, err := Attach(ctx, is, cs, image, keys); err != nil {
+		t.Fatal(err)
+	}
+	desc, ok, err = Resolve(ctx, is, cs, image)
+	if err != nil || !ok {
+		t.Fatalf("wrapped keys artifact not found: %v", err)
+	}
+	if desc.Digest != encrypted.Digest {
+		t.Fatalf("resolved to %s, want the encrypted image %s", desc.Digest, encrypted.Digest)
+	}
+	if _, _, err := imgenc.DecryptImage(ctx, cs, desc, &dcc, all); err != nil {
+		t.Fatalf("failed to decrypt the resolved image: %v", err)
+	}
+
+	// rotating the recipients attaches a new artifact and leaves the
+	// manifest alone
+	ecc2, dcc2 := testutil.CryptoConfigs(t)
+	rcc := encconfig.CombineCryptoConfigs([]encconfig.CryptoConfig{ecc2, dcc})
+	rcc.EncryptConfig.AttachDecryptConfig(rcc.DecryptConfig)
+	rewrapped, _, err := imgenc.EncryptImage(ctx, cs, desc, &rcc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := Collect(ctx, cs, rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, is, cs, image, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if is[image.Name].Target.Digest != stripped.Digest {
+		t.Fatal("rotating the recipients changed the image")
+	}
+	desc, _, err = Resolve(ctx, is, cs, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := imgenc.DecryptImage(ctx, cs, desc, &dcc2, all); err != nil {
+		t.Fatalf("failed to decrypt with the new recipient: %v", err)
+	}
+}
+
+func TestParseStorage(t *testing.T) {
+	for s, want := range map[string]Storage{"": StorageAnnotations, "referrer": StorageReferrer, "both": StorageBoth} {
+		if got, err := ParseStorage(s); err != nil || got != want {
+			t.Errorf("ParseStorage(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseStorage("manifest"); err == nil {
+		t.Error("parsed an unknown key storage")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keysidecar
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Provision returns the layer keys of the encrypted layers of the image
+// wrapped for the recipients of cc alone, unwrapped with the keys of cc's
+// DecryptConfig. The layer data is not needed, so keys for new recipients
+// can be provisioned by a holder of an existing key and handed over to be
+// added to the image later with Inject or Extend.
+func Provision(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, cc *encconfig.CryptoConfig) (Keys, error) {
+	layers, err := crypt.ImageLayers(ctx, cs, desc)
+	if err != nil {
+		return Keys{}, err
+	}
+	keys := Keys{Version: Version, Layers: make(map[digest.Digest]map[string]string)}
+	for _, l := range layers {
+		if !imgenc.IsEncryptedDiff(ctx, l.MediaType) {
+			continue
+		}
+		if _, ok := keys.Layers[l.Digest]; ok {
+			continue
+		}
+		lk, err := imgenc.ProvisionLayerKey(ctx, cs, l, cc)
+		if err != nil {
+			return Keys{}, fmt.Errorf("layer %s: %w", l.Digest, err)
+		}
+		keys.Layers[l.Digest] = lk
+	}
+	if len(keys.Layers) == 0 {
+		return Keys{}, fmt.Errorf("image %s has no encrypted layers", desc.Digest)
+	}
+	return keys, nil
+}
+
+// Add returns keys with the wrapped keys in extra, such as those returned by
+// Provision, added to those of the same layers
+func Add(keys, extra Keys) (Keys, error) {
+	added := Keys{Version: Version, Layers: make(map[digest.Digest]map[string]string, len(keys.Layers))}
+	for d, lk := range keys.Layers {
+		added.Layers[d] = lk
+	}
+	for d, ek := range extra.Layers {
+		lk, ok := added.Layers[d]
+		if !ok {
+			return Keys{}, fmt.Errorf("the wrapped keys are for layer %s, which the image does not have", d)
+		}
+		a, err := imgenc.AddWrappedKeys(lk, ek)
+		if err != nil {
+			return Keys{}, fmt.Errorf("layer %s: %w", d, err)
+		}
+		added.Layers[d] = a
+	}
+	return added, nil
+}
+
+// Inject adds the wrapped keys in extra, such as those returned by Provision,
+// to the annotations of the encrypted layers of the image and returns the new
+// descriptor of the image and whether it changed
+func Inject(ctx context.Context, cs content.Store, desc ocispec.Descriptor, extra Keys) (ocispec.Descriptor, bool, error) {
+	seen := make(map[digest.Digest]bool)
+	newDesc, modified, err := imgenc.RewriteImage(ctx, cs, desc, all, func(l ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		ek, ok := extra.Layers[l.Digest]
+		if !ok {
+			return l, false, nil
+		}
+		seen[l.Digest] = true
+		nl, err := imgenc.AddLayerKeys(ctx, cs, l, ek)
+		if err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		return nl, true, nil
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	if missing := missingLayers(extra, seen); len(missing) > 0 {
+		return ocispec.Descriptor{}, false, fmt.Errorf("the wrapped keys are for layers the image does not have: %v", missing)
+	}
+	return newDesc, modified, nil
+}
+
+// Extend attaches an artifact with the wrapped keys of the latest artifact
+// referring to the image, or of its layers if there is none, together with
+// those in extra, and returns the referrers index of the image
+func Extend(ctx context.Context, is images.Store, cs content.Store, image images.Image, extra Keys) (images.Image, error) {
+	keys, ok, err := Latest(ctx, is, cs, image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	if !ok {
+		if keys, err = Collect(ctx, cs, image.Target); err != nil {
+			return images.Image{}, err
+		}
+	}
+	if keys, err = Add(keys, extra); err != nil {
+		return images.Image{}, err
+	}
+	return Attach(ctx, is, cs, image, keys)
+}
+
+// missingLayers returns the sorted digests of the layers in keys that were
+// not seen
+func missingLayers(keys Keys, seen map[digest.Digest]bool) []digest.Digest {
+	var missing []digest.Digest
+	for d := range keys.Layers {
+		if !seen[d] {
+			missing = append(missing, d)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
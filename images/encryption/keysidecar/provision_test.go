@@ -0,0 +1,166 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keysidecar
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestProvision(t *testing.T) {
+	ctx := context.Background()
+	layout, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := layout.Store()
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("layer data"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	encrypted, _, err := imgenc.EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys of the new node are wrapped by a holder of the existing key
+	ecc2, dcc2 := testutil.CryptoConfigs(t)
+	rcc := encconfig.CombineCryptoConfigs([]encconfig.CryptoConfig{ecc2, dcc})
+	rcc.EncryptConfig.AttachDecryptConfig(rcc.DecryptConfig)
+	provisioned, err := Provision(ctx, cs, encrypted, &rcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := Collect(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lk map[string]string
+	for d, keys := range provisioned.Layers {
+		if len(keys) != 2 || keys[keymeta.Annotation] == "" {
+			t.Fatalf("got annotations %v for layer %s, want a wrapped key and its metadata", keys, d)
+		}
+		for k, v := range keys {
+			if k != keymeta.Annotation && strings.Contains(v, existing.Layers[d][k]) {
+				t.Fatalf("provisioned keys of layer %s include the existing wrapped keys", d)
+			}
+		}
+		lk = keys
+	}
+	md, err := keymeta.Read(ocispec.Descriptor{Annotations: lk})
+	if err != nil || len(md.Keys) != 1 {
+		t.Fatalf("got metadata %+v, %v, want that of the new recipient", md, err)
+	}
+
+	// injected into the annotations, both keys decrypt the image
+	injected, modified, err := Inject(ctx, cs, encrypted, provisioned)
+	if err != nil || !modified {
+		t.Fatalf("injecting the keys failed: %v, %v", modified, err)
+	}
+	for _, c := range []encconfig.CryptoConfig{dcc, dcc2} {
+		c := c
+		if _, _, err := imgenc.DecryptImage(ctx, cs, injected, &c, all); err != nil {
+			t.Fatalf("failed to decrypt the image with injected keys: %v", err)
+		}
+	}
+	keys, err := Collect(ctx, cs, injected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lk := range keys.Layers {
+		md, err := keymeta.Read(ocispec.Descriptor{Annotations: lk})
+		if err != nil || len(md.Keys) != 2 {
+			t.Fatalf("got metadata %+v, %v, want that of both recipients", md, err)
+		}
+	}
+	// injecting the same keys again adds nothing
+	again, _, err := Inject(ctx, cs, injected, provisioned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Digest != injected.Digest {
+		t.Fatal("injecting the same keys twice changed the image")
+	}
+
+	// attached in a referrer, the manifest is left alone
+	stripped, _, err := Strip(ctx, cs, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := images.Image{Name: "registry.example.com/app:1", Target: stripped}
+	is := testutil.ImageStore{image.Name: image}
+	if _, err := Attach(ctx, is, cs, image, existing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Extend(ctx, is, cs, image, provisioned); err != nil {
+		t.Fatal(err)
+	}
+	if is[image.Name].Target.Digest != stripped.Digest {
+		t.Fatal("extending the wrapped keys changed the image")
+	}
+	desc, ok, err := Resolve(ctx, is, cs, image)
+	if err != nil || !ok {
+		t.Fatalf("wrapped keys artifact not found: %v", err)
+	}
+	for _, c := range []encconfig.CryptoConfig{dcc, dcc2} {
+		c := c
+		if _, _, err := imgenc.DecryptImage(ctx, cs, desc, &c, all); err != nil {
+			t.Fatalf("failed to decrypt the image with extended keys: %v", err)
+		}
+	}
+
+	// keys of other images are refused
+	other := Keys{Version: Version, Layers: map[digest.Digest]map[string]string{layer.Digest: lk}}
+	if _, _, err := Inject(ctx, cs, encrypted, other); err == nil {
+		t.Fatal("injected keys of a layer the image does not have")
+	}
+	if _, err := Provision(ctx, cs, manifest, &rcc); err == nil {
+		t.Fatal("provisioned keys of an image without encrypted layers")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	if _, err := Decode([]byte(`{"version":2,"layers":{}}`)); err == nil {
+		t.Fatal("decoded wrapped keys of an unsupported version")
+	}
+	keys, err := Decode([]byte(`{"version":1,"layers":{"sha256:0000000000000000000000000000000000000000000000000000000000000000":{"org.opencontainers.image.enc.keys.jwe":"a"}}}`))
+	if err != nil || len(keys.Layers) != 1 {
+		t.Fatalf("got %+v, %v", keys, err)
+	}
+}
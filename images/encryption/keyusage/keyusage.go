@@ -0,0 +1,277 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keyusage restricts the keys of a decryption configuration to those that
+// are within their validity window and not revoked.
+package keyusage
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Validity is the time window in which a key may be used for decryption
+type Validity struct {
+	// Key is the fingerprint of the key as shown by 'keys inspect', or a GPG key ID
+	Key       string     `yaml:"key"`
+	NotBefore *time.Time `yaml:"not-before,omitempty"`
+	NotAfter  *time.Time `yaml:"not-after,omitempty"`
+}
+
+// Policy holds the validity windows and revocations applied to decryption keys
+type Policy struct {
+	Validity []Validity `yaml:"validity,omitempty"`
+	// Revoked lists fingerprints of keys and GPG key IDs that must not be used
+	Revoked []string `yaml:"revoked,omitempty"`
+	// CRLs lists paths of certificate revocation lists in PEM or DER format that
+	// the certificates passed for PKCS7 decryption are checked against
+	CRLs []string `yaml:"crls,omitempty"`
+	// CAs lists paths of the certificates in PEM or DER format of the CAs that
+	// issue the CRLs; a CRL that is not signed by one of them is not loaded
+	CAs []string `yaml:"cas,omitempty"`
+
+	crls []*x509.RevocationList
+}
+
+// Rejection describes a key that was removed from a decryption configuration
+type Rejection struct {
+	Key    string
+	Reason string
+}
+
+func (r Rejection) String() string {
+	return fmt.Sprintf("%s: %s", r.Key, r.Reason)
+}
+
+// Load reads a key usage policy and the revocation lists it refers to
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key usage policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse key usage policy %s: %w", path, err)
+	}
+	var cas []*x509.Certificate
+	for _, caPath := range p.CAs {
+		ca, err := loadCA(caPath)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+	for _, crlPath := range p.CRLs {
+		crl, err := loadCRL(crlPath, cas)
+		if err != nil {
+			return nil, err
+		}
+		p.crls = append(p.crls, crl)
+	}
+	return &p, nil
+}
+
+// readDER reads a file in PEM or DER format and returns its DER data
+func readDER(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return data, nil
+}
+
+func loadCA(path string) (*x509.Certificate, error) {
+	data, err := readDER(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA certificate %s: %w", path, err)
+	}
+	return ca, nil
+}
+
+// loadCRL reads the CRL at path and verifies that it is signed by one of the
+// CAs
+func loadCRL(path string, cas []*x509.Certificate) (*x509.RevocationList, error) {
+	data, err := readDER(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CRL: %w", err)
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CRL %s: %w", path, err)
+	}
+	for _, ca := range cas {
+		if string(ca.RawSubject) != string(crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(ca); err != nil {
+			return nil, fmt.Errorf("could not verify CRL %s: %w", path, err)
+		}
+		return crl, nil
+	}
+	return nil, fmt.Errorf("could not verify CRL %s: none of the CAs issued it", path)
+}
+
+// check returns why the key with the given identifiers must not be used at the given time
+func (p *Policy) check(ids []string, now time.Time) string {
+	for _, id := range ids {
+		for _, r := range p.Revoked {
+			if strings.EqualFold(r, id) {
+				return "revoked"
+			}
+		}
+		for _, v := range p.Validity {
+			if !strings.EqualFold(v.Key, id) {
+				continue
+			}
+			if v.NotBefore != nil && now.Before(*v.NotBefore) {
+				return "not valid before " + v.NotBefore.Format(time.RFC3339)
+			}
+			if v.NotAfter != nil && now.After(*v.NotAfter) {
+				return "expired on " + v.NotAfter.Format(time.RFC3339)
+			}
+		}
+	}
+	return ""
+}
+
+// checkCertificate returns why the certificate must not be used at the given time
+func (p *Policy) checkCertificate(data []byte, now time.Time) string {
+	cert, err := encutils.ParseCertificate(data, "")
+	if err != nil {
+		return ""
+	}
+	if now.Before(cert.NotBefore) {
+		return "certificate not valid before " + cert.NotBefore.Format(time.RFC3339)
+	}
+	if now.After(cert.NotAfter) {
+		return "certificate expired on " + cert.NotAfter.Format(time.RFC3339)
+	}
+	for _, crl := range p.crls {
+		if string(crl.RawIssuer) != string(cert.RawIssuer) {
+			continue
+		}
+		// revocations after a missed update of the CRL are unknown
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			return "CRL of the issuer expired on " + crl.NextUpdate.Format(time.RFC3339)
+		}
+		for _, rc := range crl.RevokedCertificates {
+			if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return "certificate revoked on " + rc.RevocationTime.Format(time.RFC3339)
+			}
+		}
+	}
+	return ""
+}
+
+// identifiers returns the fingerprint and GPG key IDs of a key, and a name for it
+func identifiers(data, password []byte) ([]string, string) {
+	ki := keyinfo.Inspect("", data, password)
+	ids := append([]string{}, ki.KeyIDs...)
+	if ki.Fingerprint != "" {
+		ids = append(ids, ki.Fingerprint)
+	}
+	name := ki.Fingerprint
+	if ki.Subject != "" {
+		name = ki.Subject
+	} else if name == "" && len(ki.KeyIDs) > 0 {
+		name = ki.KeyIDs[0]
+	}
+	return ids, name
+}
+
+// Filter returns a copy of the decryption configuration without the private keys and
+// certificates that must not be used at the given time. Private keys are also removed
+// if a certificate for their public key is rejected. Keys that cannot be identified,
+// such as PKCS11 keys and keys of key providers, are kept.
+func (p *Policy) Filter(dc *encconfig.DecryptConfig, now time.Time) (*encconfig.DecryptConfig, []Rejection) {
+	var rejections []Rejection
+	params := make(map[string][][]byte, len(dc.Parameters))
+	for k, v := range dc.Parameters {
+		params[k] = v
+	}
+
+	rejected := map[string]string{}
+	var x509s [][]byte
+	for _, cert := range dc.Parameters["x509s"] {
+		ids, name := identifiers(cert, nil)
+		reason := p.checkCertificate(cert, now)
+		if reason == "" {
+			reason = p.check(ids, now)
+		}
+		if reason != "" {
+			rejections = append(rejections, Rejection{Key: name, Reason: reason})
+			for _, id := range ids {
+				rejected[id] = reason
+			}
+			continue
+		}
+		x509s = append(x509s, cert)
+	}
+	if _, ok := params["x509s"]; ok {
+		params["x509s"] = x509s
+	}
+
+	filterKeys := func(keysParam, pwdsParam string) {
+		keys, pwds := dc.Parameters[keysParam], dc.Parameters[pwdsParam]
+		if len(keys) == 0 {
+			return
+		}
+		var newKeys, newPwds [][]byte
+		for i, key := range keys {
+			var pwd []byte
+			if i < len(pwds) {
+				pwd = pwds[i]
+			}
+			ids, name := identifiers(key, pwd)
+			reason := p.check(ids, now)
+			for _, id := range ids {
+				if r, ok := rejected[id]; ok && reason == "" {
+					reason = r
+				}
+			}
+			if reason != "" {
+				rejections = append(rejections, Rejection{Key: name, Reason: reason})
+				continue
+			}
+			newKeys = append(newKeys, key)
+			newPwds = append(newPwds, pwd)
+		}
+		params[keysParam] = newKeys
+		if _, ok := params[pwdsParam]; ok {
+			params[pwdsParam] = newPwds
+		}
+	}
+	filterKeys("privkeys", "privkeys-passwords")
+	filterKeys("gpg-privatekeys", "gpg-privatekeys-passwords")
+
+	return &encconfig.DecryptConfig{Parameters: params}, rejections
+}
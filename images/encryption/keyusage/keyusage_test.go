@@ -0,0 +1,213 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyusage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keygen"
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+func newDecryptConfig(t *testing.T) (*encconfig.DecryptConfig, string, []byte) {
+	kp, err := keygen.GenerateKeyPair(keygen.Options{Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := kp.SelfSignedCertificate("test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := keyinfo.Inspect("", kp.Public, nil).Fingerprint
+	return &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"privkeys":           {kp.Private},
+		"privkeys-passwords": {nil},
+		"x509s":              {cert},
+	}}, fp, cert
+}
+
+func TestFilter(t *testing.T) {
+	dc, fp, _ := newDecryptConfig(t)
+	now := time.Now()
+
+	p := &Policy{}
+	fdc, rejections := p.Filter(dc, now)
+	if len(rejections) != 0 || len(fdc.Parameters["privkeys"]) != 1 || len(fdc.Parameters["x509s"]) != 1 {
+		t.Fatalf("expected no key to be rejected: %v", rejections)
+	}
+
+	p = &Policy{Revoked: []string{fp}}
+	fdc, rejections = p.Filter(dc, now)
+	if len(rejections) != 2 || len(fdc.Parameters["privkeys"]) != 0 || len(fdc.Parameters["x509s"]) != 0 {
+		t.Fatalf("expected revoked key and certificate to be rejected: %v", rejections)
+	}
+	if len(dc.Parameters["privkeys"]) != 1 {
+		t.Fatal("the original decryption configuration must not be modified")
+	}
+
+	notAfter := now.Add(-time.Minute)
+	p = &Policy{Validity: []Validity{{Key: fp, NotAfter: &notAfter}}}
+	if _, rejections = p.Filter(dc, now); len(rejections) != 2 {
+		t.Fatalf("expected expired key to be rejected: %v", rejections)
+	}
+
+	// the certificate itself expires after an hour, and with it the private key
+	p = &Policy{}
+	fdc, rejections = p.Filter(dc, now.Add(2*time.Hour))
+	if len(rejections) != 2 || len(fdc.Parameters["privkeys"]) != 0 {
+		t.Fatalf("expected key of expired certificate to be rejected: %v", rejections)
+	}
+}
+
+// writeCRL writes a CRL of the CA that revokes the certificates with the given
+// serial numbers and is due to be updated at nextUpdate
+func writeCRL(t *testing.T, path string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, nextUpdate time.Time, revoked ...*big.Int) {
+	t.Helper()
+	var rcs []pkix.RevokedCertificate
+	for _, serial := range revoked {
+		rcs = append(rcs, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		RevokedCertificates: rcs,
+		ThisUpdate:          time.Now(),
+		NextUpdate:          nextUpdate,
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, crl, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newCA returns a CA with the same name as the issuer of the self-signed
+// certificates of newDecryptConfig and writes its certificate to path
+func newCA(t *testing.T, path string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCRLSign | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, caDER, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ca, caKey
+}
+
+func TestFilterCRL(t *testing.T) {
+	dc, _, certPEM := newDecryptConfig(t)
+	cert, err := encutils.ParseCertificate(certPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	ca, caKey := newCA(t, caPath)
+	crlPath := filepath.Join(dir, "revoked.crl")
+	writeCRL(t, crlPath, ca, caKey, time.Now().Add(time.Hour), cert.SerialNumber)
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(policyPath, []byte("crls: ["+crlPath+"]\ncas: ["+caPath+"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(policyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdc, rejections := p.Filter(dc, time.Now())
+	if len(rejections) != 2 || len(fdc.Parameters["privkeys"]) != 0 || len(fdc.Parameters["x509s"]) != 0 {
+		t.Fatalf("expected revoked certificate and its key to be rejected: %v", rejections)
+	}
+}
+
+func TestLoadCRLSignature(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	newCA(t, caPath)
+	// a CRL with the name of the configured CA but signed by another key
+	forged, forgedKey := newCA(t, filepath.Join(dir, "forged.crt"))
+	crlPath := filepath.Join(dir, "forged.crl")
+	writeCRL(t, crlPath, forged, forgedKey, time.Now().Add(time.Hour))
+
+	for _, policy := range []string{
+		"crls: [" + crlPath + "]\ncas: [" + caPath + "]\n",
+		"crls: [" + crlPath + "]\n",
+	} {
+		policyPath := filepath.Join(dir, "policy.yaml")
+		if err := os.WriteFile(policyPath, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(policyPath); err == nil {
+			t.Fatalf("expected the CRL not to be verified with policy %q", policy)
+		}
+	}
+}
+
+func TestFilterExpiredCRL(t *testing.T) {
+	dc, _, _ := newDecryptConfig(t)
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	ca, caKey := newCA(t, caPath)
+	crlPath := filepath.Join(dir, "empty.crl")
+	writeCRL(t, crlPath, ca, caKey, time.Now().Add(time.Minute))
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(policyPath, []byte("crls: ["+crlPath+"]\ncas: ["+caPath+"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(policyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rejections := p.Filter(dc, time.Now()); len(rejections) != 0 {
+		t.Fatalf("expected no key to be rejected before the next update of the CRL: %v", rejections)
+	}
+	if _, rejections := p.Filter(dc, time.Now().Add(10*time.Minute)); len(rejections) != 2 {
+		t.Fatalf("expected the certificate and its key to be rejected after the next update of the CRL: %v", rejections)
+	}
+}
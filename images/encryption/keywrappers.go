@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/metrics"
+	"github.com/containerd/imgcrypt/images/encryption/pgpcache"
+	"github.com/containerd/imgcrypt/images/encryption/pkcs11pool"
+	"github.com/containerd/imgcrypt/images/encryption/threshold"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/containerd/imgcrypt/images/encryption/uniformunwrap"
+)
+
+// installKeyWrappers registers imgcrypt's key wrappers with ocicrypt and then
+// wraps them with the decorators, each of which wraps the key wrappers
+// registered before it, so the order is that of the calls below. It is
+// called by every function that wraps, unwraps or inspects layer keys, so
+// that the chain does not depend on which of them is called first.
+func installKeyWrappers() {
+	// the key wrappers of the schemes; uniformunwrap replaces the JWE and
+	// PKCS#7 key wrappers without calling them to unwrap keys, so it comes
+	// first
+	uniformunwrap.Install()
+	pgpcache.Install()
+	keyprovider.Install()
+	pkcs11pool.Install()
+	hybrid.Install()
+	threshold.Install()
+
+	// the decorators, from the innermost to the outermost; the encryption
+	// context is checked by all key wrappers, including those decorated
+	// below, and the attempts record the failures of all the others
+	enccontext.Install()
+	fips.Install()
+	algpolicy.Install()
+	logging.Install()
+	tracing.Install()
+	metrics.Install()
+	keymeta.Install()
+	attempts.Install()
+}
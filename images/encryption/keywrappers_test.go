@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// wrapperChain returns the types of the key wrapper registered for the scheme
+// and of the key wrappers it decorates, from the outermost to the innermost
+func wrapperChain(scheme string) []string {
+	kwType := reflect.TypeOf((*keywrap.KeyWrapper)(nil)).Elem()
+	var chain []string
+	v := reflect.ValueOf(ocicrypt.GetKeyWrapper(scheme))
+	for v.IsValid() {
+		chain = append(chain, v.Type().String())
+		s := v
+		if s.Kind() == reflect.Ptr {
+			s = s.Elem()
+		}
+		if s.Kind() != reflect.Struct {
+			break
+		}
+		next := reflect.Value{}
+		for i := 0; i < s.NumField(); i++ {
+			if s.Type().Field(i).Type == kwType && !s.Field(i).IsNil() {
+				next = s.Field(i).Elem()
+				break
+			}
+		}
+		v = next
+	}
+	return chain
+}
+
+func TestInstallKeyWrappers(t *testing.T) {
+	installKeyWrappers()
+	decorators := []string{"*attempts.keyWrapper", "*metrics.keyWrapper", "*tracing.keyWrapper",
+		"*logging.keyWrapper", "*algpolicy.keyWrapper", "*fips.keyWrapper", "*enccontext.keyWrapper"}
+	for scheme, want := range map[string][]string{
+		"jwe": append([]string{"*attempts.keyWrapper", "*keymeta.keyWrapper"},
+			append(decorators[1:], "*uniformunwrap.keyWrapper", "*jwe.jweKeyWrapper")...),
+		"pgp":        append(append([]string{}, decorators...), "*pgpcache.keyWrapper", "*pgp.gpgKeyWrapper"),
+		"jwe-hybrid": append(append([]string{}, decorators...), "*hybrid.keyWrapper"),
+		"threshold":  {"*attempts.keyWrapper", "*enccontext.keyWrapper", "*threshold.keyWrapper"},
+	} {
+		// installing again must not change the chain
+		installKeyWrappers()
+		if got := wrapperChain(scheme); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got key wrappers %v, want %v", scheme, got, want)
+		}
+	}
+}
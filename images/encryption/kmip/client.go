@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kmip wraps layer keys with symmetric keys held by a KMIP server,
+// such as the key manager of an HSM, using its Encrypt and Decrypt
+// operations. Layer keys never leave the process unwrapped and the key
+// encryption keys never leave the server.
+package kmip
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+)
+
+// Timeout limits the time a single request to a KMIP server may take
+var Timeout = 30 * time.Second
+
+// tagLength is the length of the GCM authentication tag requested from the server
+const tagLength = 16
+
+// Config holds the settings for connecting to KMIP servers
+type Config struct {
+	// TLSConfig holds the CA bundle the servers are verified with and the
+	// client certificate and key, which most servers require
+	keyprovider.TLSConfig
+	// Version is the KMIP protocol version requested, "1.4" by default;
+	// "2.0" and "2.1" are supported as well
+	Version string `json:"version,omitempty"`
+}
+
+// LoadConfig reads a Config from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse KMIP configuration %s: %w", path, err)
+	}
+	if _, _, err := c.protocolVersion(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) protocolVersion() (int32, int32, error) {
+	switch c.Version {
+	case "", "1.4":
+		return 1, 4, nil
+	case "2.0":
+		return 2, 0, nil
+	case "2.1":
+		return 2, 1, nil
+	}
+	return 0, 0, fmt.Errorf("unsupported KMIP version %q", c.Version)
+}
+
+// Client is a connection to a KMIP server
+type Client struct {
+	conn         *tls.Conn
+	major, minor int32
+}
+
+// Dial connects to the KMIP server at endpoint
+func Dial(ctx context.Context, endpoint string, c *Config) (*Client, error) {
+	major, minor, err := c.protocolVersion()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	d := tls.Dialer{NetDialer: &net.Dialer{Timeout: Timeout}, Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to KMIP server %s: %w", endpoint, err)
+	}
+	return &Client{conn: conn.(*tls.Conn), major: major, minor: minor}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Encrypt encrypts data with AES-GCM under the key with the given unique
+// identifier and a random IV chosen by the server
+func (c *Client) Encrypt(keyID string, data []byte) (iv, ciphertext, tag []byte, err error) {
+	payload, err := c.do(operationEncrypt,
+		textString(tagUniqueIdentifier, keyID),
+		cryptographicParameters(boolean(tagRandomIV, true)),
+		byteString(tagData, data),
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d, ok1 := payload.get(tagData)
+	n, ok2 := payload.get(tagIVCounterNonce)
+	t, ok3 := payload.get(tagAuthenticatedEncryptionTag)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, nil, nil, fmt.Errorf("KMIP server returned incomplete AES-GCM result for key %s", keyID)
+	}
+	return n.value, d.value, t.value, nil
+}
+
+// Decrypt decrypts data that Encrypt encrypted under the given key
+func (c *Client) Decrypt(keyID string, iv, ciphertext, tag []byte) ([]byte, error) {
+	payload, err := c.do(operationDecrypt,
+		textString(tagUniqueIdentifier, keyID),
+		cryptographicParameters(),
+		byteString(tagData, ciphertext),
+		byteString(tagIVCounterNonce, iv),
+		byteString(tagAuthenticatedEncryptionTag, tag),
+	)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := payload.get(tagData)
+	if !ok {
+		return nil, fmt.Errorf("KMIP server returned no data for key %s", keyID)
+	}
+	return d.value, nil
+}
+
+func cryptographicParameters(extra ...item) item {
+	return structure(tagCryptographicParameters, append([]item{
+		enumeration(tagBlockCipherMode, blockCipherModeGCM),
+		enumeration(tagCryptographicAlgorithm, cryptographicAlgorithmAES),
+		integer(tagTagLength, tagLength),
+	}, extra...)...)
+}
+
+// do sends a request with a single batch item and returns the payload of the
+// response
+func (c *Client) do(operation uint32, payload ...item) (item, error) {
+	req := structure(tagRequestMessage,
+		structure(tagRequestHeader,
+			structure(tagProtocolVersion,
+				integer(tagProtocolVersionMajor, c.major),
+				integer(tagProtocolVersionMinor, c.minor),
+			),
+			integer(tagBatchCount, 1),
+		),
+		structure(tagBatchItem,
+			enumeration(tagOperation, operation),
+			structure(tagRequestPayload, payload...),
+		),
+	)
+	if err := c.conn.SetDeadline(time.Now().Add(Timeout)); err != nil {
+		return item{}, err
+	}
+	if _, err := c.conn.Write(req.marshal()); err != nil {
+		return item{}, fmt.Errorf("failed to send KMIP request: %w", err)
+	}
+	resp, err := readMessage(c.conn)
+	if err != nil {
+		return item{}, fmt.Errorf("failed to read KMIP response: %w", err)
+	}
+	if resp.tag != tagResponseMessage {
+		return item{}, fmt.Errorf("unexpected KMIP message %06x", resp.tag)
+	}
+	batchItem, ok := resp.get(tagBatchItem)
+	if !ok {
+		return item{}, fmt.Errorf("KMIP response has no batch item")
+	}
+	if status, _ := batchItem.get(tagResultStatus); status.uint32() != resultStatusSuccess {
+		reason, _ := batchItem.get(tagResultReason)
+		msg, _ := batchItem.get(tagResultMessage)
+		return item{}, &OperationError{Reason: reason.uint32(), Message: string(msg.value)}
+	}
+	result, _ := batchItem.get(tagResponsePayload)
+	return result, nil
+}
+
+// OperationError is returned if the server failed an operation
+type OperationError struct {
+	// Reason is the KMIP result reason, e.g. 1 for "item not found"
+	Reason  uint32
+	Message string
+}
+
+func (e *OperationError) Error() string {
+	msg := "KMIP operation failed with reason " + strconv.FormatUint(uint64(e.Reason), 10)
+	if e.Message != "" {
+		msg += ": " + strings.TrimSpace(e.Message)
+	}
+	return msg
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kmip
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// server is a KMIP server supporting AES-GCM Encrypt and Decrypt with a
+// single key
+type server struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		bi, _ := req.get(tagBatchItem)
+		op, _ := bi.get(tagOperation)
+		payload, _ := bi.get(tagRequestPayload)
+		uid, _ := payload.get(tagUniqueIdentifier)
+		data, _ := payload.get(tagData)
+
+		var result []item
+		if string(uid.value) != s.keyID {
+			result = []item{
+				enumeration(tagResultStatus, 1),
+				enumeration(tagResultReason, 1),
+				textString(tagResultMessage, "item not found"),
+			}
+		} else if op.uint32() == operationEncrypt {
+			iv := make([]byte, s.aead.NonceSize())
+			rand.Read(iv)
+			sealed := s.aead.Seal(nil, iv, data.value, nil)
+			n := len(sealed) - tagLength
+			result = []item{
+				enumeration(tagResultStatus, resultStatusSuccess),
+				structure(tagResponsePayload,
+					textString(tagUniqueIdentifier, s.keyID),
+					byteString(tagData, sealed[:n]),
+					byteString(tagIVCounterNonce, iv),
+					byteString(tagAuthenticatedEncryptionTag, sealed[n:]),
+				),
+			}
+		} else {
+			iv, _ := payload.get(tagIVCounterNonce)
+			tag, _ := payload.get(tagAuthenticatedEncryptionTag)
+			sealed := append(append([]byte{}, data.value...), tag.value...)
+			plain, err := s.aead.Open(nil, iv.value, sealed, nil)
+			if err != nil {
+				result = []item{enumeration(tagResultStatus, 1), enumeration(tagResultReason, 0x16)}
+			} else {
+				result = []item{
+					enumeration(tagResultStatus, resultStatusSuccess),
+					structure(tagResponsePayload, byteString(tagData, plain)),
+				}
+			}
+		}
+		resp := structure(tagResponseMessage,
+			structure(tagResponseHeader, integer(tagBatchCount, 1)),
+			structure(tagBatchItem, append([]item{op}, result...)...),
+		)
+		conn.Write(resp.marshal())
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startServer starts a KMIP server requiring client certificates and returns
+// its endpoint and a client configuration for it
+func startServer(t *testing.T, keyID string) (string, *Config) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kmip"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	block, _ := aes.NewCipher(kek)
+	aead, _ := cipher.NewGCM(block)
+	s := &server{keyID: keyID, aead: aead}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), &Config{
+		TLSConfig: keyprovider.TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	ctx := context.Background()
+	endpoint, c := startServer(t, "key-1")
+	p := &Provider{Config: c}
+
+	ec := &encconfig.EncryptConfig{Parameters: map[string][][]byte{
+		ProviderName: {[]byte(endpoint + "/key-1")},
+	}}
+	annotation, err := p.WrapKey(ctx, ec, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	optsData, err := p.UnwrapKey(ctx, &encconfig.DecryptConfig{}, annotation)
+	if err != nil || !bytes.Equal(optsData, []byte("layer key")) {
+		t.Fatalf("got %q, %v", optsData, err)
+	}
+
+	ec.Parameters[ProviderName] = [][]byte{[]byte(endpoint + "/unknown")}
+	var oerr *OperationError
+	if _, err := p.WrapKey(ctx, ec, []byte("layer key")); !errors.As(err, &oerr) || oerr.Reason != 1 {
+		t.Fatalf("expected item not found error, got %v", err)
+	}
+
+	// without a client certificate the server refuses the connection
+	noCert := &Provider{Config: &Config{TLSConfig: keyprovider.TLSConfig{CAFile: c.CAFile}}}
+	if _, err := noCert.UnwrapKey(ctx, &encconfig.DecryptConfig{}, annotation); err == nil {
+		t.Fatal("expected unwrapping without client certificate to fail")
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	for _, tc := range []struct {
+		recipient, endpoint, keyID string
+	}{
+		{"kmip.example.com/1234", "kmip.example.com:5696", "1234"},
+		{"kmip.example.com:15696/a/b", "kmip.example.com:15696", "a/b"},
+		{"[::1]/k", "[::1]:5696", "k"},
+	} {
+		endpoint, keyID, err := ParseRecipient(tc.recipient)
+		if err != nil || endpoint != tc.endpoint || keyID != tc.keyID {
+			t.Errorf("%s: got %s, %s, %v", tc.recipient, endpoint, keyID, err)
+		}
+	}
+	for _, r := range []string{"kmip.example.com", "/1234", "kmip.example.com/"} {
+		if _, _, err := ParseRecipient(r); err == nil {
+			t.Errorf("%s: expected error", r)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kmip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// ProviderName is the name of the keyprovider kmip:<endpoint>/<key-id>
+// recipients are passed to
+const ProviderName = "kmip"
+
+// DefaultPort is the port of KMIP servers given without one
+const DefaultPort = "5696"
+
+// AnnotationPacket is a layer key wrapped with a key of a KMIP server; the
+// keyprovider annotation of a layer holds a JSON array of them, one per
+// recipient
+type AnnotationPacket struct {
+	Endpoint    string `json:"endpoint"`
+	KeyID       string `json:"kid"`
+	WrappedData []byte `json:"wrapped_data"`
+	IV          []byte `json:"iv"`
+	Tag         []byte `json:"tag"`
+}
+
+// ParseRecipient splits a <endpoint>/<key-id> recipient into the host:port
+// of the server and the unique identifier of the key
+func ParseRecipient(recipient string) (endpoint, keyID string, err error) {
+	endpoint, keyID, ok := strings.Cut(recipient, "/")
+	if !ok || endpoint == "" || keyID == "" {
+		return "", "", fmt.Errorf("invalid KMIP recipient %q: expected <endpoint>/<key-id>", recipient)
+	}
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(strings.Trim(endpoint, "[]"), DefaultPort)
+	}
+	return endpoint, keyID, nil
+}
+
+// Provider is an in-process keyprovider wrapping layer keys with KMIP servers
+type Provider struct {
+	Config *Config
+}
+
+// Install registers a Provider with the given configuration as the
+// keyprovider named ProviderName
+func Install(c *Config) {
+	keyprovider.RegisterKeyProvider(ProviderName, &Provider{Config: c})
+}
+
+// WrapKey implements keyprovider.KeyProvider
+func (p *Provider) WrapKey(ctx context.Context, ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	var packets []AnnotationPacket
+	for _, r := range ec.Parameters[ProviderName] {
+		endpoint, keyID, err := ParseRecipient(string(r))
+		if err != nil {
+			return nil, err
+		}
+		c, err := Dial(ctx, endpoint, p.Config)
+		if err != nil {
+			return nil, err
+		}
+		iv, data, tag, err := c.Encrypt(keyID, optsData)
+		c.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap key with %s/%s: %w", endpoint, keyID, err)
+		}
+		packets = append(packets, AnnotationPacket{Endpoint: endpoint, KeyID: keyID, WrappedData: data, IV: iv, Tag: tag})
+	}
+	if len(packets) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(packets)
+}
+
+// UnwrapKey implements keyprovider.KeyProvider; the packets are tried in
+// turn until a server unwraps one
+func (p *Provider) UnwrapKey(ctx context.Context, _ *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	var packets []AnnotationPacket
+	if err := json.Unmarshal(annotation, &packets); err != nil {
+		return nil, fmt.Errorf("invalid KMIP annotation: %w", err)
+	}
+	var errs []string
+	for _, pkt := range packets {
+		optsData, err := p.unwrap(ctx, &pkt)
+		if err == nil {
+			return optsData, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s/%s: %s", pkt.Endpoint, pkt.KeyID, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("KMIP annotation holds no wrapped keys")
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (p *Provider) unwrap(ctx context.Context, pkt *AnnotationPacket) ([]byte, error) {
+	c, err := Dial(ctx, pkt.Endpoint, p.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Decrypt(pkt.KeyID, pkt.IV, pkt.WrappedData, pkt.Tag)
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kmip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Item types of the TTLV encoding
+const (
+	typeStructure   = 0x01
+	typeInteger     = 0x02
+	typeEnumeration = 0x05
+	typeBoolean     = 0x06
+	typeTextString  = 0x07
+	typeByteString  = 0x08
+)
+
+// Tags of the items used by the Encrypt and Decrypt operations
+const (
+	tagBatchCount                 = 0x42000D
+	tagBatchItem                  = 0x42000F
+	tagBlockCipherMode            = 0x420011
+	tagCryptographicAlgorithm     = 0x420028
+	tagCryptographicParameters    = 0x42002B
+	tagIVCounterNonce             = 0x42003D
+	tagOperation                  = 0x42005C
+	tagProtocolVersion            = 0x420069
+	tagProtocolVersionMajor       = 0x42006A
+	tagProtocolVersionMinor       = 0x42006B
+	tagRequestHeader              = 0x420077
+	tagRequestMessage             = 0x420078
+	tagRequestPayload             = 0x420079
+	tagResponseHeader             = 0x42007A
+	tagResponseMessage            = 0x42007B
+	tagResponsePayload            = 0x42007C
+	tagResultMessage              = 0x42007D
+	tagResultReason               = 0x42007E
+	tagResultStatus               = 0x42007F
+	tagUniqueIdentifier           = 0x420094
+	tagData                       = 0x4200C2
+	tagRandomIV                   = 0x4200C5
+	tagTagLength                  = 0x4200CE
+	tagAuthenticatedEncryptionTag = 0x4200FF
+)
+
+// Enumeration values
+const (
+	operationEncrypt = 0x1F
+	operationDecrypt = 0x20
+
+	blockCipherModeGCM = 0x09
+
+	cryptographicAlgorithmAES = 0x03
+
+	resultStatusSuccess = 0x00
+)
+
+// maxMessageSize limits the size of messages read from the server
+const maxMessageSize = 1 << 20
+
+// item is a TTLV encoded item; primitive items hold their value, structures
+// their items
+type item struct {
+	tag   uint32
+	typ   byte
+	value []byte
+	items []item
+}
+
+func structure(tag uint32, items ...item) item {
+	return item{tag: tag, typ: typeStructure, items: items}
+}
+
+func integer(tag uint32, v int32) item {
+	return item{tag: tag, typ: typeInteger, value: binary.BigEndian.AppendUint32(nil, uint32(v))}
+}
+
+func enumeration(tag uint32, v uint32) item {
+	return item{tag: tag, typ: typeEnumeration, value: binary.BigEndian.AppendUint32(nil, v)}
+}
+
+func boolean(tag uint32, v bool) item {
+	var b uint64
+	if v {
+		b = 1
+	}
+	return item{tag: tag, typ: typeBoolean, value: binary.BigEndian.AppendUint64(nil, b)}
+}
+
+func textString(tag uint32, s string) item {
+	return item{tag: tag, typ: typeTextString, value: []byte(s)}
+}
+
+func byteString(tag uint32, b []byte) item {
+	return item{tag: tag, typ: typeByteString, value: b}
+}
+
+// get returns the first item of a structure with the given tag
+func (it item) get(tag uint32) (item, bool) {
+	for _, i := range it.items {
+		if i.tag == tag {
+			return i, true
+		}
+	}
+	return item{}, false
+}
+
+// uint32 returns the value of an integer or enumeration
+func (it item) uint32() uint32 {
+	if len(it.value) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(it.value)
+}
+
+func (it item) marshal() []byte {
+	value := it.value
+	if it.typ == typeStructure {
+		value = nil
+		for _, i := range it.items {
+			value = append(value, i.marshal()...)
+		}
+	}
+	b := make([]byte, 8, 8+padded(len(value)))
+	binary.BigEndian.PutUint32(b, it.tag<<8|uint32(it.typ))
+	binary.BigEndian.PutUint32(b[4:], uint32(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, padded(len(value))-len(value))...)
+}
+
+// unmarshal decodes the item at the start of b and returns the remaining bytes
+func unmarshal(b []byte) (item, []byte, error) {
+	if len(b) < 8 {
+		return item{}, nil, errors.New("truncated TTLV item")
+	}
+	it := item{
+		tag: binary.BigEndian.Uint32(b) >> 8,
+		typ: b[3],
+	}
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	b = b[8:]
+	if n < 0 || padded(n) > len(b) {
+		return item{}, nil, fmt.Errorf("TTLV item %06x exceeds message", it.tag)
+	}
+	value := b[:n]
+	if it.typ == typeStructure {
+		for len(value) > 0 {
+			var child item
+			var err error
+			if child, value, err = unmarshal(value); err != nil {
+				return item{}, nil, err
+			}
+			it.items = append(it.items, child)
+		}
+	} else {
+		it.value = value
+	}
+	return it, b[padded(n):], nil
+}
+
+func padded(n int) int {
+	return (n + 7) &^ 7
+}
+
+// readMessage reads a single TTLV encoded message
+func readMessage(r io.Reader) (item, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return item{}, err
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n > maxMessageSize {
+		return item{}, fmt.Errorf("KMIP message of %d bytes is too large", n)
+	}
+	b := make([]byte, 8+padded(int(n)))
+	copy(b, header)
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return item{}, err
+	}
+	it, _, err := unmarshal(b)
+	return it, err
+}
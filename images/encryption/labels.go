@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// LabelSchema is set on the blobs written or labelled by imgcrypt and
+	// holds the version of their labels
+	LabelSchema = "io.containerd.imgcrypt.schema"
+	// LabelRecipients is set on an encrypted layer blob and holds the
+	// RecipientsHash of the recipients its key was wrapped for when the blob
+	// was written or labelled
+	LabelRecipients = "io.containerd.imgcrypt.recipients"
+	// LabelSchemes is set on an encrypted layer blob and holds the sorted,
+	// comma-separated wrap schemes of its key
+	LabelSchemes = "io.containerd.imgcrypt.schemes"
+	// LabelEncryption is set on an encrypted layer blob and identifies the
+	// plain layer, encryption parameters and cipher it was encrypted with, so
+	// that it can be reused when the same layer is encrypted again with them
+	LabelEncryption = "io.containerd.imgcrypt.encryption"
+
+	// LabelSchemaVersion is the version of the labels set by imgcrypt
+	LabelSchemaVersion = "1"
+)
+
+// RecipientsHash returns the digest identifying a set of recipients, as
+// returned by LayerInfo.Recipients, without revealing them, so that the
+// blobs encrypted for the same recipients can be found
+func RecipientsHash(recipients []string) string {
+	sorted := append([]string{}, recipients...)
+	sort.Strings(sorted)
+	return digest.FromString(strings.Join(sorted, "\n")).String()
+}
+
+// encryptedLayerLabels returns the labels describing the wrapped keys of the
+// encrypted layer with the given descriptor
+func encryptedLayerLabels(desc ocispec.Descriptor) (map[string]string, error) {
+	li, err := GetLayerInfo(0, desc, nil)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		LabelSchema:     LabelSchemaVersion,
+		LabelRecipients: RecipientsHash(li.Recipients()),
+		LabelSchemes:    strings.Join(li.Schemes(), ","),
+	}, nil
+}
+
+// updateLabels sets the labels on the blob with the given digest
+func updateLabels(ctx context.Context, cs content.Store, dgst digest.Digest, labels map[string]string) error {
+	info := content.Info{Digest: dgst, Labels: labels}
+	fieldpaths := make([]string, 0, len(labels))
+	for k := range labels {
+		fieldpaths = append(fieldpaths, "labels."+k)
+	}
+	if _, err := cs.Update(ctx, info, fieldpaths...); err != nil {
+		return fmt.Errorf("failed to set labels on %s: %w", dgst, err)
+	}
+	return nil
+}
+
+// writeLabelledBlob writes the blob described by desc from r with the labels,
+// which are also set if the blob already exists
+func writeLabelledBlob(ctx context.Context, cs content.Store, ref string, r io.Reader, desc ocispec.Descriptor, labels map[string]string) error {
+	if err := content.WriteBlob(ctx, cs, ref, r, desc, content.WithLabels(labels)); err != nil {
+		return err
+	}
+	// WriteBlob does not commit blobs that exist already
+	return updateLabels(ctx, cs, desc.Digest, labels)
+}
+
+// LabelEncryptedLayers sets the labels of encrypted layers on the locally
+// available blobs of the encrypted layers of the image that do not have them
+// yet, such as those of pulled images, and returns how many were labelled
+func LabelEncryptedLayers(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (int, error) {
+	descs, err := EncryptedLayers(ctx, cs, desc, nil)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, desc := range descs {
+		info, err := cs.Info(ctx, desc.Digest)
+		if errdefs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		if _, ok := info.Labels[LabelRecipients]; ok {
+			continue
+		}
+		labels, err := encryptedLayerLabels(desc)
+		if err != nil {
+			return n, err
+		}
+		if err := updateLabels(ctx, cs, desc.Digest, labels); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// EncryptedContent returns the blobs of the content store labelled as
+// encrypted layers that match any of the given containerd filters, such as
+// `labels."io.containerd.imgcrypt.recipients"==sha256:...`, or all of them
+func EncryptedContent(ctx context.Context, cs content.Store, filters ...string) ([]content.Info, error) {
+	return labelledContent(ctx, cs, LabelRecipients, filters)
+}
+
+// DecryptedContent returns the plaintext blobs of the content store that
+// imgcrypt decrypted from encrypted layers and that match any of the given
+// containerd filters, or all of them
+func DecryptedContent(ctx context.Context, cs content.Store, filters ...string) ([]content.Info, error) {
+	return labelledContent(ctx, cs, LabelEncryptedSource, filters)
+}
+
+// labelledContent returns the blobs with the label that match any of the filters
+func labelledContent(ctx context.Context, cs content.Store, label string, filters []string) ([]content.Info, error) {
+	has := fmt.Sprintf("labels.%q", label)
+	fs := []string{has}
+	if len(filters) > 0 {
+		// the filters are alternatives, the conditions of each are combined
+		fs = fs[:0]
+		for _, f := range filters {
+			fs = append(fs, has+","+f)
+		}
+	}
+	var infos []content.Info
+	err := cs.Walk(ctx, func(info content.Info) error {
+		infos = append(infos, info)
+		return nil
+	}, fs...)
+	return infos, err
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestContentLabels(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	plain, err := images.Manifest(ctx, cs, manifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecc, dcc := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := m.Layers[0]
+	li, err := GetLayerInfo(0, layer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := RecipientsHash(li.Recipients())
+
+	info, err := cs.Info(ctx, layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		LabelSchema:          LabelSchemaVersion,
+		LabelRecipients:      hash,
+		LabelSchemes:         "jwe",
+		LabelPlaintextSource: plain.Layers[0].Digest.String(),
+	}
+	for k, v := range want {
+		if info.Labels[k] != v {
+			t.Fatalf("expected label %s=%q on the encrypted layer, got %q", k, v, info.Labels[k])
+		}
+	}
+
+	for _, filters := range [][]string{nil, {fmt.Sprintf("labels.%q==%s", LabelRecipients, hash)}} {
+		infos, err := EncryptedContent(ctx, cs, filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Digest != layer.Digest {
+			t.Fatalf("expected the encrypted layer to be found with %v, got %v", filters, infos)
+		}
+	}
+	infos, err := EncryptedContent(ctx, cs, fmt.Sprintf("labels.%q==%s", LabelRecipients, RecipientsHash([]string{"other"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("expected no content encrypted for other recipients, got %v", infos)
+	}
+
+	if _, _, err := DecryptImage(ctx, cs, encrypted, &dcc, all); err != nil {
+		t.Fatal(err)
+	}
+	infos, err = DecryptedContent(ctx, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Digest != plain.Layers[0].Digest || infos[0].Labels[LabelEncryptedSource] != layer.Digest.String() {
+		t.Fatalf("expected the decrypted layer to be labelled with its source, got %v", infos)
+	}
+}
+
+func TestLabelEncryptedLayers(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	ecc, _ := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drop the labels as if the image was pulled
+	info, err := cs.Info(ctx, m.Layers[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Labels = nil
+	if _, err := cs.Update(ctx, info, "labels"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{1, 0} {
+		n, err := LabelEncryptedLayers(ctx, cs, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("expected %d layers to be labelled, got %d", want, n)
+		}
+	}
+	infos, err := EncryptedContent(ctx, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected the labelled layer to be found, got %v", infos)
+	}
+}
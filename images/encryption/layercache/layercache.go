@@ -0,0 +1,227 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package layercache keeps encrypted layers in a directory, so that a plain
+// layer encrypted again for the same recipients with the same cipher is
+// reused instead of encrypted anew, such as the unchanged base layers of an
+// image rebuilt by every CI run. The directory can be kept between runs like
+// other build caches.
+//
+// Entries are keyed by the digest of the plain layer, a hash of the
+// recipients and other encryption parameters, and the layer cipher. Each
+// entry holds the encrypted layer and its descriptor with the wrapped keys.
+// Reused layers have the same layer key in all images they are part of. Since
+// entries are not checked against the plain layer, which the encrypted layer
+// cannot be compared with without a private key, the directory must be
+// trusted like the build itself.
+package layercache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	descriptorFile = "descriptor.json"
+	blobFile       = "blob"
+)
+
+// Cache is a directory of encrypted layers
+type Cache struct {
+	dir string
+}
+
+// Open opens the cache in dir, creating it if it does not exist
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create layer cache: %w", err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+var current atomic.Pointer[Cache]
+
+// Set makes the cache the one encrypted layers are reused from for the rest
+// of the process; nil disables the reuse
+func Set(c *Cache) {
+	current.Store(c)
+}
+
+// Current returns the cache set with Set, or nil
+func Current() *Cache {
+	return current.Load()
+}
+
+// Key returns the key of the encryption of the plain layer with the given
+// digest with the encryption parameters, which hold the recipients, and the
+// cipher
+func Key(plain digest.Digest, ec *encconfig.EncryptConfig, cipher string) string {
+	h := sha256.New()
+	writeField(h, []byte(plain))
+	writeField(h, []byte(cipher))
+	var names []string
+	if ec != nil {
+		for name := range ec.Parameters {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(h, []byte(name))
+		values := append([][]byte(nil), ec.Parameters[name]...)
+		sort.Slice(values, func(i, j int) bool { return string(values[i]) < string(values[j]) })
+		binary.Write(h, binary.BigEndian, uint64(len(values)))
+		for _, v := range values {
+			writeField(h, v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField writes b prefixed with its length, so that the fields of a key
+// cannot run into each other
+func writeField(h hash.Hash, b []byte) {
+	binary.Write(h, binary.BigEndian, uint64(len(b)))
+	h.Write(b)
+}
+
+// Get returns the descriptor of the encrypted layer with the given key and a
+// reader of its blob, or an error matching errdefs.ErrNotFound if the cache
+// has none. The time the entry was used is updated.
+func (c *Cache) Get(key string) (ocispec.Descriptor, io.ReadCloser, error) {
+	entry := filepath.Join(c.dir, key)
+	b, err := os.ReadFile(filepath.Join(entry, descriptorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("layer cache entry %s: %w", key, errdefs.ErrNotFound)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	var desc ocispec.Descriptor
+	if err := json.Unmarshal(b, &desc); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("could not parse layer cache entry %s: %w", key, err)
+	}
+	f, err := os.Open(filepath.Join(entry, blobFile))
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return ocispec.Descriptor{}, nil, err
+	}
+	if fi.Size() != desc.Size {
+		f.Close()
+		return ocispec.Descriptor{}, nil, fmt.Errorf("layer cache entry %s has %d bytes instead of %d", key, fi.Size(), desc.Size)
+	}
+	now := time.Now()
+	_ = os.Chtimes(entry, now, now)
+	return desc, f, nil
+}
+
+// Put stores the encrypted layer with the given descriptor, whose blob is read
+// from r, under the key; the digest of the blob is verified while it is
+// stored. An existing entry for the key is kept.
+func (c *Cache) Put(key string, desc ocispec.Descriptor, r io.Reader) error {
+	entry := filepath.Join(c.dir, key)
+	if _, err := os.Stat(entry); err == nil {
+		return nil
+	}
+	tmp, err := os.MkdirTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	f, err := os.OpenFile(filepath.Join(tmp, blobFile), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != desc.Size || !verifier.Verified() {
+		return fmt.Errorf("encrypted layer %s does not match its descriptor", desc.Digest)
+	}
+	b, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, descriptorFile), b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, entry); err != nil && !errors.Is(err, os.ErrExist) {
+		// another process stored the entry first
+		if _, serr := os.Stat(entry); serr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the entry with the given key, such as one that turned out to
+// be corrupted
+func (c *Cache) Remove(key string) error {
+	return os.RemoveAll(filepath.Join(c.dir, key))
+}
+
+// Prune removes the entries that were not used since the given time, so that
+// the layers of images no longer built do not accumulate, and returns how
+// many were removed
+func (c *Cache) Prune(before time.Time) (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Before(before) {
+			if err := os.RemoveAll(filepath.Join(c.dir, e.Name())); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layercache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestKey(t *testing.T) {
+	plain := digest.FromString("plain layer")
+	ec := func(params map[string][][]byte) *encconfig.EncryptConfig {
+		return &encconfig.EncryptConfig{Parameters: params}
+	}
+	a := Key(plain, ec(map[string][][]byte{"pubkeys": {[]byte("a"), []byte("b")}}), "AES_256_CTR_HMAC_SHA256")
+	b := Key(plain, ec(map[string][][]byte{"pubkeys": {[]byte("b"), []byte("a")}}), "AES_256_CTR_HMAC_SHA256")
+	if a != b {
+		t.Fatal("expected the key not to depend on the order of the recipients")
+	}
+	for _, other := range []string{
+		Key(digest.FromString("other layer"), ec(map[string][][]byte{"pubkeys": {[]byte("a"), []byte("b")}}), "AES_256_CTR_HMAC_SHA256"),
+		Key(plain, ec(map[string][][]byte{"pubkeys": {[]byte("a")}}), "AES_256_CTR_HMAC_SHA256"),
+		Key(plain, ec(map[string][][]byte{"pubkeys": {[]byte("ab")}}), "AES_256_CTR_HMAC_SHA256"),
+		Key(plain, ec(map[string][][]byte{"x509s": {[]byte("a"), []byte("b")}}), "AES_256_CTR_HMAC_SHA256"),
+		Key(plain, ec(map[string][][]byte{"pubkeys": {[]byte("a"), []byte("b")}}), "SM4_128_CTR_HMAC_SM3"),
+	} {
+		if other == a {
+			t.Fatal("expected different layers, recipients and ciphers to have different keys")
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key(digest.FromString("plain layer"), nil, "AES_256_CTR_HMAC_SHA256")
+	if _, _, err := c.Get(key); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected no entry, got %v", err)
+	}
+
+	data := []byte("encrypted layer")
+	desc := ocispec.Descriptor{
+		MediaType:   "application/vnd.oci.image.layer.v1.tar+encrypted",
+		Digest:      digest.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: map[string]string{"org.opencontainers.image.enc.keys.jwe": "d3JhcHBlZA=="},
+	}
+	if err := c.Put(key, desc, bytes.NewReader([]byte("other data"))); err == nil {
+		t.Fatal("expected a blob that does not match its descriptor to be refused")
+	}
+	if err := c.Put(key, desc, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	got, r, err := c.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Digest != desc.Digest || got.Annotations["org.opencontainers.image.enc.keys.jwe"] != "d3JhcHBlZA==" || !bytes.Equal(b, data) {
+		t.Fatalf("expected the stored layer, got %+v", got)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(c.dir, key), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Prune(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("expected the unused entry to be pruned, got %d, %v", n, err)
+	}
+	if _, _, err := c.Get(key); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected the entry to be removed, got %v", err)
+	}
+}
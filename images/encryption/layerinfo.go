@@ -0,0 +1,214 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerInfo describes the encryption of an image layer
+type LayerInfo struct {
+	// The Number of this layer in the sequence; starting at 0
+	Index      uint32           `json:"index" yaml:"index"`
+	Digest     digest.Digest    `json:"digest" yaml:"digest"`
+	MediaType  string           `json:"mediaType" yaml:"mediaType"`
+	Size       int64            `json:"size" yaml:"size"`
+	Platform   string           `json:"platform,omitempty" yaml:"platform,omitempty"`
+	Encryption []WrapSchemeInfo `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	// Whether the layer can be decrypted with the available keys; only set if checked
+	Decryptable *bool `json:"decryptable,omitempty" yaml:"decryptable,omitempty"`
+	// The wrap scheme of the wrapped key that the available keys unwrap; only
+	// set if checked and decryptable
+	UnwrapScheme string `json:"unwrapScheme,omitempty" yaml:"unwrapScheme,omitempty"`
+	// The recipient of that wrapped key, such as the ID of the matching key,
+	// if the key wrapper of the scheme reports it
+	UnwrapRecipient string `json:"unwrapRecipient,omitempty" yaml:"unwrapRecipient,omitempty"`
+	// Whether the layer can be decrypted in FIPS mode; only set in FIPS mode
+	FIPSApproved *bool `json:"fipsApproved,omitempty" yaml:"fipsApproved,omitempty"`
+	// The metadata of the wrapped keys; only set for encrypted layers
+	KeyMetadata *keymeta.Metadata `json:"keyMetadata,omitempty" yaml:"keyMetadata,omitempty"`
+	// Whether the layer key is wrapped for all escrow recipients; only set for
+	// encrypted layers with an escrow policy
+	EscrowCompliant *bool `json:"escrowCompliant,omitempty" yaml:"escrowCompliant,omitempty"`
+	// The escrow recipients the layer key is not wrapped for
+	MissingEscrow []string `json:"missingEscrow,omitempty" yaml:"missingEscrow,omitempty"`
+	// The encryption context the layer key is bound to, as recorded in the key
+	// metadata
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty" yaml:"encryptionContext,omitempty"`
+}
+
+// WrapSchemeInfo describes the keys wrapped with one scheme for a layer
+type WrapSchemeInfo struct {
+	Scheme     string   `json:"scheme" yaml:"scheme"`
+	Recipients []string `json:"recipients" yaml:"recipients"`
+}
+
+// Schemes returns the sorted names of the wrap schemes used for the layer
+func (li *LayerInfo) Schemes() []string {
+	var schemes []string
+	for _, e := range li.Encryption {
+		schemes = append(schemes, e.Scheme)
+	}
+	return schemes
+}
+
+// Recipients returns the sorted recipients across all wrap schemes of the layer
+func (li *LayerInfo) Recipients() []string {
+	var recipients []string
+	for _, e := range li.Encryption {
+		recipients = append(recipients, e.Recipients...)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+// KeyIDs returns the sorted key IDs of the recipients in the key metadata of
+// the layer, or their hints for recipients without a key ID
+func (li *LayerInfo) KeyIDs() []string {
+	if li.KeyMetadata == nil {
+		return nil
+	}
+	var ids []string
+	for _, k := range li.KeyMetadata.Keys {
+		switch {
+		case k.KeyID != "":
+			ids = append(ids, k.KeyID)
+		case k.Hint != "":
+			ids = append(ids, k.Hint)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GetLayerInfo describes the encryption of the layer with the given descriptor.
+// If a GPG client is passed, PGP key IDs are resolved to names.
+func GetLayerInfo(index uint32, desc ocispec.Descriptor, gpgClient ocicrypt.GPGClient) (LayerInfo, error) {
+	li := LayerInfo{
+		Index:     index,
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+	}
+	if desc.Platform != nil {
+		li.Platform = platforms.Format(*desc.Platform)
+	}
+
+	installKeyWrappers()
+	for scheme, wrappedKeys := range ocicrypt.GetWrappedKeysMap(desc) {
+		var recipients []string
+		keywrapper := ocicrypt.GetKeyWrapper(scheme)
+		if keywrapper != nil {
+			var err error
+			recipients, err = keywrapper.GetRecipients(wrappedKeys)
+			if err != nil {
+				return LayerInfo{}, err
+			}
+			if scheme == "pgp" && gpgClient != nil {
+				recipients = gpgClient.ResolveRecipients(recipients)
+			}
+		} else {
+			recipients = []string{fmt.Sprintf("No %s KeyWrapper", scheme)}
+		}
+		sort.Strings(recipients)
+		li.Encryption = append(li.Encryption, WrapSchemeInfo{
+			Scheme:     scheme,
+			Recipients: recipients,
+		})
+	}
+	sort.Slice(li.Encryption, func(i, j int) bool {
+		return li.Encryption[i].Scheme < li.Encryption[j].Scheme
+	})
+	if len(li.Encryption) > 0 {
+		// wrapped keys in unknown formats are only described by their scheme
+		md, err := keymeta.Read(desc)
+		if err == nil {
+			li.KeyMetadata = md
+			li.EncryptionContext = md.Context
+		}
+		if p := escrow.Current(); p != nil {
+			li.MissingEscrow = p.Missing(md)
+			compliant := len(li.MissingEscrow) == 0
+			li.EscrowCompliant = &compliant
+		}
+	}
+	if fips.Enabled() {
+		approved := fipsApproved(desc)
+		li.FIPSApproved = &approved
+	}
+	return li, nil
+}
+
+// fipsApproved returns whether the layer is encrypted with a FIPS approved
+// cipher and its key is wrapped with FIPS approved algorithms for at least
+// one recipient
+func fipsApproved(desc ocispec.Descriptor) bool {
+	if cipher, err := layerCipher(desc); err != nil || fips.CheckCipher(string(cipher)) != nil {
+		return false
+	}
+	for scheme, wrappedKeys := range ocicrypt.GetWrappedKeysMap(desc) {
+		for _, b64 := range strings.Split(wrappedKeys, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64)
+			if err == nil && fips.CheckWrappedKey(scheme, wrapped) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckDecryption records in the LayerInfo whether the layer with the given
+// descriptor can be decrypted with the keys in the DecryptConfig, and with
+// which scheme and recipient. Only the wrapped layer key is decrypted; the
+// layer data itself is not accessed.
+func (li *LayerInfo) CheckDecryption(dc *encconfig.DecryptConfig, desc ocispec.Descriptor) {
+	rec, unbind := attempts.Bind(dc)
+	decryptable := CanDecryptLayer(dc, desc) == nil
+	unbind()
+	li.Decryptable = &decryptable
+	li.UnwrapScheme, li.UnwrapRecipient = "", ""
+	for _, l := range rec.Layers() {
+		if a, ok := l.UnwrappedBy(); ok {
+			li.UnwrapScheme = a.Scheme
+			li.UnwrapRecipient = a.Recipient
+		}
+	}
+}
+
+// CanDecryptLayer returns nil if the layer with the given descriptor is not encrypted
+// or if one of the keys in the DecryptConfig can unwrap its symmetric key
+func CanDecryptLayer(dc *encconfig.DecryptConfig, desc ocispec.Descriptor) error {
+	if !IsEncryptedDiff(context.Background(), desc.MediaType) {
+		return nil
+	}
+	_, _, _, err := DecryptLayer(dc, nil, desc, true)
+	return err
+}
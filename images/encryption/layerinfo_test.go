@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLayerInfoOutput(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	ecc, dcc := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := images.Manifest(ctx, cs, manifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	li, err := GetLayerInfo(0, m.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := li.Schemes(); len(s) != 1 || s[0] != "jwe" {
+		t.Fatalf("expected the jwe scheme, got %v", s)
+	}
+	if len(li.KeyIDs()) != 1 {
+		t.Fatalf("expected the key ID of the recipient, got %v", li.KeyIDs())
+	}
+
+	// the result of the check is only output once checked
+	var fields map[string]interface{}
+	b, err := json.Marshal(li)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index", "digest", "mediaType", "size", "encryption", "keyMetadata"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("expected the JSON output to have %q: %s", name, b)
+		}
+	}
+	if _, ok := fields["decryptable"]; ok {
+		t.Errorf("expected the unchecked layer not to have \"decryptable\": %s", b)
+	}
+
+	li.CheckDecryption(dcc.DecryptConfig, m.Layers[0])
+	b, err = yaml.Marshal(li)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LayerInfo
+	if err := yaml.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Digest != m.Layers[0].Digest || decoded.Decryptable == nil || !*decoded.Decryptable || len(decoded.Encryption) != 1 {
+		t.Fatalf("unexpected YAML output %s", b)
+	}
+
+	// plain layers have no encryption and are always decryptable
+	li, err = GetLayerInfo(1, plain.Layers[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li.CheckDecryption(dcc.DecryptConfig, plain.Layers[0])
+	if li.Index != 1 || len(li.Encryption) != 0 || li.KeyMetadata != nil || !*li.Decryptable || li.UnwrapScheme != "" {
+		t.Fatalf("unexpected info of a plain layer %+v", li)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ldapkeys
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Classes and the constructed bit of BER identifier octets
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// Universal tags of the BER encoding
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10
+	tagSet         = 0x11
+)
+
+// Application tags of the LDAP protocol operations
+const (
+	appBindRequest       = 0
+	appBindResponse      = 1
+	appUnbindRequest     = 2
+	appSearchRequest     = 3
+	appSearchResultEntry = 4
+	appSearchResultDone  = 5
+	appSearchResultRef   = 19
+	appExtendedRequest   = 23
+	appExtendedResponse  = 24
+)
+
+// Context tags of search filters
+const (
+	filterOr            = 1
+	filterEqualityMatch = 3
+)
+
+// maxMessageSize limits the size of messages read from the server
+const maxMessageSize = 4 << 20
+
+// element is a BER encoded element; primitive elements hold their value,
+// constructed ones their children
+type element struct {
+	// id is the identifier octet, holding the class, the constructed bit
+	// and the tag
+	id       byte
+	value    []byte
+	children []element
+}
+
+func (e element) constructed() bool {
+	return e.id&constructed != 0
+}
+
+func sequence(children ...element) element {
+	return element{id: classUniversal | constructed | tagSequence, children: children}
+}
+
+func set(children ...element) element {
+	return element{id: classUniversal | constructed | tagSet, children: children}
+}
+
+func application(tag byte, children ...element) element {
+	return element{id: classApplication | constructed | tag, children: children}
+}
+
+func octetString(s string) element {
+	return element{id: tagOctetString, value: []byte(s)}
+}
+
+func integer(v int64) element {
+	return element{id: tagInteger, value: big.NewInt(v).Bytes()}
+}
+
+func enumerated(v int64) element {
+	e := integer(v)
+	e.id = tagEnumerated
+	return e
+}
+
+func boolean(v bool) element {
+	if v {
+		return element{id: tagBoolean, value: []byte{0xff}}
+	}
+	return element{id: tagBoolean, value: []byte{0}}
+}
+
+// int returns the value of an INTEGER or ENUMERATED element
+func (e element) int() int64 {
+	if len(e.value) == 0 {
+		return 0
+	}
+	v := int64(int8(e.value[0]))
+	for _, b := range e.value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// marshal returns the definite-length encoding of the element
+func (e element) marshal() []byte {
+	value := e.value
+	if e.constructed() {
+		value = nil
+		for _, c := range e.children {
+			value = append(value, c.marshal()...)
+		}
+	}
+	if e.id&0x1f == tagInteger || e.id&0x1f == tagEnumerated {
+		if len(value) == 0 || value[0]&0x80 != 0 {
+			// the values encoded are not negative
+			value = append([]byte{0}, value...)
+		}
+	}
+	out := append([]byte{e.id}, marshalLength(len(value))...)
+	return append(out, value...)
+}
+
+func marshalLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// readElement reads one element from r
+func readElement(r io.Reader) (element, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return element{}, err
+	}
+	if hdr[0]&0x1f == 0x1f {
+		return element{}, errors.New("unsupported BER tag")
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 4 {
+			return element{}, errors.New("unsupported BER length")
+		}
+		b := make([]byte, octets)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return element{}, err
+		}
+		n = 0
+		for _, o := range b {
+			n = n<<8 | int(o)
+		}
+	}
+	if n > maxMessageSize {
+		return element{}, fmt.Errorf("LDAP message of %d bytes exceeds the limit of %d bytes", n, maxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return element{}, err
+	}
+	return parseElement(hdr[0], data)
+}
+
+// parseElement parses the value of an element and, if it is constructed,
+// its children
+func parseElement(id byte, data []byte) (element, error) {
+	e := element{id: id, value: data}
+	if !e.constructed() {
+		return e, nil
+	}
+	for len(data) > 0 {
+		r := &sliceReader{data: data}
+		c, err := readElement(r)
+		if err != nil {
+			return element{}, fmt.Errorf("malformed LDAP message: %w", err)
+		}
+		e.children = append(e.children, c)
+		data = r.data
+	}
+	return e, nil
+}
+
+// sliceReader reads from a byte slice, leaving the unread rest in data
+type sliceReader struct {
+	data []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
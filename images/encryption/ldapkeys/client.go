@@ -0,0 +1,283 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ldapkeys
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// startTLSOID names the StartTLS extended operation
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// resultSuccess is the result code of successful operations
+const resultSuccess = 0
+
+// ResultError is returned if the server failed an operation
+type ResultError struct {
+	// Code is the LDAP result code, e.g. 49 for invalid credentials
+	Code    int64
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	msg := fmt.Sprintf("LDAP operation failed with result code %d", e.Code)
+	if e.Message != "" {
+		msg += ": " + strings.TrimSpace(e.Message)
+	}
+	return msg
+}
+
+// entry is an entry found by a search with the values of its attributes by
+// their lower case names without options
+type entry struct {
+	dn         string
+	attributes map[string][][]byte
+}
+
+// client is a connection to an LDAP server secured with TLS
+type client struct {
+	conn    net.Conn
+	timeout time.Duration
+	msgID   int64
+}
+
+// dial connects to the server of the ldaps:// or ldap:// URL, upgrading
+// ldap:// connections with StartTLS, since keys must not be looked up over
+// connections an attacker could tamper with
+func dial(ctx context.Context, c *Config) (*client, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL %q: %w", c.URL, err)
+	}
+	cfg, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	timeout := c.timeout()
+	d := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		conn, err = (&tls.Dialer{NetDialer: d, Config: cfg}).DialContext(ctx, "tcp", hostPort(u, "636"))
+	case "ldap":
+		conn, err = d.DialContext(ctx, "tcp", hostPort(u, "389"))
+	default:
+		return nil, fmt.Errorf("invalid LDAP URL %q: expected ldaps:// or ldap://", c.URL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server %s: %w", u.Host, err)
+	}
+	cl := &client{conn: conn, timeout: timeout}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		cl.timeout = time.Until(deadline)
+	}
+	if u.Scheme == "ldap" {
+		if err := cl.startTLS(cfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Close unbinds and closes the connection
+func (cl *client) Close() error {
+	cl.msgID++
+	unbind := sequence(integer(cl.msgID), element{id: classApplication | appUnbindRequest})
+	_ = cl.conn.SetDeadline(time.Now().Add(cl.timeout))
+	_, _ = cl.conn.Write(unbind.marshal())
+	return cl.conn.Close()
+}
+
+// startTLS upgrades the connection with the StartTLS extended operation
+func (cl *client) startTLS(cfg *tls.Config) error {
+	req := application(appExtendedRequest)
+	req.children = []element{{id: classContext, value: []byte(startTLSOID)}}
+	if _, err := cl.do(req, appExtendedResponse); err != nil {
+		return fmt.Errorf("StartTLS failed: %w", err)
+	}
+	conn := tls.Client(cl.conn, cfg)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("StartTLS failed: %w", err)
+	}
+	cl.conn = conn
+	return nil
+}
+
+// bind authenticates with the simple bind of a DN and its password
+func (cl *client) bind(dn, password string) error {
+	req := application(appBindRequest,
+		integer(3),
+		octetString(dn),
+		element{id: classContext, value: []byte(password)},
+	)
+	if _, err := cl.do(req, appBindResponse); err != nil {
+		return fmt.Errorf("LDAP bind as %q failed: %w", dn, err)
+	}
+	return nil
+}
+
+// search returns the entries below baseDN whose value of any of the
+// attributes is value, with the requested attributes
+func (cl *client) search(baseDN string, matchAttributes []string, value string, attributes []string) ([]entry, error) {
+	var matches []element
+	for _, a := range matchAttributes {
+		matches = append(matches, element{
+			id:       classContext | constructed | filterEqualityMatch,
+			children: []element{octetString(a), octetString(value)},
+		})
+	}
+	filter := element{id: classContext | constructed | filterOr, children: matches}
+	var requested []element
+	for _, a := range attributes {
+		requested = append(requested, octetString(a))
+	}
+	req := application(appSearchRequest,
+		octetString(baseDN),
+		enumerated(2), // wholeSubtree
+		enumerated(0), // neverDerefAliases
+		integer(maxEntries+1),
+		integer(int64(cl.timeout/time.Second)),
+		boolean(false),
+		filter,
+		sequence(requested...),
+	)
+	msgID, err := cl.send(req)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for {
+		op, err := cl.receive(msgID)
+		if err != nil {
+			return nil, err
+		}
+		switch op.id &^ (classApplication | constructed) {
+		case appSearchResultEntry:
+			if len(entries) == maxEntries {
+				return nil, fmt.Errorf("more than %d LDAP entries match %q", maxEntries, value)
+			}
+			entries = append(entries, parseEntry(op))
+		case appSearchResultRef:
+			// referrals to other servers are not followed
+		case appSearchResultDone:
+			if err := result(op); err != nil {
+				return nil, fmt.Errorf("LDAP search failed: %w", err)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response %#x", op.id)
+		}
+	}
+}
+
+// parseEntry returns the DN and attributes of a SearchResultEntry
+func parseEntry(op element) entry {
+	e := entry{attributes: make(map[string][][]byte)}
+	if len(op.children) < 2 {
+		return e
+	}
+	e.dn = string(op.children[0].value)
+	for _, attr := range op.children[1].children {
+		if len(attr.children) < 2 {
+			continue
+		}
+		name := attributeName(string(attr.children[0].value))
+		for _, v := range attr.children[1].children {
+			e.attributes[name] = append(e.attributes[name], v.value)
+		}
+	}
+	return e
+}
+
+// attributeName returns the lower case name of an attribute without its
+// options, so that userCertificate;binary matches userCertificate
+func attributeName(a string) string {
+	name, _, _ := strings.Cut(a, ";")
+	return strings.ToLower(name)
+}
+
+// do sends a request and returns its response, which must be of the given
+// type and successful
+func (cl *client) do(req element, response byte) (element, error) {
+	msgID, err := cl.send(req)
+	if err != nil {
+		return element{}, err
+	}
+	op, err := cl.receive(msgID)
+	if err != nil {
+		return element{}, err
+	}
+	if op.id&^(classApplication|constructed) != response {
+		return element{}, fmt.Errorf("unexpected LDAP response %#x", op.id)
+	}
+	return op, result(op)
+}
+
+func (cl *client) send(req element) (int64, error) {
+	cl.msgID++
+	msg := sequence(integer(cl.msgID), req)
+	if err := cl.conn.SetDeadline(time.Now().Add(cl.timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := cl.conn.Write(msg.marshal()); err != nil {
+		return 0, fmt.Errorf("failed to send LDAP request: %w", err)
+	}
+	return cl.msgID, nil
+}
+
+// receive reads the next message and returns its protocol operation
+func (cl *client) receive(msgID int64) (element, error) {
+	msg, err := readElement(cl.conn)
+	if err != nil {
+		return element{}, fmt.Errorf("failed to read LDAP response: %w", err)
+	}
+	if len(msg.children) < 2 || msg.children[0].id != tagInteger {
+		return element{}, fmt.Errorf("malformed LDAP response")
+	}
+	if id := msg.children[0].int(); id != msgID {
+		return element{}, fmt.Errorf("LDAP response to message %d instead of %d", id, msgID)
+	}
+	return msg.children[1], nil
+}
+
+// result returns the error of an LDAPResult, if any
+func result(op element) error {
+	if len(op.children) < 3 {
+		return fmt.Errorf("malformed LDAP result")
+	}
+	if code := op.children[0].int(); code != resultSuccess {
+		return &ResultError{Code: code, Message: string(op.children[2].value)}
+	}
+	return nil
+}
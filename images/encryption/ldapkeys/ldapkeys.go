@@ -0,0 +1,308 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ldapkeys looks up the certificates and PGP keys of recipients given
+// by identity, such as x509:user@corp.com or pgp:user@corp.com, in an LDAP
+// directory like Active Directory, so that recipient lists need not name key
+// files. The directory is configured with a JSON file:
+//
+//	{
+//	  "url": "ldaps://ldap.corp.com",
+//	  "base-dn": "ou=people,dc=corp,dc=com",
+//	  "bind-dn": "cn=imgcrypt,ou=services,dc=corp,dc=com",
+//	  "bind-password-source": "file:/etc/imgcrypt/ldap-password"
+//	}
+//
+// Entries are found by the value of their mail or userPrincipalName
+// attribute. Connections are always secured with TLS, either with ldaps:// or
+// with StartTLS for ldap:// URLs; referrals are not followed.
+package ldapkeys
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/pgpkeys"
+)
+
+// Default attributes of the directory entries
+const (
+	DefaultCertificateAttribute = "userCertificate;binary"
+	DefaultPGPKeyAttribute      = "pgpKey"
+)
+
+// DefaultIdentityAttributes are the attributes identities are matched against
+var DefaultIdentityAttributes = []string{"mail", "userPrincipalName"}
+
+// DefaultTimeout bounds the lookup of a recipient
+const DefaultTimeout = 10 * time.Second
+
+// maxEntries is the number of entries an identity may match
+const maxEntries = 16
+
+// cacheTTL is how long the keys found for an identity are reused
+const cacheTTL = 5 * time.Minute
+
+// ErrNotFound is returned if no entry has the identity
+var ErrNotFound = errors.New("no LDAP entry found")
+
+// Config holds the settings for looking up keys in a directory
+type Config struct {
+	// URL is the ldaps:// URL of the directory server, or an ldap:// URL
+	// whose connection is upgraded with StartTLS
+	URL string `json:"url"`
+	// TLSConfig holds the CA bundle the server is verified with and the
+	// client certificate and key, if the server requires one
+	keyprovider.TLSConfig
+	// BaseDN is where entries are searched
+	BaseDN string `json:"base-dn"`
+	// BindDN and the password read from BindPasswordSource, file:<absolute
+	// path> or env:<variable>, authenticate the lookups; they are anonymous
+	// if BindDN is empty
+	BindDN             string `json:"bind-dn,omitempty"`
+	BindPasswordSource string `json:"bind-password-source,omitempty"`
+	// IdentityAttributes are the attributes matched against identities,
+	// DefaultIdentityAttributes if empty
+	IdentityAttributes []string `json:"identity-attributes,omitempty"`
+	// CertificateAttribute and PGPKeyAttribute hold the DER certificates
+	// and the binary or armored PGP keys of entries
+	CertificateAttribute string `json:"certificate-attribute,omitempty"`
+	PGPKeyAttribute      string `json:"pgp-key-attribute,omitempty"`
+	// Timeout bounds the lookup of a recipient, DefaultTimeout if zero
+	Timeout keyprovider.Duration `json:"timeout,omitempty"`
+}
+
+// LoadConfig reads a Config from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse LDAP configuration %s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("LDAP configuration %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	if !strings.HasPrefix(c.URL, "ldaps://") && !strings.HasPrefix(c.URL, "ldap://") {
+		return fmt.Errorf("invalid LDAP URL %q: expected ldaps:// or ldap://", c.URL)
+	}
+	if c.BaseDN == "" {
+		return errors.New("no base DN given")
+	}
+	if c.BindPasswordSource != "" && c.BindDN == "" {
+		return errors.New("a bind password requires a bind DN")
+	}
+	return nil
+}
+
+func (c *Config) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return DefaultTimeout
+}
+
+func (c *Config) identityAttributes() []string {
+	if len(c.IdentityAttributes) > 0 {
+		return c.IdentityAttributes
+	}
+	return DefaultIdentityAttributes
+}
+
+func (c *Config) certificateAttribute() string {
+	if c.CertificateAttribute != "" {
+		return c.CertificateAttribute
+	}
+	return DefaultCertificateAttribute
+}
+
+func (c *Config) pgpKeyAttribute() string {
+	if c.PGPKeyAttribute != "" {
+		return c.PGPKeyAttribute
+	}
+	return DefaultPGPKeyAttribute
+}
+
+// Directory looks up keys with a Config, reusing the keys found for an
+// identity for a few minutes, since batches of images are often encrypted
+// for the same recipients
+type Directory struct {
+	Config *Config
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	values [][]byte
+	at     time.Time
+}
+
+// New returns a Directory for the configuration
+func New(c *Config) (*Directory, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &Directory{Config: c, cache: make(map[string]cached)}, nil
+}
+
+var current atomic.Pointer[Directory]
+
+// Set makes the directory the one recipients are looked up in for the rest
+// of the process; nil disables the lookups
+func Set(d *Directory) {
+	current.Store(d)
+}
+
+// Current returns the directory recipients are looked up in, or nil
+func Current() *Directory {
+	return current.Load()
+}
+
+// Certificates returns the PEM encoded certificates of the entry with the
+// identity that are valid now
+func (d *Directory) Certificates(ctx context.Context, identity string) ([][]byte, error) {
+	values, err := d.lookup(ctx, identity, d.Config.certificateAttribute())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		certs [][]byte
+		now   = time.Now()
+	)
+	for _, der := range values {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil || now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			continue
+		}
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("the LDAP entry of %s has no valid certificate", identity)
+	}
+	return certs, nil
+}
+
+// PGPKeys returns the PGP keys of the entry with the identity that have a
+// user ID whose name or address is the identity, since recipients are
+// matched by their user IDs when encrypting
+func (d *Directory) PGPKeys(ctx context.Context, identity string) ([]pgpkeys.Key, error) {
+	values, err := d.lookup(ctx, identity, d.Config.pgpKeyAttribute())
+	if err != nil {
+		return nil, err
+	}
+	var keys []pgpkeys.Key
+	for _, data := range values {
+		ks, err := pgpkeys.ParseKeys(data, identity)
+		if err != nil {
+			return nil, fmt.Errorf("the LDAP entry of %s: %w", identity, err)
+		}
+		keys = append(keys, ks...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the LDAP entry of %s has no PGP key with the user ID %s", identity, identity)
+	}
+	return keys, nil
+}
+
+// lookup returns the values of the attribute of the entries with the
+// identity
+func (d *Directory) lookup(ctx context.Context, identity, attribute string) ([][]byte, error) {
+	k := attribute + "\x00" + identity
+	d.mu.Lock()
+	if c, ok := d.cache[k]; ok && time.Since(c.at) < cacheTTL {
+		d.mu.Unlock()
+		return c.values, nil
+	}
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, d.Config.timeout())
+	defer cancel()
+	cl, err := dial(ctx, d.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+	if d.Config.BindDN != "" {
+		password, err := readPasswordSource(d.Config.BindPasswordSource)
+		if err != nil {
+			return nil, err
+		}
+		if err := cl.bind(d.Config.BindDN, password); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := cl.search(d.Config.BaseDN, d.Config.identityAttributes(), identity, []string{attribute})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNotFound, identity)
+	}
+	var values [][]byte
+	for _, e := range entries {
+		values = append(values, e.attributes[attributeName(attribute)]...)
+	}
+
+	d.mu.Lock()
+	d.cache[k] = cached{values: values, at: time.Now()}
+	d.mu.Unlock()
+	return values, nil
+}
+
+// readPasswordSource reads the bind password from file:<absolute path> or
+// env:<variable>; no source is an empty password
+func readPasswordSource(src string) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+	scheme, value, _ := strings.Cut(src, ":")
+	switch scheme {
+	case "env":
+		password, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("LDAP bind password environment variable %s is not set", value)
+		}
+		return password, nil
+	case "file":
+		if !filepath.IsAbs(value) {
+			return "", fmt.Errorf("LDAP bind password file %s is not an absolute path", value)
+		}
+		password, err := os.ReadFile(value)
+		if err != nil {
+			return "", fmt.Errorf("could not read LDAP bind password file: %w", err)
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+	}
+	return "", fmt.Errorf("unsupported bind password source %q: expected file:<path> or env:<variable>", src)
+}
@@ -0,0 +1,281 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ldapkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+)
+
+const (
+	testBindDN   = "cn=imgcrypt,dc=corp,dc=com"
+	testPassword = "secret"
+)
+
+// server is a minimal LDAP server holding entries by their DN
+type server struct {
+	tls      *tls.Config
+	entries  map[string]map[string][][]byte
+	searches atomic.Int32
+}
+
+func (s *server) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reply := func(msgID int64, op element) bool {
+		_, err := conn.Write(sequence(integer(msgID), op).marshal())
+		return err == nil
+	}
+	ldapResult := func(app byte, code int64) element {
+		return application(app, enumerated(code), octetString(""), octetString(""))
+	}
+	for {
+		msg, err := readElement(conn)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		msgID, op := msg.children[0].int(), msg.children[1]
+		switch op.id &^ (classApplication | constructed) {
+		case appExtendedRequest:
+			if !reply(msgID, ldapResult(appExtendedResponse, resultSuccess)) {
+				return
+			}
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		case appBindRequest:
+			code := int64(resultSuccess)
+			if string(op.children[1].value) != testBindDN || string(op.children[2].value) != testPassword {
+				code = 49
+			}
+			if !reply(msgID, ldapResult(appBindResponse, code)) {
+				return
+			}
+		case appSearchRequest:
+			s.searches.Add(1)
+			filter := op.children[6]
+			want := attributeName(string(op.children[7].children[0].value))
+			for dn, attrs := range s.entries {
+				matched := false
+				for _, eq := range filter.children {
+					for _, v := range attrs[attributeName(string(eq.children[0].value))] {
+						matched = matched || bytes.Equal(v, eq.children[1].value)
+					}
+				}
+				if !matched {
+					continue
+				}
+				var vals []element
+				for _, v := range attrs[want] {
+					vals = append(vals, element{id: tagOctetString, value: v})
+				}
+				attr := sequence(octetString(want+";binary"), set(vals...))
+				if !reply(msgID, application(appSearchResultEntry, octetString(dn), sequence(attr))) {
+					return
+				}
+			}
+			if !reply(msgID, ldapResult(appSearchResultDone, resultSuccess)) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func createCert(t *testing.T, notAfter time.Time) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+// startServer starts a server with TLS, or StartTLS if startTLS is set, and
+// returns it with the configuration for connecting to it
+func startServer(t *testing.T, startTLS bool, entries map[string]map[string][][]byte) (*server, *Config) {
+	der, key := createCert(t, time.Now().Add(time.Hour))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		tls:     &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		entries: entries,
+	}
+	var (
+		l   net.Listener
+		err error
+	)
+	scheme := "ldap"
+	if startTLS {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	} else {
+		scheme = "ldaps"
+		l, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve(l)
+
+	t.Setenv("TEST_LDAP_PASSWORD", testPassword)
+	c := &Config{
+		URL:                scheme + "://" + l.Addr().String(),
+		BaseDN:             "dc=corp,dc=com",
+		BindDN:             testBindDN,
+		BindPasswordSource: "env:TEST_LDAP_PASSWORD",
+	}
+	c.CAFile = caFile
+	return s, c
+}
+
+func TestCertificates(t *testing.T) {
+	valid, _ := createCert(t, time.Now().Add(time.Hour))
+	expired, _ := createCert(t, time.Now().Add(-time.Hour))
+	s, c := startServer(t, false, map[string]map[string][][]byte{
+		"cn=user,dc=corp,dc=com": {
+			"mail":            {[]byte("user@corp.com")},
+			"usercertificate": {expired, valid},
+		},
+		"cn=nocert,dc=corp,dc=com": {
+			"userprincipalname": {[]byte("nocert@corp.com")},
+		},
+	})
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	certs, err := d.Certificates(ctx, "user@corp.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected only the valid certificate, got %d", len(certs))
+	}
+	if block, _ := pem.Decode(certs[0]); block == nil || !bytes.Equal(block.Bytes, valid) {
+		t.Fatal("unexpected certificate")
+	}
+	if _, err := d.Certificates(ctx, "user@corp.com"); err != nil || s.searches.Load() != 1 {
+		t.Fatalf("expected the certificates to be cached: %v, %d searches", err, s.searches.Load())
+	}
+
+	if _, err := d.Certificates(ctx, "nocert@corp.com"); err == nil || !strings.Contains(err.Error(), "no valid certificate") {
+		t.Errorf("expected an entry without certificates to be rejected: %v", err)
+	}
+	if _, err := d.Certificates(ctx, "nobody@corp.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	t.Setenv("TEST_LDAP_PASSWORD", "wrong")
+	var re *ResultError
+	if _, err := d.Certificates(ctx, "other@corp.com"); !errors.As(err, &re) || re.Code != 49 {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestPGPKeysWithStartTLS(t *testing.T) {
+	var armored bytes.Buffer
+	for _, email := range []string{"user@corp.com", "other@corp.com"} {
+		e, err := openpgp.NewEntity("Test", "", email, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Serialize(&armored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, c := startServer(t, true, map[string]map[string][][]byte{
+		"cn=user,dc=corp,dc=com": {
+			"mail":   {[]byte("user@corp.com")},
+			"pgpkey": {armored.Bytes()},
+		},
+	})
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.PGPKeys(context.Background(), "user@corp.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || len(keys[0].UserIDs) != 1 || !strings.Contains(keys[0].UserIDs[0], "user@corp.com") {
+		t.Fatalf("expected the key of user@corp.com only, got %+v", keys)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, c := range []Config{
+		{URL: "https://ldap.corp.com", BaseDN: "dc=corp,dc=com"},
+		{URL: "ldaps://ldap.corp.com"},
+		{URL: "ldaps://ldap.corp.com", BaseDN: "dc=corp,dc=com", BindPasswordSource: "env:X"},
+	} {
+		c := c
+		if _, err := New(&c); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+	if _, err := readPasswordSource("file:relative"); err == nil {
+		t.Error("expected a relative password file to be rejected")
+	}
+}
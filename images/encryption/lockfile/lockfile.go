@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package lockfile serializes the updates of files shared by several
+// processes, such as concurrently running decoders, with lock files.
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleLock is the age after which the lock of a crashed process is removed
+const staleLock = 30 * time.Second
+
+// Lock creates the lock file at path, waiting up to timeout for another
+// process holding it, and returns the function removing it
+func Lock(path string, timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Check returns an error unless the shared file at path and its directory are
+// owned by the user of the process and the directory is not writable by other
+// users, so that other users can neither plant the file or its lock before
+// the first process creates them nor replace them. The file need not exist.
+func Check(path string) error {
+	dir := filepath.Dir(path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if err := checkOwner(fi, true); err != nil {
+		return fmt.Errorf("refusing to use %s: directory %s %w", path, dir, err)
+	}
+	fi, err = os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("refusing to use %s: not a regular file", path)
+	}
+	if err := checkOwner(fi, false); err != nil {
+		return fmt.Errorf("refusing to use %s: the file %w", path, err)
+	}
+	return nil
+}
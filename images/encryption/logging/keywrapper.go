@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// loggedSchemes are the schemes whose key wrappers log their decisions;
+// keyproviders log theirs themselves
+var loggedSchemes = []string{"jwe", "pkcs7", "pgp", "pkcs11", "jwe-hybrid"}
+
+// keyWrapper logs which schemes are attempted or skipped to unwrap a layer
+// key and why they fail
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers registered with ocicrypt so that they log at
+// debug level with the logger of the context bound to the configuration with
+// tracing.Bind. It must be called after the other key wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for _, scheme := range loggedSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	if kw.KeyWrapper.NoPossibleKeys(dcparameters) {
+		// ocicrypt does not pass the configuration to bind a context to
+		G(context.Background()).Debug("skipping wrapped layer key, no keys given for its scheme", "scheme", kw.scheme)
+		return true
+	}
+	return false
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	l := G(tracing.Context(dc))
+	args := []interface{}{"scheme", kw.scheme, "keys", len(kw.GetPrivateKeys(dc.Parameters))}
+	if n, ok := countRecipients(annotation); ok {
+		args = append(args, "recipients", n)
+	}
+	l.Debug("attempting to unwrap layer key", args...)
+	optsData, err := kw.KeyWrapper.UnwrapKey(dc, annotation)
+	if err != nil {
+		l.Debug("unwrapping layer key failed", "scheme", kw.scheme, "error", err)
+		return nil, err
+	}
+	l.Debug("unwrapped layer key", "scheme", kw.scheme)
+	return optsData, nil
+}
+
+// countRecipients returns the number of recipients of a JWE in the JSON
+// serialization
+func countRecipients(annotation []byte) (int, bool) {
+	var jwe struct {
+		Recipients []json.RawMessage `json:"recipients"`
+	}
+	if json.Unmarshal(annotation, &jwe) != nil || jwe.Recipients == nil {
+		return 0, false
+	}
+	return len(jwe.Recipients), true
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package logging provides the structured logger imgcrypt logs its decisions
+// with, such as which keys and recipients were tried to unwrap a layer key. A
+// *slog.Logger satisfies the Logger interface as is, and FromLogrus adapts a
+// logrus entry; without a logger set, the logger of containerd is used.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger logs messages with key-value pairs of attributes in args; its methods
+// have the signatures of those of *slog.Logger
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+var (
+	defaultLogger Logger
+	loggerMu      sync.RWMutex
+)
+
+// SetLogger sets the logger used for all operations for which the context
+// does not carry a logger; nil restores the logger of containerd
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defaultLogger = l
+	loggerMu.Unlock()
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context whose operations are logged with the given logger
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// G returns the logger of the context, the one set with SetLogger, or one that
+// logs with containerd's logger of the context
+func G(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	loggerMu.RLock()
+	l := defaultLogger
+	loggerMu.RUnlock()
+	if l != nil {
+		return l
+	}
+	return FromLogrus(log.G(ctx))
+}
+
+// logrusLogger adapts a logrus entry to Logger
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// FromLogrus returns a Logger that logs with the given entry, adding the
+// attributes as fields
+func FromLogrus(entry *logrus.Entry) Logger {
+	return &logrusLogger{entry: entry}
+}
+
+func (l *logrusLogger) Debug(msg string, args ...interface{}) {
+	l.with(args).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, args ...interface{}) {
+	l.with(args).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, args ...interface{}) {
+	l.with(args).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, args ...interface{}) {
+	l.with(args).Error(msg)
+}
+
+// with returns the entry with the attributes as fields; like slog, a value
+// without a key is logged with the key !BADKEY
+func (l *logrusLogger) with(args []interface{}) *logrus.Entry {
+	if len(args) == 0 {
+		return l.entry
+	}
+	fields := make(logrus.Fields, len(args)/2+1)
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			fields["!BADKEY"] = args[0]
+			args = args[1:]
+			continue
+		}
+		if s, ok := args[1].(fmt.Stringer); ok {
+			fields[key] = s.String()
+		} else {
+			fields[key] = args[1]
+		}
+		args = args[2:]
+	}
+	return l.entry.WithFields(fields)
+}
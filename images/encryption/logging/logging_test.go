@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	"github.com/sirupsen/logrus"
+)
+
+type record struct {
+	level, msg string
+	args       []interface{}
+}
+
+type recorder struct {
+	records []record
+}
+
+func (r *recorder) log(level, msg string, args []interface{}) {
+	r.records = append(r.records, record{level, msg, args})
+}
+
+func (r *recorder) Debug(msg string, args ...interface{}) { r.log("debug", msg, args) }
+func (r *recorder) Info(msg string, args ...interface{})  { r.log("info", msg, args) }
+func (r *recorder) Warn(msg string, args ...interface{})  { r.log("warn", msg, args) }
+func (r *recorder) Error(msg string, args ...interface{}) { r.log("error", msg, args) }
+
+type failingKeyWrapper struct {
+	keywrap.KeyWrapper
+}
+
+func (failingKeyWrapper) GetPrivateKeys(map[string][][]byte) [][]byte {
+	return [][]byte{[]byte("key")}
+}
+
+func (failingKeyWrapper) UnwrapKey(*encconfig.DecryptConfig, []byte) ([]byte, error) {
+	return nil, errors.New("no matching key")
+}
+
+func TestG(t *testing.T) {
+	r := &recorder{}
+	SetLogger(r)
+	defer SetLogger(nil)
+	if G(context.Background()) != r {
+		t.Fatal("default logger not used")
+	}
+	other := &recorder{}
+	if G(WithLogger(context.Background(), other)) != other {
+		t.Fatal("logger of the context not used")
+	}
+}
+
+func TestFromLogrus(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	FromLogrus(logrus.NewEntry(logger)).Warn("not using key", "key", "a.pem", "error", errors.New("revoked"), "dangling")
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"msg": "not using key", "level": "warning", "key": "a.pem", "error": "revoked", "!BADKEY": "dangling"} {
+		if fields[k] != want {
+			t.Errorf("got %s %v, want %s", k, fields[k], want)
+		}
+	}
+}
+
+func TestUnwrapKeyLogging(t *testing.T) {
+	r := &recorder{}
+	SetLogger(r)
+	defer SetLogger(nil)
+
+	kw := &keyWrapper{failingKeyWrapper{}, "jwe"}
+	if _, err := kw.UnwrapKey(&encconfig.DecryptConfig{}, []byte(`{"recipients":[{},{}]}`)); err == nil {
+		t.Fatal("expected unwrapping to fail")
+	}
+	if len(r.records) != 2 {
+		t.Fatalf("got %d records, want 2", len(r.records))
+	}
+	attempt := r.records[0]
+	want := []interface{}{"scheme", "jwe", "keys", 1, "recipients", 2}
+	if len(attempt.args) != len(want) {
+		t.Fatalf("got attributes %v, want %v", attempt.args, want)
+	}
+	for i := range want {
+		if attempt.args[i] != want[i] {
+			t.Fatalf("got attributes %v, want %v", attempt.args, want)
+		}
+	}
+	if r.records[1].msg != "unwrapping layer key failed" || r.records[1].level != "debug" {
+		t.Fatalf("got record %+v", r.records[1])
+	}
+}
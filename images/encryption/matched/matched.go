@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package matched passes the recipient whose wrapped key was unwrapped from
+// the key wrapper of the scheme to the key wrappers that decorate it.
+//
+// Key wrappers are called without a context and only return the layer key,
+// so the key wrappers of the schemes report the recipient with Report to the
+// context bound to the DecryptConfig with tracing.Bind, and a decorator that
+// wants to know it binds a context returned by Track before calling them.
+package matched
+
+import (
+	"context"
+	"sync"
+)
+
+type trackerKey struct{}
+
+// Tracker holds the recipient reported in a context returned by Track
+type Tracker struct {
+	mu        sync.Mutex
+	recipient string
+}
+
+// Track returns a context derived from ctx in which the recipient reported
+// with Report is recorded by the returned Tracker
+func Track(ctx context.Context) (context.Context, *Tracker) {
+	t := &Tracker{}
+	return context.WithValue(ctx, trackerKey{}, t), t
+}
+
+// Report records in the Tracker of ctx, if any, that the layer key was
+// unwrapped with the key of the recipient, such as the ID of the key
+func Report(ctx context.Context, recipient string) {
+	if t, ok := ctx.Value(trackerKey{}).(*Tracker); ok {
+		t.mu.Lock()
+		t.recipient = recipient
+		t.mu.Unlock()
+	}
+}
+
+// Recipient returns the reported recipient, or "" if none was reported
+func (t *Tracker) Recipient() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recipient
+}
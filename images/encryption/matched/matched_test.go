@@ -0,0 +1,36 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package matched
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTrack(t *testing.T) {
+	// reports without a Tracker are dropped
+	Report(context.Background(), "dropped")
+
+	ctx, tr := Track(context.Background())
+	if r := tr.Recipient(); r != "" {
+		t.Fatalf("expected no recipient before a report, got %q", r)
+	}
+	Report(context.WithValue(ctx, struct{}{}, nil), "sha256:0123")
+	if r := tr.Recipient(); r != "sha256:0123" {
+		t.Fatalf("expected the reported recipient, got %q", r)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package membudget limits the memory that concurrent decryptions of layers
+// use together. Decoders run in separate processes, so each reserves its
+// share of the budget in a file shared by all of them; work that would
+// exceed the budget waits for reservations to be released or is rejected,
+// so that the pull fails cleanly instead of the decoder being killed for
+// lack of memory while the layer is unpacked.
+package membudget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/lockfile"
+	"github.com/containerd/imgcrypt/internal/procutil"
+)
+
+// DefaultReservation is the memory reserved for the decryption of a layer
+const DefaultReservation = 64 << 20
+
+// ErrExceeded is returned if a reservation does not fit into the budget
+var ErrExceeded = errors.New("memory budget exceeded")
+
+const (
+	// lockTimeout is how long to wait for other processes updating the
+	// reservations
+	lockTimeout = 5 * time.Second
+	// pollInterval is how often a waiting reservation is retried
+	pollInterval = 100 * time.Millisecond
+)
+
+// Budget is memory shared by the decryptions of all processes using the same
+// reservations file
+type Budget struct {
+	// Path is the file holding the reservations
+	Path string
+	// Limit is the number of bytes that can be reserved in total
+	Limit int64
+}
+
+type reservation struct {
+	ID    string `json:"id"`
+	PID   int    `json:"pid"`
+	Bytes int64  `json:"bytes"`
+}
+
+var lastID atomic.Int64
+
+// Reserve reserves n bytes of the budget, waiting for other reservations to
+// be released until ctx is done, and returns the function releasing them.
+// Reservations of processes that exited are released automatically.
+func (b *Budget) Reserve(ctx context.Context, n int64) (func(), error) {
+	if n > b.Limit {
+		return nil, fmt.Errorf("%w: %d bytes are needed but the limit is %d", ErrExceeded, n, b.Limit)
+	}
+	r := reservation{
+		ID:    fmt.Sprintf("%d-%d", os.Getpid(), lastID.Add(1)),
+		PID:   os.Getpid(),
+		Bytes: n,
+	}
+	for {
+		used, err := b.update(func(rs []reservation) ([]reservation, bool) {
+			if total(rs)+n > b.Limit {
+				return rs, false
+			}
+			return append(rs, r), true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if used < 0 {
+			return func() {
+				_, _ = b.update(func(rs []reservation) ([]reservation, bool) {
+					for i := range rs {
+						if rs[i].ID == r.ID {
+							return append(rs[:i], rs[i+1:]...), true
+						}
+					}
+					return rs, false
+				})
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %d of %d bytes are reserved and %d more are needed", ErrExceeded, used, b.Limit, n)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Used returns the number of bytes reserved by running processes
+func (b *Budget) Used() (int64, error) {
+	rs, err := b.read()
+	if err != nil {
+		return 0, err
+	}
+	return total(live(rs)), nil
+}
+
+func total(rs []reservation) int64 {
+	var n int64
+	for _, r := range rs {
+		n += r.Bytes
+	}
+	return n
+}
+
+func live(rs []reservation) []reservation {
+	alive := rs[:0]
+	for _, r := range rs {
+		if procutil.Alive(r.PID) {
+			alive = append(alive, r)
+		}
+	}
+	return alive
+}
+
+// update applies fn to the reservations of running processes and writes
+// them if fn changed them; it returns -1 if they were changed and otherwise
+// the number of bytes reserved
+func (b *Budget) update(fn func([]reservation) ([]reservation, bool)) (int64, error) {
+	if err := lockfile.Check(b.Path); err != nil {
+		return 0, err
+	}
+	unlock, err := lockfile.Lock(b.Path+".lock", lockTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	rs, err := b.read()
+	if err != nil {
+		return 0, err
+	}
+	rs, changed := fn(live(rs))
+	if !changed {
+		return total(rs), nil
+	}
+	return -1, b.write(rs)
+}
+
+func (b *Budget) read() ([]reservation, error) {
+	data, err := os.ReadFile(b.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rs []reservation
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &rs); err != nil {
+			return nil, fmt.Errorf("could not parse memory reservations in %s: %w", b.Path, err)
+		}
+	}
+	return rs, nil
+}
+
+func (b *Budget) write(rs []reservation) error {
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.Path), "."+filepath.Base(b.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.Path)
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package membudget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	b := &Budget{Path: filepath.Join(t.TempDir(), "budget.json"), Limit: 100}
+
+	release1, err := b.Reserve(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Reserve(ctx, 60); !errors.Is(err, ErrExceeded) {
+		t.Fatalf("expected ErrExceeded, got %v", err)
+	}
+	release2, err := b.Reserve(context.Background(), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, err := b.Used(); err != nil || used != 100 {
+		t.Fatalf("expected 100 bytes to be used, got %d, %v", used, err)
+	}
+
+	// a waiting reservation succeeds once memory is released
+	done := make(chan error)
+	go func() {
+		release, err := b.Reserve(context.Background(), 50)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	release1()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	if used, err := b.Used(); err != nil || used != 0 {
+		t.Fatalf("expected no bytes to be used, got %d, %v", used, err)
+	}
+}
+
+func TestReserveAboveLimit(t *testing.T) {
+	b := &Budget{Path: filepath.Join(t.TempDir(), "budget.json"), Limit: 100}
+	if _, err := b.Reserve(context.Background(), 101); !errors.Is(err, ErrExceeded) {
+		t.Fatalf("expected ErrExceeded, got %v", err)
+	}
+}
+
+func TestReserveRefusesSharedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the owner of the budget is not checked on Windows")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o1777); err != nil {
+		t.Fatal(err)
+	}
+	b := &Budget{Path: filepath.Join(dir, "budget.json"), Limit: 100}
+	if _, err := b.Reserve(context.Background(), 10); err == nil {
+		t.Fatal("expected a budget in a directory writable by other users to be refused")
+	}
+}
+
+func TestReserveReleasesDeadProcesses(t *testing.T) {
+	b := &Budget{Path: filepath.Join(t.TempDir(), "budget.json"), Limit: 100}
+	// a process ID that is not in use
+	data, _ := json.Marshal([]reservation{{ID: "dead", PID: 1 << 30, Bytes: 100}})
+	if err := os.WriteFile(b.Path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	release, err := b.Reserve(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
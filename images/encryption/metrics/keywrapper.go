@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+// instrumentedSchemes are the schemes whose unwrap time is recorded by their
+// key wrappers; keyproviders record theirs themselves
+var instrumentedSchemes = []string{"jwe", "pkcs7", "pgp", "pkcs11", "jwe-hybrid"}
+
+// keyWrapper records the time taken by a key wrapper to unwrap layer keys
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers registered with ocicrypt so that the time
+// they take to unwrap layer keys is recorded. It must be called after the
+// other key wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for _, scheme := range instrumentedSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() { ObserveUnwrap(kw.scheme, time.Since(start)) }()
+	return kw.KeyWrapper.UnwrapKey(dc, annotation)
+}
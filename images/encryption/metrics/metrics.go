@@ -0,0 +1,284 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package metrics records metrics of the decryption of image layers and
+// exposes them in the Prometheus text format, either over HTTP for long
+// running processes or in a file for the textfile collector of the node
+// exporter. Since ctd-decoder runs once per layer, it adds its metrics to
+// those already in the file.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+)
+
+type family struct {
+	name, help, typ string
+}
+
+// families are the metrics recorded by imgcrypt in the order they are written
+var families = []family{
+	{"imgcrypt_layers_decrypted_total", "Number of layers decrypted.", typeCounter},
+	{"imgcrypt_decrypted_bytes_total", "Number of bytes of decrypted layer data.", typeCounter},
+	{"imgcrypt_decryption_failures_total", "Number of failed layer decryptions by reason.", typeCounter},
+	{"imgcrypt_unwrap_duration_seconds", "Time taken to unwrap layer keys by wrap scheme.", typeHistogram},
+	{"imgcrypt_key_cache_requests_total", "Number of lookups of prefetched layer keys by result.", typeCounter},
+}
+
+// unwrapBuckets are the upper bounds of the unwrap duration buckets in seconds
+var unwrapBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Registry holds the values of metric series
+type Registry struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{values: make(map[string]float64)}
+}
+
+// Default is the registry the metrics of imgcrypt are recorded in
+var Default = NewRegistry()
+
+// series returns the name of a series with the given label pairs
+func series(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Add adds v to the series
+func (r *Registry) Add(series string, v float64) {
+	r.mu.Lock()
+	r.values[series] += v
+	r.mu.Unlock()
+}
+
+func (r *Registry) observe(name string, buckets []float64, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, le := range buckets {
+		// all buckets are written, including those still empty
+		k := series(name+"_bucket", append(labels, "le", formatFloat(le))...)
+		if v <= le {
+			r.values[k]++
+		} else {
+			r.values[k] += 0
+		}
+	}
+	r.values[series(name+"_bucket", append(labels, "le", "+Inf")...)]++
+	r.values[series(name+"_sum", labels...)] += v
+	r.values[series(name+"_count", labels...)]++
+}
+
+// LayerDecrypted records that a layer with the given size was decrypted
+func LayerDecrypted(size int64) {
+	Default.Add("imgcrypt_layers_decrypted_total", 1)
+	Default.Add("imgcrypt_decrypted_bytes_total", float64(size))
+}
+
+// DecryptionFailed records that the decryption of a layer failed for the reason
+func DecryptionFailed(reason string) {
+	Default.Add(series("imgcrypt_decryption_failures_total", "reason", reason), 1)
+}
+
+// ObserveUnwrap records the time taken to unwrap a layer key with the scheme
+func ObserveUnwrap(scheme string, d time.Duration) {
+	Default.observe("imgcrypt_unwrap_duration_seconds", unwrapBuckets, d.Seconds(), "scheme", scheme)
+}
+
+// CacheLookup records whether a prefetched layer key was found
+func CacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	Default.Add(series("imgcrypt_key_cache_requests_total", "result", result), 1)
+}
+
+// countingReader records the decryption of a layer once it was read entirely
+type countingReader struct {
+	r        io.Reader
+	classify func(error) string
+	n        int64
+	done     bool
+}
+
+// CountReader returns a reader of the decrypted layer data from r that records
+// the layer as decrypted when r is exhausted, or the decryption as failed for
+// the reason classify returns if reading r fails
+func CountReader(r io.Reader, classify func(error) string) io.Reader {
+	return &countingReader{r: r, classify: classify}
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if err != nil && !cr.done {
+		cr.done = true
+		if err == io.EOF {
+			LayerDecrypted(cr.n)
+		} else {
+			DecryptionFailed(cr.classify(err))
+		}
+	}
+	return n, err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// familyOf returns the family a series belongs to
+func familyOf(s string) (family, bool) {
+	name := s
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		name = s[:i]
+	}
+	for _, f := range families {
+		if name == f.name {
+			return f, true
+		}
+		if f.typ == typeHistogram {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if name == f.name+suffix {
+					return f, true
+				}
+			}
+		}
+	}
+	return family{}, false
+}
+
+// bucketLess orders the series of a family by name and labels, and buckets
+// by their upper bound
+func bucketLess(a, b string) bool {
+	ka, lea := splitLe(a)
+	kb, leb := splitLe(b)
+	if ka != kb {
+		return ka < kb
+	}
+	return lea < leb
+}
+
+func splitLe(s string) (string, float64) {
+	i := strings.Index(s, `le="`)
+	if i < 0 {
+		return s, 0
+	}
+	j := strings.IndexByte(s[i+4:], '"')
+	if j < 0 {
+		return s, 0
+	}
+	le := s[i+4 : i+4+j]
+	v, err := strconv.ParseFloat(le, 64)
+	if le == "+Inf" || err != nil {
+		v = math.Inf(1)
+	}
+	return s[:i] + s[i+4+j:], v
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	byFamily := make(map[string][]string)
+	for s := range r.values {
+		if f, ok := familyOf(s); ok {
+			byFamily[f.name] = append(byFamily[f.name], s)
+		}
+	}
+	var buf bytes.Buffer
+	for _, f := range families {
+		ss := byFamily[f.name]
+		if len(ss) == 0 {
+			continue
+		}
+		sort.Slice(ss, func(i, j int) bool { return bucketLess(ss[i], ss[j]) })
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range ss {
+			fmt.Fprintf(&buf, "%s %s\n", s, formatFloat(r.values[s]))
+		}
+	}
+	r.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// Merge adds the values of the series in the Prometheus text format read from
+// rd; series of unknown metrics are ignored
+func (r *Registry) Merge(rd io.Reader) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return fmt.Errorf("invalid metrics line %q", line)
+		}
+		s := strings.TrimSpace(line[:i])
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid value in metrics line %q: %w", line, err)
+		}
+		if _, ok := familyOf(s); ok {
+			r.Add(s, v)
+		}
+	}
+	return scanner.Err()
+}
+
+// Handler returns an HTTP handler serving the metrics of the Default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = Default.WriteTo(w)
+	})
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	Default = NewRegistry()
+	ObserveUnwrap("jwe", 20*time.Millisecond)
+	CacheLookup(true)
+	DecryptionFailed("key-not-found")
+	if _, err := io.Copy(io.Discard, CountReader(strings.NewReader("layer data"), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE imgcrypt_unwrap_duration_seconds histogram\n",
+		"imgcrypt_layers_decrypted_total 1\n",
+		"imgcrypt_decrypted_bytes_total 10\n",
+		`imgcrypt_decryption_failures_total{reason="key-not-found"} 1` + "\n",
+		`imgcrypt_unwrap_duration_seconds_bucket{scheme="jwe",le="0.01"} 0` + "\n",
+		`imgcrypt_unwrap_duration_seconds_bucket{scheme="jwe",le="0.05"} 1` + "\n",
+		`imgcrypt_unwrap_duration_seconds_count{scheme="jwe"} 1` + "\n",
+		`imgcrypt_key_cache_requests_total{result="hit"} 1` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+	if strings.Index(out, `le="5"`) > strings.Index(out, `le="10"`) {
+		t.Errorf("buckets are not ordered by their bounds:\n%s", out)
+	}
+}
+
+func TestUpdateTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imgcrypt.prom")
+	for i := 0; i < 2; i++ {
+		Default = NewRegistry()
+		LayerDecrypted(100)
+		ObserveUnwrap("pkcs11", time.Second)
+		if err := UpdateTextfile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"imgcrypt_layers_decrypted_total 2\n",
+		"imgcrypt_decrypted_bytes_total 200\n",
+		`imgcrypt_unwrap_duration_seconds_sum{scheme="pkcs11"} 2` + "\n",
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("missing %q in\n%s", line, data)
+		}
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: %v", err)
+	}
+}
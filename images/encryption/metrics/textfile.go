@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/lockfile"
+)
+
+// lockTimeout is how long UpdateTextfile waits for other processes updating
+// the file
+const lockTimeout = 5 * time.Second
+
+// UpdateTextfile adds the metrics of the Default registry to those in the
+// file at path, which is meant to be read by the textfile collector of the
+// node exporter, and resets the registry. Concurrent updates by several
+// processes are serialized with a lock file next to it, and the file is
+// replaced atomically.
+func UpdateTextfile(path string) error {
+	unlock, err := lockfile.Lock(path+".lock", lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	merged := NewRegistry()
+	f, err := os.Open(path)
+	if err == nil {
+		err = merged.Merge(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not read metrics from %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	Default.mu.Lock()
+	for s, v := range Default.values {
+		merged.values[s] += v
+	}
+	Default.values = make(map[string]float64)
+	Default.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := merged.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,33 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/containerd/identifiers"
+)
+
+// NamespaceKeysDir returns the directory below root that holds the decryption keys of
+// the given namespace
+func NamespaceKeysDir(root, namespace string) (string, error) {
+	if err := identifiers.Validate(namespace); err != nil {
+		return "", fmt.Errorf("invalid namespace: %w", err)
+	}
+	return filepath.Join(root, namespace), nil
+}
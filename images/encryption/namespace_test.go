@@ -0,0 +1,34 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNamespaceKeysDir(t *testing.T) {
+	dir, err := NamespaceKeysDir("/keys", "tenant-a")
+	if err != nil || dir != filepath.Join("/keys", "tenant-a") {
+		t.Fatalf("unexpected result %q, %v", dir, err)
+	}
+	for _, ns := range []string{"", "..", "../tenant-b", "a/b"} {
+		if _, err := NamespaceKeysDir("/keys", ns); err == nil {
+			t.Fatalf("expected namespace %q to be rejected", ns)
+		}
+	}
+}
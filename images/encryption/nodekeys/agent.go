@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nodekeys
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+)
+
+const (
+	// DefaultInterval is how often the agent fetches the keys if neither it
+	// nor the key server set an interval
+	DefaultInterval = time.Hour
+
+	minRetry = 5 * time.Second
+	maxRetry = 5 * time.Minute
+)
+
+// Agent keeps the keys of a node in a key directory in sync with a key server
+type Agent struct {
+	Client *Client
+	// Dir is the key directory of the decoder
+	Dir string
+	// Interval is how often the keys are fetched unless the key server sets
+	// the refreshAfter of the key set; DefaultInterval if zero
+	Interval time.Duration
+
+	refresh time.Duration
+}
+
+// Sync fetches the keys and installs them, returning whether any key changed
+func (a *Agent) Sync(ctx context.Context) (bool, error) {
+	ks, err := a.Client.Fetch(ctx)
+	if errors.Is(err, ErrNotModified) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	a.refresh = 0
+	if ks.RefreshAfter != "" {
+		a.refresh, _ = time.ParseDuration(ks.RefreshAfter)
+	}
+	return Install(a.Dir, ks.Keys)
+}
+
+// Run syncs the keys until ctx is done. If a sync fails, the installed keys
+// are kept and the sync is retried with exponential backoff.
+func (a *Agent) Run(ctx context.Context) error {
+	l := logging.G(ctx)
+	retry := minRetry
+	for {
+		changed, err := a.Sync(ctx)
+		wait := a.interval()
+		switch {
+		case err != nil:
+			l.Warn("failed to sync node keys, keeping the installed keys", "error", err, "retry", retry.String())
+			wait = retry
+			if retry *= 2; retry > maxRetry {
+				retry = maxRetry
+			}
+		case changed:
+			l.Info("installed node keys", "dir", a.Dir)
+			retry = minRetry
+		default:
+			retry = minRetry
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (a *Agent) interval() time.Duration {
+	switch {
+	case a.refresh > 0:
+		return a.refresh
+	case a.Interval > 0:
+		return a.Interval
+	}
+	return DefaultInterval
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nodekeys
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultGCPMetadataURL is the metadata server of Google Compute Engine
+	DefaultGCPMetadataURL = "http://metadata.google.internal"
+	// DefaultAWSMetadataURL is the instance metadata service of Amazon EC2
+	DefaultAWSMetadataURL = "http://169.254.169.254"
+)
+
+// maxIdentitySize limits the size of a token or identity document
+const maxIdentitySize = 64 << 10
+
+// TokenFile authenticates with the bootstrap token in a file, sent as bearer
+// token; the file is read for every request so that the token can be rotated
+type TokenFile struct {
+	Path string
+}
+
+// Authorize implements Credentials
+func (t TokenFile) Authorize(_ context.Context, req *http.Request) error {
+	data, err := os.ReadFile(t.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read bootstrap token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("bootstrap token file %s is empty", t.Path)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// GCPIdentity authenticates with the identity token that the metadata server
+// of Google Compute Engine issues for the instance, sent as bearer token; the
+// key server verifies its signature, audience and instance claims
+type GCPIdentity struct {
+	// Audience is the audience of the token, typically the URL of the key server
+	Audience string
+	// MetadataURL is DefaultGCPMetadataURL if empty
+	MetadataURL string
+}
+
+// Authorize implements Credentials
+func (g GCPIdentity) Authorize(ctx context.Context, req *http.Request) error {
+	base := g.MetadataURL
+	if base == "" {
+		base = DefaultGCPMetadataURL
+	}
+	u := base + "/computeMetadata/v1/instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(g.Audience)
+	mreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	mreq.Header.Set("Metadata-Flavor", "Google")
+	token, err := metadata(mreq)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// AWSIdentity authenticates with the PKCS#7 signed instance identity document
+// of Amazon EC2, read with IMDSv2 and sent with the AWS-PKCS7 authorization
+// scheme; the key server verifies the signature with the AWS certificate of
+// the region
+type AWSIdentity struct {
+	// MetadataURL is DefaultAWSMetadataURL if empty
+	MetadataURL string
+}
+
+// Authorize implements Credentials
+func (a AWSIdentity) Authorize(ctx context.Context, req *http.Request) error {
+	base := a.MetadataURL
+	if base == "" {
+		base = DefaultAWSMetadataURL
+	}
+	treq, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/latest/api/token", nil)
+	if err != nil {
+		return err
+	}
+	treq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadata(treq)
+	if err != nil {
+		return err
+	}
+	dreq, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/latest/dynamic/instance-identity/pkcs7", nil)
+	if err != nil {
+		return err
+	}
+	dreq.Header.Set("X-aws-ec2-metadata-token", token)
+	signature, err := metadata(dreq)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "AWS-PKCS7 "+strings.Join(strings.Fields(signature), ""))
+	return nil
+}
+
+// metadata returns the body of a request to a metadata service
+func metadata(req *http.Request) (string, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxIdentitySize))
+	if err != nil {
+		return "", fmt.Errorf("metadata service: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return strings.TrimSpace(string(data)), nil
+}
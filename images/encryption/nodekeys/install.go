@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nodekeys
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+)
+
+// manifestName is the file in the key directory listing the keys installed by
+// Install; it begins with a dot so that the decoder ignores it
+const manifestName = ".imgcrypt-agent.json"
+
+// keyName restricts the names of keys to plain file names
+var keyName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+type manifest struct {
+	Keys []string `json:"keys"`
+}
+
+// Install makes the keys the set of keys installed in dir by the agent and
+// returns whether any file was changed. Keys are written with mode 0600 by
+// renaming temporary files whose names begin with a dot, so that the decoder
+// never reads partially written keys. Keys installed earlier that are not in
+// the set are removed; files not installed by the agent are left alone.
+func Install(dir string, keys []Key) (bool, error) {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !keyName.MatchString(k.Name) || k.Name == manifestName {
+			return false, fmt.Errorf("invalid key name %q", k.Name)
+		}
+		if seen[k.Name] {
+			return false, fmt.Errorf("duplicate key %q", k.Name)
+		}
+		seen[k.Name] = true
+		if err := checkKey(k); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, k := range keys {
+		path := filepath.Join(dir, k.Name)
+		if cur, err := os.ReadFile(path); err == nil && bytes.Equal(cur, []byte(k.Data)) {
+			continue
+		}
+		if err := writeFile(dir, k.Name, []byte(k.Data)); err != nil {
+			return changed, fmt.Errorf("failed to install key %s: %w", k.Name, err)
+		}
+		changed = true
+	}
+
+	old, err := readManifest(dir)
+	if err != nil {
+		return changed, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.Name)
+	}
+	sort.Strings(names)
+	data, err := json.Marshal(manifest{Keys: names})
+	if err != nil {
+		return changed, err
+	}
+	if err := writeFile(dir, manifestName, data); err != nil {
+		return changed, err
+	}
+	for _, name := range old.Keys {
+		if seen[name] || !keyName.MatchString(name) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err == nil {
+			changed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return changed, fmt.Errorf("failed to remove key %s: %w", name, err)
+		}
+	}
+	return changed, nil
+}
+
+// Installed returns the names of the keys installed in dir by the agent
+func Installed(dir string) ([]string, error) {
+	m, err := readManifest(dir)
+	return m.Keys, err
+}
+
+// checkKey makes sure that the key can be used by the decoder without a password
+func checkKey(k Key) error {
+	data := []byte(k.Data)
+	if hybrid.IsPrivateKey(data) {
+		return nil
+	}
+	ki := keyinfo.Inspect(k.Name, data, nil)
+	switch {
+	case ki.Kind == keyinfo.KindPkcs11KeyFile:
+		return nil
+	case ki.Kind == keyinfo.KindPrivateKey && !ki.Encrypted:
+		return nil
+	case ki.Kind == keyinfo.KindPrivateKey:
+		return fmt.Errorf("key %s is encrypted; the decoder cannot use keys with a password", k.Name)
+	}
+	return fmt.Errorf("key %s is not a private key", k.Name)
+}
+
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid %s: %w", manifestName, err)
+	}
+	return m, nil
+}
+
+// writeFile atomically replaces the named file in dir
+func writeFile(dir, name string, data []byte) error {
+	f, err := os.CreateTemp(dir, ".imgcrypt-agent-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nodekeys
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func privateKeyPEM(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// fakeServer serves ks to the node "node1" authenticated with the token
+func fakeServer(t *testing.T, ks *KeySet) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/nodes/node1/keys" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		data, _ := json.Marshal(ks)
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(data)
+	}))
+}
+
+func TestAgentSync(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "static.pem"), []byte(privateKeyPEM(t)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &KeySet{Keys: []Key{{Name: "a.pem", Data: privateKeyPEM(t)}, {Name: "b.pem", Data: privateKeyPEM(t)}}, RefreshAfter: "10m"}
+	srv := fakeServer(t, ks)
+	defer srv.Close()
+
+	a := &Agent{Client: &Client{URL: srv.URL, Node: "node1", Credentials: TokenFile{Path: tokenFile}}, Dir: dir}
+	ctx := context.Background()
+	if changed, err := a.Sync(ctx); err != nil || !changed {
+		t.Fatalf("first sync: changed %v, error %v", changed, err)
+	}
+	if a.interval().String() != "10m0s" {
+		t.Fatalf("interval %s, want the refreshAfter of the key set", a.interval())
+	}
+	if changed, err := a.Sync(ctx); err != nil || changed {
+		t.Fatalf("unchanged sync: changed %v, error %v", changed, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "a.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("key installed with mode %v", info.Mode().Perm())
+	}
+
+	// rotate b.pem out; the key not installed by the agent stays
+	ks.Keys = ks.Keys[:1]
+	if changed, err := a.Sync(ctx); err != nil || !changed {
+		t.Fatalf("rotating sync: changed %v, error %v", changed, err)
+	}
+	for name, want := range map[string]bool{"a.pem": true, "b.pem": false, "static.pem": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Fatalf("%s exists: %v, want %v", name, err == nil, want)
+		}
+	}
+	if names, err := Installed(dir); err != nil || !reflect.DeepEqual(names, []string{"a.pem"}) {
+		t.Fatalf("installed %v, error %v", names, err)
+	}
+
+	a.Client.Credentials = TokenFile{Path: filepath.Join(t.TempDir(), "missing")}
+	if _, err := a.Sync(ctx); err == nil {
+		t.Fatal("expected sync without token to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.pem")); err != nil {
+		t.Fatal("failed sync removed the installed key")
+	}
+}
+
+func TestInstallRejects(t *testing.T) {
+	dir := t.TempDir()
+	for _, keys := range [][]Key{
+		{{Name: "../escape.pem", Data: privateKeyPEM(t)}},
+		{{Name: ".hidden", Data: privateKeyPEM(t)}},
+		{{Name: "a.pem", Data: "not a key"}},
+		{{Name: "a.pem", Data: privateKeyPEM(t)}, {Name: "a.pem", Data: privateKeyPEM(t)}},
+	} {
+		if _, err := Install(dir, keys); err == nil {
+			t.Fatalf("expected %v to be rejected", keys[0].Name)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("rejected keys left %d files", len(entries))
+	}
+}
+
+func TestAWSIdentity(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("imds-token"))
+		case r.URL.Path == "/latest/dynamic/instance-identity/pkcs7" && r.Header.Get("X-aws-ec2-metadata-token") == "imds-token":
+			w.Write([]byte("MIIB\nabcd\n"))
+		default:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}))
+	defer imds.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://keys.example.com", nil)
+	if err := (AWSIdentity{MetadataURL: imds.URL}).Authorize(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "AWS-PKCS7 MIIBabcd" {
+		t.Fatalf("Authorization %q", got)
+	}
+
+	c := &Client{URL: imds.URL, Node: "node1", Credentials: AWSIdentity{MetadataURL: imds.URL + "/missing"}}
+	if _, err := c.Fetch(context.Background()); err == nil || errors.Is(err, ErrNotModified) {
+		t.Fatalf("expected authentication failure, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package nydus recognizes the layers of Nydus (RAFS) images.
+//
+// A Nydus image consists of data blobs, which nydusd reads chunk by chunk on
+// demand, and a bootstrap layer holding the filesystem metadata, including the
+// digests of the chunks and, for blobs built with chunk encryption, their
+// keys. imgcrypt encrypts the bootstrap layer like any other layer and leaves
+// the data blobs as they are, so that they can still be loaded lazily while
+// their keys are only released to holders of the imgcrypt-managed keys.
+package nydus
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeBlob is the media type of Nydus data blobs
+	MediaTypeBlob = "application/vnd.oci.image.layer.nydus.blob.v1"
+	// AnnotationBlob marks a layer as Nydus data blob; older Nydus images
+	// use it on data blobs with the media type of gzip compressed layers
+	AnnotationBlob = "containerd.io/snapshot/nydus-blob"
+	// AnnotationBootstrap marks a layer as the bootstrap of a Nydus image
+	AnnotationBootstrap = "containerd.io/snapshot/nydus-bootstrap"
+)
+
+// IsBlob returns whether the layer is a Nydus data blob
+func IsBlob(desc ocispec.Descriptor) bool {
+	return desc.MediaType == MediaTypeBlob || desc.Annotations[AnnotationBlob] == "true"
+}
+
+// IsBootstrap returns whether the layer is the bootstrap of a Nydus image
+func IsBootstrap(desc ocispec.Descriptor) bool {
+	return desc.Annotations[AnnotationBootstrap] == "true"
+}
+
+// IsImage returns whether the layers are those of a Nydus image
+func IsImage(layers []ocispec.Descriptor) bool {
+	for _, l := range layers {
+		if IsBootstrap(l) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ocilayout reads and writes images in OCI image layout directories,
+// so that encrypted images can be moved between hosts without a registry.
+package ocilayout
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const indexFile = "index.json"
+
+// Layout is an OCI image layout directory. Its blobs are stored where the
+// local content store of containerd keeps them, so it serves as the provider
+// and ingester of the blobs of its images. The labels of its blobs, which an
+// OCI image layout has no place for, are only kept in memory.
+type Layout struct {
+	dir   string
+	store content.Store
+}
+
+// Open opens the OCI image layout in dir, creating it if it does not exist
+func Open(dir string) (*Layout, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	layoutPath := filepath.Join(dir, ocispec.ImageLayoutFile)
+	b, err := os.ReadFile(layoutPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		b, err = json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(layoutPath, b, 0644); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		var il ocispec.ImageLayout
+		if err := json.Unmarshal(b, &il); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", layoutPath, err)
+		}
+		if il.Version != ocispec.ImageLayoutVersion {
+			return nil, fmt.Errorf("unsupported OCI image layout version %q in %s", il.Version, dir)
+		}
+	}
+	store, err := local.NewLabeledStore(dir, &labelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		return nil, err
+	}
+	return &Layout{dir: dir, store: store}, nil
+}
+
+// Close removes the directory of incomplete blobs, which is not part of an
+// OCI image layout, unless it holds blobs of interrupted copies
+func (l *Layout) Close() error {
+	_ = os.Remove(filepath.Join(l.dir, "ingest"))
+	return nil
+}
+
+// ReaderAt returns a reader of the blob described by desc
+func (l *Layout) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return l.store.ReaderAt(ctx, desc)
+}
+
+// Writer returns a writer of a blob of the layout
+func (l *Layout) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	return l.store.Writer(ctx, opts...)
+}
+
+// Store returns the content store of the blobs of the layout, such as for
+// encrypting its images in place
+func (l *Layout) Store() content.Store {
+	return l.store
+}
+
+// Dir returns the directory of the layout
+func (l *Layout) Dir() string {
+	return l.dir
+}
+
+// Index returns the index of the layout
+func (l *Layout) Index() (ocispec.Index, error) {
+	var idx ocispec.Index
+	b, err := os.ReadFile(filepath.Join(l.dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		idx.SchemaVersion = 2
+		return idx, nil
+	}
+	if err != nil {
+		return idx, err
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return idx, fmt.Errorf("could not parse index of OCI image layout %s: %w", l.dir, err)
+	}
+	return idx, nil
+}
+
+// Resolve returns the descriptor of the image with the given name, which is
+// matched against the image name annotation of containerd and the reference
+// name annotation of the entries of the index; these annotations are removed
+// from the returned descriptor
+func (l *Layout) Resolve(name string) (ocispec.Descriptor, error) {
+	idx, err := l.Index()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, desc := range idx.Manifests {
+		if desc.Annotations[images.AnnotationImageName] == name || desc.Annotations[ocispec.AnnotationRefName] == name {
+			// the names are annotations of the index, not of the image
+			annotations := make(map[string]string, len(desc.Annotations))
+			for k, v := range desc.Annotations {
+				if k != images.AnnotationImageName && k != ocispec.AnnotationRefName {
+					annotations[k] = v
+				}
+			}
+			desc.Annotations = nil
+			if len(annotations) > 0 {
+				desc.Annotations = annotations
+			}
+			return desc, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image %s in OCI image layout %s: %w", name, l.dir, errdefs.ErrNotFound)
+}
+
+// Tag makes desc, whose blobs must be in the layout, the image with the given
+// name, replacing an image of that name
+func (l *Layout) Tag(name string, desc ocispec.Descriptor) error {
+	idx, err := l.Index()
+	if err != nil {
+		return err
+	}
+	annotations := make(map[string]string, len(desc.Annotations)+2)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[images.AnnotationImageName] = name
+	annotations[ocispec.AnnotationRefName] = name
+	desc.Annotations = annotations
+
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Annotations[images.AnnotationImageName] != name && m.Annotations[ocispec.AnnotationRefName] != name {
+			manifests = append(manifests, m)
+		}
+	}
+	idx.Manifests = append(manifests, desc)
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	// the index is replaced atomically so that readers never see a partial one
+	tmp, err := os.CreateTemp(l.dir, indexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(l.dir, indexFile))
+}
+
+// ImportArchive writes the blobs of the OCI image archive read from r, such as
+// one written by 'ctr images export' or by BuildKit with --output type=oci,
+// to the layout and returns the index of the archive; the index of the layout
+// is left unchanged. The digest of each blob is verified while it is written.
+func (l *Layout) ImportArchive(ctx context.Context, r io.Reader) (ocispec.Index, error) {
+	var (
+		idx      ocispec.Index
+		hasIndex bool
+	)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return idx, fmt.Errorf("could not read OCI image archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch {
+		case name == indexFile:
+			if err := json.NewDecoder(tr).Decode(&idx); err != nil {
+				return idx, fmt.Errorf("could not parse index of OCI image archive: %w", err)
+			}
+			hasIndex = true
+		case strings.HasPrefix(name, "blobs/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				continue
+			}
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+			if err := dgst.Validate(); err != nil {
+				return idx, fmt.Errorf("invalid blob %s in OCI image archive: %w", hdr.Name, err)
+			}
+			desc := ocispec.Descriptor{Digest: dgst, Size: hdr.Size}
+			if err := content.WriteBlob(ctx, l.store, "import-"+dgst.String(), tr, desc); err != nil {
+				return idx, fmt.Errorf("failed to write %s: %w", dgst, err)
+			}
+		}
+	}
+	if !hasIndex {
+		return idx, fmt.Errorf("OCI image archive has no %s", indexFile)
+	}
+	return idx, nil
+}
+
+// labelStore keeps the labels of the blobs of a layout in memory
+type labelStore struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *labelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyLabels(s.labels[dgst]), nil
+}
+
+func (s *labelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = copyLabels(labels)
+	return nil
+}
+
+func (s *labelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+		s.labels[dgst] = labels
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	return copyLabels(labels), nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
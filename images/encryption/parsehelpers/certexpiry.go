@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+)
+
+// ErrCertificateExpiring is returned with StrictCertExpiry if the certificate
+// of a recipient expires within the warning window
+var ErrCertificateExpiring = errors.New("recipient certificate expires too soon")
+
+// RecipientCertificate describes the certificate of a pkcs7 or x509
+// recipient, so that the encryptor can tell whom layer keys are wrapped for
+// and when they can no longer be wrapped for it
+type RecipientCertificate struct {
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans,omitempty"`
+	NotAfter  time.Time `json:"notAfter"`
+	// Expiring is set if the certificate expires within the warning window
+	// or has expired
+	Expiring bool `json:"expiring,omitempty"`
+}
+
+func (rc RecipientCertificate) String() string {
+	s := rc.Subject
+	if len(rc.SANs) > 0 {
+		s += " (" + strings.Join(rc.SANs, ", ") + ")"
+	}
+	return s + ", valid until " + rc.NotAfter.UTC().Format(time.RFC3339)
+}
+
+// Warning describes when an expiring certificate expires
+func (rc RecipientCertificate) Warning(now time.Time) string {
+	if !now.Before(rc.NotAfter) {
+		return fmt.Sprintf("the certificate of %s expired on %s", rc.Recipient, rc.NotAfter.UTC().Format(time.RFC3339))
+	}
+	days := int(rc.NotAfter.Sub(now).Hours() / 24)
+	return fmt.Sprintf("the certificate of %s expires in %d days, on %s", rc.Recipient, days, rc.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// describeCertificate describes a recipient certificate with its subject
+// alternative names
+func describeCertificate(recipient string, cert *x509.Certificate, now time.Time, window time.Duration) RecipientCertificate {
+	rc := RecipientCertificate{
+		Recipient: recipient,
+		Subject:   cert.Subject.String(),
+		NotAfter:  cert.NotAfter,
+		Expiring:  cert.NotAfter.Before(now.Add(window)),
+	}
+	rc.SANs = append(rc.SANs, cert.DNSNames...)
+	rc.SANs = append(rc.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		rc.SANs = append(rc.SANs, ip.String())
+	}
+	for _, u := range cert.URIs {
+		rc.SANs = append(rc.SANs, u.String())
+	}
+	return rc
+}
+
+// certExpiryWarning returns how long before their expiry certificates are
+// warned about
+func (args EncArgs) certExpiryWarning() time.Duration {
+	if args.CertExpiryWarning > 0 {
+		return args.CertExpiryWarning
+	}
+	return ExpiryWarning
+}
+
+// recipientCertificates returns the certificates of a pkcs7 or x509
+// recipient, the first of each chain
+func recipientCertificates(recipient string) ([]*x509.Certificate, error) {
+	protocol, value, _ := strings.Cut(recipient, ":")
+	var datas [][]byte
+	switch protocol {
+	case "pkcs7":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %s: %w", value, err)
+		}
+		datas = [][]byte{data}
+	case "x509":
+		d := ldapkeys.Current()
+		if d == nil {
+			return nil, fmt.Errorf("recipient %s: x509 recipients require an LDAP directory", recipient)
+		}
+		var err error
+		if datas, err = d.Certificates(context.Background(), value); err != nil {
+			return nil, fmt.Errorf("recipient %s: %w", recipient, err)
+		}
+	}
+	var certs []*x509.Certificate
+	for _, data := range datas {
+		chain, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %s: %w", recipient, err)
+		}
+		certs = append(certs, chain[0])
+	}
+	return certs, nil
+}
+
+// checkCertificateExpiry reports the certificates of the pkcs7 and x509
+// recipients and warns about those expiring within the warning window, or
+// refuses them with StrictCertExpiry, so that images are not encrypted for
+// keys that are about to be retired
+func checkCertificateExpiry(args EncArgs, recipients []string, now time.Time) error {
+	window := args.certExpiryWarning()
+	for _, recipient := range recipients {
+		certs, err := recipientCertificates(recipient)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			rc := describeCertificate(recipient, cert, now, window)
+			if rc.Expiring && args.StrictCertExpiry {
+				return fmt.Errorf("%w: %s", ErrCertificateExpiring, rc.Warning(now))
+			}
+			if args.ReportCertificate != nil {
+				args.ReportCertificate(rc)
+			} else if rc.Expiring {
+				logging.G(context.Background()).Warn(rc.Warning(now), "subject", rc.Subject)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/recipientgroups"
+)
+
+// Option sets one of the arguments from which CreateCryptoConfig and
+// CreateDecryptCryptoConfig create crypto configurations
+type Option func(*EncArgs) error
+
+// NewEncArgs returns the arguments set by the options after checking that
+// the recipients are well-formed and that the options can be combined, so
+// that mistakes are reported before any key is read or looked up
+func NewEncArgs(opts ...Option) (EncArgs, error) {
+	var args EncArgs
+	for _, opt := range opts {
+		if err := opt(&args); err != nil {
+			return EncArgs{}, err
+		}
+	}
+	if err := checkEncArgs(args); err != nil {
+		return EncArgs{}, err
+	}
+	return args, nil
+}
+
+// checkEncArgs returns an error if the arguments contradict each other or
+// set something that has no effect
+func checkEncArgs(args EncArgs) error {
+	recipients, _, err := args.RecipientGroups.Expand(args.Recipient)
+	if err != nil {
+		return err
+	}
+	decRecipients, _, err := args.RecipientGroups.Expand(args.DecRecipient)
+	if err != nil {
+		return err
+	}
+	schemes := make(map[string]bool)
+	for _, recipient := range recipients {
+		protocol, value, ok := strings.Cut(recipient, ":")
+		if !ok || value == "" {
+			return fmt.Errorf("recipient %q: invalid recipient format", recipient)
+		}
+		switch protocol {
+		case "pgp", "jwe", "pkcs7", "x509", "pkcs11", "provider", "kmip", "timelock", "threshold":
+		default:
+			return fmt.Errorf("recipient %q: provided protocol not recognized", recipient)
+		}
+		schemes[protocol] = true
+	}
+	for _, recipient := range decRecipients {
+		if protocol, value, _ := strings.Cut(recipient, ":"); (protocol != "pkcs7" && protocol != "x509") || value == "" {
+			return fmt.Errorf("decryption recipient %q: only pkcs7 certificates are needed for decryption", recipient)
+		}
+	}
+	switch args.GPGVersion {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("unsupported gpg version %q, expected v1 or v2", args.GPGVersion)
+	}
+	if len(args.RecipientCA) > 0 && args.AllowUnverifiedRecipient {
+		return errors.New("recipient CAs cannot be combined with unverified recipients")
+	}
+	if len(args.KeyLookup) > 0 && !schemes["pgp"] {
+		return errors.New("pgp key lookup requires pgp recipients")
+	}
+	if len(args.PGPFingerprint) > 0 && len(args.KeyLookup) == 0 {
+		return errors.New("pgp fingerprints confirm looked up keys and require pgp key lookup")
+	}
+	if args.ConfirmKey != nil && len(args.KeyLookup) == 0 {
+		return errors.New("key confirmation requires pgp key lookup")
+	}
+	if _, err := enccontext.Parse(args.EncryptionContext); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WithRecipients adds recipients in the format of --recipient, such as
+// "jwe:pubkey.pem", "pkcs7:cert.pem", "pgp:user@example.com", an identity
+// whose certificate is in the LDAP directory as "x509:user@example.com" or a
+// group defined with WithRecipientGroups as "group:<name>"
+func WithRecipients(recipients ...string) Option {
+	return func(args *EncArgs) error {
+		args.Recipient = append(args.Recipient, recipients...)
+		return nil
+	}
+}
+
+// WithRecipientGroups defines the groups that recipients given as
+// group:<name> expand to; members may be recipients of any scheme or other
+// groups
+func WithRecipientGroups(groups map[string][]string) Option {
+	return func(args *EncArgs) error {
+		if args.RecipientGroups == nil {
+			args.RecipientGroups = make(recipientgroups.Groups)
+		}
+		for name, members := range groups {
+			args.RecipientGroups[name] = members
+		}
+		return nil
+	}
+}
+
+// WithKeys adds private keys in the format of --key, such as
+// "privkey.pem:pass=secret" or a pkcs11 URI
+func WithKeys(keys ...string) Option {
+	return func(args *EncArgs) error {
+		args.Key = append(args.Key, keys...)
+		return nil
+	}
+}
+
+// WithDecRecipients adds the pkcs7 certificates needed to decrypt layers
+// wrapped for them, in the format of --dec-recipient
+func WithDecRecipients(recipients ...string) Option {
+	return func(args *EncArgs) error {
+		args.DecRecipient = append(args.DecRecipient, recipients...)
+		return nil
+	}
+}
+
+// WithKeyProvider wraps and unwraps layer keys with the named keyprovider;
+// the parameters, if any, are passed to it for wrapping
+func WithKeyProvider(name string, params ...string) Option {
+	return func(args *EncArgs) error {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("invalid keyprovider name %q", name)
+		}
+		if len(params) == 0 {
+			args.Recipient = append(args.Recipient, "provider:"+name)
+		}
+		for _, p := range params {
+			args.Recipient = append(args.Recipient, "provider:"+name+":"+p)
+		}
+		args.Key = append(args.Key, "provider:"+name)
+		return nil
+	}
+}
+
+// WithGPGHomedir sets the GPG home directory
+func WithGPGHomedir(dir string) Option {
+	return func(args *EncArgs) error {
+		args.GPGHomedir = dir
+		return nil
+	}
+}
+
+// WithGPGVersion sets the GPG version, "v1" or "v2"
+func WithGPGVersion(version string) Option {
+	return func(args *EncArgs) error {
+		args.GPGVersion = version
+		return nil
+	}
+}
+
+// WithGPGAgent has gpg-agent unwrap PGP wrapped keys
+func WithGPGAgent() Option {
+	return func(args *EncArgs) error {
+		args.GPGAgent = true
+		return nil
+	}
+}
+
+// WithGPGPassphrase has gpg-agent unwrap PGP wrapped keys with the key
+// unprotected by the passphrase through loopback pinentry
+func WithGPGPassphrase(passphrase []byte) Option {
+	return func(args *EncArgs) error {
+		args.GPGPassphrase = passphrase
+		return nil
+	}
+}
+
+// WithKeyUsagePolicy sets the path of the key usage policy
+func WithKeyUsagePolicy(path string) Option {
+	return func(args *EncArgs) error {
+		args.KeyUsagePolicy = path
+		return nil
+	}
+}
+
+// WithPkcs11Config sets the path of the ocicrypt configuration file with the
+// PKCS#11 settings instead of the one named by OCICRYPT_CONFIG
+func WithPkcs11Config(path string) Option {
+	return func(args *EncArgs) error {
+		args.Pkcs11Config = path
+		return nil
+	}
+}
+
+// WithRecipientCAs adds files with CA certificates that pkcs7 recipient
+// certificates must chain to
+func WithRecipientCAs(files ...string) Option {
+	return func(args *EncArgs) error {
+		args.RecipientCA = append(args.RecipientCA, files...)
+		return nil
+	}
+}
+
+// WithUnverifiedRecipients skips the verification of pkcs7 recipient
+// certificates
+func WithUnverifiedRecipients() Option {
+	return func(args *EncArgs) error {
+		args.AllowUnverifiedRecipient = true
+		return nil
+	}
+}
+
+// WithCertExpiryWarning sets how long before their expiry the certificates
+// of pkcs7 and x509 recipients are warned about; with strict they are refused
+func WithCertExpiryWarning(d time.Duration, strict bool) Option {
+	return func(args *EncArgs) error {
+		if d < 0 {
+			return fmt.Errorf("invalid certificate expiry warning %s", d)
+		}
+		args.CertExpiryWarning = d
+		args.StrictCertExpiry = strict
+		return nil
+	}
+}
+
+// WithCertificateReport sets the function called with each certificate of a
+// pkcs7 or x509 recipient that layer keys are wrapped for
+func WithCertificateReport(report func(RecipientCertificate)) Option {
+	return func(args *EncArgs) error {
+		if report == nil {
+			return errors.New("nil certificate report callback")
+		}
+		args.ReportCertificate = report
+		return nil
+	}
+}
+
+// WithPGPKeyLookup adds where the keys of pgp recipients missing from the
+// pubring are looked up: "wkd" or the hkps:// URL of a keyserver
+func WithPGPKeyLookup(sources ...string) Option {
+	return func(args *EncArgs) error {
+		args.KeyLookup = append(args.KeyLookup, sources...)
+		return nil
+	}
+}
+
+// WithPGPFingerprints adds fingerprints of looked up keys that are used
+// without confirmation
+func WithPGPFingerprints(fingerprints ...string) Option {
+	return func(args *EncArgs) error {
+		args.PGPFingerprint = append(args.PGPFingerprint, fingerprints...)
+		return nil
+	}
+}
+
+// WithKeyConfirmation sets the function asked whether a looked up key whose
+// fingerprint was not given may be used
+func WithKeyConfirmation(confirm func(recipient, fingerprint string, userIDs []string) (bool, error)) Option {
+	return func(args *EncArgs) error {
+		if confirm == nil {
+			return errors.New("nil key confirmation callback")
+		}
+		args.ConfirmKey = confirm
+		return nil
+	}
+}
+
+// WithPasswordCallback sets the function called for the password of a
+// private key file for which no or a wrong password was given
+func WithPasswordCallback(cb func(keyfile string) ([]byte, error)) Option {
+	return func(args *EncArgs) error {
+		if cb == nil {
+			return errors.New("nil password callback")
+		}
+		args.PasswordPrompt = cb
+		return nil
+	}
+}
+
+// WithPINCallback sets the function called for the PIN of a pkcs11 private
+// key whose URI has neither a pin-value nor a pin-source attribute
+func WithPINCallback(cb func(uri string) ([]byte, error)) Option {
+	return func(args *EncArgs) error {
+		if cb == nil {
+			return errors.New("nil PIN callback")
+		}
+		args.PINPrompt = cb
+		return nil
+	}
+}
+
+// WithEncryptionContext adds key=value pairs, such as the repository or the
+// tenant of an image, that layer keys are bound to when wrapped and that
+// they must be bound to when unwrapped
+func WithEncryptionContext(pairs ...string) Option {
+	return func(args *EncArgs) error {
+		args.EncryptionContext = append(args.EncryptionContext, pairs...)
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewEncArgs(t *testing.T) {
+	args, err := NewEncArgs(
+		WithRecipients("jwe:pubkey.pem", "pgp:user@example.com"),
+		WithKeyProvider("kms", "key1"),
+		WithGPGHomedir("/tmp/gnupg"),
+		WithGPGVersion("v2"),
+		WithPGPKeyLookup("wkd"),
+		WithPGPFingerprints("0123"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"jwe:pubkey.pem", "pgp:user@example.com", "provider:kms:key1"}; !reflect.DeepEqual(args.Recipient, expected) {
+		t.Errorf("expected recipients %v, got %v", expected, args.Recipient)
+	}
+	if expected := []string{"provider:kms"}; !reflect.DeepEqual(args.Key, expected) {
+		t.Errorf("expected keys %v, got %v", expected, args.Key)
+	}
+	if args.GPGHomedir != "/tmp/gnupg" || args.GPGVersion != "v2" {
+		t.Errorf("unexpected gpg settings %q %q", args.GPGHomedir, args.GPGVersion)
+	}
+
+	for name, opts := range map[string][]Option{
+		"malformed recipient":        {WithRecipients("pubkey.pem")},
+		"unknown protocol":           {WithRecipients("rsa:pubkey.pem")},
+		"non-pkcs7 dec recipient":    {WithDecRecipients("jwe:pubkey.pem")},
+		"gpg version":                {WithGPGVersion("3")},
+		"CA and unverified":          {WithRecipientCAs("ca.pem"), WithUnverifiedRecipients()},
+		"lookup without pgp":         {WithRecipients("jwe:pubkey.pem"), WithPGPKeyLookup("wkd")},
+		"fingerprint without lookup": {WithRecipients("pgp:user@example.com"), WithPGPFingerprints("0123")},
+		"keyprovider name":           {WithKeyProvider("a:b")},
+		"nil password callback":      {WithPasswordCallback(nil)},
+	} {
+		if _, err := NewEncArgs(opts...); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
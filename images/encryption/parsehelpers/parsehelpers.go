@@ -19,31 +19,118 @@
 package parsehelpers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
-
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/enccontext"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/gpgagent"
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/keychain"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/keyusage"
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/pgpcache"
+	"github.com/containerd/imgcrypt/images/encryption/pgpkeys"
+	"github.com/containerd/imgcrypt/images/encryption/recipientgroups"
+	"github.com/containerd/imgcrypt/images/encryption/securemem"
+	"github.com/containerd/imgcrypt/images/encryption/threshold"
 	"github.com/gobars/ocicrypt"
 	encconfig "github.com/gobars/ocicrypt/config"
-	"github.com/gobars/ocicrypt/config/pkcs11config"
 	"github.com/gobars/ocicrypt/crypto/pkcs11"
 	encutils "github.com/gobars/ocicrypt/utils"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// EncArgs are the recipients, keys and settings from which crypto
+// configurations are created, one field per ctr-enc flag.
+//
+// EncArgs should be built with NewEncArgs and options, which check the
+// combination of the settings; setting the fields directly is deprecated and
+// new settings are only added as options.
 type EncArgs struct {
 	GPGHomedir   string   // --gpg-homedir
 	GPGVersion   string   // --gpg-version
 	Key          []string // --key
 	Recipient    []string // --recipient
 	DecRecipient []string // --dec-recipient
+
+	// RecipientGroups defines the groups that recipients and decryption
+	// recipients given as group:<name> expand to
+	RecipientGroups recipientgroups.Groups
+
+	// GPGAgent has gpg-agent unwrap PGP wrapped keys instead of exporting
+	// the private keys from the keyring, so that smartcard keys can be used
+	GPGAgent bool // --gpg-agent
+	// GPGPassphrase, if set, is the passphrase of the PGP key that gpg-agent
+	// is given through loopback pinentry; it implies GPGAgent
+	GPGPassphrase []byte
+	// GPGPassphraseSource is where GPGPassphrase is read from if it is not
+	// set: file:<path> or env:<variable>
+	GPGPassphraseSource string // --gpg-passphrase-source
+
+	// KeyUsagePolicy is the path of a key usage policy; expired and revoked keys
+	// are removed from decryption configurations
+	KeyUsagePolicy string // --key-usage-policy
+
+	// RecipientCA lists files with the CA certificates that pkcs7 recipient
+	// certificates must chain to
+	RecipientCA []string // --recipient-ca
+	// AllowUnverifiedRecipient skips the verification of pkcs7 recipient certificates
+	AllowUnverifiedRecipient bool // --insecure-allow-unverified-recipient
+	// CertExpiryWarning is how long before their expiry the certificates of
+	// pkcs7 and x509 recipients are warned about; ExpiryWarning if zero
+	CertExpiryWarning time.Duration // --cert-expiry-warning
+	// StrictCertExpiry refuses to encrypt for certificates that expire within
+	// CertExpiryWarning instead of warning about them
+	StrictCertExpiry bool // --strict-cert-expiry
+	// ReportCertificate, if set, is called with each certificate of a pkcs7
+	// or x509 recipient that layer keys are wrapped for; expiring
+	// certificates are logged as warnings otherwise
+	ReportCertificate func(RecipientCertificate)
+
+	// KeyLookup lists where the keys of pgp recipients missing from the pubring
+	// are looked up: "wkd" or the hkps:// URL of a keyserver
+	KeyLookup []string // --pgp-key-lookup
+	// PGPFingerprint lists the fingerprints of looked up keys that are used
+	// without confirmation
+	PGPFingerprint []string // --pgp-fingerprint
+	// ConfirmKey, if set, is called to ask whether a looked up key whose
+	// fingerprint is not given in PGPFingerprint may be used
+	ConfirmKey func(recipient, fingerprint string, userIDs []string) (bool, error)
+
+	// PasswordPrompt, if set, is called to ask for the password of a private key
+	// file for which no or a wrong password was given
+	PasswordPrompt func(keyfile string) ([]byte, error)
+	// PINPrompt, if set, is called to ask for the PIN of a pkcs11 private key
+	// whose URI has neither a pin-value nor a pin-source attribute
+	PINPrompt func(uri string) ([]byte, error)
+
+	// Pkcs11Config is the path of the ocicrypt configuration file with the
+	// PKCS#11 settings; ocicrypt finds it through OCICRYPT_CONFIG if empty
+	Pkcs11Config string
+
+	// EncryptionContext lists the key=value pairs that layer keys are bound to
+	// when wrapped, and that they must be bound to when unwrapped
+	EncryptionContext []string // --encryption-context
 }
 
+// maxPasswordPrompts is the number of times the user is asked for the password of a key
+const maxPasswordPrompts = 3
+
 // processRecipientKeys sorts the array of recipients by type. Recipients may be either
-// x509 certificates, public keys, or PGP public keys identified by email address or name
-func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, [][]byte, [][]byte, [][]byte, error) {
+// x509 certificates given by file or by identity in the LDAP directory, public keys, PGP
+// public keys identified by email address or name, or PKCS#11 public keys given by key
+// file or RFC 7512 URI
+func processRecipientKeys(recipients []string, pkcs11ConfigPath string) ([][]byte, [][]byte, [][]byte, [][]byte, [][]byte, [][]byte, error) {
 	var (
 		gpgRecipients [][]byte
 		pubkeys       [][]byte
@@ -68,14 +155,24 @@ func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, []
 			gpgRecipients = append(gpgRecipients, []byte(value))
 
 		case "jwe":
-			tmp, err := os.ReadFile(value)
+			datas, err := readKeyFile(value)
 			if err != nil {
 				return nil, nil, nil, nil, nil, nil, fmt.Errorf("unable to read file: %w", err)
 			}
-			if !encutils.IsPublicKey(tmp) {
-				return nil, nil, nil, nil, nil, nil, errors.New("file provided is not a public key")
+			found := 0
+			for _, tmp := range datas {
+				if !encutils.IsPublicKey(tmp) && !hybrid.IsPublicKey(tmp) {
+					if value == Stdin {
+						continue
+					}
+					return nil, nil, nil, nil, nil, nil, errors.New("file provided is not a public key")
+				}
+				pubkeys = append(pubkeys, tmp)
+				found++
+			}
+			if found == 0 {
+				return nil, nil, nil, nil, nil, nil, errors.New("no public key in the standard input")
 			}
-			pubkeys = append(pubkeys, tmp)
 
 		case "pkcs7":
 			tmp, err := os.ReadFile(value)
@@ -87,7 +184,27 @@ func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, []
 			}
 			x509s = append(x509s, tmp)
 
+		case "x509":
+			// x509:<identity> is looked up in the LDAP directory
+			d := ldapkeys.Current()
+			if d == nil {
+				return nil, nil, nil, nil, nil, nil, fmt.Errorf("recipient %s: x509 recipients require an LDAP directory", recipient)
+			}
+			certs, err := d.Certificates(context.Background(), value)
+			if err != nil {
+				return nil, nil, nil, nil, nil, nil, fmt.Errorf("recipient %s: %w", recipient, err)
+			}
+			x509s = append(x509s, certs...)
+
 		case "pkcs11":
+			if isPkcs11URI(value) {
+				tmp, err := pkcs11URIKeyFile(recipient, "public", pkcs11ConfigPath)
+				if err != nil {
+					return nil, nil, nil, nil, nil, nil, err
+				}
+				pkcs11Yamls = append(pkcs11Yamls, tmp)
+				continue
+			}
 			tmp, err := os.ReadFile(value)
 			if err != nil {
 				return nil, nil, nil, nil, nil, nil, fmt.Errorf("unable to read file %s: %w", value, err)
@@ -103,6 +220,14 @@ func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, []
 		case "provider":
 			keyProvider = append(keyProvider, []byte(value))
 
+		case "kmip":
+			// kmip:<endpoint>/<key-id> is handled by the in-process kmip keyprovider
+			keyProvider = append(keyProvider, []byte(recipient))
+
+		case "timelock":
+			// timelock:<unlock-time>@<service> is handled by the in-process timelock keyprovider
+			keyProvider = append(keyProvider, []byte(recipient))
+
 		default:
 			return nil, nil, nil, nil, nil, nil, errors.New("provided protocol not recognized")
 		}
@@ -114,12 +239,15 @@ func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, []
 // - file=<passwordfile>
 // - pass=<password>
 // - fd=<filedescriptor>
+// - keychain=<name>
 // - <password>
 func processPwdString(pwdString string) ([]byte, error) {
 	if strings.HasPrefix(pwdString, "file=") {
 		return os.ReadFile(pwdString[5:])
 	} else if strings.HasPrefix(pwdString, "pass=") {
 		return []byte(pwdString[5:]), nil
+	} else if strings.HasPrefix(pwdString, "keychain=") {
+		return keychain.Lookup(pwdString[9:])
 	} else if strings.HasPrefix(pwdString, "fd=") {
 		fdStr := pwdString[3:]
 		fd, err := strconv.Atoi(fdStr)
@@ -141,6 +269,12 @@ func processPwdString(pwdString string) ([]byte, error) {
 	return []byte(pwdString), nil
 }
 
+// ParsePassword parses a password given in any of the forms accepted after the
+// colon of a private key file
+func ParsePassword(pwdString string) ([]byte, error) {
+	return processPwdString(pwdString)
+}
+
 // processPrivateKeyFiles sorts the different types of private key files; private key files may either be
 // private keys or GPG private key ring files. The private key files may include the password for the
 // private key and take any of the following forms:
@@ -148,9 +282,13 @@ func processPwdString(pwdString string) ([]byte, error) {
 // - <filename>:file=<passwordfile>
 // - <filename>:pass=<password>
 // - <filename>:fd=<filedescriptor>
+// - <filename>:keychain=<name>
 // - <filename>:<password>
 // - keyprovider:<...>
-func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]byte, [][]byte, [][]byte, [][]byte, error) {
+// - pkcs11:<RFC 7512 URI path and query>
+// If the password of a private key is missing or wrong and a prompt is passed, the
+// user is asked for the password; likewise for the PIN of a pkcs11 key without one.
+func processPrivateKeyFiles(keyFilesAndPwds []string, prompt, pinPrompt func(string) ([]byte, error), pkcs11ConfigPath string) ([][]byte, [][]byte, [][]byte, [][]byte, [][]byte, [][]byte, error) {
 	var (
 		gpgSecretKeyRingFiles [][]byte
 		gpgSecretKeyPasswords [][]byte
@@ -169,6 +307,18 @@ func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]b
 			keyProviders = append(keyProviders, []byte(keyfileAndPwd[9:]))
 			continue
 		}
+		// as well as PKCS#11 URIs, which contain colons
+		if strings.HasPrefix(keyfileAndPwd, "pkcs11:") && isPkcs11URI(keyfileAndPwd[7:]) {
+			tmp, err := pkcs11URIKeyFile(keyfileAndPwd, "private", pkcs11ConfigPath)
+			if err == nil {
+				tmp, err = withPkcs11PIN(tmp, pinPrompt)
+			}
+			if err != nil {
+				return nil, nil, nil, nil, nil, nil, err
+			}
+			pkcs11Yamls = append(pkcs11Yamls, tmp)
+			continue
+		}
 		parts := strings.Split(keyfileAndPwd, ":")
 		if len(parts) == 2 {
 			password, err = processPwdString(parts[1])
@@ -178,32 +328,61 @@ func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]b
 		}
 
 		keyfile := parts[0]
-		tmp, err := os.ReadFile(keyfile)
+		datas, err := readKeyFile(keyfile)
 		if err != nil {
 			return nil, nil, nil, nil, nil, nil, err
 		}
-		isPrivKey, err := encutils.IsPrivateKey(tmp, password)
-		if encutils.IsPasswordError(err) {
-			return nil, nil, nil, nil, nil, nil, err
-		}
+		found := 0
+		for _, tmp := range datas {
+			if hybrid.IsPrivateKey(tmp) {
+				privkeys = append(privkeys, tmp)
+				privkeysPasswords = append(privkeysPasswords, nil)
+				found++
+				continue
+			}
+			password := password
+			isPrivKey, err := encutils.IsPrivateKey(tmp, password)
+			for i := 0; encutils.IsPasswordError(err) && prompt != nil && i < maxPasswordPrompts; i++ {
+				password, err = prompt(keyfile)
+				if err != nil {
+					return nil, nil, nil, nil, nil, nil, err
+				}
+				isPrivKey, err = encutils.IsPrivateKey(tmp, password)
+			}
+			if encutils.IsPasswordError(err) {
+				return nil, nil, nil, nil, nil, nil, err
+			}
 
-		if encutils.IsPkcs11PrivateKey(tmp) {
-			pkcs11Yamls = append(pkcs11Yamls, tmp)
-		} else if isPrivKey {
-			privkeys = append(privkeys, tmp)
-			privkeysPasswords = append(privkeysPasswords, password)
-		} else if encutils.IsGPGPrivateKeyRing(tmp) {
-			gpgSecretKeyRingFiles = append(gpgSecretKeyRingFiles, tmp)
-			gpgSecretKeyPasswords = append(gpgSecretKeyPasswords, password)
-		} else {
-			return nil, nil, nil, nil, nil, nil, fmt.Errorf("unidentified private key in file %s", keyfile)
+			if encutils.IsPkcs11PrivateKey(tmp) {
+				if tmp, err = withPkcs11PIN(tmp, pinPrompt); err != nil {
+					return nil, nil, nil, nil, nil, nil, err
+				}
+				pkcs11Yamls = append(pkcs11Yamls, tmp)
+			} else if isPrivKey {
+				privkeys = append(privkeys, tmp)
+				privkeysPasswords = append(privkeysPasswords, password)
+			} else if encutils.IsGPGPrivateKeyRing(tmp) {
+				gpgSecretKeyRingFiles = append(gpgSecretKeyRingFiles, tmp)
+				gpgSecretKeyPasswords = append(gpgSecretKeyPasswords, password)
+			} else if keyfile == Stdin {
+				// the standard input may also hold the public keys of recipients
+				continue
+			} else {
+				return nil, nil, nil, nil, nil, nil, fmt.Errorf("unidentified private key in file %s", keyfile)
+			}
+			found++
+		}
+		if found == 0 {
+			return nil, nil, nil, nil, nil, nil, errors.New("no private key in the standard input")
 		}
 	}
 	return gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privkeys, privkeysPasswords, pkcs11Yamls, keyProviders, nil
 }
 
+// CreateGPGClient returns the GPG client for the GPG version and home directory
+// of args, which is shared by all callers asking for the same ones
 func CreateGPGClient(args EncArgs) (ocicrypt.GPGClient, error) {
-	return ocicrypt.NewGPGClient(args.GPGVersion, args.GPGHomedir)
+	return pgpcache.NewGPGClient(args.GPGVersion, args.GPGHomedir)
 }
 
 func getGPGPrivateKeys(args EncArgs, gpgSecretKeyRingFiles [][]byte, descs []ocispec.Descriptor, mustFindKey bool) (gpgPrivKeys [][]byte, gpgPrivKeysPwds [][]byte, err error) {
@@ -214,7 +393,7 @@ func getGPGPrivateKeys(args EncArgs, gpgSecretKeyRingFiles [][]byte, descs []oci
 
 	var gpgVault ocicrypt.GPGVault
 	if len(gpgSecretKeyRingFiles) > 0 {
-		gpgVault = ocicrypt.NewGPGVault()
+		gpgVault = pgpcache.NewVault()
 		err = gpgVault.AddSecretKeyRingDataArray(gpgSecretKeyRingFiles)
 		if err != nil {
 			return nil, nil, err
@@ -223,19 +402,50 @@ func getGPGPrivateKeys(args EncArgs, gpgSecretKeyRingFiles [][]byte, descs []oci
 	return ocicrypt.GPGGetPrivateKey(descs, gpgClient, gpgVault, mustFindKey)
 }
 
+// readGPGPubRing reads the public keys of the GPG home directory natively from
+// its keybox or keyring and has gpg export them if that fails, for example
+// because they are kept by keyboxd
+func readGPGPubRing(args EncArgs) ([]byte, error) {
+	pubring, err := pgpkeys.ReadPubring(args.GPGHomedir, args.GPGVersion)
+	if err == nil {
+		return pubring, nil
+	}
+	gpgClient, gpgErr := CreateGPGClient(args)
+	if gpgErr != nil {
+		return nil, fmt.Errorf("could not read GPG public keys: %w", err)
+	}
+	return gpgClient.ReadGPGPubRingFile()
+}
+
 // CreateDecryptCryptoConfig creates the CryptoConfig object that contains the necessary
 // information to perform decryption from command line options and possibly
 // LayerInfos describing the image and helping us to query for the PGP decryption keys
 func CreateDecryptCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.CryptoConfig, error) {
 	ccs := []encconfig.CryptoConfig{}
 
+	passphrase := args.GPGPassphrase
+	if passphrase == nil && args.GPGPassphraseSource != "" {
+		var err error
+		if passphrase, err = gpgagent.ReadPassphraseSource(args.GPGPassphraseSource); err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+	}
+	if passphrase != nil {
+		// the passphrase can only be given to gpg-agent
+		args.GPGAgent = true
+	}
+
 	// x509 cert is needed for PKCS7 decryption
-	_, _, x509s, _, _, _, err := processRecipientKeys(args.DecRecipient)
+	decRecipients, _, err := args.RecipientGroups.Expand(args.DecRecipient)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+	_, _, x509s, _, _, _, err := processRecipientKeys(decRecipients, args.Pkcs11Config)
 	if err != nil {
 		return encconfig.CryptoConfig{}, err
 	}
 
-	gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privKeys, privKeysPasswords, pkcs11Yamls, keyProviders, err := processPrivateKeyFiles(args.Key)
+	gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privKeys, privKeysPasswords, pkcs11Yamls, keyProviders, err := processPrivateKeyFiles(args.Key, args.PasswordPrompt, args.PINPrompt, args.Pkcs11Config)
 	if err != nil {
 		return encconfig.CryptoConfig{}, err
 	}
@@ -243,8 +453,12 @@ func CreateDecryptCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (enccon
 	_, err = CreateGPGClient(args)
 	gpgInstalled := err == nil
 	if gpgInstalled {
-		if len(gpgSecretKeyRingFiles) == 0 && len(privKeys) == 0 && len(pkcs11Yamls) == 0 && len(keyProviders) == 0 && descs != nil {
+		if args.GPGAgent {
+			gpgagent.Install()
+		}
+		if !args.GPGAgent && len(gpgSecretKeyRingFiles) == 0 && len(privKeys) == 0 && len(pkcs11Yamls) == 0 && len(keyProviders) == 0 && descs != nil {
 			// Get pgp private keys from keyring only if no private key was passed
+			// and gpg-agent is not asked to use them
 			gpgPrivKeys, gpgPrivKeyPasswords, err := getGPGPrivateKeys(args, gpgSecretKeyRingFiles, descs, true)
 			if err != nil {
 				return encconfig.CryptoConfig{}, err
@@ -273,6 +487,10 @@ func CreateDecryptCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (enccon
 		}
 		ccs = append(ccs, x509sCc)
 	}
+	privKeys, privKeysPasswords, hybridPrivKeys := splitHybridPrivateKeys(privKeys, privKeysPasswords)
+	if len(hybridPrivKeys) > 0 {
+		ccs = append(ccs, hybrid.DecryptWithPrivateKeys(hybridPrivKeys))
+	}
 	if len(privKeys) > 0 {
 		privKeysCc, err := encconfig.DecryptWithPrivKeys(privKeys, privKeysPasswords)
 		if err != nil {
@@ -281,7 +499,7 @@ func CreateDecryptCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (enccon
 		ccs = append(ccs, privKeysCc)
 	}
 	if len(pkcs11Yamls) > 0 {
-		p11conf, err := pkcs11config.GetUserPkcs11Config()
+		p11conf, err := LoadPkcs11Config(args.Pkcs11Config)
 		if err != nil {
 			return encconfig.CryptoConfig{}, err
 		}
@@ -298,17 +516,255 @@ func CreateDecryptCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (enccon
 		}
 		ccs = append(ccs, keyProviderCc)
 	}
-	return encconfig.CombineCryptoConfigs(ccs), nil
+	cc := encconfig.CombineCryptoConfigs(ccs)
+	if args.GPGAgent && gpgInstalled {
+		if cc.DecryptConfig == nil {
+			cc.DecryptConfig = &encconfig.DecryptConfig{}
+		}
+		if passphrase != nil {
+			gpgagent.WithAgentPassphrase(cc.DecryptConfig, args.GPGHomedir, passphrase)
+		} else {
+			gpgagent.WithAgent(cc.DecryptConfig, args.GPGHomedir)
+		}
+	}
+	if len(args.EncryptionContext) > 0 {
+		c, err := enccontext.Parse(args.EncryptionContext)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		if cc.DecryptConfig == nil {
+			cc.DecryptConfig = &encconfig.DecryptConfig{}
+		}
+		if cc.DecryptConfig.Parameters == nil {
+			cc.DecryptConfig.Parameters = make(map[string][][]byte)
+		}
+		enccontext.Set(cc.DecryptConfig.Parameters, c)
+	}
+	if cc.DecryptConfig != nil {
+		// the private keys and passwords are kept outside of the Go heap
+		// until the configuration is released with ReleaseCryptoConfig
+		if err := securemem.ProtectParameters(cc.DecryptConfig.Parameters); err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+	}
+	if args.KeyUsagePolicy != "" && cc.DecryptConfig != nil {
+		p, err := keyusage.Load(args.KeyUsagePolicy)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		var rejections []keyusage.Rejection
+		cc.DecryptConfig, rejections = p.Filter(cc.DecryptConfig, time.Now())
+		for _, r := range rejections {
+			logging.G(context.Background()).Warn("not using key rejected by the key usage policy", "key", r.Key, "reason", r.Reason)
+		}
+	}
+	return cc, nil
+}
+
+// ReleaseCryptoConfig zeroes and releases the private keys and passwords of a
+// CryptoConfig created by CreateDecryptCryptoConfig or CreateCryptoConfig,
+// which must not be used afterwards
+func ReleaseCryptoConfig(cc *encconfig.CryptoConfig) {
+	if cc.DecryptConfig != nil {
+		securemem.ReleaseParameters(cc.DecryptConfig.Parameters)
+	}
+	if cc.EncryptConfig != nil {
+		securemem.ReleaseParameters(cc.EncryptConfig.DecryptConfig.Parameters)
+	}
+}
+
+// splitHybridPublicKeys separates the hybrid public keys from the public keys
+// of the jwe scheme
+func splitHybridPublicKeys(pubKeys [][]byte) ([][]byte, [][]byte) {
+	var jweKeys, hybridKeys [][]byte
+	for _, key := range pubKeys {
+		if hybrid.IsPublicKey(key) {
+			hybridKeys = append(hybridKeys, key)
+		} else {
+			jweKeys = append(jweKeys, key)
+		}
+	}
+	return jweKeys, hybridKeys
+}
+
+// splitHybridPrivateKeys separates the hybrid private keys from the private
+// keys of the jwe scheme and their passwords
+func splitHybridPrivateKeys(privKeys, passwords [][]byte) ([][]byte, [][]byte, [][]byte) {
+	var jweKeys, jwePasswords, hybridKeys [][]byte
+	for i, key := range privKeys {
+		if hybrid.IsPrivateKey(key) {
+			hybridKeys = append(hybridKeys, key)
+		} else {
+			jweKeys = append(jweKeys, key)
+			jwePasswords = append(jwePasswords, passwords[i])
+		}
+	}
+	return jweKeys, jwePasswords, hybridKeys
 }
 
-// CreateCryptoConfig from the list of recipient strings and list of key paths of private keys
+// checkFIPSRecipients returns an error if layer keys cannot be wrapped for
+// all recipients in FIPS mode
+func checkFIPSRecipients(gpgRecipients, pubKeys, x509s, hybridPubKeys [][]byte) error {
+	if len(gpgRecipients) > 0 {
+		return fips.CheckScheme("pgp")
+	}
+	if len(hybridPubKeys) > 0 {
+		return fips.CheckScheme(hybrid.Scheme)
+	}
+	if len(x509s) > 0 {
+		return fips.CheckScheme("pkcs7")
+	}
+	for _, data := range pubKeys {
+		key, err := encutils.ParsePublicKey(data, "JWE")
+		if err != nil {
+			return err
+		}
+		if err := fips.CheckPublicKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recipientScheme returns the wrap scheme of a recipient given on the command line
+func recipientScheme(recipient string) string {
+	protocol, value, _ := strings.Cut(recipient, ":")
+	switch protocol {
+	case "provider":
+		name, _, _ := strings.Cut(value, ":")
+		return "provider." + name
+	case "x509":
+		return "pkcs7"
+	case "jwe":
+		if data, err := os.ReadFile(value); err == nil && hybrid.IsPublicKey(data) {
+			return hybrid.Scheme
+		}
+	}
+	return protocol
+}
+
+// checkPolicyRecipients returns an error if the algorithm policy does not
+// allow layer keys to be wrapped for all recipients
+func checkPolicyRecipients(recipients []string) error {
+	policy := algpolicy.Current()
+	for _, recipient := range recipients {
+		if err := policy.CheckScheme(recipientScheme(recipient)); err != nil {
+			return fmt.Errorf("recipient %s: %w", recipient, err)
+		}
+	}
+	return nil
+}
+
+// parseThresholdRecipient parses a recipient threshold:<k>:<file>,<file>,...
+// into a group of the public keys in the files, of which k must jointly decrypt
+func parseThresholdRecipient(recipient string) (threshold.Group, []string, error) {
+	_, value, _ := strings.Cut(recipient, ":")
+	k, list, ok := strings.Cut(value, ":")
+	if !ok || list == "" {
+		return threshold.Group{}, nil, fmt.Errorf("recipient %s: expected threshold:<k>:<file>,<file>,...", recipient)
+	}
+	n, err := strconv.Atoi(k)
+	if err != nil {
+		return threshold.Group{}, nil, fmt.Errorf("recipient %s: invalid threshold %q", recipient, k)
+	}
+	g := threshold.Group{Threshold: n}
+	files := strings.Split(list, ",")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return threshold.Group{}, nil, fmt.Errorf("unable to read file %s: %w", file, err)
+		}
+		if !encutils.IsPublicKey(data) {
+			return threshold.Group{}, nil, fmt.Errorf("recipient %s: %s is not a public key", recipient, file)
+		}
+		g.PublicKeys = append(g.PublicKeys, data)
+	}
+	return g, files, nil
+}
+
+// splitThresholdRecipients returns the recipients other than the threshold
+// recipients and the groups of the threshold recipients
+func splitThresholdRecipients(recipients []string) ([]string, []threshold.Group, error) {
+	var (
+		others []string
+		groups []threshold.Group
+	)
+	for _, recipient := range recipients {
+		if !strings.HasPrefix(recipient, threshold.Scheme+":") {
+			others = append(others, recipient)
+			continue
+		}
+		g, _, err := parseThresholdRecipient(recipient)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := g.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("recipient %s: %w", recipient, err)
+		}
+		groups = append(groups, g)
+	}
+	return others, groups, nil
+}
+
+// withEscrowRecipients returns the recipients with the escrow recipients of
+// the escrow policy added, unless they are already among them
+func withEscrowRecipients(recipients []string) []string {
+	p := escrow.Current()
+	if p == nil || len(recipients) == 0 {
+		return recipients
+	}
+	result := append([]string{}, recipients...)
+	for _, r := range p.Recipients {
+		found := false
+		for _, have := range recipients {
+			if have == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// groupMembers describes the members of the recipient groups for the key
+// metadata the way the metadata describes the recipients of wrapped keys: by
+// the IDs of their public keys, or by hints that do not reveal them
+func groupMembers(groups map[string][]string) map[string][]keymeta.Key {
+	described := make(map[string][]keymeta.Key, len(groups))
+	for name, members := range groups {
+		for _, m := range members {
+			k := keymeta.Key{Scheme: recipientScheme(m)}
+			protocol, value, _ := strings.Cut(m, ":")
+			switch protocol {
+			case "jwe", "pkcs7":
+				if data, err := os.ReadFile(value); err == nil {
+					k.KeyID, _ = keymeta.PublicKeyID(data)
+				}
+			}
+			if k.KeyID == "" {
+				k.Hint = keymeta.RecipientHint([]byte(value))
+			}
+			described[name] = append(described[name], k)
+		}
+	}
+	return described
+}
+
+// CreateCryptoConfig from the list of recipient strings and list of key paths of private keys;
+// with an escrow policy the layer keys are also wrapped for its escrow recipients
 func CreateCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.CryptoConfig, error) {
-	recipients := args.Recipient
+	recipients, groups, err := args.RecipientGroups.Expand(withEscrowRecipients(args.Recipient))
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
 	keys := args.Key
 
 	var decryptCc *encconfig.CryptoConfig
 	ccs := []encconfig.CryptoConfig{}
-	if len(keys) > 0 {
+	if len(keys) > 0 || args.GPGAgent {
 		dcc, err := CreateDecryptCryptoConfig(args, descs)
 		if err != nil {
 			return encconfig.CryptoConfig{}, err
@@ -318,19 +774,54 @@ func CreateCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.Cry
 	}
 
 	if len(recipients) > 0 {
-		gpgRecipients, pubKeys, x509s, pkcs11Pubkeys, pkcs11Yamls, keyProvider, err := processRecipientKeys(recipients)
+		others, thresholdGroups, err := splitThresholdRecipients(recipients)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		gpgRecipients, pubKeys, x509s, pkcs11Pubkeys, pkcs11Yamls, keyProvider, err := processRecipientKeys(others, args.Pkcs11Config)
 		if err != nil {
 			return encconfig.CryptoConfig{}, err
 		}
+		pubKeys, hybridPubKeys := splitHybridPublicKeys(pubKeys)
+		if err := checkPolicyRecipients(recipients); err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		if fips.Enabled() {
+			if err := checkFIPSRecipients(gpgRecipients, pubKeys, x509s, hybridPubKeys); err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			if len(thresholdGroups) > 0 {
+				if err := fips.CheckScheme(threshold.Scheme); err != nil {
+					return encconfig.CryptoConfig{}, err
+				}
+			}
+		}
 		encryptCcs := []encconfig.CryptoConfig{}
-
-		gpgClient, err := CreateGPGClient(args)
-		gpgInstalled := err == nil
-		if len(gpgRecipients) > 0 && gpgInstalled {
-			gpgPubRingFile, err := gpgClient.ReadGPGPubRingFile()
+		if len(thresholdGroups) > 0 {
+			thresholdCc, err := threshold.EncryptWithGroups(thresholdGroups...)
 			if err != nil {
 				return encconfig.CryptoConfig{}, err
 			}
+			encryptCcs = append(encryptCcs, thresholdCc)
+		}
+
+		if len(gpgRecipients) > 0 {
+			gpgPubRingFile, err := readGPGPubRing(args)
+			if err != nil && len(args.KeyLookup) == 0 && ldapkeys.Current() == nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			if d := ldapkeys.Current(); d != nil {
+				gpgPubRingFile, err = lookupDirectoryPGPKeys(d, gpgPubRingFile, gpgRecipients)
+				if err != nil {
+					return encconfig.CryptoConfig{}, err
+				}
+			}
+			if len(args.KeyLookup) > 0 {
+				gpgPubRingFile, err = lookupPGPKeys(args, gpgPubRingFile, gpgRecipients)
+				if err != nil {
+					return encconfig.CryptoConfig{}, err
+				}
+			}
 
 			gpgCc, err := encconfig.EncryptWithGpg(gpgRecipients, gpgPubRingFile)
 			if err != nil {
@@ -341,6 +832,14 @@ func CreateCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.Cry
 
 		// Create Encryption Crypto Config
 		if len(x509s) > 0 {
+			if err := checkCertificateExpiry(args, others, time.Now()); err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			if !args.AllowUnverifiedRecipient {
+				if err := verifyRecipientCertificates(x509s, args.RecipientCA, time.Now()); err != nil {
+					return encconfig.CryptoConfig{}, err
+				}
+			}
 			pkcs7Cc, err := encconfig.EncryptWithPkcs7(x509s)
 			if err != nil {
 				return encconfig.CryptoConfig{}, err
@@ -354,9 +853,12 @@ func CreateCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.Cry
 			}
 			encryptCcs = append(encryptCcs, jweCc)
 		}
+		if len(hybridPubKeys) > 0 {
+			encryptCcs = append(encryptCcs, hybrid.EncryptWithPublicKeys(hybridPubKeys))
+		}
 		var p11conf *pkcs11.Pkcs11Config
 		if len(pkcs11Yamls) > 0 || len(pkcs11Pubkeys) > 0 {
-			p11conf, err = pkcs11config.GetUserPkcs11Config()
+			p11conf, err = LoadPkcs11Config(args.Pkcs11Config)
 			if err != nil {
 				return encconfig.CryptoConfig{}, err
 			}
@@ -375,6 +877,18 @@ func CreateCryptoConfig(args EncArgs, descs []ocispec.Descriptor) (encconfig.Cry
 			encryptCcs = append(encryptCcs, keyProviderCc)
 		}
 		ecc := encconfig.CombineCryptoConfigs(encryptCcs)
+		if len(args.EncryptionContext) > 0 {
+			c, err := enccontext.Parse(args.EncryptionContext)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			enccontext.Set(ecc.EncryptConfig.Parameters, c)
+		}
+		if len(groups) > 0 {
+			if err := keymeta.SetGroups(ecc.EncryptConfig.Parameters, groupMembers(groups)); err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+		}
 		if decryptCc != nil {
 			ecc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
 		}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseCryptoConfig(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	args, err := NewEncArgs(WithKeys(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := CreateDecryptCryptoConfig(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKeys := cc.DecryptConfig.Parameters["privkeys"]
+	if len(privKeys) != 1 || !bytes.Equal(privKeys[0], keyPEM) {
+		t.Fatal("expected the private key in the configuration")
+	}
+
+	ReleaseCryptoConfig(&cc)
+	if !bytes.Equal(privKeys[0], make([]byte, len(keyPEM))) {
+		t.Fatal("expected the private key to be zeroed")
+	}
+	if _, ok := cc.DecryptConfig.Parameters["privkeys"]; ok {
+		t.Fatal("expected the private key to be removed from the configuration")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/pgpkeys"
+)
+
+// ErrUnconfirmedKey is returned if a PGP key looked up for a recipient is
+// neither pinned with its fingerprint nor confirmed by the user
+var ErrUnconfirmedKey = errors.New("PGP key looked up for recipient was not confirmed")
+
+// lookupPGPKeys appends the keys of the recipients missing from the binary
+// pubring that are found in the lookup sources of args. A key is only used if
+// its fingerprint is among args.PGPFingerprint or args.ConfirmKey accepts it.
+func lookupPGPKeys(args EncArgs, pubring []byte, recipients [][]byte) ([]byte, error) {
+	var names []string
+	for _, r := range recipients {
+		names = append(names, string(r))
+	}
+	missing, err := pgpkeys.Missing(pubring, names)
+	if err != nil || len(missing) == 0 {
+		return pubring, err
+	}
+	resolver, err := pgpkeys.NewResolver(args.KeyLookup)
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[string]bool)
+	for _, fpr := range args.PGPFingerprint {
+		pinned[pgpkeys.NormalizeFingerprint(fpr)] = true
+	}
+
+	ctx := context.Background()
+	for _, r := range missing {
+		keys, err := resolver.Lookup(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			ok := pinned[k.Fingerprint]
+			if !ok && args.ConfirmKey != nil {
+				if ok, err = args.ConfirmKey(r, k.Fingerprint, k.UserIDs); err != nil {
+					return nil, err
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("%w: %s has fingerprint %s", ErrUnconfirmedKey, r, k.Fingerprint)
+			}
+			pubring = append(pubring, k.Data...)
+		}
+	}
+	return pubring, nil
+}
+
+// lookupDirectoryPGPKeys appends the keys of the recipients missing from the
+// binary pubring that are found in the LDAP directory. The directory is
+// trusted like the keyring, so its keys need no confirmation; recipients
+// without an entry are left to the lookup sources.
+func lookupDirectoryPGPKeys(d *ldapkeys.Directory, pubring []byte, recipients [][]byte) ([]byte, error) {
+	var names []string
+	for _, r := range recipients {
+		names = append(names, string(r))
+	}
+	missing, err := pgpkeys.Missing(pubring, names)
+	if err != nil || len(missing) == 0 {
+		return pubring, err
+	}
+	for _, r := range missing {
+		keys, err := d.PGPKeys(context.Background(), r)
+		if errors.Is(err, ldapkeys.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			pubring = append(pubring, k.Data...)
+		}
+	}
+	return pubring, nil
+}
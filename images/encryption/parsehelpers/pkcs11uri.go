@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/imgcrypt/images/encryption/keygen"
+	"github.com/gobars/ocicrypt/config/pkcs11config"
+	"github.com/gobars/ocicrypt/crypto/pkcs11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+	"gopkg.in/yaml.v3"
+)
+
+// pkcs11PathAttributes are the path attributes of RFC 7512 PKCS#11 URIs
+var pkcs11PathAttributes = map[string]bool{
+	"token": true, "manufacturer": true, "serial": true, "model": true,
+	"library-manufacturer": true, "library-description": true, "library-version": true,
+	"slot-manufacturer": true, "slot-description": true, "slot-id": true,
+	"object": true, "type": true, "id": true,
+}
+
+// isPkcs11URI returns whether the value following "pkcs11:" in a recipient or
+// key is the path of a PKCS#11 URI rather than the name of a key file
+func isPkcs11URI(value string) bool {
+	attr, _, _ := strings.Cut(value, "?")
+	attr, _, _ = strings.Cut(attr, ";")
+	name, _, ok := strings.Cut(attr, "=")
+	return ok && pkcs11PathAttributes[name]
+}
+
+// LoadPkcs11Config returns the PKCS#11 settings of the ocicrypt configuration
+// file at path, or of the one ocicrypt finds through OCICRYPT_CONFIG and its
+// default locations if path is empty
+func LoadPkcs11Config(path string) (*pkcs11.Pkcs11Config, error) {
+	if path == "" {
+		return pkcs11config.GetUserPkcs11Config()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c pkcs11config.OcicryptConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return &c.Pkcs11Config, nil
+}
+
+// pkcs11URIKeyFile returns the key file for a PKCS#11 URI given as recipient
+// or key, which must not reference an object of another type than objectType.
+// If the URI names no module, the module allowed by the ocicrypt configuration
+// at configPath is used.
+func pkcs11URIKeyFile(uri, objectType, configPath string) ([]byte, error) {
+	p11uri, err := pkcs11.ParsePkcs11Uri(uri)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p11uri.GetPathAttribute("type", false); ok && t != objectType {
+		return nil, fmt.Errorf("pkcs11 URI %s does not reference a %s key", uri, objectType)
+	}
+	if !hasPkcs11Module(p11uri) {
+		p11conf, err := LoadPkcs11Config(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if uri, err = Pkcs11URIWithModule(uri, p11conf); err != nil {
+			return nil, err
+		}
+	}
+	return keygen.Pkcs11KeyFile(uri, nil)
+}
+
+// Pkcs11URIWithModule returns the PKCS#11 URI with the module-path of the
+// module allowed by the configuration added if the URI names no module
+func Pkcs11URIWithModule(uri string, p11conf *pkcs11.Pkcs11Config) (string, error) {
+	p11uri, err := pkcs11.ParsePkcs11Uri(uri)
+	if err != nil || hasPkcs11Module(p11uri) {
+		return uri, err
+	}
+	module, err := resolvePkcs11Module(p11conf)
+	if err != nil {
+		return "", fmt.Errorf("pkcs11 URI %s: %w", uri, err)
+	}
+	if err := p11uri.AddQueryAttribute("module-path", module); err != nil {
+		return "", err
+	}
+	return p11uri.Format()
+}
+
+func hasPkcs11Module(p11uri *pkcs11uri.Pkcs11URI) bool {
+	_, hasPath := p11uri.GetQueryAttribute("module-path", false)
+	_, hasName := p11uri.GetQueryAttribute("module-name", false)
+	return hasPath || hasName
+}
+
+// withPkcs11PIN returns the pkcs11 key file with the PIN asked for by prompt
+// added to its URI, unless it already has a pin-value or pin-source attribute
+func withPkcs11PIN(keyFile []byte, prompt func(string) ([]byte, error)) ([]byte, error) {
+	kf, err := pkcs11.ParsePkcs11KeyFile(keyFile)
+	if err != nil || kf.Uri.HasPIN() || prompt == nil {
+		return keyFile, err
+	}
+	uri, err := kf.Uri.Format()
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := strings.Cut(uri, "?")
+	pin, err := prompt(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := kf.Uri.AddQueryAttribute("pin-value", string(pin)); err != nil {
+		return nil, err
+	}
+	if uri, err = kf.Uri.Format(); err != nil {
+		return nil, err
+	}
+	return keygen.Pkcs11KeyFile(uri, kf.Uri.GetEnvMap())
+}
+
+// resolvePkcs11Module returns the only module allowed by the configuration,
+// which is either a file entry of its allowed module paths or a shared
+// library in one of its allowed directories
+func resolvePkcs11Module(p11conf *pkcs11.Pkcs11Config) (string, error) {
+	var modules []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && !seen[path] {
+			seen[path] = true
+			modules = append(modules, path)
+		}
+	}
+	for _, p := range p11conf.AllowedModulePaths {
+		if !strings.HasSuffix(p, "/") {
+			add(p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".so") {
+				add(p + e.Name())
+			}
+		}
+	}
+	switch len(modules) {
+	case 0:
+		return "", errors.New("no module is allowed by the ocicrypt configuration")
+	case 1:
+		return modules[0], nil
+	default:
+		return "", fmt.Errorf("the ocicrypt configuration allows several modules (%s); select one with module-name or module-path", strings.Join(modules, ", "))
+	}
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobars/ocicrypt/crypto/pkcs11"
+)
+
+func TestIsPkcs11URI(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"token=test;object=key;type=public": true,
+		"object=key?module-name=softhsm2":   true,
+		"id=%01":                            true,
+		"/etc/keys/pkcs11.yaml":             false,
+		"key=value.yaml":                    false,
+		"pubkey.pem":                        false,
+	} {
+		if isPkcs11URI(value) != expected {
+			t.Errorf("%s: expected %v", value, expected)
+		}
+	}
+}
+
+func TestPkcs11URIRecipientsAndKeys(t *testing.T) {
+	_, _, _, _, yamls, _, err := processRecipientKeys([]string{"pkcs11:token=test;object=key;type=public?module-name=softhsm2"}, "")
+	if err != nil || len(yamls) != 1 {
+		t.Fatalf("got %d key files, %v", len(yamls), err)
+	}
+	kf, err := pkcs11.ParsePkcs11KeyFile(yamls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object, _ := kf.Uri.GetPathAttribute("object", false); object != "key" {
+		t.Fatalf("unexpected object %q", object)
+	}
+
+	_, _, _, _, yamls, _, err = processPrivateKeyFiles([]string{"pkcs11:token=test;object=key;type=private?module-name=softhsm2"}, nil, nil, "")
+	if err != nil || len(yamls) != 1 {
+		t.Fatalf("got %d key files, %v", len(yamls), err)
+	}
+
+	prompt := func(uri string) ([]byte, error) {
+		if !strings.HasPrefix(uri, "pkcs11:") || strings.Contains(uri, "?") {
+			t.Errorf("asked for PIN of %s", uri)
+		}
+		return []byte("1234"), nil
+	}
+	_, _, _, _, yamls, _, err = processPrivateKeyFiles([]string{"pkcs11:token=test;object=key;type=private?module-name=softhsm2"}, nil, prompt, "")
+	if err != nil || len(yamls) != 1 {
+		t.Fatalf("got %d key files, %v", len(yamls), err)
+	}
+	if kf, err = pkcs11.ParsePkcs11KeyFile(yamls[0]); err != nil {
+		t.Fatal(err)
+	}
+	if pin, _ := kf.Uri.GetPIN(); pin != "1234" {
+		t.Fatalf("unexpected PIN %q", pin)
+	}
+
+	if _, _, _, _, _, _, err := processRecipientKeys([]string{"pkcs11:token=test;object=key;type=private?module-name=softhsm2"}, ""); err == nil {
+		t.Fatal("expected private key URI to be rejected as recipient")
+	}
+}
+
+func TestResolvePkcs11Module(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"libsofthsm2.so", "README"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(t.TempDir(), "libother.so")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	module, err := resolvePkcs11Module(&pkcs11.Pkcs11Config{AllowedModulePaths: []string{dir + "/"}})
+	if err != nil || module != filepath.Join(dir, "libsofthsm2.so") {
+		t.Fatalf("got %s, %v", module, err)
+	}
+	if _, err := resolvePkcs11Module(&pkcs11.Pkcs11Config{AllowedModulePaths: []string{dir + "/", other}}); err == nil {
+		t.Fatal("expected several allowed modules to be ambiguous")
+	}
+	if _, err := resolvePkcs11Module(&pkcs11.Pkcs11Config{}); err == nil {
+		t.Fatal("expected error without allowed modules")
+	}
+}
+
+func TestPkcs11ConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "libsofthsm2.so")
+	if err := os.WriteFile(module, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(t.TempDir(), "ocicrypt.conf")
+	if err := os.WriteFile(config, []byte("pkcs11:\n  module-directories:\n    - "+dir+"/\n  allowed-module-paths:\n    - "+dir+"/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the configuration named by the environment is not used
+	t.Setenv("OCICRYPT_CONFIG", filepath.Join(t.TempDir(), "missing.conf"))
+
+	p11conf, err := LoadPkcs11Config(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p11conf.AllowedModulePaths) != 1 || p11conf.AllowedModulePaths[0] != dir+"/" {
+		t.Fatalf("unexpected allowed module paths %v", p11conf.AllowedModulePaths)
+	}
+	if _, err := LoadPkcs11Config(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Fatal("expected a missing configuration file to be refused")
+	}
+
+	// URIs without a module get the module allowed by the given configuration
+	_, _, _, _, yamls, _, err := processRecipientKeys([]string{"pkcs11:token=test;object=key;type=public"}, config)
+	if err != nil || len(yamls) != 1 {
+		t.Fatalf("got %d key files, %v", len(yamls), err)
+	}
+	kf, err := pkcs11.ParsePkcs11KeyFile(yamls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := kf.Uri.GetQueryAttribute("module-path", false); path != module {
+		t.Fatalf("expected the module of the configuration, got %q", path)
+	}
+}
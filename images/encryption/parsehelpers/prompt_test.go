@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPrompt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nolint:staticcheck // encrypted PEM blocks are what users pass
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a prompt a missing password is an error
+	if _, _, _, _, _, _, err := processPrivateKeyFiles([]string{keyFile}, nil, nil, ""); err == nil {
+		t.Fatal("expected an error without a password")
+	}
+
+	// a wrong password given with the key is asked for again
+	var asked []string
+	answers := [][]byte{[]byte("wrong"), []byte("secret")}
+	prompt := func(keyfile string) ([]byte, error) {
+		asked = append(asked, keyfile)
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, nil
+	}
+	_, _, privKeys, passwords, _, _, err := processPrivateKeyFiles([]string{keyFile + ":pass=wrong"}, prompt, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 2 || asked[0] != keyFile {
+		t.Fatalf("expected to be asked twice for the password of %s, got %v", keyFile, asked)
+	}
+	if len(privKeys) != 1 || string(passwords[0]) != "secret" {
+		t.Fatalf("expected the key with the password given at the prompt, got %d keys", len(privKeys))
+	}
+
+	// the user is asked a limited number of times
+	asked = nil
+	wrong := func(keyfile string) ([]byte, error) {
+		asked = append(asked, keyfile)
+		return []byte("wrong"), nil
+	}
+	if _, _, _, _, _, _, err := processPrivateKeyFiles([]string{keyFile}, wrong, nil, ""); err == nil {
+		t.Fatal("expected an error after wrong passwords")
+	}
+	if len(asked) != maxPasswordPrompts {
+		t.Fatalf("expected to be asked %d times, got %d", maxPasswordPrompts, len(asked))
+	}
+
+	// an aborted prompt is returned as it is
+	aborted := errors.New("aborted")
+	abort := func(string) ([]byte, error) { return nil, aborted }
+	if _, _, _, _, _, _, err := processPrivateKeyFiles([]string{keyFile}, abort, nil, ""); !errors.Is(err, aborted) {
+		t.Fatalf("expected the error of the prompt, got %v", err)
+	}
+}
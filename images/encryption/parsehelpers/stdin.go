@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"os"
+	"sync"
+)
+
+// Stdin is the file name of keys and jwe recipients that stands for the
+// standard input, so that keys can be piped from a secret store
+const Stdin = "-"
+
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+
+	// stdin is where Stdin is read from
+	stdin io.Reader = os.Stdin
+)
+
+// readStdin reads the standard input once; all keys and recipients given as
+// Stdin share what was read
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinData, stdinErr = io.ReadAll(stdin)
+	})
+	return stdinData, stdinErr
+}
+
+// readKeyFile returns the content of the key file, or the keys read from the
+// standard input if the file is Stdin
+func readKeyFile(path string) ([][]byte, error) {
+	if path != Stdin {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+	data, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	return splitPEM(data), nil
+}
+
+// splitPEM splits data into its PEM blocks, which frame the keys when several
+// are passed in one stream; data without PEM blocks, such as a DER encoded key
+// or a GPG key ring, is returned as one key
+func splitPEM(data []byte) [][]byte {
+	var keys [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		keys = append(keys, pem.EncodeToMemory(block))
+	}
+	if len(keys) == 0 && len(bytes.TrimSpace(data)) > 0 {
+		// a copy, since the keys are zeroed once they are protected
+		keys = append(keys, append([]byte(nil), data...))
+	}
+	return keys
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"sync"
+	"testing"
+)
+
+func TestStdinKeysAndRecipients(t *testing.T) {
+	var data []byte
+	for i := 0; i < 2; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	stdinOnce, stdin = sync.Once{}, bytes.NewReader(data)
+	defer func() { stdinOnce = sync.Once{} }()
+
+	_, pubKeys, _, _, _, _, err := processRecipientKeys([]string{"jwe:-"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubKeys) != 2 {
+		t.Errorf("expected 2 public keys, got %d", len(pubKeys))
+	}
+	// the standard input is read once and shared with the private keys
+	_, _, privKeys, passwords, _, _, err := processPrivateKeyFiles([]string{"-"}, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(privKeys) != 2 || len(passwords) != 2 {
+		t.Errorf("expected 2 private keys, got %d", len(privKeys))
+	}
+
+	stdinOnce, stdin = sync.Once{}, bytes.NewReader(nil)
+	if _, _, _, _, _, _, err := processPrivateKeyFiles([]string{"-"}, nil, nil, ""); err == nil {
+		t.Error("expected an error for empty standard input")
+	}
+}
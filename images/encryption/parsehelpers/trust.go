@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrUnverifiedRecipient is returned if a pkcs7 recipient certificate cannot be
+// verified against the configured trust roots
+var ErrUnverifiedRecipient = errors.New("pkcs7 recipient certificate could not be verified")
+
+// parseCertificates parses the PEM-encoded certificates or the single DER-encoded certificate in data
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// loadCertPool creates a pool from the certificates in the given files
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse CA file %s: %w", file, err)
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+	return pool, nil
+}
+
+// verifyRecipientCertificates checks that each of the pkcs7 recipient certificates is
+// currently valid and chains to one of the CA certificates in caFiles. Further
+// certificates following the first one in a recipient file are used as intermediates.
+func verifyRecipientCertificates(x509s [][]byte, caFiles []string, now time.Time) error {
+	if len(x509s) == 0 {
+		return nil
+	}
+	if len(caFiles) == 0 {
+		return fmt.Errorf("%w: no trust roots are configured for pkcs7 recipients", ErrUnverifiedRecipient)
+	}
+	roots, err := loadCertPool(caFiles)
+	if err != nil {
+		return err
+	}
+	for _, data := range x509s {
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnverifiedRecipient, err)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrUnverifiedRecipient, certs[0].Subject, err)
+		}
+	}
+	return nil
+}
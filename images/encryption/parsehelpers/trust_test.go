@@ -0,0 +1,134 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestVerifyRecipientCertificates(t *testing.T) {
+	ca, caKey, caPEM := createCert(t, "ca", true, nil, nil)
+	_, _, leafPEM := createCert(t, "leaf", false, ca, caKey)
+	_, _, selfSignedPEM := createCert(t, "self-signed", false, nil, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	caFiles := []string{caFile}
+	now := time.Now()
+
+	if err := verifyRecipientCertificates([][]byte{leafPEM}, caFiles, now); err != nil {
+		t.Fatalf("expected certificate issued by the CA to be verified: %v", err)
+	}
+	if err := verifyRecipientCertificates([][]byte{leafPEM}, caFiles, now.Add(2*time.Hour)); !errors.Is(err, ErrUnverifiedRecipient) {
+		t.Fatalf("expected expired certificate to be rejected: %v", err)
+	}
+	if err := verifyRecipientCertificates([][]byte{selfSignedPEM}, caFiles, now); !errors.Is(err, ErrUnverifiedRecipient) {
+		t.Fatalf("expected self-signed certificate to be rejected: %v", err)
+	}
+	if err := verifyRecipientCertificates([][]byte{leafPEM}, nil, now); !errors.Is(err, ErrUnverifiedRecipient) {
+		t.Fatalf("expected certificate to be rejected without trust roots: %v", err)
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	ca, caKey, caPEM := createCert(t, "ca", true, nil, nil)
+	_, _, leafPEM := createCert(t, "leaf", false, ca, caKey)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	leafFile := filepath.Join(dir, "leaf.pem")
+	for path, data := range map[string][]byte{caFile: caPEM, leafFile: leafPEM} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reported []RecipientCertificate
+	report := WithCertificateReport(func(rc RecipientCertificate) { reported = append(reported, rc) })
+	args, err := NewEncArgs(WithRecipients("pkcs7:"+leafFile), WithRecipientCAs(caFile), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCryptoConfig(args, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0].Subject != "CN=leaf" || !reported[0].Expiring {
+		t.Fatalf("expected the certificate expiring within an hour to be reported as expiring: %+v", reported)
+	}
+
+	reported = nil
+	args, err = NewEncArgs(WithRecipients("pkcs7:"+leafFile), WithRecipientCAs(caFile), report, WithCertExpiryWarning(time.Minute, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCryptoConfig(args, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0].Expiring {
+		t.Fatalf("expected the certificate not to expire within a minute: %+v", reported)
+	}
+
+	args, err = NewEncArgs(WithRecipients("pkcs7:"+leafFile), WithRecipientCAs(caFile), WithCertExpiryWarning(2*time.Hour, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCryptoConfig(args, nil); !errors.Is(err, ErrCertificateExpiring) {
+		t.Fatalf("expected the expiring certificate to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/hybrid"
+	"github.com/containerd/imgcrypt/images/encryption/keyinfo"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/containerd/imgcrypt/images/encryption/kmip"
+	"github.com/containerd/imgcrypt/images/encryption/ldapkeys"
+	"github.com/containerd/imgcrypt/images/encryption/pgpkeys"
+	"github.com/containerd/imgcrypt/images/encryption/threshold"
+	"github.com/containerd/imgcrypt/images/encryption/timelock"
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+	"github.com/gobars/ocicrypt/crypto/pkcs11"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+// RecipientCheckTimeout bounds the time spent reaching the network backend of
+// a recipient, such as a keyprovider or KMIP server, if the context has no
+// deadline
+const RecipientCheckTimeout = 5 * time.Second
+
+// ExpiryWarning is how long before the expiry of a recipient key or
+// certificate a warning is reported
+const ExpiryWarning = 30 * 24 * time.Hour
+
+// RecipientReport describes a recipient and why layer keys cannot, or may
+// soon not, be wrapped for it
+type RecipientReport struct {
+	Recipient string `json:"recipient" yaml:"recipient"`
+	// Scheme is the wrap scheme used for the recipient
+	Scheme string `json:"scheme" yaml:"scheme"`
+	// Key describes the public key or certificate of the recipient, if any
+	Key      *keyinfo.KeyInfo `json:"key,omitempty" yaml:"key,omitempty"`
+	Errors   []string         `json:"errors,omitempty" yaml:"errors,omitempty"`
+	Warnings []string         `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+// Valid returns whether layer keys can be wrapped for the recipient
+func (rr *RecipientReport) Valid() bool {
+	return len(rr.Errors) == 0
+}
+
+func (rr *RecipientReport) errorf(format string, args ...interface{}) {
+	rr.Errors = append(rr.Errors, fmt.Sprintf(format, args...))
+}
+
+func (rr *RecipientReport) warnf(format string, args ...interface{}) {
+	rr.Warnings = append(rr.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Report describes the recipients checked by ValidateRecipients
+type Report struct {
+	Recipients []RecipientReport `json:"recipients" yaml:"recipients"`
+}
+
+// Valid returns whether layer keys can be wrapped for all recipients
+func (r *Report) Valid() bool {
+	for i := range r.Recipients {
+		if !r.Recipients[i].Valid() {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateRecipients parses and loads the recipients, given in the format of
+// --recipient, and checks that layer keys can be wrapped for them without
+// encrypting anything, for example in admission webhooks and CI; see
+// CheckRecipients
+func ValidateRecipients(recipients []string) (Report, error) {
+	return CheckRecipients(context.Background(), recipients)
+}
+
+// CheckRecipients parses and loads the recipients and checks them with the
+// settings of the options: that their keys are allowed by the algorithm
+// policy and FIPS mode, that certificates and PGP keys are neither expired
+// nor revoked and that certificates chain to the recipient CAs, that PGP keys
+// are in the keyring or can be looked up, and that keyproviders and KMIP
+// servers can be reached. The report describes every recipient, with groups
+// replaced by their members; an error is
+// returned if the options are invalid or any recipient is not usable.
+func CheckRecipients(ctx context.Context, recipients []string, opts ...Option) (Report, error) {
+	args, err := NewEncArgs(append([]Option{WithRecipients(recipients...)}, opts...)...)
+	if err != nil {
+		return Report{}, err
+	}
+	// the members of groups are checked
+	recipients, _, err = args.RecipientGroups.Expand(recipients)
+	if err != nil {
+		return Report{}, err
+	}
+	var (
+		report  Report
+		invalid int
+		now     = time.Now()
+	)
+	for _, recipient := range recipients {
+		rr := checkRecipient(ctx, args, recipient, now)
+		if !rr.Valid() {
+			invalid++
+		}
+		report.Recipients = append(report.Recipients, rr)
+	}
+	if invalid > 0 {
+		return report, fmt.Errorf("%d of %d recipients are not usable", invalid, len(recipients))
+	}
+	return report, nil
+}
+
+// checkRecipient loads a recipient the way CreateCryptoConfig does and checks
+// its key and backend
+func checkRecipient(ctx context.Context, args EncArgs, recipient string, now time.Time) RecipientReport {
+	rr := RecipientReport{Recipient: recipient, Scheme: recipientScheme(recipient)}
+	if err := algpolicy.Current().CheckScheme(rr.Scheme); err != nil {
+		rr.errorf("%v", err)
+	}
+	if rr.Scheme == threshold.Scheme {
+		checkThresholdRecipient(&rr, recipient)
+		return rr
+	}
+	gpgRecipients, pubKeys, x509s, pkcs11Pubkeys, pkcs11Yamls, keyProviders, err := processRecipientKeys([]string{recipient}, args.Pkcs11Config)
+	if err != nil {
+		rr.errorf("%v", err)
+		return rr
+	}
+	if fips.Enabled() {
+		jwePubKeys, hybridPubKeys := splitHybridPublicKeys(pubKeys)
+		if err := checkFIPSRecipients(gpgRecipients, jwePubKeys, x509s, hybridPubKeys); err != nil {
+			rr.errorf("%v", err)
+		}
+	}
+	_, value, _ := strings.Cut(recipient, ":")
+	switch {
+	case len(gpgRecipients) > 0:
+		checkPGPRecipient(ctx, args, &rr, value, now)
+	case len(pubKeys) > 0:
+		checkPublicKey(&rr, value, pubKeys[0])
+	case len(pkcs11Pubkeys) > 0:
+		checkPublicKey(&rr, value, pkcs11Pubkeys[0])
+	case len(x509s) > 0:
+		checkCertificate(args, &rr, value, x509s[0], now)
+	case len(pkcs11Yamls) > 0:
+		checkPkcs11KeyFile(&rr, pkcs11Yamls[0])
+	case strings.HasPrefix(recipient, "kmip:"):
+		checkKMIPServer(ctx, &rr, value)
+	case strings.HasPrefix(recipient, "timelock:"):
+		checkTimelockRecipient(&rr, value, now)
+	case len(keyProviders) > 0:
+		checkKeyProvider(ctx, &rr, value)
+	}
+	return rr
+}
+
+// checkThresholdRecipient checks the group and the keys of its recipients
+func checkThresholdRecipient(rr *RecipientReport, recipient string) {
+	if fips.Enabled() {
+		if err := fips.CheckScheme(threshold.Scheme); err != nil {
+			rr.errorf("%v", err)
+		}
+	}
+	g, files, err := parseThresholdRecipient(recipient)
+	if err != nil {
+		rr.errorf("%v", err)
+		return
+	}
+	if err := g.Validate(); err != nil {
+		rr.errorf("%v", err)
+	}
+	for i, data := range g.PublicKeys {
+		var kr RecipientReport
+		checkPublicKey(&kr, files[i], data)
+		for _, e := range kr.Errors {
+			rr.errorf("%s: %s", files[i], e)
+		}
+	}
+}
+
+// checkPublicKey checks that the algorithm policy allows the key
+func checkPublicKey(rr *RecipientReport, path string, data []byte) {
+	if hybrid.IsPublicKey(data) {
+		rr.Key = &keyinfo.KeyInfo{Kind: keyinfo.KindPublicKey, Algorithm: hybrid.Scheme}
+		return
+	}
+	ki := keyinfo.Inspect(path, data, nil)
+	rr.Key = &ki
+	for _, p := range ki.Problems {
+		rr.errorf("%s", p)
+	}
+	pub, err := encutils.ParsePublicKey(data, "")
+	if err != nil {
+		rr.errorf("%v", err)
+		return
+	}
+	if err := algpolicy.Current().CheckPublicKey(pub); err != nil {
+		rr.errorf("%v", err)
+	}
+}
+
+// checkCertificate checks the validity of the certificate, its key and,
+// unless unverified recipients are allowed, its chain to the recipient CAs
+func checkCertificate(args EncArgs, rr *RecipientReport, path string, data []byte, now time.Time) {
+	ki := keyinfo.Inspect(path, data, nil)
+	rr.Key = &ki
+	for _, p := range ki.Problems {
+		rr.errorf("%s", p)
+	}
+	if ki.Expired(now) {
+		rr.errorf("the certificate is not valid now; it is valid from %s until %s", ki.NotBefore.Format(time.RFC3339), ki.NotAfter.Format(time.RFC3339))
+	} else if ki.NotAfter != nil && ki.NotAfter.Before(now.Add(args.certExpiryWarning())) {
+		if args.StrictCertExpiry {
+			rr.errorf("%v: it expires on %s", ErrCertificateExpiring, ki.NotAfter.Format(time.RFC3339))
+		} else {
+			rr.warnf("the certificate expires on %s", ki.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if certs, err := parseCertificates(data); err == nil {
+		if err := algpolicy.Current().CheckPublicKey(certs[0].PublicKey); err != nil {
+			rr.errorf("%v", err)
+		}
+	}
+	if !args.AllowUnverifiedRecipient {
+		if err := verifyRecipientCertificates([][]byte{data}, args.RecipientCA, now); err != nil {
+			rr.errorf("%v", err)
+		}
+	}
+}
+
+// checkPkcs11KeyFile checks that the module of the pkcs11 key file exists
+func checkPkcs11KeyFile(rr *RecipientReport, data []byte) {
+	ki := keyinfo.Inspect(rr.Recipient, data, nil)
+	rr.Key = &ki
+	kf, err := pkcs11.ParsePkcs11KeyFile(data)
+	if err != nil {
+		rr.errorf("%v", err)
+		return
+	}
+	if _, err := kf.Uri.GetModule(); err != nil {
+		rr.errorf("pkcs11 module: %v", err)
+	}
+}
+
+// checkPGPRecipient checks that the recipient has keys in the keyring, the
+// LDAP directory or the lookup sources and that none of them is expired or revoked
+func checkPGPRecipient(ctx context.Context, args EncArgs, rr *RecipientReport, recipient string, now time.Time) {
+	var el openpgp.EntityList
+	pubring, err := readGPGPubRing(args)
+	if err == nil && len(pubring) > 0 {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(pubring))
+	}
+	d := ldapkeys.Current()
+	if err != nil && len(args.KeyLookup) == 0 && d == nil {
+		rr.errorf("%v", err)
+		return
+	}
+	var matching openpgp.EntityList
+	for _, e := range el {
+		if pgpkeys.Matches(e, recipient) {
+			matching = append(matching, e)
+		}
+	}
+	if len(matching) == 0 && d != nil {
+		matching, err = lookupDirectoryPGPRecipient(ctx, d, recipient)
+		if err != nil && !errors.Is(err, ldapkeys.ErrNotFound) {
+			rr.errorf("%v", err)
+			return
+		}
+	}
+	if len(matching) == 0 && len(args.KeyLookup) > 0 {
+		matching, err = lookupPGPRecipient(ctx, args, recipient)
+		if err != nil {
+			rr.errorf("%v", err)
+			return
+		}
+	}
+	if len(matching) == 0 {
+		rr.errorf("no PGP key found for %s", recipient)
+		return
+	}
+	for _, e := range matching {
+		ki := describePGPKey(e)
+		rr.Key = &ki
+		checkPGPKey(rr, e, now)
+	}
+}
+
+// lookupPGPRecipient looks up the keys of the recipient in the lookup sources
+func lookupPGPRecipient(ctx context.Context, args EncArgs, recipient string) (openpgp.EntityList, error) {
+	resolver, err := pgpkeys.NewResolver(args.KeyLookup)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withCheckTimeout(ctx)
+	defer cancel()
+	keys, err := resolver.Lookup(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	var el openpgp.EntityList
+	for _, k := range keys {
+		kel, err := openpgp.ReadKeyRing(bytes.NewReader(k.Data))
+		if err != nil {
+			return nil, err
+		}
+		el = append(el, kel...)
+	}
+	return el, nil
+}
+
+// lookupDirectoryPGPRecipient looks up the keys of the recipient in the LDAP
+// directory
+func lookupDirectoryPGPRecipient(ctx context.Context, d *ldapkeys.Directory, recipient string) (openpgp.EntityList, error) {
+	ctx, cancel := withCheckTimeout(ctx)
+	defer cancel()
+	keys, err := d.PGPKeys(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	var el openpgp.EntityList
+	for _, k := range keys {
+		kel, err := openpgp.ReadKeyRing(bytes.NewReader(k.Data))
+		if err != nil {
+			return nil, err
+		}
+		el = append(el, kel...)
+	}
+	return el, nil
+}
+
+// describePGPKey describes the primary key of a PGP entity
+func describePGPKey(e *openpgp.Entity) keyinfo.KeyInfo {
+	ki := keyinfo.KeyInfo{
+		Kind:        keyinfo.KindGPGPublicKeyRing,
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint),
+		KeyIDs:      []string{e.PrimaryKey.KeyIdString()},
+	}
+	for _, sk := range e.Subkeys {
+		ki.KeyIDs = append(ki.KeyIDs, sk.PublicKey.KeyIdString())
+	}
+	for name, id := range e.Identities {
+		ki.Identities = append(ki.Identities, name)
+		if lifetime := id.SelfSignature.KeyLifetimeSecs; lifetime != nil && *lifetime > 0 {
+			notAfter := e.PrimaryKey.CreationTime.Add(time.Duration(*lifetime) * time.Second)
+			ki.NotAfter = &notAfter
+		}
+	}
+	return ki
+}
+
+// checkPGPKey checks that the PGP key is neither revoked nor expired and that
+// the algorithm policy allows it
+func checkPGPKey(rr *RecipientReport, e *openpgp.Entity, now time.Time) {
+	fpr := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+	if len(e.Revocations) > 0 {
+		rr.errorf("PGP key %s is revoked", fpr)
+	}
+	expired, expiring := false, false
+	for _, id := range e.Identities {
+		expired = expired || id.SelfSignature.KeyExpired(now)
+		expiring = expiring || id.SelfSignature.KeyExpired(now.Add(ExpiryWarning))
+	}
+	if expired {
+		rr.errorf("PGP key %s is expired", fpr)
+	} else if expiring {
+		rr.warnf("PGP key %s expires within %d days", fpr, int(ExpiryWarning.Hours()/24))
+	}
+	if pub, ok := e.PrimaryKey.PublicKey.(*rsa.PublicKey); ok {
+		if err := algpolicy.Current().CheckRSABits(pub.N.BitLen()); err != nil {
+			rr.errorf("PGP key %s: %v", fpr, err)
+		}
+	}
+}
+
+// checkKeyProvider checks that the keyprovider is registered in-process, or
+// configured or discovered and can be called
+func checkKeyProvider(ctx context.Context, rr *RecipientReport, value string) {
+	name, _, _ := strings.Cut(value, ":")
+	p, ok := keyprovider.Install()[name]
+	if !ok {
+		if ocicrypt.GetKeyWrapper("provider."+name) == nil {
+			rr.errorf("keyprovider %s is neither configured nor discovered", name)
+		}
+		return
+	}
+	ctx, cancel := withCheckTimeout(ctx)
+	defer cancel()
+	if err := p.Ping(ctx); err != nil {
+		rr.errorf("keyprovider %s cannot be called: %v", name, err)
+	}
+}
+
+// checkKMIPServer checks that a connection to the KMIP server can be made
+func checkKMIPServer(ctx context.Context, rr *RecipientReport, value string) {
+	endpoint, _, err := kmip.ParseRecipient(value)
+	if err != nil {
+		rr.errorf("%v", err)
+		return
+	}
+	ctx, cancel := withCheckTimeout(ctx)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		rr.errorf("KMIP server %s cannot be reached: %v", endpoint, err)
+		return
+	}
+	conn.Close()
+}
+
+// checkTimelockRecipient checks the unlock time and the service URL of a
+// time-lock recipient
+func checkTimelockRecipient(rr *RecipientReport, value string, now time.Time) {
+	at, _, err := timelock.ParseRecipient(value)
+	if err != nil {
+		rr.errorf("%v", err)
+		return
+	}
+	if !at.After(now) {
+		rr.warnf("the unlock time %s has passed, so the image is not time-locked", at.Format(time.RFC3339))
+	}
+}
+
+// withCheckTimeout bounds ctx by RecipientCheckTimeout unless it has a deadline
+func withCheckTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, RecipientCheckTimeout)
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package parsehelpers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRSAPublicKey(t *testing.T, path string, bits int) string {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckRecipients(t *testing.T) {
+	dir := t.TempDir()
+	pub := writeRSAPublicKey(t, filepath.Join(dir, "pub.pem"), 2048)
+	weak := writeRSAPublicKey(t, filepath.Join(dir, "weak.pem"), 1024)
+
+	ca, caKey, caPEM := createCert(t, "ca", true, nil, nil)
+	_, _, leafPEM := createCert(t, "leaf", false, ca, caKey)
+	caFile := filepath.Join(dir, "ca.pem")
+	leafFile := filepath.Join(dir, "leaf.pem")
+	for path, data := range map[string][]byte{caFile: caPEM, leafFile: leafPEM} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := CheckRecipients(context.Background(), []string{"jwe:" + pub, "pkcs7:" + leafFile}, WithRecipientCAs(caFile))
+	if err != nil {
+		t.Fatalf("expected recipients to be valid: %v %+v", err, report)
+	}
+	if len(report.Recipients) != 2 || report.Recipients[0].Key == nil || report.Recipients[0].Key.Algorithm != "RSA-2048" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if rr := report.Recipients[1]; rr.Scheme != "pkcs7" || len(rr.Warnings) != 1 {
+		t.Errorf("expected a warning for the certificate expiring soon: %+v", rr)
+	}
+
+	report, err = ValidateRecipients([]string{"jwe:" + pub, "jwe:" + weak, "pkcs7:" + leafFile, "provider:no-such-provider"})
+	if err == nil {
+		t.Fatal("expected invalid recipients to be reported")
+	}
+	for i, valid := range []bool{true, false, false, false} {
+		if rr := report.Recipients[i]; rr.Valid() != valid {
+			t.Errorf("%s: expected valid %v: %v", rr.Recipient, valid, rr.Errors)
+		}
+	}
+	if report.Valid() {
+		t.Error("expected the report to be invalid")
+	}
+
+	if _, err := ValidateRecipients([]string{"pubkey.pem"}); err == nil {
+		t.Error("expected malformed recipient to be rejected")
+	}
+
+	groups := WithRecipientGroups(map[string][]string{"team": {"jwe:" + pub, "pkcs7:" + leafFile}})
+	report, err = CheckRecipients(context.Background(), []string{"group:team", "jwe:" + pub}, groups, WithRecipientCAs(caFile))
+	if err != nil {
+		t.Fatalf("expected group members to be valid: %v %+v", err, report)
+	}
+	if len(report.Recipients) != 2 || report.Recipients[1].Scheme != "pkcs7" {
+		t.Errorf("expected the group to be replaced by its members: %+v", report)
+	}
+	if _, err := CheckRecipients(context.Background(), []string{"group:nobody"}, groups); err == nil {
+		t.Error("expected undefined group to be rejected")
+	}
+
+	report, _ = CheckRecipients(context.Background(), []string{"x509:user@example.com"})
+	if rr := report.Recipients[0]; rr.Scheme != "pkcs7" || rr.Valid() || !strings.Contains(rr.Errors[0], "LDAP directory") {
+		t.Errorf("expected x509 recipient without a directory to be reported: %+v", rr)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/matched"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+	"github.com/gobars/ocicrypt/keywrap"
+	"github.com/gobars/ocicrypt/keywrap/pgp"
+)
+
+// passwordsParameter is the DecryptConfig parameter holding the passwords of
+// the PGP private keys, by their index
+const passwordsParameter = "gpg-privatekeys-passwords"
+
+// keyring is a parsed secret keyring; its private keys are decrypted with the
+// password it was cached with when first used
+type keyring struct {
+	// mu serializes the use of the keys since decrypting them modifies them
+	mu sync.Mutex
+	el openpgp.EntityList
+}
+
+// unwrap returns the layer key in the PGP packet and the ID of the key that
+// decrypted it if one of the keys of the keyring can decrypt it
+func (kr *keyring) unwrap(pgpPacket, password []byte, hasPassword bool) ([]byte, uint64, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	var prompt openpgp.PromptFunction
+	if hasPassword {
+		responded := false
+		prompt = func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+			if responded {
+				return nil, errors.New("don't seem to have the right password")
+			}
+			responded = true
+			for _, key := range keys {
+				if key.PrivateKey != nil {
+					_ = key.PrivateKey.Decrypt(password)
+				}
+			}
+			return password, nil
+		}
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(pgpPacket), kr.el, prompt, pgp.GPGDefaultEncryptConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	optsData, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	return optsData, md.DecryptedWith.PublicKey.KeyId, nil
+}
+
+// keyWrapper unwraps PGP wrapped keys with the cached keyrings
+type keyWrapper struct {
+	keywrap.KeyWrapper
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, pgpPacket []byte) ([]byte, error) {
+	privKeys := kw.GetPrivateKeys(dc.Parameters)
+	if len(privKeys) == 0 {
+		return kw.KeyWrapper.UnwrapKey(dc, pgpPacket)
+	}
+	passwords := dc.Parameters[passwordsParameter]
+	for idx, privKey := range privKeys {
+		var password []byte
+		if idx < len(passwords) {
+			password = passwords[idx]
+		}
+		// keys decrypted with one password must not be handed to those
+		// that have another one
+		kr, err := keyrings.get(hash(privKey, password), func() (interface{}, error) {
+			el, err := openpgp.ReadKeyRing(bytes.NewReader(privKey))
+			if err != nil {
+				return nil, err
+			}
+			return &keyring{el: el}, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private keys: %w", err)
+		}
+		if optsData, keyID, err := kr.(*keyring).unwrap(pgpPacket, password, idx < len(passwords)); err == nil {
+			// the key ID in the form of the recipients of the scheme
+			matched.Report(tracing.Context(dc), "0x"+strconv.FormatUint(keyID, 16))
+			return optsData, nil
+		}
+	}
+	return nil, errors.New("PGP: No suitable key found to unwrap key")
+}
+
+var installOnce sync.Once
+
+// Install registers the unwrapper using the cached keyrings for PGP wrapped
+// keys with ocicrypt; it must be installed before the key wrappers that
+// decorate it
+func Install() {
+	installOnce.Do(func() {
+		ocicrypt.RegisterKeyWrapper("pgp", &keyWrapper{ocicrypt.GetKeyWrapper("pgp")})
+	})
+}
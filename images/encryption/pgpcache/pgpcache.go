@@ -0,0 +1,193 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package pgpcache keeps the PGP keyrings parsed for unwrapping layer keys and
+// looking up secret keys, and the GPG clients, for the lifetime of the
+// process, instead of parsing the secret keyrings for every layer as ocicrypt
+// does. Decrypting large images with big keyrings otherwise spends most of its
+// time parsing them. Everything in this package is safe for concurrent use.
+package pgpcache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/gpgclient"
+	"github.com/gobars/ocicrypt"
+)
+
+const (
+	// DefaultMaxKeyrings is the number of parsed keyrings kept at most
+	DefaultMaxKeyrings = 16
+	// MaxKeyringsEnv overrides DefaultMaxKeyrings
+	MaxKeyringsEnv = "IMGCRYPT_PGP_MAX_CACHED_KEYRINGS"
+)
+
+func maxKeyrings() int {
+	n, err := strconv.Atoi(os.Getenv(MaxKeyringsEnv))
+	if err != nil || n < 1 {
+		return DefaultMaxKeyrings
+	}
+	return n
+}
+
+type cacheKey [sha256.Size]byte
+
+// entry is a parsed keyring; it is parsed once by the first of its users
+type entry struct {
+	once  sync.Once
+	value interface{}
+	err   error
+}
+
+// cache holds parsed keyrings by the hash of their data, evicting the least
+// recently used ones
+type cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*entry
+	order   []cacheKey
+	parses  int
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[cacheKey]*entry)}
+}
+
+// get returns the value parse returns for the keyring data, calling it only
+// if the keyring is not cached yet; failures are not cached
+func (c *cache) get(k cacheKey, parse func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	if !ok {
+		e = &entry{}
+		c.entries[k] = e
+	}
+	c.touch(k)
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		e.value, e.err = parse()
+		c.mu.Lock()
+		c.parses++
+		c.mu.Unlock()
+	})
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[k] == e {
+			c.remove(k)
+		}
+		c.mu.Unlock()
+		return nil, e.err
+	}
+	return e.value, nil
+}
+
+// touch makes k the most recently used key and evicts the least recently used
+// ones beyond the limit
+func (c *cache) touch(k cacheKey) {
+	for i, o := range c.order {
+		if o == k {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, k)
+	for len(c.order) > maxKeyrings() {
+		c.remove(c.order[0])
+	}
+}
+
+func (c *cache) remove(k cacheKey) {
+	delete(c.entries, k)
+	for i, o := range c.order {
+		if o == k {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *cache) purge() {
+	c.mu.Lock()
+	c.entries = make(map[cacheKey]*entry)
+	c.order = nil
+	c.mu.Unlock()
+}
+
+// hash returns the cache key of the given keyring data and password
+func hash(parts ...[]byte) cacheKey {
+	h := sha256.New()
+	for _, p := range parts {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(p)))
+		h.Write(n[:])
+		h.Write(p)
+	}
+	var k cacheKey
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+var (
+	// keyrings holds the keyrings parsed for unwrapping layer keys
+	keyrings = newCache()
+	// vaultKeyrings holds the keyrings parsed for looking up secret keys
+	vaultKeyrings = newCache()
+)
+
+// Purge drops all parsed keyrings, including the private keys decrypted with
+// their passwords
+func Purge() {
+	keyrings.purge()
+	vaultKeyrings.purge()
+}
+
+type clientKey struct {
+	version, homedir string
+}
+
+type clientEntry struct {
+	client ocicrypt.GPGClient
+	err    error
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[clientKey]clientEntry)
+)
+
+// NewGPGClient returns the GPG client for the given version and home
+// directory, creating it the first time only; creating a client runs gpg to
+// detect its version and checks the home directory, which is also done only
+// once
+func NewGPGClient(gpgVersion, gpgHomedir string) (ocicrypt.GPGClient, error) {
+	k := clientKey{gpgVersion, gpgHomedir}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, ok := clients[k]; ok {
+		return c.client, c.err
+	}
+	var client ocicrypt.GPGClient
+	c, err := gpgclient.New(gpgVersion, gpgHomedir)
+	if err == nil {
+		client = c
+	}
+	clients[k] = clientEntry{client, err}
+	return client, err
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpcache
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+	"github.com/gobars/ocicrypt/keywrap/pgp"
+)
+
+// testKeyring returns a new entity with its public and secret keyrings
+func testKeyring(t *testing.T, email string) (*openpgp.Entity, []byte, []byte) {
+	e, err := openpgp.NewEntity("Test", "", email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub, sec bytes.Buffer
+	if err := e.Serialize(&pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(&sec, nil); err != nil {
+		t.Fatal(err)
+	}
+	return e, pub.Bytes(), sec.Bytes()
+}
+
+func TestUnwrapKey(t *testing.T) {
+	keyrings = newCache()
+	defer Purge()
+
+	_, pub, sec := testKeyring(t, "test@example.com")
+	_, _, other := testKeyring(t, "other@example.com")
+	optsData := []byte(`{"symkey":"secret"}`)
+	wrapped, err := pgp.NewKeyWrapper().WrapKeys(&encconfig.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gpg-pubkeyringfile": {pub},
+			"gpg-recipients":     {[]byte("test@example.com")},
+		},
+	}, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kw := &keyWrapper{pgp.NewKeyWrapper()}
+	dc := &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"gpg-privatekeys": {other, sec},
+	}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := kw.UnwrapKey(dc, wrapped)
+			if err == nil && !bytes.Equal(got, optsData) {
+				t.Errorf("unexpected layer key %q", got)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keyrings.parses != 2 {
+		t.Fatalf("expected the 2 keyrings to be parsed once, parsed %d times", keyrings.parses)
+	}
+
+	dc = &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"gpg-privatekeys": {other},
+	}}
+	if _, err := kw.UnwrapKey(dc, wrapped); err == nil {
+		t.Fatal("expected unwrapping with another key to fail")
+	}
+	if keyrings.parses != 2 {
+		t.Fatalf("expected the cached keyring to be used, parsed %d times", keyrings.parses)
+	}
+}
+
+func TestVault(t *testing.T) {
+	vaultKeyrings = newCache()
+	defer Purge()
+
+	e, _, sec := testKeyring(t, "test@example.com")
+	keyid := e.Subkeys[0].PublicKey.KeyId
+	for i := 0; i < 2; i++ {
+		v := NewVault()
+		if err := v.AddSecretKeyRingData(sec); err != nil {
+			t.Fatal(err)
+		}
+		keys, data := v.GetGPGPrivateKey(keyid)
+		if len(keys) == 0 || !bytes.Equal(data, sec) {
+			t.Fatalf("key 0x%x not found", keyid)
+		}
+		if keys, _ := v.GetGPGPrivateKey(keyid + 1); len(keys) != 0 {
+			t.Fatal("found a key that is not in the keyring")
+		}
+	}
+	if vaultKeyrings.parses != 1 {
+		t.Fatalf("expected the keyring to be parsed once, parsed %d times", vaultKeyrings.parses)
+	}
+	if err := NewVault().AddSecretKeyRingData([]byte("invalid")); err == nil {
+		t.Fatal("expected an invalid keyring to be rejected")
+	}
+	if len(vaultKeyrings.entries) != 1 {
+		t.Fatalf("expected the invalid keyring not to be cached")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	t.Setenv(MaxKeyringsEnv, "2")
+	c := newCache()
+	parse := func() (interface{}, error) { return nil, nil }
+	for _, k := range []byte{1, 2, 1, 3} {
+		if _, err := c.get(hash([]byte{k}), parse); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("expected 2 cached keyrings, got %d", len(c.entries))
+	}
+	if _, ok := c.entries[hash([]byte{2})]; ok {
+		t.Fatal("expected the least recently used keyring to be evicted")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpcache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gobars/ocicrypt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Vault is a GPGVault whose keyrings are parsed once per process and that may
+// be shared by the decryptions of several layers and images
+type Vault struct {
+	mu          sync.RWMutex
+	entityLists []openpgp.EntityList
+	keyDataList [][]byte
+}
+
+var _ ocicrypt.GPGVault = &Vault{}
+
+// NewVault returns an empty Vault
+func NewVault() *Vault {
+	return &Vault{}
+}
+
+// AddSecretKeyRingData adds the secret keyring with the given data
+func (v *Vault) AddSecretKeyRingData(gpgSecretKeyRingData []byte) error {
+	el, err := vaultKeyrings.get(hash(gpgSecretKeyRingData), func() (interface{}, error) {
+		return openpgp.ReadKeyRing(bytes.NewReader(gpgSecretKeyRingData))
+	})
+	if err != nil {
+		return fmt.Errorf("could not read keyring: %w", err)
+	}
+	v.mu.Lock()
+	v.entityLists = append(v.entityLists, el.(openpgp.EntityList))
+	v.keyDataList = append(v.keyDataList, gpgSecretKeyRingData)
+	v.mu.Unlock()
+	return nil
+}
+
+// AddSecretKeyRingDataArray adds the secret keyrings with the given data
+func (v *Vault) AddSecretKeyRingDataArray(gpgSecretKeyRingDataArray [][]byte) error {
+	for _, data := range gpgSecretKeyRingDataArray {
+		if err := v.AddSecretKeyRingData(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSecretKeyRingFiles adds the secret keyrings in the given files
+func (v *Vault) AddSecretKeyRingFiles(filenames []string) error {
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if err := v.AddSecretKeyRingData(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGPGPrivateKey returns the encryption keys with the given key ID and the
+// data of the first keyring that has them
+func (v *Vault) GetGPGPrivateKey(keyid uint64) ([]openpgp.Key, []byte) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for i, el := range v.entityLists {
+		if keys := el.KeysByIdUsage(keyid, packet.KeyFlagEncryptCommunications); len(keys) > 0 {
+			return keys, v.keyDataList[i]
+		}
+	}
+	return nil, nil
+}
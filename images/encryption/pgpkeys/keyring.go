@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpkeys
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrKeyboxd is returned by ReadPubring if the public keys of the GnuPG home
+// directory are kept by keyboxd, which only gpg can read them from
+var ErrKeyboxd = errors.New("public keys are kept by keyboxd")
+
+const (
+	kbxBlobFirst   = 1
+	kbxBlobOpenPGP = 2
+
+	// kbxFlagEphemeral marks keys that gpg does not list
+	kbxFlagEphemeral = 2
+)
+
+// Homedir returns the GnuPG home directory, which is the given one, the
+// one in GNUPGHOME or ~/.gnupg
+func Homedir(homedir string) (string, error) {
+	if homedir != "" {
+		return homedir, nil
+	}
+	if h := os.Getenv("GNUPGHOME"); h != "" {
+		return h, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gnupg"), nil
+}
+
+// ReadPubring returns the public keys of a GnuPG home directory as binary
+// keyring without running gpg. The pubring.kbx keybox of GnuPG 2.1 and later
+// is preferred over a legacy pubring.gpg, unless gpgVersion is "v1". If the
+// home directory uses keyboxd, as GnuPG 2.4 does by default, ErrKeyboxd is
+// returned.
+func ReadPubring(homedir, gpgVersion string) ([]byte, error) {
+	homedir, err := Homedir(homedir)
+	if err != nil {
+		return nil, err
+	}
+	if UsesKeyboxd(homedir) {
+		return nil, ErrKeyboxd
+	}
+	files := []string{"pubring.kbx", "pubring.gpg"}
+	if gpgVersion == "v1" {
+		files = []string{"pubring.gpg"}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(homedir, f))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if IsKeybox(data) {
+			return ParseKeybox(data)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("no public keyring found in %s", homedir)
+}
+
+// UsesKeyboxd returns whether use-keyboxd is set in common.conf or the
+// keyboxd database exists
+func UsesKeyboxd(homedir string) bool {
+	if _, err := os.Stat(filepath.Join(homedir, "public-keys.d", "pubring.db")); err == nil {
+		return true
+	}
+	f, err := os.Open(filepath.Join(homedir, "common.conf"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "use-keyboxd" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsKeybox returns whether data starts with the header blob of a keybox
+func IsKeybox(data []byte) bool {
+	return len(data) >= 12 && data[4] == kbxBlobFirst && string(data[8:12]) == "KBXf"
+}
+
+// ParseKeybox returns the OpenPGP keyblocks of a keybox file as binary
+// keyring; X.509 certificates and ephemeral keys are skipped
+func ParseKeybox(data []byte) ([]byte, error) {
+	var keyring []byte
+	for off := 0; off < len(data); {
+		if len(data)-off < 6 {
+			return nil, errors.New("truncated keybox blob")
+		}
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		if n < 6 || n > len(data)-off {
+			return nil, fmt.Errorf("invalid keybox blob length %d at offset %d", n, off)
+		}
+		blob := data[off : off+n]
+		off += n
+		if blob[4] != kbxBlobOpenPGP {
+			continue
+		}
+		if len(blob) < 16 {
+			return nil, errors.New("truncated OpenPGP keybox blob")
+		}
+		if binary.BigEndian.Uint16(blob[6:])&kbxFlagEphemeral != 0 {
+			continue
+		}
+		start, length := binary.BigEndian.Uint32(blob[8:]), binary.BigEndian.Uint32(blob[12:])
+		if uint64(start)+uint64(length) > uint64(len(blob)) {
+			return nil, errors.New("OpenPGP keyblock exceeds keybox blob")
+		}
+		keyring = append(keyring, blob[start:start+length]...)
+	}
+	return keyring, nil
+}
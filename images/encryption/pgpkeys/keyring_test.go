@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpkeys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+)
+
+// kbxBlob returns a keybox blob of the given type and flags holding keyblock
+func kbxBlob(typ byte, flags uint16, keyblock []byte) []byte {
+	blob := make([]byte, 20, 20+len(keyblock))
+	binary.BigEndian.PutUint32(blob, uint32(cap(blob)))
+	blob[4], blob[5] = typ, 1
+	binary.BigEndian.PutUint16(blob[6:], flags)
+	binary.BigEndian.PutUint32(blob[8:], 20)
+	binary.BigEndian.PutUint32(blob[12:], uint32(len(keyblock)))
+	return append(blob, keyblock...)
+}
+
+// kbxHeader returns the first blob of a keybox
+func kbxHeader() []byte {
+	header := make([]byte, 32)
+	binary.BigEndian.PutUint32(header, 32)
+	header[4], header[5] = kbxBlobFirst, 1
+	copy(header[8:], "KBXf")
+	return header
+}
+
+func serializedEntity(t *testing.T, email string) []byte {
+	e, err := openpgp.NewEntity("Test", "", email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseKeybox(t *testing.T) {
+	kbx := kbxHeader()
+	kbx = append(kbx, kbxBlob(kbxBlobOpenPGP, 0, serializedEntity(t, "a@example.com"))...)
+	kbx = append(kbx, kbxBlob(3, 0, []byte("x509 certificate"))...)
+	kbx = append(kbx, kbxBlob(kbxBlobOpenPGP, kbxFlagEphemeral, serializedEntity(t, "b@example.com"))...)
+	kbx = append(kbx, kbxBlob(kbxBlobOpenPGP, 0, serializedEntity(t, "c@example.com"))...)
+	if !IsKeybox(kbx) {
+		t.Fatal("expected keybox to be detected")
+	}
+
+	keyring, err := ParseKeybox(kbx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := Missing(keyring, []string{"a@example.com", "b@example.com", "c@example.com"})
+	if err != nil || len(missing) != 1 || missing[0] != "b@example.com" {
+		t.Fatalf("got %v, %v", missing, err)
+	}
+
+	if _, err := ParseKeybox(kbx[:len(kbx)-1]); err == nil {
+		t.Fatal("expected truncated keybox to be rejected")
+	}
+}
+
+func TestReadPubring(t *testing.T) {
+	homedir := t.TempDir()
+	if _, err := ReadPubring(homedir, ""); err == nil {
+		t.Fatal("expected error without keyring")
+	}
+
+	legacy := serializedEntity(t, "legacy@example.com")
+	if err := os.WriteFile(filepath.Join(homedir, "pubring.gpg"), legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+	kbx := append(kbxHeader(), kbxBlob(kbxBlobOpenPGP, 0, serializedEntity(t, "kbx@example.com"))...)
+	if err := os.WriteFile(filepath.Join(homedir, "pubring.kbx"), kbx, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for version, expected := range map[string]string{"": "kbx@example.com", "v2": "kbx@example.com", "v1": "legacy@example.com"} {
+		keyring, err := ReadPubring(homedir, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if missing, err := Missing(keyring, []string{expected}); err != nil || len(missing) != 0 {
+			t.Errorf("version %q: expected key of %s, got %v, %v", version, expected, missing, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(homedir, "common.conf"), []byte("use-keyboxd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPubring(homedir, ""); !errors.Is(err, ErrKeyboxd) {
+		t.Fatalf("expected ErrKeyboxd, got %v", err)
+	}
+}
+
+func TestReadPubringOfGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	homedir := t.TempDir()
+	cmd := exec.Command("gpg", "--homedir", homedir, "--batch", "--passphrase", "", "--pinentry-mode", "loopback",
+		"--quick-gen-key", "Test <test@example.com>", "rsa2048", "cert,sign,encr", "never")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	defer exec.Command("gpgconf", "--homedir", homedir, "--kill", "gpg-agent").Run()
+
+	keyring, err := ReadPubring(homedir, "")
+	if errors.Is(err, ErrKeyboxd) {
+		t.Skip("gpg uses keyboxd")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := Missing(keyring, []string{"test@example.com"}); err != nil || len(missing) != 0 {
+		t.Fatalf("got %v, %v", missing, err)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package pgpkeys reads the public PGP keys of recipients from GnuPG keyrings
+// and keyboxes and looks up those that are not in the local keyring through
+// the Web Key Directory (WKD) of their domain or through HKP keyservers.
+package pgpkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // WKD hashes local parts with SHA-1
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+)
+
+// SourceWKD is the source for looking up keys in the Web Key Directory
+const SourceWKD = "wkd"
+
+// maxKeySize limits the size of the keys read from a source
+const maxKeySize = 1 << 20
+
+// Key is a public key found for a recipient
+type Key struct {
+	// Fingerprint is the upper case hex fingerprint of the primary key
+	Fingerprint string
+	UserIDs     []string
+	// Data is the binary serialization of the key
+	Data []byte
+}
+
+// Resolver looks up keys in a list of sources, each of which is either
+// SourceWKD or the hkps:// or https:// URL of a keyserver
+type Resolver struct {
+	Sources []string
+	Client  *http.Client
+}
+
+// NewResolver returns a Resolver for the given sources
+func NewResolver(sources []string) (*Resolver, error) {
+	for _, s := range sources {
+		if s != SourceWKD && !strings.HasPrefix(s, "hkps://") && !strings.HasPrefix(s, "https://") {
+			return nil, fmt.Errorf("unsupported PGP key source %q: expected %q or an hkps:// keyserver", s, SourceWKD)
+		}
+	}
+	return &Resolver{Sources: sources, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Lookup returns the keys of the first source that has keys with a user ID
+// whose name or address is recipient
+func (r *Resolver) Lookup(ctx context.Context, recipient string) ([]Key, error) {
+	var errs []string
+	for _, s := range r.Sources {
+		var (
+			keys []Key
+			err  error
+		)
+		if s == SourceWKD {
+			keys, err = r.lookupWKD(ctx, recipient)
+		} else {
+			u := strings.TrimSuffix(strings.Replace(s, "hkps://", "https://", 1), "/")
+			keys, err = r.fetch(ctx, u+"/pks/lookup?op=get&options=mr&search="+url.QueryEscape(recipient), recipient)
+		}
+		if err == nil && len(keys) > 0 {
+			return keys, nil
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("no PGP key found for %s: %s", recipient, strings.Join(errs, "; "))
+	}
+	return nil, fmt.Errorf("no PGP key found for %s", recipient)
+}
+
+// lookupWKD tries the advanced and then the direct method of the WKD
+func (r *Resolver) lookupWKD(ctx context.Context, recipient string) ([]Key, error) {
+	advanced, direct, err := WKDURLs(recipient)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := r.fetch(ctx, advanced, recipient)
+	if err == nil && len(keys) > 0 {
+		return keys, nil
+	}
+	return r.fetch(ctx, direct, recipient)
+}
+
+func (r *Resolver) fetch(ctx context.Context, u, recipient string) ([]Key, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeySize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(data, recipient)
+}
+
+// ParseKeys returns the keys in the binary or armored keyring data that have
+// a user ID whose name or address is recipient
+func ParseKeys(data []byte, recipient string) ([]Key, error) {
+	var (
+		el  openpgp.EntityList
+		err error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PGP keys: %w", err)
+	}
+	var keys []Key
+	for _, e := range el {
+		if !Matches(e, recipient) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := e.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		k := Key{
+			Fingerprint: strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint[:])),
+			Data:        buf.Bytes(),
+		}
+		for id := range e.Identities {
+			k.UserIDs = append(k.UserIDs, id)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Matches returns whether the entity has a user ID whose name or address is
+// recipient, which is how recipients are matched when encrypting
+func Matches(e *openpgp.Entity, recipient string) bool {
+	for id := range e.Identities {
+		addr, err := mail.ParseAddress(id)
+		if err != nil {
+			continue
+		}
+		if addr.Name == recipient || addr.Address == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the recipients for which the binary keyring has no key
+func Missing(pubring []byte, recipients []string) ([]string, error) {
+	var el openpgp.EntityList
+	if len(pubring) > 0 {
+		var err error
+		if el, err = openpgp.ReadKeyRing(bytes.NewReader(pubring)); err != nil {
+			return nil, err
+		}
+	}
+	var missing []string
+	for _, r := range recipients {
+		found := false
+		for _, e := range el {
+			if Matches(e, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing, nil
+}
+
+// NormalizeFingerprint returns a fingerprint given with or without spaces and
+// 0x prefix in upper case hex
+func NormalizeFingerprint(fpr string) string {
+	fpr = strings.TrimPrefix(strings.TrimPrefix(fpr, "0x"), "0X")
+	return strings.ToUpper(strings.ReplaceAll(fpr, " ", ""))
+}
+
+// WKDURLs returns the URLs of the advanced and the direct method of looking up
+// the key of an email address in the WKD
+func WKDURLs(email string) (advanced, direct string, err error) {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(domain, "/@") {
+		return "", "", errors.New("WKD lookup needs an email address")
+	}
+	domain = strings.ToLower(domain)
+	sum := sha1.Sum([]byte(strings.ToLower(local))) //nolint:gosec
+	hu := zbase32(sum[:]) + "?l=" + url.QueryEscape(local)
+	advanced = "https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hu
+	direct = "https://" + domain + "/.well-known/openpgpkey/hu/" + hu
+	return advanced, direct, nil
+}
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+func zbase32(b []byte) string {
+	var (
+		sb   strings.Builder
+		acc  uint
+		bits uint
+	)
+	for _, c := range b {
+		acc = acc<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(acc>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(acc<<(5-bits))&31])
+	}
+	return sb.String()
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgpkeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobars/ocicrypt/crypto/openpgp"
+)
+
+func TestWKDURLs(t *testing.T) {
+	advanced, direct, err := WKDURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"; advanced != exp {
+		t.Errorf("got %s, expected %s", advanced, exp)
+	}
+	if exp := "https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"; direct != exp {
+		t.Errorf("got %s, expected %s", direct, exp)
+	}
+	if _, _, err := WKDURLs("Joe Doe"); err == nil {
+		t.Error("expected error for a name")
+	}
+}
+
+func TestLookupHKP(t *testing.T) {
+	e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	if err := e.Serialize(&key); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pks/lookup" || r.URL.Query().Get("op") != "get" || r.URL.Query().Get("search") != "test@example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(key.Bytes())
+	}))
+	defer srv.Close()
+
+	r, err := NewResolver([]string{strings.Replace(srv.URL, "https://", "hkps://", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Client = srv.Client()
+
+	keys, err := r.Lookup(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpr := NormalizeFingerprint("0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint[:]))
+	if len(keys) != 1 || keys[0].Fingerprint != fpr {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	missing, err := Missing(keys[0].Data, []string{"test@example.com", "Test", "other@example.com"})
+	if err != nil || len(missing) != 1 || missing[0] != "other@example.com" {
+		t.Fatalf("got %v, %v", missing, err)
+	}
+
+	if _, err := r.Lookup(context.Background(), "other@example.com"); err == nil {
+		t.Fatal("expected lookup of unknown recipient to fail")
+	}
+	if _, err := NewResolver([]string{"http://keys.example.com"}); err == nil {
+		t.Fatal("expected plain http keyserver to be rejected")
+	}
+}
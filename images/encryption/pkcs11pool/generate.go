@@ -0,0 +1,183 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"github.com/miekg/pkcs11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// curveOIDs are the object identifiers passed as CKA_EC_PARAMS
+var curveOIDs = map[elliptic.Curve]asn1.ObjectIdentifier{
+	elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+	elliptic.P384(): {1, 3, 132, 0, 34},
+	elliptic.P521(): {1, 3, 132, 0, 35},
+}
+
+// GenerateKeyPair generates a key pair on the token of the URI, labeled with
+// its object attribute and identified by its id attribute, and returns the
+// public key. The private key is sensitive and not extractable, so it never
+// leaves the token. No key pair is generated if the token already holds an
+// object with the same label and id.
+func GenerateKeyPair(uri *pkcs11uri.Pkcs11URI, spec KeyPairSpec) (crypto.PublicKey, error) {
+	id, _ := uri.GetPathAttribute("id", false)
+	label, hasLabel := uri.GetPathAttribute("object", false)
+	if id == "" && !hasLabel {
+		return nil, errors.New("neither 'id' nor 'object' attributes were found in pkcs11 URI")
+	}
+
+	mech, public, private, err := keyPairTemplates(spec)
+	if err != nil {
+		return nil, err
+	}
+	var names []*pkcs11.Attribute
+	if label != "" {
+		names = append(names, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	if id != "" {
+		names = append(names, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+	public = append(public, names...)
+	private = append(private, names...)
+
+	t, err := New(1).token(&ocipkcs11.Pkcs11KeyFileObject{Uri: uri})
+	if err != nil {
+		return nil, err
+	}
+	var pub crypto.PublicKey
+	err = t.do(func(sh pkcs11.SessionHandle) error {
+		if err := t.mod.FindObjectsInit(sh, names); err != nil {
+			return fmt.Errorf("FindObjectsInit failed: %w", err)
+		}
+		objs, _, err := t.mod.FindObjects(sh, 1)
+		if err != nil {
+			_ = t.mod.FindObjectsFinal(sh)
+			return fmt.Errorf("FindObjects failed: %w", err)
+		}
+		if err := t.mod.FindObjectsFinal(sh); err != nil {
+			return fmt.Errorf("FindObjectsFinal failed: %w", err)
+		}
+		if len(objs) > 0 {
+			return fmt.Errorf("the token already holds an object with label %q and id %q", label, id)
+		}
+
+		pubObj, _, err := t.mod.GenerateKeyPair(sh, mech, public, private)
+		if err != nil {
+			return fmt.Errorf("GenerateKeyPair failed: %w", err)
+		}
+		pub, err = publicKey(t.mod, sh, pubObj, spec)
+		return err
+	})
+	return pub, err
+}
+
+// keyPairTemplates returns the mechanism and the attributes of the public and
+// private key objects of the key pair
+func keyPairTemplates(spec KeyPairSpec) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	}
+
+	if spec.Curve != nil {
+		oid, ok := curveOIDs[spec.Curve]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("unsupported curve %s", spec.Curve.Params().Name)
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+		private = append(private,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true))
+		return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}, public, private, nil
+	}
+
+	if spec.Bits < 2048 {
+		return nil, nil, nil, errors.New("RSA keys must have at least 2048 bits")
+	}
+	public = append(public,
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, spec.Bits),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	private = append(private,
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true))
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, public, private, nil
+}
+
+// publicKey reads the public key of the generated key pair from the token
+func publicKey(mod module, sh pkcs11.SessionHandle, obj pkcs11.ObjectHandle, spec KeyPairSpec) (crypto.PublicKey, error) {
+	if spec.Curve == nil {
+		attrs, err := mod.GetAttributeValue(sh, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GetAttributeValue failed: %w", err)
+		}
+		e := new(big.Int).SetBytes(attrs[1].Value)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("the public exponent of the RSA key is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(e.Int64())}, nil
+	}
+
+	attrs, err := mod.GetAttributeValue(sh, obj, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %w", err)
+	}
+	// the point is DER encoded as an octet string, though some modules
+	// return it raw
+	point := attrs[0].Value
+	var octets []byte
+	if rest, err := asn1.Unmarshal(point, &octets); err == nil && len(rest) == 0 {
+		point = octets
+	}
+	x, y := elliptic.Unmarshal(spec.Curve, point) //nolint:staticcheck // ignore SA1019, ecdsa keys are built from coordinates
+	if x == nil {
+		return nil, errors.New("could not parse the EC point of the public key")
+	}
+	return &ecdsa.PublicKey{Curve: spec.Curve, X: x, Y: y}, nil
+}
@@ -0,0 +1,74 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"github.com/miekg/pkcs11"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	mod := &fakeModule{open: make(map[pkcs11.SessionHandle]bool)}
+	openModule = func(string) (module, error) { return mod, nil }
+
+	path := filepath.Join(t.TempDir(), "libfake.so")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	uri, err := ocipkcs11.ParsePkcs11Uri("pkcs11:token=test;object=new?module-path=" + path + "&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri.SetAllowedModulePaths([]string{path})
+	SetModulePolicy(&ModulePolicy{AllowedModulePaths: []string{path}})
+
+	if _, err := GenerateKeyPair(uri, KeyPairSpec{Bits: 1024}); err == nil {
+		t.Fatal("expected 1024 bit RSA key to be rejected")
+	}
+	pub, err := GenerateKeyPair(uri, KeyPairSpec{Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsaPub, ok := pub.(*rsa.PublicKey); !ok || !rsaPub.Equal(&mod.key.PublicKey) {
+		t.Fatalf("unexpected public key %v", pub)
+	}
+
+	attrs := make(map[uint][]byte)
+	for _, a := range mod.generated {
+		attrs[a.Type] = a.Value
+	}
+	for typ, value := range map[uint]bool{pkcs11.CKA_TOKEN: true, pkcs11.CKA_SENSITIVE: true, pkcs11.CKA_EXTRACTABLE: false, pkcs11.CKA_DECRYPT: true} {
+		if v, ok := attrs[typ]; !ok || len(v) != 1 || (v[0] != 0) != value {
+			t.Errorf("attribute %#x of private key is %v, expected %v", typ, v, value)
+		}
+	}
+	if string(attrs[pkcs11.CKA_LABEL]) != "new" {
+		t.Errorf("unexpected label %q", attrs[pkcs11.CKA_LABEL])
+	}
+
+	if _, err := GenerateKeyPair(uri, KeyPairSpec{Bits: 2048}); err == nil {
+		t.Fatal("expected existing key to be kept")
+	}
+}
@@ -0,0 +1,109 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"github.com/gobars/ocicrypt/keywrap"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+// keyWrapper unwraps pkcs11 wrapped keys with the sessions of a pool
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	pool *Pool
+}
+
+// WrapKeys checks the modules of the recipients against the module policy
+// before ocicrypt loads them
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	var p11conf *ocipkcs11.Pkcs11Config
+	if conf, ok := ec.DecryptConfig.Parameters["pkcs11-config"]; ok && len(conf) > 0 {
+		var err error
+		if p11conf, err = ocipkcs11.ParsePkcs11ConfigFile(conf[0]); err != nil {
+			return nil, err
+		}
+	}
+	for _, data := range ec.Parameters["pkcs11-yamls"] {
+		key, err := encutils.ParsePublicKey(data, "PKCS11")
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(*ocipkcs11.Pkcs11KeyFileObject)
+		if !ok {
+			continue
+		}
+		if p11conf != nil {
+			k.Uri.SetModuleDirectories(p11conf.ModuleDirectories)
+			k.Uri.SetAllowedModulePaths(p11conf.AllowedModulePaths)
+		}
+		path, err := k.Uri.GetModule()
+		if err != nil {
+			return nil, fmt.Errorf("no module available in pkcs11 URI: %w", err)
+		}
+		if err := checkModule(path); err != nil {
+			return nil, err
+		}
+	}
+	return kw.KeyWrapper.WrapKeys(ec, optsData)
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, jsonString []byte) ([]byte, error) {
+	privKeys := kw.GetPrivateKeys(dc.Parameters)
+	if len(privKeys) == 0 {
+		return nil, errors.New("no private keys found for PKCS11 decryption")
+	}
+	var p11conf *ocipkcs11.Pkcs11Config
+	if conf, ok := dc.Parameters["pkcs11-config"]; ok && len(conf) > 0 {
+		var err error
+		if p11conf, err = ocipkcs11.ParsePkcs11ConfigFile(conf[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []*ocipkcs11.Pkcs11KeyFileObject
+	for _, privKey := range privKeys {
+		key, err := encutils.ParsePrivateKey(privKey, nil, "PKCS11")
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := key.(*ocipkcs11.Pkcs11KeyFileObject); ok {
+			if p11conf != nil {
+				k.Uri.SetModuleDirectories(p11conf.ModuleDirectories)
+				k.Uri.SetAllowedModulePaths(p11conf.AllowedModulePaths)
+			}
+			keys = append(keys, k)
+		}
+	}
+	plaintext, err := kw.pool.Decrypt(keys, jsonString)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS11: no suitable private key found for decryption: %w", err)
+	}
+	return plaintext, nil
+}
+
+func install() {
+	ocicrypt.RegisterKeyWrapper("pkcs11", &keyWrapper{ocicrypt.GetKeyWrapper("pkcs11"), New(maxSessions())})
+}
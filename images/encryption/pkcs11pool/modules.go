@@ -0,0 +1,223 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gobars/ocicrypt/config/pkcs11config"
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"gopkg.in/yaml.v3"
+)
+
+// ModulePolicy restricts the PKCS#11 modules that are loaded beyond the
+// allowed-module-paths passed along with pkcs11 keys, which a decoder receives
+// from its clients. It is read from the pkcs11 section of an ocicrypt
+// configuration file, for example
+//
+//	pkcs11:
+//	  module-directories:
+//	  - /usr/lib64/pkcs11/
+//	  allowed-module-paths:
+//	  - /usr/lib64/pkcs11/libsofthsm2.so
+//	  module-sha256:
+//	    /usr/lib64/pkcs11/libsofthsm2.so: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	  require-module-sha256: true
+type ModulePolicy struct {
+	// ModuleDirectories are searched for the modules given by module-name
+	ModuleDirectories []string `yaml:"module-directories,omitempty"`
+	// AllowedModulePaths lists the module files and, ending in "/", the
+	// directories whose modules may be loaded
+	AllowedModulePaths []string `yaml:"allowed-module-paths,omitempty"`
+	// ModuleSHA256 maps module paths to the hex encoded SHA-256 digests of
+	// their files
+	ModuleSHA256 map[string]string `yaml:"module-sha256,omitempty"`
+	// RequireModuleSHA256 refuses modules without a digest in ModuleSHA256
+	RequireModuleSHA256 bool `yaml:"require-module-sha256,omitempty"`
+}
+
+// LoadModulePolicy reads the module policy from the ocicrypt configuration
+// file at path
+func LoadModulePolicy(path string) (*ModulePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read PKCS#11 module policy: %w", err)
+	}
+	var conf struct {
+		Pkcs11 ModulePolicy `yaml:"pkcs11"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("could not parse PKCS#11 module policy %s: %w", path, err)
+	}
+	p := &conf.Pkcs11
+	for module, digest := range p.ModuleSHA256 {
+		if !filepath.IsAbs(module) {
+			return nil, fmt.Errorf("module %s with pinned digest is not an absolute path", module)
+		}
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 digest %q of module %s", digest, module)
+		}
+	}
+	return p, nil
+}
+
+// Pkcs11Config returns the ocicrypt configuration with the module directories
+// and allowed module paths of the policy
+func (p *ModulePolicy) Pkcs11Config() *ocipkcs11.Pkcs11Config {
+	return &ocipkcs11.Pkcs11Config{
+		ModuleDirectories:  p.ModuleDirectories,
+		AllowedModulePaths: p.AllowedModulePaths,
+	}
+}
+
+// Check returns an error if the module at path must not be loaded, which is
+// the case if it is not allowed, can be written by other users than its owner
+// or does not have its pinned digest. If the path is a symbolic link, the
+// digest may also be pinned for the file it links to.
+func (p *ModulePolicy) Check(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("PKCS#11 module %s is not an absolute path", path)
+	}
+	path = filepath.Clean(path)
+	if !p.allowed(path) {
+		return fmt.Errorf("PKCS#11 module %s is not allowed by policy", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open PKCS#11 module: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat PKCS#11 module: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("PKCS#11 module %s is not a regular file", path)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("PKCS#11 module %s is writable by group or others", path)
+	}
+
+	digest, ok := p.ModuleSHA256[path]
+	if !ok {
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			digest, ok = p.ModuleSHA256[target]
+		}
+	}
+	if !ok {
+		if p.RequireModuleSHA256 {
+			return fmt.Errorf("PKCS#11 module %s has no pinned SHA-256 digest", path)
+		}
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not read PKCS#11 module: %w", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, digest) {
+		return fmt.Errorf("PKCS#11 module %s has SHA-256 digest %s instead of the pinned %s", path, actual, digest)
+	}
+	return nil
+}
+
+// allowed returns whether the path is an allowed module file or a file in an
+// allowed directory, not in a subdirectory of it
+func (p *ModulePolicy) allowed(path string) bool {
+	for _, allowed := range p.AllowedModulePaths {
+		if strings.HasSuffix(allowed, "/") {
+			if filepath.Dir(path) == filepath.Clean(allowed) {
+				return true
+			}
+		} else if filepath.Clean(allowed) == path {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	policyMu     sync.Mutex
+	policyLoaded bool
+	policy       *ModulePolicy
+)
+
+// SetModulePolicy sets the policy checked before PKCS#11 modules are loaded,
+// instead of the one read from the ocicrypt configuration file that ocicrypt
+// uses. A decoder sets it so that its own policy applies regardless of the
+// configuration of its clients.
+func SetModulePolicy(p *ModulePolicy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy, policyLoaded = p, true
+}
+
+// checkModule checks the module at path against the policy that was set or,
+// if none was, the one of the ocicrypt configuration file, if there is one
+func checkModule(path string) error {
+	policyMu.Lock()
+	if !policyLoaded {
+		if file := ConfigFile(); file != "" {
+			p, err := LoadModulePolicy(file)
+			if err != nil {
+				policyMu.Unlock()
+				return err
+			}
+			policy = p
+		}
+		policyLoaded = true
+	}
+	p := policy
+	policyMu.Unlock()
+
+	if p == nil {
+		return nil
+	}
+	return p.Check(path)
+}
+
+// ConfigFile returns the ocicrypt configuration file in the locations ocicrypt
+// looks for it, or "" if there is none or the internal default configuration
+// is used
+func ConfigFile() string {
+	var candidates []string
+	if file := os.Getenv(pkcs11config.ENVVARNAME); file == "internal" {
+		return ""
+	} else if file != "" {
+		candidates = append(candidates, file)
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, pkcs11config.CONFIGFILE))
+	}
+	if dir := os.Getenv("HOME"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, ".config", pkcs11config.CONFIGFILE))
+	}
+	candidates = append(candidates, filepath.Join("/etc", pkcs11config.CONFIGFILE))
+	for _, file := range candidates {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModulePolicy(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "pkcs11", "libhsm.so")
+	if err := os.Mkdir(filepath.Dir(module), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(module, []byte("module"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "pkcs11", "libhsm-link.so")
+	if err := os.Symlink(module, link); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("module"))
+	digest := hex.EncodeToString(sum[:])
+
+	conf := filepath.Join(dir, "ocicrypt.conf")
+	data := fmt.Sprintf("pkcs11:\n  allowed-module-paths:\n  - %s/\n  module-sha256:\n    %s: %s\n", filepath.Dir(module), module, digest)
+	if err := os.WriteFile(conf, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadModulePolicy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{module, link, filepath.Join(dir, "pkcs11", "..", "pkcs11", "libhsm.so")} {
+		if err := p.Check(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, "libother.so"), "libhsm.so", filepath.Join(dir, "pkcs11", "sub", "libhsm.so")} {
+		if err := p.Check(path); err == nil {
+			t.Errorf("%s: expected module to be refused", path)
+		}
+	}
+
+	p.ModuleSHA256[module] = hex.EncodeToString(make([]byte, sha256.Size))
+	if err := p.Check(module); err == nil {
+		t.Fatal("expected module with other digest to be refused")
+	}
+	delete(p.ModuleSHA256, module)
+	if err := p.Check(module); err != nil {
+		t.Fatal(err)
+	}
+	p.RequireModuleSHA256 = true
+	if err := p.Check(module); err == nil {
+		t.Fatal("expected module without digest to be refused")
+	}
+
+	p = &ModulePolicy{AllowedModulePaths: []string{module}}
+	if err := os.Chmod(module, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check(module); err == nil {
+		t.Fatal("expected writable module to be refused")
+	}
+
+	if err := os.WriteFile(conf, []byte("pkcs11:\n  module-sha256:\n    libhsm.so: "+digest+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadModulePolicy(conf); err == nil {
+		t.Fatal("expected relative module path to be rejected")
+	}
+}
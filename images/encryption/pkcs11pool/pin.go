@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// PINCallback, if set, is called for the PIN of a private key whose URI has
+// neither a pin-value nor a pin-source attribute; it is passed the URI
+// without its query attributes. Embedders set it before decrypting images.
+var PINCallback func(uri string) ([]byte, error)
+
+// PIN returns the PIN for the private key of the URI. It is taken from the
+// pin-value attribute or read from the pin-source attribute, which is either
+// file:<absolute path> or env:<variable>, or asked from PINCallback.
+func PIN(uri *pkcs11uri.Pkcs11URI) (string, error) {
+	if v, ok := uri.GetQueryAttribute("pin-value", false); ok {
+		return v, nil
+	}
+	if src, ok := uri.GetQueryAttribute("pin-source", false); ok {
+		return readPINSource(src)
+	}
+	if PINCallback == nil {
+		return "", errors.New("missing PIN for private key operation")
+	}
+	s, err := uri.Format()
+	if err != nil {
+		return "", err
+	}
+	s, _, _ = strings.Cut(s, "?")
+	pin, err := PINCallback(s)
+	if err != nil {
+		return "", err
+	}
+	return string(pin), nil
+}
+
+func readPINSource(src string) (string, error) {
+	scheme, value, ok := strings.Cut(src, ":")
+	if !ok {
+		scheme, value = "file", src
+	}
+	switch scheme {
+	case "env":
+		pin, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("PIN environment variable %s is not set", value)
+		}
+		return pin, nil
+	case "file":
+		if !filepath.IsAbs(value) {
+			return "", fmt.Errorf("PIN file %s is not an absolute path", value)
+		}
+		pin, err := os.ReadFile(value)
+		if err != nil {
+			return "", fmt.Errorf("could not read PIN file: %w", err)
+		}
+		return strings.TrimRight(string(pin), "\r\n"), nil
+	default:
+		return "", fmt.Errorf("unsupported pin-source %q: expected file:<path> or env:<variable>", src)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+func TestPIN(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PKCS11_PIN", "from-env")
+	defer func() { PINCallback = nil }()
+	PINCallback = func(uri string) ([]byte, error) {
+		if !strings.HasPrefix(uri, "pkcs11:") || strings.Contains(uri, "?") {
+			t.Errorf("callback called with %s", uri)
+		}
+		return []byte("from-callback"), nil
+	}
+
+	for query, expected := range map[string]string{
+		"?pin-value=1234":                 "1234",
+		"?pin-source=file:" + pinFile:     "from-file",
+		"?pin-source=" + pinFile:          "from-file",
+		"?pin-source=env:TEST_PKCS11_PIN": "from-env",
+		"?module-name=softhsm2":           "from-callback",
+	} {
+		uri := pkcs11uri.New()
+		if err := uri.Parse("pkcs11:token=test;object=key" + query); err != nil {
+			t.Fatal(err)
+		}
+		if pin, err := PIN(uri); err != nil || pin != expected {
+			t.Errorf("%s: got %q, %v", query, pin, err)
+		}
+	}
+
+	for _, query := range []string{"?pin-source=env:TEST_PKCS11_UNSET", "?pin-source=file:pin", "?pin-source=https://example.com/pin"} {
+		uri := pkcs11uri.New()
+		if err := uri.Parse("pkcs11:token=test;object=key" + query); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := PIN(uri); err == nil {
+			t.Errorf("%s: expected error", query)
+		}
+	}
+}
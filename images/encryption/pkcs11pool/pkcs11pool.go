@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package pkcs11pool unwraps pkcs11 wrapped layer keys with PKCS#11 sessions
+// that are kept open and logged in across layers, instead of loading the
+// module and opening a session for each layer as ocicrypt does. Network HSMs
+// that throttle session churn otherwise make decrypting large images slow.
+package pkcs11pool
+
+import (
+	"crypto/elliptic"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultMaxSessions is the number of sessions opened with a token at most
+	DefaultMaxSessions = 4
+	// MaxSessionsEnv overrides DefaultMaxSessions; 1 serializes the operations
+	// on a token, which some modules require
+	MaxSessionsEnv = "IMGCRYPT_PKCS11_MAX_SESSIONS"
+)
+
+func maxSessions() int {
+	n, err := strconv.Atoi(os.Getenv(MaxSessionsEnv))
+	if err != nil || n < 1 {
+		return DefaultMaxSessions
+	}
+	return n
+}
+
+var installOnce sync.Once
+
+// Install registers the pooling unwrapper for pkcs11 wrapped keys with
+// ocicrypt; without cgo it does nothing
+func Install() {
+	installOnce.Do(install)
+}
+
+// KeyPairSpec describes the key pair to generate
+type KeyPairSpec struct {
+	// Bits is the size of an RSA key pair
+	Bits int
+	// Curve, if set, selects an EC key pair on the curve instead
+	Curve elliptic.Curve
+}
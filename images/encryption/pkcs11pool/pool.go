@@ -0,0 +1,486 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"github.com/miekg/pkcs11"
+)
+
+// module is the part of the PKCS#11 API used by the package; it is implemented
+// by *pkcs11.Ctx
+type module interface {
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	DecryptInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error
+	Decrypt(sh pkcs11.SessionHandle, cipher []byte) ([]byte, error)
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+}
+
+// openModule loads and initializes the PKCS#11 module at path
+var openModule = func(path string) (module, error) {
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load PKCS#11 module %s", path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			ctx.Destroy()
+			return nil, fmt.Errorf("could not initialize PKCS#11 module %s: %w", path, err)
+		}
+	}
+	return ctx, nil
+}
+
+// ProbeModule loads and initializes the PKCS#11 module at path if the module
+// policy allows it, and returns the number of its slots with a token present
+func ProbeModule(path string) (int, error) {
+	if err := checkModule(path); err != nil {
+		return 0, err
+	}
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return 0, fmt.Errorf("could not load PKCS#11 module %s", path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			ctx.Destroy()
+			return 0, fmt.Errorf("could not initialize PKCS#11 module %s: %w", path, err)
+		}
+	} else {
+		// leave modules initialized by others alone
+		defer func() {
+			_ = ctx.Finalize()
+			ctx.Destroy()
+		}()
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("could not list the slots of PKCS#11 module %s: %w", path, err)
+	}
+	return len(slots), nil
+}
+
+// Pool keeps the PKCS#11 modules it loads initialized and the sessions it
+// opens with their tokens logged in, so that they are reused by subsequent
+// decryptions
+type Pool struct {
+	maxSessions int
+
+	mu      sync.Mutex
+	modules map[string]module
+	slots   map[string]uint
+	tokens  map[tokenKey]*token
+}
+
+type tokenKey struct {
+	module string
+	slot   uint
+}
+
+type objectKey struct {
+	id, label string
+}
+
+// token holds the sessions opened with the token in a slot; at most
+// cap(sem) of them are in use at the same time
+type token struct {
+	mod  module
+	slot uint
+	pin  string
+	sem  chan struct{}
+	// target identifies the token to unwraplimit
+	target string
+
+	// loginMu serializes the logins, so that a wrong PIN is not tried by
+	// several sessions at once
+	loginMu  sync.Mutex
+	loggedIn bool
+
+	mu      sync.Mutex
+	idle    []pkcs11.SessionHandle
+	objects map[objectKey]pkcs11.ObjectHandle
+}
+
+// New returns a Pool that opens up to maxSessions sessions with each token;
+// with 1 the operations on a token are serialized
+func New(maxSessions int) *Pool {
+	if maxSessions < 1 {
+		maxSessions = DefaultMaxSessions
+	}
+	return &Pool{
+		maxSessions: maxSessions,
+		modules:     make(map[string]module),
+		slots:       make(map[string]uint),
+		tokens:      make(map[tokenKey]*token),
+	}
+}
+
+// Decrypt decrypts the JSON encoded pkcs11 blob holding a wrapped layer key
+// with the first of the private keys that can unwrap it, as ocicrypt does,
+// but with pooled sessions
+func (p *Pool) Decrypt(privKeys []*ocipkcs11.Pkcs11KeyFileObject, blob []byte) ([]byte, error) {
+	var pkcs11blob ocipkcs11.Pkcs11Blob
+	if err := json.Unmarshal(blob, &pkcs11blob); err != nil {
+		return nil, fmt.Errorf("could not parse pkcs11 blob: %w", err)
+	}
+	if pkcs11blob.Version != 0 {
+		return nil, fmt.Errorf("found pkcs11 blob with version %d but maximum supported version is 0", pkcs11blob.Version)
+	}
+	var errs []string
+	for _, recipient := range pkcs11blob.Recipients {
+		if recipient.Version != 0 {
+			return nil, fmt.Errorf("found pkcs11 recipient with version %d but maximum supported version is 0", recipient.Version)
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(recipient.Blob)
+		if err != nil || len(ciphertext) == 0 {
+			continue
+		}
+		for _, key := range privKeys {
+			plaintext, err := p.decrypt(key, ciphertext, recipient.Hash)
+			if err == nil {
+				return plaintext, nil
+			}
+			uri, _ := key.Uri.Format()
+			errs = append(errs, fmt.Sprintf("%s: %s", uri, err))
+		}
+	}
+	return nil, fmt.Errorf("could not find a pkcs11 key for decryption: %s", strings.Join(errs, "; "))
+}
+
+func (p *Pool) decrypt(key *ocipkcs11.Pkcs11KeyFileObject, ciphertext []byte, hashalg string) ([]byte, error) {
+	var oaep *pkcs11.OAEPParams
+	// an empty hash historically stands for sha1
+	switch hashalg {
+	case "sha1", "":
+		oaep = ocipkcs11.OAEPSha1Params
+	case "sha256":
+		oaep = ocipkcs11.OAEPSha256Params
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q for decryption", hashalg)
+	}
+	id, _ := key.Uri.GetPathAttribute("id", false)
+	label, hasLabel := key.Uri.GetPathAttribute("object", false)
+	if id == "" && !hasLabel {
+		return nil, errors.New("neither 'id' nor 'object' attributes were found in pkcs11 URI")
+	}
+	t, err := p.token(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	err = t.do(func(sh pkcs11.SessionHandle) error {
+		obj, err := t.findKey(sh, objectKey{id: id, label: label})
+		if err != nil {
+			return err
+		}
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, oaep)}
+		if err := t.mod.DecryptInit(sh, mech, obj); err != nil {
+			t.forgetKey(objectKey{id: id, label: label}, err)
+			return fmt.Errorf("DecryptInit failed: %w", err)
+		}
+		plaintext, err = t.mod.Decrypt(sh, ciphertext)
+		if err != nil {
+			return fmt.Errorf("Decrypt failed: %w", err)
+		}
+		return nil
+	})
+	return plaintext, err
+}
+
+// token returns the token the private key is on, loading its module if it
+// is not loaded yet
+func (p *Pool) token(key *ocipkcs11.Pkcs11KeyFileObject) (*token, error) {
+	path, err := key.Uri.GetModule()
+	if err != nil {
+		return nil, fmt.Errorf("no module available in pkcs11 URI: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mod, ok := p.modules[path]
+	if !ok {
+		if err := checkModule(path); err != nil {
+			return nil, err
+		}
+		restore, err := setEnv(key.Uri.GetEnvMap())
+		if err != nil {
+			return nil, err
+		}
+		mod, err = openModule(path)
+		restore()
+		if err != nil {
+			return nil, err
+		}
+		p.modules[path] = mod
+	}
+
+	slot, err := p.slot(mod, path, key)
+	if err != nil {
+		return nil, err
+	}
+	k := tokenKey{module: path, slot: slot}
+	t, ok := p.tokens[k]
+	if !ok {
+		// the PIN is only needed to log in the first session
+		pin, err := PIN(key.Uri)
+		if err != nil {
+			return nil, err
+		}
+		t = &token{
+			mod:     mod,
+			slot:    slot,
+			pin:     pin,
+			sem:     make(chan struct{}, p.maxSessions),
+			target:  fmt.Sprintf("token in slot %d of %s", slot, path),
+			objects: make(map[objectKey]pkcs11.ObjectHandle),
+		}
+		p.tokens[k] = t
+	}
+	return t, nil
+}
+
+// slot returns the slot-id of the URI or the slot holding its token
+func (p *Pool) slot(mod module, path string, key *ocipkcs11.Pkcs11KeyFileObject) (uint, error) {
+	if s, ok := key.Uri.GetPathAttribute("slot-id", false); ok {
+		slot, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("slot-id is not a valid number: %w", err)
+		}
+		return uint(slot), nil
+	}
+	label, ok := key.Uri.GetPathAttribute("token", false)
+	if !ok {
+		return 0, errors.New("missing 'token' attribute since 'slot-id' was not given")
+	}
+	if slot, ok := p.slots[path+"\x00"+label]; ok {
+		return slot, nil
+	}
+	slots, err := mod.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("GetSlotList failed: %w", err)
+	}
+	for _, slot := range slots {
+		if ti, err := mod.GetTokenInfo(slot); err == nil && ti.Label == label {
+			p.slots[path+"\x00"+label] = slot
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no slot holds token %q", label)
+}
+
+// do runs fn with a logged in session of the token; if the session turns out
+// to be no longer usable, the idle sessions are assumed to be lost as well
+// and fn is run once more with a new session
+func (t *token) do(fn func(pkcs11.SessionHandle) error) error {
+	t.sem <- struct{}{}
+	defer func() { <-t.sem }()
+
+	for attempt := 0; ; attempt++ {
+		sh, err := t.session()
+		if err != nil {
+			return err
+		}
+		err = fn(sh)
+		if err == nil || !sessionLost(err) {
+			t.mu.Lock()
+			t.idle = append(t.idle, sh)
+			t.mu.Unlock()
+			return err
+		}
+
+		t.mu.Lock()
+		lost := append(t.idle, sh)
+		t.idle = nil
+		t.mu.Unlock()
+		for _, sh := range lost {
+			_ = t.mod.CloseSession(sh)
+		}
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// session returns an idle session or opens and logs in a new one
+func (t *token) session() (pkcs11.SessionHandle, error) {
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		sh := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+		return sh, nil
+	}
+	t.mu.Unlock()
+
+	sh, err := t.mod.OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return 0, fmt.Errorf("OpenSession to slot %d failed: %w", t.slot, err)
+	}
+	if err := t.login(sh); err != nil {
+		_ = t.mod.CloseSession(sh)
+		return 0, err
+	}
+	return sh, nil
+}
+
+// login logs in the session; the login state is shared by all sessions with
+// a token. Until a login succeeded, the attempts to use the PIN are limited
+// by unwraplimit.
+func (t *token) login(sh pkcs11.SessionHandle) error {
+	t.loginMu.Lock()
+	defer t.loginMu.Unlock()
+	done := func(unwraplimit.Result) {}
+	if !t.loggedIn {
+		var err error
+		if done, err = unwraplimit.Attempt(unwraplimit.KindPIN, t.target); err != nil {
+			return fmt.Errorf("could not login to device: %w", err)
+		}
+	}
+	err := t.mod.Login(sh, pkcs11.CKU_USER, t.pin)
+	switch {
+	case err == nil, isError(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN):
+		t.loggedIn = true
+		done(unwraplimit.Succeeded)
+		return nil
+	case isError(err, pkcs11.CKR_PIN_INCORRECT):
+		done(unwraplimit.Wrong)
+	default:
+		done(unwraplimit.Inconclusive)
+	}
+	return fmt.Errorf("could not login to device: %w", err)
+}
+
+// findKey returns the handle of the private key, which is valid in all
+// sessions with the token
+func (t *token) findKey(sh pkcs11.SessionHandle, k objectKey) (pkcs11.ObjectHandle, error) {
+	t.mu.Lock()
+	obj, ok := t.objects[k]
+	t.mu.Unlock()
+	if ok {
+		return obj, nil
+	}
+
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}
+	if k.label != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label))
+	}
+	if k.id != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, k.id))
+	}
+	if err := t.mod.FindObjectsInit(sh, template); err != nil {
+		return 0, fmt.Errorf("FindObjectsInit failed: %w", err)
+	}
+	objs, _, err := t.mod.FindObjects(sh, 2)
+	if err != nil {
+		_ = t.mod.FindObjectsFinal(sh)
+		return 0, fmt.Errorf("FindObjects failed: %w", err)
+	}
+	if err := t.mod.FindObjectsFinal(sh); err != nil {
+		return 0, fmt.Errorf("FindObjectsFinal failed: %w", err)
+	}
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("could not find private key with label %q and id %q", k.label, k.id)
+	case 1:
+	default:
+		return 0, fmt.Errorf("there are several private keys with label %q and id %q", k.label, k.id)
+	}
+
+	t.mu.Lock()
+	t.objects[k] = objs[0]
+	t.mu.Unlock()
+	return objs[0], nil
+}
+
+// forgetKey drops the handle of the private key if err says it is invalid
+func (t *token) forgetKey(k objectKey, err error) {
+	if isError(err, pkcs11.CKR_KEY_HANDLE_INVALID) || isError(err, pkcs11.CKR_OBJECT_HANDLE_INVALID) {
+		t.mu.Lock()
+		delete(t.objects, k)
+		t.mu.Unlock()
+	}
+}
+
+// sessionLost returns whether err says that the session can no longer be
+// used, for example because a network HSM dropped it
+func sessionLost(err error) bool {
+	for _, code := range []uint{
+		pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_DEVICE_ERROR, pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_KEY_HANDLE_INVALID, pkcs11.CKR_OBJECT_HANDLE_INVALID,
+	} {
+		if isError(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func isError(err error, code uint) bool {
+	var e pkcs11.Error
+	return errors.As(err, &e) && uint(e) == code
+}
+
+// setEnv sets the environment variables the module needs while it is
+// initialized and returns a function restoring the previous values
+func setEnv(env map[string]string) (func(), error) {
+	old := make(map[string]*string)
+	restore := func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+	for k, v := range env {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		if err := os.Setenv(k, v); err != nil {
+			restore()
+			return nil, fmt.Errorf("could not set environment variable %s: %w", k, err)
+		}
+	}
+	return restore, nil
+}
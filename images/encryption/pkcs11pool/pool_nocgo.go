@@ -0,0 +1,40 @@
+//go:build !cgo
+// +build !cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"crypto"
+	"errors"
+
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// install does nothing since PKCS#11 modules can only be used with cgo
+func install() {}
+
+// GenerateKeyPair fails since PKCS#11 modules can only be used with cgo
+func GenerateKeyPair(*pkcs11uri.Pkcs11URI, KeyPairSpec) (crypto.PublicKey, error) {
+	return nil, errors.New("generating keys on PKCS#11 tokens requires cgo")
+}
+
+// ProbeModule fails since PKCS#11 modules can only be used with cgo
+func ProbeModule(string) (int, error) {
+	return 0, errors.New("loading PKCS#11 modules requires cgo")
+}
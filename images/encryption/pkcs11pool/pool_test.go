@@ -0,0 +1,255 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11pool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	ocipkcs11 "github.com/gobars/ocicrypt/crypto/pkcs11"
+	"github.com/miekg/pkcs11"
+)
+
+// fakeModule is a module with a token "test" in slot 3 holding an RSA key
+// labeled "key", or the key pair it generates
+type fakeModule struct {
+	key       *rsa.PrivateKey
+	generated []*pkcs11.Attribute
+
+	mu       sync.Mutex
+	next     pkcs11.SessionHandle
+	open     map[pkcs11.SessionHandle]bool
+	opened   int
+	active   int
+	maxUsers int
+	logins   int
+}
+
+func (m *fakeModule) GetSlotList(bool) ([]uint, error) { return []uint{1, 3}, nil }
+
+func (m *fakeModule) GetTokenInfo(slot uint) (pkcs11.TokenInfo, error) {
+	if slot == 3 {
+		return pkcs11.TokenInfo{Label: "test"}, nil
+	}
+	return pkcs11.TokenInfo{Label: "other"}, nil
+}
+
+func (m *fakeModule) OpenSession(slot uint, _ uint) (pkcs11.SessionHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slot != 3 {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	m.next++
+	m.opened++
+	m.open[m.next] = true
+	return m.next, nil
+}
+
+func (m *fakeModule) CloseSession(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.open, sh)
+	return nil
+}
+
+func (m *fakeModule) check(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.open[sh] {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return nil
+}
+
+func (m *fakeModule) Login(sh pkcs11.SessionHandle, _ uint, pin string) error {
+	m.mu.Lock()
+	m.logins++
+	m.mu.Unlock()
+	if pin != "1234" {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	return m.check(sh)
+}
+
+func (m *fakeModule) FindObjectsInit(sh pkcs11.SessionHandle, _ []*pkcs11.Attribute) error {
+	return m.check(sh)
+}
+
+func (m *fakeModule) FindObjects(sh pkcs11.SessionHandle, _ int) ([]pkcs11.ObjectHandle, bool, error) {
+	if m.key == nil {
+		return nil, false, m.check(sh)
+	}
+	return []pkcs11.ObjectHandle{42}, false, m.check(sh)
+}
+
+func (m *fakeModule) FindObjectsFinal(sh pkcs11.SessionHandle) error { return m.check(sh) }
+
+func (m *fakeModule) DecryptInit(sh pkcs11.SessionHandle, _ []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	return m.check(sh)
+}
+
+func (m *fakeModule) Decrypt(sh pkcs11.SessionHandle, ciphertext []byte) ([]byte, error) {
+	if err := m.check(sh); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.active++
+	if m.active > m.maxUsers {
+		m.maxUsers = m.active
+	}
+	m.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	m.mu.Lock()
+	m.active--
+	m.mu.Unlock()
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, m.key, ciphertext, nil)
+}
+
+func (m *fakeModule) GenerateKeyPair(sh pkcs11.SessionHandle, _ []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := m.check(sh); err != nil {
+		return 0, 0, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return 0, 0, err
+	}
+	m.key = key
+	m.generated = private
+	return 41, 42, nil
+}
+
+func (m *fakeModule) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	if o != 41 {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, m.key.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(m.key.E)).Bytes()),
+	}, m.check(sh)
+}
+
+func setup(t *testing.T) (*fakeModule, *ocipkcs11.Pkcs11KeyFileObject, []byte) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := &fakeModule{key: rsaKey, open: make(map[pkcs11.SessionHandle]bool)}
+	loaded := 0
+	openModule = func(string) (module, error) {
+		loaded++
+		if loaded > 1 {
+			t.Error("module loaded more than once")
+		}
+		return mod, nil
+	}
+
+	path := filepath.Join(t.TempDir(), "libfake.so")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	uri, err := ocipkcs11.ParsePkcs11Uri("pkcs11:token=test;object=key;type=private?module-path=" + path + "&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri.SetAllowedModulePaths([]string{path})
+	SetModulePolicy(&ModulePolicy{AllowedModulePaths: []string{path}})
+	key := &ocipkcs11.Pkcs11KeyFileObject{Uri: uri}
+
+	blob, err := ocipkcs11.EncryptMultiple([]interface{}{&rsaKey.PublicKey}, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mod, key, blob
+}
+
+func decryptLayers(t *testing.T, p *Pool, key *ocipkcs11.Pkcs11KeyFileObject, blob []byte, layers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < layers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			plaintext, err := p.Decrypt([]*ocipkcs11.Pkcs11KeyFileObject{key}, blob)
+			if err != nil || !bytes.Equal(plaintext, []byte("layer key")) {
+				t.Errorf("got %q, %v", plaintext, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolReusesSessions(t *testing.T) {
+	mod, key, blob := setup(t)
+	p := New(2)
+
+	decryptLayers(t, p, key, blob, 30)
+	if mod.opened > 2 {
+		t.Fatalf("opened %d sessions for 30 layers, expected at most 2", mod.opened)
+	}
+
+	// the HSM drops all sessions; they are replaced
+	mod.mu.Lock()
+	mod.open = make(map[pkcs11.SessionHandle]bool)
+	opened := mod.opened
+	mod.mu.Unlock()
+	decryptLayers(t, p, key, blob, 5)
+	if mod.opened-opened > 2 {
+		t.Fatalf("opened %d sessions after they were dropped, expected at most 2", mod.opened-opened)
+	}
+}
+
+func TestPoolSerializes(t *testing.T) {
+	mod, key, blob := setup(t)
+	decryptLayers(t, New(1), key, blob, 10)
+	if mod.opened != 1 || mod.maxUsers != 1 {
+		t.Fatalf("opened %d sessions used by %d at once, expected 1", mod.opened, mod.maxUsers)
+	}
+}
+
+func TestPoolLimitsPINAttempts(t *testing.T) {
+	mod, key, blob := setup(t)
+	if err := key.Uri.SetQueryAttribute("pin-value", "0000"); err != nil {
+		t.Fatal(err)
+	}
+	p := New(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Decrypt([]*ocipkcs11.Pkcs11KeyFileObject{key}, blob); err == nil {
+				t.Error("expected decryption with a wrong PIN to fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if mod.logins != 1 {
+		t.Fatalf("tried the wrong PIN %d times, expected once", mod.logins)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy implements an authorization policy on the encryption of images.
+//
+// A policy file holds rules that apply to the images whose name or digest
+// matches, and optionally hooks that are run with a JSON description of the image on stdin,
+// for example to evaluate a rego policy with opa:
+//
+//	rules:
+//	  - match: registry.example.com/*
+//	    require-encryption: true
+//	    required-recipients: ["CN=prod"]
+//	    allowed-schemes: [pkcs7, pkcs11]
+//	  - match: docker.io/*
+//	    deny: true
+//	  - match: sha256:4b1f5e9a0c3f3c6f5d1e2a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c4d5e6f70819
+//	    deny: true
+//	  - match: "*"
+//	    namespaces: [k8s.io]
+//	    require-encryption: true
+//	hooks:
+//	  - command: [opa, eval, --fail-defined, -d, /etc/imgcrypt/policy.rego, -I, data.imgcrypt.deny[x]]
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference/docker"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule holds requirements for the images whose name or digest matches
+type Rule struct {
+	// Match is an image name, a prefix of image names followed by '*', or the
+	// digest of the manifest or index of an image; "*" matches all images.
+	// Names are normalized like docker references, so that "alpine:3" matches
+	// docker.io/library/alpine:3. Any name can be given to an image, while a
+	// digest always matches the same content.
+	Match string `yaml:"match" json:"match"`
+	// Namespaces restricts the rule to images in the given containerd namespaces
+	Namespaces []string `yaml:"namespaces,omitempty" json:"namespaces,omitempty"`
+	// Deny forbids the use of the matching images
+	Deny bool `yaml:"deny,omitempty" json:"deny,omitempty"`
+	// RequireEncryption denies the use of images with plaintext layers; layers that
+	// are not distributable are exempt
+	RequireEncryption bool `yaml:"require-encryption,omitempty" json:"require-encryption,omitempty"`
+	// RequiredRecipients must be recipients of every encrypted layer
+	RequiredRecipients []string `yaml:"required-recipients,omitempty" json:"required-recipients,omitempty"`
+	// AllowedSchemes restricts the key wrapping schemes of encrypted layers
+	AllowedSchemes []string `yaml:"allowed-schemes,omitempty" json:"allowed-schemes,omitempty"`
+}
+
+// Hook is an external program deciding on the use of an image. It is passed the
+// name and layers of the image as JSON on stdin and denies its use by exiting
+// with a non-zero status.
+type Hook struct {
+	Command []string `yaml:"command" json:"command"`
+}
+
+// Policy is a set of rules and hooks that all must allow the use of an image
+type Policy struct {
+	Rules []Rule `yaml:"rules,omitempty" json:"rules,omitempty"`
+	Hooks []Hook `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+}
+
+var _ imgenc.AuthorizationPolicy = &Policy{}
+
+// Load reads a policy file in YAML or JSON format
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not parse policy %s: %w", path, err)
+	}
+	for _, h := range p.Hooks {
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("policy %s has a hook without command", path)
+		}
+	}
+	return &p, nil
+}
+
+// Matches returns true if the rule applies to the image with the given
+// reference, as returned by imgenc.ImageReference, in the given namespace
+func (r *Rule) Matches(namespace, ref string) bool {
+	if len(r.Namespaces) > 0 && !contains(r.Namespaces, namespace) {
+		return false
+	}
+	name, dgst := splitReference(ref)
+	if d, err := digest.Parse(r.Match); err == nil {
+		return d == dgst
+	}
+	if strings.HasSuffix(r.Match, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(r.Match, "*"))
+	}
+	return name == normalize(r.Match)
+}
+
+// splitReference returns the normalized name of the reference and the digest
+// it is pinned to
+func splitReference(ref string) (string, digest.Digest) {
+	name, d, ok := strings.Cut(ref, "@")
+	if !ok {
+		return normalize(name), ""
+	}
+	dgst, err := digest.Parse(d)
+	if err != nil {
+		return normalize(ref), ""
+	}
+	return normalize(name), dgst
+}
+
+// normalize returns the fully qualified form of the image name
+func normalize(name string) string {
+	named, err := docker.ParseNormalizedNamed(name)
+	if err != nil {
+		return name
+	}
+	return named.String()
+}
+
+// Check returns an error describing the first requirement of the rule the layers violate
+func (r *Rule) Check(layers []imgenc.LayerInfo) error {
+	if r.Deny {
+		return errors.New("use of the image is denied by policy")
+	}
+	for _, l := range layers {
+		if err := r.checkLayer(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLayer checks the encryption of a single layer
+func (r *Rule) checkLayer(l imgenc.LayerInfo) error {
+	if r.Deny {
+		return errors.New("use of the image is denied by policy")
+	}
+	if len(l.Encryption) == 0 {
+		if r.RequireEncryption && !images.IsNonDistributable(l.MediaType) {
+			if l.Digest == "" {
+				// a stream processor is not told the digest of the layer
+				return fmt.Errorf("%s layer is not encrypted", l.MediaType)
+			}
+			return fmt.Errorf("layer %s is not encrypted", l.Digest)
+		}
+		return nil
+	}
+	if len(r.AllowedSchemes) > 0 {
+		for _, s := range l.Schemes() {
+			if !contains(r.AllowedSchemes, s) {
+				return fmt.Errorf("layer %s uses key wrapping scheme %s, which is not allowed", l.Digest, s)
+			}
+		}
+	}
+	recipients := l.Recipients()
+	for _, rr := range r.RequiredRecipients {
+		if !contains(recipients, rr) {
+			return fmt.Errorf("layer %s is not encrypted for required recipient %s", l.Digest, rr)
+		}
+	}
+	return nil
+}
+
+// Authorize checks the image with the given reference against all matching
+// rules and all hooks
+func (p *Policy) Authorize(ctx context.Context, name string, layers []imgenc.LayerInfo) error {
+	namespace, _ := namespaces.Namespace(ctx)
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.Matches(namespace, name) {
+			continue
+		}
+		if err := r.Check(layers); err != nil {
+			return fmt.Errorf("rule for %s: %w", r.Match, err)
+		}
+	}
+	for _, h := range p.Hooks {
+		if err := h.Run(ctx, name, layers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyOpt returns an option for the applier of the layers of the image with the given
+// reference, as returned by imgenc.ImageReference, that checks every layer against the matching rules before it is unpacked.
+// This enforces the rules, such as the denial of plaintext layers, also where the
+// image is unpacked without creating a container. Hooks are not run.
+func (p *Policy) ApplyOpt(name string) diff.ApplyOpt {
+	return func(ctx context.Context, desc ocispec.Descriptor, _ *diff.ApplyConfig) error {
+		namespace, _ := namespaces.Namespace(ctx)
+		li, err := imgenc.GetLayerInfo(0, desc, nil)
+		if err != nil {
+			return err
+		}
+		return p.CheckLayer(namespace, name, li)
+	}
+}
+
+// CheckLayer checks a single layer of the image with the given reference in
+// the given namespace against the matching rules; hooks are not run. Without
+// a reference, as in a stream processor that is not told which image a layer
+// belongs to, only the rules matching all images apply.
+func (p *Policy) CheckLayer(namespace, ref string, li imgenc.LayerInfo) error {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.Matches(namespace, ref) {
+			continue
+		}
+		if err := r.checkLayer(li); err != nil {
+			return fmt.Errorf("%w: rule for %s: %w", imgenc.ErrNotAuthorized, r.Match, err)
+		}
+	}
+	return nil
+}
+
+// hookInput is passed to hooks on stdin
+type hookInput struct {
+	Name   string             `json:"name"`
+	Layers []imgenc.LayerInfo `json:"layers"`
+}
+
+// Run runs the hook for the given image and returns an error if it denies its use
+func (h *Hook) Run(ctx context.Context, name string, layers []imgenc.LayerInfo) error {
+	input, err := json.Marshal(hookInput{Name: name, Layers: layers})
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("policy hook %s: %s", h.Command[0], msg)
+		}
+		return fmt.Errorf("policy hook %s: %w", h.Command[0], err)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
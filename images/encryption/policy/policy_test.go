@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+)
+
+func TestAuthorize(t *testing.T) {
+	p := &Policy{
+		Rules: []Rule{
+			{Match: "registry.example.com/*", RequireEncryption: true, RequiredRecipients: []string{"prod"}},
+			{Match: "docker.io/library/bash:latest", Deny: true},
+			{Match: "*", Namespaces: []string{"secure"}, RequireEncryption: true},
+		},
+	}
+	plain := imgenc.LayerInfo{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}
+	encrypted := func(recipients ...string) imgenc.LayerInfo {
+		return imgenc.LayerInfo{
+			MediaType:  "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+			Encryption: []imgenc.WrapSchemeInfo{{Scheme: "pkcs7", Recipients: recipients}},
+		}
+	}
+
+	var testcases = []struct {
+		ns      string
+		name    string
+		layers  []imgenc.LayerInfo
+		allowed bool
+	}{
+		{name: "registry.example.com/app:1", layers: []imgenc.LayerInfo{encrypted("prod", "dev")}, allowed: true},
+		{name: "registry.example.com/app:1", layers: []imgenc.LayerInfo{encrypted("dev")}, allowed: false},
+		{name: "registry.example.com/app:1", layers: []imgenc.LayerInfo{plain}, allowed: false},
+		{name: "other.example.com/app:1", layers: []imgenc.LayerInfo{plain}, allowed: true},
+		{name: "docker.io/library/bash:latest", layers: []imgenc.LayerInfo{plain}, allowed: false},
+		{ns: "secure", name: "other.example.com/app:1", layers: []imgenc.LayerInfo{plain}, allowed: false},
+		{ns: "secure", name: "other.example.com/app:1", layers: []imgenc.LayerInfo{encrypted("dev")}, allowed: true},
+	}
+
+	for _, tc := range testcases {
+		ctx := context.Background()
+		if tc.ns != "" {
+			ctx = namespaces.WithNamespace(ctx, tc.ns)
+		}
+		err := p.Authorize(ctx, tc.name, tc.layers)
+		if (err == nil) != tc.allowed {
+			t.Fatalf("%s: expected allowed=%v, but got %v", tc.name, tc.allowed, err)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	const dgst = "sha256:4b1f5e9a0c3f3c6f5d1e2a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c4d5e6f70819"
+	var testcases = []struct {
+		match   string
+		ref     string
+		matches bool
+	}{
+		{match: "docker.io/library/bash:latest", ref: "bash:latest@" + dgst, matches: true},
+		{match: "bash:latest", ref: "docker.io/library/bash:latest@" + dgst, matches: true},
+		{match: "bash:latest", ref: "docker.io/library/bash:5@" + dgst, matches: false},
+		{match: "docker.io/*", ref: "alpine@" + dgst, matches: true},
+		{match: "registry.example.com/*", ref: "registry.example.com/app:1@" + dgst, matches: true},
+		// a digest matches the content under any name
+		{match: dgst, ref: "local/renamed:1@" + dgst, matches: true},
+		{match: dgst, ref: "docker.io/library/bash@" + dgst, matches: true},
+		{match: dgst, ref: "docker.io/library/bash:latest", matches: false},
+		{match: "sha256:0000000000000000000000000000000000000000000000000000000000000000", ref: "bash@" + dgst, matches: false},
+		{match: "*", ref: "", matches: true},
+	}
+	for _, tc := range testcases {
+		r := Rule{Match: tc.match}
+		if r.Matches("", tc.ref) != tc.matches {
+			t.Fatalf("expected rule %s to match %s: %v", tc.match, tc.ref, tc.matches)
+		}
+	}
+
+	p := &Policy{Rules: []Rule{{Match: dgst, Deny: true}}}
+	ref := imgenc.ImageReference("local/renamed:1", dgst)
+	if err := p.Authorize(context.Background(), ref, nil); err == nil {
+		t.Fatal("expected the denied digest to be denied under another name")
+	}
+}
+
+func TestCheckLayerWithoutReference(t *testing.T) {
+	p := &Policy{
+		Rules: []Rule{
+			{Match: "*", Namespaces: []string{"secure"}, RequireEncryption: true},
+			{Match: "docker.io/*", Deny: true},
+		},
+	}
+	plain := imgenc.LayerInfo{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}
+	err := p.CheckLayer("secure", "", plain)
+	if !errors.Is(err, imgenc.ErrNotAuthorized) || !strings.Contains(err.Error(), "application/vnd.oci.image.layer.v1.tar+gzip layer is not encrypted") {
+		t.Fatalf("expected the plaintext layer to be denied, got %v", err)
+	}
+	// only the rules for all images apply to a layer of an unknown image
+	if err := p.CheckLayer("other", "", plain); err != nil {
+		t.Fatalf("expected the plaintext layer to be allowed in another namespace, got %v", err)
+	}
+	nondistributable := imgenc.LayerInfo{MediaType: "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"}
+	if err := p.CheckLayer("secure", "", nondistributable); err != nil {
+		t.Fatalf("expected the non-distributable layer to be exempt, got %v", err)
+	}
+}
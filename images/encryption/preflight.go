@@ -0,0 +1,167 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt/images/encryption/attempts"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PreflightLayer reports how the key of an encrypted layer was unwrapped
+type PreflightLayer struct {
+	Digest   digest.Digest `json:"digest"`
+	Platform string        `json:"platform,omitempty"`
+	// Authorization is set for the layer whose key the authorization check
+	// unwraps, the first encrypted one
+	Authorization bool `json:"authorization,omitempty"`
+	// Scheme is the wrap scheme the key was unwrapped with
+	Scheme string `json:"scheme,omitempty"`
+	// KeyIDs are the IDs of the given private keys the layer key is wrapped
+	// for with the scheme, as recorded in the key metadata of the layer
+	KeyIDs []string `json:"keyIds,omitempty"`
+	// Duration is the time taken to unwrap the key with all schemes tried
+	Duration time.Duration      `json:"duration"`
+	Attempts []attempts.Attempt `json:"attempts"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// PreflightReport reports how the keys of the encrypted layers of an image
+// were unwrapped before the image is used
+type PreflightReport struct {
+	Layers   []PreflightLayer `json:"layers"`
+	Duration time.Duration    `json:"duration"`
+}
+
+// Err returns an *AuthorizationError if the key of a layer could not be
+// unwrapped
+func (r *PreflightReport) Err() error {
+	var (
+		failed []attempts.Layer
+		err    error
+	)
+	for _, l := range r.Layers {
+		if l.Error == "" {
+			continue
+		}
+		failed = append(failed, attempts.Layer{Digest: l.Digest, Attempts: l.Attempts})
+		if err == nil {
+			err = fmt.Errorf("layer %s: %s", l.Digest, l.Error)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	return &AuthorizationError{Layers: failed, Err: err}
+}
+
+// Preflight unwraps the keys of the encrypted layers of the image for the
+// platforms matched by platform, or of all platforms if it is nil, with dc
+// as the decoder does when the image is unpacked, and reports with which
+// scheme and key each was unwrapped and how long it took, so that operators
+// can confirm that the intended keys are used rather than a fallback. The
+// layer data is not accessed. Failures to unwrap layer keys are reported in
+// the layers rather than returned.
+func Preflight(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, platform platforms.Matcher, dc *encconfig.DecryptConfig) (*PreflightReport, error) {
+	start := time.Now()
+	descs, err := EncryptedLayers(ctx, cs, desc, platform)
+	if err != nil {
+		return nil, err
+	}
+	cc := encconfig.InitDecryption(dc.Parameters)
+	keyIDs := privateKeyIDs(cc.DecryptConfig)
+	report := &PreflightReport{Layers: []PreflightLayer{}}
+	for i, desc := range descs {
+		rec, unbind := attempts.Bind(cc.DecryptConfig)
+		layerStart := time.Now()
+		desc, err := ExpandKeys(ctx, cs, desc)
+		if err == nil {
+			_, _, _, err = DecryptLayer(cc.DecryptConfig, nil, desc, true)
+		}
+		l := PreflightLayer{
+			Digest:        desc.Digest,
+			Authorization: i == 0,
+			Duration:      time.Since(layerStart),
+			Attempts:      []attempts.Attempt{},
+		}
+		unbind()
+		if desc.Platform != nil {
+			l.Platform = platforms.Format(*desc.Platform)
+		}
+		for _, rl := range rec.Layers() {
+			l.Attempts = append(l.Attempts, rl.Attempts...)
+		}
+		if err != nil {
+			l.Error = err.Error()
+		}
+		for _, a := range l.Attempts {
+			if a.Reason == attempts.ReasonUnwrapped {
+				l.Scheme = a.Scheme
+			}
+		}
+		if l.Scheme != "" {
+			if md, err := keymeta.Read(desc); err == nil {
+				for _, k := range md.Keys {
+					if k.Scheme == l.Scheme && keyIDs[k.KeyID] {
+						l.KeyIDs = append(l.KeyIDs, k.KeyID)
+					}
+				}
+				sort.Strings(l.KeyIDs)
+			}
+		}
+		report.Layers = append(report.Layers, l)
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// privateKeyIDs returns the key IDs of the private keys in dc that can be
+// parsed with their passwords
+func privateKeyIDs(dc *encconfig.DecryptConfig) map[string]bool {
+	ids := make(map[string]bool)
+	privKeys := dc.Parameters["privkeys"]
+	passwords := dc.Parameters["privkeys-passwords"]
+	for i, privKey := range privKeys {
+		var password []byte
+		if i < len(passwords) {
+			password = passwords[i]
+		}
+		key, err := encutils.ParsePrivateKey(privKey, password, "private key")
+		if err != nil {
+			continue
+		}
+		signer, ok := key.(interface{ Public() crypto.PublicKey })
+		if !ok {
+			continue
+		}
+		if id, err := keymeta.KeyID(signer.Public()); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
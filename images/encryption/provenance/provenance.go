@@ -0,0 +1,413 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package provenance attaches attestations to encrypted images recording who
+// encrypted them, when, for which recipients and with which version of
+// imgcrypt, and verifies them.
+//
+// An attestation is an in-toto statement in a DSSE envelope, which is signed
+// if a key is given. It is stored as an OCI referrer of the encrypted image
+// with the artifact type of in-toto statements.
+package provenance
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/imgcrypt/images/crypt"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/keysidecar"
+	"github.com/containerd/imgcrypt/images/encryption/referrers"
+	"github.com/containerd/imgcrypt/images/encryption/signature"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// StatementType is the type of in-toto statements
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateType is the type of the predicate of the attestations
+	PredicateType = "https://github.com/containerd/imgcrypt/provenance/encryption/v1"
+	// PayloadType is the DSSE payload type of in-toto statements
+	PayloadType = "application/vnd.in-toto+json"
+	// ArtifactType is the artifact type of the referrer manifests holding
+	// attestations
+	ArtifactType = "application/vnd.in-toto+json"
+	// EnvelopeMediaType is the media type of the DSSE envelopes
+	EnvelopeMediaType = "application/vnd.dsse.envelope.v1+json"
+	// AnnotationPredicateType is the annotation of a referrer naming the type
+	// of the predicate of its statement
+	AnnotationPredicateType = "in-toto.io/predicate-type"
+)
+
+// ErrNoProvenance is returned if an image has no valid attestation
+var ErrNoProvenance = errors.New("image has no valid provenance attestation")
+
+// Subject is the image an attestation is about
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Tool is the tool that encrypted the image
+type Tool struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// Predicate records the encryption of an image
+type Predicate struct {
+	// Who encrypted the image, such as user@host or the ID of a build system
+	Encryptor string    `json:"encryptor"`
+	Encrypted time.Time `json:"encrypted"`
+	Tool      Tool      `json:"tool"`
+	// The sorted recipients, key IDs and wrap schemes across all encrypted
+	// layers
+	Recipients []string `json:"recipients"`
+	KeyIDs     []string `json:"keyIds,omitempty"`
+	Schemes    []string `json:"schemes"`
+	// The encrypted layers
+	Layers []digest.Digest `json:"layers"`
+}
+
+// Statement is an in-toto statement about the encryption of an image
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Envelope is a DSSE envelope
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     []byte      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+// Signature is a signature of a DSSE envelope
+type Signature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   []byte `json:"sig"`
+}
+
+// DefaultEncryptor returns user@host of the current process
+func DefaultEncryptor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+}
+
+// toolVersion returns the version of imgcrypt the running program was built with
+func toolVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if bi.Main.Path == "github.com/containerd/imgcrypt" {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == "github.com/containerd/imgcrypt" {
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// New returns the statement about the encryption of the image, whose
+// manifests are read from cs, by the encryptor.
+//
+// Deprecated: Use NewStatement, which also includes the recipients of wrapped
+// keys stored in a referrer of the image.
+func New(ctx context.Context, cs content.Provider, image images.Image, encryptor string) (Statement, error) {
+	pred, err := describe(ctx, cs, image.Target)
+	if err != nil {
+		return Statement{}, err
+	}
+	return newStatement(image, pred, encryptor)
+}
+
+// NewStatement returns the statement about the encryption of the image, whose
+// manifests are read from cs, by the encryptor; the recipients of wrapped keys
+// stored in a referrer of the image are included
+func NewStatement(ctx context.Context, is images.Store, cs content.Store, image images.Image, encryptor string) (Statement, error) {
+	pred, err := describeImage(ctx, is, cs, image)
+	if err != nil {
+		return Statement{}, err
+	}
+	return newStatement(image, pred, encryptor)
+}
+
+// newStatement returns the statement about the image with the predicate
+// describing its layers
+func newStatement(image images.Image, pred Predicate, encryptor string) (Statement, error) {
+	spec, err := reference.Parse(image.Name)
+	if err != nil {
+		return Statement{}, err
+	}
+	pred.Encryptor = encryptor
+	pred.Encrypted = time.Now().UTC().Truncate(time.Second)
+	pred.Tool = Tool{Name: "imgcrypt", Version: toolVersion()}
+	return Statement{
+		Type: StatementType,
+		Subject: []Subject{{
+			Name:   spec.Locator,
+			Digest: map[string]string{image.Target.Digest.Algorithm().String(): image.Target.Digest.Encoded()},
+		}},
+		PredicateType: PredicateType,
+		Predicate:     pred,
+	}, nil
+}
+
+// describeImage returns the predicate with the encryption of the layers of the
+// image with the wrapped keys stored in a referrer of the image, if any
+func describeImage(ctx context.Context, is images.Store, cs content.Store, image images.Image) (Predicate, error) {
+	desc, _, err := keysidecar.Resolve(ctx, is, cs, image)
+	if err != nil {
+		return Predicate{}, err
+	}
+	return describe(ctx, cs, desc)
+}
+
+// describe returns the predicate with the encryption of the layers of the image
+func describe(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (Predicate, error) {
+	all, err := crypt.ImageLayers(ctx, cs, desc)
+	if err != nil {
+		return Predicate{}, err
+	}
+	recipients, keyIDs, schemes := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	pred := Predicate{Layers: []digest.Digest{}}
+	for _, l := range crypt.SelectLayers(all, nil, nil) {
+		desc, err := imgenc.ExpandKeys(ctx, cs, l.Descriptor)
+		if err != nil {
+			return Predicate{}, err
+		}
+		li, err := imgenc.GetLayerInfo(l.Index, desc, nil)
+		if err != nil {
+			return Predicate{}, err
+		}
+		if len(li.Encryption) == 0 {
+			continue
+		}
+		pred.Layers = append(pred.Layers, li.Digest)
+		for _, r := range li.Recipients() {
+			recipients[r] = true
+		}
+		for _, id := range li.KeyIDs() {
+			keyIDs[id] = true
+		}
+		for _, s := range li.Schemes() {
+			schemes[s] = true
+		}
+	}
+	pred.Recipients, pred.KeyIDs, pred.Schemes = sortedKeys(recipients), sortedKeys(keyIDs), sortedKeys(schemes)
+	return pred, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pae returns the DSSE pre-authentication encoding of the payload
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// Seal puts the statement into a DSSE envelope signed with the signer, if any
+func Seal(st Statement, signer crypto.Signer) (Envelope, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env := Envelope{PayloadType: PayloadType, Payload: payload, Signatures: []Signature{}}
+	if signer != nil {
+		sig, err := signature.SignMessage(signer, pae(PayloadType, payload))
+		if err != nil {
+			return Envelope{}, err
+		}
+		env.Signatures = append(env.Signatures, Signature{Sig: sig})
+	}
+	return env, nil
+}
+
+// Open returns the statement of the envelope, whose signature must be made
+// with one of the keys if any are given
+func Open(env Envelope, keys []crypto.PublicKey) (Statement, error) {
+	if env.PayloadType != PayloadType {
+		return Statement{}, fmt.Errorf("unsupported payload type %q", env.PayloadType)
+	}
+	if len(keys) > 0 && !signedBy(env, keys) {
+		if len(env.Signatures) == 0 {
+			return Statement{}, errors.New("attestation is not signed")
+		}
+		return Statement{}, errors.New("attestation signature does not match any key")
+	}
+	var st Statement
+	if err := json.Unmarshal(env.Payload, &st); err != nil {
+		return Statement{}, fmt.Errorf("invalid statement: %w", err)
+	}
+	if st.Type != StatementType || st.PredicateType != PredicateType {
+		return Statement{}, fmt.Errorf("unsupported statement %s with predicate %s", st.Type, st.PredicateType)
+	}
+	return st, nil
+}
+
+func signedBy(env Envelope, keys []crypto.PublicKey) bool {
+	msg := pae(env.PayloadType, env.Payload)
+	for _, sig := range env.Signatures {
+		for _, key := range keys {
+			if signature.VerifyMessage(key, msg, sig.Sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReferrersTag returns the name of the index listing the referrers of the
+// image with the given name and digest.
+//
+// Deprecated: Use referrers.Tag.
+func ReferrersTag(name string, dgst digest.Digest) (string, error) {
+	return referrers.Tag(name, dgst)
+}
+
+// Attach stores the envelope as a referrer of the image and returns the
+// referrers index of the image
+func Attach(ctx context.Context, is images.Store, cs content.Store, image images.Image, env Envelope) (images.Image, error) {
+	p, err := json.Marshal(env)
+	if err != nil {
+		return images.Image{}, err
+	}
+	return referrers.Attach(ctx, is, cs, image, ArtifactType, EnvelopeMediaType, p, map[string]string{AnnotationPredicateType: PredicateType})
+}
+
+// Attestations returns the envelopes of the attestations of the image listed
+// by its referrers index in the image store
+func Attestations(ctx context.Context, is images.Store, cs content.Store, image images.Image) ([]Envelope, error) {
+	artifacts, err := referrers.List(ctx, is, cs, image, ArtifactType, EnvelopeMediaType)
+	if err != nil {
+		return nil, err
+	}
+	var envs []Envelope
+	for _, a := range artifacts {
+		if a.Descriptor.Annotations[AnnotationPredicateType] != PredicateType {
+			continue
+		}
+		var env Envelope
+		if err := json.Unmarshal(a.Data, &env); err != nil {
+			return nil, fmt.Errorf("invalid attestation %s: %w", a.Descriptor.Digest, err)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// Verify returns the statement of the latest attestation of the image that is
+// signed with one of the keys, if any are given, whose subject is the image
+// and whose recipients are those of the encrypted layers of the image, so that
+// rewrapping the layer keys without a new attestation is detected
+func Verify(ctx context.Context, is images.Store, cs content.Store, image images.Image, keys []crypto.PublicKey) (Statement, error) {
+	envs, err := Attestations(ctx, is, cs, image)
+	if err != nil {
+		return Statement{}, err
+	}
+	current, err := describeImage(ctx, is, cs, image)
+	if err != nil {
+		return Statement{}, err
+	}
+	var (
+		problems []string
+		found    *Statement
+	)
+	for _, env := range envs {
+		st, err := Open(env, keys)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if err := checkStatement(st, image.Target.Digest, current); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if found == nil || st.Predicate.Encrypted.After(found.Predicate.Encrypted) {
+			st := st
+			found = &st
+		}
+	}
+	if found != nil {
+		return *found, nil
+	}
+	if len(problems) == 0 {
+		return Statement{}, fmt.Errorf("%w: %s has no attestation", ErrNoProvenance, image.Target.Digest)
+	}
+	return Statement{}, fmt.Errorf("%w: %s", ErrNoProvenance, strings.Join(problems, "; "))
+}
+
+// checkStatement checks that the statement is about the image with the given
+// digest and the current encryption of its layers
+func checkStatement(st Statement, dgst digest.Digest, current Predicate) error {
+	subject := false
+	for _, s := range st.Subject {
+		subject = subject || s.Digest[dgst.Algorithm().String()] == dgst.Encoded()
+	}
+	if !subject {
+		return fmt.Errorf("attestation is not about %s", dgst)
+	}
+	if !equal(st.Predicate.Recipients, current.Recipients) {
+		return fmt.Errorf("attestation records recipients %s, but the image is encrypted for %s", strings.Join(st.Predicate.Recipients, ", "), strings.Join(current.Recipients, ", "))
+	}
+	if !equal(st.Predicate.KeyIDs, current.KeyIDs) {
+		return errors.New("attestation records other key IDs than those the image is encrypted for")
+	}
+	return nil
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provenance
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/images/encryption/referrers"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// encryptedImage writes an image with a single layer encrypted for a new
+// key to a new store
+func encryptedImage(t *testing.T) (content.Store, images.Image) {
+	t.Helper()
+	layout, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := layout.Store()
+	config := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageLayer, []byte("layer data"))
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, cs, ocispec.MediaTypeImageManifest, mb)
+
+	ecc, _ := testutil.CryptoConfigs(t)
+	target, _, err := imgenc.EncryptImage(context.Background(), cs, manifest, &ecc, func(ocispec.Descriptor) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, images.Image{Name: "registry.example.com/app:1", Target: target}
+}
+
+func TestAttestation(t *testing.T) {
+	ctx := context.Background()
+	cs, image := encryptedImage(t)
+	is := testutil.ImageStore{image.Name: image}
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Verify(ctx, is, cs, image, nil); !errors.Is(err, ErrNoProvenance) {
+		t.Fatalf("expected an image without attestation to fail, got %v", err)
+	}
+
+	st, err := NewStatement(ctx, is, cs, image, "alice@build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Subject[0].Name != "registry.example.com/app" || st.Subject[0].Digest["sha256"] != image.Target.Digest.Encoded() {
+		t.Fatalf("unexpected subject %+v", st.Subject)
+	}
+	if len(st.Predicate.Layers) != 1 || len(st.Predicate.Recipients) != 1 || strings.Join(st.Predicate.Schemes, ",") != "jwe" || st.Predicate.Tool.Name != "imgcrypt" {
+		t.Fatalf("unexpected predicate %+v", st.Predicate)
+	}
+	env, err := Seal(st, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := Attach(ctx, is, cs, image, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := referrers.Tag(image.Name, image.Target.Digest); index.Name != want || index.Target.MediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("expected the referrers index %s, got %+v", want, index)
+	}
+
+	verified, err := Verify(ctx, is, cs, image, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Predicate.Encryptor != "alice@build" {
+		t.Fatalf("expected the attestation by alice@build, got %+v", verified.Predicate)
+	}
+	if _, err := Verify(ctx, is, cs, image, []crypto.PublicKey{&signer.PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(ctx, is, cs, image, []crypto.PublicKey{&other.PublicKey}); !errors.Is(err, ErrNoProvenance) {
+		t.Fatalf("expected an attestation signed with another key to fail, got %v", err)
+	}
+
+	// an attestation with other recipients than those of the image fails
+	st.Predicate.Recipients = []string{"someone else"}
+	if env, err = Seal(st, nil); err != nil {
+		t.Fatal(err)
+	}
+	is = testutil.ImageStore{image.Name: image}
+	if _, err := Attach(ctx, is, cs, image, env); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(ctx, is, cs, image, nil); err == nil || !strings.Contains(err.Error(), "records recipients") {
+		t.Fatalf("expected an attestation with other recipients to fail, got %v", err)
+	}
+}
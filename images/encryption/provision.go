@@ -0,0 +1,177 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/imgcrypt/images/encryption/audit"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProvisionLayerKey returns the annotations with the layer key of the
+// encrypted layer wrapped for the recipients of cc alone, and with their key
+// metadata; the layer key is unwrapped with the keys of cc's DecryptConfig.
+// The layer data is not read, so that keys for new recipients, such as the
+// nodes of a new fleet, can be wrapped with the manifest and key blobs of an
+// image alone and added to its layers later with AddLayerKeys.
+func ProvisionLayerKey(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, cc *encconfig.CryptoConfig) (_ map[string]string, err error) {
+	if !IsEncryptedDiff(ctx, desc.MediaType) {
+		return nil, fmt.Errorf("layer %s is not encrypted", desc.Digest)
+	}
+	ctx, span := tracing.Start(ctx, "imgcrypt.ProvisionLayerKey", layerAttributes(desc)...)
+	defer func() { tracing.End(span, err) }()
+	if cc.EncryptConfig == nil || cc.DecryptConfig == nil {
+		return nil, fmt.Errorf("provisioning the key of layer %s needs recipients and a key to unwrap it", desc.Digest)
+	}
+	defer tracing.Bind(ctx, cc.EncryptConfig)()
+	defer tracing.Bind(ctx, cc.DecryptConfig)()
+
+	if desc, err = ExpandKeys(ctx, cs, desc); err != nil {
+		return nil, err
+	}
+	// the layer is already encrypted, so its data is not read
+	_, _, finalizer, err := encryptLayer(cc, nil, desc)
+	if err != nil {
+		auditLayer(ctx, audit.OpWrap, desc, err)
+		return nil, err
+	}
+	annotations, err := finalizer()
+	if err != nil {
+		return nil, fmt.Errorf("error getting annotations from encLayer finalizer: %w", err)
+	}
+
+	provisioned := ocispec.Descriptor{
+		MediaType:   desc.MediaType,
+		Digest:      desc.Digest,
+		Size:        desc.Size,
+		Annotations: make(map[string]string),
+	}
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, keysAnnotationPrefix) {
+			provisioned.Annotations[k] = v
+			continue
+		}
+		// the keys of the new recipients are appended to the existing ones
+		if added := newEntries(desc.Annotations[k], v); added != "" {
+			provisioned.Annotations[k] = added
+		}
+	}
+	if !hasWrappedKeys(provisioned) {
+		return nil, fmt.Errorf("no wrapped keys produced for layer %s", desc.Digest)
+	}
+	md, err := keymeta.New(provisioned, cc.EncryptConfig, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if prev, err := keymeta.Read(desc); err == nil && md.Context == nil {
+		md.Context = prev.Context
+	}
+	if err := keymeta.Annotate(&provisioned, md); err != nil {
+		return nil, err
+	}
+	auditLayer(ctx, audit.OpWrap, provisioned, nil)
+
+	keys := make(map[string]string)
+	for k, v := range provisioned.Annotations {
+		if strings.HasPrefix(k, keysAnnotationPrefix) || k == keymeta.Annotation {
+			keys[k] = v
+		}
+	}
+	return keys, nil
+}
+
+// newEntries returns the comma separated wrapped keys of updated that are not
+// in orig
+func newEntries(orig, updated string) string {
+	existing := make(map[string]bool)
+	for _, e := range strings.Split(orig, ",") {
+		existing[e] = true
+	}
+	var added []string
+	for _, e := range strings.Split(updated, ",") {
+		if e != "" && !existing[e] {
+			added = append(added, e)
+		}
+	}
+	return strings.Join(added, ",")
+}
+
+// AddWrappedKeys returns the annotations of an encrypted layer with the
+// wrapped keys and key metadata in keys added to those it has; keys were
+// wrapped for additional recipients with the same layer key, as done by
+// ProvisionLayerKey. Wrapped keys the layer already has are not added again.
+func AddWrappedKeys(annotations, keys map[string]string) (map[string]string, error) {
+	a := make(map[string]string, len(annotations)+len(keys))
+	for k, v := range annotations {
+		a[k] = v
+	}
+	added := false
+	for k, v := range keys {
+		if !strings.HasPrefix(k, keysAnnotationPrefix) {
+			continue
+		}
+		if e := newEntries(a[k], v); e != "" {
+			if a[k] != "" {
+				e = a[k] + "," + e
+			}
+			a[k] = e
+			added = true
+		}
+	}
+	if !added {
+		return a, nil
+	}
+	md, err := keymeta.Read(ocispec.Descriptor{Annotations: annotations})
+	if err != nil {
+		return nil, err
+	}
+	other, err := keymeta.Read(ocispec.Descriptor{Annotations: keys})
+	if err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{Annotations: a}
+	if err := keymeta.Annotate(&desc, keymeta.Append(md, other)); err != nil {
+		return nil, err
+	}
+	return desc.Annotations, nil
+}
+
+// AddLayerKeys returns the descriptor of the encrypted layer with the wrapped
+// keys and key metadata in keys added as by AddWrappedKeys; the wrapped keys
+// of the layer are read from its key blob, if it has one, and are stored in a
+// new key blob written to cs if they grow too large
+func AddLayerKeys(ctx context.Context, cs content.Store, desc ocispec.Descriptor, keys map[string]string) (ocispec.Descriptor, error) {
+	if !IsEncryptedDiff(ctx, desc.MediaType) {
+		return ocispec.Descriptor{}, fmt.Errorf("layer %s is not encrypted", desc.Digest)
+	}
+	desc, err := ExpandKeys(ctx, cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if desc.Annotations, err = AddWrappedKeys(desc.Annotations, keys); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("layer %s: %w", desc.Digest, err)
+	}
+	return spillKeys(ctx, cs, desc)
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package recipientgroups expands named groups of recipients, given as
+// group:<name> wherever a recipient is accepted, into their members. Members
+// are recipients of any wrap scheme or other groups, for example:
+//
+//	groups:
+//	  platform-team:
+//	    - jwe:/etc/imgcrypt/alice-pub.pem
+//	    - pgp:bob@example.com
+//	    - provider:vault:transit/platform
+//	  release:
+//	    - group:platform-team
+//	    - pkcs7:/etc/imgcrypt/release.crt
+package recipientgroups
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix starts recipients that name a group
+const Prefix = "group:"
+
+// Groups maps the names of groups to their members
+type Groups map[string][]string
+
+// IsGroup returns whether the recipient names a group
+func IsGroup(recipient string) bool {
+	return strings.HasPrefix(recipient, Prefix)
+}
+
+// Expand returns the recipients with the groups among them replaced by their
+// members, recursively, keeping the order and dropping duplicates, and the
+// recipients each of the groups used expanded to
+func (g Groups) Expand(recipients []string) ([]string, map[string][]string, error) {
+	var (
+		expanded []string
+		seen     = make(map[string]bool)
+		members  = make(map[string][]string)
+	)
+	for _, r := range recipients {
+		rs, err := g.expand(r, members, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				expanded = append(expanded, r)
+			}
+		}
+	}
+	if len(members) == 0 {
+		members = nil
+	}
+	return expanded, members, nil
+}
+
+// expand returns the recipients recipient expands to and adds the members of
+// the groups expanded to members; path holds the groups being expanded
+func (g Groups) expand(recipient string, members map[string][]string, path []string) ([]string, error) {
+	if !IsGroup(recipient) {
+		return []string{recipient}, nil
+	}
+	name := strings.TrimPrefix(recipient, Prefix)
+	for i, p := range path {
+		if p == name {
+			return nil, fmt.Errorf("recipient group %s includes itself: %s", name, strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	if ms, ok := members[name]; ok {
+		return ms, nil
+	}
+	def, ok := g[name]
+	if !ok {
+		return nil, fmt.Errorf("recipient group %q is not defined", name)
+	}
+	if len(def) == 0 {
+		return nil, fmt.Errorf("recipient group %q has no members", name)
+	}
+	var (
+		ms   []string
+		seen = make(map[string]bool)
+	)
+	for _, m := range def {
+		rs, err := g.expand(m, members, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				ms = append(ms, r)
+			}
+		}
+	}
+	members[name] = ms
+	return ms, nil
+}
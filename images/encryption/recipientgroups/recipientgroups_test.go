@@ -0,0 +1,66 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recipientgroups
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	g := Groups{
+		"platform": {"jwe:alice.pem", "pgp:bob@example.com"},
+		"release":  {"group:platform", "pkcs7:release.crt", "jwe:alice.pem"},
+	}
+	recipients, members, err := g.Expand([]string{"jwe:carol.pem", "group:release", "pgp:bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"jwe:carol.pem", "jwe:alice.pem", "pgp:bob@example.com", "pkcs7:release.crt"}; !reflect.DeepEqual(recipients, expected) {
+		t.Fatalf("expected %v, got %v", expected, recipients)
+	}
+	expected := map[string][]string{
+		"platform": {"jwe:alice.pem", "pgp:bob@example.com"},
+		"release":  {"jwe:alice.pem", "pgp:bob@example.com", "pkcs7:release.crt"},
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("expected %v, got %v", expected, members)
+	}
+
+	recipients, members, err = Groups(nil).Expand([]string{"jwe:carol.pem"})
+	if err != nil || len(recipients) != 1 || members != nil {
+		t.Fatalf("got %v, %v, %v", recipients, members, err)
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	g := Groups{
+		"a":     {"group:b"},
+		"b":     {"jwe:key.pem", "group:a"},
+		"empty": {},
+	}
+	for recipient, msg := range map[string]string{
+		"group:a":       "includes itself: a -> b -> a",
+		"group:missing": "not defined",
+		"group:empty":   "no members",
+	} {
+		if _, _, err := g.Expand([]string{recipient}); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("%s: expected an error containing %q, got %v", recipient, msg, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"sort"
+)
+
+// RecipientDiff describes how the recipients of a layer differ between two images
+type RecipientDiff struct {
+	Index    uint32   `json:"index" yaml:"index"`
+	Platform string   `json:"platform,omitempty" yaml:"platform,omitempty"`
+	Added    []string `json:"added,omitempty" yaml:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty" yaml:"removed,omitempty"`
+}
+
+// ImageRecipients returns the sorted set of recipients across all the given layers
+func ImageRecipients(layers []LayerInfo) []string {
+	set := map[string]struct{}{}
+	for _, li := range layers {
+		for _, r := range li.Recipients() {
+			set[r] = struct{}{}
+		}
+	}
+	return sortedKeys(set)
+}
+
+// DiffRecipients compares the recipients of the layers of two images. Layers are
+// matched by platform and index since re-encryption changes the layer digests.
+// Only layers whose recipients differ are returned; a layer that exists in only
+// one of the images has all its recipients added or removed.
+func DiffRecipients(from, to []LayerInfo) []RecipientDiff {
+	type layerKey struct {
+		platform string
+		index    uint32
+	}
+	fromSets := map[layerKey]map[string]struct{}{}
+	toSets := map[layerKey]map[string]struct{}{}
+	var keys []layerKey
+	for _, l := range []struct {
+		layers []LayerInfo
+		sets   map[layerKey]map[string]struct{}
+	}{{from, fromSets}, {to, toSets}} {
+		for _, li := range l.layers {
+			k := layerKey{platform: li.Platform, index: li.Index}
+			if _, ok := fromSets[k]; !ok {
+				if _, ok := toSets[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			set := l.sets[k]
+			if set == nil {
+				set = map[string]struct{}{}
+				l.sets[k] = set
+			}
+			for _, r := range li.Recipients() {
+				set[r] = struct{}{}
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].platform != keys[j].platform {
+			return keys[i].platform < keys[j].platform
+		}
+		return keys[i].index < keys[j].index
+	})
+
+	var diffs []RecipientDiff
+	for _, k := range keys {
+		d := RecipientDiff{
+			Index:    k.index,
+			Platform: k.platform,
+			Added:    setDifference(toSets[k], fromSets[k]),
+			Removed:  setDifference(fromSets[k], toSets[k]),
+		}
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// setDifference returns the sorted elements of a that are not in b
+func setDifference(a, b map[string]struct{}) []string {
+	diff := map[string]struct{}{}
+	for e := range a {
+		if _, ok := b[e]; !ok {
+			diff[e] = struct{}{}
+		}
+	}
+	return sortedKeys(diff)
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
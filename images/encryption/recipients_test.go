@@ -0,0 +1,46 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRecipients(t *testing.T) {
+	layer := func(index uint32, recipients ...string) LayerInfo {
+		return LayerInfo{
+			Index:      index,
+			Platform:   "linux/amd64",
+			Encryption: []WrapSchemeInfo{{Scheme: "pgp", Recipients: recipients}},
+		}
+	}
+	from := []LayerInfo{layer(0, "alice", "bob"), layer(1, "alice")}
+	to := []LayerInfo{layer(0, "alice", "carol"), layer(1, "alice"), layer(2, "carol")}
+
+	expected := []RecipientDiff{
+		{Index: 0, Platform: "linux/amd64", Added: []string{"carol"}, Removed: []string{"bob"}},
+		{Index: 2, Platform: "linux/amd64", Added: []string{"carol"}},
+	}
+	if actual := DiffRecipients(from, to); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+
+	if actual := ImageRecipients(to); !reflect.DeepEqual(actual, []string{"alice", "carol"}) {
+		t.Fatalf("unexpected recipients %v", actual)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package referrers stores artifacts about images, such as attestations and
+// wrapped keys, as OCI referrers: manifests whose subject is the image and
+// that have an artifact type.
+//
+// Since containerd has no referrers API, the referrers of an image are listed
+// by the index tagged with the digest of the image, such as
+// <name>:sha256-<hex>, following the referrers tag schema of the OCI
+// distribution specification. Pushing that tag also works with registries
+// that do not support the referrers API, while those that do find the
+// referrers by their subject. Fetch queries the referrers API of a registry
+// and stores the result under that tag, so that the tag only needs to be
+// pulled from registries without the API.
+package referrers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/imgcrypt/internal/contentutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Artifact is a referrer of an image holding a single blob
+type Artifact struct {
+	// The descriptor of the referrer manifest in the referrers index
+	Descriptor ocispec.Descriptor
+	// When the artifact was attached, if known
+	Created time.Time
+	Data    []byte
+}
+
+// Tag returns the name of the index listing the referrers of the image with
+// the given name and digest
+func Tag(name string, dgst digest.Digest) (string, error) {
+	spec, err := reference.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s-%s", spec.Locator, dgst.Algorithm(), dgst.Encoded()), nil
+}
+
+// manifest is an image manifest of an artifact
+type manifest struct {
+	ocispec.Manifest
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// emptyJSON is the config of artifacts without configuration
+var emptyJSON = []byte("{}")
+
+// Attach stores data with the media type as an artifact of the artifact type
+// referring to the image, with the annotations and the time it was created,
+// and adds it to the referrers index of the image, which is created if needed
+// and returned
+func Attach(ctx context.Context, is images.Store, cs content.Store, image images.Image, artifactType, mediaType string, data []byte, annotations map[string]string) (images.Image, error) {
+	tag, err := Tag(image.Name, image.Target.Digest)
+	if err != nil {
+		return images.Image{}, err
+	}
+	layer, err := contentutil.WriteBlob(ctx, cs, mediaType, data, nil)
+	if err != nil {
+		return images.Image{}, err
+	}
+	config, err := contentutil.WriteBlob(ctx, cs, artifactType, emptyJSON, nil)
+	if err != nil {
+		return images.Image{}, err
+	}
+	a := map[string]string{ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339)}
+	for k, v := range annotations {
+		a[k] = v
+	}
+	subject := ocispec.Descriptor{MediaType: image.Target.MediaType, Digest: image.Target.Digest, Size: image.Target.Size}
+	p, err := json.Marshal(manifest{
+		Manifest: ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      config,
+			Layers:      []ocispec.Descriptor{layer},
+			Subject:     &subject,
+			Annotations: a,
+		},
+		ArtifactType: artifactType,
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	desc, err := contentutil.WriteBlob(ctx, cs, ocispec.MediaTypeImageManifest, p, map[string]string{
+		"containerd.io/gc.ref.content.config": config.Digest.String(),
+		"containerd.io/gc.ref.content.l.0":    layer.Digest.String(),
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	desc.ArtifactType = artifactType
+	desc.Annotations = a
+
+	// keep the referrers that were added before
+	var descs []ocispec.Descriptor
+	index, err := is.Get(ctx, tag)
+	if err == nil {
+		if p, err := content.ReadBlob(ctx, cs, index.Target); err == nil {
+			var idx ocispec.Index
+			if err := json.Unmarshal(p, &idx); err == nil {
+				descs = idx.Manifests
+			}
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return images.Image{}, err
+	}
+	descs = append(descs, desc)
+	return storeIndex(ctx, is, cs, tag, descs)
+}
+
+// storeIndex writes the referrers index listing the manifests and stores it
+// under the tag
+func storeIndex(ctx context.Context, is images.Store, cs content.Store, tag string, descs []ocispec.Descriptor) (images.Image, error) {
+	ip, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: descs,
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	labels := make(map[string]string)
+	for i, m := range descs {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+	}
+	indexDesc, err := contentutil.WriteBlob(ctx, cs, ocispec.MediaTypeImageIndex, ip, labels)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	index := images.Image{Name: tag, Target: indexDesc}
+	updated, err := is.Update(ctx, index, "target")
+	if errdefs.IsNotFound(err) {
+		return is.Create(ctx, index)
+	}
+	return updated, err
+}
+
+// List returns the artifacts of the artifact type referring to the image that
+// are listed by its referrers index in the image store, with their blob of the
+// media type, in the order they were added
+func List(ctx context.Context, is images.Store, cs content.Store, image images.Image, artifactType, mediaType string) ([]Artifact, error) {
+	tag, err := Tag(image.Name, image.Target.Digest)
+	if err != nil {
+		return nil, err
+	}
+	index, err := is.Get(ctx, tag)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p, err := content.ReadBlob(ctx, cs, index.Target)
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(p, &idx); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal referrers index %s: %w", tag, err)
+	}
+	var artifacts []Artifact
+	for _, desc := range idx.Manifests {
+		if desc.ArtifactType != artifactType {
+			continue
+		}
+		p, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		var m manifest
+		if err := json.Unmarshal(p, &m); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal referrer %s: %w", desc.Digest, err)
+		}
+		if m.Subject == nil || m.Subject.Digest != image.Target.Digest {
+			continue
+		}
+		for _, l := range m.Layers {
+			if l.MediaType != mediaType {
+				continue
+			}
+			data, err := content.ReadBlob(ctx, cs, l)
+			if err != nil {
+				return nil, err
+			}
+			a := Artifact{Descriptor: desc, Data: data}
+			a.Created, _ = time.Parse(time.RFC3339, m.Annotations[ocispec.AnnotationCreated])
+			artifacts = append(artifacts, a)
+			break
+		}
+	}
+	return artifacts, nil
+}
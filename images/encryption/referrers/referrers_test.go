@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package referrers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/contentutil"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestTag(t *testing.T) {
+	dgst := digest.FromString("image")
+	tag, err := Tag("registry.example.com/app:1", dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "registry.example.com/app:sha256-" + dgst.Encoded(); tag != want {
+		t.Fatalf("got %s, want %s", tag, want)
+	}
+}
+
+func TestAttachList(t *testing.T) {
+	ctx := context.Background()
+	layout, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := layout.Store()
+	target, err := contentutil.WriteBlob(ctx, cs, ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := images.Image{Name: "registry.example.com/app:1", Target: target}
+	is := testutil.ImageStore{image.Name: image}
+
+	if _, err := Attach(ctx, is, cs, image, "application/vnd.example.a", "application/json", []byte(`"first"`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, is, cs, image, "application/vnd.example.b", "application/json", []byte(`"other"`), nil); err != nil {
+		t.Fatal(err)
+	}
+	index, err := Attach(ctx, is, cs, image, "application/vnd.example.a", "application/json", []byte(`"second"`), map[string]string{"k": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _ := Tag(image.Name, target.Digest)
+	if index.Name != tag || is[tag].Target.Digest != index.Target.Digest {
+		t.Fatalf("referrers index %s not stored as %s", index.Name, tag)
+	}
+
+	artifacts, err := List(ctx, is, cs, image, "application/vnd.example.a", "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("got %d artifacts, want 2", len(artifacts))
+	}
+	if string(artifacts[0].Data) != `"first"` || string(artifacts[1].Data) != `"second"` {
+		t.Fatalf("artifacts not listed in the order they were added: %s, %s", artifacts[0].Data, artifacts[1].Data)
+	}
+	if artifacts[1].Descriptor.Annotations["k"] != "v" || artifacts[1].Created.IsZero() {
+		t.Fatalf("annotations of the artifact not kept: %v", artifacts[1].Descriptor.Annotations)
+	}
+
+	// another image has no referrers
+	other := images.Image{Name: "registry.example.com/app:2", Target: ocispec.Descriptor{Digest: digest.FromString("other")}}
+	if artifacts, err := List(ctx, is, cs, other, "application/vnd.example.a", "application/json"); err != nil || len(artifacts) != 0 {
+		t.Fatalf("got %d artifacts and error %v for an image without referrers", len(artifacts), err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	src, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcCS := src.Store()
+	target, err := contentutil.WriteBlob(ctx, srcCS, ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcIS := testutil.ImageStore{}
+	attached, err := Attach(ctx, srcIS, srcCS, images.Image{Name: "registry.example.com/app:1", Target: target}, "application/vnd.example.a", "application/json", []byte(`"keys"`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrersIndex, err := content.ReadBlob(ctx, srcCS, attached.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	supported := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !supported || r.URL.Path != "/v2/app/referrers/"+target.Digest.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Write(referrersIndex)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := func(string) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{Client: srv.Client(), Host: u.Host, Scheme: u.Scheme, Path: "/v2", Capabilities: docker.HostCapabilityPull}}, nil
+	}
+	fetcher := remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		p, err := content.ReadBlob(ctx, srcCS, desc)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(p)), nil
+	})
+
+	dst, err := ocilayout.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := dst.Store()
+	image := images.Image{Name: u.Host + "/app:1", Target: target}
+	is := testutil.ImageStore{}
+	if _, err := Fetch(ctx, hosts, fetcher, is, cs, image); err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := List(ctx, is, cs, image, "application/vnd.example.a", "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 1 || string(artifacts[0].Data) != `"keys"` {
+		t.Fatalf("expected the fetched referrer to be listed, got %d artifacts", len(artifacts))
+	}
+
+	// registries without the referrers API answer with 404 Not Found
+	supported = false
+	if _, err := Fetch(ctx, hosts, fetcher, testutil.ImageStore{}, cs, image); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected a not found error without the referrers API, got %v", err)
+	}
+}
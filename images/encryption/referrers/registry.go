@@ -0,0 +1,151 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package referrers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Fetch queries the referrers API of the registry of the image,
+// /v2/<name>/referrers/<digest>, fetches the referrers it lists with fetcher
+// and stores them in a referrers index under the tag of the image, which is
+// returned. The error satisfies errdefs.IsNotFound if the registry does not
+// support the referrers API, in which case the tag is to be pulled instead.
+func Fetch(ctx context.Context, hosts docker.RegistryHosts, fetcher remotes.Fetcher, is images.Store, cs content.Store, image images.Image) (images.Image, error) {
+	tag, err := Tag(image.Name, image.Target.Digest)
+	if err != nil {
+		return images.Image{}, err
+	}
+	spec, err := reference.Parse(image.Name)
+	if err != nil {
+		return images.Image{}, err
+	}
+	host := spec.Hostname()
+	hs, err := hosts(host)
+	if err != nil {
+		return images.Image{}, err
+	}
+	if len(hs) == 0 {
+		return images.Image{}, fmt.Errorf("no hosts configured for registry %s", host)
+	}
+	// mirrors come first, the registry itself last
+	h := hs[len(hs)-1]
+	repo := strings.TrimPrefix(spec.Locator, host+"/")
+	ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull", repo))
+
+	var descs []ocispec.Descriptor
+	u := fmt.Sprintf("%s://%s%s/%s/referrers/%s", h.Scheme, h.Host, h.Path, repo, image.Target.Digest)
+	for u != "" {
+		resp, err := get(ctx, h, u)
+		if err != nil {
+			return images.Image{}, err
+		}
+		var idx ocispec.Index
+		err = json.NewDecoder(resp.Body).Decode(&idx)
+		resp.Body.Close()
+		if err != nil {
+			return images.Image{}, fmt.Errorf("invalid response from %s: %w", u, err)
+		}
+		descs = append(descs, idx.Manifests...)
+		if u, err = nextPage(resp); err != nil {
+			return images.Image{}, err
+		}
+	}
+
+	handler := images.Handlers(remotes.FetchHandler(cs, fetcher), images.SetChildrenLabels(cs, images.ChildrenHandler(cs)))
+	if err := images.Dispatch(ctx, handler, nil, descs...); err != nil {
+		return images.Image{}, fmt.Errorf("failed to fetch referrers of %s: %w", image.Name, err)
+	}
+	return storeIndex(ctx, is, cs, tag, descs)
+}
+
+// nextPage returns the URL of the next page from the Link header, if any
+func nextPage(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start, end := strings.IndexByte(link, '<'), strings.IndexByte(link, '>')
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid Link header %q", link)
+	}
+	next, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return "", fmt.Errorf("invalid Link header %q: %w", link, err)
+	}
+	return resp.Request.URL.ResolveReference(next).String(), nil
+}
+
+// get requests the referrers index u from the registry host, authorizing the
+// request once the registry asked for it; registries without the referrers
+// API answer with 404 Not Found
+func get(ctx context.Context, h docker.RegistryHost, u string) (*http.Response, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for retried := false; ; retried = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range h.Header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		if h.Authorizer != nil {
+			if err := h.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && h.Authorizer != nil && !retried {
+			err := h.Authorizer.AddResponses(ctx, []*http.Response{resp})
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp, nil
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return nil, fmt.Errorf("no referrers API at %s: %w", h.Host, errdefs.ErrNotFound)
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status from GET %s: %s", u, resp.Status)
+		}
+	}
+}
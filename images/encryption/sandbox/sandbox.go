@@ -0,0 +1,43 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package sandbox restricts what the process decrypting a layer may do once
+// its configuration and keys are loaded, since it parses ciphertext and
+// annotations chosen by whoever built the image, typically as root.
+//
+// On Linux, a seccomp filter refuses the system calls that administer the
+// host, such as mount, ptrace, module loading or namespace changes, a Landlock
+// ruleset limits writes to the given paths and all capabilities are dropped.
+// Landlock needs Linux 5.13, and Landlock and the dropping of capabilities
+// need a program built without cgo, since they have to be applied to every
+// thread of the process; they are skipped where they cannot be applied.
+package sandbox
+
+// Config configures the sandbox
+type Config struct {
+	// Writable are the files and directories that may be written to, such
+	// as the directories for temporary files and logs; the parent directory
+	// of a file that does not exist yet is writable instead. All other files
+	// may only be read and executed, except /dev/null.
+	Writable []string
+}
+
+// Status tells which restrictions were applied
+type Status struct {
+	Seccomp      bool
+	Landlock     bool
+	Capabilities bool
+}
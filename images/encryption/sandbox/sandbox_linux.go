@@ -0,0 +1,249 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	// x32SyscallBit marks the system calls of the x32 ABI on amd64, which
+	// have numbers of their own
+	x32SyscallBit = 0x40000000
+
+	landlockAccessFSv1 = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	landlockAccessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	landlockAccessRead = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR
+)
+
+// deniedSyscalls are the system calls the seccomp filter refuses; decrypting
+// a layer, unwrapping its key and running keyproviders need none of them
+var deniedSyscalls = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV, unix.SYS_KCMP, unix.SYS_PIDFD_GETFD,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT, unix.SYS_MOUNT_SETATTR,
+	unix.SYS_FSOPEN, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT, unix.SYS_FSPICK, unix.SYS_MOVE_MOUNT, unix.SYS_OPEN_TREE,
+	unix.SYS_SETNS, unix.SYS_UNSHARE, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD, unix.SYS_FANOTIFY_INIT,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT, unix.SYS_QUOTACTL,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_ADJTIMEX, unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_SETHOSTNAME, unix.SYS_SETDOMAINNAME,
+}
+
+// auditArchs are the architectures of the system calls of the process
+var auditArchs = map[string]uint32{
+	"386":      unix.AUDIT_ARCH_I386,
+	"amd64":    unix.AUDIT_ARCH_X86_64,
+	"arm":      unix.AUDIT_ARCH_ARM,
+	"arm64":    unix.AUDIT_ARCH_AARCH64,
+	"mips64le": unix.AUDIT_ARCH_MIPSEL64,
+	"ppc64":    unix.AUDIT_ARCH_PPC64,
+	"ppc64le":  unix.AUDIT_ARCH_PPC64LE,
+	"riscv64":  unix.AUDIT_ARCH_RISCV64,
+	"s390x":    unix.AUDIT_ARCH_S390X,
+}
+
+// Apply restricts the process as configured. The restrictions cannot be
+// lifted again and are inherited by the programs the process runs, such as
+// keyprovider commands.
+func Apply(c Config) (Status, error) {
+	var status Status
+	ruleset, err := landlockRuleset(append([]string{"/dev/null"}, c.Writable...))
+	if err != nil {
+		return status, err
+	}
+	defer func() {
+		if ruleset >= 0 {
+			unix.Close(ruleset)
+		}
+	}()
+
+	status.Seccomp, err = applySeccomp()
+	if err != nil {
+		return status, err
+	}
+
+	// Landlock and capabilities only restrict the thread they are applied to
+	if ruleset >= 0 && !status.Seccomp {
+		// Landlock requires no_new_privs, which the seccomp filter did not set
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+			unix.Close(ruleset)
+			ruleset = -1
+		}
+	}
+	if ruleset >= 0 {
+		_, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0)
+		switch errno {
+		case 0:
+			status.Landlock = true
+		case syscall.ENOTSUP:
+		default:
+			return status, fmt.Errorf("could not apply Landlock ruleset: %w", errno)
+		}
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	switch errno {
+	case 0:
+		status.Capabilities = true
+	case syscall.ENOTSUP:
+	default:
+		return status, fmt.Errorf("could not drop capabilities: %w", errno)
+	}
+	return status, nil
+}
+
+// applySeccomp sets no_new_privs and installs the seccomp filter on all
+// threads of the process; it returns false if the architecture or the kernel
+// does not support seccomp filters
+func applySeccomp() (bool, error) {
+	arch, ok := auditArchs[runtime.GOARCH]
+	if !ok {
+		return false, nil
+	}
+	filter := seccompFilter(arch)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is set on the other threads when the filter is synchronized
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return false, fmt.Errorf("could not set no_new_privs: %w", err)
+	}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	switch {
+	case errno == unix.ENOSYS:
+		return false, nil
+	case errno != 0:
+		return false, fmt.Errorf("could not install seccomp filter: %w", errno)
+	case r != 0:
+		return false, fmt.Errorf("could not install seccomp filter on thread %d", r)
+	}
+	return true, nil
+}
+
+// seccompFilter returns the filter refusing the denied system calls with
+// EPERM, as well as all system calls of other architectures
+func seccompFilter(arch uint32) []unix.SockFilter {
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	n := 7 + len(deniedSyscalls)
+	// the index of the final instruction, which refuses the system call
+	last := n - 1
+	filter := make([]unix.SockFilter, 0, n)
+	jump := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: uint8(last - len(filter) - 1), K: k}
+	}
+	// offsetof(struct seccomp_data, arch)
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4})
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch})
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny})
+	// offsetof(struct seccomp_data, nr)
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0})
+	filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit))
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr)))
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+	return append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny})
+}
+
+// landlockRuleset creates the Landlock ruleset allowing files to be read and
+// executed and the writable paths to be written to; it returns -1 if the
+// kernel does not support Landlock
+func landlockRuleset(writable []string) (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+			return -1, nil
+		}
+		return -1, fmt.Errorf("could not get Landlock version: %w", errno)
+	}
+	handled := uint64(landlockAccessFSv1)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("could not create Landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	if err := addLandlockRule(ruleset, "/", landlockAccessRead); err != nil {
+		unix.Close(ruleset)
+		return -1, err
+	}
+	for _, p := range writable {
+		fi, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			p = filepath.Dir(p)
+			fi, err = os.Stat(p)
+		}
+		if err != nil {
+			unix.Close(ruleset)
+			return -1, fmt.Errorf("could not make %s writable: %w", p, err)
+		}
+		access := handled
+		if !fi.IsDir() {
+			access &= landlockAccessFile
+		}
+		if err := addLandlockRule(ruleset, p, access); err != nil {
+			unix.Close(ruleset)
+			return -1, err
+		}
+	}
+	return ruleset, nil
+}
+
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s for Landlock rule: %w", path, err)
+	}
+	defer unix.Close(fd)
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("could not add Landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
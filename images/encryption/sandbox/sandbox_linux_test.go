@@ -0,0 +1,115 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// result is what the sandboxed test process reports
+type result struct {
+	Status      Status
+	Error       string
+	Unshare     bool
+	WriteInside bool
+	WriteOut    bool
+	ReadOut     bool
+}
+
+// TestMain runs the sandboxed part of TestApply in a process of its own,
+// since the sandbox cannot be lifted again
+func TestMain(m *testing.M) {
+	if dir := os.Getenv("IMGCRYPT_SANDBOX_TEST"); dir != "" {
+		var r result
+		unshareBefore := unix.Unshare(0) == nil
+		status, err := Apply(Config{Writable: []string{filepath.Join(dir, "writable")}})
+		r.Status = status
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Unshare = unshareBefore && unix.Unshare(0) == nil
+		r.WriteInside = os.WriteFile(filepath.Join(dir, "writable", "file"), []byte("data"), 0600) == nil
+		r.WriteOut = os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0600) == nil
+		_, err = os.ReadFile(filepath.Join(dir, "readable"))
+		r.ReadOut = err == nil
+		b, _ := json.Marshal(r)
+		fmt.Println(string(b))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "writable"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "readable"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "IMGCRYPT_SANDBOX_TEST="+dir)
+	out, err := cmd.Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			t.Fatalf("sandboxed process failed: %s", ee.Stderr)
+		}
+		t.Fatal(err)
+	}
+	var r result
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatalf("unexpected output %q: %v", out, err)
+	}
+	if r.Error != "" {
+		if !r.Status.Seccomp {
+			t.Skipf("seccomp is not available: %s", r.Error)
+		}
+		t.Fatal(r.Error)
+	}
+	if r.Unshare {
+		t.Error("expected unshare to be refused")
+	}
+	if !r.WriteInside || !r.ReadOut {
+		t.Error("expected the writable directory to be writable and other files to be readable")
+	}
+	if r.Status.Landlock && r.WriteOut {
+		t.Error("expected a file outside of the writable directory not to be writable")
+	}
+	t.Logf("applied %+v", r.Status)
+}
+
+func TestSeccompFilter(t *testing.T) {
+	filter := seccompFilter(unix.AUDIT_ARCH_X86_64)
+	last := len(filter) - 1
+	if filter[last].K != seccompRetErrno|uint32(unix.EPERM) || filter[last-1].K != seccompRetAllow {
+		t.Fatal("expected the filter to end with allowing and refusing system calls")
+	}
+	for i, ins := range filter[4:last] {
+		if ins.Code&0x07 == unix.BPF_JMP && i+4+1+int(ins.Jt) != last {
+			t.Fatalf("instruction %d does not jump to the refusal", i+4)
+		}
+	}
+}
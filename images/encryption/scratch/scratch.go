@@ -0,0 +1,233 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package scratch gives the decoder a private directory for the temporary
+// files written while a layer is decrypted, such as by gpg, keyprovider
+// commands or PKCS#11 modules, which find it in the environment. The
+// directory can be required to be memory-backed and its size limited, and it
+// is removed when the decryption ends; directories left behind by decoders
+// that were killed are removed by the next decoder.
+package scratch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/imgcrypt/internal/procutil"
+)
+
+var (
+	// ErrNotMemoryBacked is returned if the scratch space must not be on
+	// disk but the directory is not on a memory-backed file system
+	ErrNotMemoryBacked = errors.New("scratch directory is not memory-backed")
+	// ErrExceeded is returned by the reader of a Space once more than its
+	// limit was written to it
+	ErrExceeded = errors.New("scratch space limit exceeded")
+)
+
+// DefaultMemoryDir is the directory the scratch space is created in if it
+// must not be on disk and no directory is given
+const DefaultMemoryDir = "/dev/shm"
+
+const (
+	// prefix is the prefix of the scratch directories, followed by the ID of
+	// the process using them
+	prefix = "imgcrypt-scratch-"
+	// checkInterval is how often the size of the scratch space is checked
+	checkInterval = 100 * time.Millisecond
+)
+
+// Config configures the scratch space
+type Config struct {
+	// Dir is the directory the scratch space is created in, by default the
+	// directory for temporary files
+	Dir string
+	// Limit is the number of bytes that may be written to the scratch space;
+	// 0 means no limit
+	Limit int64
+	// NoDisk refuses a scratch space that is not on a memory-backed file
+	// system, such as tmpfs, so that no plaintext is ever written to disk
+	NoDisk bool
+}
+
+// Space is the private scratch directory of a process
+type Space struct {
+	dir      string
+	limit    int64
+	exceeded atomic.Bool
+	stop     chan struct{}
+	once     sync.Once
+	env      map[string]*string
+}
+
+// New creates the scratch space of the process and makes it the directory
+// for temporary files of the process and of the commands it runs until the
+// Space is closed. Scratch directories of processes that exited are removed
+// first.
+func New(c Config) (*Space, error) {
+	parent := c.Dir
+	if parent == "" {
+		parent = os.TempDir()
+		if c.NoDisk {
+			parent = DefaultMemoryDir
+		}
+	}
+	if c.NoDisk {
+		ok, err := memoryBacked(parent)
+		if err != nil {
+			return nil, fmt.Errorf("could not check the file system of scratch directory %s: %w", parent, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotMemoryBacked, parent)
+		}
+	}
+	Sweep(parent)
+	dir, err := os.MkdirTemp(parent, fmt.Sprintf("%s%d-", prefix, os.Getpid()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create scratch directory: %w", err)
+	}
+	s := &Space{dir: dir, limit: c.Limit, stop: make(chan struct{}), env: make(map[string]*string)}
+	for _, name := range tempEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			s.env[name] = &v
+		} else {
+			s.env[name] = nil
+		}
+		if err := os.Setenv(name, dir); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if s.limit > 0 {
+		go s.watch()
+	}
+	return s, nil
+}
+
+// Dir returns the scratch directory
+func (s *Space) Dir() string {
+	return s.dir
+}
+
+// Usage returns the number of bytes in the files of the scratch space
+func (s *Space) Usage() (int64, error) {
+	var n int64
+	err := filepath.WalkDir(s.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// files may be removed while the directory is walked
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Err returns ErrExceeded once more than the limit was written to the
+// scratch space
+func (s *Space) Err() error {
+	if s.exceeded.Load() {
+		return fmt.Errorf("%w: more than %d bytes in %s", ErrExceeded, s.limit, s.dir)
+	}
+	return nil
+}
+
+func (s *Space) watch() {
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if n, err := s.Usage(); err == nil && n > s.limit {
+				s.exceeded.Store(true)
+				return
+			}
+		}
+	}
+}
+
+// Reader returns a reader of r that fails with ErrExceeded once more than the
+// limit was written to the scratch space, so that the decryption is aborted
+func (s *Space) Reader(r io.Reader) io.Reader {
+	return &reader{r: r, s: s}
+}
+
+type reader struct {
+	r io.Reader
+	s *Space
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.s.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Close removes the scratch space and restores the directory for temporary
+// files
+func (s *Space) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.stop)
+		for name, v := range s.env {
+			if v == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *v)
+			}
+		}
+		err = os.RemoveAll(s.dir)
+	})
+	return err
+}
+
+// Sweep removes the scratch directories in dir of processes that exited
+func Sweep(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		pidStr, _, _ := strings.Cut(strings.TrimPrefix(e.Name(), prefix), "-")
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || procutil.Alive(pid) {
+			continue
+		}
+		_ = os.RemoveAll(filepath.Join(dir, e.Name()))
+	}
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package scratch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSpace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the directory for temporary files is set differently on Windows")
+	}
+	parent := t.TempDir()
+	t.Setenv("TMPDIR", "/previous")
+	s, err := New(Config{Dir: parent, Limit: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if filepath.Dir(s.Dir()) != parent || os.TempDir() != s.Dir() {
+		t.Fatalf("expected the scratch directory in %s to be the directory for temporary files, got %s and %s", parent, s.Dir(), os.TempDir())
+	}
+
+	if err := os.WriteFile(filepath.Join(s.Dir(), "spill"), bytes.Repeat([]byte{1}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := s.Reader(bytes.NewReader([]byte("layer data")))
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrExceeded) {
+		t.Fatalf("expected ErrExceeded, got %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.Dir()); !os.IsNotExist(err) {
+		t.Fatalf("expected the scratch directory to be removed, got %v", err)
+	}
+	if os.Getenv("TMPDIR") != "/previous" {
+		t.Fatalf("expected TMPDIR to be restored, got %q", os.Getenv("TMPDIR"))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exited processes are not recognized on Windows")
+	}
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("cannot run true:", err)
+	}
+	parent := t.TempDir()
+	dead := filepath.Join(parent, fmt.Sprintf("%s%d-1", prefix, cmd.Process.Pid))
+	alive := filepath.Join(parent, fmt.Sprintf("%s%d-1", prefix, os.Getpid()))
+	other := filepath.Join(parent, "other")
+	for _, dir := range []string{dead, alive, other} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Sweep(parent)
+	if _, err := os.Stat(dead); !os.IsNotExist(err) {
+		t.Fatal("expected the scratch directory of the exited process to be removed")
+	}
+	for _, dir := range []string{alive, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNoDisk(t *testing.T) {
+	dir := t.TempDir()
+	if ok, err := memoryBacked(dir); err == nil && ok {
+		t.Skip("the temporary directory is memory-backed")
+	}
+	if _, err := New(Config{Dir: dir, NoDisk: true}); err == nil {
+		t.Fatal("expected an error for a scratch directory on disk")
+	}
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package securemem keeps key material, such as private keys, their
+// passwords and unwrapped layer keys, in memory outside of the Go heap that
+// the garbage collector never copies. On Linux the memory is locked into RAM,
+// so that it is not swapped out, and excluded from core dumps; memory that
+// cannot be locked, such as beyond RLIMIT_MEMLOCK, is still excluded from
+// core dumps. The memory is zeroed when it is released.
+//
+// Copies made by the libraries that parse the keys, such as the parsed
+// private keys of crypto/rsa, are not covered.
+package securemem
+
+import (
+	"runtime"
+	"sync"
+)
+
+// SensitiveParameters are the parameters of the crypto configurations of
+// ocicrypt and imgcrypt that hold private keys, passwords and PINs
+var SensitiveParameters = []string{
+	"privkeys",
+	"privkeys-passwords",
+	"gpg-privatekeys",
+	"gpg-privatekeys-passwords",
+	"jwe-hybrid-privkeys",
+	"gpg-agent-passphrases",
+	// the PINs of PKCS#11 keys are part of their YAML files
+	"pkcs11-yamls",
+}
+
+// pageSize is the unit memory is allocated in
+var pageSize = 4096
+
+// Buffer is memory for key material outside of the Go heap
+type Buffer struct {
+	mem    []byte
+	n      int
+	locked bool
+}
+
+var (
+	mu sync.Mutex
+	// free holds released buffers by their number of pages; their memory
+	// is reused rather than unmapped, so that slices of released buffers
+	// that are still referenced stay valid and read zeros
+	free = make(map[int][]*Buffer)
+	// live holds the buffers in use by the address of their first byte
+	live = make(map[*byte]*Buffer)
+)
+
+// New returns a zeroed buffer of n bytes, with n > 0
+func New(n int) (*Buffer, error) {
+	pages := (n + pageSize - 1) / pageSize
+	mu.Lock()
+	defer mu.Unlock()
+	var b *Buffer
+	if bs := free[pages]; len(bs) > 0 {
+		b = bs[len(bs)-1]
+		free[pages] = bs[:len(bs)-1]
+	} else {
+		mem, locked, err := alloc(pages * pageSize)
+		if err != nil {
+			return nil, err
+		}
+		b = &Buffer{mem: mem, locked: locked}
+	}
+	b.n = n
+	live[&b.mem[0]] = b
+	return b, nil
+}
+
+// Bytes returns the memory of the buffer
+func (b *Buffer) Bytes() []byte {
+	return b.mem[:b.n:b.n]
+}
+
+// Locked returns whether the memory of the buffer is locked into RAM
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// Free zeroes the buffer and makes its memory available to other buffers;
+// the buffer must not be used afterwards
+func (b *Buffer) Free() {
+	Wipe(b.mem)
+	mu.Lock()
+	defer mu.Unlock()
+	if live[&b.mem[0]] != b {
+		return
+	}
+	delete(live, &b.mem[0])
+	pages := len(b.mem) / pageSize
+	free[pages] = append(free[pages], b)
+}
+
+// Wipe zeroes data
+func Wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+	runtime.KeepAlive(data)
+}
+
+// Protect returns a copy of data in a buffer and wipes data; data that is
+// empty or protected already is returned as it is
+func Protect(data []byte) ([]byte, error) {
+	if len(data) == 0 || protected(data) {
+		return data, nil
+	}
+	b, err := New(len(data))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.Bytes(), data)
+	Wipe(data)
+	return b.Bytes(), nil
+}
+
+// Release frees the buffer data was returned from by Protect or Bytes
+func Release(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	mu.Lock()
+	b := live[&data[0]]
+	mu.Unlock()
+	if b != nil {
+		b.Free()
+	}
+}
+
+// protected returns whether data starts a buffer
+func protected(data []byte) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return live[&data[0]] != nil
+}
+
+// ProtectParameters protects the values of the sensitive parameters in place
+func ProtectParameters(params map[string][][]byte) error {
+	for _, name := range SensitiveParameters {
+		for i, v := range params[name] {
+			p, err := Protect(v)
+			if err != nil {
+				return err
+			}
+			params[name][i] = p
+		}
+	}
+	return nil
+}
+
+// ReleaseParameters releases the buffers of the values of the sensitive
+// parameters and removes them; params is nil-safe
+func ReleaseParameters(params map[string][][]byte) {
+	for _, name := range SensitiveParameters {
+		for _, v := range params[name] {
+			Release(v)
+		}
+		delete(params, name)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package securemem
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	pageSize = unix.Getpagesize()
+}
+
+// alloc maps n bytes of anonymous memory that is excluded from core dumps and
+// locked into RAM if the limit of locked memory allows
+func alloc(n int) ([]byte, bool, error) {
+	mem, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not allocate memory for key material: %w", err)
+	}
+	_ = unix.Madvise(mem, unix.MADV_DONTDUMP)
+	return mem, unix.Mlock(mem) == nil, nil
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package securemem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProtect(t *testing.T) {
+	data := []byte("secret key")
+	p, err := Protect(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, []byte("secret key")) {
+		t.Fatalf("unexpected protected data %q", p)
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatal("expected the original data to be wiped")
+	}
+	if again, err := Protect(p); err != nil || &again[0] != &p[0] {
+		t.Fatal("expected protected data to be returned as it is")
+	}
+
+	Release(p)
+	if !bytes.Equal(p, make([]byte, len(p))) {
+		t.Fatal("expected the released data to be zeroed")
+	}
+	b, err := New(len(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Free()
+	if &b.Bytes()[0] != &p[0] {
+		t.Fatal("expected the memory of the released buffer to be reused")
+	}
+}
+
+func TestParameters(t *testing.T) {
+	params := map[string][][]byte{
+		"privkeys":           {[]byte("private key")},
+		"privkeys-passwords": {nil},
+		"pubkeys":            {[]byte("public key")},
+	}
+	if err := ProtectParameters(params); err != nil {
+		t.Fatal(err)
+	}
+	key := params["privkeys"][0]
+	if !protected(key) || protected(params["pubkeys"][0]) {
+		t.Fatal("expected only the private key to be protected")
+	}
+	ReleaseParameters(params)
+	if _, ok := params["privkeys"]; ok {
+		t.Fatal("expected the private keys to be removed")
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) || params["pubkeys"] == nil {
+		t.Fatal("expected the private key to be zeroed and the public key to be kept")
+	}
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package signature verifies the signatures of images before the keys of their
+// encrypted layers are unwrapped.
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/imgcrypt"
+	"github.com/gobars/ocicrypt/crypto/sm2"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// CosignSignatureMediaType is the media type of the layers of cosign signature images
+	CosignSignatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// CosignSignatureAnnotation is the annotation of a layer holding the signature over it
+	CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// ErrNoValidSignature is returned if none of the signatures of an image can be verified
+var ErrNoValidSignature = errors.New("image has no valid signature")
+
+// simpleSigningPayload is the part of the cosign payload that is checked
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// LoadCosignKeys reads the public keys used to verify cosign signatures. ECDSA,
+// RSA, Ed25519 and SM2 keys are supported.
+func LoadCosignKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read verification key: %w", err)
+		}
+		key, err := encutils.ParsePublicKey(data, path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// CosignSignatureTag returns the name of the cosign signature image of the image with
+// the given name and digest
+func CosignSignatureTag(name string, dgst digest.Digest) (string, error) {
+	spec, err := reference.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s-%s.sig", spec.Locator, dgst.Algorithm(), dgst.Encoded()), nil
+}
+
+// CosignSignatures returns the signatures of the image held by its cosign signature
+// image in the image store; the signature image must have been pulled
+func CosignSignatures(ctx context.Context, is images.Store, cs content.Store, image images.Image) ([]imgcrypt.Signature, error) {
+	tag, err := CosignSignatureTag(image.Name, image.Target.Digest)
+	if err != nil {
+		return nil, err
+	}
+	sigImage, err := is.Get(ctx, tag)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not get signature image %s: %v", ErrNoValidSignature, tag, err)
+	}
+	p, err := content.ReadBlob(ctx, cs, sigImage.Target)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal signature manifest: %w", err)
+	}
+
+	var sigs []imgcrypt.Signature
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != CosignSignatureMediaType {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[CosignSignatureAnnotation])
+		if err != nil {
+			continue
+		}
+		payload, err := content.ReadBlob(ctx, cs, layer)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, imgcrypt.Signature{Payload: payload, Signature: sig})
+	}
+	return sigs, nil
+}
+
+// VerifyCosignSignatures checks that one of the signatures can be verified with one of the
+// keys and that its payload refers to the given digest
+func VerifyCosignSignatures(keys []crypto.PublicKey, sigs []imgcrypt.Signature, dgst digest.Digest) error {
+	if len(keys) == 0 {
+		return errors.New("no keys for verifying signatures")
+	}
+	var problems []string
+	for _, sig := range sigs {
+		var payload simpleSigningPayload
+		if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid payload: %v", err))
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != dgst {
+			problems = append(problems, fmt.Sprintf("signature is for %s", payload.Critical.Image.DockerManifestDigest))
+			continue
+		}
+		for _, key := range keys {
+			if VerifyMessage(key, sig.Payload, sig.Signature) {
+				return nil
+			}
+		}
+		problems = append(problems, "signature does not match any key")
+	}
+	if len(problems) == 0 {
+		return fmt.Errorf("%w: %s is not signed", ErrNoValidSignature, dgst)
+	}
+	return fmt.Errorf("%w: %s", ErrNoValidSignature, strings.Join(problems, "; "))
+}
+
+// VerifyMessage verifies the signature over msg in the way cosign creates it for the type of key
+func VerifyMessage(key crypto.PublicKey, msg, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(msg)
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
+	case *sm2.PublicKey:
+		return k.Verify(msg, sig)
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/imgcrypt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AddToPayload adds the cosign signatures of the image and the manifests leading from
+// the signed one to the manifest for the platform to the payload of the decryption tool
+func AddToPayload(ctx context.Context, is images.Store, cs content.Store, image images.Image, platform platforms.MatchComparer, data *imgcrypt.Payload) error {
+	sigs, err := CosignSignatures(ctx, is, cs, image)
+	if err != nil {
+		return err
+	}
+	manifests, err := manifestChain(ctx, cs, image.Target, platform)
+	if err != nil {
+		return err
+	}
+	data.Signatures = sigs
+	data.Manifests = manifests
+	return nil
+}
+
+// manifestChain returns the content of desc followed by the content of the manifests
+// down to the one for the platform
+func manifestChain(ctx context.Context, cs content.Store, desc ocispec.Descriptor, platform platforms.MatchComparer) ([][]byte, error) {
+	p, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		return [][]byte{p}, nil
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var index ocispec.Index
+		if err := json.Unmarshal(p, &index); err != nil {
+			return nil, err
+		}
+		for _, m := range index.Manifests {
+			if m.Platform != nil && !platform.Match(*m.Platform) {
+				continue
+			}
+			chain, err := manifestChain(ctx, cs, m, platform)
+			if err != nil {
+				return nil, err
+			}
+			return append([][]byte{p}, chain...), nil
+		}
+		return nil, fmt.Errorf("no manifest for the platform in %s", desc.Digest)
+	}
+	return nil, fmt.Errorf("unexpected media type %s of %s", desc.MediaType, desc.Digest)
+}
+
+// VerifyPayload checks that the layer of the payload belongs to an image that was
+// signed with one of the keys. The manifests in the payload must lead from the signed
+// one to a manifest that holds the layer. The descriptor of the layer in the signed
+// manifest is returned, so that only its annotations are used for unwrapping.
+func VerifyPayload(keys []crypto.PublicKey, data *imgcrypt.Payload) (ocispec.Descriptor, error) {
+	if len(data.Manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("%w: the payload carries no signed manifest", ErrNoValidSignature)
+	}
+	if err := VerifyCosignSignatures(keys, data.Signatures, digest.FromBytes(data.Manifests[0])); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for i := 1; i < len(data.Manifests); i++ {
+		var index ocispec.Index
+		if err := json.Unmarshal(data.Manifests[i-1], &index); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		dgst := digest.FromBytes(data.Manifests[i])
+		if !containsDigest(index.Manifests, dgst) {
+			return ocispec.Descriptor{}, fmt.Errorf("%w: manifest %s is not part of the signed image", ErrNoValidSignature, dgst)
+		}
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data.Manifests[len(data.Manifests)-1], &manifest); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Digest == data.Descriptor.Digest {
+			return layer, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("%w: layer %s is not part of the signed image", ErrNoValidSignature, data.Descriptor.Digest)
+}
+
+func containsDigest(descs []ocispec.Descriptor, dgst digest.Digest) bool {
+	for _, d := range descs {
+		if d.Digest == dgst {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/imgcrypt/internal/contentutil"
+	"github.com/gobars/ocicrypt/crypto/sm2"
+	"github.com/gobars/ocicrypt/crypto/x509"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PEM block types of password-protected cosign private keys
+var cosignKeyTypes = []string{"ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY"}
+
+// cosignKey is the content of an encrypted cosign private key
+type cosignKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// LoadSigningKey parses a private key for signing images. Besides the private key
+// formats accepted for decryption, password-protected keys created by
+// 'cosign generate-key-pair' are supported.
+func LoadSigningKey(data, password []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		for _, t := range cosignKeyTypes {
+			if block.Type == t {
+				der, err := decryptCosignKey(block.Bytes, password)
+				if err != nil {
+					return nil, err
+				}
+				data = der
+				break
+			}
+		}
+	}
+	key, err := encutils.ParsePrivateKey(data, password, "signing key")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return signer, nil
+}
+
+// decryptCosignKey returns the PKCS8 private key in an encrypted cosign key
+func decryptCosignKey(data, password []byte) ([]byte, error) {
+	var ck cosignKey
+	if err := json.Unmarshal(data, &ck); err != nil {
+		return nil, fmt.Errorf("could not parse cosign private key: %w", err)
+	}
+	if ck.KDF.Name != "scrypt" || ck.Cipher.Name != "nacl/secretbox" || len(ck.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported cosign private key encryption %s/%s", ck.KDF.Name, ck.Cipher.Name)
+	}
+	if password == nil {
+		return nil, errors.New("signing key: Missing password for encrypted private key")
+	}
+	secret, err := scrypt.Key(password, ck.KDF.Salt, ck.KDF.Params.N, ck.KDF.Params.R, ck.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		key   [32]byte
+		nonce [24]byte
+	)
+	copy(key[:], secret)
+	copy(nonce[:], ck.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, ck.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.New("signing key: Wrong password: could not decrypt private key")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		return nil, fmt.Errorf("could not parse cosign private key: %w", err)
+	}
+	return der, nil
+}
+
+// SignMessage signs msg the way cosign does for the type of key
+func SignMessage(key crypto.Signer, msg []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, k, sum[:])
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(msg)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, msg), nil
+	case *sm2.PrivateKey:
+		return k.Sign(rand.Reader, msg, nil)
+	}
+	return nil, fmt.Errorf("unsupported signing key type %T", key)
+}
+
+// CosignSign signs the target of the image with the key and stores the signature in the
+// cosign signature image of the image, which is created or extended with the signature.
+// The signature image is returned.
+func CosignSign(ctx context.Context, is images.Store, cs content.Store, image images.Image, key crypto.Signer) (images.Image, error) {
+	spec, err := reference.Parse(image.Name)
+	if err != nil {
+		return images.Image{}, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": spec.Locator},
+			"image":    map[string]string{"docker-manifest-digest": image.Target.Digest.String()},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	sig, err := SignMessage(key, payload)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	tag, err := CosignSignatureTag(image.Name, image.Target.Digest)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	// keep the signatures that were made before
+	var layers []ocispec.Descriptor
+	sigImage, err := is.Get(ctx, tag)
+	if err == nil {
+		if p, err := content.ReadBlob(ctx, cs, sigImage.Target); err == nil {
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(p, &manifest); err == nil {
+				layers = manifest.Layers
+			}
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return images.Image{}, err
+	}
+
+	layer, err := contentutil.WriteBlob(ctx, cs, CosignSignatureMediaType, payload, nil)
+	if err != nil {
+		return images.Image{}, err
+	}
+	layer.Annotations = map[string]string{CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+	layers = append(layers, layer)
+
+	var diffIDs []digest.Digest
+	for _, l := range layers {
+		diffIDs = append(diffIDs, l.Digest)
+	}
+	zero := time.Time{}
+	config, err := json.Marshal(ocispec.Image{
+		Created: &zero,
+		RootFS:  ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		History: []ocispec.History{{Created: &zero}},
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	configDesc, err := contentutil.WriteBlob(ctx, cs, ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	labels := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	manifestDesc, err := contentutil.WriteBlob(ctx, cs, ocispec.MediaTypeImageManifest, manifest, labels)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	sigImage = images.Image{Name: tag, Target: manifestDesc}
+	updated, err := is.Update(ctx, sigImage, "target")
+	if errdefs.IsNotFound(err) {
+		return is.Create(ctx, sigImage)
+	}
+	return updated, err
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/gobars/ocicrypt/crypto/sm2"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptCosignKey creates a private key in the format of 'cosign generate-key-pair'
+func encryptCosignKey(t *testing.T, der, password []byte) []byte {
+	var ck cosignKey
+	ck.KDF.Name = "scrypt"
+	ck.KDF.Params.N, ck.KDF.Params.R, ck.KDF.Params.P = 1024, 8, 1
+	ck.KDF.Salt = []byte("0123456789abcdef0123456789abcdef")
+	ck.Cipher.Name = "nacl/secretbox"
+	ck.Cipher.Nonce = []byte("0123456789abcdef01234567")
+
+	secret, err := scrypt.Key(password, ck.KDF.Salt, ck.KDF.Params.N, ck.KDF.Params.R, ck.KDF.Params.P, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		key   [32]byte
+		nonce [24]byte
+	)
+	copy(key[:], secret)
+	copy(nonce[:], ck.Cipher.Nonce)
+	ck.Ciphertext = secretbox.Seal(nil, der, &nonce, &key)
+
+	data, err := json.Marshal(ck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: data})
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encryptCosignKey(t, der, []byte("secret"))
+
+	if _, err := LoadSigningKey(data, nil); !encutils.IsPasswordError(err) {
+		t.Fatalf("expected missing password error: %v", err)
+	}
+	if _, err := LoadSigningKey(data, []byte("wrong")); !encutils.IsPasswordError(err) {
+		t.Fatalf("expected wrong password error: %v", err)
+	}
+	key, err := LoadSigningKey(data, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := SignMessage(key, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMessage(&priv.PublicKey, []byte("payload"), sig) {
+		t.Fatal("signature made with the loaded key does not verify")
+	}
+}
+
+func TestSignSM2(t *testing.T) {
+	priv, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := SignMessage(priv, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMessage(&priv.PublicKey, []byte("payload"), sig) {
+		t.Fatal("SM2 signature does not verify")
+	}
+	if VerifyMessage(&priv.PublicKey, []byte("other payload"), sig) {
+		t.Fatal("SM2 signature verifies for another payload")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/imgcrypt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	p, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func signedPayload(t *testing.T, key *ecdsa.PrivateKey, layer ocispec.Descriptor) *imgcrypt.Payload {
+	manifest := mustMarshal(t, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	index := mustMarshal(t, ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+		}},
+	})
+	sigPayload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest.FromBytes(index)))
+	sum := sha256.Sum256(sigPayload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &imgcrypt.Payload{
+		Descriptor: ocispec.Descriptor{Digest: layer.Digest},
+		Manifests:  [][]byte{index, manifest},
+		Signatures: []imgcrypt.Signature{{Payload: sigPayload, Signature: sig}},
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := ocispec.Descriptor{
+		MediaType:   "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		Digest:      digest.FromString("layer"),
+		Annotations: map[string]string{"org.opencontainers.image.enc.keys.jwe": "signed"},
+	}
+	keys := []crypto.PublicKey{key.Public()}
+
+	data := signedPayload(t, key, layer)
+	data.Descriptor.Annotations = map[string]string{"org.opencontainers.image.enc.keys.jwe": "injected"}
+	desc, err := VerifyPayload(keys, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Annotations["org.opencontainers.image.enc.keys.jwe"] != "signed" {
+		t.Fatal("expected descriptor of the signed manifest to be returned")
+	}
+
+	if _, err := VerifyPayload([]crypto.PublicKey{otherKey.Public()}, data); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected signature with another key to be rejected: %v", err)
+	}
+
+	data.Descriptor.Digest = digest.FromString("other layer")
+	if _, err := VerifyPayload(keys, data); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected layer of another image to be rejected: %v", err)
+	}
+
+	data = signedPayload(t, key, layer)
+	data.Manifests[1] = mustMarshal(t, ocispec.Manifest{Layers: []ocispec.Descriptor{layer}})
+	if _, err := VerifyPayload(keys, data); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected manifest that is not part of the signed index to be rejected: %v", err)
+	}
+
+	data.Manifests = nil
+	if _, err := VerifyPayload(keys, data); !errors.Is(err, ErrNoValidSignature) {
+		t.Fatalf("expected payload without signed manifest to be rejected: %v", err)
+	}
+}
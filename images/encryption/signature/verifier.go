@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"os/exec"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+)
+
+// Verifier verifies the signature over an image
+type Verifier interface {
+	Verify(ctx context.Context, is images.Store, cs content.Store, image images.Image) error
+}
+
+// CosignVerifier verifies the cosign signatures of images with public keys
+type CosignVerifier struct {
+	Keys []crypto.PublicKey
+}
+
+// Verify checks that the image has a cosign signature made with one of the keys
+func (cv CosignVerifier) Verify(ctx context.Context, is images.Store, cs content.Store, image images.Image) error {
+	sigs, err := CosignSignatures(ctx, is, cs, image)
+	if err != nil {
+		return err
+	}
+	return VerifyCosignSignatures(cv.Keys, sigs, image.Target.Digest)
+}
+
+// CommandVerifier verifies images by running a command, such as 'notation verify',
+// with the digest reference of the image appended to its arguments
+type CommandVerifier struct {
+	Command []string
+}
+
+// Verify runs the command; the image is verified if the command succeeds
+func (cv CommandVerifier) Verify(ctx context.Context, _ images.Store, _ content.Store, image images.Image) error {
+	if len(cv.Command) == 0 {
+		return fmt.Errorf("%w: no verification command", ErrNoValidSignature)
+	}
+	spec, err := reference.Parse(image.Name)
+	if err != nil {
+		return err
+	}
+	ref := fmt.Sprintf("%s@%s", spec.Locator, image.Target.Digest)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cv.Command[0], append(cv.Command[1:], ref)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s: %v: %s", ErrNoValidSignature, cv.Command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// Verifiers requires all of its verifiers to succeed
+type Verifiers []Verifier
+
+// Verify runs all verifiers
+func (vs Verifiers) Verify(ctx context.Context, is images.Store, cs content.Store, image images.Image) error {
+	for _, v := range vs {
+		if err := v.Verify(ctx, is, cs, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithSignatureVerification verifies the signature of the image of a container upon its
+// creation; it must be passed before options that unwrap keys, such as
+// encryption.WithAuthorizationCheck
+func WithSignatureVerification(v Verifier) containerd.NewContainerOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		image, err := client.ImageService().Get(ctx, c.Image)
+		if errdefs.IsNotFound(err) {
+			// allow creation of container without a existing image
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return v.Verify(ctx, client.ImageService(), client.ContentStore(), image)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/doctor"
+)
+
+// Options select what the status covers
+type Options struct {
+	// Keys are the key files, or directories of them, used for decryption,
+	// such as the --decryption-keys-path of ctd-decoder
+	Keys []string
+	// Tracker records the decryptions; Current is used if nil
+	Tracker *Tracker
+}
+
+// Status is the status of image decryption on a node
+type Status struct {
+	// Healthy is false if a key is unusable, the outcomes of decryptions
+	// cannot be read, or the last decryption failed
+	Healthy bool `json:"healthy"`
+	// Time is when the status was collected
+	Time time.Time `json:"time"`
+	// Problems tell why the status is not healthy
+	Problems []string `json:"problems,omitempty"`
+	// Keys are the results of checking the keys
+	Keys []doctor.Result `json:"keys,omitempty"`
+	// Decryption holds the outcomes of the decryptions
+	Decryption Record `json:"decryption"`
+}
+
+// Collect checks the keys and reads the outcomes of the decryptions
+func Collect(opts Options) Status {
+	s := Status{Time: time.Now().UTC()}
+	if len(opts.Keys) > 0 {
+		s.Keys = doctor.CheckKeys(opts.Keys)
+	}
+	for _, r := range s.Keys {
+		if r.Status == doctor.StatusError {
+			s.Problems = append(s.Problems, r.Message)
+		}
+	}
+	t := opts.Tracker
+	if t == nil {
+		t = Current()
+	}
+	rec, err := t.Record()
+	if err != nil {
+		s.Problems = append(s.Problems, err.Error())
+	} else if rec.Failing() {
+		s.Problems = append(s.Problems, fmt.Sprintf("the last decryption failed at %s: %s", rec.LastFailure.Format(time.RFC3339), rec.LastFailureReason))
+	}
+	s.Decryption = rec
+	s.Healthy = len(s.Problems) == 0
+	return s
+}
+
+// Handler serves the status as JSON at /status and, for probes, at /healthz
+// as "ok" or the problems with status 503
+func Handler(opts Options) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Collect(opts))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s := Collect(opts)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !s.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(s.Problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Serve serves h on the unix socket at path until ctx is done, replacing a
+// socket left behind by a previous process
+func Serve(ctx context.Context, path string, h http.Handler) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("could not listen on status socket: %w", err)
+	}
+	defer os.Remove(path)
+
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
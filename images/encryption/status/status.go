@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package status reports the health of image decryption on a node to
+// monitoring agents, such as a custom plugin of the node-problem-detector:
+// whether the decryption keys are usable, when a layer was last decrypted,
+// and how often and why decryptions failed.
+//
+// The outcomes of decryptions are recorded by a Tracker. ctd-decoder runs
+// once per layer, so it records them in a file shared by all decoders, which
+// a long running process such as imgcrypt-agent reads to serve the status on
+// a unix socket with Serve.
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/lockfile"
+)
+
+// lockTimeout is how long a Tracker waits for other processes updating its
+// file
+const lockTimeout = 5 * time.Second
+
+// Record holds the outcomes of the decryptions of layers
+type Record struct {
+	// LastSuccess is when a layer was last decrypted
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	// LastFailure is when the decryption of a layer last failed
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	// LastFailureReason is the error class of the last failure
+	LastFailureReason string `json:"lastFailureReason,omitempty"`
+	// Decrypted is the number of layers decrypted
+	Decrypted int64 `json:"decrypted"`
+	// Failures are the numbers of failed decryptions by error class
+	Failures map[string]int64 `json:"failures,omitempty"`
+}
+
+// Failing returns whether the last decryption failed
+func (r *Record) Failing() bool {
+	return r.LastFailure.After(r.LastSuccess)
+}
+
+// Tracker records the outcomes of decryptions, in memory or in the file at
+// Path, which is shared by the processes using it
+type Tracker struct {
+	// Path is the file the outcomes are recorded in
+	Path string
+
+	mu  sync.Mutex
+	rec Record
+}
+
+var current atomic.Pointer[Tracker]
+
+var defaultTracker = &Tracker{}
+
+// Set makes t record the decryptions of the rest of the process; nil
+// restores the tracker recording them in memory
+func Set(t *Tracker) {
+	current.Store(t)
+}
+
+// Current returns the tracker recording the decryptions
+func Current() *Tracker {
+	if t := current.Load(); t != nil {
+		return t
+	}
+	return defaultTracker
+}
+
+// Succeeded records that a layer was decrypted
+func (t *Tracker) Succeeded() error {
+	return t.update(func(r *Record) {
+		r.LastSuccess = time.Now().UTC()
+		r.Decrypted++
+	})
+}
+
+// Failed records that the decryption of a layer failed for the reason, the
+// error class of the failure
+func (t *Tracker) Failed(reason string) error {
+	return t.update(func(r *Record) {
+		r.LastFailure = time.Now().UTC()
+		r.LastFailureReason = reason
+		if r.Failures == nil {
+			r.Failures = make(map[string]int64)
+		}
+		r.Failures[reason]++
+	})
+}
+
+// Record returns the outcomes recorded so far
+func (t *Tracker) Record() (Record, error) {
+	if t.Path == "" {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		rec := t.rec
+		rec.Failures = make(map[string]int64, len(t.rec.Failures))
+		for k, v := range t.rec.Failures {
+			rec.Failures[k] = v
+		}
+		return rec, nil
+	}
+	return t.read()
+}
+
+func (t *Tracker) update(fn func(*Record)) error {
+	if t.Path == "" {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fn(&t.rec)
+		return nil
+	}
+	if err := lockfile.Check(t.Path); err != nil {
+		return err
+	}
+	unlock, err := lockfile.Lock(t.Path+".lock", lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rec, err := t.read()
+	if err != nil {
+		return err
+	}
+	fn(&rec)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.Path), "."+filepath.Base(t.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// monitoring agents may run as another user
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.Path)
+}
+
+func (t *Tracker) read() (Record, error) {
+	var rec Record
+	if err := lockfile.Check(t.Path); errors.Is(err, os.ErrNotExist) {
+		return rec, nil
+	} else if err != nil {
+		return rec, err
+	}
+	data, err := os.ReadFile(t.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return rec, fmt.Errorf("could not parse decryption status in %s: %w", t.Path, err)
+		}
+	}
+	return rec, nil
+}
+
+// trackingReader records the outcome of a decryption once the layer was read
+// entirely or reading it failed
+type trackingReader struct {
+	r        io.Reader
+	classify func(error) string
+	done     bool
+}
+
+// TrackReader returns a reader of the decrypted layer data from r that
+// records the decryption with the Current tracker as succeeded when r is
+// exhausted, or as failed for the reason classify returns if reading r fails
+func TrackReader(r io.Reader, classify func(error) string) io.Reader {
+	return &trackingReader{r: r, classify: classify}
+}
+
+func (tr *trackingReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if err != nil && !tr.done {
+		tr.done = true
+		// the status is informational, so failing to record it does not
+		// fail the decryption
+		if err == io.EOF {
+			_ = Current().Succeeded()
+		} else {
+			_ = Current().Failed(tr.classify(err))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+func TestTracker(t *testing.T) {
+	for _, tracker := range []*Tracker{{}, {Path: filepath.Join(t.TempDir(), "status.json")}} {
+		if err := tracker.Failed("key-not-found"); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := tracker.Record()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Failing() || rec.LastFailureReason != "key-not-found" || rec.Failures["key-not-found"] != 1 {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+		if err := tracker.Succeeded(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tracker.Failed("key-not-found"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tracker.Succeeded(); err != nil {
+			t.Fatal(err)
+		}
+		if rec, err = tracker.Record(); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Failing() || rec.Decrypted != 2 || rec.Failures["key-not-found"] != 2 {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+	}
+}
+
+func TestTrackReader(t *testing.T) {
+	tracker := &Tracker{}
+	Set(tracker)
+	defer Set(nil)
+
+	if _, err := io.ReadAll(TrackReader(strings.NewReader("layer"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	failing := io.MultiReader(strings.NewReader("lay"), &errReader{errors.New("corrupted")})
+	if _, err := io.ReadAll(TrackReader(failing, func(error) string { return "integrity" })); err == nil {
+		t.Fatal("expected reading to fail")
+	}
+	rec, err := tracker.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Decrypted != 1 || rec.Failures["integrity"] != 1 {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	_, privKey, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "node.pem"), privKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &Tracker{}
+	h := Handler(Options{Keys: []string{dir}, Tracker: tracker})
+
+	get := func(path string) (int, []byte) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.Bytes()
+	}
+	if code, body := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("unexpected health %d: %s", code, body)
+	}
+
+	if err := tracker.Failed("unwrap-failed"); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/healthz"); code != http.StatusServiceUnavailable || !bytes.Contains(body, []byte("unwrap-failed")) {
+		t.Fatalf("unexpected health %d: %s", code, body)
+	}
+	_, body := get("/status")
+	var s Status
+	if err := json.Unmarshal(body, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Healthy || len(s.Keys) != 1 || s.Decryption.Failures["unwrap-failed"] != 1 {
+		t.Fatalf("unexpected status %s", body)
+	}
+}
+
+func TestServe(t *testing.T) {
+	// the path of a unix socket is limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, path, Handler(Options{Tracker: &Tracker{}})) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://status/healthz"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/containerd/identifiers"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context in which the layers unpacked with
+// WithDecryptedUnpack are decrypted by ctd-decoder with the key set of the
+// tenant instead of its shared keys. Any client of containerd can name any
+// tenant, so this is no access control between tenants.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// TenantKeysDir returns the directory below root that holds the decryption
+// keys of the given tenant
+func TenantKeysDir(root, tenant string) (string, error) {
+	if err := identifiers.Validate(tenant); err != nil {
+		return "", fmt.Errorf("invalid tenant: %w", err)
+	}
+	return filepath.Join(root, tenant), nil
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/imgcrypt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWithTenant(t *testing.T) {
+	desc := ocispec.Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted", Digest: "sha256:0123"}
+	var payload imgcrypt.Payload
+	if err := WithDecryptedUnpack(&payload)(context.Background(), desc, &diff.ApplyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant := payload.Tenant(); tenant != "" {
+		t.Fatalf("expected no tenant, got %q", tenant)
+	}
+	ctx := WithTenant(context.Background(), "tenant-a")
+	if err := WithDecryptedUnpack(&payload)(ctx, desc, &diff.ApplyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant := payload.Tenant(); tenant != "tenant-a" {
+		t.Fatalf("expected tenant-a, got %q", tenant)
+	}
+}
+
+func TestTenantKeysDir(t *testing.T) {
+	dir, err := TenantKeysDir("/keys", "tenant-a")
+	if err != nil || dir != filepath.Join("/keys", "tenant-a") {
+		t.Fatalf("unexpected result %q, %v", dir, err)
+	}
+	for _, tenant := range []string{"", "..", "../tenant-b", "a/b"} {
+		if _, err := TenantKeysDir("/keys", tenant); err == nil {
+			t.Fatalf("expected tenant %q to be rejected", tenant)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package threshold
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// exp and log are the exponentials and logarithms of GF(2^8) with the AES
+// polynomial x^8 + x^4 + x^3 + x + 1 and the generator x + 1
+var exp, log = func() (e [510]byte, l [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		e[i], e[i+255] = x, x
+		l[x] = byte(i)
+		// multiply by x + 1
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}()
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return exp[int(log[a])+int(log[b])]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return exp[int(log[a])+255-int(log[b])]
+}
+
+// split splits secret into n shares of which any k recover it; share i is
+// the evaluation at x = i + 1 of random polynomials of degree k - 1 whose
+// constant terms are the bytes of the secret
+func split(secret []byte, k, n int) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, errors.New("invalid threshold")
+	}
+	coeffs := make([]byte, (k-1)*len(secret))
+	if _, err := rand.Read(coeffs); err != nil {
+		return nil, err
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret))
+		for j, s := range secret {
+			// Horner's method from the highest coefficient
+			var y byte
+			for c := k - 2; c >= 0; c-- {
+				y = mul(y, x) ^ coeffs[c*len(secret)+j]
+			}
+			share[j] = mul(y, x) ^ s
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// combine recovers the secret from shares indexed by their x coordinates by
+// Lagrange interpolation at x = 0
+func combine(shares map[byte][]byte) ([]byte, error) {
+	var size int
+	for x, s := range shares {
+		if x == 0 {
+			return nil, errors.New("invalid share index 0")
+		}
+		if size != 0 && len(s) != size {
+			return nil, errors.New("shares have different sizes")
+		}
+		size = len(s)
+	}
+	secret := make([]byte, size)
+	for xi, si := range shares {
+		// the Lagrange basis polynomial of xi at 0
+		l := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				l = mul(l, div(xj, xj^xi))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(si[b], l)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,479 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package threshold wraps layer keys for groups of n recipients of which any
+// k must jointly decrypt, for images that no single keyholder should be able
+// to open alone. The key encrypting the layer options is split into n shares
+// with Shamir's secret sharing and each share is wrapped in a JWE for one
+// recipient, so fewer than k private keys reveal nothing about the layer key.
+package threshold
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/fips"
+	"github.com/containerd/imgcrypt/images/encryption/logging"
+	"github.com/containerd/imgcrypt/images/encryption/matched"
+	"github.com/containerd/imgcrypt/images/encryption/securemem"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+const (
+	// Scheme is the name of the key wrapping scheme
+	Scheme = "threshold"
+	// AnnotationID is the annotation holding the wrapped keys
+	AnnotationID = "org.opencontainers.image.enc.keys.threshold"
+
+	// ParameterGroups is the EncryptConfig parameter holding the JSON encoded
+	// recipient groups
+	ParameterGroups = "threshold-groups"
+	// the DecryptConfig parameters of the private keys given with --key
+	parameterPrivateKeys = "privkeys"
+	parameterPasswords   = "privkeys-passwords"
+
+	// maxShares is the number of x coordinates of GF(2^8) besides 0
+	maxShares = 255
+)
+
+// ErrNotEnoughShares is returned if fewer than the threshold of the shares of
+// a layer key could be unwrapped
+var ErrNotEnoughShares = errors.New("not enough shares of the threshold wrapped layer key could be unwrapped")
+
+// Group holds the public keys of n recipients of which Threshold must
+// jointly decrypt
+type Group struct {
+	Threshold int `json:"threshold"`
+	// PublicKeys are PEM or JWK encoded RSA or EC public keys
+	PublicKeys [][]byte `json:"publicKeys"`
+}
+
+// Validate returns an error if the group cannot protect a layer key
+func (g Group) Validate() error {
+	n := len(g.PublicKeys)
+	switch {
+	case g.Threshold < 2:
+		return fmt.Errorf("threshold %d must be at least 2", g.Threshold)
+	case g.Threshold > n:
+		return fmt.Errorf("threshold %d exceeds the %d recipients", g.Threshold, n)
+	case n > maxShares:
+		return fmt.Errorf("a group may have at most %d recipients", maxShares)
+	}
+	// a key listed several times would give its holder several shares
+	seen := make(map[string]int)
+	for i, data := range g.PublicKeys {
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return err
+		}
+		kid, err := keyID(pub)
+		if err != nil {
+			return err
+		}
+		if j, ok := seen[kid]; ok {
+			return fmt.Errorf("recipient %d has the same public key as recipient %d", i+1, j+1)
+		}
+		seen[kid] = i
+	}
+	return nil
+}
+
+// parsePublicKey parses a PEM or JWK encoded public key
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	pub, err := encutils.ParsePublicKey(data, "THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if jwk, ok := pub.(*jose.JSONWebKey); ok {
+		return jwk.Key, nil
+	}
+	return pub, nil
+}
+
+// EncryptWithGroups returns the CryptoConfig encrypting for the groups
+func EncryptWithGroups(groups ...Group) (encconfig.CryptoConfig, error) {
+	var params [][]byte
+	for _, g := range groups {
+		if err := g.Validate(); err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		data, err := json.Marshal(g)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		params = append(params, data)
+	}
+	return encconfig.CryptoConfig{
+		EncryptConfig: &encconfig.EncryptConfig{
+			Parameters: map[string][][]byte{
+				ParameterGroups: params,
+			},
+			DecryptConfig: encconfig.DecryptConfig{},
+		},
+	}, nil
+}
+
+// wrappedKeys is the annotation of the threshold wrapped keys of a layer
+type wrappedKeys struct {
+	Groups []wrappedGroup `json:"groups"`
+}
+
+// wrappedGroup holds the layer options encrypted with AES-256-GCM under a key
+// whose shares are wrapped for the recipients of a group
+type wrappedGroup struct {
+	Threshold  int     `json:"threshold"`
+	IV         string  `json:"iv"`
+	Ciphertext string  `json:"ciphertext"`
+	Shares     []share `json:"shares"`
+}
+
+type share struct {
+	// X is the x coordinate of the share
+	X   int    `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	// JWE is the compact serialization of the share wrapped for the recipient
+	JWE string `json:"jwe"`
+}
+
+var b64 = base64.RawURLEncoding
+
+type keyWrapper struct{}
+
+var installOnce sync.Once
+
+// Install registers the threshold key wrapper with ocicrypt
+func Install() {
+	installOnce.Do(func() {
+		ocicrypt.RegisterKeyWrapper(Scheme, &keyWrapper{})
+	})
+}
+
+func (kw *keyWrapper) GetAnnotationID() string {
+	return AnnotationID
+}
+
+// WrapKeys wraps the optsData for the groups of the EncryptConfig
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	params := ec.Parameters[ParameterGroups]
+	if len(params) == 0 {
+		return nil, nil
+	}
+	if fips.Enabled() {
+		if err := fips.CheckScheme(Scheme); err != nil {
+			return nil, err
+		}
+	}
+	if err := algpolicy.Current().CheckScheme(Scheme); err != nil {
+		return nil, err
+	}
+	var wk wrappedKeys
+	for _, data := range params {
+		var g Group
+		if err := json.Unmarshal(data, &g); err != nil {
+			return nil, fmt.Errorf("invalid threshold group: %w", err)
+		}
+		if err := g.Validate(); err != nil {
+			return nil, err
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wg, err := wrapGroup(g, key, optsData)
+		if err != nil {
+			return nil, err
+		}
+		wk.Groups = append(wk.Groups, *wg)
+	}
+	return json.Marshal(&wk)
+}
+
+// wrapGroup encrypts optsData with key and wraps the shares of key for the
+// recipients of the group; key and its shares are wiped once they are used
+func wrapGroup(g Group, key, optsData []byte) (*wrappedGroup, error) {
+	defer securemem.Wipe(key)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := split(key, g.Threshold, len(g.PublicKeys))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, s := range shares {
+			securemem.Wipe(s)
+		}
+	}()
+	wg := &wrappedGroup{
+		Threshold:  g.Threshold,
+		IV:         b64.EncodeToString(iv),
+		Ciphertext: b64.EncodeToString(aead.Seal(nil, iv, optsData, []byte(strconv.Itoa(g.Threshold)))),
+	}
+	for i, data := range g.PublicKeys {
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+		s, err := wrapShare(pub, shares[i])
+		if err != nil {
+			return nil, err
+		}
+		s.X = i + 1
+		wg.Shares = append(wg.Shares, *s)
+	}
+	return wg, nil
+}
+
+func wrapShare(pub interface{}, data []byte) (*share, error) {
+	var alg jose.KeyAlgorithm
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return nil, fmt.Errorf("threshold recipients must have RSA or EC keys, not %T", pub)
+	}
+	p := algpolicy.Current()
+	if err := p.CheckPublicKey(pub); err != nil {
+		return nil, err
+	}
+	if err := p.CheckJWEAlgorithm(string(alg)); err != nil {
+		return nil, err
+	}
+	kid, err := keyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: pub}, nil)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := enc.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	s, err := obj.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return &share{Kid: kid, Alg: string(alg), JWE: s}, nil
+}
+
+// keyID identifies a recipient like the key metadata of layers, by the
+// SHA-256 digest of its DER encoded public key
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// UnwrapKey unwraps the optsData with the private keys of the DecryptConfig,
+// which must unwrap at least the threshold of the shares of a group
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	if fips.Enabled() {
+		if err := fips.CheckScheme(Scheme); err != nil {
+			return nil, err
+		}
+	}
+	wk, err := parse(annotation)
+	if err != nil {
+		return nil, err
+	}
+	l := logging.G(tracing.Context(dc))
+	privKeys := privateKeys(dc)
+	var best, threshold int
+	for _, wg := range wk.Groups {
+		shares := make(map[byte][]byte)
+		var kids []string
+		for _, s := range wg.Shares {
+			priv, ok := privKeys[s.Kid]
+			if !ok || s.X < 1 || s.X > maxShares {
+				continue
+			}
+			obj, err := jose.ParseEncrypted(s.JWE)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse share: %w", err)
+			}
+			data, err := obj.Decrypt(priv)
+			if err != nil {
+				l.Debug("share matched the key id but could not be unwrapped", "kid", s.Kid, "error", err)
+				continue
+			}
+			shares[byte(s.X)] = data
+			kids = append(kids, s.Kid)
+		}
+		if len(shares) > best || best == 0 {
+			best, threshold = len(shares), wg.Threshold
+		}
+		if len(shares) < wg.Threshold {
+			wipeShares(shares)
+			continue
+		}
+		optsData, err := openGroup(wg, shares)
+		wipeShares(shares)
+		if err != nil {
+			return nil, err
+		}
+		l.Debug("threshold group unwrapped", "shares", len(shares), "threshold", wg.Threshold)
+		matched.Report(tracing.Context(dc), strings.Join(kids, ","))
+		return optsData, nil
+	}
+	return nil, fmt.Errorf("%w: %d of %d", ErrNotEnoughShares, best, threshold)
+}
+
+// wipeShares wipes the unwrapped shares of a group key
+func wipeShares(shares map[byte][]byte) {
+	for _, s := range shares {
+		securemem.Wipe(s)
+	}
+}
+
+func openGroup(wg wrappedGroup, shares map[byte][]byte) ([]byte, error) {
+	key, err := combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Wipe(key)
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := b64.DecodeString(wg.IV)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := b64.DecodeString(wg.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, errors.New("invalid IV")
+	}
+	optsData, err := aead.Open(nil, iv, ct, []byte(strconv.Itoa(wg.Threshold)))
+	if err != nil {
+		return nil, fmt.Errorf("threshold wrapped layer key could not be recovered: %w", err)
+	}
+	return optsData, nil
+}
+
+// privateKeys returns the private keys of the DecryptConfig by key ID
+func privateKeys(dc *encconfig.DecryptConfig) map[string]interface{} {
+	keys := make(map[string]interface{})
+	passwords := dc.Parameters[parameterPasswords]
+	for i, data := range dc.Parameters[parameterPrivateKeys] {
+		var password []byte
+		if i < len(passwords) {
+			password = passwords[i]
+		}
+		key, err := encutils.ParsePrivateKey(data, password, "THRESHOLD")
+		if err != nil {
+			continue
+		}
+		if jwk, ok := key.(*jose.JSONWebKey); ok {
+			key = jwk.Key
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			continue
+		}
+		if kid, err := keyID(signer.Public()); err == nil {
+			keys[kid] = key
+		}
+	}
+	return keys
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parse(annotation []byte) (*wrappedKeys, error) {
+	var wk wrappedKeys
+	if err := json.Unmarshal(annotation, &wk); err != nil {
+		return nil, fmt.Errorf("could not parse threshold wrapped keys: %w", err)
+	}
+	if len(wk.Groups) == 0 {
+		return nil, errors.New("threshold wrapped keys have no groups")
+	}
+	return &wk, nil
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(dcparameters[parameterPrivateKeys]) == 0
+}
+
+func (kw *keyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters[parameterPrivateKeys]
+}
+
+func (kw *keyWrapper) GetKeyIdsFromPacket(string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the threshold and key IDs of the recipients of the
+// wrapped keys
+func (kw *keyWrapper) GetRecipients(b64s string) ([]string, error) {
+	var recipients []string
+	for _, b64wk := range strings.Split(b64s, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64wk)
+		if err != nil {
+			return nil, err
+		}
+		wk, err := parse(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, wg := range wk.Groups {
+			for _, s := range wg.Shares {
+				recipients = append(recipients, fmt.Sprintf("[threshold %d-of-%d] %s", wg.Threshold, len(wg.Shares), s.Kid))
+			}
+		}
+	}
+	return recipients, nil
+}
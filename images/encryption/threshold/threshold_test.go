@@ -0,0 +1,167 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package threshold
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3"
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := split(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, xs := range [][]byte{{1, 2, 3}, {5, 3, 1}, {2, 4, 5, 1}} {
+		subset := make(map[byte][]byte)
+		for _, x := range xs {
+			subset[x] = shares[x-1]
+		}
+		got, err := combine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("shares %v recovered %x", xs, got)
+		}
+	}
+	got, err := combine(map[byte][]byte{1: shares[0], 2: shares[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("two of three required shares recovered the secret")
+	}
+}
+
+// keyPair returns the PEM encoded public and private key of a new key
+func keyPair(t *testing.T, ec bool) ([]byte, []byte) {
+	var (
+		priv interface{}
+		pub  interface{}
+		err  error
+	)
+	if ec {
+		var k *ecdsa.PrivateKey
+		k, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		priv, pub = k, &k.PublicKey
+	} else {
+		var k *rsa.PrivateKey
+		k, err = rsa.GenerateKey(rand.Reader, 2048)
+		priv, pub = k, &k.PublicKey
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	var pubs, privs [][]byte
+	for i := 0; i < 3; i++ {
+		pub, priv := keyPair(t, i == 1)
+		pubs = append(pubs, pub)
+		privs = append(privs, priv)
+	}
+	cc, err := EncryptWithGroups(Group{Threshold: 2, PublicKeys: pubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := &keyWrapper{}
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+	annotation, err := kw.WrapKeys(cc.EncryptConfig, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := func(keys ...[]byte) *encconfig.DecryptConfig {
+		return &encconfig.DecryptConfig{Parameters: map[string][][]byte{parameterPrivateKeys: keys}}
+	}
+	got, err := kw.UnwrapKey(dc(privs[2], privs[1]), annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, optsData) {
+		t.Fatalf("unwrapped %q", got)
+	}
+	if _, err := kw.UnwrapKey(dc(privs[0]), annotation); !errors.Is(err, ErrNotEnoughShares) {
+		t.Fatalf("expected a single key to be refused, got %v", err)
+	}
+	_, otherPriv := keyPair(t, true)
+	if _, err := kw.UnwrapKey(dc(privs[0], otherPriv), annotation); !errors.Is(err, ErrNotEnoughShares) {
+		t.Fatalf("expected an unrelated key not to count, got %v", err)
+	}
+}
+
+func TestGroupValidate(t *testing.T) {
+	pub, _ := keyPair(t, true)
+	other, _ := keyPair(t, false)
+	// the same key as a JWK, whose encoding differs from the PEM one
+	parsed, err := parsePublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := (&jose.JSONWebKey{Key: parsed}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []Group{
+		{Threshold: 1, PublicKeys: [][]byte{pub, other}},
+		{Threshold: 3, PublicKeys: [][]byte{pub, other}},
+		{Threshold: 2, PublicKeys: [][]byte{pub, []byte("not a key")}},
+		{Threshold: 2, PublicKeys: [][]byte{pub, pub}},
+		{Threshold: 2, PublicKeys: [][]byte{pub, other, jwk}},
+	} {
+		if err := g.Validate(); err == nil {
+			t.Fatalf("expected %d-of-%d group to be invalid", g.Threshold, len(g.PublicKeys))
+		}
+	}
+	if err := (Group{Threshold: 2, PublicKeys: [][]byte{pub, other}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWrapGroupWipesKey(t *testing.T) {
+	pub, _ := keyPair(t, true)
+	other, _ := keyPair(t, true)
+	key := bytes.Repeat([]byte{0xaa}, 32)
+	if _, err := wrapGroup(Group{Threshold: 2, PublicKeys: [][]byte{pub, other}}, key, []byte("opts")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, make([]byte, 32)) {
+		t.Fatal("group key was not wiped")
+	}
+}
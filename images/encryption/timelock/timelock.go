@@ -0,0 +1,355 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package timelock wraps layer keys for a time-lock service, so that images
+// such as embargoed releases cannot be decrypted before an unlock time. The
+// service publishes a public key for every unlock time and releases the
+// private key only once that time has passed:
+//
+//	GET <service>/v1/timelock/<unix-time>/public
+//	  {"kid": "...", "publicKey": "<PEM>", "unlockTime": "2026-12-01T00:00:00Z"}
+//	GET <service>/v1/timelock/<unix-time>/private
+//	  {"kid": "...", "privateKey": "<PEM>"}, or 425 Too Early before the unlock time
+//
+// The service may round the unlock time up to the epochs it has keys for.
+// The layer key is wrapped in a JWE for the public key; decryption fails with
+// a LockedError before the unlock time, which is checked against the local
+// clock before the service is asked.
+package timelock
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/algpolicy"
+	"github.com/containerd/imgcrypt/images/encryption/keyprovider"
+	"github.com/go-jose/go-jose/v3"
+	encconfig "github.com/gobars/ocicrypt/config"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+// ProviderName is the name of the keyprovider timelock:<unlock-time>@<service>
+// recipients are passed to
+const ProviderName = "timelock"
+
+// Timeout limits the time a single request to a time-lock service may take
+var Timeout = 30 * time.Second
+
+// ErrLocked is wrapped by LockedError
+var ErrLocked = errors.New("layer key is time-locked")
+
+// LockedError is returned when a layer key is unwrapped before its unlock time
+type LockedError struct {
+	UnlockTime time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s until %s (%s from now)", ErrLocked, e.UnlockTime.UTC().Format(time.RFC3339), time.Until(e.UnlockTime).Round(time.Second))
+}
+
+// Is makes a LockedError match ErrLocked
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Config holds the settings for connecting to time-lock services
+type Config struct {
+	// TLSConfig holds the CA bundle the services are verified with and the
+	// client certificate and key
+	keyprovider.TLSConfig
+	// TokenFile holds a bearer token sent to the services
+	TokenFile string `json:"token-file,omitempty"`
+}
+
+// LoadConfig reads a Config from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse time-lock configuration %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// ParseRecipient splits a <unlock-time>@<service> recipient into the unlock
+// time, given in RFC 3339 format or as Unix time, and the URL of the service
+func ParseRecipient(recipient string) (time.Time, string, error) {
+	at, service, ok := strings.Cut(recipient, "@")
+	if !ok || at == "" || service == "" {
+		return time.Time{}, "", fmt.Errorf("invalid time-lock recipient %q: expected <unlock-time>@<service-url>", recipient)
+	}
+	if !strings.HasPrefix(service, "https://") && !strings.HasPrefix(service, "http://") {
+		return time.Time{}, "", fmt.Errorf("invalid time-lock recipient %q: the service must be an http or https URL", recipient)
+	}
+	if secs, err := strconv.ParseInt(at, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), strings.TrimSuffix(service, "/"), nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid unlock time %q: expected RFC 3339 or Unix time", at)
+	}
+	return t.UTC(), strings.TrimSuffix(service, "/"), nil
+}
+
+// AnnotationPacket is a layer key wrapped for the key of an unlock time; the
+// keyprovider annotation of a layer holds a JSON array of them, one per
+// recipient
+type AnnotationPacket struct {
+	Service    string    `json:"service"`
+	UnlockTime time.Time `json:"unlockTime"`
+	KeyID      string    `json:"kid"`
+	// JWE is the compact serialization of the wrapped layer key
+	JWE string `json:"jwe"`
+}
+
+// Provider is an in-process keyprovider wrapping layer keys for time-lock
+// services
+type Provider struct {
+	Config *Config
+
+	mu   sync.Mutex
+	keys map[string]interface{}
+}
+
+// Install registers a Provider with the given configuration, which may be
+// nil, as the keyprovider named ProviderName
+func Install(c *Config) {
+	if c == nil {
+		c = &Config{}
+	}
+	keyprovider.RegisterKeyProvider(ProviderName, &Provider{Config: c})
+}
+
+// UnlockTimes returns the unlock times of the time-locked keys in a
+// keyprovider annotation
+func UnlockTimes(annotation []byte) ([]time.Time, error) {
+	var packets []AnnotationPacket
+	if err := json.Unmarshal(annotation, &packets); err != nil {
+		return nil, fmt.Errorf("invalid time-lock annotation: %w", err)
+	}
+	var times []time.Time
+	for _, pkt := range packets {
+		times = append(times, pkt.UnlockTime)
+	}
+	return times, nil
+}
+
+type publicKeyResponse struct {
+	KeyID      string    `json:"kid"`
+	PublicKey  string    `json:"publicKey"`
+	UnlockTime time.Time `json:"unlockTime"`
+}
+
+type privateKeyResponse struct {
+	KeyID      string `json:"kid"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// WrapKey implements keyprovider.KeyProvider
+func (p *Provider) WrapKey(ctx context.Context, ec *encconfig.EncryptConfig, optsData []byte) ([]byte, error) {
+	var packets []AnnotationPacket
+	for _, r := range ec.Parameters[ProviderName] {
+		at, service, err := ParseRecipient(string(r))
+		if err != nil {
+			return nil, err
+		}
+		var resp publicKeyResponse
+		if err := p.get(ctx, service, at, "public", &resp); err != nil {
+			return nil, fmt.Errorf("failed to get the time-lock key of %s: %w", at.Format(time.RFC3339), err)
+		}
+		if resp.UnlockTime.Before(at) {
+			return nil, fmt.Errorf("time-lock service %s returned a key unlocking at %s, before %s", service, resp.UnlockTime.Format(time.RFC3339), at.Format(time.RFC3339))
+		}
+		pub, err := encutils.ParsePublicKey([]byte(resp.PublicKey), "TIMELOCK")
+		if err != nil {
+			return nil, err
+		}
+		jwe, err := wrap(pub, optsData)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, AnnotationPacket{Service: service, UnlockTime: resp.UnlockTime.UTC(), KeyID: resp.KeyID, JWE: jwe})
+	}
+	if len(packets) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(packets)
+}
+
+func wrap(pub interface{}, optsData []byte) (string, error) {
+	if jwk, ok := pub.(*jose.JSONWebKey); ok {
+		pub = jwk.Key
+	}
+	var alg jose.KeyAlgorithm
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return "", fmt.Errorf("time-lock keys must be RSA or EC keys, not %T", pub)
+	}
+	policy := algpolicy.Current()
+	if err := policy.CheckPublicKey(pub); err != nil {
+		return "", err
+	}
+	if err := policy.CheckJWEAlgorithm(string(alg)); err != nil {
+		return "", err
+	}
+	enc, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: pub}, nil)
+	if err != nil {
+		return "", err
+	}
+	obj, err := enc.Encrypt(optsData)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+// UnwrapKey implements keyprovider.KeyProvider; the packets are tried in
+// turn, and a LockedError for the earliest unlock time is returned if all of
+// them are still locked
+func (p *Provider) UnwrapKey(ctx context.Context, _ *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	var packets []AnnotationPacket
+	if err := json.Unmarshal(annotation, &packets); err != nil {
+		return nil, fmt.Errorf("invalid time-lock annotation: %w", err)
+	}
+	var (
+		locked *LockedError
+		errs   []string
+	)
+	for _, pkt := range packets {
+		optsData, err := p.unwrap(ctx, &pkt)
+		if err == nil {
+			return optsData, nil
+		}
+		var le *LockedError
+		if errors.As(err, &le) {
+			if locked == nil || le.UnlockTime.Before(locked.UnlockTime) {
+				locked = le
+			}
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", pkt.Service, err))
+	}
+	switch {
+	case len(errs) > 0:
+		return nil, errors.New(strings.Join(errs, "; "))
+	case locked != nil:
+		return nil, locked
+	}
+	return nil, errors.New("time-lock annotation holds no wrapped keys")
+}
+
+func (p *Provider) unwrap(ctx context.Context, pkt *AnnotationPacket) ([]byte, error) {
+	if time.Now().Before(pkt.UnlockTime) {
+		return nil, &LockedError{UnlockTime: pkt.UnlockTime}
+	}
+	priv, err := p.privateKey(ctx, pkt)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := jose.ParseEncrypted(pkt.JWE)
+	if err != nil {
+		return nil, err
+	}
+	return obj.Decrypt(priv)
+}
+
+// privateKey returns the private key of the unlock time of the packet, which
+// is cached since the layers of an image are typically locked until the same
+// time
+func (p *Provider) privateKey(ctx context.Context, pkt *AnnotationPacket) (interface{}, error) {
+	cacheKey := pkt.Service + "@" + strconv.FormatInt(pkt.UnlockTime.Unix(), 10)
+	p.mu.Lock()
+	priv, ok := p.keys[cacheKey]
+	p.mu.Unlock()
+	if ok {
+		return priv, nil
+	}
+	var resp privateKeyResponse
+	if err := p.get(ctx, pkt.Service, pkt.UnlockTime, "private", &resp); err != nil {
+		return nil, err
+	}
+	if pkt.KeyID != "" && resp.KeyID != "" && resp.KeyID != pkt.KeyID {
+		return nil, fmt.Errorf("time-lock service returned key %s instead of %s", resp.KeyID, pkt.KeyID)
+	}
+	priv, err := encutils.ParsePrivateKey([]byte(resp.PrivateKey), nil, "TIMELOCK")
+	if err != nil {
+		return nil, err
+	}
+	if jwk, ok := priv.(*jose.JSONWebKey); ok {
+		priv = jwk.Key
+	}
+	p.mu.Lock()
+	if p.keys == nil {
+		p.keys = make(map[string]interface{})
+	}
+	p.keys[cacheKey] = priv
+	p.mu.Unlock()
+	return priv, nil
+}
+
+func (p *Provider) get(ctx context.Context, service string, at time.Time, kind string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/timelock/%d/%s", service, at.Unix(), kind), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.Config.TokenFile != "" {
+		token, err := os.ReadFile(p.Config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read time-lock token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	tlsConfig, err := p.Config.TLSConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooEarly {
+		// the local clock is ahead of the service
+		return &LockedError{UnlockTime: at}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("time-lock service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
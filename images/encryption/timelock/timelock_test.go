@@ -0,0 +1,179 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package timelock
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+)
+
+// service is a time-lock service with one key for every unlock time
+type service struct {
+	keys     map[int64]*ecdsa.PrivateKey
+	requests int
+}
+
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/timelock/"), "/")
+	if len(parts) != 2 || r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	at, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, ok := s.keys[at]
+	if !ok {
+		key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		s.keys[at] = key
+	}
+	kid := fmt.Sprintf("key-%d", at)
+	switch parts[1] {
+	case "public":
+		der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		_ = json.NewEncoder(w).Encode(publicKeyResponse{
+			KeyID:      kid,
+			PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			UnlockTime: time.Unix(at, 0),
+		})
+	case "private":
+		if time.Now().Before(time.Unix(at, 0)) {
+			http.Error(w, "too early", http.StatusTooEarly)
+			return
+		}
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		_ = json.NewEncoder(w).Encode(privateKeyResponse{
+			KeyID:      kid,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	at, service, err := ParseRecipient("2030-01-01T00:00:00+01:00@https://timelock.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(time.Date(2029, 12, 31, 23, 0, 0, 0, time.UTC)) || service != "https://timelock.example.com" {
+		t.Fatalf("unexpected unlock time %s or service %s", at, service)
+	}
+	if at, _, err = ParseRecipient("1893456000@http://localhost:8080"); err != nil || at.Unix() != 1893456000 {
+		t.Fatalf("unexpected unlock time %s or error %v", at, err)
+	}
+	for _, r := range []string{"2030-01-01", "2030-01-01T00:00:00Z@", "tomorrow@https://timelock.example.com", "1893456000@timelock.example.com"} {
+		if _, _, err := ParseRecipient(r); err == nil {
+			t.Fatalf("expected %q to be rejected", r)
+		}
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	s := &service{keys: make(map[int64]*ecdsa.PrivateKey)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	tokenFile := t.TempDir() + "/token"
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{Config: &Config{TokenFile: tokenFile}}
+	ctx := context.Background()
+	optsData := []byte(`{"symkey":"c2VjcmV0"}`)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	wrap := func(at time.Time) []byte {
+		ec := &encconfig.EncryptConfig{Parameters: map[string][][]byte{
+			ProviderName: {[]byte(fmt.Sprintf("%d@%s", at.Unix(), srv.URL))},
+		}}
+		annotation, err := p.WrapKey(ctx, ec, optsData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return annotation
+	}
+
+	// a key whose unlock time has passed is released by the service
+	unlocked := wrap(past)
+	got, err := p.UnwrapKey(ctx, &encconfig.DecryptConfig{}, unlocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(optsData) {
+		t.Fatalf("expected %s, but got %s", optsData, got)
+	}
+
+	// the private key is cached
+	requests := s.requests
+	if _, err := p.UnwrapKey(ctx, &encconfig.DecryptConfig{}, unlocked); err != nil {
+		t.Fatal(err)
+	}
+	if s.requests != requests {
+		t.Fatalf("expected the private key to be cached")
+	}
+
+	// a key whose unlock time lies ahead is not requested from the service
+	locked := wrap(future)
+	_, err = p.UnwrapKey(ctx, &encconfig.DecryptConfig{}, locked)
+	var le *LockedError
+	if !errors.As(err, &le) || !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a LockedError, but got %v", err)
+	}
+	if !le.UnlockTime.Equal(future) {
+		t.Fatalf("expected unlock time %s, but got %s", future, le.UnlockTime)
+	}
+	if s.requests != requests+1 {
+		t.Fatalf("expected the service not to be asked for a locked key")
+	}
+
+	// the service refuses to release the key if the local clock is ahead
+	pkt := []AnnotationPacket{}
+	if err := json.Unmarshal(locked, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	p2 := &Provider{Config: p.Config}
+	if _, err := p2.privateKey(ctx, &pkt[0]); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the service to refuse the key with ErrLocked, but got %v", err)
+	}
+
+	times, err := UnlockTimes(locked)
+	if err != nil || len(times) != 1 || !times[0].Equal(future) {
+		t.Fatalf("unexpected unlock times %v or error %v", times, err)
+	}
+}
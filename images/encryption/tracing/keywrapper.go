@@ -0,0 +1,68 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"sync"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SchemeKey is the attribute holding the wrap scheme of a span
+const SchemeKey = attribute.Key("imgcrypt.scheme")
+
+// tracedSchemes are the schemes whose key wrappers are traced; keyproviders
+// trace their calls themselves
+var tracedSchemes = []string{"jwe", "pkcs7", "pgp", "pkcs11", "jwe-hybrid"}
+
+// keyWrapper creates spans for the wrapping and unwrapping of layer keys
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	scheme string
+}
+
+var installOnce sync.Once
+
+// Install wraps the key wrappers registered with ocicrypt so that they create
+// spans from the context bound to the configuration they are called with. It
+// must be called after the other key wrappers are installed.
+func Install() {
+	installOnce.Do(func() {
+		for _, scheme := range tracedSchemes {
+			if kw := ocicrypt.GetKeyWrapper(scheme); kw != nil {
+				ocicrypt.RegisterKeyWrapper(scheme, &keyWrapper{kw, scheme})
+			}
+		}
+	})
+}
+
+func (kw *keyWrapper) WrapKeys(ec *encconfig.EncryptConfig, optsData []byte) (wrapped []byte, err error) {
+	ctx, span := Start(Context(ec), "imgcrypt.WrapKeys", SchemeKey.String(kw.scheme))
+	defer func() { End(span, err) }()
+	defer Bind(ctx, ec)()
+	return kw.KeyWrapper.WrapKeys(ec, optsData)
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) (optsData []byte, err error) {
+	ctx, span := Start(Context(dc), "imgcrypt.UnwrapKey", SchemeKey.String(kw.scheme))
+	defer func() { End(span, err) }()
+	defer Bind(ctx, dc)()
+	return kw.KeyWrapper.UnwrapKey(dc, annotation)
+}
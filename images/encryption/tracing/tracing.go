@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tracing creates OpenTelemetry spans for the encryption and
+// decryption of images with the global tracer provider, so that the time of
+// slow pulls can be attributed to key services, cryptography or IO.
+//
+// ocicrypt calls key wrappers without a context. The context of an operation
+// is therefore bound to its EncryptConfig or DecryptConfig with Bind, and the
+// key wrappers installed by Install start their spans from it.
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer the spans are created with
+const TracerName = "github.com/containerd/imgcrypt"
+
+// Start starts a span with the given name and attributes as child of the span
+// in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err in the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type binding struct {
+	ctx context.Context
+}
+
+var (
+	bindingsMu sync.Mutex
+	bindings   = make(map[interface{}][]*binding)
+)
+
+// Bind makes ctx the context of the operations done with config, which is a
+// pointer to an EncryptConfig or DecryptConfig, until the returned function
+// is called. If config is bound several times, the latest context is used.
+func Bind(ctx context.Context, config interface{}) func() {
+	b := &binding{ctx: ctx}
+	bindingsMu.Lock()
+	bindings[config] = append(bindings[config], b)
+	bindingsMu.Unlock()
+	return func() {
+		bindingsMu.Lock()
+		defer bindingsMu.Unlock()
+		bs := bindings[config]
+		for i := range bs {
+			if bs[i] == b {
+				bs = append(bs[:i], bs[i+1:]...)
+				break
+			}
+		}
+		if len(bs) == 0 {
+			delete(bindings, config)
+		} else {
+			bindings[config] = bs
+		}
+	}
+}
+
+// Context returns the context bound to config, or the background context
+func Context(config interface{}) context.Context {
+	bindingsMu.Lock()
+	defer bindingsMu.Unlock()
+	if bs := bindings[config]; len(bs) > 0 {
+		return bs[len(bs)-1].ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type failingKeyWrapper struct {
+	keywrap.KeyWrapper
+}
+
+func (failingKeyWrapper) UnwrapKey(*encconfig.DecryptConfig, []byte) ([]byte, error) {
+	return nil, errors.New("no matching key")
+}
+
+func TestBind(t *testing.T) {
+	dc := &encconfig.DecryptConfig{}
+	if Context(dc) != context.Background() {
+		t.Fatal("unbound config has a context")
+	}
+	ctx1 := context.WithValue(context.Background(), struct{}{}, 1)
+	ctx2 := context.WithValue(context.Background(), struct{}{}, 2)
+	unbind1 := Bind(ctx1, dc)
+	unbind2 := Bind(ctx2, dc)
+	if Context(dc) != ctx2 {
+		t.Fatal("latest context not used")
+	}
+	unbind2()
+	if Context(dc) != ctx1 {
+		t.Fatal("previous context not restored")
+	}
+	unbind1()
+	if Context(dc) != context.Background() {
+		t.Fatal("context still bound")
+	}
+}
+
+func TestUnwrapKeySpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(tp)
+
+	dc := &encconfig.DecryptConfig{}
+	ctx, parent := Start(context.Background(), "pull")
+	unbind := Bind(ctx, dc)
+	kw := &keyWrapper{failingKeyWrapper{}, "jwe"}
+	if _, err := kw.UnwrapKey(dc, nil); err == nil {
+		t.Fatal("expected unwrapping to fail")
+	}
+	unbind()
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "imgcrypt.UnwrapKey" {
+		t.Fatalf("got span %q", span.Name())
+	}
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("span is not a child of the bound context's span")
+	}
+	if span.Status().Code != codes.Error {
+		t.Fatalf("got status %v, want error", span.Status().Code)
+	}
+	var scheme string
+	for _, a := range span.Attributes() {
+		if a.Key == SchemeKey {
+			scheme = a.Value.AsString()
+		}
+	}
+	if scheme != "jwe" {
+		t.Fatalf("got scheme %q, want jwe", scheme)
+	}
+}
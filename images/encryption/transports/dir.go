@@ -0,0 +1,308 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transports
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The files of the directory format of containers/image: the version file,
+// the manifest of the image and the manifests of the instances of an index
+// named after their digest; other blobs are named after their digest alone
+const (
+	dirVersionFile    = "version"
+	dirVersion        = "Directory Transport Version: 1.1\n"
+	dirManifestFile   = "manifest.json"
+	dirManifestSuffix = ".manifest.json"
+)
+
+// dirSource reads an image from a directory
+type dirSource struct {
+	dir    string
+	target ocispec.Descriptor
+}
+
+func newDirSource(ref Reference) (*dirSource, error) {
+	b, err := os.ReadFile(filepath.Join(ref.Path, dirVersionFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an image directory: %w", ref.Path, err)
+	}
+	if string(b) != dirVersion {
+		return nil, fmt.Errorf("unsupported image directory version %q in %s", string(b), ref.Path)
+	}
+	manifest, err := os.ReadFile(filepath.Join(ref.Path, dirManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := detectMediaType(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the manifest in %s: %w", ref.Path, err)
+	}
+	return &dirSource{
+		dir: ref.Path,
+		target: ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+		},
+	}, nil
+}
+
+// detectMediaType returns the media type of a manifest or index, which the
+// directory format does not record
+func detectMediaType(b []byte) (string, error) {
+	var m struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", err
+	}
+	switch {
+	case m.MediaType != "":
+		return m.MediaType, nil
+	case m.Manifests != nil:
+		return ocispec.MediaTypeImageIndex, nil
+	case m.Config.MediaType == images.MediaTypeDockerSchema2Config:
+		return images.MediaTypeDockerSchema2Manifest, nil
+	}
+	return ocispec.MediaTypeImageManifest, nil
+}
+
+func (s *dirSource) Target(ctx context.Context) (ocispec.Descriptor, error) {
+	return s.target, nil
+}
+
+func (s *dirSource) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	names := []string{desc.Digest.Encoded()}
+	switch {
+	case desc.Digest == s.target.Digest:
+		names = []string{dirManifestFile}
+	case images.IsManifestType(desc.MediaType) || images.IsIndexType(desc.MediaType):
+		names = []string{desc.Digest.Encoded() + dirManifestSuffix, desc.Digest.Encoded()}
+	}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(s.dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileReaderAt{f, fi.Size()}, nil
+	}
+	return nil, fmt.Errorf("blob %s in %s: %w", desc.Digest, s.dir, errdefs.ErrNotFound)
+}
+
+func (s *dirSource) Close() error {
+	return nil
+}
+
+// fileReaderAt reads a blob from a file
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (r *fileReaderAt) Size() int64 {
+	return r.size
+}
+
+// dirDestination writes an image to a directory
+type dirDestination struct {
+	dir string
+}
+
+// newDirDestination returns the destination of an image directory, which may
+// not exist yet; the files of an image already in it are removed, and other
+// files are not overwritten
+func newDirDestination(ref Reference) (*dirDestination, error) {
+	entries, err := os.ReadDir(ref.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.MkdirAll(ref.Path, 0755); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case len(entries) > 0:
+		if _, err := os.Stat(filepath.Join(ref.Path, dirVersionFile)); err != nil {
+			return nil, fmt.Errorf("%s is not empty and not an image directory", ref.Path)
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(ref.Path, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &dirDestination{dir: ref.Path}, nil
+}
+
+func (d *dirDestination) Put(ctx context.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error {
+	if _, err := imgenc.CopyImage(ctx, src, d, desc, matcher(platform)); err != nil {
+		return err
+	}
+	name := desc.Digest.Encoded()
+	if images.IsManifestType(desc.MediaType) || images.IsIndexType(desc.MediaType) {
+		name += dirManifestSuffix
+	}
+	if err := os.Rename(filepath.Join(d.dir, name), filepath.Join(d.dir, dirManifestFile)); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(d.dir, dirVersionFile), []byte(dirVersion), 0644)
+}
+
+// Writer returns a writer of the blob described by the descriptor of the
+// options
+func (d *dirDestination) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, o := range opts {
+		if err := o(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	desc := wOpts.Desc
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("blob without a valid digest: %w", err)
+	}
+	name := desc.Digest.Encoded()
+	if images.IsManifestType(desc.MediaType) || images.IsIndexType(desc.MediaType) {
+		name += dirManifestSuffix
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, name)); err == nil {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
+	f, err := os.CreateTemp(d.dir, ".tmp-"+desc.Digest.Encoded()+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{
+		f:        f,
+		path:     filepath.Join(d.dir, name),
+		ref:      wOpts.Ref,
+		desc:     desc,
+		digester: digest.Canonical.Digester(),
+		started:  time.Now(),
+	}, nil
+}
+
+func (d *dirDestination) Close() error {
+	return nil
+}
+
+// dirWriter writes a blob to a temporary file that is renamed to the file of
+// the blob when it is committed
+type dirWriter struct {
+	f         *os.File
+	path      string
+	ref       string
+	desc      ocispec.Descriptor
+	digester  digest.Digester
+	offset    int64
+	started   time.Time
+	updated   time.Time
+	committed bool
+}
+
+func (w *dirWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.digester.Hash().Write(p[:n])
+	w.offset += int64(n)
+	w.updated = time.Now()
+	return n, err
+}
+
+func (w *dirWriter) Digest() digest.Digest {
+	return w.digester.Digest()
+}
+
+func (w *dirWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if size > 0 && size != w.offset {
+		return fmt.Errorf("unexpected commit size %d, expected %d: %w", w.offset, size, errdefs.ErrFailedPrecondition)
+	}
+	if dgst := w.Digest(); expected != "" && expected != dgst {
+		return fmt.Errorf("unexpected commit digest %s, expected %s: %w", dgst, expected, errdefs.ErrFailedPrecondition)
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(w.f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *dirWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.ref,
+		Offset:    w.offset,
+		Total:     w.desc.Size,
+		Expected:  w.desc.Digest,
+		StartedAt: w.started,
+		UpdatedAt: w.updated,
+	}, nil
+}
+
+func (w *dirWriter) Truncate(size int64) error {
+	if size != 0 {
+		return fmt.Errorf("cannot truncate a blob to %d bytes: %w", size, errdefs.ErrInvalidArgument)
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.digester = digest.Canonical.Digester()
+	w.offset = 0
+	return nil
+}
+
+func (w *dirWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layoutSource reads an image from an OCI image layout
+type layoutSource struct {
+	*ocilayout.Layout
+	name string
+}
+
+func newLayoutSource(ref Reference) (*layoutSource, error) {
+	l, err := ocilayout.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &layoutSource{Layout: l, name: ref.Name}, nil
+}
+
+// Target returns the image with the reference name, or the only image of the
+// layout if the reference has no name, as containers/image does
+func (s *layoutSource) Target(ctx context.Context) (ocispec.Descriptor, error) {
+	if s.name != "" {
+		return s.Resolve(s.name)
+	}
+	idx, err := s.Index()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(idx.Manifests) != 1 {
+		return ocispec.Descriptor{}, fmt.Errorf("the OCI image layout has %d images; select one with oci:<path>:<ref>", len(idx.Manifests))
+	}
+	desc := idx.Manifests[0]
+	// the name annotations belong to the index, not to the image
+	if name := desc.Annotations[ocispec.AnnotationRefName]; name != "" {
+		return s.Resolve(name)
+	}
+	if name := desc.Annotations[images.AnnotationImageName]; name != "" {
+		return s.Resolve(name)
+	}
+	return desc, nil
+}
+
+// layoutDestination writes an image to an OCI image layout
+type layoutDestination struct {
+	*ocilayout.Layout
+	name string
+}
+
+func newLayoutDestination(ref Reference) (*layoutDestination, error) {
+	if ref.Name == "" {
+		return nil, errors.New("a reference name is needed to write to an OCI image layout, such as oci:<path>:latest")
+	}
+	l, err := ocilayout.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &layoutDestination{Layout: l, name: ref.Name}, nil
+}
+
+func (d *layoutDestination) Put(ctx context.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error {
+	if _, err := imgenc.CopyImage(ctx, src, d.Layout, desc, matcher(platform)); err != nil {
+		return err
+	}
+	return d.Tag(d.name, desc)
+}
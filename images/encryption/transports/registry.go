@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registrySource reads an image from a registry
+type registrySource struct {
+	fetcher remotes.Fetcher
+	target  ocispec.Descriptor
+}
+
+func newRegistrySource(ctx context.Context, ref Reference, opts Options) (*registrySource, error) {
+	if opts.Resolver == nil {
+		return nil, errors.New("no resolver for docker:// references")
+	}
+	name, desc, err := opts.Resolver.Resolve(ctx, ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := opts.Resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &registrySource{fetcher: fetcher, target: desc}, nil
+}
+
+func (s *registrySource) Target(ctx context.Context) (ocispec.Descriptor, error) {
+	return s.target, nil
+}
+
+// ReaderAt fetches the blob; it must be read from start to end, as blobs are
+// copied
+func (s *registrySource) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	rc, err := s.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &sequentialReaderAt{rc: rc, size: desc.Size}, nil
+}
+
+func (s *registrySource) Close() error {
+	return nil
+}
+
+// sequentialReaderAt reads a fetched blob, which can only be read in order
+type sequentialReaderAt struct {
+	rc     io.ReadCloser
+	size   int64
+	offset int64
+}
+
+func (r *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off != r.offset {
+		return 0, fmt.Errorf("fetched blobs can only be read sequentially, not at offset %d", off)
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.offset += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *sequentialReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *sequentialReaderAt) Close() error {
+	return r.rc.Close()
+}
+
+// registryDestination pushes an image to a registry
+type registryDestination struct {
+	ref  Reference
+	opts Options
+}
+
+// Put pushes the image along with the key blobs of its layers; unless src is a
+// content.Store, which pushing needs, the image is first copied into a
+// temporary OCI image layout. Non-distributable layers are not pushed.
+func (d *registryDestination) Put(ctx context.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error {
+	store, ok := src.(content.Store)
+	if !ok {
+		l, cleanup, err := tempLayout(d.opts.TmpDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if _, err := imgenc.CopyImage(ctx, src, l, desc, matcher(platform)); err != nil {
+			return err
+		}
+		store = l.Store()
+	}
+	pusher, err := d.opts.Resolver.Pusher(ctx, d.ref.Name)
+	if err != nil {
+		return err
+	}
+	return remotes.PushContent(ctx, pusher, desc, store, nil, platform, func(h images.Handler) images.Handler {
+		return remotes.SkipNonDistributableBlobs(imgenc.KeyBlobChildren(h))
+	})
+}
+
+func (d *registryDestination) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transports
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/dockerdaemon"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// stagedName is the name of the image in the temporary OCI image layouts that
+// skopeo copies images to and from
+const stagedName = "image"
+
+// stagedSource is an image copied into a temporary OCI image layout, which is
+// removed when the source is closed
+type stagedSource struct {
+	*ocilayout.Layout
+	target  ocispec.Descriptor
+	cleanup func()
+}
+
+func (s *stagedSource) Target(ctx context.Context) (ocispec.Descriptor, error) {
+	return s.target, nil
+}
+
+func (s *stagedSource) Close() error {
+	s.cleanup()
+	return nil
+}
+
+// newStorageSource copies the image from container storage into a temporary
+// OCI image layout with skopeo
+func newStorageSource(ctx context.Context, ref Reference, opts Options) (*stagedSource, error) {
+	l, cleanup, err := tempLayout(opts.TmpDir)
+	if err != nil {
+		return nil, err
+	}
+	staged := Reference{Transport: OCI, Path: l.Dir(), Name: stagedName}
+	if err := skopeoCopy(ctx, opts, ref, staged); err != nil {
+		cleanup()
+		return nil, err
+	}
+	desc, err := l.Resolve(stagedName)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &stagedSource{Layout: l, target: desc, cleanup: cleanup}, nil
+}
+
+// storageDestination writes an image to container storage with skopeo. Since
+// container storage keeps layers unpacked, skopeo can only store encrypted
+// layers it is able to decrypt.
+type storageDestination struct {
+	ref  Reference
+	opts Options
+}
+
+func (d *storageDestination) Put(ctx context.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error {
+	l, cleanup, err := tempLayout(d.opts.TmpDir)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, err := imgenc.CopyImage(ctx, src, l, desc, matcher(platform)); err != nil {
+		return err
+	}
+	if err := l.Tag(stagedName, desc); err != nil {
+		return err
+	}
+	return skopeoCopy(ctx, d.opts, Reference{Transport: OCI, Path: l.Dir(), Name: stagedName}, d.ref)
+}
+
+func (d *storageDestination) Close() error {
+	return nil
+}
+
+// skopeoCopy copies an image between two references with skopeo
+func skopeoCopy(ctx context.Context, opts Options, src, dst Reference) error {
+	skopeo := opts.Skopeo
+	if skopeo == "" {
+		skopeo = "skopeo"
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, skopeo, "copy", "--quiet", src.String(), dst.String())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("skopeo copy %s %s: %w: %s", src, dst, err, msg)
+		}
+		return fmt.Errorf("skopeo copy %s %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// newDaemonSource imports the image saved by the Docker engine into a
+// temporary OCI image layout
+func newDaemonSource(ctx context.Context, ref Reference, opts Options) (*stagedSource, error) {
+	d, err := dockerdaemon.New(opts.DockerHost)
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.Save(ctx, ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	l, cleanup, err := tempLayout(opts.TmpDir)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := dockerdaemon.Import(ctx, r, l.Store())
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &stagedSource{Layout: l, target: desc, cleanup: cleanup}, nil
+}
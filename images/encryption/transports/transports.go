@@ -0,0 +1,279 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package transports reads and writes images at the locations named by the
+// transport strings of the containers/image ecosystem, such as those skopeo
+// and podman take, so that imgcrypt can copy images between registries, OCI
+// image layouts, directories and container storage and encrypt or decrypt
+// them on the way:
+//
+//	docker://docker.io/library/alpine:latest   an image in a registry
+//	oci:/path/to/layout[:ref]                  an image in an OCI image layout
+//	dir:/path/to/dir                           an image in a directory
+//	containers-storage:alpine:latest           an image in the storage of podman and CRI-O
+//	docker-daemon:alpine:latest                an image of the local Docker engine
+//
+// Registries are reached with the resolver given in the Options. Container
+// storage is read and written with skopeo; images of the Docker engine can
+// only be read.
+package transports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	imgenc "github.com/containerd/imgcrypt/images/encryption"
+	"github.com/containerd/imgcrypt/images/encryption/dockerdaemon"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The transports of the references
+const (
+	Docker            = "docker"
+	OCI               = "oci"
+	Dir               = "dir"
+	ContainersStorage = "containers-storage"
+	DockerDaemon      = "docker-daemon"
+)
+
+// prefixes are the prefixes of the transport strings by transport
+var prefixes = map[string]string{
+	Docker:            "docker://",
+	OCI:               "oci:",
+	Dir:               "dir:",
+	ContainersStorage: "containers-storage:",
+	DockerDaemon:      dockerdaemon.Prefix,
+}
+
+// Reference is a parsed transport string
+type Reference struct {
+	// Transport is one of the transports above
+	Transport string
+	// Path is the directory of oci: and dir: references
+	Path string
+	// Name is the image reference of docker://, containers-storage: and
+	// docker-daemon: references and the reference name of an oci: reference
+	Name string
+}
+
+// HasTransport returns whether s starts with the prefix of a transport, unlike
+// the names of images in containerd
+func HasTransport(s string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses a transport string; the references of docker:// are
+// normalized, so that docker://alpine refers to
+// docker.io/library/alpine:latest
+func Parse(s string) (Reference, error) {
+	for transport, prefix := range prefixes {
+		if !strings.HasPrefix(s, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(s, prefix)
+		if rest == "" {
+			return Reference{}, fmt.Errorf("invalid transport string %q: missing %s reference", s, transport)
+		}
+		switch transport {
+		case Docker:
+			named, err := docker.ParseDockerRef(rest)
+			if err != nil {
+				return Reference{}, fmt.Errorf("invalid transport string %q: %w", s, err)
+			}
+			return Reference{Transport: Docker, Name: named.String()}, nil
+		case OCI:
+			path, name, _ := strings.Cut(rest, ":")
+			if path == "" {
+				return Reference{}, fmt.Errorf("invalid transport string %q: missing OCI image layout directory", s)
+			}
+			return Reference{Transport: OCI, Path: path, Name: name}, nil
+		case Dir:
+			return Reference{Transport: Dir, Path: rest}, nil
+		default:
+			return Reference{Transport: transport, Name: rest}, nil
+		}
+	}
+	return Reference{}, fmt.Errorf("%q has no transport such as docker:// or oci:", s)
+}
+
+// String returns the transport string of the reference
+func (r Reference) String() string {
+	switch r.Transport {
+	case OCI:
+		if r.Name == "" {
+			return prefixes[OCI] + r.Path
+		}
+		return prefixes[OCI] + r.Path + ":" + r.Name
+	case Dir:
+		return prefixes[Dir] + r.Path
+	}
+	return prefixes[r.Transport] + r.Name
+}
+
+// Options configure how the images of references are reached
+type Options struct {
+	// Resolver resolves, fetches and pushes docker:// references, which
+	// cannot be used without one
+	Resolver remotes.Resolver
+	// Skopeo is the skopeo binary that copies containers-storage: images,
+	// "skopeo" from the PATH by default
+	Skopeo string
+	// DockerHost is the address of the Docker engine that docker-daemon:
+	// images are read from, as for dockerdaemon.New
+	DockerHost string
+	// TmpDir is the directory of the temporary OCI image layouts that images
+	// are staged in, the default directory for temporary files if empty
+	TmpDir string
+}
+
+// Source is an image read from a reference; its blobs are read with the
+// content.Provider
+type Source interface {
+	content.Provider
+	// Target returns the descriptor of the manifest or index of the image
+	Target(ctx context.Context) (ocispec.Descriptor, error)
+	// Close releases the resources of the source, such as the temporary
+	// layout it was staged in
+	Close() error
+}
+
+// Destination is where an image is written to
+type Destination interface {
+	// Put writes the image with the given target descriptor whose blobs
+	// src provides; only the manifests of the platforms matched by platform
+	// are written, or all if it is nil
+	Put(ctx context.Context, src content.Provider, desc ocispec.Descriptor, platform platforms.MatchComparer) error
+	// Close releases the resources of the destination
+	Close() error
+}
+
+// NewSource returns the source of the image of the reference
+func NewSource(ctx context.Context, ref Reference, opts Options) (Source, error) {
+	switch ref.Transport {
+	case Docker:
+		return newRegistrySource(ctx, ref, opts)
+	case OCI:
+		return newLayoutSource(ref)
+	case Dir:
+		return newDirSource(ref)
+	case ContainersStorage:
+		return newStorageSource(ctx, ref, opts)
+	case DockerDaemon:
+		return newDaemonSource(ctx, ref, opts)
+	}
+	return nil, fmt.Errorf("unknown transport %q", ref.Transport)
+}
+
+// NewDestination returns the destination of the image of the reference
+func NewDestination(ctx context.Context, ref Reference, opts Options) (Destination, error) {
+	switch ref.Transport {
+	case Docker:
+		if opts.Resolver == nil {
+			return nil, errors.New("no resolver for docker:// references")
+		}
+		return &registryDestination{ref: ref, opts: opts}, nil
+	case OCI:
+		return newLayoutDestination(ref)
+	case Dir:
+		return newDirDestination(ref)
+	case ContainersStorage:
+		return &storageDestination{ref: ref, opts: opts}, nil
+	case DockerDaemon:
+		return nil, errors.New("images cannot be written to the Docker engine")
+	}
+	return nil, fmt.Errorf("unknown transport %q", ref.Transport)
+}
+
+// CopyOptions configure Copy
+type CopyOptions struct {
+	// Platform selects the manifests that are copied; all are copied if nil
+	Platform platforms.MatchComparer
+	// TmpDir is the directory of the temporary OCI image layout the image is
+	// transformed in, the default directory for temporary files if empty
+	TmpDir string
+	// Transform changes the image with the given target descriptor in cs,
+	// such as by encrypting or decrypting its layers, and returns the
+	// descriptor of the changed image
+	Transform func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error)
+}
+
+// Copy copies the image of src to dst and returns the descriptor of the copied
+// image. Without a transform, the blobs are copied as they are, so encrypted
+// layers stay encrypted and no keys are needed. With one, the image is first
+// copied into a temporary OCI image layout, which is removed before
+// returning, and transformed there, so that only the transformed image
+// reaches dst.
+func Copy(ctx context.Context, src Source, dst Destination, opts CopyOptions) (ocispec.Descriptor, error) {
+	desc, err := src.Target(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if opts.Transform == nil {
+		return desc, dst.Put(ctx, src, desc, opts.Platform)
+	}
+	l, cleanup, err := tempLayout(opts.TmpDir)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer cleanup()
+	if _, err := imgenc.CopyImage(ctx, src, l, desc, matcher(opts.Platform)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	newDesc, err := opts.Transform(ctx, l.Store(), desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return newDesc, dst.Put(ctx, l.Store(), newDesc, opts.Platform)
+}
+
+// tempLayout creates a temporary OCI image layout in tmpDir and returns it
+// with the function that removes it
+func tempLayout(tmpDir string) (*ocilayout.Layout, func(), error) {
+	dir, err := os.MkdirTemp(tmpDir, "imgcrypt-transport-")
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := ocilayout.Open(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return l, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// matcher returns platform as a platforms.Matcher, keeping nil a nil interface
+func matcher(platform platforms.MatchComparer) platforms.Matcher {
+	if platform == nil {
+		return nil
+	}
+	return platform
+}
@@ -0,0 +1,248 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package transports
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/ocilayout"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Reference
+	}{
+		{"docker://alpine", Reference{Transport: Docker, Name: "docker.io/library/alpine:latest"}},
+		{"docker://example.com/app:v1", Reference{Transport: Docker, Name: "example.com/app:v1"}},
+		{"oci:/tmp/layout", Reference{Transport: OCI, Path: "/tmp/layout"}},
+		{"oci:/tmp/layout:v1", Reference{Transport: OCI, Path: "/tmp/layout", Name: "v1"}},
+		{"dir:/tmp/image", Reference{Transport: Dir, Path: "/tmp/image"}},
+		{"containers-storage:app:v1", Reference{Transport: ContainersStorage, Name: "app:v1"}},
+		{"docker-daemon:app:v1", Reference{Transport: DockerDaemon, Name: "app:v1"}},
+	}
+	for _, tc := range tests {
+		if !HasTransport(tc.s) {
+			t.Errorf("expected %q to have a transport", tc.s)
+		}
+		ref, err := Parse(tc.s)
+		if err != nil {
+			t.Errorf("%s: %v", tc.s, err)
+			continue
+		}
+		if ref != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.s, tc.want, ref)
+		}
+		if _, err := Parse(ref.String()); err != nil {
+			t.Errorf("%s: could not parse %q: %v", tc.s, ref.String(), err)
+		}
+	}
+	for _, s := range []string{"docker.io/library/alpine:latest", "oci:", "dir:", "docker://"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+	if HasTransport("docker.io/library/alpine:latest") {
+		t.Error("expected an image name of containerd to have no transport")
+	}
+}
+
+// writeImage writes an image with one layer to the OCI image layout in dir
+// under the given name and returns its descriptor
+func writeImage(t *testing.T, dir, name string) ocispec.Descriptor {
+	t.Helper()
+	l, err := ocilayout.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	config := testutil.WriteBlob(t, l, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := testutil.WriteBlob(t, l, "application/vnd.oci.image.layer.v1.tar+gzip+encrypted", []byte("encrypted layer"))
+	layer.Annotations = map[string]string{"org.opencontainers.image.enc.keys.jwe": "d3JhcHBlZA=="}
+	mb, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := testutil.WriteBlob(t, l, ocispec.MediaTypeImageManifest, mb)
+	if err := l.Tag(name, manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// copyRefs copies the image between the transport strings
+func copyRefs(t *testing.T, src, dst string, opts Options, copts CopyOptions) ocispec.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	srcRef, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstRef, err := Parse(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSource(ctx, srcRef, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d, err := NewDestination(ctx, dstRef, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	desc, err := Copy(ctx, s, d, copts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestCopyDir(t *testing.T) {
+	layoutDir := t.TempDir()
+	manifest := writeImage(t, layoutDir, "v1")
+
+	imageDir := filepath.Join(t.TempDir(), "image")
+	copyRefs(t, "oci:"+layoutDir+":v1", "dir:"+imageDir, Options{}, CopyOptions{})
+	b, err := os.ReadFile(filepath.Join(imageDir, dirVersionFile))
+	if err != nil || string(b) != dirVersion {
+		t.Fatalf("expected the version file of the directory format, got %q, %v", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(imageDir, dirManifestFile)); err != nil || digest.FromBytes(b) != manifest.Digest {
+		t.Fatalf("expected the manifest in %s, got %v", dirManifestFile, err)
+	}
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected the version, manifest, config and layer files, got %d files", len(entries))
+	}
+
+	// the directory is read back with the media type of the manifest
+	var transformed ocispec.Descriptor
+	outDir := t.TempDir()
+	desc := copyRefs(t, "dir:"+imageDir, "oci:"+outDir+":v2", Options{}, CopyOptions{
+		TmpDir: t.TempDir(),
+		Transform: func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+			if desc.MediaType != ocispec.MediaTypeImageManifest {
+				t.Errorf("expected an OCI image manifest, got %s", desc.MediaType)
+			}
+			m, err := images.Manifest(ctx, cs, desc, nil)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			m.Annotations = map[string]string{"transformed": "true"}
+			mb, err := json.Marshal(m)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			transformed = testutil.WriteBlob(t, cs, desc.MediaType, mb)
+			return transformed, nil
+		},
+	})
+	if desc.Digest != transformed.Digest {
+		t.Fatalf("expected the transformed image to be copied, got %s", desc.Digest)
+	}
+	l, err := ocilayout.Open(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got, err := l.Resolve("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(context.Background(), l, got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Annotations["transformed"] != "true" || m.Layers[0].Annotations["org.opencontainers.image.enc.keys.jwe"] != "d3JhcHBlZA==" {
+		t.Fatalf("expected the transformed manifest with the encrypted layer, got %+v", m)
+	}
+
+	// an untagged layout destination is refused, and so is overwriting
+	// a directory that is not an image directory
+	if _, err := NewDestination(context.Background(), Reference{Transport: OCI, Path: outDir}, Options{}); err == nil {
+		t.Fatal("expected an OCI image layout destination without a reference name to be refused")
+	}
+	if _, err := NewDestination(context.Background(), Reference{Transport: Dir, Path: outDir}, Options{}); err == nil {
+		t.Fatal("expected a non-empty directory that is not an image directory to be refused")
+	}
+}
+
+func TestCopyContainersStorage(t *testing.T) {
+	// the fake skopeo keeps the storage as an OCI image layout
+	storage := filepath.Join(t.TempDir(), "storage")
+	skopeo := filepath.Join(t.TempDir(), "skopeo")
+	script := `#!/bin/sh
+[ "$1" = copy ] && [ "$2" = --quiet ] || exit 2
+layout() { p=${1#oci:}; echo "${p%:image}"; }
+case "$4" in
+containers-storage:*) mkdir -p "$STORAGE" && cp -r "$(layout "$3")"/. "$STORAGE" ;;
+oci:*) cp -r "$STORAGE"/. "$(layout "$4")" ;;
+*) exit 2 ;;
+esac
+`
+	if err := os.WriteFile(skopeo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STORAGE", storage)
+	opts := Options{Skopeo: skopeo, TmpDir: t.TempDir()}
+
+	layoutDir := t.TempDir()
+	manifest := writeImage(t, layoutDir, "v1")
+	copyRefs(t, "oci:"+layoutDir+":v1", "containers-storage:app:v1", opts, CopyOptions{})
+	outDir := t.TempDir()
+	desc := copyRefs(t, "containers-storage:app:v1", "oci:"+outDir+":v1", opts, CopyOptions{})
+	if desc.Digest != manifest.Digest {
+		t.Fatalf("expected the image to be read back from the storage, got %s", desc.Digest)
+	}
+	entries, err := os.ReadDir(opts.TmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the temporary layouts to be removed, got %d", len(entries))
+	}
+
+	// failures of skopeo are reported with its output
+	if err := os.WriteFile(skopeo, []byte("#!/bin/sh\necho no such image >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := Parse("containers-storage:missing")
+	if _, err := NewSource(context.Background(), ref, opts); err == nil || !strings.Contains(err.Error(), "no such image") {
+		t.Fatalf("expected the error of skopeo, got %v", err)
+	}
+}
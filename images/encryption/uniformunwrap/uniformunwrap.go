@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package uniformunwrap replaces the unwrapping of JWE and PKCS#7 wrapped
+// layer keys by ocicrypt with one whose duration does not tell which of the
+// private keys, or which recipient of the wrapped key, matched.
+//
+// ocicrypt tries the private keys one after the other and returns as soon as
+// one of them unwraps the key, and go-jose tries the recipients of a JWE in
+// the same way, so the time an unwrap takes reveals to a local observer how
+// the keys of a node are configured and whether an image is meant for it.
+// The key wrappers installed by Install try every private key against every
+// recipient, and pad each unwrap, successful or not, to the minimum duration
+// set with Set, which covers the difference between RSA and EC keys and
+// between a failed and a successful private key operation.
+package uniformunwrap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobars/ocicrypt"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap"
+)
+
+var minDuration atomic.Int64
+
+// Set makes every unwrap of a JWE or PKCS#7 wrapped key take at least d for
+// the rest of the process; it should exceed the time the slowest of the
+// configured private keys takes to fail against all recipients. Zero, the
+// default, only tries all keys and recipients.
+func Set(d time.Duration) {
+	minDuration.Store(int64(d))
+}
+
+// Current returns the minimum duration of an unwrap
+func Current() time.Duration {
+	return time.Duration(minDuration.Load())
+}
+
+// keyWrapper unwraps keys with unwrap and pads the time taken to the minimum
+// duration; wrapping is left to the key wrapper of ocicrypt
+type keyWrapper struct {
+	keywrap.KeyWrapper
+	unwrap func(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error)
+}
+
+var installOnce sync.Once
+
+// Install replaces the JWE and PKCS#7 key wrappers registered with ocicrypt.
+// It must be called before the other key wrappers are installed, since it
+// does not call the key wrapper it replaces to unwrap keys.
+func Install() {
+	installOnce.Do(func() {
+		if kw := ocicrypt.GetKeyWrapper("jwe"); kw != nil {
+			ocicrypt.RegisterKeyWrapper("jwe", &keyWrapper{kw, unwrapJWE})
+		}
+		if kw := ocicrypt.GetKeyWrapper("pkcs7"); kw != nil {
+			ocicrypt.RegisterKeyWrapper("pkcs7", &keyWrapper{kw, unwrapPKCS7})
+		}
+	})
+}
+
+func (kw *keyWrapper) UnwrapKey(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	defer pad(time.Now().Add(Current()))
+	return kw.unwrap(dc, annotation)
+}
+
+// pad sleeps until deadline
+func pad(deadline time.Time) {
+	if d := time.Until(deadline); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package uniformunwrap
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/keywrap/jwe"
+	"github.com/gobars/ocicrypt/keywrap/pkcs7"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+var optsData = []byte(`{"symkey":"c2VjcmV0","cipheroptions":{}}`)
+
+func decryptConfig(privKeys [][]byte, x509s ...[]byte) *encconfig.DecryptConfig {
+	return &encconfig.DecryptConfig{Parameters: map[string][][]byte{
+		"privkeys":           privKeys,
+		"privkeys-passwords": make([][]byte, len(privKeys)),
+		"x509s":              x509s,
+	}}
+}
+
+func TestUnwrapJWE(t *testing.T) {
+	rsaPub, rsaPriv, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, ecPriv, err := encutils.CreateECDSATestKey(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotation, err := jwe.NewKeyWrapper().WrapKeys(&encconfig.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {rsaPub, ecPub}},
+	}, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := splitJWE(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(recipients))
+	}
+
+	for _, privKeys := range [][][]byte{{otherPriv, ecPriv}, {rsaPriv, otherPriv}, {ecPriv, rsaPriv}} {
+		got, err := unwrapJWE(decryptConfig(privKeys), annotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, optsData) {
+			t.Fatalf("unexpected layer options %q", got)
+		}
+	}
+	if _, err := unwrapJWE(decryptConfig([][]byte{otherPriv}), annotation); err == nil {
+		t.Fatal("expected unwrapping with a key that is not a recipient to fail")
+	}
+}
+
+func TestUnwrapPKCS7(t *testing.T) {
+	caKey, caCert, err := encutils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := encutils.CertifyKey(pub, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotation, err := pkcs7.NewKeyWrapper().WrapKeys(&encconfig.EncryptConfig{
+		Parameters: map[string][][]byte{"x509s": {cert.Raw}},
+	}, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := unwrapPKCS7(decryptConfig([][]byte{otherPriv, priv}, caCert.Raw, cert.Raw), annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, optsData) {
+		t.Fatalf("unexpected layer options %q", got)
+	}
+	if _, err := unwrapPKCS7(decryptConfig([][]byte{otherPriv}, cert.Raw), annotation); err == nil {
+		t.Fatal("expected unwrapping with a key that is not a recipient to fail")
+	}
+}
+
+func TestMinDuration(t *testing.T) {
+	_, priv, err := encutils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Set(100 * time.Millisecond)
+	defer Set(0)
+
+	kw := &keyWrapper{jwe.NewKeyWrapper(), unwrapJWE}
+	start := time.Now()
+	if _, err := kw.UnwrapKey(decryptConfig([][]byte{priv}), []byte("not a JWE")); err == nil {
+		t.Fatal("expected unwrapping an invalid JWE to fail")
+	}
+	if d := time.Since(start); d < Current() {
+		t.Fatalf("failed unwrap took %v, less than the minimum duration %v", d, Current())
+	}
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package uniformunwrap
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/containerd/imgcrypt/images/encryption/matched"
+	"github.com/containerd/imgcrypt/images/encryption/securemem"
+	"github.com/containerd/imgcrypt/images/encryption/tracing"
+	"github.com/containerd/imgcrypt/images/encryption/unwraplimit"
+	"github.com/go-jose/go-jose/v3"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/gobars/ocicrypt/crypto/x509"
+	"github.com/gobars/ocicrypt/keywrap/pkcs7"
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+// privateKeys parses the private keys of the DecryptConfig, all of them before
+// any is tried, with the errors of ocicrypt and the passphrase attempts
+// limited by unwraplimit
+func privateKeys(dc *encconfig.DecryptConfig, prefix string) ([]interface{}, error) {
+	privKeys := dc.Parameters["privkeys"]
+	if len(privKeys) == 0 {
+		return nil, fmt.Errorf("no private keys found for %s decryption", prefix)
+	}
+	passwords := dc.Parameters["privkeys-passwords"]
+	if len(passwords) != len(privKeys) {
+		return nil, errors.New("private key password array length must be same as that of private keys")
+	}
+	keys := make([]interface{}, 0, len(privKeys))
+	for i, privKey := range privKeys {
+		key, err := unwraplimit.ParsePrivateKey(privKey, passwords[i], prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// keep returns the first of the unwrapped keys and zeroes the others, which
+// are the same key unwrapped again with a duplicate private key
+func keep(first, optsData []byte) []byte {
+	if first == nil {
+		return optsData
+	}
+	securemem.Wipe(optsData)
+	return first
+}
+
+// unwrapJWE tries every private key against every recipient of the JWE
+func unwrapJWE(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	recipients, err := splitJWE(annotation)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := privateKeys(dc, "JWE")
+	if err != nil {
+		return nil, err
+	}
+	var optsData []byte
+	for _, key := range keys {
+		for _, r := range recipients {
+			if plain, err := r.Decrypt(key); err == nil {
+				if optsData == nil {
+					matched.Report(tracing.Context(dc), keymeta.PrivateKeyID(key))
+				}
+				optsData = keep(optsData, plain)
+			}
+		}
+	}
+	if optsData == nil {
+		return nil, errors.New("JWE: no suitable private key found for decryption")
+	}
+	return optsData, nil
+}
+
+// splitJWE returns a JWE for each recipient of the serialized JWE, since
+// go-jose stops at the first recipient a key unwraps
+func splitJWE(annotation []byte) ([]*jose.JSONWebEncryption, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(annotation, &fields); err != nil {
+		// the compact serialization has a single recipient
+		jwe, err := jose.ParseEncrypted(string(annotation))
+		if err != nil {
+			return nil, errors.New("jose.ParseEncrypted failed")
+		}
+		return []*jose.JSONWebEncryption{jwe}, nil
+	}
+	var recipients []map[string]json.RawMessage
+	if raw, ok := fields["recipients"]; ok {
+		if err := json.Unmarshal(raw, &recipients); err != nil {
+			return nil, errors.New("jose.ParseEncrypted failed")
+		}
+		delete(fields, "recipients")
+	}
+	if len(recipients) == 0 {
+		recipients = append(recipients, nil)
+	}
+	jwes := make([]*jose.JSONWebEncryption, 0, len(recipients))
+	for _, r := range recipients {
+		for k, v := range r {
+			fields[k] = v
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		jwe, err := jose.ParseEncrypted(string(b))
+		if err != nil {
+			return nil, errors.New("jose.ParseEncrypted failed")
+		}
+		jwes = append(jwes, jwe)
+		for k := range r {
+			delete(fields, k)
+		}
+	}
+	return jwes, nil
+}
+
+// unwrapPKCS7 tries every private key with every certificate
+func unwrapPKCS7(dc *encconfig.DecryptConfig, annotation []byte) ([]byte, error) {
+	keys, err := privateKeys(dc, "PKCS7")
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, data := range dc.Parameters["x509s"] {
+		cert, err := encutils.ParseCertificate(data, "PKCS7")
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no x509 certificates found needed for PKCS7 decryption")
+	}
+	p7, err := pkcs7.Parse(annotation)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse PKCS7 packet: %w", err)
+	}
+	var optsData []byte
+	for _, key := range keys {
+		for _, cert := range certs {
+			if plain, err := p7.Decrypt(cert, crypto.PrivateKey(key)); err == nil {
+				if optsData == nil {
+					matched.Report(tracing.Context(dc), keymeta.PrivateKeyID(key))
+				}
+				optsData = keep(optsData, plain)
+			}
+		}
+	}
+	if optsData == nil {
+		return nil, errors.New("PKCS7: no suitable private key found for decryption")
+	}
+	return optsData, nil
+}
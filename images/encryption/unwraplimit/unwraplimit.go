@@ -0,0 +1,359 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package unwraplimit limits the attempts to use the PIN of a PKCS#11 token or
+// the passphrase of a private key while layer keys are unwrapped. Tokens lock
+// themselves after a few wrong PINs, so a wrong PIN that is tried for each
+// layer of an image, or by a loop pulling an image again and again, would
+// otherwise lock the token for all of its users.
+//
+// Wrong PINs are counted per token and wrong passphrases per private key.
+// Once MaxFailures of them were tried within the Lockout period, further
+// attempts fail with ErrLockedOut without using the token or the key until
+// the period has passed since the last failure, and after a failure the next
+// attempt is refused until MinInterval has passed. An attempt counts as a
+// failure while it is in progress, so that concurrent attempts cannot exceed
+// the limit together, and a success clears the failures. Decoders run in
+// separate processes, so they count the failures in a state file shared by
+// all of them.
+package unwraplimit
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/imgcrypt/images/encryption/lockfile"
+	encutils "github.com/gobars/ocicrypt/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrLockedOut is returned if a PIN or passphrase may not be tried
+var ErrLockedOut = errors.New("locked out after failed attempts")
+
+// Kind is the kind of secret whose attempts are limited
+type Kind string
+
+const (
+	// KindPIN is the PIN of a PKCS#11 token
+	KindPIN Kind = "pin"
+	// KindPassphrase is the passphrase of a private key
+	KindPassphrase Kind = "passphrase"
+)
+
+// Result is the outcome of an attempt
+type Result int
+
+const (
+	// Succeeded means that the secret was right
+	Succeeded Result = iota
+	// Wrong means that the secret was wrong
+	Wrong
+	// Inconclusive means that the attempt failed for another reason, such
+	// as an unreachable token, and does not count
+	Inconclusive
+)
+
+// Limit limits the failed attempts to use the secrets of one kind
+type Limit struct {
+	// MaxFailures is the number of wrong secrets tried within Lockout after
+	// which attempts are refused; 0 does not limit them
+	MaxFailures int `yaml:"max-failures"`
+	// Lockout is how long a failure is remembered
+	Lockout time.Duration `yaml:"lockout"`
+	// MinInterval is how long after a failure the next attempt is refused
+	MinInterval time.Duration `yaml:"min-interval,omitempty"`
+}
+
+// Limits holds the limits of all kinds of secrets
+type Limits struct {
+	PIN        Limit `yaml:"pin"`
+	Passphrase Limit `yaml:"passphrase"`
+	// StateFile is the file the failures are counted in; without it they
+	// are counted in the memory of the process
+	StateFile string `yaml:"-"`
+}
+
+// DefaultLimits stays below the number of wrong PINs after which tokens
+// commonly lock themselves
+var DefaultLimits = Limits{
+	PIN:        Limit{MaxFailures: 2, Lockout: time.Hour, MinInterval: time.Minute},
+	Passphrase: Limit{MaxFailures: 5, Lockout: 15 * time.Minute},
+}
+
+// Load reads a limits file; limits it does not set keep their defaults
+func Load(path string) (*Limits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read unwrap limits: %w", err)
+	}
+	l := DefaultLimits
+	if err := yaml.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("could not parse unwrap limits %s: %w", path, err)
+	}
+	for _, limit := range []Limit{l.PIN, l.Passphrase} {
+		if limit.MaxFailures < 0 || limit.Lockout < 0 || limit.MinInterval < 0 {
+			return nil, fmt.Errorf("unwrap limits %s must not be negative", path)
+		}
+	}
+	return &l, nil
+}
+
+var current atomic.Pointer[Limits]
+
+// Set makes the limits apply to the rest of the process; nil restores the
+// default limits
+func Set(l *Limits) {
+	current.Store(l)
+}
+
+// Current returns the limits that apply
+func Current() *Limits {
+	if l := current.Load(); l != nil {
+		return l
+	}
+	return &DefaultLimits
+}
+
+func (l *Limits) limit(kind Kind) Limit {
+	if kind == KindPIN {
+		return l.PIN
+	}
+	return l.Passphrase
+}
+
+// KeyTarget returns the target of the passphrase of the private key, which
+// identifies the key without revealing it
+func KeyTarget(privKey []byte) string {
+	sum := sha256.Sum256(privKey)
+	return "key:sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ParsePrivateKey parses a private key like ocicrypt does, limiting the
+// attempts to decrypt it with a passphrase
+func ParsePrivateKey(privKey, password []byte, prefix string) (interface{}, error) {
+	block, _ := pem.Decode(privKey)
+	//nolint:staticcheck // ocicrypt supports encrypted PEM blocks
+	if password == nil || block == nil || !x509.IsEncryptedPEMBlock(block) {
+		return encutils.ParsePrivateKey(privKey, password, prefix)
+	}
+	done, err := Attempt(KindPassphrase, KeyTarget(privKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", prefix, err)
+	}
+	key, err := encutils.ParsePrivateKey(privKey, password, prefix)
+	switch {
+	case err == nil:
+		done(Succeeded)
+	case encutils.IsPasswordError(err):
+		done(Wrong)
+	default:
+		done(Inconclusive)
+	}
+	return key, err
+}
+
+// failure is a failed attempt, or one in progress that has an ID
+type failure struct {
+	Time time.Time `json:"time"`
+	ID   string    `json:"id,omitempty"`
+}
+
+// state holds the failures by kind and target
+type state map[string][]failure
+
+const (
+	// lockTimeout is how long to wait for other processes updating the
+	// state file
+	lockTimeout = 5 * time.Second
+	// pendingTimeout is how long an attempt may be in progress; after that,
+	// such as when the process making it crashed, it counts as a failure
+	pendingTimeout = 30 * time.Second
+	// pollInterval is how often an attempt waiting for others is retried
+	pollInterval = 100 * time.Millisecond
+)
+
+// errPending means that the attempt has to wait for others in progress
+var errPending = errors.New("attempts in progress")
+
+var (
+	memMu    sync.Mutex
+	memState = make(state)
+	lastID   atomic.Int64
+)
+
+// Attempt returns an error wrapping ErrLockedOut if the secret of the kind
+// used for target, such as a token or the KeyTarget of a private key, may not
+// be tried now. Otherwise the attempt counts as a failure until the returned
+// function is called with its result. If the limit is only reached because
+// of attempts in progress, it waits for their results.
+func Attempt(kind Kind, target string) (func(Result), error) {
+	l := Current()
+	limit := l.limit(kind)
+	if limit.MaxFailures == 0 && limit.MinInterval == 0 {
+		return func(Result) {}, nil
+	}
+	key := string(kind) + " " + target
+	id := fmt.Sprintf("%d-%d", os.Getpid(), lastID.Add(1))
+	deadline := time.Now().Add(pendingTimeout)
+	for {
+		err := update(l.StateFile, func(s state) error {
+			now := time.Now()
+			failures := recent(s[key], now, limit)
+			var (
+				wrong   int
+				pending bool
+				last    time.Time
+			)
+			for _, f := range failures {
+				if f.ID != "" && now.Before(f.Time.Add(pendingTimeout)) {
+					pending = true
+					continue
+				}
+				wrong++
+				last = f.Time
+			}
+			if limit.MaxFailures > 0 && wrong >= limit.MaxFailures {
+				return fmt.Errorf("%w: %d wrong %ss for %s, retry after %s", ErrLockedOut, wrong, kind, target, last.Add(limit.Lockout).Format(time.RFC3339))
+			}
+			if wrong > 0 && now.Before(last.Add(limit.MinInterval)) {
+				return fmt.Errorf("%w: wrong %s for %s, retry after %s", ErrLockedOut, kind, target, last.Add(limit.MinInterval).Format(time.RFC3339))
+			}
+			if pending && (limit.MinInterval > 0 || limit.MaxFailures > 0 && len(failures) >= limit.MaxFailures) {
+				return errPending
+			}
+			s[key] = append(failures, failure{Time: now, ID: id})
+			return nil
+		})
+		if err == errPending && time.Now().Before(deadline) {
+			time.Sleep(pollInterval)
+			continue
+		}
+		if err == errPending {
+			return nil, fmt.Errorf("%w: another attempt to use the %s for %s is in progress", ErrLockedOut, kind, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	var once sync.Once
+	return func(r Result) {
+		once.Do(func() { _ = report(l.StateFile, key, id, r) })
+	}, nil
+}
+
+// recent returns the failures that are remembered, with the latest last
+func recent(failures []failure, now time.Time, limit Limit) []failure {
+	var kept []failure
+	for _, f := range failures {
+		if now.Before(f.Time.Add(limit.Lockout)) || now.Before(f.Time.Add(limit.MinInterval)) || now.Before(f.Time.Add(pendingTimeout)) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// report records the result of the attempt with the given ID
+func report(path, key, id string, r Result) error {
+	return update(path, func(s state) error {
+		switch r {
+		case Succeeded:
+			delete(s, key)
+		case Wrong:
+			for i := range s[key] {
+				if s[key][i].ID == id {
+					s[key][i] = failure{Time: time.Now()}
+				}
+			}
+		default:
+			failures := s[key][:0]
+			for _, f := range s[key] {
+				if f.ID != id {
+					failures = append(failures, f)
+				}
+			}
+			if len(failures) == 0 {
+				delete(s, key)
+			} else {
+				s[key] = failures
+			}
+		}
+		return nil
+	})
+}
+
+// update applies fn to the state in the file at path, or in memory without a
+// path, and keeps the changes unless fn returns an error
+func update(path string, fn func(state) error) error {
+	if path == "" {
+		memMu.Lock()
+		defer memMu.Unlock()
+		return fn(memState)
+	}
+	if err := lockfile.Check(path); err != nil {
+		return err
+	}
+	unlock, err := lockfile.Lock(path+".lock", lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s := make(state)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("could not parse unwrap failures in %s: %w", path, err)
+		}
+	}
+	if err := fn(s); err != nil {
+		return err
+	}
+	return write(path, s)
+}
+
+func write(path string, s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package unwraplimit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	encutils "github.com/gobars/ocicrypt/utils"
+)
+
+func TestAttempt(t *testing.T) {
+	Set(&Limits{PIN: Limit{MaxFailures: 2, Lockout: time.Hour}})
+	defer Set(nil)
+
+	for i := 0; i < 2; i++ {
+		done, err := Attempt(KindPIN, "token a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(Wrong)
+	}
+	if _, err := Attempt(KindPIN, "token a"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected the third attempt to be refused, got %v", err)
+	}
+
+	// results other than a wrong PIN do not count, and a success clears the
+	// failures
+	for _, r := range []Result{Wrong, Inconclusive, Inconclusive, Succeeded, Wrong} {
+		done, err := Attempt(KindPIN, "token b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(r)
+	}
+	if _, err := Attempt(KindPIN, "token b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttemptStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.json")
+	Set(&Limits{PIN: Limit{MaxFailures: 3, Lockout: time.Hour, MinInterval: time.Hour}, StateFile: path})
+	defer Set(nil)
+
+	done, err := Attempt(KindPIN, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(Wrong)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	// the failure is remembered by the file, not by the process
+	Set(&Limits{PIN: Limit{MaxFailures: 3, Lockout: time.Hour, MinInterval: time.Hour}})
+	if _, err := Attempt(KindPIN, "token"); err != nil {
+		t.Fatal(err)
+	}
+	Set(&Limits{PIN: Limit{MaxFailures: 3, Lockout: time.Hour, MinInterval: time.Hour}, StateFile: path})
+	if _, err := Attempt(KindPIN, "token"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected an attempt within the minimum interval to be refused, got %v", err)
+	}
+}
+
+func TestAttemptWaitsForPending(t *testing.T) {
+	Set(&Limits{PIN: Limit{MaxFailures: 1, Lockout: time.Hour}})
+	defer Set(nil)
+
+	done, err := Attempt(KindPIN, "token c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		done(Succeeded)
+	}()
+	start := time.Now()
+	done2, err := Attempt(KindPIN, "token c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done2(Succeeded)
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("expected the attempt to wait for the one in progress")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	Set(&Limits{Passphrase: Limit{MaxFailures: 2, Lockout: time.Hour}})
+	defer Set(nil)
+
+	_, privKey, err := encutils.CreateRSATestKey(2048, []byte("secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePrivateKey(privKey, []byte("secret"), "JWE"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ParsePrivateKey(privKey, []byte("wrong"), "JWE"); !encutils.IsPasswordError(err) {
+			t.Fatalf("expected a wrong password error, got %v", err)
+		}
+	}
+	if _, err := ParsePrivateKey(privKey, []byte("secret"), "JWE"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected the key to be locked out, got %v", err)
+	}
+}
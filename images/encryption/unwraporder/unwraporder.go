@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package unwraporder sets the order in which the wrapped keys of a layer are
+// tried when it is decrypted, so that cheap local private keys are tried
+// before slow HSMs and keyproviders, and when to stop trying. ocicrypt tries
+// the wrap schemes of a layer in no particular order. An order file looks
+// like:
+//
+//	order: [jwe, pkcs7, pgp, pkcs11, provider.kms, provider.*]
+//	stop-on-failure: [pkcs11]
+//	exclusive: false
+//
+// Schemes are tried one at a time in the order listed, where a trailing '*'
+// matches all schemes with the prefix in alphabetical order, and schemes not
+// listed are tried last unless the order is exclusive. Schemes without a key
+// configured for them are skipped. Without an order file, DefaultOrder
+// applies.
+package unwraporder
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gobars/ocicrypt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultOrder tries the schemes of local private keys before PKCS#11 tokens
+// and keyproviders
+var DefaultOrder = Order{
+	Schemes: []string{"jwe", "jwe-hybrid", "pkcs7", "pgp", "threshold", "pkcs11", "provider.*"},
+}
+
+// Order holds the order in which the wrap schemes of a layer are tried
+type Order struct {
+	// Schemes lists wrap schemes such as jwe, pkcs7, pgp, pkcs11, threshold
+	// and provider.<name>; a trailing '*' matches all schemes with the prefix
+	Schemes []string `yaml:"order"`
+	// StopOnFailure lists the schemes whose failure to unwrap the layer key
+	// ends the attempts, for example so that a wrong PIN is not followed by
+	// calls to keyproviders
+	StopOnFailure []string `yaml:"stop-on-failure,omitempty"`
+	// Exclusive skips the schemes that are not listed
+	Exclusive bool `yaml:"exclusive,omitempty"`
+}
+
+// Load reads an order file
+func Load(path string) (*Order, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read unwrap order: %w", err)
+	}
+	var o Order
+	if err := yaml.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("could not parse unwrap order %s: %w", path, err)
+	}
+	if len(o.Schemes) == 0 {
+		return nil, fmt.Errorf("unwrap order %s lists no schemes", path)
+	}
+	return &o, nil
+}
+
+var current atomic.Pointer[Order]
+
+// Set makes the order apply to the rest of the process; nil restores the
+// default order
+func Set(o *Order) {
+	current.Store(o)
+}
+
+// Current returns the order that applies
+func Current() *Order {
+	if o := current.Load(); o != nil {
+		return o
+	}
+	return &DefaultOrder
+}
+
+// matches returns whether the scheme is the pattern or has its prefix if it
+// ends with '*'
+func matches(pattern, scheme string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(scheme, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == scheme
+}
+
+// StopsOnFailure returns whether a failure of the scheme ends the attempts
+func (o *Order) StopsOnFailure(scheme string) bool {
+	for _, p := range o.StopOnFailure {
+		if matches(p, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stage holds the wrapped keys of one scheme of a layer
+type Stage struct {
+	Scheme string
+	// Desc is the descriptor of the layer with only the wrapped keys of the
+	// scheme
+	Desc ocispec.Descriptor
+}
+
+// Stages returns the schemes the layer key is wrapped with in the order they
+// are tried, each with the descriptor to try them with
+func (o *Order) Stages(desc ocispec.Descriptor) []Stage {
+	var present []string
+	for scheme := range ocicrypt.GetWrappedKeysMap(desc) {
+		present = append(present, scheme)
+	}
+	sort.Strings(present)
+
+	var (
+		ordered []string
+		taken   = make(map[string]bool)
+	)
+	for _, p := range o.Schemes {
+		for _, scheme := range present {
+			if !taken[scheme] && matches(p, scheme) {
+				ordered = append(ordered, scheme)
+				taken[scheme] = true
+			}
+		}
+	}
+	if !o.Exclusive {
+		for _, scheme := range present {
+			if !taken[scheme] {
+				ordered = append(ordered, scheme)
+			}
+		}
+	}
+
+	var stages []Stage
+	for _, scheme := range ordered {
+		stages = append(stages, Stage{Scheme: scheme, Desc: only(desc, present, scheme)})
+	}
+	return stages
+}
+
+// only returns the descriptor without the wrapped keys of the schemes other
+// than scheme
+func only(desc ocispec.Descriptor, present []string, scheme string) ocispec.Descriptor {
+	annotations := make(map[string]string, len(desc.Annotations))
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	for _, other := range present {
+		if other != scheme {
+			delete(annotations, ocicrypt.GetKeyWrapper(other).GetAnnotationID())
+		}
+	}
+	desc.Annotations = annotations
+	return desc
+}
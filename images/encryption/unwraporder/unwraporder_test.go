@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package unwraporder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/keywrap"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// annotatedKeyWrapper is a key wrapper of a keyprovider that is only used for
+// its annotation
+type annotatedKeyWrapper struct {
+	keywrap.KeyWrapper
+	annotationID string
+}
+
+func (kw annotatedKeyWrapper) GetAnnotationID() string {
+	return kw.annotationID
+}
+
+func init() {
+	for _, name := range []string{"kms", "vault"} {
+		ocicrypt.RegisterKeyWrapper("provider."+name, annotatedKeyWrapper{annotationID: "org.opencontainers.image.enc.keys.provider." + name})
+	}
+}
+
+func testDescriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		Annotations: map[string]string{
+			"org.opencontainers.image.enc.keys.jwe":            "jwe",
+			"org.opencontainers.image.enc.keys.pkcs7":          "pkcs7",
+			"org.opencontainers.image.enc.keys.pkcs11":         "pkcs11",
+			"org.opencontainers.image.enc.keys.provider.kms":   "kms",
+			"org.opencontainers.image.enc.keys.provider.vault": "vault",
+			"org.opencontainers.image.enc.pub-opts":            "opts",
+		},
+	}
+}
+
+func schemes(stages []Stage) []string {
+	var s []string
+	for _, st := range stages {
+		s = append(s, st.Scheme)
+	}
+	return s
+}
+
+func TestStages(t *testing.T) {
+	desc := testDescriptor()
+
+	stages := DefaultOrder.Stages(desc)
+	if got, want := schemes(stages), []string{"jwe", "pkcs7", "pkcs11", "provider.kms", "provider.vault"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("default order is %v, want %v", got, want)
+	}
+	for _, st := range stages {
+		wrapped := ocicrypt.GetWrappedKeysMap(st.Desc)
+		if len(wrapped) != 1 || wrapped[st.Scheme] == "" {
+			t.Fatalf("descriptor of %s has wrapped keys %v", st.Scheme, wrapped)
+		}
+		if st.Desc.Annotations["org.opencontainers.image.enc.pub-opts"] != "opts" {
+			t.Fatalf("descriptor of %s lost the other annotations", st.Scheme)
+		}
+	}
+	if len(ocicrypt.GetWrappedKeysMap(desc)) != 5 {
+		t.Fatal("the annotations of the layer were changed")
+	}
+
+	o := Order{Schemes: []string{"provider.vault", "pkcs11"}}
+	if got, want := schemes(o.Stages(desc)), []string{"provider.vault", "pkcs11", "jwe", "pkcs7", "provider.kms"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order is %v, want %v", got, want)
+	}
+	o.Exclusive = true
+	if got, want := schemes(o.Stages(desc)), []string{"provider.vault", "pkcs11"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("exclusive order is %v, want %v", got, want)
+	}
+	o.Schemes = []string{"pgp"}
+	if stages := o.Stages(desc); len(stages) != 0 {
+		t.Fatalf("exclusive order without present schemes is %v", schemes(stages))
+	}
+}
+
+func TestStopsOnFailure(t *testing.T) {
+	o := Order{StopOnFailure: []string{"pkcs11", "provider.k*"}}
+	for scheme, want := range map[string]bool{
+		"pkcs11":         true,
+		"provider.kms":   true,
+		"provider.vault": false,
+		"jwe":            false,
+	} {
+		if got := o.StopsOnFailure(scheme); got != want {
+			t.Errorf("StopsOnFailure(%s) = %v, want %v", scheme, got, want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.yaml")
+	if err := os.WriteFile(path, []byte("order: [pkcs11, jwe]\nstop-on-failure: [pkcs11]\nexclusive: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	o, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Order{Schemes: []string{"pkcs11", "jwe"}, StopOnFailure: []string{"pkcs11"}, Exclusive: true}
+	if !reflect.DeepEqual(o, want) {
+		t.Fatalf("loaded %+v, want %+v", o, want)
+	}
+
+	empty := filepath.Join(dir, "empty.yaml")
+	if err := os.WriteFile(empty, []byte("exclusive: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(empty); err == nil {
+		t.Fatal("loaded an order without schemes")
+	}
+
+	Set(o)
+	defer Set(nil)
+	if Current() != o {
+		t.Fatal("Current does not return the order that was set")
+	}
+	Set(nil)
+	if !reflect.DeepEqual(Current(), &DefaultOrder) {
+		t.Fatal("Current does not return the default order")
+	}
+}
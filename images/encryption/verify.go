@@ -0,0 +1,229 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/images/encryption/bufpool"
+	"github.com/containerd/imgcrypt/images/encryption/chunkhash"
+	"github.com/containerd/imgcrypt/images/encryption/escrow"
+	"github.com/containerd/imgcrypt/images/encryption/keymeta"
+	"github.com/gobars/ocicrypt"
+	"github.com/gobars/ocicrypt/blockcipher"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const annotationPubOpts = "org.opencontainers.image.enc.pubopts"
+
+// VerifyIssue describes an inconsistency found in an image
+type VerifyIssue struct {
+	Digest  digest.Digest `json:"digest" yaml:"digest"`
+	Message string        `json:"message" yaml:"message"`
+}
+
+func (vi VerifyIssue) String() string {
+	return fmt.Sprintf("%s: %s", vi.Digest, vi.Message)
+}
+
+// VerifyImage checks the internal consistency of the encrypted layers of an image:
+// the annotations of every encrypted layer must be present and parseable, the
+// layer media types must be consistent with the manifest and with the annotations,
+// and the locally available layer blobs must match their digest and size.
+// With an escrow policy, the layer keys must be wrapped for its recipients.
+// Wrapped keys stored in a key blob are read from the key blob, which must be
+// in the content store.
+// If a DecryptConfig is passed, the encrypted layers are also fully decrypted so that
+// their payloads are authenticated.
+// Issues with the image are returned; an error is only returned if the image
+// could not be checked.
+func VerifyImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor, dc *encconfig.DecryptConfig) ([]VerifyIssue, error) {
+	var issues []VerifyIssue
+
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			p, err := content.ReadBlob(ctx, cs, desc)
+			if err != nil {
+				if errdefs.IsNotFound(err) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(p, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal manifest %s: %w", desc.Digest, err)
+			}
+			for _, layer := range manifest.Layers {
+				layerIssues, err := verifyLayer(ctx, cs, desc.MediaType, layer, dc)
+				if err != nil {
+					return nil, err
+				}
+				issues = append(issues, layerIssues...)
+			}
+			return nil, nil
+		}
+		children, err := images.Children(ctx, cs, desc)
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return children, err
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
+// verifyLayer checks a single layer of a manifest with the given media type
+func verifyLayer(ctx context.Context, cs content.Store, manifestMediaType string, desc ocispec.Descriptor, dc *encconfig.DecryptConfig) ([]VerifyIssue, error) {
+	var issues []VerifyIssue
+	addIssue := func(format string, a ...interface{}) {
+		issues = append(issues, VerifyIssue{
+			Digest:  desc.Digest,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	encrypted := IsEncryptedDiff(ctx, desc.MediaType)
+	if expanded, err := ExpandKeys(ctx, cs, desc); err != nil {
+		addIssue("%v", err)
+	} else {
+		desc = expanded
+	}
+	installKeyWrappers()
+	wrappedKeys := ocicrypt.GetWrappedKeysMap(desc)
+
+	if !encrypted {
+		if len(wrappedKeys) > 0 {
+			addIssue("layer with media type %s has wrapped keys", desc.MediaType)
+		}
+	} else {
+		if manifestMediaType == images.MediaTypeDockerSchema2Manifest {
+			addIssue("encrypted layer with media type %s in a Docker manifest", desc.MediaType)
+		}
+		if len(wrappedKeys) == 0 {
+			addIssue("encrypted layer has no wrapped keys")
+		}
+		for scheme, annotation := range wrappedKeys {
+			keywrapper := ocicrypt.GetKeyWrapper(scheme)
+			if keywrapper == nil {
+				addIssue("unsupported key wrapping scheme %s", scheme)
+				continue
+			}
+			for _, b64 := range strings.Split(annotation, ",") {
+				if _, err := base64.StdEncoding.DecodeString(b64); err != nil {
+					addIssue("wrapped key for scheme %s is not valid base64: %v", scheme, err)
+				}
+			}
+			if _, err := keywrapper.GetRecipients(annotation); err != nil {
+				addIssue("wrapped keys for scheme %s cannot be parsed: %v", scheme, err)
+			}
+		}
+		if err := verifyPubOpts(desc); err != nil {
+			addIssue("%v", err)
+		}
+		if _, _, err := chunkhash.Read(desc); err != nil {
+			addIssue("%v", err)
+		}
+		if p := escrow.Current(); p != nil && len(wrappedKeys) > 0 {
+			md, _ := keymeta.Read(desc)
+			if err := p.Check(md); err != nil {
+				addIssue("%v", err)
+			}
+		}
+	}
+
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return issues, nil
+		}
+		return nil, err
+	}
+	defer ra.Close()
+
+	if ra.Size() != desc.Size {
+		addIssue("size of blob is %d but descriptor has size %d", ra.Size(), desc.Size)
+	}
+
+	digester := desc.Digest.Algorithm().Digester()
+	r := io.TeeReader(content.NewReader(ra), digester.Hash())
+	if encrypted && dc != nil && len(issues) == 0 {
+		_, plainReader, _, err := DecryptLayer(dc, r, desc, false)
+		if err == nil {
+			_, err = bufpool.Copy(io.Discard, plainReader)
+		}
+		if err != nil {
+			addIssue("layer could not be authenticated: %v", err)
+		}
+	}
+	if _, err := bufpool.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+	if digester.Digest() != desc.Digest {
+		addIssue("blob has digest %s", digester.Digest())
+		// the chunk hashes tell which parts of the blob are corrupted
+		if t, ok, err := chunkhash.Read(desc); err == nil && ok {
+			corrupted, err := t.Verify(content.NewReader(ra))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+			}
+			for _, i := range corrupted {
+				offset, length := t.Range(i)
+				addIssue("chunk %d at bytes %d-%d does not match its hash", i, offset, offset+length-1)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// verifyPubOpts checks that the public block cipher options of an encrypted layer can be parsed
+func verifyPubOpts(desc ocispec.Descriptor) error {
+	_, err := layerCipher(desc)
+	return err
+}
+
+// layerCipher returns the cipher named by the public block cipher options of an encrypted layer
+func layerCipher(desc ocispec.Descriptor) (blockcipher.LayerCipherType, error) {
+	b64 := desc.Annotations[annotationPubOpts]
+	if b64 == "" {
+		return "", fmt.Errorf("encrypted layer is missing annotation %s", annotationPubOpts)
+	}
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("annotation %s is not valid base64: %w", annotationPubOpts, err)
+	}
+	var pubOpts blockcipher.PublicLayerBlockCipherOptions
+	if err := json.Unmarshal(data, &pubOpts); err != nil {
+		return "", fmt.Errorf("annotation %s cannot be parsed: %w", annotationPubOpts, err)
+	}
+	if pubOpts.CipherType == "" {
+		return "", fmt.Errorf("annotation %s does not specify a cipher", annotationPubOpts)
+	}
+	return pubOpts.CipherType, nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/imgcrypt/internal/testutil"
+	encconfig "github.com/gobars/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestVerifyImage(t *testing.T) {
+	ctx := context.Background()
+	cs, manifest := writeTestImage(t)
+	ecc, dcc := testutil.CryptoConfigs(t)
+	_, other := testutil.CryptoConfigs(t)
+	all := func(ocispec.Descriptor) bool { return true }
+	encrypted, _, err := EncryptImage(ctx, cs, manifest, &ecc, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := images.Manifest(ctx, cs, encrypted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dc := range []*encconfig.DecryptConfig{nil, dcc.DecryptConfig} {
+		issues, err := VerifyImage(ctx, cs, encrypted, dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issues) != 0 {
+			t.Fatalf("expected no issues, got %v", issues)
+		}
+	}
+
+	layer := m.Layers[0]
+	withAnnotations := func(update func(map[string]string)) ocispec.Descriptor {
+		desc := layer
+		desc.Annotations = make(map[string]string)
+		for k, v := range layer.Annotations {
+			desc.Annotations[k] = v
+		}
+		update(desc.Annotations)
+		return desc
+	}
+	plain := m.Layers[0]
+	plain.MediaType = ocispec.MediaTypeImageLayer
+	wrongSize := layer
+	wrongSize.Size++
+
+	for _, tc := range []struct {
+		name  string
+		layer ocispec.Descriptor
+		issue string
+	}{
+		{"missing pubopts", withAnnotations(func(a map[string]string) { delete(a, annotationPubOpts) }), "missing annotation"},
+		{"missing keys", withAnnotations(func(a map[string]string) { delete(a, "org.opencontainers.image.enc.keys.jwe") }), "no wrapped keys"},
+		{"bad keys", withAnnotations(func(a map[string]string) { a["org.opencontainers.image.enc.keys.jwe"] = "!" }), "not valid base64"},
+		{"plain with keys", plain, "has wrapped keys"},
+		{"wrong size", wrongSize, "size of blob"},
+	} {
+		desc := writeTestManifest(t, cs, m.Config, tc.layer)
+		issues, err := VerifyImage(ctx, cs, desc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, issue := range issues {
+			found = found || strings.Contains(issue.Message, tc.issue)
+		}
+		if !found {
+			t.Errorf("%s: expected an issue %q, got %v", tc.name, tc.issue, issues)
+		}
+	}
+
+	// with a key that cannot unwrap the layer key the layer is not authenticated
+	issues, err := VerifyImage(ctx, cs, encrypted, other.DecryptConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || !strings.Contains(issues[0].Message, "could not be authenticated") {
+		t.Fatalf("expected the layer not to be authenticated, got %v", issues)
+	}
+}
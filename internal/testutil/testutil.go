@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package testutil provides the fixtures shared by the tests of the
+// encryption packages.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	encconfig "github.com/gobars/ocicrypt/config"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// WriteBlob writes data to the content store and returns its descriptor; the
+// blob is written in the default namespace, which the content stores of
+// containerd's metadata database require
+func WriteBlob(t testing.TB, cs content.Ingester, mediaType string, data []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// CryptoConfigs returns configurations to encrypt for a new RSA key with JWE
+// and to decrypt with it
+func CryptoConfigs(t testing.TB) (encconfig.CryptoConfig, encconfig.CryptoConfig) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecc, err := encconfig.EncryptWithJwe([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	dcc, err := encconfig.DecryptWithPrivKeys([][]byte{privPEM}, [][]byte{nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ecc, dcc
+}
+
+// ImageStore keeps images in memory
+type ImageStore map[string]images.Image
+
+// Get returns the image with the given name
+func (is ImageStore) Get(_ context.Context, name string) (images.Image, error) {
+	img, ok := is[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return img, nil
+}
+
+// List returns all images, ignoring the filters
+func (is ImageStore) List(context.Context, ...string) ([]images.Image, error) {
+	var imgs []images.Image
+	for _, img := range is {
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// Create adds an image
+func (is ImageStore) Create(_ context.Context, img images.Image) (images.Image, error) {
+	if _, ok := is[img.Name]; ok {
+		return images.Image{}, errdefs.ErrAlreadyExists
+	}
+	is[img.Name] = img
+	return img, nil
+}
+
+// Update replaces an image
+func (is ImageStore) Update(_ context.Context, img images.Image, _ ...string) (images.Image, error) {
+	if _, ok := is[img.Name]; !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	is[img.Name] = img
+	return img, nil
+}
+
+// Delete removes an image
+func (is ImageStore) Delete(_ context.Context, name string, _ ...images.DeleteOpt) error {
+	delete(is, name)
+	return nil
+}
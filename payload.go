@@ -27,9 +27,16 @@ const (
 	PayloadURI = "io.containerd.ocicrypt.v1.Payload"
 )
 
+// PayloadAnnotationTenant is the annotation of a payload naming the tenant
+// whose key set the decryption tool decrypts the layer with. It is set by the
+// containerd client and not authenticated, so it selects a key set but does
+// not isolate the tenants from each other.
+const PayloadAnnotationTenant = "io.containerd.imgcrypt.tenant"
+
 var PayloadToolIDs = []string{
 	"io.containerd.ocicrypt.decoder.v1.tar",
 	"io.containerd.ocicrypt.decoder.v1.tar.gzip",
+	"io.containerd.ocicrypt.decoder.v1.tar.zstd",
 }
 
 func init() {
@@ -41,4 +48,37 @@ func init() {
 type Payload struct {
 	DecryptConfig encconfig.DecryptConfig
 	Descriptor    ocispec.Descriptor
+	// Manifests holds the signed manifest or index of the image followed by the
+	// manifests leading to the layer, and Signatures the signatures over the first
+	// one; they allow the decryption tool to verify the image before unwrapping keys
+	Manifests  [][]byte    `json:",omitempty"`
+	Signatures []Signature `json:",omitempty"`
+	// UnwrappedKeys holds layer keys that were unwrapped in a batch call to a
+	// keyprovider before unpacking, so the keyprovider is not called per layer
+	UnwrappedKeys []UnwrappedKey `json:",omitempty"`
+	// KeyBlobs holds the blobs the wrapped keys of layers were stored in
+	// because they were too large for the annotations of the layers
+	KeyBlobs [][]byte `json:",omitempty"`
+	// Annotations carry further information about the request, such as the
+	// tenant in PayloadAnnotationTenant
+	Annotations map[string]string `json:",omitempty"`
+}
+
+// Tenant returns the tenant the client requested the layer to be decrypted
+// for, if any
+func (p *Payload) Tenant() string {
+	return p.Annotations[PayloadAnnotationTenant]
+}
+
+// UnwrappedKey is a layer key together with the keyprovider annotation it was
+// unwrapped from
+type UnwrappedKey struct {
+	Annotation []byte
+	OptsData   []byte
+}
+
+// Signature is a cosign signature over the simple signing payload of an image
+type Signature struct {
+	Payload   []byte
+	Signature []byte
 }
@@ -886,6 +886,7 @@ testPKCS7() {
 	for recipient in pkcs7:${CLIENTCERT}; do
 		$CTR images encrypt \
 			--recipient ${recipient} \
+			--recipient-ca ${CACERT} \
 			${ALPINE} ${ALPINE_ENC}
 		failExit $? "Image encryption with PKCS7 failed; public key: ${recipient}"
 
@@ -928,6 +929,7 @@ testPKCS7() {
 	echo "Testing adding a PKCS7 recipient"
 	$CTR images encrypt \
 		--recipient pkcs7:${CLIENTCERT} \
+		--recipient-ca ${CACERT} \
 		${ALPINE} ${ALPINE_ENC}
 	failExit $? "Image encryption with PKCS7 failed; public key: ${recipient}"
 
@@ -935,6 +937,7 @@ testPKCS7() {
 		--key ${CLIENTCERTKEY} \
 		--dec-recipient pkcs7:${CLIENTCERT} \
 		--recipient pkcs7:${CLIENT2CERT} \
+		--recipient-ca ${CACERT} \
 		${ALPINE_ENC}
 	failExit $? "Adding recipient to PKCS7 encrypted image failed"
 
@@ -1063,6 +1066,7 @@ testPGPandJWEandPKCS7andPKCS11andKeyprovider() {
 		--recipient jwe:${PUBKEY2PEM} \
 		--recipient pkcs7:${CLIENTCERT} \
 		--recipient pkcs7:${CLIENT2CERT} \
+		--recipient-ca ${CACERT} \
 		--recipient pkcs11:${SOFTHSM_KEY} \
 		--recipient pkcs11:${SOFTHSM_KEY_PEM} \
 		${ALPINE} ${ALPINE_ENC}
@@ -1099,6 +1103,7 @@ testPGPandJWEandPKCS7andPKCS11andKeyprovider() {
 			--gpg-homedir ${GPGHOMEDIR} \
 			--gpg-version 2 \
 			--recipient ${recipient} \
+			--recipient-ca ${CACERT} \
 			--key <(echo "${GPGTESTKEY1}" | base64 -d) \
 			${ALPINE_ENC}
 		failExit $? "Adding ${recipient} failed"
@@ -1234,6 +1239,7 @@ testPGPandJWEandPKCS7andPKCS11andKeyprovider() {
 			--gpg-homedir ${GPGHOMEDIR} \
 			--gpg-version 2 \
 			--recipient ${recipient} \
+			--recipient-ca ${CACERT} \
 			--key ${PRIVKEYPEM} \
 			${ALPINE_ENC}
 		failExit $? "Adding ${recipient} failed"
@@ -1357,6 +1363,7 @@ testKeyprovider() {
 		--recipient jwe:${PUBKEY2PEM} \
 		--recipient pkcs7:${CLIENTCERT} \
 		--recipient pkcs7:${CLIENT2CERT} \
+		--recipient-ca ${CACERT} \
 		--recipient pkcs11:${SOFTHSM_KEY} \
 		--recipient pkcs11:${SOFTHSM_KEY_PEM} \
 		--recipient provider:testkeyprovider:foobar \